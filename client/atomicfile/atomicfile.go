@@ -0,0 +1,78 @@
+// Package atomicfile provides functions that write files atomically. A file written
+// using this package either has its previous content or the entire new content, even
+// if the process crashes or the power is lost in the middle of writing. This makes it
+// suitable for persisting Agent's state, e.g. in a PackagesStateProvider implementation.
+package atomicfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// tempSuffix is the suffix of the temporary files created by WriteFrom. It is
+// specific enough that RemoveTemporaryFiles does not remove unrelated files.
+const tempSuffix = ".atomicfile-"
+
+// WriteFile atomically replaces the content of the file at path by data.
+// If the file does not exist it is created with permissions perm.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return WriteFrom(path, bytes.NewReader(data), perm)
+}
+
+// WriteFrom atomically replaces the content of the file at path by the data read
+// from r until EOF. If reading from r fails the file is left unchanged.
+// If the file does not exist it is created with permissions perm.
+//
+// The data is written to a temporary file in the same directory, which is flushed
+// to stable storage and then renamed to path.
+func WriteFrom(path string, r io.Reader, perm os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+tempSuffix+"*")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file: %v", err)
+	}
+	tmpPath := f.Name()
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// Make sure the rename itself is persisted.
+	return syncDir(dir)
+}
+
+// RemoveTemporaryFiles removes temporary files left in dir by WriteFile and
+// WriteFrom calls that were interrupted by a crash.
+func RemoveTemporaryFiles(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, ".*"+tempSuffix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if err := os.Remove(match); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+
+	require.NoError(t, WriteFile(path, []byte("first"), 0600))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.EqualValues(t, "first", b)
+
+	require.NoError(t, WriteFile(path, []byte("second"), 0600))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.EqualValues(t, "second", b)
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.EqualValues(t, 0600, info.Mode().Perm())
+	}
+
+	// No temporary files must be left.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection lost")
+	}
+	return n, err
+}
+
+func TestWriteFromFailedRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "content")
+	require.NoError(t, WriteFile(path, []byte("original"), 0600))
+
+	err := WriteFrom(path, &failingReader{r: strings.NewReader("partial")}, 0600)
+	assert.Error(t, err)
+
+	// The original content must be intact and no temporary files must be left.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.EqualValues(t, "original", b)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestRemoveTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, WriteFile(filepath.Join(dir, "state"), []byte("state"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".state.atomicfile-123"), []byte("partial"), 0600))
+	// Files that are not created by WriteFrom must be kept.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".config.tmpl"), []byte("template"), 0600))
+
+	require.NoError(t, RemoveTemporaryFiles(dir))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.EqualValues(t, ".config.tmpl", entries[0].Name())
+	assert.EqualValues(t, "state", entries[1].Name())
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package atomicfile
+
+import "os"
+
+// syncDir flushes the directory entries of dir to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+	return d.Sync()
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package atomicfile
+
+// syncDir is a no-op on Windows, where directories cannot be opened for syncing
+// and renames are persisted by the file system journal.
+func syncDir(dir string) error {
+	return nil
+}
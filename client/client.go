@@ -3,10 +3,24 @@ package client
 import (
 	"context"
 
+	"github.com/open-telemetry/opamp-go/client/internal"
 	"github.com/open-telemetry/opamp-go/client/types"
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
+var (
+	// ErrAlreadyStarted is returned by Start if the client is started.
+	ErrAlreadyStarted = internal.ErrAlreadyStarted
+
+	// ErrNotStarted is returned by Stop and Restart if the client is not started,
+	// e.g. if it is already stopped.
+	ErrNotStarted = internal.ErrNotStarted
+
+	// ErrMemoryLimitExceeded is returned by UpdateEffectiveConfig if the config does
+	// not fit in the StartSettings.MemoryLimit.
+	ErrMemoryLimitExceeded = internal.ErrMemoryLimitExceeded
+)
+
 // OpAMPClient is an interface representing the client side of the OpAMP protocol.
 type OpAMPClient interface {
 
@@ -29,25 +43,56 @@ type OpAMPClient interface {
 	//  - OnError
 	//  - OnRemoteConfig
 	//
-	// Start should be called only once. It should not be called concurrently with
+	// Start returns ErrAlreadyStarted if the client is started. Once Stop() returned
+	// successfully the client may be started again, with new settings: the state
+	// set by the settings of the previous Start is reset, the AgentDescription and
+	// the health set via SetAgentDescription and SetHealth are kept and the sequence
+	// numbers of the messages continue. It should not be called concurrently with
 	// any other OpAMPClient methods.
 	Start(ctx context.Context, settings types.StartSettings) error
 
-	// Stop the client. May be called only after Start() returns successfully.
-	// May be called only once.
+	// Stop the client. Returns ErrNotStarted if the client is not started, e.g. if
+	// Stop was already called.
 	// After this call returns successfully it is guaranteed that no
 	// callbacks will be called. Stop() will cancel context of any in-fly
 	// callbacks, but will wait until such in-fly callbacks are returned before
 	// Stop returns, so make sure the callbacks don't block infinitely and react
-	// promptly to context cancellations.
-	// Once stopped OpAMPClient cannot be started again.
+	// promptly to context cancellations. If ctx is done before the client stopped
+	// Stop returns its error and may be called again to wait until it stopped.
+	// Once stopped OpAMPClient may be started again.
+	//
+	// The WebSocket client closes the connection gracefully, so that the Server can
+	// tell a shutdown of the Agent from a crash: it sends a message with
+	// AgentDisconnect and the close frame, and waits until the Server closes the
+	// connection, at most until ctx is done or for 5 seconds if ctx has no deadline.
 	Stop(ctx context.Context) error
 
+	// Restart stops the client and starts it with the settings. The instance uid and
+	// the remote config status of the client are kept unless they are set in the
+	// settings, and the sequence numbers of the messages continue, so the Server
+	// sees the same Agent reconnecting. Returns ErrNotStarted if the client is not
+	// started. It should not be called concurrently with any other OpAMPClient
+	// methods.
+	Restart(ctx context.Context, settings types.StartSettings) error
+
+	// SetServerURL reconnects the client to the Server at serverURL, e.g. when the
+	// address of the Server is managed by an external discovery system. The client is
+	// restarted with the settings of the last Start() and the new OpAMPServerURL, as
+	// by Restart, the ServerURLResolver is no longer used. Unlike the OpAMPConnectionSettings offered by the Server the new
+	// endpoint is not verified and there is no fallback to the previous one. Returns
+	// ErrNotStarted if the client is not started, or an error without stopping the
+	// client if serverURL is invalid or the transport does not support its scheme.
+	// It should not be called concurrently with any other OpAMPClient methods.
+	SetServerURL(ctx context.Context, serverURL string) error
+
 	// SetAgentDescription sets attributes of the Agent. The attributes will be included
 	// in the next status report sent to the Server. MUST be called before Start().
 	// May be also called after Start(), in which case the attributes will be included
 	// in the next outgoing status report. This is typically used by Agents which allow
-	// their AgentDescription to change dynamically while the OpAMPClient is started.
+	// their AgentDescription to change dynamically while the OpAMPClient is started,
+	// e.g. to report the non-identifying attributes discovered later, such as cloud
+	// metadata, without restarting the client. A status report is scheduled on every
+	// call.
 	// May be also called from OnMessage handler.
 	//
 	// nil values are not allowed and will return an error.
@@ -56,8 +101,20 @@ type OpAMPClient interface {
 	// AgentDescription returns the last value successfully set by SetAgentDescription().
 	AgentDescription() *protobufs.AgentDescription
 
+	// RequestInstanceUid asks the Server to assign a new instance uid to the Agent,
+	// e.g. when the Agent detects that it runs on a clone of another host (see
+	// HostFingerprint) and may share its instance uid with the original Agent. The
+	// request is sent with the next message, which is scheduled right away; if
+	// called before Start() it is sent with the first message. Once the Server
+	// assigns the instance uid the SaveInstanceUid callback is called and all
+	// following messages carry the new instance uid. Servers that do not support
+	// the request keep the current instance uid.
+	// May be also called from OnMessage handler.
+	RequestInstanceUid()
+
 	// SetHealth sets the health status of the Agent. The AgentHealth will be included
-	// in the next status report sent to the Server. MAY be called before or after Start().
+	// in the next status report sent to the Server, a status report is scheduled if
+	// the AgentHealth changed. MAY be called before or after Start().
 	// May be also called after Start().
 	// May be also called from OnMessage handler.
 	//
@@ -73,6 +130,12 @@ type OpAMPClient interface {
 	// LastRemoteConfigHash field must be non-nil.
 	// May be called anytime after Start(), including from OnMessage handler.
 	// nil values are not allowed and will return an error.
+	//
+	// The status is guaranteed to reach the Server: if the message carrying it
+	// cannot be sent, the status is sent with the next message or after
+	// reconnecting. To survive restarts of the Agent the changed status is also
+	// passed to the SaveRemoteConfigStatus callback, the Agent must persist it and
+	// pass it in StartSettings.RemoteConfigStatus when it starts again.
 	SetRemoteConfigStatus(status *protobufs.RemoteConfigStatus) error
 
 	// SetPackageStatuses sets the current PackageStatuses.
@@ -80,4 +143,49 @@ type OpAMPClient interface {
 	// May be called anytime after Start(), including from OnMessage handler.
 	// nil values are not allowed and will return an error.
 	SetPackageStatuses(statuses *protobufs.PackageStatuses) error
+
+	// CompressionStats returns the sizes of the messages sent to the Server since
+	// the client was created, before and after the compression (see
+	// StartSettings.EnableCompression). The sizes of the individual messages are
+	// also reported to StartSettings.Metrics if it implements types.SizeRecorder.
+	// May be called anytime.
+	CompressionStats() types.CompressionStats
+
+	// ConnectionState returns the current state of the connection to the Server:
+	// whether the client is connecting, connected or disconnected, the last
+	// connection error and since when it is connected. The transitions are also
+	// reported to the OnConnectionStateChange callback. May be called anytime.
+	ConnectionState() types.ConnectionState
+
+	// Flush sends the pending statuses to the Server and blocks until they are
+	// delivered or ctx is done, e.g. before the Agent restarts or exits. Waits
+	// while the client is not connected. Returns ctx.Err() if ctx is done first.
+	// May be called anytime after Start(), but not from the callbacks.
+	Flush(ctx context.Context) error
+}
+
+// restartClient implements OpAMPClient.Restart of the client with the common state.
+func restartClient(
+	ctx context.Context, client OpAMPClient, common *internal.ClientCommon, settings types.StartSettings,
+) error {
+	settings = common.RestartSettings(settings)
+	if err := client.Stop(ctx); err != nil {
+		return err
+	}
+	return client.Start(ctx, settings)
+}
+
+// setServerURL implements OpAMPClient.SetServerURL of the client with the common
+// state, the transport of the client supports the schemes.
+func setServerURL(
+	ctx context.Context, client OpAMPClient, common *internal.ClientCommon, serverURL string, schemes ...string,
+) error {
+	settings, err := common.ServerURLSettings(serverURL, schemes...)
+	if err != nil {
+		return err
+	}
+	if err := client.Stop(ctx); err != nil {
+		return err
+	}
+	return client.Start(ctx, settings)
 }
@@ -1,24 +1,47 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	ulid "github.com/oklog/ulid/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/client/outbox"
+	"github.com/open-telemetry/opamp-go/client/storage"
 	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
 	"github.com/open-telemetry/opamp-go/internal/testhelpers"
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
@@ -96,6 +119,12 @@ func prepareSettings(t *testing.T, settings *types.StartSettings, c OpAMPClient)
 		} else {
 			u.Scheme = "ws"
 		}
+	case *grpcClient:
+		if settings.TLSConfig != nil {
+			u.Scheme = "grpcs"
+		} else {
+			u.Scheme = "grpc"
+		}
 	}
 	settings.OpAMPServerURL = u.String()
 }
@@ -127,6 +156,81 @@ func TestConnectNoServer(t *testing.T) {
 	})
 }
 
+// recordingLogger records the logged messages.
+type recordingLogger struct {
+	mux      sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Errorf(format string, v ...interface{}) {
+	l.Debugf(format, v...)
+}
+
+func (l *recordingLogger) recorded() []string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return append([]string(nil), l.messages...)
+}
+
+func TestConnectionSecretsRedacted(t *testing.T) {
+	secrets := []string{"s3cr3t-t0ken", "pa55word", "query-t0ken"}
+	newHeader := func() http.Header {
+		return http.Header{"Authorization": {"Bearer s3cr3t-t0ken"}}
+	}
+
+	for _, newClient := range []func(logger *recordingLogger) OpAMPClient{
+		func(logger *recordingLogger) OpAMPClient { return NewHTTP(logger) },
+		func(logger *recordingLogger) OpAMPClient { return NewWebSocket(logger) },
+	} {
+		logger := &recordingLogger{}
+		client := newClient(logger)
+
+		var errs []string
+		var errsMux sync.Mutex
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://agent:pa55word@" + testhelpers.GetAvailableLocalAddress() + "/?access_token=query-t0ken",
+			Header:         newHeader(),
+			Callbacks: types.CallbacksStruct{
+				OnConnectFailedFunc: func(err error) {
+					errsMux.Lock()
+					defer errsMux.Unlock()
+					errs = append(errs, err.Error())
+				},
+			},
+		}
+		startClient(t, settings, client)
+		eventually(t, func() bool {
+			errsMux.Lock()
+			defer errsMux.Unlock()
+			return len(errs) > 0
+		})
+		assert.NoError(t, client.Stop(context.Background()))
+
+		// The URL cannot be parsed, its credentials must not leak via the parse error.
+		invalidClient := newClient(logger)
+		err := invalidClient.Start(context.Background(), types.StartSettings{
+			OpAMPServerURL: "ws://agent:pa55word@[::1",
+			Header:         newHeader(),
+		})
+		require.Error(t, err)
+
+		errsMux.Lock()
+		for _, secret := range secrets {
+			assert.NotContains(t, err.Error(), secret)
+			for _, msg := range append(errs, logger.recorded()...) {
+				assert.NotContains(t, msg, secret)
+			}
+		}
+		errsMux.Unlock()
+	}
+}
+
 func TestInvalidInstanceId(t *testing.T) {
 	testClients(t, func(t *testing.T, client OpAMPClient) {
 		settings := createNoServerSettings()
@@ -164,7 +268,7 @@ func TestStartStarted(t *testing.T) {
 
 		// Try to start again.
 		err := client.Start(context.Background(), settings)
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrAlreadyStarted)
 
 		err = client.Stop(context.Background())
 		assert.NoError(t, err)
@@ -174,7 +278,274 @@ func TestStartStarted(t *testing.T) {
 func TestStopWithoutStart(t *testing.T) {
 	testClients(t, func(t *testing.T, client OpAMPClient) {
 		err := client.Stop(context.Background())
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrNotStarted)
+	})
+}
+
+func TestStopStopped(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		startClient(t, createNoServerSettings(), client)
+		require.NoError(t, client.Stop(context.Background()))
+
+		err := client.Stop(context.Background())
+		assert.ErrorIs(t, err, ErrNotStarted)
+		err = client.Restart(context.Background(), createNoServerSettings())
+		assert.ErrorIs(t, err, ErrNotStarted)
+	})
+}
+
+func TestStartStopped(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var connected int64
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Callbacks: types.CallbacksStruct{
+				OnConnectFunc: func(info types.ConnectionInfo) {
+					atomic.AddInt64(&connected, 1)
+				},
+			},
+		}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.Start(context.Background(), settings))
+		eventually(t, func() bool { return atomic.LoadInt64(&connected) == 1 })
+		require.NoError(t, client.Stop(context.Background()))
+
+		// The stopped client connects again when it is started.
+		require.NoError(t, client.Start(context.Background(), settings))
+		eventually(t, func() bool { return atomic.LoadInt64(&connected) == 2 })
+
+		srv.Close()
+		require.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestStartStoppedKeepsState(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var messagesMux sync.Mutex
+		var messages []*protobufs.AgentToServer
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			messagesMux.Lock()
+			defer messagesMux.Unlock()
+			messages = append(messages, msg)
+			return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+		}
+		lastReceived := func() *protobufs.AgentToServer {
+			messagesMux.Lock()
+			defer messagesMux.Unlock()
+			if len(messages) == 0 {
+				return nil
+			}
+			return messages[len(messages)-1]
+		}
+
+		settings := types.StartSettings{OpAMPServerURL: "ws://" + srv.Endpoint}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.Start(context.Background(), settings))
+		health := &protobufs.AgentHealth{Healthy: true, StartTimeUnixNano: 1}
+		require.NoError(t, client.SetHealth(health))
+		eventually(t, func() bool { return proto.Equal(health, lastReceived().GetHealth()) })
+		require.NoError(t, client.Stop(context.Background()))
+
+		// The client started again reports the state it had when it was stopped.
+		messagesMux.Lock()
+		messages = nil
+		messagesMux.Unlock()
+		require.NoError(t, client.Start(context.Background(), settings))
+		eventually(t, func() bool { return lastReceived() != nil })
+		msg := lastReceived()
+		assert.True(t, proto.Equal(health, msg.Health))
+		assert.True(t, proto.Equal(createAgentDescr(), msg.AgentDescription))
+
+		srv.Close()
+		require.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestRestart(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var messagesMux sync.Mutex
+		var messages []*protobufs.AgentToServer
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			messagesMux.Lock()
+			defer messagesMux.Unlock()
+			messages = append(messages, msg)
+			return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+		}
+		received := func() []*protobufs.AgentToServer {
+			messagesMux.Lock()
+			defer messagesMux.Unlock()
+			return append([]*protobufs.AgentToServer(nil), messages...)
+		}
+
+		settings := types.StartSettings{OpAMPServerURL: "ws://" + srv.Endpoint}
+		prepareClient(t, &settings, client)
+		instanceUid := settings.InstanceUid
+		require.NoError(t, client.Start(context.Background(), settings))
+		eventually(t, func() bool { return len(received()) == 1 })
+
+		// Restart without an instance uid, with a new header.
+		restartSettings := types.StartSettings{
+			OpAMPServerURL: settings.OpAMPServerURL,
+			Header:         http.Header{"X-Restarted": []string{"true"}},
+		}
+		var header atomic.Value
+		srv.OnConnect = func(r *http.Request) {
+			header.Store(r.Header.Get("X-Restarted"))
+		}
+		require.NoError(t, client.Restart(context.Background(), restartSettings))
+
+		// The WebSocket client sends AgentDisconnect when it stops.
+		disconnects := 0
+		if _, ok := client.(*wsClient); ok {
+			disconnects = 1
+		}
+		eventually(t, func() bool { return len(received()) == 2+disconnects })
+		if disconnects > 0 {
+			assert.NotNil(t, received()[1].AgentDisconnect)
+		}
+
+		// The Server sees the same Agent with the continued sequence numbers.
+		msg := received()[1+disconnects]
+		assert.EqualValues(t, instanceUid, msg.InstanceUid)
+		assert.EqualValues(t, 1+disconnects, msg.SequenceNum)
+		assert.Nil(t, msg.AgentDisconnect)
+		assert.True(t, proto.Equal(createAgentDescr(), msg.AgentDescription))
+		assert.EqualValues(t, "true", header.Load())
+
+		srv.Close()
+		require.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestSetServerURL(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv1 := internal.StartMockServer(t)
+		var srv1Messages, srv1Disconnects int64
+		srv1.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if msg.AgentDisconnect != nil {
+				atomic.AddInt64(&srv1Disconnects, 1)
+				return nil
+			}
+			atomic.AddInt64(&srv1Messages, 1)
+			return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+		}
+		srv2 := internal.StartMockServer(t)
+		var rcvMsg atomic.Value
+		srv2.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			rcvMsg.Store(msg)
+			return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+		}
+
+		settings := types.StartSettings{OpAMPServerURL: "ws://" + srv1.Endpoint}
+		prepareClient(t, &settings, client)
+		assert.ErrorIs(t, client.SetServerURL(context.Background(), settings.OpAMPServerURL), ErrNotStarted)
+
+		require.NoError(t, client.Start(context.Background(), settings))
+		eventually(t, func() bool { return atomic.LoadInt64(&srv1Messages) == 1 })
+
+		// The scheme of the transport must be used.
+		err := client.SetServerURL(context.Background(), "ftp://"+srv2.Endpoint)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `unsupported OpAMP Server URL scheme "ftp"`)
+
+		u, err := url.Parse(settings.OpAMPServerURL)
+		require.NoError(t, err)
+		u.Host = srv2.Endpoint
+		require.NoError(t, client.SetServerURL(context.Background(), u.String()))
+
+		// The new Server sees the same Agent with the continued sequence numbers,
+		// the WebSocket client sent AgentDisconnect to the previous one.
+		eventually(t, func() bool { return rcvMsg.Load() != nil })
+		msg := rcvMsg.Load().(*protobufs.AgentToServer)
+		assert.EqualValues(t, settings.InstanceUid, msg.InstanceUid)
+		disconnects := atomic.LoadInt64(&srv1Disconnects)
+		if _, ok := client.(*wsClient); ok {
+			assert.EqualValues(t, 1, disconnects)
+		}
+		assert.EqualValues(t, 1+disconnects, msg.SequenceNum)
+
+		srv1.Close()
+		srv2.Close()
+		require.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+// startRedirectServer starts a Server that permanently redirects the requests to the
+// target Server, counting them.
+func startRedirectServer(target *internal.MockServer, redirected *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(redirected, 1)
+		http.Redirect(w, r, "http://"+target.Endpoint+r.URL.Path, http.StatusPermanentRedirect)
+	}))
+}
+
+func TestRedirectNotAllowed(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var redirected int64
+		redirectSrv := startRedirectServer(srv, &redirected)
+		defer redirectSrv.Close()
+
+		var connectErr atomic.Value
+		settings := types.StartSettings{
+			OpAMPServerURL: redirectSrv.URL + "/v1/opamp",
+			Callbacks: types.CallbacksStruct{
+				OnConnectFailedFunc: func(err error) {
+					connectErr.Store(err)
+				},
+			},
+		}
+		startClient(t, settings, client)
+
+		// The default policy does not follow the redirects to another origin.
+		eventually(t, func() bool { return connectErr.Load() != nil })
+		assert.Contains(t, connectErr.Load().(error).Error(), "redirect to another origin")
+
+		srv.Close()
+		require.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestRedirectFollowed(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var received int64
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			atomic.AddInt64(&received, 1)
+			return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+		}
+		var redirected int64
+		redirectSrv := startRedirectServer(srv, &redirected)
+		defer redirectSrv.Close()
+
+		var endpoint atomic.Value
+		settings := types.StartSettings{
+			OpAMPServerURL: redirectSrv.URL + "/v1/opamp",
+			RedirectPolicy: types.FollowRedirects,
+			Callbacks: types.CallbacksStruct{
+				OnConnectFunc: func(info types.ConnectionInfo) {
+					endpoint.Store(info.Endpoint)
+				},
+			},
+		}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		eventually(t, func() bool { return atomic.LoadInt64(&received) == 1 })
+		u, err := url.Parse(endpoint.Load().(string))
+		require.NoError(t, err)
+		assert.Equal(t, srv.Endpoint, u.Host)
+
+		// The client keeps using the URL it was permanently redirected to.
+		require.NoError(t, client.SetAgentDescription(createAgentDescr()))
+		eventually(t, func() bool { return atomic.LoadInt64(&received) == 2 })
+		assert.EqualValues(t, 1, atomic.LoadInt64(&redirected))
+
+		srv.Close()
+		require.NoError(t, client.Stop(context.Background()))
 	})
 }
 
@@ -220,7 +591,7 @@ func TestConnectWithServer(t *testing.T) {
 		var connected int64
 		settings := types.StartSettings{
 			Callbacks: types.CallbacksStruct{
-				OnConnectFunc: func() {
+				OnConnectFunc: func(info types.ConnectionInfo) {
 					atomic.StoreInt64(&connected, 1)
 				},
 			},
@@ -240,6 +611,142 @@ func TestConnectWithServer(t *testing.T) {
 	})
 }
 
+func TestConnectionState(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		assert.Equal(t, types.ConnectionDisconnected, client.ConnectionState().Status)
+
+		srv := internal.StartMockServer(t)
+
+		var mux sync.Mutex
+		var transitions []types.ConnectionStatus
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Callbacks: types.CallbacksStruct{
+				OnConnectionStateChangeFunc: func(state types.ConnectionState) {
+					mux.Lock()
+					defer mux.Unlock()
+					transitions = append(transitions, state.Status)
+				},
+			},
+		}
+		startClient(t, settings, client)
+
+		eventually(t, func() bool { return client.ConnectionState().Status == types.ConnectionConnected })
+		state := client.ConnectionState()
+		assert.False(t, state.ConnectedSince.IsZero())
+		assert.Contains(t, state.Info.Endpoint, srv.Endpoint)
+		assert.NoError(t, state.LastError)
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+
+		state = client.ConnectionState()
+		assert.Equal(t, types.ConnectionDisconnected, state.Status)
+		assert.True(t, state.ConnectedSince.IsZero())
+
+		mux.Lock()
+		defer mux.Unlock()
+		require.GreaterOrEqual(t, len(transitions), 3)
+		assert.Equal(t, types.ConnectionConnecting, transitions[0])
+		assert.Equal(t, types.ConnectionConnected, transitions[1])
+		assert.Equal(t, types.ConnectionDisconnected, transitions[len(transitions)-1])
+	})
+}
+
+func TestConnectionStateConnectFailed(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		startClient(t, createNoServerSettings(), client)
+
+		eventually(t, func() bool { return client.ConnectionState().LastError != nil })
+		assert.Equal(t, types.ConnectionConnecting, client.ConnectionState().Status)
+
+		assert.NoError(t, client.Stop(context.Background()))
+		state := client.ConnectionState()
+		assert.Equal(t, types.ConnectionDisconnected, state.Status)
+		assert.Error(t, state.LastError)
+	})
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestWireCapture(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+					Hash: []byte{1},
+					Opamp: &protobufs.OpAMPConnectionSettings{
+						Headers: &protobufs.Headers{
+							Headers: []*protobufs.Header{{Key: "Authorization", Value: "offered-secret"}},
+						},
+					},
+				},
+			}
+		}
+
+		var capture lockedBuffer
+		var received int64
+		settings := types.StartSettings{
+			Callbacks: types.CallbacksStruct{
+				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
+					atomic.StoreInt64(&received, 1)
+				},
+				OnOpampConnectionSettingsFunc: func(
+					ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
+				) error {
+					atomic.StoreInt64(&received, 1)
+					return nil
+				},
+			},
+			WireCapture: &capture,
+		}
+		settings.OpAMPServerURL = "ws://" + srv.Endpoint
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		eventually(t, func() bool { return atomic.LoadInt64(&received) != 0 })
+		assert.NoError(t, client.Stop(context.Background()))
+		srv.Close()
+
+		transport := sharedinternal.WirePlainHTTP
+		if _, ok := client.(*wsClient); ok {
+			transport = sharedinternal.WireWebSocket
+		}
+		r := bytes.NewReader(capture.Bytes())
+		sent, err := sharedinternal.ReadWireRecord(r)
+		require.NoError(t, err)
+		assert.EqualValues(t, sharedinternal.WireAgentToServer, sent.Direction)
+		assert.EqualValues(t, transport, sent.Transport)
+		var first protobufs.AgentToServer
+		require.NoError(t, sharedinternal.DecodeWSMessage(sent.Frame, &first))
+		assert.EqualValues(t, settings.InstanceUid, first.InstanceUid)
+
+		response, err := sharedinternal.ReadWireRecord(r)
+		require.NoError(t, err)
+		assert.EqualValues(t, sharedinternal.WireServerToAgent, response.Direction)
+		assert.EqualValues(t, sharedinternal.WireRedacted, response.Flags)
+		assert.NotContains(t, string(response.Frame), "offered-secret")
+	})
+}
+
 func TestConnectWithServer503(t *testing.T) {
 	testClients(t, func(t *testing.T, client OpAMPClient) {
 		// Start a server.
@@ -258,7 +765,7 @@ func TestConnectWithServer503(t *testing.T) {
 		var connectErr atomic.Value
 		settings := types.StartSettings{
 			Callbacks: types.CallbacksStruct{
-				OnConnectFunc: func() {
+				OnConnectFunc: func(info types.ConnectionInfo) {
 					atomic.StoreInt64(&clientConnected, 1)
 					assert.Fail(t, "Client should not be able to connect")
 				},
@@ -315,51 +822,355 @@ func TestConnectWithHeader(t *testing.T) {
 	})
 }
 
-func TestConnectWithTLS(t *testing.T) {
+func TestConnectWithHeaderProvider(t *testing.T) {
 	testClients(t, func(t *testing.T, client OpAMPClient) {
-		// Start a server.
-		srv := internal.StartTLSMockServer(t)
-		var conn atomic.Value
+		// Record the tokens the Server receives, close the first WebSocket connection
+		// to make the client reconnect.
+		srv := internal.StartMockServer(t)
+		var tokensMux sync.Mutex
+		var tokens []string
 		srv.OnConnect = func(r *http.Request) {
-			conn.Store(true)
+			assert.EqualValues(t, "custom-agent/1.0", r.Header.Get("User-Agent"))
+			tokensMux.Lock()
+			defer tokensMux.Unlock()
+			tokens = append(tokens, r.Header.Get("Authorization"))
+		}
+		var wsConns int64
+		srv.OnWSConnect = func(conn *websocket.Conn) {
+			if atomic.AddInt64(&wsConns, 1) == 1 {
+				_ = conn.Close()
+			}
+		}
+		seenTokens := func() []string {
+			tokensMux.Lock()
+			defer tokensMux.Unlock()
+			return append([]string(nil), tokens...)
 		}
 
-		certs := rootCAs(t, srv.GetHTTPTestServer())
-
-		// Start a client.
+		// The first call fails, the following calls mint new tokens.
+		var calls int64
+		var connectFailed atomic.Value
 		settings := types.StartSettings{
-			OpAMPServerURL: "wss://" + srv.Endpoint,
-			TLSConfig: &tls.Config{
-				RootCAs: certs,
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Header:         http.Header{"User-Agent": {"custom-agent/1.0"}, "Authorization": {"Bearer static"}},
+			HeaderProvider: func(ctx context.Context) (http.Header, error) {
+				call := atomic.AddInt64(&calls, 1)
+				if call == 1 {
+					return nil, errors.New("token service unavailable")
+				}
+				return http.Header{"Authorization": {fmt.Sprintf("Bearer token-%d", call)}}, nil
+			},
+			RetryPolicy: types.RetryPolicy{InitialInterval: 10 * time.Millisecond},
+			Callbacks: types.CallbacksStruct{
+				OnConnectFailedFunc: func(err error) {
+					connectFailed.Store(err)
+				},
 			},
 		}
-
 		startClient(t, settings, client)
 
-		// Wait for connection to be established.
-		eventually(t, func() bool { return conn.Load() != nil })
+		eventually(t, func() bool { return len(seenTokens()) >= 1 })
+		require.NotNil(t, connectFailed.Load())
+		assert.Contains(t, connectFailed.Load().(error).Error(), "token service unavailable")
+		assert.Equal(t, "Bearer token-2", seenTokens()[0])
+
+		if _, ok := client.(*httpClient); ok {
+			// Every request gets a new token.
+			require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
+		}
+		eventually(t, func() bool { return len(seenTokens()) >= 2 })
+		assert.Equal(t, "Bearer token-3", seenTokens()[1])
 
-		// Shutdown the Server and the client.
 		srv.Close()
 		_ = client.Stop(context.Background())
 	})
 }
 
-func rootCAs(t *testing.T, s *httptest.Server) *x509.CertPool {
-	certs := x509.NewCertPool()
-	for _, c := range s.TLS.Certificates {
-		roots, err := x509.ParseCertificates(c.Certificate[len(c.Certificate)-1])
-		if err != nil {
-			t.Fatalf("error parsing server's root cert: %v", err)
-		}
-		for _, root := range roots {
-			certs.AddCert(root)
-		}
-	}
-	return certs
+// tokenSourceFunc is an adapter to use a func as an oauth2.TokenSource.
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
 }
 
-func createRemoteConfig() *protobufs.AgentRemoteConfig {
+func TestConnectWithTokenSource(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var tokensMux sync.Mutex
+		var tokens []string
+		srv.OnConnect = func(r *http.Request) {
+			tokensMux.Lock()
+			defer tokensMux.Unlock()
+			tokens = append(tokens, r.Header.Get("Authorization"))
+		}
+		seenTokens := func() []string {
+			tokensMux.Lock()
+			defer tokensMux.Unlock()
+			return append([]string(nil), tokens...)
+		}
+
+		// The tokens are refreshed shortly after they are issued.
+		var issued int64
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Header:         http.Header{"Authorization": {"Bearer static"}},
+			TokenSource: tokenSourceFunc(func() (*oauth2.Token, error) {
+				return &oauth2.Token{
+					AccessToken: fmt.Sprintf("token-%d", atomic.AddInt64(&issued, 1)),
+					TokenType:   "bearer",
+					Expiry:      time.Now().Add(10*time.Second + 200*time.Millisecond),
+				}, nil
+			}),
+		}
+		startClient(t, settings, client)
+
+		eventually(t, func() bool { return len(seenTokens()) >= 1 })
+		assert.Equal(t, "Bearer token-1", seenTokens()[0])
+
+		if _, ok := client.(*httpClient); ok {
+			// The next request gets the new token.
+			time.Sleep(300 * time.Millisecond)
+			require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
+		}
+		// The WebSocket client reconnects when the token expires.
+		eventually(t, func() bool { return len(seenTokens()) >= 2 })
+		assert.Equal(t, "Bearer token-2", seenTokens()[1])
+
+		srv.Close()
+		_ = client.Stop(context.Background())
+	})
+}
+
+// startTestProxy starts an HTTP proxy that tunnels CONNECT requests, as used for
+// WebSocket connections, and forwards the plain HTTP requests. Counts the proxied
+// requests.
+func startTestProxy(t *testing.T, proxied *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(proxied, 1)
+		if r.Method != http.MethodConnect {
+			r.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			for name, values := range resp.Header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+			return
+		}
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(target, conn)
+			_ = target.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(conn, target)
+			_ = conn.Close()
+		}()
+	}))
+}
+
+func TestConnectThroughProxy(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// Start a server.
+		srv := internal.StartMockServer(t)
+		var conn atomic.Value
+		srv.OnConnect = func(r *http.Request) {
+			conn.Store(true)
+		}
+
+		var proxied int64
+		proxy := startTestProxy(t, &proxied)
+		defer proxy.Close()
+
+		// Start a client.
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			ProxyURL:       proxy.URL,
+		}
+		startClient(t, settings, client)
+
+		// Wait for connection to be established through the proxy.
+		eventually(t, func() bool { return conn.Load() != nil })
+		assert.Greater(t, atomic.LoadInt64(&proxied), int64(0))
+
+		// Shutdown the Server and the client.
+		srv.Close()
+		_ = client.Stop(context.Background())
+	})
+}
+
+// roundTripperFunc implements http.RoundTripper using a func.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestConnectWithCustomTransport(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// Start a server.
+		srv := internal.StartMockServer(t)
+		var conn atomic.Value
+		srv.OnConnect = func(r *http.Request) {
+			conn.Store(true)
+		}
+
+		// The HTTP client sends the requests using the round tripper and the
+		// WebSocket client connects using the dialer.
+		var used int64
+		roundTripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt64(&used, 1)
+			return http.DefaultTransport.RoundTrip(req)
+		})
+		dialer := *websocket.DefaultDialer
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt64(&used, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+
+		// Start a client.
+		settings := types.StartSettings{
+			OpAMPServerURL:   "ws://" + srv.Endpoint,
+			HTTPRoundTripper: roundTripper,
+			WebSocketDialer:  &dialer,
+		}
+		startClient(t, settings, client)
+
+		eventually(t, func() bool { return conn.Load() != nil })
+		assert.Greater(t, atomic.LoadInt64(&used), int64(0))
+
+		// Shutdown the Server and the client.
+		srv.Close()
+		_ = client.Stop(context.Background())
+	})
+}
+
+func TestConnectUnixSocket(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartUnixMockServer(t, filepath.Join(t.TempDir(), "opamp.sock"))
+		var path atomic.Value
+		srv.OnConnect = func(r *http.Request) {
+			path.Store(r.URL.Path)
+		}
+
+		var conn atomic.Value
+		settings := types.StartSettings{
+			OpAMPServerURL: "opamp+unix://" + srv.Endpoint,
+			Callbacks: types.CallbacksStruct{
+				OnConnectFunc: func(info types.ConnectionInfo) {
+					conn.Store(info)
+				},
+			},
+		}
+		// Not startClient, which replaces the scheme of the URL.
+		settings.InstanceUid = "01ARZ3NDEKTSV4RRFFQ69G5FAV"
+		require.NoError(t, client.SetAgentDescription(createAgentDescr()))
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		eventually(t, func() bool { return conn.Load() != nil })
+		assert.EqualValues(t, "/v1/opamp", path.Load())
+
+		srv.Close()
+		_ = client.Stop(context.Background())
+	})
+}
+
+func TestStartWithInvalidProxy(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		settings := createNoServerSettings()
+		settings.ProxyURL = "ftp://proxy.example.com"
+		prepareClient(t, &settings, client)
+		assert.Error(t, client.Start(context.Background(), settings))
+	})
+}
+
+func TestStartWithTLSConfigAndPlainURL(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		settings := createNoServerSettings()
+		prepareClient(t, &settings, client)
+		// Set after prepareClient, which would switch to the secure scheme.
+		settings.TLSConfig = &tls.Config{}
+		err := client.Start(context.Background(), settings)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "plain")
+	})
+}
+
+func TestConnectWithTLS(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// Start a server.
+		srv := internal.StartTLSMockServer(t)
+		var conn atomic.Value
+		srv.OnConnect = func(r *http.Request) {
+			conn.Store(true)
+		}
+
+		certs := rootCAs(t, srv.GetHTTPTestServer())
+
+		// Start a client.
+		var connInfo atomic.Value
+		settings := types.StartSettings{
+			OpAMPServerURL: "wss://" + srv.Endpoint,
+			TLSConfig: &tls.Config{
+				RootCAs: certs,
+			},
+			Callbacks: types.CallbacksStruct{
+				OnConnectFunc: func(info types.ConnectionInfo) {
+					connInfo.Store(info)
+				},
+			},
+		}
+
+		startClient(t, settings, client)
+
+		// Wait for connection to be established.
+		eventually(t, func() bool { return conn.Load() != nil })
+		eventually(t, func() bool { return connInfo.Load() != nil })
+
+		// Verify that the TLS parameters of the connection are reported.
+		info := connInfo.Load().(types.ConnectionInfo)
+		assert.NotZero(t, info.TLSVersion)
+		fingerprint := sha256.Sum256(srv.GetHTTPTestServer().Certificate().Raw)
+		assert.EqualValues(t, fingerprint[:], info.ServerCertificateFingerprint)
+		assert.Contains(t, info.Endpoint, srv.Endpoint)
+
+		// Shutdown the Server and the client.
+		srv.Close()
+		_ = client.Stop(context.Background())
+	})
+}
+
+func rootCAs(t *testing.T, s *httptest.Server) *x509.CertPool {
+	certs := x509.NewCertPool()
+	for _, c := range s.TLS.Certificates {
+		roots, err := x509.ParseCertificates(c.Certificate[len(c.Certificate)-1])
+		if err != nil {
+			t.Fatalf("error parsing server's root cert: %v", err)
+		}
+		for _, root := range roots {
+			certs.AddCert(root)
+		}
+	}
+	return certs
+}
+
+func createRemoteConfig() *protobufs.AgentRemoteConfig {
 	return &protobufs.AgentRemoteConfig{
 		Config: &protobufs.AgentConfigMap{
 			ConfigMap: map[string]*protobufs.AgentConfigFile{},
@@ -376,6 +1187,10 @@ func TestFirstStatusReport(t *testing.T) {
 		// Start a Server.
 		srv := internal.StartMockServer(t)
 		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if msg.AgentDisconnect != nil {
+				// Sent by the WebSocket client when it stops.
+				return nil
+			}
 			assert.EqualValues(t, 0, msg.SequenceNum)
 			return &protobufs.ServerToAgent{
 				InstanceUid:  msg.InstanceUid,
@@ -387,7 +1202,7 @@ func TestFirstStatusReport(t *testing.T) {
 		var connected, remoteConfigReceived int64
 		settings := types.StartSettings{
 			Callbacks: types.CallbacksStruct{
-				OnConnectFunc: func() {
+				OnConnectFunc: func(info types.ConnectionInfo) {
 					atomic.AddInt64(&connected, 1)
 				},
 				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
@@ -417,6 +1232,130 @@ func TestFirstStatusReport(t *testing.T) {
 	})
 }
 
+func TestServerErrorThrottlesClient(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		const retryAfter = 500 * time.Millisecond
+
+		// Start a Server that reports that it is unavailable in response to the first
+		// message and records when the next one arrives.
+		var msgCount int64
+		var errorSentAt, nextReceivedAt atomic.Value
+		srv := internal.StartMockServer(t)
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if atomic.AddInt64(&msgCount, 1) > 1 {
+				nextReceivedAt.Store(time.Now())
+				return nil
+			}
+			errorSentAt.Store(time.Now())
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				ErrorResponse: &protobufs.ServerErrorResponse{
+					Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable,
+					ErrorMessage: "overloaded",
+					Details: &protobufs.ServerErrorResponse_RetryInfo{
+						RetryInfo: &protobufs.RetryInfo{RetryAfterNanoseconds: uint64(retryAfter)},
+					},
+				},
+			}
+		}
+
+		// Start a client.
+		var serverErr atomic.Value
+		settings := types.StartSettings{
+			Callbacks: types.CallbacksStruct{
+				OnErrorFunc: func(err *types.ServerError) {
+					serverErr.Store(err)
+				},
+			},
+		}
+		settings.OpAMPServerURL = "ws://" + srv.Endpoint
+		startClient(t, settings, client)
+
+		// Wait for the error to be reported.
+		eventually(t, func() bool { return serverErr.Load() != nil })
+		assert.EqualValues(t, &types.ServerError{
+			Type:       protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable,
+			Message:    "overloaded",
+			RetryAfter: retryAfter,
+			Throttle:   retryAfter,
+		}, serverErr.Load())
+
+		// The next message is delayed until the suggested retry interval elapses.
+		assert.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
+		eventually(t, func() bool { return nextReceivedAt.Load() != nil })
+		assert.GreaterOrEqual(t,
+			nextReceivedAt.Load().(time.Time).Sub(errorSentAt.Load().(time.Time)),
+			retryAfter-50*time.Millisecond,
+		)
+
+		// Shutdown the Server.
+		srv.Close()
+
+		// Shutdown the client.
+		err := client.Stop(context.Background())
+		assert.NoError(t, err)
+	})
+}
+
+func TestFlagsHandled(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		const unknownFlag = protobufs.ServerToAgentFlags(8)
+		flags := protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState | unknownFlag
+
+		// Start a Server that asks for the full state in response to the first message.
+		var msgCount int64
+		var fullStateReceived int64
+		srv := internal.StartMockServer(t)
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if atomic.AddInt64(&msgCount, 1) == 1 {
+				return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid, Flags: uint64(flags)}
+			}
+			if msg.AgentDescription != nil {
+				atomic.StoreInt64(&fullStateReceived, 1)
+			}
+			return nil
+		}
+
+		// Start a client.
+		effectiveConfigErr := errors.New("effective config unavailable")
+		var effectiveConfigCalls int64
+		var handled atomic.Value
+		settings := types.StartSettings{
+			Callbacks: types.CallbacksStruct{
+				GetEffectiveConfigFunc: func(ctx context.Context) (*protobufs.EffectiveConfig, error) {
+					// Succeed on Start, fail when the full state is requested.
+					if atomic.AddInt64(&effectiveConfigCalls, 1) == 1 {
+						return &protobufs.EffectiveConfig{}, nil
+					}
+					return nil, effectiveConfigErr
+				},
+				OnFlagsHandledFunc: func(handling types.FlagsHandling) {
+					handled.Store(handling)
+				},
+			},
+		}
+		settings.OpAMPServerURL = "ws://" + srv.Endpoint
+		startClient(t, settings, client)
+
+		// Wait for the flags to be handled and the full state to be reported.
+		eventually(t, func() bool { return handled.Load() != nil })
+		assert.EqualValues(t, types.FlagsHandling{
+			Flags:              flags,
+			FullStateScheduled: true,
+			EffectiveConfigErr: effectiveConfigErr,
+			IgnoredFlags:       unknownFlag,
+		}, handled.Load())
+		eventually(t, func() bool { return atomic.LoadInt64(&fullStateReceived) != 0 })
+
+		// Shutdown the Server.
+		srv.Close()
+
+		// Shutdown the client.
+		err := client.Stop(context.Background())
+		assert.NoError(t, err)
+	})
+}
+
 func TestIncludesDetailsOnReconnect(t *testing.T) {
 	srv := internal.StartMockServer(t)
 
@@ -440,7 +1379,7 @@ func TestIncludesDetailsOnReconnect(t *testing.T) {
 	var connected int64
 	settings := types.StartSettings{
 		Callbacks: types.CallbacksStruct{
-			OnConnectFunc: func() {
+			OnConnectFunc: func(info types.ConnectionInfo) {
 				atomic.AddInt64(&connected, 1)
 			},
 		},
@@ -571,172 +1510,1427 @@ func TestSetAgentDescription(t *testing.T) {
 			},
 		)
 
-		// Now change again.
-		clientAgentDescr.NonIdentifyingAttributes = []*protobufs.KeyValue{
-			{
-				Key:   "os.name",
-				Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: "linux"}},
+		// Now change again.
+		clientAgentDescr.NonIdentifyingAttributes = []*protobufs.KeyValue{
+			{
+				Key:   "os.name",
+				Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: "linux"}},
+			},
+		}
+		assert.NoError(t, client.SetAgentDescription(clientAgentDescr))
+
+		// Verify change is delivered.
+		eventually(
+			t,
+			func() bool {
+				agentDescr := rcvAgentDescr.Load().(*protobufs.AgentDescription)
+				if agentDescr == nil {
+					return false
+				}
+				return proto.Equal(clientAgentDescr, agentDescr)
+			},
+		)
+
+		// Shutdown the Server.
+		srv.Close()
+
+		// Shutdown the client.
+		err := client.Stop(context.Background())
+		assert.NoError(t, err)
+	})
+}
+
+func TestAgentIdentification(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// Start a server.
+		srv := internal.StartMockServer(t)
+		newInstanceUid := ulid.MustNew(
+			ulid.Timestamp(time.Now()), ulid.Monotonic(rand.New(rand.NewSource(0)), 0),
+		)
+		var rcvAgentInstanceUid atomic.Value
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			rcvAgentInstanceUid.Store(msg.InstanceUid)
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				AgentIdentification: &protobufs.AgentIdentification{
+					NewInstanceUid: newInstanceUid.String(),
+				},
+			}
+		}
+
+		// Start a client.
+		settings := types.StartSettings{}
+		settings.OpAMPServerURL = "ws://" + srv.Endpoint
+		prepareClient(t, &settings, client)
+
+		oldInstanceUid := settings.InstanceUid
+		assert.NoError(t, client.Start(context.Background(), settings))
+
+		// First, Server gets the original instanceId
+		eventually(
+			t,
+			func() bool {
+				instanceUid, ok := rcvAgentInstanceUid.Load().(string)
+				if !ok {
+					return false
+				}
+				return instanceUid == oldInstanceUid
+			},
+		)
+
+		// Send a dummy message
+		_ = client.SetAgentDescription(createAgentDescr())
+
+		// When it was sent, the new instance uid should have been used, which should
+		// have been observed by the Server
+		eventually(
+			t,
+			func() bool {
+				instanceUid, ok := rcvAgentInstanceUid.Load().(string)
+				if !ok {
+					return false
+				}
+				return instanceUid == newInstanceUid.String()
+			},
+		)
+
+		// Shutdown the Server.
+		srv.Close()
+
+		// Shutdown the client.
+		err := client.Stop(context.Background())
+		assert.NoError(t, err)
+	})
+}
+
+func TestCoalescingWindow(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var mux sync.Mutex
+		var received []*protobufs.AgentToServer
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			mux.Lock()
+			received = append(received, msg)
+			mux.Unlock()
+			return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+		}
+		receivedCount := func() int {
+			mux.Lock()
+			defer mux.Unlock()
+			return len(received)
+		}
+
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig,
+			CoalescingWindow: 200 * time.Millisecond,
+		}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: false}))
+		require.NoError(t, client.Start(context.Background(), settings))
+		eventually(t, func() bool { return receivedCount() == 1 })
+
+		// The updates made in quick succession are sent in one message.
+		require.NoError(t, client.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: []byte{1, 2, 3},
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		}))
+		require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
+		require.NoError(t, client.SetAgentDescription(createAgentDescr()))
+
+		eventually(t, func() bool { return receivedCount() == 2 })
+		mux.Lock()
+		msg := received[1]
+		mux.Unlock()
+		assert.NotNil(t, msg.RemoteConfigStatus)
+		assert.True(t, msg.Health.Healthy)
+		assert.NotNil(t, msg.AgentDescription)
+
+		// No more messages follow.
+		time.Sleep(2 * settings.CoalescingWindow)
+		assert.EqualValues(t, 2, receivedCount())
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestOutboxReplaysUndeliveredStatuses(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		path := filepath.Join(t.TempDir(), "outbox")
+
+		// Set the status while the Server is unreachable.
+		settings := createNoServerSettings()
+		settings.Capabilities = protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig
+		settings.Outbox = outbox.NewFile(path)
+		startClient(t, settings, client)
+
+		status := &protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: []byte{1, 2, 3},
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		}
+		require.NoError(t, client.SetRemoteConfigStatus(status))
+		require.NoError(t, client.Stop(context.Background()))
+
+		journaled, err := outbox.NewFile(path).Load()
+		require.NoError(t, err)
+		require.NotNil(t, journaled)
+		assert.True(t, proto.Equal(status, journaled.RemoteConfigStatus))
+
+		// Start again without the status, now the Server is reachable.
+		srv := internal.StartMockServer(t)
+		var received atomic.Value
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if msg.RemoteConfigStatus != nil {
+				received.Store(msg.RemoteConfigStatus)
+			}
+			return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+		}
+		settings.OpAMPServerURL = "ws://" + srv.Endpoint
+		startClient(t, settings, client)
+
+		eventually(t, func() bool { return received.Load() != nil })
+		assert.True(t, proto.Equal(status, received.Load().(*protobufs.RemoteConfigStatus)))
+
+		// The journal is cleared once the status is delivered.
+		eventually(t, func() bool {
+			_, err := os.Stat(path)
+			return os.IsNotExist(err)
+		})
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestUpdateEffectiveConfigMemoryLimit(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// The config does not fit in the memory limit.
+		cfg := &protobufs.EffectiveConfig{
+			ConfigMap: &protobufs.AgentConfigMap{ConfigMap: map[string]*protobufs.AgentConfigFile{
+				"": {Body: make([]byte, 1000)},
+			}},
+		}
+		metrics := &testMetrics{}
+		settings := createNoServerSettings()
+		settings.Capabilities = protobufs.AgentCapabilities_AgentCapabilities_ReportsEffectiveConfig
+		settings.MemoryLimit = 100
+		settings.Metrics = metrics
+		settings.Callbacks = types.CallbacksStruct{
+			GetEffectiveConfigFunc: func(ctx context.Context) (*protobufs.EffectiveConfig, error) {
+				return cfg, nil
+			},
+		}
+		startClient(t, settings, client)
+
+		err := client.UpdateEffectiveConfig(context.Background())
+		assert.ErrorIs(t, err, ErrMemoryLimitExceeded)
+		assert.EqualValues(t, 1, atomic.LoadInt64(&metrics.memoryLimitExceeded))
+
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+// partiallyMigratedCallbacks are the LegacyCallbacks that also implement a newer
+// callback.
+type partiallyMigratedCallbacks struct {
+	types.LegacyCallbacksStruct
+	flagsHandled int64
+}
+
+func (c *partiallyMigratedCallbacks) OnFlagsHandled(types.FlagsHandling) {
+	atomic.AddInt64(&c.flagsHandled, 1)
+}
+
+func TestLegacyCallbacks(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// Start a Server that reports an error and then asks for the full state.
+		srv := internal.StartMockServer(t)
+		var responses int64
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if atomic.AddInt64(&responses, 1) == 1 {
+				return &protobufs.ServerToAgent{
+					InstanceUid: msg.InstanceUid,
+					ErrorResponse: &protobufs.ServerErrorResponse{
+						Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest,
+						ErrorMessage: "bad",
+					},
+				}
+			}
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				Flags:       uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState),
+			}
+		}
+
+		// The callbacks written against the previous releases.
+		var connected int64
+		var serverErr atomic.Value
+		callbacks := &partiallyMigratedCallbacks{LegacyCallbacksStruct: types.LegacyCallbacksStruct{
+			OnConnectFunc: func() { atomic.AddInt64(&connected, 1) },
+			OnErrorFunc:   func(err *protobufs.ServerErrorResponse) { serverErr.Store(err) },
+		}}
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Callbacks:      types.AdaptLegacyCallbacks(callbacks),
+		}
+		startClient(t, settings, client)
+
+		eventually(t, func() bool { return serverErr.Load() != nil })
+		err := serverErr.Load().(*protobufs.ServerErrorResponse)
+		assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest, err.Type)
+		assert.EqualValues(t, "bad", err.ErrorMessage)
+		assert.NotZero(t, atomic.LoadInt64(&connected))
+
+		// The newer callbacks they implement are called.
+		require.NoError(t, client.SetAgentDescription(createAgentDescr()))
+		eventually(t, func() bool { return atomic.LoadInt64(&callbacks.flagsHandled) > 0 })
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestStrictSpecCompliance(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// Start a Server that responds to the first message with a wrong instance uid.
+		srv := internal.StartMockServer(t)
+		var responses int64
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			response := &protobufs.ServerToAgent{
+				InstanceUid:  msg.InstanceUid,
+				Capabilities: uint64(protobufs.ServerCapabilities_ServerCapabilities_AcceptsStatus),
+				RemoteConfig: createRemoteConfig(),
+			}
+			if atomic.AddInt64(&responses, 1) == 1 {
+				response.InstanceUid = "wrong"
+			}
+			return response
+		}
+
+		var remoteConfigs int64
+		var violation atomic.Value
+		metrics := &testMetrics{}
+		settings := types.StartSettings{
+			OpAMPServerURL:       "ws://" + srv.Endpoint,
+			StrictSpecCompliance: true,
+			Metrics:              metrics,
+			Capabilities:         protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig,
+			Callbacks: types.CallbacksStruct{
+				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
+					if msg.RemoteConfig != nil {
+						atomic.AddInt64(&remoteConfigs, 1)
+					}
+				},
+				OnSpecViolationFunc: func(v types.SpecViolation) {
+					violation.Store(v)
+				},
+			},
+		}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		// The violating message is rejected and not processed.
+		eventually(t, func() bool { return violation.Load() != nil })
+		v := violation.Load().(types.SpecViolation)
+		assert.EqualValues(t, "wrong", v.Message.InstanceUid)
+		assert.EqualValues(t, []string{
+			fmt.Sprintf("instance_uid %q does not match the instance uid of the Agent %q", "wrong", settings.InstanceUid),
+		}, v.Violations)
+		assert.EqualValues(t, 1, atomic.LoadInt64(&metrics.specViolations))
+		assert.EqualValues(t, 0, atomic.LoadInt64(&remoteConfigs))
+
+		// The compliant messages are processed.
+		require.NoError(t, client.SetAgentDescription(createAgentDescr()))
+		eventually(t, func() bool { return atomic.LoadInt64(&remoteConfigs) == 1 })
+		assert.EqualValues(t, 1, atomic.LoadInt64(&metrics.specViolations))
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestRequestInstanceUid(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// Start a server that assigns a new instance uid when the Agent asks for it.
+		srv := internal.StartMockServer(t)
+		newInstanceUid := ulid.MustNew(
+			ulid.Timestamp(time.Now()), ulid.Monotonic(rand.New(rand.NewSource(1)), 0),
+		).String()
+		var requestedBy, lastInstanceUid atomic.Value
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			lastInstanceUid.Store(msg.InstanceUid)
+			response := &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+			if msg.Flags&uint64(protobufs.AgentToServerFlags_AgentToServerFlags_RequestInstanceUid) != 0 {
+				requestedBy.Store(msg.InstanceUid)
+				response.AgentIdentification = &protobufs.AgentIdentification{NewInstanceUid: newInstanceUid}
+			}
+			return response
+		}
+
+		// The new instance uid is persisted before any message carries it.
+		var saved atomic.Value
+		settings := types.StartSettings{
+			Callbacks: types.CallbacksStruct{
+				SaveInstanceUidFunc: func(ctx context.Context, instanceUid string) {
+					if instanceUid, ok := lastInstanceUid.Load().(string); ok && instanceUid == newInstanceUid {
+						t.Error("a message was sent with the new instance uid before it was saved")
+					}
+					saved.Store(instanceUid)
+				},
+			},
+		}
+		settings.OpAMPServerURL = "ws://" + srv.Endpoint
+		prepareClient(t, &settings, client)
+		oldInstanceUid := settings.InstanceUid
+		require.NoError(t, client.Start(context.Background(), settings))
+		eventually(t, func() bool { return lastInstanceUid.Load() != nil })
+		assert.Nil(t, requestedBy.Load())
+
+		client.RequestInstanceUid()
+		eventually(t, func() bool { return saved.Load() != nil })
+		assert.EqualValues(t, oldInstanceUid, requestedBy.Load())
+		assert.EqualValues(t, newInstanceUid, saved.Load())
+
+		// The following messages carry the new instance uid.
+		_ = client.SetAgentDescription(createAgentDescr())
+		eventually(t, func() bool { return lastInstanceUid.Load() == newInstanceUid })
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestClientStorage(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// Start a server that assigns a new instance uid.
+		srv := internal.StartMockServer(t)
+		newInstanceUid := ulid.MustNew(
+			ulid.Timestamp(time.Now()), ulid.Monotonic(rand.New(rand.NewSource(2)), 0),
+		).String()
+		var lastMsg atomic.Value
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if msg.AgentDisconnect != nil {
+				return nil
+			}
+			lastMsg.Store(msg)
+			response := &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+			if msg.InstanceUid != newInstanceUid {
+				response.AgentIdentification = &protobufs.AgentIdentification{NewInstanceUid: newInstanceUid}
+			}
+			return response
+		}
+
+		// The instance uid is generated on the first start.
+		path := filepath.Join(t.TempDir(), "state")
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Capabilities:   protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig,
+			Storage:        storage.NewFile(path),
+		}
+		prepareClient(t, &settings, client)
+		settings.InstanceUid = ""
+		require.NoError(t, client.Start(context.Background(), settings))
+		eventually(t, func() bool { return lastMsg.Load() != nil })
+		assert.NotEqualValues(t, newInstanceUid, lastMsg.Load().(*protobufs.AgentToServer).InstanceUid)
+
+		status := &protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: []byte{1, 2, 3},
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		}
+		require.NoError(t, client.SetRemoteConfigStatus(status))
+		eventually(t, func() bool {
+			msg := lastMsg.Load().(*protobufs.AgentToServer)
+			return msg.InstanceUid == newInstanceUid && msg.RemoteConfigStatus != nil
+		})
+		require.NoError(t, client.Stop(context.Background()))
+
+		// The assigned instance uid and the status are saved.
+		state, err := storage.NewFile(path).Load()
+		require.NoError(t, err)
+		require.NotNil(t, state)
+		assert.EqualValues(t, newInstanceUid, state.InstanceUid)
+		assert.True(t, proto.Equal(status, state.RemoteConfigStatus))
+
+		// The saved state is used when the client starts again.
+		lastMsg = atomic.Value{}
+		require.NoError(t, client.Start(context.Background(), settings))
+		eventually(t, func() bool { return lastMsg.Load() != nil })
+		msg := lastMsg.Load().(*protobufs.AgentToServer)
+		assert.EqualValues(t, newInstanceUid, msg.InstanceUid)
+		assert.True(t, proto.Equal(status, msg.RemoteConfigStatus))
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestCommandFailureReportedInHealth(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var lastHealth atomic.Value
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if msg.Health != nil {
+				lastHealth.Store(msg.Health)
+			}
+			if msg.SequenceNum != 0 {
+				return nil
+			}
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				Command:     &protobufs.ServerToAgentCommand{Type: protobufs.CommandType_CommandType_Restart},
+			}
+		}
+
+		var commandCtx atomic.Value
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth,
+			Callbacks: types.CallbacksStruct{
+				OnCommandFunc: func(ctx context.Context, command *protobufs.ServerToAgentCommand) error {
+					commandCtx.Store(ctx)
+					return errors.New("restart is disabled")
+				},
+			},
+		}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		// The failure is reported without changing the health set by the Agent.
+		eventually(t, func() bool {
+			health, ok := lastHealth.Load().(*protobufs.AgentHealth)
+			return ok && health.LastError != ""
+		})
+		health := lastHealth.Load().(*protobufs.AgentHealth)
+		assert.True(t, health.Healthy)
+		assert.Contains(t, health.LastError, "restart is disabled")
+		assert.NotNil(t, commandCtx.Load())
+
+		// The Agent clears the error, which the Server must see.
+		require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
+		eventually(t, func() bool {
+			health, ok := lastHealth.Load().(*protobufs.AgentHealth)
+			return ok && health.LastError == ""
+		})
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestCommandRedeliveredAfterRestart(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// The previous run did not acknowledge the command before the Agent exited.
+		path := filepath.Join(t.TempDir(), "state")
+		command := &protobufs.ServerToAgentCommand{Type: protobufs.CommandType_CommandType_Restart}
+		require.NoError(t, storage.NewFile(path).Save(&types.ClientState{
+			InstanceUid:    "01ARZ3NDEKTSV4RRFFQ69G5FAV",
+			PendingCommand: command,
+		}))
+
+		commands := make(chan *protobufs.ServerToAgentCommand, 2)
+		settings := createNoServerSettings()
+		settings.Capabilities = protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand
+		settings.Storage = storage.NewFile(path)
+		settings.Callbacks = types.CallbacksStruct{
+			OnCommandFunc: func(ctx context.Context, command *protobufs.ServerToAgentCommand) error {
+				commands <- command
+				return nil
+			},
+		}
+		prepareClient(t, &settings, client)
+		settings.InstanceUid = ""
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		// The command is redelivered even if the Server is not reachable.
+		select {
+		case redelivered := <-commands:
+			assert.True(t, proto.Equal(command, redelivered))
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "the command is not redelivered")
+		}
+		require.NoError(t, client.Stop(context.Background()))
+
+		// The acknowledged command is no longer saved, it is not delivered again.
+		state, err := storage.NewFile(path).Load()
+		require.NoError(t, err)
+		assert.Nil(t, state.PendingCommand)
+		require.NoError(t, client.Start(context.Background(), settings))
+		require.NoError(t, client.Stop(context.Background()))
+		assert.Empty(t, commands)
+	})
+}
+
+func TestFlush(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		assert.ErrorIs(t, client.Flush(context.Background()), ErrNotStarted)
+
+		// The Server is not reachable, the pending health is not delivered.
+		settings := createNoServerSettings()
+		settings.Capabilities = protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
+		require.NoError(t, client.Start(context.Background(), settings))
+		require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: false}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, client.Flush(ctx), context.DeadlineExceeded)
+		require.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestRestartCommandHandler(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var lastHealth atomic.Value
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if msg.Health != nil {
+				lastHealth.Store(msg.Health)
+			}
+			if msg.SequenceNum != 0 {
+				return nil
+			}
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				Command:     &protobufs.ServerToAgentCommand{Type: protobufs.CommandType_CommandType_Restart},
+			}
+		}
+
+		type restartState struct {
+			health *protobufs.AgentHealth
+			status types.ConnectionStatus
+		}
+		restarted := make(chan restartState, 1)
+		onCommand, err := RestartCommandHandler(client, RestartCommandSettings{
+			Restart: func(ctx context.Context) error {
+				health, _ := lastHealth.Load().(*protobufs.AgentHealth)
+				restarted <- restartState{health: health, status: client.ConnectionState().Status}
+				return nil
+			},
+			Health: &protobufs.AgentHealth{Healthy: false, LastError: "restarting"},
+			OnError: func(err error) {
+				t.Errorf("restart failed: %v", err)
+			},
+		})
+		require.NoError(t, err)
+
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth,
+			Callbacks: types.CallbacksStruct{OnCommandFunc: onCommand},
+		}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		// The Server has the restarting health and the client is stopped before the
+		// Agent restarts.
+		select {
+		case state := <-restarted:
+			require.NotNil(t, state.health)
+			assert.Equal(t, "restarting", state.health.LastError)
+			assert.Equal(t, types.ConnectionDisconnected, state.status)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "the Agent is not restarted")
+		}
+
+		// The other commands are rejected.
+		assert.Error(t, onCommand(context.Background(), &protobufs.ServerToAgentCommand{Type: protobufs.CommandType(1)}))
+		srv.Close()
+	})
+}
+
+func TestRestartCommandHandlerRequiresRestart(t *testing.T) {
+	_, err := RestartCommandHandler(NewHTTP(nil), RestartCommandSettings{})
+	assert.ErrorIs(t, err, errRestartRequired)
+}
+
+func TestReportRemoteConfigApplying(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var mux sync.Mutex
+		var statuses []protobufs.RemoteConfigStatuses
+		applying := make(chan struct{})
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if status := msg.RemoteConfigStatus; status != nil && bytes.Equal(status.LastRemoteConfigHash, []byte{1, 2, 3}) {
+				mux.Lock()
+				statuses = append(statuses, status.Status)
+				if status.Status == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING {
+					close(applying)
+				}
+				mux.Unlock()
+			}
+			if msg.SequenceNum != 0 {
+				return nil
+			}
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				RemoteConfig: &protobufs.AgentRemoteConfig{
+					Config:     &protobufs.AgentConfigMap{},
+					ConfigHash: []byte{1, 2, 3},
+				},
+			}
+		}
+
+		// The Agent applies the config after OnMessage returns, once the Server knows
+		// that it is being applied.
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig,
+			ReportRemoteConfigApplying: true,
+			Callbacks: types.CallbacksStruct{
+				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
+					if msg.RemoteConfig == nil {
+						return
+					}
+					hash := msg.RemoteConfig.ConfigHash
+					go func() {
+						<-applying
+						_ = client.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+							LastRemoteConfigHash: hash,
+							Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+						})
+					}()
+				},
+			},
+		}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		eventually(t, func() bool {
+			mux.Lock()
+			defer mux.Unlock()
+			return len(statuses) == 2
+		})
+		mux.Lock()
+		assert.Equal(t, []protobufs.RemoteConfigStatuses{
+			protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING,
+			protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		}, statuses)
+		mux.Unlock()
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestResponseVerification(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		serverKey, key, err := ed25519.GenerateKey(cryptorand.Reader)
+		require.NoError(t, err)
+		_, otherKey, err := ed25519.GenerateKey(cryptorand.Reader)
+		require.NoError(t, err)
+
+		srv := internal.StartMockServer(t)
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			// The first config is signed with another key, the next one with the key
+			// of the Server.
+			response := &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				RemoteConfig: &protobufs.AgentRemoteConfig{
+					Config:     &protobufs.AgentConfigMap{},
+					ConfigHash: []byte{1},
+				},
+			}
+			signingKey := otherKey
+			if msg.SequenceNum != 0 {
+				response.RemoteConfig.ConfigHash = []byte{2}
+				signingKey = key
+			}
+			require.NoError(t, sharedinternal.SignServerToAgent(response, signingKey))
+			return response
+		}
+
+		var configHashes atomic.Value
+		configHashes.Store([][]byte{})
+		metrics := &testMetrics{}
+		settings := types.StartSettings{
+			OpAMPServerURL:          "ws://" + srv.Endpoint,
+			Capabilities:            protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig,
+			ResponseVerificationKey: serverKey,
+			Metrics:                 metrics,
+			Callbacks: types.CallbacksStruct{
+				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
+					if msg.RemoteConfig != nil {
+						configHashes.Store(append(configHashes.Load().([][]byte), msg.RemoteConfig.ConfigHash))
+					}
+				},
+			},
+		}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		eventually(t, func() bool { return atomic.LoadInt64(&metrics.unverifiedResponses) == 1 })
+		assert.Empty(t, configHashes.Load())
+
+		// Makes the client send the next message.
+		require.NoError(t, client.SetAgentDescription(createAgentDescr()))
+		eventually(t, func() bool { return len(configHashes.Load().([][]byte)) == 1 })
+		assert.Equal(t, [][]byte{{2}}, configHashes.Load())
+		assert.EqualValues(t, 1, atomic.LoadInt64(&metrics.unverifiedResponses))
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestOfferTimeouts(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		srv := internal.StartMockServer(t)
+		var remoteConfigStatus, packageStatuses atomic.Value
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if msg.RemoteConfigStatus != nil {
+				remoteConfigStatus.Store(msg.RemoteConfigStatus)
+			}
+			if msg.PackageStatuses != nil {
+				packageStatuses.Store(msg.PackageStatuses)
+			}
+			if msg.SequenceNum != 0 {
+				return nil
+			}
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				RemoteConfig: &protobufs.AgentRemoteConfig{
+					Config:     &protobufs.AgentConfigMap{},
+					ConfigHash: []byte{1, 2, 3},
+				},
+				PackagesAvailable: &protobufs.PackagesAvailable{
+					Packages:        map[string]*protobufs.PackageAvailable{},
+					AllPackagesHash: []byte{4, 5, 6},
+				},
+			}
+		}
+
+		// The Agent hangs processing the offers and ignores the cancellation for
+		// longer than both timeouts. The HTTP client sends the statuses once it
+		// returns, the other transports meanwhile.
+		var cancelled int32
+		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig |
+				protobufs.AgentCapabilities_AgentCapabilities_AcceptsPackages |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsPackageStatuses,
+			PackagesStateProvider:    internal.NewInMemPackagesStore(),
+			RemoteConfigTimeout:      50 * time.Millisecond,
+			PackagesAvailableTimeout: 100 * time.Millisecond,
+			Callbacks: types.CallbacksStruct{
+				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
+					<-ctx.Done()
+					atomic.StoreInt32(&cancelled, 1)
+					time.Sleep(200 * time.Millisecond)
+				},
+			},
+		}
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		// The Server learns that the offers failed while the Agent still hangs.
+		eventually(t, func() bool {
+			status, ok := remoteConfigStatus.Load().(*protobufs.RemoteConfigStatus)
+			return ok && status.Status == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED
+		})
+		status := remoteConfigStatus.Load().(*protobufs.RemoteConfigStatus)
+		assert.Equal(t, []byte{1, 2, 3}, status.LastRemoteConfigHash)
+		assert.Contains(t, status.ErrorMessage, "timed out")
+
+		eventually(t, func() bool {
+			statuses, ok := packageStatuses.Load().(*protobufs.PackageStatuses)
+			return ok && statuses.ErrorMessage != ""
+		})
+		statuses := packageStatuses.Load().(*protobufs.PackageStatuses)
+		assert.Equal(t, []byte{4, 5, 6}, statuses.ServerProvidedAllPackagesHash)
+		assert.Contains(t, statuses.ErrorMessage, "timed out")
+		assert.EqualValues(t, 1, atomic.LoadInt32(&cancelled))
+
+		srv.Close()
+		assert.NoError(t, client.Stop(context.Background()))
+	})
+}
+
+func TestConnectionSettings(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		hash := []byte{1, 2, 3}
+		// The offer does not change the endpoint, so it is accepted without verifying a
+		// new endpoint first.
+		opampSettings := &protobufs.OpAMPConnectionSettings{
+			Headers: &protobufs.Headers{Headers: []*protobufs.Header{{Key: "Authorization", Value: "new-secret"}}},
+		}
+		metricsSettings := &protobufs.TelemetryConnectionSettings{DestinationEndpoint: "http://metrics.com"}
+		tracesSettings := &protobufs.TelemetryConnectionSettings{DestinationEndpoint: "http://traces.com"}
+		logsSettings := &protobufs.TelemetryConnectionSettings{DestinationEndpoint: "http://logs.com"}
+		otherSettings := &protobufs.OtherConnectionSettings{DestinationEndpoint: "http://other.com"}
+
+		var rcvStatus int64
+		// Start a Server.
+		srv := internal.StartMockServer(t)
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if msg != nil {
+				if atomic.AddInt64(&rcvStatus, 1) > 1 {
+					return nil
+				}
+
+				return &protobufs.ServerToAgent{
+					ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+						Hash:       hash,
+						Opamp:      opampSettings,
+						OwnMetrics: metricsSettings,
+						OwnTraces:  tracesSettings,
+						OwnLogs:    logsSettings,
+						OtherConnections: map[string]*protobufs.OtherConnectionSettings{
+							"other": otherSettings,
+						},
+					},
+				}
+			}
+			return nil
+		}
+
+		var gotOpampSettings int64
+		var gotOwnSettings int64
+		var gotOtherSettings int64
+
+		// Start a client.
+		settings := types.StartSettings{
+			Callbacks: types.CallbacksStruct{
+				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
+					if msg.OwnMetricsConnSettings == nil {
+						// Plain HTTP response to the status report.
+						return
+					}
+					assert.True(t, proto.Equal(metricsSettings, msg.OwnMetricsConnSettings))
+					assert.True(t, proto.Equal(tracesSettings, msg.OwnTracesConnSettings))
+					assert.True(t, proto.Equal(logsSettings, msg.OwnLogsConnSettings))
+					atomic.AddInt64(&gotOwnSettings, 1)
+
+					assert.Len(t, msg.OtherConnSettings, 1)
+					assert.True(t, proto.Equal(otherSettings, msg.OtherConnSettings["other"]))
+					atomic.AddInt64(&gotOtherSettings, 1)
+				},
+
+				OnOpampConnectionSettingsFunc: func(
+					ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
+				) error {
+					assert.True(t, proto.Equal(opampSettings, settings))
+					atomic.AddInt64(&gotOpampSettings, 1)
+					return nil
+				},
+			},
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnTraces |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnMetrics |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnLogs |
+				protobufs.AgentCapabilities_AgentCapabilities_AcceptsOtherConnectionSettings |
+				protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings,
+		}
+		settings.OpAMPServerURL = "ws://" + srv.Endpoint
+		prepareClient(t, &settings, client)
+
+		assert.NoError(t, client.Start(context.Background(), settings))
+
+		eventually(t, func() bool { return atomic.LoadInt64(&gotOpampSettings) == 1 })
+		eventually(t, func() bool { return atomic.LoadInt64(&gotOwnSettings) == 1 })
+		eventually(t, func() bool { return atomic.LoadInt64(&gotOtherSettings) == 1 })
+
+		// Shutdown the Server.
+		srv.Close()
+
+		// Shutdown the client.
+		err := client.Stop(context.Background())
+		assert.NoError(t, err)
+	})
+}
+
+func TestOpAMPEndpointTransition(t *testing.T) {
+	tests := []struct {
+		name     string
+		healthy  bool
+		accepted int64
+	}{
+		{name: "healthy endpoint", healthy: true, accepted: 1},
+		{name: "unreachable endpoint", healthy: false, accepted: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testClients(t, func(t *testing.T, client OpAMPClient) {
+				const gracePeriod = 300 * time.Millisecond
+
+				// Start the Server the Agent will be redirected to.
+				newSrv := internal.StartMockServer(t)
+				var newSrvConnected int64
+				newSrv.OnConnect = func(r *http.Request) {
+					assert.EqualValues(t, "new-secret", r.Header.Get("Authorization"))
+					atomic.AddInt64(&newSrvConnected, 1)
+				}
+				newSrv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+				}
+				newEndpoint := newSrv.Endpoint
+				if !test.healthy {
+					newSrv.Close()
+					newEndpoint = testhelpers.GetAvailableLocalAddress()
+				}
+
+				var opampSettings *protobufs.OpAMPConnectionSettings
+
+				// Start the current Server that offers the new endpoint.
+				srv := internal.StartMockServer(t)
+				srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					return &protobufs.ServerToAgent{
+						ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+							Hash:  []byte{1, 2, 3},
+							Opamp: opampSettings,
+						},
+					}
+				}
+
+				var offered, accepted int64
+				var acceptedAt time.Time
+				settings := types.StartSettings{
+					Callbacks: types.CallbacksStruct{
+						OnOpampConnectionSettingsFunc: func(
+							ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
+						) error {
+							atomic.AddInt64(&offered, 1)
+							return nil
+						},
+						OnOpampConnectionSettingsAcceptedFunc: func(settings *protobufs.OpAMPConnectionSettings) {
+							assert.True(t, proto.Equal(opampSettings, settings))
+							acceptedAt = time.Now()
+							atomic.AddInt64(&accepted, 1)
+						},
+					},
+					OpAMPEndpointGracePeriod: gracePeriod,
+					Capabilities:             protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings,
+				}
+				settings.OpAMPServerURL = "ws://" + srv.Endpoint
+				prepareClient(t, &settings, client)
+
+				u, err := url.Parse(settings.OpAMPServerURL)
+				require.NoError(t, err)
+				opampSettings = &protobufs.OpAMPConnectionSettings{
+					DestinationEndpoint: u.Scheme + "://" + newEndpoint,
+					Headers: &protobufs.Headers{
+						Headers: []*protobufs.Header{{Key: "Authorization", Value: "new-secret"}},
+					},
+				}
+
+				startedAt := time.Now()
+				require.NoError(t, client.Start(context.Background(), settings))
+
+				eventually(t, func() bool { return atomic.LoadInt64(&offered) == 1 })
+				if test.healthy {
+					eventually(t, func() bool { return atomic.LoadInt64(&accepted) == 1 })
+					assert.GreaterOrEqual(t, acceptedAt.Sub(startedAt), gracePeriod)
+					assert.GreaterOrEqual(t, atomic.LoadInt64(&newSrvConnected), int64(1))
+				} else {
+					// The settings must never be accepted. Wait well past the grace period.
+					assert.Never(t, func() bool { return atomic.LoadInt64(&accepted) != 0 }, 3*gracePeriod, 10*time.Millisecond)
+				}
+				assert.EqualValues(t, test.accepted, atomic.LoadInt64(&accepted))
+
+				// Shutdown the client.
+				assert.NoError(t, client.Stop(context.Background()))
+
+				// Shutdown the Servers.
+				srv.Close()
+				if test.healthy {
+					newSrv.Close()
+				}
+			})
+		})
+	}
+}
+
+func TestFollowOfferedEndpoint(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		// Start the Server the Agent will be redirected to.
+		newSrv := internal.StartMockServer(t)
+		var newSrvMsg atomic.Value
+		newSrv.OnConnect = func(r *http.Request) {
+			assert.EqualValues(t, "new-secret", r.Header.Get("Authorization"))
+		}
+		newSrv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if msg.SequenceNum > 0 {
+				// Not the status report that verifies the endpoint.
+				newSrvMsg.Store(msg)
+			}
+			return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+		}
+
+		var opampSettings *protobufs.OpAMPConnectionSettings
+
+		// Start the current Server that redirects the Agent.
+		srv := internal.StartMockServer(t)
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+					Hash:  []byte{1, 2, 3},
+					Opamp: opampSettings,
+				},
+			}
+		}
+
+		var accepted int64
+		settings := types.StartSettings{
+			Callbacks: types.CallbacksStruct{
+				OnOpampConnectionSettingsFunc: func(
+					ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
+				) error {
+					return nil
+				},
+				OnOpampConnectionSettingsAcceptedFunc: func(settings *protobufs.OpAMPConnectionSettings) {
+					atomic.AddInt64(&accepted, 1)
+				},
+			},
+			OpAMPEndpointGracePeriod: 50 * time.Millisecond,
+			FollowOfferedEndpoint:    true,
+			Capabilities:             protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings,
+		}
+		settings.OpAMPServerURL = "ws://" + srv.Endpoint
+		prepareClient(t, &settings, client)
+
+		u, err := url.Parse(settings.OpAMPServerURL)
+		require.NoError(t, err)
+		opampSettings = &protobufs.OpAMPConnectionSettings{
+			DestinationEndpoint: u.Scheme + "://" + newSrv.Endpoint,
+			Headers: &protobufs.Headers{
+				Headers: []*protobufs.Header{{Key: "Authorization", Value: "new-secret"}},
+			},
+		}
+
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		// The client reconnects to the new Server by itself, the Server sees the
+		// same Agent.
+		eventually(t, func() bool { return atomic.LoadInt64(&accepted) == 1 })
+		eventually(t, func() bool { return newSrvMsg.Load() != nil })
+		assert.EqualValues(t, settings.InstanceUid, newSrvMsg.Load().(*protobufs.AgentToServer).InstanceUid)
+
+		assert.NoError(t, client.Stop(context.Background()))
+		srv.Close()
+		newSrv.Close()
+	})
+}
+
+// generateClientCertificate returns the PEM encoded self-signed client certificate
+// with the common name and its private key.
+func generateClientCertificate(t *testing.T, commonName string) (certPem, keyPem []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestOpAMPCertificateRotation(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		certPem, keyPem := generateClientCertificate(t, "rotated")
+		offer := &protobufs.OpAMPConnectionSettings{
+			Certificate: &protobufs.TLSCertificate{PublicKey: certPem, PrivateKey: keyPem},
+		}
+
+		// Count the connections that use the offered certificate.
+		srv := internal.StartTLSMockServerWithClientAuth(t)
+		var rotatedConns int64
+		srv.OnConnect = func(r *http.Request) {
+			if certs := r.TLS.PeerCertificates; len(certs) > 0 && certs[0].Subject.CommonName == "rotated" {
+				atomic.AddInt64(&rotatedConns, 1)
+			}
+		}
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			return &protobufs.ServerToAgent{
+				InstanceUid: msg.InstanceUid,
+				ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+					Hash:  []byte{1, 2, 3},
+					Opamp: offer,
+				},
+			}
+		}
+
+		var accepted atomic.Value
+		settings := types.StartSettings{
+			OpAMPServerURL: "wss://" + srv.Endpoint,
+			TLSConfig:      &tls.Config{RootCAs: rootCAs(t, srv.GetHTTPTestServer())},
+			Callbacks: types.CallbacksStruct{
+				OnOpampConnectionSettingsFunc: func(
+					ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
+				) error {
+					return nil
+				},
+				OnOpampConnectionSettingsAcceptedFunc: func(settings *protobufs.OpAMPConnectionSettings) {
+					accepted.Store(settings)
+				},
+			},
+			OpAMPEndpointGracePeriod: 300 * time.Millisecond,
+			Capabilities:             protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings,
+		}
+		startClient(t, settings, client)
+
+		// The certificate is verified, accepted and handed to the Agent to persist it.
+		eventually(t, func() bool { return accepted.Load() != nil })
+		assert.True(t, proto.Equal(offer, accepted.Load().(*protobufs.OpAMPConnectionSettings)))
+
+		// The client switched to the certificate.
+		switch client.(type) {
+		case *wsClient:
+			// One connection to verify the certificate, then the reconnection.
+			eventually(t, func() bool { return atomic.LoadInt64(&rotatedConns) >= 2 })
+		case *httpClient:
+			rotated := atomic.LoadInt64(&rotatedConns)
+			require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
+			eventually(t, func() bool { return atomic.LoadInt64(&rotatedConns) > rotated })
+		}
+
+		// The persisted certificate can be used after a restart.
+		restartConfig, err := TLSConfigWithCertificate(settings.TLSConfig, offer.Certificate)
+		require.NoError(t, err)
+		assert.Len(t, restartConfig.Certificates, 1)
+
+		assert.NoError(t, client.Stop(context.Background()))
+		srv.Close()
+	})
+}
+
+func TestConnectionSettingsRejection(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		hash := []byte{1, 2, 3}
+		var rejection atomic.Value
+
+		// Start a Server.
+		srv := internal.StartMockServer(t)
+		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			if status, rest := types.ParseConnectionSettingsStatus(msg.Health.GetLastError()); status != nil {
+				assert.Equal(t, "agent error", rest)
+				rejection.Store(status)
+			}
+			return &protobufs.ServerToAgent{
+				ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+					Hash: hash,
+					Opamp: &protobufs.OpAMPConnectionSettings{
+						DestinationEndpoint: "https://opamp.example.com",
+					},
+				},
+			}
+		}
+
+		// Start a client that rejects the offer.
+		settings := types.StartSettings{
+			Callbacks: types.CallbacksStruct{
+				OnOpampConnectionSettingsFunc: func(
+					ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
+				) error {
+					return types.RejectConnectionSettings(
+						types.RejectionReasonPolicyDenied, "endpoint %s is not allowed", settings.DestinationEndpoint,
+					)
+				},
+				OnOpampConnectionSettingsAcceptedFunc: func(settings *protobufs.OpAMPConnectionSettings) {
+					assert.Fail(t, "rejected settings must not be accepted")
+				},
 			},
+			// The rejection is reported in the health.
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth,
 		}
-		assert.NoError(t, client.SetAgentDescription(clientAgentDescr))
+		settings.OpAMPServerURL = "ws://" + srv.Endpoint
+		prepareClient(t, &settings, client)
+		require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true, LastError: "agent error"}))
 
-		// Verify change is delivered.
-		eventually(
-			t,
-			func() bool {
-				agentDescr := rcvAgentDescr.Load().(*protobufs.AgentDescription)
-				if agentDescr == nil {
-					return false
-				}
-				return proto.Equal(clientAgentDescr, agentDescr)
-			},
-		)
+		require.NoError(t, client.Start(context.Background(), settings))
+
+		// The Server must receive the reason of the rejection.
+		eventually(t, func() bool { return rejection.Load() != nil })
+		status := rejection.Load().(*types.ConnectionSettingsStatus)
+		assert.EqualValues(t, types.RejectionReasonPolicyDenied, status.Reason)
+		assert.Contains(t, status.Message, "is not allowed")
+		assert.Equal(t, hash, status.Hash)
 
 		// Shutdown the Server.
 		srv.Close()
 
 		// Shutdown the client.
-		err := client.Stop(context.Background())
-		assert.NoError(t, err)
+		assert.NoError(t, client.Stop(context.Background()))
 	})
 }
 
-func TestAgentIdentification(t *testing.T) {
+func TestInvalidConnectionSettingsHeaders(t *testing.T) {
 	testClients(t, func(t *testing.T, client OpAMPClient) {
-		// Start a server.
+		var rejection atomic.Value
+
+		// Start a Server.
 		srv := internal.StartMockServer(t)
-		newInstanceUid := ulid.MustNew(
-			ulid.Timestamp(time.Now()), ulid.Monotonic(rand.New(rand.NewSource(0)), 0),
-		)
-		var rcvAgentInstanceUid atomic.Value
 		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
-			rcvAgentInstanceUid.Store(msg.InstanceUid)
+			if status, _ := types.ParseConnectionSettingsStatus(msg.Health.GetLastError()); status != nil {
+				rejection.Store(string(status.Reason))
+			}
 			return &protobufs.ServerToAgent{
-				InstanceUid: msg.InstanceUid,
-				AgentIdentification: &protobufs.AgentIdentification{
-					NewInstanceUid: newInstanceUid.String(),
+				ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+					Hash: []byte{1, 2, 3},
+					Opamp: &protobufs.OpAMPConnectionSettings{
+						Headers: &protobufs.Headers{
+							Headers: []*protobufs.Header{{Key: "Content-Length", Value: "0"}},
+						},
+					},
+					OwnMetrics: &protobufs.TelemetryConnectionSettings{
+						DestinationEndpoint: "http://metrics.com",
+						Headers: &protobufs.Headers{
+							Headers: []*protobufs.Header{{Key: "x-api-key", Value: "secret"}},
+						},
+					},
 				},
 			}
 		}
 
-		// Start a client.
-		settings := types.StartSettings{}
+		var gotMetricsSettings int64
+		settings := types.StartSettings{
+			Callbacks: types.CallbacksStruct{
+				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
+					if msg.OwnMetricsConnSettings != nil {
+						assert.Equal(t, "X-Api-Key", msg.OwnMetricsConnSettings.Headers.Headers[0].Key)
+						atomic.AddInt64(&gotMetricsSettings, 1)
+					}
+				},
+				OnOpampConnectionSettingsFunc: func(
+					ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
+				) error {
+					assert.Fail(t, "offer with invalid headers must not be delivered")
+					return nil
+				},
+			},
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnMetrics |
+				protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth,
+		}
 		settings.OpAMPServerURL = "ws://" + srv.Endpoint
 		prepareClient(t, &settings, client)
+		require.NoError(t, client.SetHealth(&protobufs.AgentHealth{Healthy: true}))
 
-		oldInstanceUid := settings.InstanceUid
-		assert.NoError(t, client.Start(context.Background(), settings))
-
-		// First, Server gets the original instanceId
-		eventually(
-			t,
-			func() bool {
-				instanceUid, ok := rcvAgentInstanceUid.Load().(string)
-				if !ok {
-					return false
-				}
-				return instanceUid == oldInstanceUid
-			},
-		)
-
-		// Send a dummy message
-		_ = client.SetAgentDescription(createAgentDescr())
+		require.NoError(t, client.Start(context.Background(), settings))
 
-		// When it was sent, the new instance uid should have been used, which should
-		// have been observed by the Server
-		eventually(
-			t,
-			func() bool {
-				instanceUid, ok := rcvAgentInstanceUid.Load().(string)
-				if !ok {
-					return false
-				}
-				return instanceUid == newInstanceUid.String()
-			},
-		)
+		eventually(t, func() bool { return atomic.LoadInt64(&gotMetricsSettings) >= 1 })
+		eventually(t, func() bool { return rejection.Load() == string(types.RejectionReasonInvalidHeaders) })
 
 		// Shutdown the Server.
 		srv.Close()
 
 		// Shutdown the client.
-		err := client.Stop(context.Background())
-		assert.NoError(t, err)
+		assert.NoError(t, client.Stop(context.Background()))
 	})
 }
 
-func TestConnectionSettings(t *testing.T) {
+func TestStartWithInvalidHeader(t *testing.T) {
 	testClients(t, func(t *testing.T, client OpAMPClient) {
-		hash := []byte{1, 2, 3}
-		opampSettings := &protobufs.OpAMPConnectionSettings{DestinationEndpoint: "http://opamp.com"}
-		metricsSettings := &protobufs.TelemetryConnectionSettings{DestinationEndpoint: "http://metrics.com"}
-		tracesSettings := &protobufs.TelemetryConnectionSettings{DestinationEndpoint: "http://traces.com"}
-		logsSettings := &protobufs.TelemetryConnectionSettings{DestinationEndpoint: "http://logs.com"}
-		otherSettings := &protobufs.OtherConnectionSettings{DestinationEndpoint: "http://other.com"}
+		settings := createNoServerSettings()
+		settings.Header = http.Header{"Host": {"example.com"}}
+		prepareClient(t, &settings, client)
+
+		err := client.Start(context.Background(), settings)
+		assert.ErrorIs(t, err, sharedinternal.ErrForbiddenHeader)
+	})
+}
+
+func TestStartWithNegativeCallbackTimeout(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		settings := createNoServerSettings()
+		settings.CallbackTimeout = -time.Second
+		prepareClient(t, &settings, client)
+
+		err := client.Start(context.Background(), settings)
+		assert.Error(t, err)
+	})
+}
+
+func TestStartWithInvalidCompressionLevel(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		settings := createNoServerSettings()
+		settings.CompressionLevel = 10
+		prepareClient(t, &settings, client)
+
+		err := client.Start(context.Background(), settings)
+		assert.Error(t, err)
+	})
+}
+
+func TestScheduledConnectionSettings(t *testing.T) {
+	testClients(t, func(t *testing.T, client OpAMPClient) {
+		activateAt := time.Now().Add(500 * time.Millisecond).UTC()
+		windowHeader := func(key string, t time.Time) *protobufs.Headers {
+			return &protobufs.Headers{Headers: []*protobufs.Header{
+				{Key: "Authorization", Value: "secret"},
+				{Key: key, Value: t.Format(time.RFC3339Nano)},
+			}}
+		}
 
-		var rcvStatus int64
 		// Start a Server.
 		srv := internal.StartMockServer(t)
+		var offered int64
 		srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
-			if msg != nil {
-				atomic.AddInt64(&rcvStatus, 1)
-
-				return &protobufs.ServerToAgent{
-					ConnectionSettings: &protobufs.ConnectionSettingsOffers{
-						Hash:       hash,
-						Opamp:      opampSettings,
-						OwnMetrics: metricsSettings,
-						OwnTraces:  tracesSettings,
-						OwnLogs:    logsSettings,
-						OtherConnections: map[string]*protobufs.OtherConnectionSettings{
-							"other": otherSettings,
-						},
+			if atomic.AddInt64(&offered, 1) > 1 {
+				return nil
+			}
+			return &protobufs.ServerToAgent{
+				ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+					Hash: []byte{1, 2, 3},
+					OwnMetrics: &protobufs.TelemetryConnectionSettings{
+						DestinationEndpoint: "http://metrics.com",
+						Headers:             windowHeader(types.ConnectionSettingsNotBeforeHeader, activateAt),
 					},
-				}
+					OwnLogs: &protobufs.TelemetryConnectionSettings{
+						DestinationEndpoint: "http://logs.com",
+						Headers:             windowHeader(types.ConnectionSettingsNotAfterHeader, time.Now().Add(-time.Minute)),
+					},
+				},
 			}
-			return nil
 		}
 
-		var gotOpampSettings int64
-		var gotOwnSettings int64
-		var gotOtherSettings int64
+		var metricsReceivedAt atomic.Value
+		var gotLogs int64
 
 		// Start a client.
 		settings := types.StartSettings{
+			OpAMPServerURL: "ws://" + srv.Endpoint,
 			Callbacks: types.CallbacksStruct{
 				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
-					assert.True(t, proto.Equal(metricsSettings, msg.OwnMetricsConnSettings))
-					assert.True(t, proto.Equal(tracesSettings, msg.OwnTracesConnSettings))
-					assert.True(t, proto.Equal(logsSettings, msg.OwnLogsConnSettings))
-					atomic.AddInt64(&gotOwnSettings, 1)
-
-					assert.Len(t, msg.OtherConnSettings, 1)
-					assert.True(t, proto.Equal(otherSettings, msg.OtherConnSettings["other"]))
-					atomic.AddInt64(&gotOtherSettings, 1)
-				},
-
-				OnOpampConnectionSettingsFunc: func(
-					ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
-				) error {
-					assert.True(t, proto.Equal(opampSettings, settings))
-					atomic.AddInt64(&gotOpampSettings, 1)
-					return nil
+					if msg.OwnMetricsConnSettings != nil {
+						// The window header must be removed, other headers kept.
+						assert.Len(t, msg.OwnMetricsConnSettings.Headers.Headers, 1)
+						metricsReceivedAt.Store(time.Now())
+					}
+					if msg.OwnLogsConnSettings != nil {
+						atomic.AddInt64(&gotLogs, 1)
+					}
 				},
 			},
-			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnTraces |
-				protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnMetrics |
-				protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnLogs |
-				protobufs.AgentCapabilities_AgentCapabilities_AcceptsOtherConnectionSettings |
-				protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings,
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnMetrics |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnLogs,
 		}
-		settings.OpAMPServerURL = "ws://" + srv.Endpoint
 		prepareClient(t, &settings, client)
 
 		assert.NoError(t, client.Start(context.Background(), settings))
 
-		eventually(t, func() bool { return atomic.LoadInt64(&gotOpampSettings) == 1 })
-		eventually(t, func() bool { return atomic.LoadInt64(&gotOwnSettings) == 1 })
-		eventually(t, func() bool { return atomic.LoadInt64(&gotOtherSettings) == 1 })
-		eventually(t, func() bool { return atomic.LoadInt64(&rcvStatus) == 1 })
+		// The metrics settings must be delivered at the activation time.
+		eventually(t, func() bool { return metricsReceivedAt.Load() != nil })
+		assert.False(t, metricsReceivedAt.Load().(time.Time).Before(activateAt))
+
+		// The expired logs settings must never be delivered.
+		assert.EqualValues(t, 0, atomic.LoadInt64(&gotLogs))
 
 		// Shutdown the Server.
 		srv.Close()
@@ -959,9 +3153,13 @@ func verifyRemoteConfigUpdate(t *testing.T, successCase bool, expectStatus *prot
 		srv.EnableExpectMode()
 
 		// Start a client.
+		var savedStatus atomic.Value
 		settings := types.StartSettings{
 			OpAMPServerURL: "ws://" + srv.Endpoint,
 			Callbacks: types.CallbacksStruct{
+				SaveRemoteConfigStatusFunc: func(ctx context.Context, status *protobufs.RemoteConfigStatus) {
+					savedStatus.Store(status)
+				},
 				OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
 					if msg.RemoteConfig != nil {
 						if successCase {
@@ -1047,6 +3245,9 @@ func verifyRemoteConfigUpdate(t *testing.T, successCase bool, expectStatus *prot
 			return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
 		})
 
+		// The Agent was asked to persist the status.
+		assert.True(t, proto.Equal(firstConfigStatus, savedStatus.Load().(*protobufs.RemoteConfigStatus)))
+
 		// Shutdown the Server.
 		srv.Close()
 
@@ -1095,6 +3296,37 @@ type packageTestCase struct {
 	expectedStatus      *protobufs.PackageStatuses
 	expectedFileContent map[string][]byte
 	expectedError       string
+	verifyErr           error
+	downloaders         map[string]types.Downloader
+	expectedFiles       map[string]map[string][]byte
+	prepareStore        func(store *internal.InMemPackagesStore)
+}
+
+// contentDownloader is a Downloader that returns the fixed content.
+type contentDownloader struct {
+	content []byte
+}
+
+func (d *contentDownloader) Download(_ context.Context, _ *protobufs.DownloadableFile) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(d.content)), nil
+}
+
+// verifyingPackagesStore is a package store that implements types.PackageVerifier.
+type verifyingPackagesStore struct {
+	*internal.InMemPackagesStore
+	verifyErr error
+}
+
+var _ types.PackageVerifier = (*verifyingPackagesStore)(nil)
+
+func (s *verifyingPackagesStore) VerifyPackage(_ context.Context, _ string, _ string) error {
+	return s.verifyErr
+}
+
+func (s *verifyingPackagesStore) RollbackContent(_ context.Context, packageName string) error {
+	// There is no previous content in the tests, rolling back removes the content.
+	delete(s.GetContent(), packageName)
+	return nil
 }
 
 const packageUpdateErrorMsg = "cannot update packages"
@@ -1107,6 +3339,16 @@ func verifyUpdatePackages(t *testing.T, testCase packageTestCase) {
 		srv.EnableExpectMode()
 
 		localPackageState := internal.NewInMemPackagesStore()
+		if testCase.prepareStore != nil {
+			testCase.prepareStore(localPackageState)
+		}
+		var packagesStateProvider types.PackagesStateProvider = localPackageState
+		if testCase.verifyErr != nil {
+			packagesStateProvider = &verifyingPackagesStore{
+				InMemPackagesStore: localPackageState,
+				verifyErr:          testCase.verifyErr,
+			}
+		}
 
 		var syncerDoneCh <-chan struct{}
 
@@ -1132,7 +3374,8 @@ func verifyUpdatePackages(t *testing.T, testCase packageTestCase) {
 			Callbacks: types.CallbacksStruct{
 				OnMessageFunc: onMessageFunc,
 			},
-			PackagesStateProvider: localPackageState,
+			PackagesStateProvider: packagesStateProvider,
+			Downloaders:           testCase.downloaders,
 			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsPackages |
 				protobufs.AgentCapabilities_AgentCapabilities_ReportsPackageStatuses,
 		}
@@ -1207,6 +3450,9 @@ func verifyUpdatePackages(t *testing.T, testCase packageTestCase) {
 				expectedContent := testCase.expectedFileContent[pkgName]
 				assert.EqualValues(t, expectedContent, receivedContent)
 			}
+			if testCase.expectedFiles != nil {
+				assert.EqualValues(t, testCase.expectedFiles, localPackageState.GetFiles())
+			}
 		}
 
 		// Client --->
@@ -1324,6 +3570,29 @@ func TestUpdatePackages(t *testing.T) {
 	notFound.expectedStatus.Packages["package1"].ErrorMessage = "cannot download"
 	tests = append(tests, notFound)
 
+	// A case when the file is downloaded by a Downloader registered for the URL scheme.
+	customScheme := createPackageTestCase("downloader for custom scheme", downloadSrv)
+	customScheme.available.Packages["package1"].File.DownloadUrl = "test://validfile.pkg"
+	customScheme.downloaders = map[string]types.Downloader{
+		"test": &contentDownloader{content: packageFileContent},
+	}
+	tests = append(tests, customScheme)
+
+	// A case when there is no Downloader for the URL scheme.
+	unknownScheme := createPackageTestCase("no downloader for scheme", downloadSrv)
+	unknownScheme.available.Packages["package1"].File.DownloadUrl = "test://validfile.pkg"
+	unknownScheme.expectedStatus.Packages["package1"].Status = protobufs.PackageStatusEnum_PackageStatusEnum_InstallFailed
+	unknownScheme.expectedStatus.Packages["package1"].ErrorMessage = "no downloader for URL scheme"
+	tests = append(tests, unknownScheme)
+
+	// A case when the installed package fails verification and is rolled back.
+	verifyFailed := createPackageTestCase("verification failed", downloadSrv)
+	verifyFailed.verifyErr = errors.New("unexpected version")
+	verifyFailed.expectedStatus.Packages["package1"].Status = protobufs.PackageStatusEnum_PackageStatusEnum_InstallFailed
+	verifyFailed.expectedStatus.Packages["package1"].ErrorMessage = "failed verification: unexpected version"
+	verifyFailed.expectedFileContent = nil
+	tests = append(tests, verifyFailed)
+
 	// A case when OnPackagesAvailable callback returns an error.
 	errorOnCallback := createPackageTestCase("error on callback", downloadSrv)
 	errorOnCallback.expectedError = packageUpdateErrorMsg
@@ -1337,6 +3606,176 @@ func TestUpdatePackages(t *testing.T) {
 	}
 }
 
+// packagePatch is a BSDIFF40 patch that transforms packageFileContent into
+// patchedPackageFileContent.
+const packagePatch = "42534449464634302c0000000000000027000000000000002600000000000000425a6839314159" +
+	"2653598a86ee4b000005e0004808140020002129a6d066817c0ae1772453850908a86ee4b0425a" +
+	"6839314159265359b1d9abf0000000600040004000200021008283177245385090b1d9abf0425a" +
+	"6839314159265359977e8f0b0000011980400010002662958020003100d00104da4d3328280" +
+	"26ecca92b106f8bb9229c28484bbf478580"
+
+var patchedPackageFileContent = []byte("Package File Content v2 with more data")
+
+func TestUpdatePackagesWithPatch(t *testing.T) {
+	patch, err := hex.DecodeString(packagePatch)
+	require.NoError(t, err)
+
+	m := http.NewServeMux()
+	m.HandleFunc("/patch.bsdiff", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(patch)
+	})
+	m.HandleFunc("/full.pkg", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(patchedPackageFileContent)
+	})
+	downloadSrv := httptest.NewServer(m)
+	defer downloadSrv.Close()
+
+	baseContentHash := []byte{4, 5}
+	patchedHash := sha256.Sum256(patchedPackageFileContent)
+
+	// Installs package1 1.0.0 with packageFileContent.
+	installBase := func(store *internal.InMemPackagesStore) {
+		ctx := context.Background()
+		require.NoError(t, store.CreatePackage("package1", protobufs.PackageType_PackageType_TopLevel))
+		require.NoError(t, store.UpdateContent(ctx, "package1", bytes.NewReader(packageFileContent), baseContentHash))
+		require.NoError(t, store.SetPackageState("package1", types.PackageState{
+			Exists:  true,
+			Type:    protobufs.PackageType_PackageType_TopLevel,
+			Hash:    []byte{1, 2, 3},
+			Version: "1.0.0",
+		}))
+	}
+
+	createPatchTestCase := func(name string) packageTestCase {
+		test := createPackageTestCase(name, downloadSrv)
+		pkg := test.available.Packages["package1"]
+		pkg.Version = "2.0.0"
+		pkg.Hash = []byte{2, 3, 4}
+		pkg.File.DownloadUrl = downloadSrv.URL + "/patch.bsdiff#" +
+			types.PackagePatchBaseURLFragmentKey + "=" + hex.EncodeToString(baseContentHash) + "&" +
+			types.PackagePatchFullURLFragmentKey + "=" + url.QueryEscape(downloadSrv.URL+"/full.pkg")
+		pkg.File.ContentHash = patchedHash[:]
+		status := test.expectedStatus.Packages["package1"]
+		status.AgentHasVersion = "2.0.0"
+		status.AgentHasHash = []byte{2, 3, 4}
+		status.ServerOfferedVersion = "2.0.0"
+		status.ServerOfferedHash = []byte{2, 3, 4}
+		test.expectedFileContent = map[string][]byte{"package1": patchedPackageFileContent}
+		return test
+	}
+
+	// The Agent has the base content, the patch is applied. There is no full
+	// URL to fall back to.
+	applied := createPatchTestCase("patch applied")
+	applied.prepareStore = installBase
+	applied.available.Packages["package1"].File.DownloadUrl = downloadSrv.URL + "/patch.bsdiff#" +
+		types.PackagePatchBaseURLFragmentKey + "=" + hex.EncodeToString(baseContentHash)
+
+	// The Agent does not have the base content, the full file is downloaded.
+	fullDownload := createPatchTestCase("no base, full download")
+
+	for _, test := range []packageTestCase{applied, fullDownload} {
+		t.Run(test.name, func(t *testing.T) {
+			verifyUpdatePackages(t, test)
+		})
+	}
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func TestUpdateMultiFilePackage(t *testing.T) {
+	binContent := []byte("agent binary")
+	confContent := []byte("agent config")
+
+	manifest, err := json.Marshal(types.PackageManifest{
+		Files: []types.PackageManifestFile{
+			{Path: "bin/agent", DownloadUrl: "/files/agent", SHA256: sha256Hex(binContent)},
+			{Path: "conf/agent.yaml", DownloadUrl: "/files/agent.yaml", SHA256: sha256Hex(confContent)},
+		},
+	})
+	require.NoError(t, err)
+
+	corruptedManifest, err := json.Marshal(types.PackageManifest{
+		Files: []types.PackageManifestFile{
+			{Path: "bin/agent", DownloadUrl: "/files/agent", SHA256: sha256Hex(binContent)},
+			{Path: "conf/agent.yaml", DownloadUrl: "/files/agent.yaml", SHA256: sha256Hex(binContent)},
+		},
+	})
+	require.NoError(t, err)
+
+	m := http.NewServeMux()
+	m.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(manifest)
+	})
+	m.HandleFunc("/corrupted.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(corruptedManifest)
+	})
+	m.HandleFunc("/files/agent", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(binContent)
+	})
+	m.HandleFunc("/files/agent.yaml", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(confContent)
+	})
+	downloadSrv := httptest.NewServer(m)
+	defer downloadSrv.Close()
+
+	manifestHash := sha256.Sum256(manifest)
+	corruptedManifestHash := sha256.Sum256(corruptedManifest)
+
+	// The files of the previous version of the package.
+	installPrevious := func(store *internal.InMemPackagesStore) {
+		update, err := store.BeginFilesUpdate(context.Background(), "package1")
+		require.NoError(t, err)
+		require.NoError(t, update.WriteFile(context.Background(), "bin/agent", bytes.NewReader([]byte("old binary"))))
+		require.NoError(t, update.WriteFile(context.Background(), "bin/removed", bytes.NewReader([]byte("old file"))))
+		require.NoError(t, update.Commit(context.Background()))
+	}
+
+	success := createPackageTestCase("all files verified", downloadSrv)
+	success.available.Packages["package1"].File.DownloadUrl = downloadSrv.URL + "/manifest.json#" + types.PackageManifestURLFragment
+	success.available.Packages["package1"].File.ContentHash = manifestHash[:]
+	success.expectedFileContent = map[string][]byte{"package1": manifest}
+	success.expectedFiles = map[string]map[string][]byte{
+		"package1": {"bin/agent": binContent, "conf/agent.yaml": confContent},
+	}
+
+	// The files that are not in the manifest anymore are deleted.
+	replaced := createPackageTestCase("previous files replaced", downloadSrv)
+	replaced.prepareStore = installPrevious
+	replaced.available = success.available
+	replaced.expectedFileContent = success.expectedFileContent
+	replaced.expectedFiles = success.expectedFiles
+
+	// The previous files are kept if any of the files cannot be verified.
+	corrupted := createPackageTestCase("file hash mismatch", downloadSrv)
+	corrupted.prepareStore = installPrevious
+	corrupted.available.Packages["package1"].File.DownloadUrl = downloadSrv.URL + "/corrupted.json#" + types.PackageManifestURLFragment
+	corrupted.available.Packages["package1"].File.ContentHash = corruptedManifestHash[:]
+	corrupted.expectedStatus.Packages["package1"].Status = protobufs.PackageStatusEnum_PackageStatusEnum_InstallFailed
+	corrupted.expectedStatus.Packages["package1"].ErrorMessage = "1 of 2 files failed: file conf/agent.yaml"
+	corrupted.expectedFileContent = nil
+	corrupted.expectedFiles = map[string]map[string][]byte{
+		"package1": {"bin/agent": []byte("old binary"), "bin/removed": []byte("old file")},
+	}
+
+	// The manifest itself must match the content hash offered by the Server.
+	untrusted := createPackageTestCase("manifest hash mismatch", downloadSrv)
+	untrusted.available.Packages["package1"].File.DownloadUrl = downloadSrv.URL + "/manifest.json#" + types.PackageManifestURLFragment
+	untrusted.available.Packages["package1"].File.ContentHash = corruptedManifestHash[:]
+	untrusted.expectedStatus.Packages["package1"].Status = protobufs.PackageStatusEnum_PackageStatusEnum_InstallFailed
+	untrusted.expectedStatus.Packages["package1"].ErrorMessage = "cannot download manifest"
+	untrusted.expectedFileContent = nil
+
+	for _, test := range []packageTestCase{success, replaced, corrupted, untrusted} {
+		t.Run(test.name, func(t *testing.T) {
+			verifyUpdatePackages(t, test)
+		})
+	}
+}
+
 func TestMissingCapabilities(t *testing.T) {
 	testClients(t, func(t *testing.T, client OpAMPClient) {
 		// Start a server.
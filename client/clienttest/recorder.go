@@ -0,0 +1,70 @@
+// Package clienttest provides utilities for testing the Agents that use the OpAMP
+// client without network.
+package clienttest
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Recorder is a types.Sender that records the messages sent by the client created
+// by client.NewInMemory, so that the tests can assert on the exact messages.
+type Recorder struct {
+	mux      sync.Mutex
+	messages []*protobufs.AgentToServer
+	// The number of messages returned by Next.
+	next int
+	// Closed and replaced when a message is recorded.
+	recorded chan struct{}
+}
+
+var _ types.Sender = (*Recorder)(nil)
+
+// NewRecorder creates a new Recorder that has not recorded any messages yet.
+func NewRecorder() *Recorder {
+	return &Recorder{recorded: make(chan struct{})}
+}
+
+// Send implements types.Sender.Send. Records a copy of the message.
+func (r *Recorder) Send(_ context.Context, msg *protobufs.AgentToServer) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.messages = append(r.messages, proto.Clone(msg).(*protobufs.AgentToServer))
+	close(r.recorded)
+	r.recorded = make(chan struct{})
+	return nil
+}
+
+// Messages returns all the recorded messages in the order they were sent.
+func (r *Recorder) Messages() []*protobufs.AgentToServer {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]*protobufs.AgentToServer(nil), r.messages...)
+}
+
+// Next returns the oldest recorded message not returned by Next yet. Waits until
+// the client sends the message or ctx is done.
+func (r *Recorder) Next(ctx context.Context) (*protobufs.AgentToServer, error) {
+	for {
+		r.mux.Lock()
+		if r.next < len(r.messages) {
+			msg := r.messages[r.next]
+			r.next++
+			r.mux.Unlock()
+			return msg, nil
+		}
+		recorded := r.recorded
+		r.mux.Unlock()
+
+		select {
+		case <-recorded:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	ulid "github.com/oklog/ulid/v2"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Diagnosis is the result of Diagnose. It is intended to be marshalled to JSON, e.g.
+// to be attached to support tickets. Secrets are removed from all fields.
+type Diagnosis struct {
+	// Endpoint is the URL of the Server.
+	Endpoint string `json:"endpoint"`
+	// Transport used to connect to the Server, "WebSocket" or "HTTP".
+	Transport string `json:"transport,omitempty"`
+	// Connected is true if the Server responded to the first status report.
+	Connected bool `json:"connected"`
+	// Error describes why the handshake failed or the error reported by the Server.
+	// Empty if the handshake succeeded.
+	Error string `json:"error,omitempty"`
+
+	// ConnectLatencyMs is the time from starting to connect until the response to the
+	// first status report was received.
+	ConnectLatencyMs float64 `json:"connect_latency_ms,omitempty"`
+	// RoundTripLatencyMs is the time from sending the second status report until
+	// receiving the response, over the already established connection.
+	RoundTripLatencyMs float64 `json:"round_trip_latency_ms,omitempty"`
+
+	// TLSVersion is the negotiated TLS version, empty if the connection is not encrypted.
+	TLSVersion string `json:"tls_version,omitempty"`
+	// CompressionEnabled is true if the Server agreed to compress the messages.
+	CompressionEnabled bool `json:"compression_enabled"`
+	// ServerCapabilities are the names of the capabilities reported by the Server.
+	ServerCapabilities []string `json:"server_capabilities,omitempty"`
+
+	// Deviations from the OpAMP specification detected in the Server's responses.
+	Deviations []string `json:"deviations"`
+}
+
+// Number of status reports exchanged with the Server by Diagnose.
+const diagnoseReports = 2
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// diagnosticConn exchanges status reports with the Server for Diagnose.
+type diagnosticConn interface {
+	// exchange sends the msg and returns the Server's response.
+	exchange(ctx context.Context, msg *protobufs.AgentToServer) (*protobufs.ServerToAgent, error)
+	close()
+}
+
+// Diagnose checks the connectivity to the OpAMP Server and its conformance to the
+// OpAMP specification. It connects to the Server using the OpAMPServerURL, Header,
+// HeaderProvider, TokenSource, TLSConfig, DialContext and EnableCompression of the
+// settings, exchanges two minimal status reports and reports the latency, the
+// negotiated features and the deviations from the specification detected in the
+// Server's responses. The WebSocket transport is used for an "opamp+unix" URL.
+//
+// The status reports use settings.InstanceUid, or a random instance uid if it is
+// empty, so the Server sees the diagnosis as a connection of that Agent. Diagnose
+// is intended to be used while the Agent's OpAMPClient is stopped. The callbacks in
+// the settings are not called. The ctx limits the duration of the diagnosis.
+func Diagnose(ctx context.Context, settings types.StartSettings) *Diagnosis {
+	d := &Diagnosis{Endpoint: sharedinternal.RedactURL(settings.OpAMPServerURL), Deviations: []string{}}
+	redactor := internal.NewRedactor()
+	redactor.SetSecrets(settings.Header, settings.OpAMPServerURL)
+	fail := func(err error) *Diagnosis {
+		d.Error = redactor.Redact(err.Error())
+		return d
+	}
+
+	settings = internal.ResolveUnixSocket(settings, "ws")
+	u, err := url.Parse(settings.OpAMPServerURL)
+	if err != nil {
+		return fail(err)
+	}
+
+	// The diagnosis is short, the provided headers are used for all its requests.
+	headerProvider := internal.TokenHeaderProvider(
+		internal.TokenSource(settings.TokenSource), settings.HeaderProvider, nil,
+	)
+	settings.Header, err = internal.ProvidedHeader(ctx, settings.Header, headerProvider, redactor)
+	if err != nil {
+		return fail(err)
+	}
+
+	instanceUid := settings.InstanceUid
+	if instanceUid == "" {
+		instanceUid = ulid.MustNew(ulid.Timestamp(time.Now()), rand.Reader).String()
+	}
+	capabilities := settings.Capabilities | protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus
+
+	start := time.Now()
+	var conn diagnosticConn
+	switch u.Scheme {
+	case "ws", "wss":
+		d.Transport = types.TransportWebSocket.String()
+		if settings.TLSConfig != nil {
+			u.Scheme = "wss"
+		}
+		conn, err = dialWSDiagnostics(ctx, d, u.String(), settings)
+	case "http", "https":
+		d.Transport = types.TransportHTTP.String()
+		if settings.TLSConfig != nil {
+			u.Scheme = "https"
+		}
+		conn = newHTTPDiagnostics(d, u.String(), settings)
+	default:
+		err = fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.close()
+
+	for seq := uint64(0); seq < diagnoseReports; seq++ {
+		msg := &protobufs.AgentToServer{
+			InstanceUid:  instanceUid,
+			SequenceNum:  seq,
+			Capabilities: uint64(capabilities),
+		}
+		sentAt := time.Now()
+		response, err := conn.exchange(ctx, msg)
+		if err != nil {
+			return fail(err)
+		}
+
+		if seq == 0 {
+			d.Connected = true
+			d.ConnectLatencyMs = milliseconds(time.Since(start))
+			d.ServerCapabilities = serverCapabilityNames(protobufs.ServerCapabilities(response.Capabilities))
+		} else {
+			d.RoundTripLatencyMs = milliseconds(time.Since(sentAt))
+		}
+
+		checkDiagnosticResponse(d, msg, response)
+		if response.ErrorResponse != nil {
+			return fail(types.NewServerError(response.ErrorResponse))
+		}
+	}
+	return d
+}
+
+// checkDiagnosticResponse adds the deviations from the specification found in the
+// response to the msg to d.
+func checkDiagnosticResponse(d *Diagnosis, msg *protobufs.AgentToServer, response *protobufs.ServerToAgent) {
+	deviation := func(format string, a ...interface{}) {
+		d.Deviations = append(d.Deviations, fmt.Sprintf("response to report %d: ", msg.SequenceNum)+fmt.Sprintf(format, a...))
+	}
+
+	if response.InstanceUid != msg.InstanceUid {
+		deviation("instance_uid %q does not match the Agent's instance_uid %q", response.InstanceUid, msg.InstanceUid)
+	}
+
+	capabilities := protobufs.ServerCapabilities(response.Capabilities)
+	if capabilities&protobufs.ServerCapabilities_ServerCapabilities_AcceptsStatus == 0 {
+		deviation("capabilities do not include AcceptsStatus, which all Servers must set")
+	}
+	var known uint64
+	for value := range protobufs.ServerCapabilities_name {
+		known |= uint64(value)
+	}
+	if undefined := response.Capabilities &^ known; undefined != 0 {
+		deviation("capabilities have undefined bits set: 0x%x", undefined)
+	}
+
+	if undefined := response.Flags &^ uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState); undefined != 0 {
+		deviation("flags have undefined bits set: 0x%x", undefined)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func serverCapabilityNames(capabilities protobufs.ServerCapabilities) []string {
+	var names []string
+	for bit := protobufs.ServerCapabilities(1); bit != 0 && bit <= capabilities; bit <<= 1 {
+		if capabilities&bit == 0 {
+			continue
+		}
+		name, ok := protobufs.ServerCapabilities_name[int32(bit)]
+		if !ok {
+			name = fmt.Sprintf("0x%x", uint64(bit))
+		}
+		names = append(names, strings.TrimPrefix(name, "ServerCapabilities_"))
+	}
+	return names
+}
+
+type wsDiagnostics struct {
+	d    *Diagnosis
+	conn *websocket.Conn
+}
+
+func dialWSDiagnostics(ctx context.Context, d *Diagnosis, serverURL string, settings types.StartSettings) (*wsDiagnostics, error) {
+	dialer := newDialer(settings)
+
+	conn, resp, err := dialer.DialContext(ctx, serverURL, settings.Header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%v, server response code=%d", err, resp.StatusCode)
+		}
+		return nil, err
+	}
+
+	d.CompressionEnabled = strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	if state := resp.TLS; state != nil {
+		d.TLSVersion = tlsVersionNames[state.Version]
+	}
+	return &wsDiagnostics{d: d, conn: conn}, nil
+}
+
+func (w *wsDiagnostics) exchange(ctx context.Context, msg *protobufs.AgentToServer) (*protobufs.ServerToAgent, error) {
+	// Unblock reading when ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = w.conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if err := sharedinternal.WriteWSMessage(w.conn, msg); err != nil {
+		return nil, err
+	}
+	messageType, data, err := w.conn.ReadMessage()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("cannot read the response: %v", err)
+	}
+
+	if messageType != websocket.BinaryMessage {
+		w.d.Deviations = append(w.d.Deviations, fmt.Sprintf("response to report %d: not a binary WebSocket message", msg.SequenceNum))
+	}
+	if len(data) == 0 || data[0] != 0 {
+		w.d.Deviations = append(w.d.Deviations, fmt.Sprintf("response to report %d: the message header is missing", msg.SequenceNum))
+	}
+	response := &protobufs.ServerToAgent{}
+	if err := sharedinternal.DecodeWSMessage(data, response); err != nil {
+		return nil, fmt.Errorf("cannot decode the response: %v", err)
+	}
+	return response, nil
+}
+
+func (w *wsDiagnostics) close() {
+	_ = w.conn.Close()
+}
+
+type httpDiagnostics struct {
+	d         *Diagnosis
+	url       string
+	header    http.Header
+	client    *http.Client
+	transport *http.Transport
+}
+
+func newHTTPDiagnostics(d *Diagnosis, serverURL string, settings types.StartSettings) *httpDiagnostics {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = settings.TLSConfig
+	transport.Proxy = internal.ProxyFunc(settings)
+	if settings.DialContext != nil {
+		transport.DialContext = settings.DialContext
+	}
+	// Let the Server compress the responses if it supports it.
+	transport.DisableCompression = !settings.EnableCompression
+
+	header := settings.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/x-protobuf")
+
+	h := &httpDiagnostics{
+		d:         d,
+		url:       serverURL,
+		header:    header,
+		client:    &http.Client{Transport: transport},
+		transport: transport,
+	}
+	if settings.HTTPRoundTripper != nil {
+		h.client = &http.Client{Transport: settings.HTTPRoundTripper}
+	}
+	return h
+}
+
+func (h *httpDiagnostics) exchange(ctx context.Context, msg *protobufs.AgentToServer) (*protobufs.ServerToAgent, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, internal.OpAMPPlainHTTPMethod, h.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = h.header
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server response code=%d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/x-protobuf" {
+		h.d.Deviations = append(h.d.Deviations,
+			fmt.Sprintf("response to report %d: Content-Type is %q instead of application/x-protobuf", msg.SequenceNum, contentType))
+	}
+	h.d.CompressionEnabled = resp.Uncompressed
+	if resp.TLS != nil {
+		h.d.TLSVersion = tlsVersionNames[resp.TLS.Version]
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the response: %v", err)
+	}
+	response := &protobufs.ServerToAgent{}
+	if err := proto.Unmarshal(body, response); err != nil {
+		return nil, fmt.Errorf("cannot decode the response: %v", err)
+	}
+	return response, nil
+}
+
+func (h *httpDiagnostics) close() {
+	h.transport.CloseIdleConnections()
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestDiagnose(t *testing.T) {
+	for _, scheme := range []string{"ws", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			srv := internal.StartMockServer(t)
+			defer srv.Close()
+			srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+				return &protobufs.ServerToAgent{
+					InstanceUid: msg.InstanceUid,
+					Capabilities: uint64(protobufs.ServerCapabilities_ServerCapabilities_AcceptsStatus |
+						protobufs.ServerCapabilities_ServerCapabilities_OffersRemoteConfig),
+				}
+			}
+
+			d := Diagnose(context.Background(), types.StartSettings{
+				OpAMPServerURL: scheme + "://" + srv.Endpoint,
+				Header:         http.Header{"Authorization": {"Bearer s3cr3t-t0ken"}},
+			})
+			assert.True(t, d.Connected)
+			assert.Empty(t, d.Error)
+			assert.Positive(t, d.ConnectLatencyMs)
+			assert.Positive(t, d.RoundTripLatencyMs)
+			assert.EqualValues(t, []string{"AcceptsStatus", "OffersRemoteConfig"}, d.ServerCapabilities)
+			assert.Empty(t, d.Deviations)
+
+			b, err := json.Marshal(d)
+			require.NoError(t, err)
+			assert.NotContains(t, string(b), "s3cr3t-t0ken")
+		})
+	}
+}
+
+func TestDiagnoseDeviations(t *testing.T) {
+	for _, scheme := range []string{"ws", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			srv := internal.StartMockServer(t)
+			defer srv.Close()
+			srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+				return &protobufs.ServerToAgent{
+					InstanceUid:  "other",
+					Capabilities: 1 << 20,
+					Flags:        4,
+				}
+			}
+
+			d := Diagnose(context.Background(), types.StartSettings{OpAMPServerURL: scheme + "://" + srv.Endpoint})
+			assert.True(t, d.Connected)
+			// 4 deviations in each of the 2 responses.
+			assert.Len(t, d.Deviations, 8)
+			assert.Contains(t, d.Deviations[0], "instance_uid")
+			assert.Contains(t, d.Deviations[1], "AcceptsStatus")
+			assert.Contains(t, d.Deviations[2], "capabilities have undefined bits set: 0x100000")
+			assert.Contains(t, d.Deviations[3], "flags have undefined bits set: 0x4")
+		})
+	}
+}
+
+func TestDiagnoseServerError(t *testing.T) {
+	srv := internal.StartMockServer(t)
+	defer srv.Close()
+	srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+		return &protobufs.ServerToAgent{
+			InstanceUid:  msg.InstanceUid,
+			Capabilities: uint64(protobufs.ServerCapabilities_ServerCapabilities_AcceptsStatus),
+			ErrorResponse: &protobufs.ServerErrorResponse{
+				Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest,
+				ErrorMessage: "unknown agent",
+			},
+		}
+	}
+
+	d := Diagnose(context.Background(), types.StartSettings{OpAMPServerURL: "ws://" + srv.Endpoint})
+	assert.True(t, d.Connected)
+	assert.EqualValues(t, "bad request: unknown agent", d.Error)
+	assert.Empty(t, d.Deviations)
+}
+
+func TestDiagnoseNoServer(t *testing.T) {
+	d := Diagnose(context.Background(), createNoServerSettings())
+	assert.False(t, d.Connected)
+	assert.NotEmpty(t, d.Error)
+}
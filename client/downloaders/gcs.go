@@ -0,0 +1,268 @@
+package downloaders
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// GCSScheme is the URL scheme of the files stored in Google Cloud Storage.
+const GCSScheme = "gs"
+
+const (
+	gcsEndpoint         = "https://storage.googleapis.com"
+	gcsReadOnlyScope    = "https://www.googleapis.com/auth/devstorage.read_only"
+	googleTokenURL      = "https://oauth2.googleapis.com/token"
+	gceMetadataEndpoint = "http://metadata.google.internal"
+)
+
+var errNoGoogleCredentials = errors.New("no Google credentials found")
+
+// GCSDownloader downloads package files stored in Google Cloud Storage. The files
+// are referenced by URLs in the form:
+//
+//	gs://<bucket>/<object>
+//
+// The credentials are looked up using the Application Default Credentials chain:
+// the file pointed to by GOOGLE_APPLICATION_CREDENTIALS, the gcloud well-known
+// file (~/.config/gcloud/application_default_credentials.json) and finally the
+// service account of the GCE instance. Both service account keys and user
+// credentials are supported. The request is sent anonymously if no credentials
+// are found.
+type GCSDownloader struct {
+	// Client is the HTTP client used to talk to GCS. http.DefaultClient is used if nil.
+	Client *http.Client
+
+	// Endpoint can be set to override the GCS endpoint, e.g. for testing.
+	Endpoint string
+}
+
+var _ types.Downloader = (*GCSDownloader)(nil)
+
+// Download implements types.Downloader.
+func (d *GCSDownloader) Download(ctx context.Context, file *protobufs.DownloadableFile) (io.ReadCloser, error) {
+	u, err := url.Parse(file.DownloadUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != GCSScheme || u.Host == "" || len(u.Path) <= 1 {
+		return nil, fmt.Errorf("invalid GCS URL %s, must be gs://<bucket>/<object>", file.DownloadUrl)
+	}
+	bucket := u.Host
+	object := strings.TrimPrefix(u.Path, "/")
+
+	endpoint := d.Endpoint
+	if endpoint == "" {
+		endpoint = gcsEndpoint
+	}
+	objectURL := fmt.Sprintf(
+		"%s/storage/v1/b/%s/o/%s?alt=media",
+		strings.TrimSuffix(endpoint, "/"), url.PathEscape(bucket), url.PathEscape(object),
+	)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := d.accessToken(ctx)
+	if err != nil && !errors.Is(err, errNoGoogleCredentials) {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("cannot fetch gs://%s/%s, HTTP response=%v", bucket, object, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (d *GCSDownloader) httpClient() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	return http.DefaultClient
+}
+
+// googleCredentialsFile is the format of the Application Default Credentials file.
+type googleCredentialsFile struct {
+	Type string `json:"type"`
+
+	// Service account key fields.
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	// User credentials fields.
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// accessToken walks the Application Default Credentials chain.
+func (d *GCSDownloader) accessToken(ctx context.Context) (string, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		path = wellKnownGoogleCredentialsFile()
+		if _, err := os.Stat(path); err != nil {
+			return d.gceAccessToken(ctx)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read Google credentials: %v", err)
+	}
+	var creds googleCredentialsFile
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return "", fmt.Errorf("cannot parse Google credentials %s: %v", path, err)
+	}
+
+	switch creds.Type {
+	case "service_account":
+		return d.serviceAccountAccessToken(ctx, &creds)
+	case "authorized_user":
+		return d.exchangeToken(ctx, googleTokenURL, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {creds.ClientID},
+			"client_secret": {creds.ClientSecret},
+			"refresh_token": {creds.RefreshToken},
+		})
+	}
+	return "", fmt.Errorf("unsupported Google credentials type %q", creds.Type)
+}
+
+func wellKnownGoogleCredentialsFile() string {
+	const file = "application_default_credentials.json"
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", file)
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "gcloud", file)
+}
+
+// serviceAccountAccessToken exchanges a JWT signed by the service account key for an
+// access token (see https://developers.google.com/identity/protocols/oauth2/service-account).
+func (d *GCSDownloader) serviceAccountAccessToken(ctx context.Context, creds *googleCredentialsFile) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("cannot decode service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse service account private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("service account private key is not an RSA key")
+	}
+
+	tokenURI := creds.TokenURI
+	if tokenURI == "" {
+		tokenURI = googleTokenURL
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": creds.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcsReadOnlyScope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	return d.exchangeToken(ctx, tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+}
+
+func (d *GCSDownloader) exchangeToken(ctx context.Context, tokenURL string, form url.Values) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return d.readAccessToken(req)
+}
+
+// gceAccessToken fetches the token of the instance service account from the GCE
+// metadata server.
+func (d *GCSDownloader) gceAccessToken(ctx context.Context) (string, error) {
+	// Do not hang for long if we are not running on GCE.
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet,
+		gceMetadataEndpoint+"/computeMetadata/v1/instance/service-accounts/default/token", nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	token, err := d.readAccessToken(req)
+	if err != nil {
+		return "", errNoGoogleCredentials
+	}
+	return token, nil
+}
+
+func (d *GCSDownloader) readAccessToken(req *http.Request) (string, error) {
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot obtain Google access token, HTTP response=%v", resp.StatusCode)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("cannot parse Google access token response: %v", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", errors.New("Google token response contains no access token")
+	}
+	return tokenResp.AccessToken, nil
+}
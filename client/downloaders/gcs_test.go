@@ -0,0 +1,78 @@
+package downloaders
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestGCSDownloadWithServiceAccount(t *testing.T) {
+	const accessToken = "access-token"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.EqualValues(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.Form.Get("grant_type"))
+		assert.Len(t, strings.Split(r.Form.Get("assertion"), "."), 3)
+		_, _ = w.Write([]byte(`{"access_token":"` + accessToken + `"}`))
+	})
+	mux.HandleFunc("/storage/v1/b/bucket/o/", func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues(t, "/storage/v1/b/bucket/o/agents%2Fagent.tar.gz", r.URL.EscapedPath())
+		assert.EqualValues(t, "media", r.URL.Query().Get("alt"))
+		if r.Header.Get("Authorization") != "Bearer "+accessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(blobContent)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// Create a service account key file that uses the test token endpoint.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	credsJSON, err := json.Marshal(googleCredentialsFile{
+		Type:        "service_account",
+		ClientEmail: "agent@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})),
+		TokenURI:    srv.URL + "/token",
+	})
+	require.NoError(t, err)
+	credsPath := filepath.Join(t.TempDir(), "creds.json")
+	require.NoError(t, os.WriteFile(credsPath, credsJSON, 0600))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credsPath)
+
+	d := &GCSDownloader{Endpoint: srv.URL}
+	r, err := d.Download(context.Background(), &protobufs.DownloadableFile{
+		DownloadUrl: "gs://bucket/agents/agent.tar.gz",
+	})
+	require.NoError(t, err)
+	defer func() { _ = r.Close() }()
+
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, blobContent, content)
+}
+
+func TestGCSDownloadInvalidURL(t *testing.T) {
+	d := &GCSDownloader{}
+	_, err := d.Download(context.Background(), &protobufs.DownloadableFile{DownloadUrl: "gs://bucket"})
+	assert.Error(t, err)
+}
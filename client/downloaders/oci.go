@@ -0,0 +1,293 @@
+// Package downloaders contains types.Downloader implementations that allow package
+// files to be downloaded from sources other than plain HTTP(S) URLs.
+//
+// The package is a separate Go module, so that the OpAMP client does not depend on
+// the cloud provider specific code unless the Agent opts in to use it.
+package downloaders
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// OCIScheme is the URL scheme of the files stored in OCI registries.
+const OCIScheme = "oci"
+
+const ociDigestAlgorithm = "sha256"
+
+var (
+	errOCIDigestMismatch      = errors.New("downloaded content does not match the digest")
+	errOCIContentHashMismatch = errors.New("digest does not match the file content hash")
+	errOCIInsecureRealm       = errors.New("registry token realm must use https")
+)
+
+// OCIDownloader downloads package files stored as blobs in OCI registries. The
+// files are referenced by URLs in the form:
+//
+//	oci://<registry>/<repository>@sha256:<hex digest>
+//
+// For example "oci://ghcr.io/org/agent@sha256:9f86d0...". The digest is the digest
+// of the blob that contains the package file. The downloaded content is verified
+// against the digest, and the digest must match DownloadableFile.ContentHash if the
+// Server specified it.
+type OCIDownloader struct {
+	// Client is the HTTP client used to talk to the registry. http.DefaultClient
+	// is used if nil.
+	Client *http.Client
+
+	// Optional credentials used to obtain the registry token. Anonymous access
+	// is used if Username is empty. The credentials are only sent to the token
+	// realm if it is on the registry host or on one of the TokenHosts.
+	Username string
+	Password string
+
+	// TokenHosts are the hosts, in addition to the registry host, that the
+	// credentials may be sent to when the registry delegates the authentication to
+	// a separate token service, e.g. "auth.docker.io". An entry without a port
+	// matches any port of the host.
+	TokenHosts []string
+
+	// PlainHTTP can be set to true to talk to the registry and the token realm
+	// over plain HTTP. Should only be used for local testing.
+	PlainHTTP bool
+}
+
+var _ types.Downloader = (*OCIDownloader)(nil)
+
+type ociReference struct {
+	registry   string
+	repository string
+	digest     []byte
+}
+
+func parseOCIReference(rawURL string) (*ociReference, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != OCIScheme {
+		return nil, fmt.Errorf("not an %s URL: %s", OCIScheme, rawURL)
+	}
+
+	repository, digest, found := cut(strings.TrimPrefix(u.Path, "/"), "@")
+	if !found || repository == "" {
+		return nil, fmt.Errorf("OCI reference %s must specify a digest", rawURL)
+	}
+	algorithm, hexDigest, _ := cut(digest, ":")
+	if algorithm != ociDigestAlgorithm {
+		return nil, fmt.Errorf("unsupported digest algorithm in %s", rawURL)
+	}
+	digestBytes, err := hex.DecodeString(hexDigest)
+	if err != nil || len(digestBytes) != sha256.Size {
+		return nil, fmt.Errorf("invalid digest in %s", rawURL)
+	}
+
+	return &ociReference{registry: u.Host, repository: repository, digest: digestBytes}, nil
+}
+
+func (r *ociReference) digestString() string {
+	return ociDigestAlgorithm + ":" + hex.EncodeToString(r.digest)
+}
+
+// Download implements types.Downloader.
+func (d *OCIDownloader) Download(ctx context.Context, file *protobufs.DownloadableFile) (io.ReadCloser, error) {
+	ref, err := parseOCIReference(file.DownloadUrl)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.ContentHash) != 0 && !bytes.Equal(file.ContentHash, ref.digest) {
+		return nil, errOCIContentHashMismatch
+	}
+
+	scheme := "https"
+	if d.PlainHTTP {
+		scheme = "http"
+	}
+	blobURL := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", scheme, ref.registry, ref.repository, ref.digestString())
+
+	resp, err := d.get(ctx, blobURL, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Obtain a token as requested by the registry and try again.
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+
+		token, err := d.fetchToken(ctx, ref.registry, challenge)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = d.get(ctx, blobURL, "Bearer "+token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("cannot fetch blob %s, HTTP response=%v", ref.digestString(), resp.StatusCode)
+	}
+
+	return &digestVerifyingReader{body: resp.Body, hash: sha256.New(), expected: ref.digest}, nil
+}
+
+func (d *OCIDownloader) httpClient() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	return http.DefaultClient
+}
+
+func (d *OCIDownloader) get(ctx context.Context, url string, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return d.httpClient().Do(req)
+}
+
+// fetchToken obtains a bearer token as described by the WWW-Authenticate challenge
+// returned by the registry (see https://docs.docker.com/registry/spec/auth/token/).
+func (d *OCIDownloader) fetchToken(ctx context.Context, registry string, challenge string) (string, error) {
+	scheme, params, _ := cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unsupported registry authentication challenge %q", challenge)
+	}
+
+	attrs := parseChallengeParams(params)
+	realm := attrs["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("registry authentication challenge has no realm: %q", challenge)
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	if tokenURL.Scheme != "https" && !(d.PlainHTTP && tokenURL.Scheme == "http") {
+		return "", errOCIInsecureRealm
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if attrs[key] != "" {
+			query.Set(key, attrs[key])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if d.Username != "" {
+		if !d.isTokenHost(registry, tokenURL) {
+			return "", fmt.Errorf("refusing to send registry credentials to token realm host %s", tokenURL.Host)
+		}
+		req.SetBasicAuth(d.Username, d.Password)
+	}
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot obtain registry token, HTTP response=%v", resp.StatusCode)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("cannot parse registry token response: %v", err)
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", errors.New("registry token response contains no token")
+}
+
+// isTokenHost returns true if the credentials may be sent to the token URL.
+func (d *OCIDownloader) isTokenHost(registry string, tokenURL *url.URL) bool {
+	if strings.EqualFold(tokenURL.Host, registry) {
+		return true
+	}
+	for _, host := range d.TokenHosts {
+		if strings.EqualFold(tokenURL.Host, host) || strings.EqualFold(tokenURL.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChallengeParams parses the comma separated key="value" pairs of a
+// WWW-Authenticate header.
+func parseChallengeParams(params string) map[string]string {
+	attrs := map[string]string{}
+	for params != "" {
+		var key, value string
+		key, params, _ = cut(strings.TrimLeft(params, " ,"), "=")
+		if strings.HasPrefix(params, `"`) {
+			value, params, _ = cut(params[1:], `"`)
+		} else {
+			value, params, _ = cut(params, ",")
+		}
+		if key != "" {
+			attrs[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+	return attrs
+}
+
+// cut slices s around the first instance of sep. Same as strings.Cut, which is
+// not available in the Go version this module supports.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// digestVerifyingReader computes the digest of the content while it is read and
+// returns an error instead of io.EOF if the digest does not match.
+type digestVerifyingReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+}
+
+func (r *digestVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.expected) {
+		return n, errOCIDigestMismatch
+	}
+	return n, err
+}
+
+func (r *digestVerifyingReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,168 @@
+package downloaders
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+var blobContent = []byte("Package File Content")
+
+// startFakeRegistry starts a registry that serves the content at the blob digest
+// and requires a bearer token.
+func startFakeRegistry(t *testing.T, content []byte) (host string, digest []byte) {
+	sum := sha256.Sum256(blobContent)
+	digest = sum[:]
+	const token = "secret-token"
+
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues(t, "registry", r.URL.Query().Get("service"))
+		assert.EqualValues(t, "repository:org/agent:pull", r.URL.Query().Get("scope"))
+		_, _ = w.Write([]byte(`{"token":"` + token + `"}`))
+	})
+	mux.HandleFunc("/v2/org/agent/blobs/sha256:"+hex.EncodeToString(digest), func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set(
+				"WWW-Authenticate",
+				`Bearer realm="`+srv.URL+`/token",service="registry",scope="repository:org/agent:pull"`,
+			)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(content)
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	return u.Host, digest
+}
+
+func download(t *testing.T, file *protobufs.DownloadableFile) ([]byte, error) {
+	d := &OCIDownloader{PlainHTTP: true}
+	r, err := d.Download(context.Background(), file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	return io.ReadAll(r)
+}
+
+func TestOCIDownload(t *testing.T) {
+	host, digest := startFakeRegistry(t, blobContent)
+
+	content, err := download(t, &protobufs.DownloadableFile{
+		DownloadUrl: "oci://" + host + "/org/agent@sha256:" + hex.EncodeToString(digest),
+		ContentHash: digest,
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, blobContent, content)
+}
+
+func TestOCIDownloadContentHashMismatch(t *testing.T) {
+	host, digest := startFakeRegistry(t, blobContent)
+
+	_, err := download(t, &protobufs.DownloadableFile{
+		DownloadUrl: "oci://" + host + "/org/agent@sha256:" + hex.EncodeToString(digest),
+		ContentHash: []byte{1, 2, 3},
+	})
+	assert.ErrorIs(t, err, errOCIContentHashMismatch)
+}
+
+func TestOCIDownloadCorruptedBlob(t *testing.T) {
+	host, digest := startFakeRegistry(t, []byte("corrupted"))
+
+	_, err := download(t, &protobufs.DownloadableFile{
+		DownloadUrl: "oci://" + host + "/org/agent@sha256:" + hex.EncodeToString(digest),
+	})
+	assert.ErrorIs(t, err, errOCIDigestMismatch)
+}
+
+func TestParseOCIReference(t *testing.T) {
+	digest := hex.EncodeToString(make([]byte, sha256.Size))
+
+	ref, err := parseOCIReference("oci://ghcr.io/org/team/agent@sha256:" + digest)
+	require.NoError(t, err)
+	assert.EqualValues(t, "ghcr.io", ref.registry)
+	assert.EqualValues(t, "org/team/agent", ref.repository)
+	assert.EqualValues(t, "sha256:"+digest, ref.digestString())
+
+	for _, invalid := range []string{
+		"https://ghcr.io/org/agent@sha256:" + digest,
+		"oci://ghcr.io/org/agent:latest",
+		"oci://ghcr.io/org/agent@sha512:" + digest,
+		"oci://ghcr.io/org/agent@sha256:abc",
+	} {
+		_, err := parseOCIReference(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestOCIDownloadCredentials(t *testing.T) {
+	sum := sha256.Sum256(blobContent)
+	digest := sum[:]
+	const token = "secret-token"
+
+	// The token service runs on a different host than the registry.
+	var credentialsSent bool
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, credentialsSent = r.BasicAuth()
+		_, _ = w.Write([]byte(`{"token":"` + token + `"}`))
+	}))
+	defer tokenSrv.Close()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenSrv.URL+`/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(blobContent)
+	}))
+	defer registry.Close()
+
+	registryURL, err := url.Parse(registry.URL)
+	require.NoError(t, err)
+	tokenURL, err := url.Parse(tokenSrv.URL)
+	require.NoError(t, err)
+	file := &protobufs.DownloadableFile{
+		DownloadUrl: "oci://" + registryURL.Host + "/org/agent@sha256:" + hex.EncodeToString(digest),
+	}
+
+	// The credentials are not sent to an unknown token host.
+	d := &OCIDownloader{Username: "user", Password: "password", PlainHTTP: true}
+	_, err = d.Download(context.Background(), file)
+	assert.Error(t, err)
+	assert.False(t, credentialsSent)
+
+	// Anonymous access is allowed.
+	d = &OCIDownloader{PlainHTTP: true}
+	r, err := d.Download(context.Background(), file)
+	require.NoError(t, err)
+	_ = r.Close()
+	assert.False(t, credentialsSent)
+
+	// The credentials are sent to the allowed token host.
+	d = &OCIDownloader{Username: "user", Password: "password", TokenHosts: []string{tokenURL.Host}, PlainHTTP: true}
+	r, err = d.Download(context.Background(), file)
+	require.NoError(t, err)
+	_ = r.Close()
+	assert.True(t, credentialsSent)
+
+	// The token realm must use https unless plain HTTP is allowed.
+	_, err = (&OCIDownloader{}).fetchToken(context.Background(), registryURL.Host, `Bearer realm="`+tokenSrv.URL+`/token"`)
+	assert.ErrorIs(t, err, errOCIInsecureRealm)
+}
@@ -0,0 +1,234 @@
+package downloaders
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// S3Scheme is the URL scheme of the files stored in Amazon S3.
+const S3Scheme = "s3"
+
+const (
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+	awsTimeFormat       = "20060102T150405Z"
+	awsDateFormat       = "20060102"
+	emptyPayloadHash    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Downloader downloads package files stored in Amazon S3 or S3 compatible object
+// storage. The files are referenced by URLs in the form:
+//
+//	s3://<bucket>/<key>
+//
+// The credentials are looked up using the standard AWS credential chain, see
+// credentials for the details. The request is sent anonymously if no credentials
+// are found.
+type S3Downloader struct {
+	// Client is the HTTP client used to talk to S3. http.DefaultClient is used if nil.
+	Client *http.Client
+
+	// Region of the bucket. If empty the AWS_REGION or AWS_DEFAULT_REGION environment
+	// variables are used, defaulting to "us-east-1".
+	Region string
+
+	// Endpoint can be set to use S3 compatible storage, e.g. "https://minio.local:9000".
+	// Path-style requests are used with custom endpoints. If empty the AWS endpoint
+	// for the region is used.
+	Endpoint string
+
+	// Credentials can be set to override the credential chain.
+	Credentials *AWSCredentials
+
+	now         func() time.Time
+	stsEndpoint string
+}
+
+var _ types.Downloader = (*S3Downloader)(nil)
+
+// Download implements types.Downloader.
+func (d *S3Downloader) Download(ctx context.Context, file *protobufs.DownloadableFile) (io.ReadCloser, error) {
+	u, err := url.Parse(file.DownloadUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != S3Scheme || u.Host == "" || len(u.Path) <= 1 {
+		return nil, fmt.Errorf("invalid S3 URL %s, must be s3://<bucket>/<key>", file.DownloadUrl)
+	}
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+
+	region := d.region()
+	var objectURL string
+	if d.Endpoint != "" {
+		objectURL = strings.TrimSuffix(d.Endpoint, "/") + "/" + bucket + "/" + escapePath(key)
+	} else {
+		objectURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, escapePath(key))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := d.credentials(ctx)
+	if err != nil && !errors.Is(err, errNoAWSCredentials) {
+		return nil, err
+	}
+	if creds != nil {
+		req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+		signAWSv4(req, creds, region, "s3", d.currentTime(), emptyPayloadHash)
+	}
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("cannot fetch s3://%s/%s, HTTP response=%v", bucket, key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (d *S3Downloader) httpClient() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	return http.DefaultClient
+}
+
+func (d *S3Downloader) currentTime() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+func (d *S3Downloader) region() string {
+	if d.Region != "" {
+		return d.Region
+	}
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+// signAWSv4 signs the request using AWS Signature Version 4. All headers that are
+// set on the request at the time of the call are signed.
+func signAWSv4(req *http.Request, creds *AWSCredentials, region, service string, now time.Time, payloadHash string) {
+	now = now.UTC()
+	amzDate := now.Format(awsTimeFormat)
+	date := now.Format(awsDateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// Canonical headers, including the host which is not in req.Header.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, creds.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything except the unreserved characters, as
+// required by AWS Signature Version 4.
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// escapePath escapes the object key, keeping the "/" separators.
+func escapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
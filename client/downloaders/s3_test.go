@@ -0,0 +1,178 @@
+package downloaders
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+var testAWSCredentials = &AWSCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSignAWSv4(t *testing.T) {
+	// "get-vanilla" case from the AWS Signature Version 4 test suite.
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+
+	signAWSv4(req, testAWSCredentials, "us-east-1", "service",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC), emptyPayloadHash)
+
+	assert.EqualValues(t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, "+
+			"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"),
+	)
+}
+
+func TestS3Download(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues(t, "/bucket/agents/agent%201.0.tar.gz", r.URL.EscapedPath())
+		assert.True(t, strings.HasPrefix(
+			r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/",
+		))
+		assert.EqualValues(t, emptyPayloadHash, r.Header.Get("X-Amz-Content-Sha256"))
+		_, _ = w.Write(blobContent)
+	}))
+	defer srv.Close()
+
+	d := &S3Downloader{Endpoint: srv.URL, Region: "eu-west-1", Credentials: testAWSCredentials}
+	r, err := d.Download(context.Background(), &protobufs.DownloadableFile{
+		DownloadUrl: "s3://bucket/agents/agent 1.0.tar.gz",
+	})
+	require.NoError(t, err)
+	defer func() { _ = r.Close() }()
+
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, blobContent, content)
+}
+
+// clearAWSEnv unsets the environment variables of the credential chain.
+func clearAWSEnv(t *testing.T) {
+	for _, env := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE",
+		"AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_SESSION_NAME",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+	} {
+		t.Setenv(env, "")
+	}
+	dir := t.TempDir()
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+}
+
+func TestAWSProfileCredentials(t *testing.T) {
+	clearAWSEnv(t)
+	require.NoError(t, os.WriteFile(os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), []byte(`
+[default]
+aws_access_key_id = default-key
+aws_secret_access_key = default-secret
+
+[agents]
+aws_access_key_id = agents-key
+aws_secret_access_key = agents-secret
+aws_session_token = agents-token
+`), 0600))
+	require.NoError(t, os.WriteFile(os.Getenv("AWS_CONFIG_FILE"), []byte(`
+[default]
+aws_access_key_id = config-key
+aws_secret_access_key = config-secret
+
+[profile sso]
+aws_access_key_id = sso-key
+aws_secret_access_key = sso-secret
+`), 0600))
+
+	d := &S3Downloader{}
+	creds, err := d.credentials(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, &AWSCredentials{AccessKeyID: "default-key", SecretAccessKey: "default-secret"}, creds)
+
+	t.Setenv("AWS_PROFILE", "agents")
+	creds, err = d.credentials(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, &AWSCredentials{
+		AccessKeyID: "agents-key", SecretAccessKey: "agents-secret", SessionToken: "agents-token",
+	}, creds)
+
+	t.Setenv("AWS_PROFILE", "sso")
+	creds, err = d.credentials(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, &AWSCredentials{AccessKeyID: "sso-key", SecretAccessKey: "sso-secret"}, creds)
+}
+
+func TestAWSWebIdentityCredentials(t *testing.T) {
+	clearAWSEnv(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("web-token\n"), 0600))
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/agents")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_SESSION_NAME", "agent")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.EqualValues(t, "AssumeRoleWithWebIdentity", r.Form.Get("Action"))
+		assert.EqualValues(t, "arn:aws:iam::123456789012:role/agents", r.Form.Get("RoleArn"))
+		assert.EqualValues(t, "agent", r.Form.Get("RoleSessionName"))
+		assert.EqualValues(t, "web-token", r.Form.Get("WebIdentityToken"))
+		assert.Empty(t, r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>web-key</AccessKeyId>
+      <SecretAccessKey>web-secret</SecretAccessKey>
+      <SessionToken>web-session</SessionToken>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer srv.Close()
+
+	d := &S3Downloader{stsEndpoint: srv.URL}
+	creds, err := d.credentials(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, &AWSCredentials{
+		AccessKeyID: "web-key", SecretAccessKey: "web-secret", SessionToken: "web-session",
+	}, creds)
+}
+
+func TestAWSContainerCredentials(t *testing.T) {
+	clearAWSEnv(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("pod-token"), 0600))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues(t, "pod-token", r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`{"AccessKeyId":"task-key","SecretAccessKey":"task-secret","Token":"task-token"}`))
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", srv.URL+"/v1/credentials")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", tokenFile)
+
+	d := &S3Downloader{}
+	creds, err := d.credentials(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, &AWSCredentials{
+		AccessKeyID: "task-key", SecretAccessKey: "task-secret", SessionToken: "task-token",
+	}, creds)
+
+	// The token must not be sent in plain text off the host.
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "http://credentials.example.com/v1/credentials")
+	_, err = d.credentials(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,385 @@
+package downloaders
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// The instance metadata service of EC2 instances.
+	ec2MetadataEndpoint = "http://169.254.169.254"
+
+	// The credentials endpoint of ECS tasks, AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+	// is relative to it.
+	ecsCredentialsEndpoint = "http://169.254.170.2"
+
+	stsAPIVersion = "2011-06-15"
+)
+
+var (
+	errNoAWSCredentials = errors.New("no AWS credentials found")
+
+	// The hosts AWS_CONTAINER_CREDENTIALS_FULL_URI may point to over plain HTTP,
+	// besides the loopback addresses: the EKS Pod Identity Agent.
+	containerCredentialsHosts = []string{"169.254.170.23", "fd00:ec2::23"}
+)
+
+// AWSCredentials are the credentials used to sign the requests to S3.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// credentials walks the standard AWS credential chain:
+//
+//  1. The AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+//     variables.
+//  2. The profile AWS_PROFILE (or "default") of the shared credentials file
+//     (AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials) and of the shared config
+//     file (AWS_CONFIG_FILE or ~/.aws/config). The profile can either contain static
+//     keys or a role_arn and a web_identity_token_file.
+//  3. Web identity federation configured by the AWS_ROLE_ARN and
+//     AWS_WEB_IDENTITY_TOKEN_FILE environment variables, e.g. IAM roles for service
+//     accounts on EKS.
+//  4. The container credentials endpoint configured by the
+//     AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI
+//     environment variables, e.g. ECS task roles or EKS Pod Identity.
+//  5. The EC2 instance role.
+func (d *S3Downloader) credentials(ctx context.Context) (*AWSCredentials, error) {
+	if d.Credentials != nil {
+		return d.Credentials, nil
+	}
+	if creds := awsEnvCredentials(); creds != nil {
+		return creds, nil
+	}
+
+	profile, err := awsProfile()
+	if err != nil {
+		return nil, err
+	}
+	if profile["aws_access_key_id"] != "" && profile["aws_secret_access_key"] != "" {
+		return &AWSCredentials{
+			AccessKeyID:     profile["aws_access_key_id"],
+			SecretAccessKey: profile["aws_secret_access_key"],
+			SessionToken:    profile["aws_session_token"],
+		}, nil
+	}
+	if profile["role_arn"] != "" && profile["web_identity_token_file"] != "" {
+		return d.webIdentityCredentials(
+			ctx, profile["role_arn"], profile["web_identity_token_file"], profile["role_session_name"],
+		)
+	}
+
+	if roleArn, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); roleArn != "" && tokenFile != "" {
+		return d.webIdentityCredentials(ctx, roleArn, tokenFile, os.Getenv("AWS_ROLE_SESSION_NAME"))
+	}
+
+	creds, err := d.containerCredentials(ctx)
+	if creds != nil || err != nil {
+		return creds, err
+	}
+
+	return d.ec2RoleCredentials(ctx)
+}
+
+func awsEnvCredentials() *AWSCredentials {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil
+	}
+	return &AWSCredentials{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// awsProfile returns the settings of the current profile. The settings of the shared
+// credentials file take precedence over the settings of the shared config file.
+// Returns an empty profile if neither file defines it.
+func awsProfile() (map[string]string, error) {
+	name := os.Getenv("AWS_PROFILE")
+	if name == "" {
+		name = "default"
+	}
+	// The profiles of the config file, except the default one, are prefixed.
+	configSection := name
+	if name != "default" {
+		configSection = "profile " + name
+	}
+
+	profile, err := readAWSSection(awsFilePath("AWS_CONFIG_FILE", "config"), configSection)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := readAWSSection(awsFilePath("AWS_SHARED_CREDENTIALS_FILE", "credentials"), name)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range credentials {
+		profile[key] = value
+	}
+	return profile, nil
+}
+
+// awsFilePath returns the path set in the env variable or the file name in ~/.aws.
+func awsFilePath(env, name string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+// readAWSSection reads the settings of the section of the AWS ini file. Returns an
+// empty map if the file or section does not exist.
+func readAWSSection(path, section string) (map[string]string, error) {
+	settings := map[string]string{}
+	if path == "" {
+		return settings, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = strings.Join(strings.Fields(line[1:len(line)-1]), " ") == section
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		key, value, found := cut(line, "=")
+		if !found {
+			continue
+		}
+		settings[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// webIdentityCredentials exchanges the web identity token read from tokenFile for
+// the credentials of the role using STS AssumeRoleWithWebIdentity. The call does not
+// need to be signed.
+func (d *S3Downloader) webIdentityCredentials(
+	ctx context.Context, roleArn, tokenFile, sessionName string,
+) (*AWSCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read web identity token: %v", err)
+	}
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("opamp-%d", d.currentTime().UnixNano())
+	}
+
+	endpoint := d.stsEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", d.region())
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {stsAPIVersion},
+		"RoleArn":          {roleArn},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot assume role %s with web identity, HTTP response=%v", roleArn, resp.StatusCode)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("cannot parse AssumeRoleWithWebIdentity response: %v", err)
+	}
+	return &AWSCredentials{
+		AccessKeyID:     result.Credentials.AccessKeyId,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+	}, nil
+}
+
+// containerCredentials fetches the credentials from the container credentials
+// endpoint. Returns (nil, nil) if no endpoint is configured.
+func (d *S3Downloader) containerCredentials(ctx context.Context) (*AWSCredentials, error) {
+	var endpoint string
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = ecsCredentialsEndpoint + relative
+	} else if full := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); full != "" {
+		if err := checkContainerCredentialsURI(full); err != nil {
+			return nil, err
+		}
+		endpoint = full
+	} else {
+		return nil, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read container authorization token: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	body, err := d.readMetadata(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch container credentials: %v", err)
+	}
+	return parseRoleCredentials(body)
+}
+
+// checkContainerCredentialsURI checks that the full container credentials URI does
+// not send the authorization token in plain text off the host.
+func checkContainerCredentialsURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return nil
+		}
+		for _, allowed := range containerCredentialsHosts {
+			if ip.Equal(net.ParseIP(allowed)) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("container credentials URI %s must use https or a loopback host", uri)
+}
+
+// ec2RoleCredentials fetches the credentials of the instance role from the EC2
+// instance metadata service (IMDSv2).
+func (d *S3Downloader) ec2RoleCredentials(ctx context.Context) (*AWSCredentials, error) {
+	// Do not hang for long if we are not running on EC2.
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, ec2MetadataEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "60")
+	token, err := d.readMetadata(tokenReq)
+	if err != nil {
+		return nil, errNoAWSCredentials
+	}
+
+	const credsPath = "/latest/meta-data/iam/security-credentials/"
+	get := func(path string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ec2MetadataEndpoint+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+		return d.readMetadata(req)
+	}
+
+	role, err := get(credsPath)
+	if err != nil {
+		return nil, errNoAWSCredentials
+	}
+	role, _, _ = cut(strings.TrimSpace(role), "\n")
+
+	body, err := get(credsPath + role)
+	if err != nil {
+		return nil, err
+	}
+	return parseRoleCredentials(body)
+}
+
+// parseRoleCredentials parses the credentials returned by the EC2 instance metadata
+// service and by the container credentials endpoint.
+func parseRoleCredentials(body string) (*AWSCredentials, error) {
+	var roleCreds struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+	}
+	if err := json.Unmarshal([]byte(body), &roleCreds); err != nil {
+		return nil, fmt.Errorf("cannot parse role credentials: %v", err)
+	}
+	return &AWSCredentials{
+		AccessKeyID:     roleCreds.AccessKeyId,
+		SecretAccessKey: roleCreds.SecretAccessKey,
+		SessionToken:    roleCreds.Token,
+	}, nil
+}
+
+func (d *S3Downloader) readMetadata(req *http.Request) (string, error) {
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata service HTTP response=%v", resp.StatusCode)
+	}
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
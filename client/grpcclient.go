@@ -0,0 +1,388 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+var (
+	errGRPCProxyNotSupported       = errors.New("ProxyURL and Proxy are not supported by the gRPC client")
+	errGRPCURLResolverNotSupported = errors.New("ServerURLResolver is not supported by the gRPC client")
+	errGRPCFollowNotSupported      = errors.New("FollowOfferedEndpoint is not supported by the gRPC client")
+	errGRPCCaptureNotSupported     = errors.New("WireCapture is not supported by the gRPC client")
+)
+
+// The schemes of the OpAMPServerURL supported by the gRPC client.
+var grpcSchemes = []string{"grpc", "grpcs", internal.UnixSocketScheme}
+
+// grpcClient is an OpAMP Client implementation that carries the messages over a
+// bidirectional gRPC stream.
+type grpcClient struct {
+	common internal.ClientCommon
+
+	// OpAMP Server URL.
+	url *url.URL
+
+	// Request headers to send as the metadata of the stream.
+	requestHeader http.Header
+
+	// Returns the additional headers before every connection attempt. nil if not set.
+	headerProvider internal.HeaderProvider
+
+	// The source of the OAuth2 tokens to connect with, nil if not set.
+	tokenSource oauth2.TokenSource
+
+	// The gRPC connection to the Server, the streams are opened on it. Created by
+	// Start and closed by Stop.
+	conn *grpc.ClientConn
+
+	// The options of the stream calls.
+	callOptions []grpc.CallOption
+
+	// True if the messages are compressed with gzip.
+	compression bool
+
+	// The current stream and the func that cancels it. Cancelling the stream unblocks
+	// the sender and the receiver.
+	stream       grpc.ClientStream
+	cancelStream context.CancelFunc
+	streamMutex  sync.RWMutex
+
+	// The time when the OAuth2 token the stream was opened with is replaced by a new
+	// token, zero if there is none or it does not expire.
+	tokenRefresh time.Time
+
+	// The sender is responsible for sending portion of the OpAMP protocol.
+	sender *internal.GRPCSender
+}
+
+// NewGRPC creates a new OpAMP Client that carries the AgentToServer and
+// ServerToAgent messages over a bidirectional gRPC stream, for the Servers that
+// only support gRPC. The client calls the internal.GRPCConnectMethod, i.e.
+// "/opamp.proto.OpAMPService/Connect", and reconnects when the stream ends.
+//
+// The OpAMPServerURL must use the grpc scheme, or the grpcs scheme for TLS, e.g.
+// "grpcs://opamp.example.com:4320", its path is not used. Header, HeaderProvider
+// and TokenSource are sent as the metadata of the stream. TLSConfig, DialContext,
+// EnableCompression (gzip), HeartbeatInterval and RetryPolicy are applied as for the
+// WebSocket client. ProxyURL, Proxy, ServerURLResolver, FollowOfferedEndpoint and
+// WireCapture are not supported, Start fails if they are set. The OpAMP connection settings offered by the Server are accepted without
+// verifying the endpoint, see OnOpampConnectionSettingsAccepted.
+func NewGRPC(logger types.Logger) *grpcClient {
+	if logger == nil {
+		logger = &sharedinternal.NopLogger{}
+	}
+
+	redactor := internal.NewRedactor()
+	logger = redactor.Logger(logger)
+	sender := internal.NewGRPCSender(logger)
+	return &grpcClient{
+		common: internal.NewClientCommon(logger, redactor, sender),
+		sender: sender,
+	}
+}
+
+// Start implements OpAMPClient.Start.
+func (c *grpcClient) Start(ctx context.Context, settings types.StartSettings) error {
+	if err := c.common.PrepareStart(ctx, settings); err != nil {
+		return err
+	}
+	if internal.HasProxySettings(settings) {
+		return errGRPCProxyNotSupported
+	}
+	if settings.ServerURLResolver != nil {
+		return errGRPCURLResolverNotSupported
+	}
+	if settings.FollowOfferedEndpoint {
+		return errGRPCFollowNotSupported
+	}
+	if settings.WireCapture != nil {
+		return errGRPCCaptureNotSupported
+	}
+	settings = internal.ResolveUnixSocket(settings, "grpc")
+
+	// Prepare connection settings.
+	var err error
+	c.url, err = url.Parse(settings.OpAMPServerURL)
+	if err != nil {
+		return c.common.Redactor.RedactError(err)
+	}
+
+	c.conn, err = grpc.Dial(internal.GRPCTarget(c.url), grpcDialOptions(c.url, settings)...)
+	if err != nil {
+		return c.common.Redactor.RedactError(err)
+	}
+
+	c.compression = settings.EnableCompression
+	c.callOptions = nil
+	if c.compression {
+		c.callOptions = append(c.callOptions, grpc.UseCompressor(gzip.Name))
+	}
+
+	c.requestHeader = settings.Header
+	c.headerProvider = settings.HeaderProvider
+	c.tokenSource = internal.TokenSource(settings.TokenSource)
+
+	c.sender.SetHeartbeatInterval(settings.HeartbeatInterval)
+
+	c.common.StartConnectAndRun(c.runUntilStopped)
+
+	return nil
+}
+
+// grpcDialOptions returns the options of the gRPC connection to the Server at
+// serverURL.
+func grpcDialOptions(serverURL *url.URL, settings types.StartSettings) []grpc.DialOption {
+	var opts []grpc.DialOption
+	if serverURL.Scheme == "grpcs" {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(settings.TLSConfig)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if settings.DialContext != nil {
+		dialContext := settings.DialContext
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialContext(ctx, "tcp", addr)
+		}))
+	}
+	return opts
+}
+
+// Stop implements OpAMPClient.Stop.
+func (c *grpcClient) Stop(ctx context.Context) error {
+	// Cancel the stream if any.
+	c.streamMutex.RLock()
+	cancelStream := c.cancelStream
+	c.streamMutex.RUnlock()
+
+	if cancelStream != nil {
+		cancelStream()
+	}
+
+	if err := c.common.Stop(ctx); err != nil {
+		return err
+	}
+	return c.conn.Close()
+}
+
+// Restart implements OpAMPClient.Restart.
+func (c *grpcClient) Restart(ctx context.Context, settings types.StartSettings) error {
+	return restartClient(ctx, c, &c.common, settings)
+}
+
+// SetServerURL implements OpAMPClient.SetServerURL.
+func (c *grpcClient) SetServerURL(ctx context.Context, serverURL string) error {
+	return setServerURL(ctx, c, &c.common, serverURL, grpcSchemes...)
+}
+
+// AgentDescription implements OpAMPClient.AgentDescription.
+func (c *grpcClient) AgentDescription() *protobufs.AgentDescription {
+	return c.common.AgentDescription()
+}
+
+// SetAgentDescription implements OpAMPClient.SetAgentDescription.
+func (c *grpcClient) SetAgentDescription(descr *protobufs.AgentDescription) error {
+	return c.common.SetAgentDescription(descr)
+}
+
+// RequestInstanceUid implements OpAMPClient.RequestInstanceUid.
+func (c *grpcClient) RequestInstanceUid() {
+	c.common.RequestInstanceUid()
+}
+
+// SetHealth implements OpAMPClient.SetHealth.
+func (c *grpcClient) SetHealth(health *protobufs.AgentHealth) error {
+	return c.common.SetHealth(health)
+}
+
+// UpdateEffectiveConfig implements OpAMPClient.UpdateEffectiveConfig.
+func (c *grpcClient) UpdateEffectiveConfig(ctx context.Context) error {
+	return c.common.UpdateEffectiveConfig(ctx)
+}
+
+// SetRemoteConfigStatus implements OpAMPClient.SetRemoteConfigStatus.
+func (c *grpcClient) SetRemoteConfigStatus(status *protobufs.RemoteConfigStatus) error {
+	return c.common.SetRemoteConfigStatus(status)
+}
+
+// SetPackageStatuses implements OpAMPClient.SetPackageStatuses.
+func (c *grpcClient) SetPackageStatuses(statuses *protobufs.PackageStatuses) error {
+	return c.common.SetPackageStatuses(statuses)
+}
+
+// CompressionStats implements OpAMPClient.CompressionStats.
+func (c *grpcClient) CompressionStats() types.CompressionStats {
+	return c.common.CompressionStats()
+}
+
+// ConnectionState implements OpAMPClient.ConnectionState.
+func (c *grpcClient) ConnectionState() types.ConnectionState {
+	return c.common.ConnectionState()
+}
+
+func (c *grpcClient) Flush(ctx context.Context) error {
+	return c.common.Flush(ctx)
+}
+
+// tryConnectOnce opens the stream once. Returns an error if it fails. The Server
+// cannot suggest a retry interval, retryAfter is never defined.
+func (c *grpcClient) tryConnectOnce(ctx context.Context) (err error, retryAfter sharedinternal.OptionalDuration) {
+	var tokenRefresh time.Time
+	headerProvider := internal.TokenHeaderProvider(c.tokenSource, c.headerProvider, func(token *oauth2.Token) {
+		tokenRefresh = internal.TokenRefreshTime(token)
+	})
+	header, err := internal.ProvidedHeader(ctx, c.requestHeader, headerProvider, c.common.Redactor)
+	if err != nil {
+		if c.common.Callbacks != nil && !c.common.IsStopping() {
+			c.common.Callbacks.OnConnectFailed(c.common.Redactor.RedactError(err))
+		}
+		return err, sharedinternal.OptionalDuration{Defined: false}
+	}
+
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	streamCtx = metadata.NewOutgoingContext(streamCtx, internal.GRPCMetadata(header))
+	stream, err := c.conn.NewStream(
+		streamCtx, &internal.GRPCConnectStream, internal.GRPCConnectMethod, c.callOptions...,
+	)
+	if err != nil {
+		cancelStream()
+		if c.common.Callbacks != nil && !c.common.IsStopping() {
+			c.common.Callbacks.OnConnectFailed(c.common.Redactor.RedactError(err))
+		}
+		return err, sharedinternal.OptionalDuration{Defined: false}
+	}
+
+	// Successfully connected.
+	c.streamMutex.Lock()
+	c.stream = stream
+	c.cancelStream = cancelStream
+	c.tokenRefresh = tokenRefresh
+	c.streamMutex.Unlock()
+	c.sender.SetCompression(c.compression)
+	if c.common.Callbacks != nil {
+		c.common.Callbacks.OnConnect(c.connectionInfo(stream))
+	}
+
+	return nil, sharedinternal.OptionalDuration{Defined: false}
+}
+
+// connectionInfo describes the opened gRPC stream.
+func (c *grpcClient) connectionInfo(stream grpc.ClientStream) types.ConnectionInfo {
+	info := types.ConnectionInfo{
+		Endpoint:           sharedinternal.RedactURL(c.url.String()),
+		Transport:          types.TransportGRPC,
+		CompressionEnabled: c.compression,
+	}
+
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			internal.SetConnectionInfoTLS(&info, &tlsInfo.State)
+		}
+	}
+	return info
+}
+
+// runOneCycle performs the following actions:
+//  1. open the stream (try until succeeds).
+//  2. send first status report.
+//  3. receive and process messages until error happens.
+//
+// If it encounters an error it cancels the stream and returns.
+// Will stop and return if Stop() is called (ctx is cancelled, isStopping is set).
+func (c *grpcClient) runOneCycle(ctx context.Context) {
+	if err := c.common.EnsureConnected(ctx, c.tryConnectOnce); err != nil {
+		// Can't connect, so can't move forward. This currently happens when we
+		// are being stopped.
+		return
+	}
+
+	if c.common.IsStopping() {
+		c.cancelStream()
+		return
+	}
+
+	// Prepare the first status report.
+	err := c.common.PrepareFirstMessage(ctx)
+	if err != nil {
+		c.common.Logger.Errorf("cannot prepare the first message:%v", err)
+		c.cancelStream()
+		c.common.ConnectionLost(err)
+		return
+	}
+
+	// Create a cancellable context for background processors.
+	procCtx, procCancel := context.WithCancel(ctx)
+
+	// Connected successfully. Start the sender. This will also send the first
+	// status report.
+	if err := c.sender.Start(procCtx, c.stream); err != nil {
+		c.common.Logger.Errorf("Failed to send first status report: %v", err)
+		// We could not send the report, the only thing we can do is start over.
+		c.cancelStream()
+		procCancel()
+		c.sender.WaitToStop()
+		c.common.ConnectionLost(err)
+		return
+	}
+
+	// First status report sent. Now loop to receive and process messages.
+	r := internal.NewGRPCReceiver(
+		c.common.Logger,
+		c.common.Callbacks,
+		c.stream,
+		c.sender,
+		&c.common.ClientSyncedState,
+		c.common.PackagesStateProvider,
+		c.common.PackageDownloads,
+		c.common.EndpointTransition,
+		c.common.Capabilities,
+		c.common.SpecCompliance,
+		c.common.ResponseVerifier,
+	)
+	if !c.tokenRefresh.IsZero() {
+		go c.common.ReconnectOnTokenRefresh(procCtx, c.tokenRefresh, c.cancelStream)
+	}
+	err = r.ReceiverLoop(ctx)
+
+	// Stop the background processors.
+	procCancel()
+	c.common.ConnectionLost(err)
+
+	// If we exited receiverLoop it means the stream ended, we cannot receive
+	// messages anymore. We need to start over.
+
+	// Cancel the stream to unblock the GRPCSender as well.
+	c.cancelStream()
+
+	// Wait for GRPCSender to stop.
+	c.sender.WaitToStop()
+}
+
+func (c *grpcClient) runUntilStopped(ctx context.Context) {
+	// Iterates until we detect that the client is stopping.
+	for {
+		if c.common.IsStopping() {
+			return
+		}
+
+		c.runOneCycle(ctx)
+	}
+}
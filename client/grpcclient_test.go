@@ -0,0 +1,219 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// startGRPCServer starts a gRPC Server that passes the messages of the Agents and
+// the metadata of their streams to the channels and replies with reply.
+func startGRPCServer(
+	t *testing.T, reply func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent,
+) (addr string, received <-chan *protobufs.AgentToServer, connected <-chan metadata.MD) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	receivedCh := make(chan *protobufs.AgentToServer, 10)
+	connectedCh := make(chan metadata.MD, 10)
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "opamp.proto.OpAMPService",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName:    internal.GRPCConnectStream.StreamName,
+				ServerStreams: true,
+				ClientStreams: true,
+				Handler: func(_ interface{}, stream grpc.ServerStream) error {
+					md, _ := metadata.FromIncomingContext(stream.Context())
+					connectedCh <- md
+					for {
+						var msg protobufs.AgentToServer
+						if err := stream.RecvMsg(&msg); err != nil {
+							return err
+						}
+						receivedCh <- &msg
+						if response := reply(&msg); response != nil {
+							if err := stream.SendMsg(response); err != nil {
+								return err
+							}
+						}
+					}
+				},
+			},
+		},
+	}, nil)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	return lis.Addr().String(), receivedCh, connectedCh
+}
+
+func TestGRPCClient(t *testing.T) {
+	for _, compression := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compression=%v", compression), func(t *testing.T) {
+			remoteConfig := &protobufs.AgentRemoteConfig{
+				Config: &protobufs.AgentConfigMap{
+					ConfigMap: map[string]*protobufs.AgentConfigFile{
+						"": {Body: []byte("receivers: {}")},
+					},
+				},
+				ConfigHash: []byte("hash"),
+			}
+			addr, received, connected := startGRPCServer(t, func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+				if msg.SequenceNum != 0 {
+					return nil
+				}
+				return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid, RemoteConfig: remoteConfig}
+			})
+
+			client := NewGRPC(nil)
+			connInfo := make(chan types.ConnectionInfo, 1)
+			settings := types.StartSettings{
+				OpAMPServerURL:    "grpc://" + addr,
+				Header:            http.Header{"X-Agent-Group": []string{"edge"}},
+				EnableCompression: compression,
+				Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+					protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig,
+				Callbacks: types.CallbacksStruct{
+					OnConnectFunc: func(info types.ConnectionInfo) {
+						connInfo <- info
+					},
+					OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
+						assert.NoError(t, client.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+							LastRemoteConfigHash: msg.RemoteConfig.ConfigHash,
+							Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+						}))
+					},
+				},
+			}
+			startClient(t, settings, client)
+
+			info := <-connInfo
+			assert.EqualValues(t, types.TransportGRPC, info.Transport)
+			assert.EqualValues(t, compression, info.CompressionEnabled)
+			assert.EqualValues(t, 0, info.TLSVersion)
+
+			// The headers are sent as the metadata of the stream.
+			md := <-connected
+			assert.EqualValues(t, []string{"edge"}, md.Get("x-agent-group"))
+
+			// The first message carries the description.
+			msg := nextGRPCMessage(t, received)
+			assert.EqualValues(t, 0, msg.SequenceNum)
+			assert.True(t, proto.Equal(createAgentDescr(), msg.AgentDescription))
+
+			// The Agent reports that it applied the remote config it received.
+			msg = nextGRPCMessage(t, received)
+			assert.EqualValues(t, 1, msg.SequenceNum)
+			assert.EqualValues(t, protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED, msg.RemoteConfigStatus.Status)
+			assert.EqualValues(t, remoteConfig.ConfigHash, msg.RemoteConfigStatus.LastRemoteConfigHash)
+
+			stats := client.CompressionStats()
+			assert.EqualValues(t, 2, stats.Messages)
+			if compression {
+				assert.EqualValues(t, 2, stats.CompressedMessages)
+			} else {
+				assert.EqualValues(t, stats.UncompressedBytes, stats.CompressedBytes)
+			}
+
+			require.NoError(t, client.Stop(context.Background()))
+		})
+	}
+}
+
+func TestGRPCClientReconnects(t *testing.T) {
+	addr, received, connected := startGRPCServer(t, func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+		return nil
+	})
+
+	client := NewGRPC(nil)
+	settings := types.StartSettings{
+		OpAMPServerURL: "grpc://" + addr,
+		RetryPolicy:    types.RetryPolicy{InitialInterval: 10 * time.Millisecond},
+	}
+	startClient(t, settings, client)
+	<-connected
+	nextGRPCMessage(t, received)
+
+	// The client reconnects and sends the full status when the stream is cancelled.
+	client.streamMutex.RLock()
+	cancelStream := client.cancelStream
+	client.streamMutex.RUnlock()
+	cancelStream()
+	<-connected
+	msg := nextGRPCMessage(t, received)
+	assert.True(t, proto.Equal(createAgentDescr(), msg.AgentDescription))
+
+	require.NoError(t, client.Stop(context.Background()))
+}
+
+func TestGRPCClientStartStopped(t *testing.T) {
+	addr, received, connected := startGRPCServer(t, func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+		return nil
+	})
+
+	client := NewGRPC(nil)
+	settings := types.StartSettings{OpAMPServerURL: "grpc://" + addr}
+	prepareClient(t, &settings, client)
+	require.NoError(t, client.Start(context.Background(), settings))
+	<-connected
+	msg := nextGRPCMessage(t, received)
+	instanceUid := msg.InstanceUid
+	require.NoError(t, client.Stop(context.Background()))
+
+	// The stopped client connects again when it is started, as the same Agent.
+	require.NoError(t, client.Start(context.Background(), settings))
+	<-connected
+	msg = nextGRPCMessage(t, received)
+	assert.EqualValues(t, instanceUid, msg.InstanceUid)
+	assert.EqualValues(t, 1, msg.SequenceNum)
+	assert.True(t, proto.Equal(createAgentDescr(), msg.AgentDescription))
+
+	require.NoError(t, client.Stop(context.Background()))
+}
+
+func TestGRPCClientProxyNotSupported(t *testing.T) {
+	client := NewGRPC(nil)
+	settings := types.StartSettings{
+		OpAMPServerURL: "grpc://localhost:4320",
+		ProxyURL:       "http://proxy:3128",
+	}
+	prepareClient(t, &settings, client)
+	assert.ErrorIs(t, client.Start(context.Background(), settings), errGRPCProxyNotSupported)
+}
+
+func TestGRPCClientWireCaptureNotSupported(t *testing.T) {
+	client := NewGRPC(nil)
+	settings := types.StartSettings{
+		OpAMPServerURL: "grpc://localhost:4320",
+		WireCapture:    io.Discard,
+	}
+	prepareClient(t, &settings, client)
+	assert.ErrorIs(t, client.Start(context.Background(), settings), errGRPCCaptureNotSupported)
+}
+
+func nextGRPCMessage(t *testing.T, received <-chan *protobufs.AgentToServer) *protobufs.AgentToServer {
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no message received")
+		return nil
+	}
+}
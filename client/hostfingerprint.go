@@ -0,0 +1,99 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// HostFingerprintAttributeKey is the key of the non-identifying attribute that
+// carries the host fingerprint. Servers can use this attribute to detect cloned
+// hosts (e.g. VMs created from the same image) that reuse the same instance UID.
+const HostFingerprintAttributeKey = "host.fingerprint"
+
+var errNoHostFingerprintSource = errors.New("no machine id or hardware address is available to fingerprint the host")
+
+// Name prefixes of the network interfaces that are created by container runtimes,
+// hypervisors, VPNs etc. Their hardware addresses are not specific to the host.
+var virtualInterfacePrefixes = []string{
+	"docker", "veth", "br-", "virbr", "vmnet", "vboxnet", "cni", "flannel", "cali",
+	"weave", "kube-", "tun", "tap", "wg", "zt", "utun", "awdl", "llw", "bridge",
+}
+
+// HostFingerprint returns a stable fingerprint of the host the Agent is running on.
+// The fingerprint is a hex-encoded SHA256 hash of the machine id of the OS (e.g.
+// /etc/machine-id on Linux, IOPlatformUUID on macOS or MachineGuid on Windows).
+// If the machine id is not available the hardware addresses of the physical
+// network interfaces are used instead. The raw machine id and hardware addresses
+// are never exposed.
+func HostFingerprint() (string, error) {
+	hash := sha256.New()
+
+	if id, err := machineId(); err == nil && id != "" {
+		hash.Write([]byte(id))
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	addrs := physicalHardwareAddrs()
+	if len(addrs) == 0 {
+		return "", errNoHostFingerprintSource
+	}
+	for _, addr := range addrs {
+		hash.Write([]byte(addr))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// physicalHardwareAddrs returns the sorted hardware addresses of the network
+// interfaces that are likely to be physical. Loopback and virtual interfaces, and
+// interfaces with locally administered (e.g. randomized) addresses are skipped.
+func physicalHardwareAddrs() []string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var addrs []string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		if iface.HardwareAddr[0]&0x02 != 0 || isVirtualInterface(iface.Name) {
+			continue
+		}
+		addrs = append(addrs, iface.HardwareAddr.String())
+	}
+	// Sort to make sure the fingerprint does not depend on the enumeration order.
+	sort.Strings(addrs)
+	return addrs
+}
+
+func isVirtualInterface(name string) bool {
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostFingerprintAttribute returns a KeyValue that can be added to the
+// NonIdentifyingAttributes of the AgentDescription to let the Server detect
+// cloned hosts. See HostFingerprint for details.
+func HostFingerprintAttribute() (*protobufs.KeyValue, error) {
+	fingerprint, err := HostFingerprint()
+	if err != nil {
+		return nil, err
+	}
+	return &protobufs.KeyValue{
+		Key: HostFingerprintAttributeKey,
+		Value: &protobufs.AnyValue{
+			Value: &protobufs.AnyValue_StringValue{StringValue: fingerprint},
+		},
+	}, nil
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostFingerprint(t *testing.T) {
+	fingerprint, err := HostFingerprint()
+	if err == errNoHostFingerprintSource {
+		t.Skip("host has no machine-id or hardware addresses")
+	}
+	require.NoError(t, err)
+
+	// Fingerprint must be stable.
+	fingerprint2, err := HostFingerprint()
+	require.NoError(t, err)
+	assert.EqualValues(t, fingerprint, fingerprint2)
+
+	attr, err := HostFingerprintAttribute()
+	require.NoError(t, err)
+	assert.EqualValues(t, HostFingerprintAttributeKey, attr.Key)
+	assert.EqualValues(t, fingerprint, attr.Value.GetStringValue())
+}
+
+func TestIsVirtualInterface(t *testing.T) {
+	for _, name := range []string{"docker0", "veth1a2b3c", "br-0123abcd", "virbr0", "cni0", "tun0", "utun3"} {
+		assert.True(t, isVirtualInterface(name), name)
+	}
+	for _, name := range []string{"eth0", "en0", "enp3s0", "wlan0", "Ethernet"} {
+		assert.False(t, isVirtualInterface(name), name)
+	}
+}
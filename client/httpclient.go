@@ -2,6 +2,7 @@ package client
 
 import (
 	"context"
+	"errors"
 
 	"github.com/open-telemetry/opamp-go/client/internal"
 	"github.com/open-telemetry/opamp-go/client/types"
@@ -9,6 +10,11 @@ import (
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
+var errHTTPURLResolverNotSupported = errors.New("ServerURLResolver is not supported by the HTTP client")
+
+// The schemes of the OpAMPServerURL supported by the HTTP client.
+var httpSchemes = []string{"http", "https", internal.UnixSocketScheme}
+
 // httpClient is an OpAMP Client implementation for plain HTTP transport.
 // See specification: https://github.com/open-telemetry/opamp-spec/blob/main/specification.md#plain-http-transport
 type httpClient struct {
@@ -26,9 +32,12 @@ func NewHTTP(logger types.Logger) *httpClient {
 		logger = &sharedinternal.NopLogger{}
 	}
 
+	redactor := internal.NewRedactor()
+	logger = redactor.Logger(logger)
 	sender := internal.NewHTTPSender(logger)
+	sender.SetRedactor(redactor)
 	w := &httpClient{
-		common: internal.NewClientCommon(logger, sender),
+		common: internal.NewClientCommon(logger, redactor, sender),
 		sender: sender,
 	}
 	return w
@@ -39,18 +48,36 @@ func (c *httpClient) Start(ctx context.Context, settings types.StartSettings) er
 	if err := c.common.PrepareStart(ctx, settings); err != nil {
 		return err
 	}
+	if settings.ServerURLResolver != nil {
+		return errHTTPURLResolverNotSupported
+	}
+	settings = internal.ResolveUnixSocket(settings, "http")
 
 	c.opAMPServerURL = settings.OpAMPServerURL
+	var endpointSwitcher internal.EndpointSwitcher
+	if settings.FollowOfferedEndpoint {
+		endpointSwitcher = c.sender.SwitchEndpoint
+	}
+	c.common.EndpointTransition = internal.NewEndpointTransition(
+		c.sender.VerifyEndpoint, c.sender.SwitchCertificate, endpointSwitcher, settings.OpAMPEndpointGracePeriod,
+	)
 
 	// Prepare Server connection settings.
 	c.sender.SetRequestHeader(settings.Header)
+	c.sender.SetHeaderProvider(internal.TokenHeaderProvider(
+		internal.TokenSource(settings.TokenSource), settings.HeaderProvider, nil,
+	))
 
-	// Add TLS configuration into httpClient
+	// Add redirect, TLS and proxy configuration into httpClient
+	c.sender.SetRedirectPolicy(settings.RedirectPolicy)
 	c.sender.AddTLSConfig(settings.TLSConfig)
+	c.sender.SetProxy(internal.ProxyFunc(settings))
+	c.sender.SetDialContext(settings.DialContext)
+	c.sender.SetRoundTripper(settings.HTTPRoundTripper)
 
-	if settings.EnableCompression {
-		c.sender.EnableCompression()
-	}
+	c.sender.SetCompression(settings.EnableCompression)
+	c.sender.SetRetryPolicy(settings.RetryPolicy)
+	c.sender.SetWireCapture(sharedinternal.NewWireCapture(settings.WireCapture, c.common.Logger))
 
 	// Prepare the first message to send.
 	err := c.common.PrepareFirstMessage(ctx)
@@ -70,6 +97,16 @@ func (c *httpClient) Stop(ctx context.Context) error {
 	return c.common.Stop(ctx)
 }
 
+// Restart implements OpAMPClient.Restart.
+func (c *httpClient) Restart(ctx context.Context, settings types.StartSettings) error {
+	return restartClient(ctx, c, &c.common, settings)
+}
+
+// SetServerURL implements OpAMPClient.SetServerURL.
+func (c *httpClient) SetServerURL(ctx context.Context, serverURL string) error {
+	return setServerURL(ctx, c, &c.common, serverURL, httpSchemes...)
+}
+
 // AgentDescription implements OpAMPClient.AgentDescription.
 func (c *httpClient) AgentDescription() *protobufs.AgentDescription {
 	return c.common.AgentDescription()
@@ -80,6 +117,11 @@ func (c *httpClient) SetAgentDescription(descr *protobufs.AgentDescription) erro
 	return c.common.SetAgentDescription(descr)
 }
 
+// RequestInstanceUid implements OpAMPClient.RequestInstanceUid.
+func (c *httpClient) RequestInstanceUid() {
+	c.common.RequestInstanceUid()
+}
+
 // SetHealth implements OpAMPClient.SetHealth.
 func (c *httpClient) SetHealth(health *protobufs.AgentHealth) error {
 	return c.common.SetHealth(health)
@@ -100,6 +142,20 @@ func (c *httpClient) SetPackageStatuses(statuses *protobufs.PackageStatuses) err
 	return c.common.SetPackageStatuses(statuses)
 }
 
+// CompressionStats implements OpAMPClient.CompressionStats.
+func (c *httpClient) CompressionStats() types.CompressionStats {
+	return c.common.CompressionStats()
+}
+
+// ConnectionState implements OpAMPClient.ConnectionState.
+func (c *httpClient) ConnectionState() types.ConnectionState {
+	return c.common.ConnectionState()
+}
+
+func (c *httpClient) Flush(ctx context.Context) error {
+	return c.common.Flush(ctx)
+}
+
 func (c *httpClient) runUntilStopped(ctx context.Context) {
 	// Start the HTTP sender. This will make request/responses with retries for
 	// failures and will wait with configured polling interval if there is nothing
@@ -110,6 +166,10 @@ func (c *httpClient) runUntilStopped(ctx context.Context) {
 		c.common.Callbacks,
 		&c.common.ClientSyncedState,
 		c.common.PackagesStateProvider,
+		c.common.PackageDownloads,
+		c.common.EndpointTransition,
 		c.common.Capabilities,
+		c.common.SpecCompliance,
+		c.common.ResponseVerifier,
 	)
 }
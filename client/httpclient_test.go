@@ -1,10 +1,12 @@
 package client
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -93,3 +95,52 @@ func TestHTTPClientCompression(t *testing.T) {
 	err := client.Stop(context.Background())
 	assert.NoError(t, err)
 }
+
+type sizeMetrics struct {
+	mutex sync.Mutex
+	sizes map[string][]int64
+}
+
+func (m *sizeMetrics) IncrementCounter(string) {}
+
+func (m *sizeMetrics) RecordSize(name string, bytes int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sizes[name] = append(m.sizes[name], bytes)
+}
+
+func TestHTTPClientCompressionStats(t *testing.T) {
+	srv := internal.StartMockServer(t)
+	var compressed, uncompressed int64
+	srv.OnRequest = func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		assert.NoError(t, err)
+		decompressed, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		atomic.StoreInt64(&compressed, int64(len(body)))
+		atomic.StoreInt64(&uncompressed, int64(len(decompressed)))
+		w.WriteHeader(http.StatusOK)
+	}
+	defer srv.Close()
+
+	metrics := &sizeMetrics{sizes: map[string][]int64{}}
+	settings := types.StartSettings{EnableCompression: true, Metrics: metrics}
+	settings.OpAMPServerURL = "http://" + srv.Endpoint
+	client := NewHTTP(nil)
+	startClient(t, settings, client)
+	defer client.Stop(context.Background())
+
+	// The stats match the sizes of the only request sent.
+	eventually(t, func() bool { return client.CompressionStats().Messages == 1 })
+	stats := client.CompressionStats()
+	assert.EqualValues(t, 1, stats.CompressedMessages)
+	assert.Equal(t, atomic.LoadInt64(&uncompressed), stats.UncompressedBytes)
+	assert.Equal(t, atomic.LoadInt64(&compressed), stats.CompressedBytes)
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	assert.Equal(t, []int64{stats.UncompressedBytes}, metrics.sizes[types.MetricSentUncompressedBytes])
+	assert.Equal(t, []int64{stats.CompressedBytes}, metrics.sizes[types.MetricSentCompressedBytes])
+}
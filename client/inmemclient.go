@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// The OpAMPServerURL of the in-memory client if none is set, the settings are
+// validated as for the other clients.
+const inMemoryServerURL = "memory://opamp"
+
+var (
+	errInMemorySenderClosed = errors.New("the sender of the in-memory client is closed, the client cannot be restarted")
+	errInMemoryServerURL    = errors.New("the in-memory client does not connect to a Server URL")
+)
+
+// inMemoryClient is an OpAMP Client implementation that does not connect to a
+// Server. The messages it sends are passed to a types.Sender and the messages of the
+// Server are passed to Receive. It allows testing the Agent's logic without network.
+type inMemoryClient struct {
+	common internal.ClientCommon
+
+	// The sender passes the messages to the types.Sender.
+	sender *internal.InMemorySender
+
+	// Closed when the client is stopped, nil if the types.Sender is not an io.Closer.
+	closer io.Closer
+
+	// True if the client was stopped, the sender must be restarted to start again.
+	stopped bool
+}
+
+// NewInMemory creates a new OpAMP Client that passes the messages it sends to the
+// sender. The messages of the Server are passed to the client via Receive. The
+// connection settings of the StartSettings (OpAMPServerURL, Header, TLSConfig,
+// etc.) are not used, OpAMPServerURL may be empty. If the sender implements
+// io.Closer it is closed when the client is stopped and the client cannot be started
+// again, otherwise it may be restarted.
+func NewInMemory(logger types.Logger, sender types.Sender) *inMemoryClient {
+	if logger == nil {
+		logger = &sharedinternal.NopLogger{}
+	}
+
+	redactor := internal.NewRedactor()
+	logger = redactor.Logger(logger)
+	inMemorySender := internal.NewInMemorySender(logger, sender)
+	closer, _ := sender.(io.Closer)
+	return &inMemoryClient{
+		common: internal.NewClientCommon(logger, redactor, inMemorySender),
+		sender: inMemorySender,
+		closer: closer,
+	}
+}
+
+// InMemoryServer is an OpAMP Server the Agents can connect to without network.
+// It is implemented by the Server created by server.New.
+type InMemoryServer interface {
+	// ConnectInMemory returns the Sender that passes the messages of the Agent to
+	// the Server. The Server passes its messages to receiver.
+	ConnectInMemory(header http.Header, receiver types.Receiver) types.Sender
+}
+
+// ConnectInMemory creates a new OpAMP Client that is connected to the srv without
+// network, e.g. for the integration tests of the Agent's and the Server's logic.
+// The header is passed to the Server when the client connects. The client connects
+// when it is started, see NewInMemory for the settings that are used.
+func ConnectInMemory(logger types.Logger, srv InMemoryServer, header http.Header) *inMemoryClient {
+	var c *inMemoryClient
+	// The Server passes the messages only after the client sent its first message.
+	sender := srv.ConnectInMemory(header, func(ctx context.Context, msg *protobufs.ServerToAgent) error {
+		return c.Receive(ctx, msg)
+	})
+	c = NewInMemory(logger, sender)
+	return c
+}
+
+// Start implements OpAMPClient.Start. The first message is passed to the sender
+// right away and OnConnect is called with TransportInMemory.
+func (c *inMemoryClient) Start(ctx context.Context, settings types.StartSettings) error {
+	if settings.OpAMPServerURL == "" {
+		settings.OpAMPServerURL = inMemoryServerURL
+	}
+	if err := c.common.PrepareStart(ctx, settings); err != nil {
+		return err
+	}
+	if c.stopped {
+		if c.closer != nil {
+			return errInMemorySenderClosed
+		}
+		c.sender.Restart()
+		c.stopped = false
+	}
+
+	// Prepare the first message to send.
+	if err := c.common.PrepareFirstMessage(ctx); err != nil {
+		return err
+	}
+	c.sender.ScheduleSend()
+
+	c.common.StartConnectAndRun(c.runUntilStopped)
+
+	return nil
+}
+
+// Receive processes the message as if the Server sent it. Returns when the message
+// is processed, i.e. when the callbacks returned, so that the test can assert on
+// their effects. Returns an error if the client is stopped or ctx is done before
+// the message is processed. Must not be called from the callbacks or the sender.
+func (c *inMemoryClient) Receive(ctx context.Context, msg *protobufs.ServerToAgent) error {
+	return c.sender.Receive(ctx, msg)
+}
+
+// Stop implements OpAMPClient.Stop.
+func (c *inMemoryClient) Stop(ctx context.Context) error {
+	if err := c.common.Stop(ctx); err != nil {
+		return err
+	}
+	c.stopped = true
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+// Restart implements OpAMPClient.Restart. Returns an error without stopping the
+// client if its sender is an io.Closer, see NewInMemory.
+func (c *inMemoryClient) Restart(ctx context.Context, settings types.StartSettings) error {
+	if c.closer != nil {
+		return errInMemorySenderClosed
+	}
+	return restartClient(ctx, c, &c.common, settings)
+}
+
+// SetServerURL implements OpAMPClient.SetServerURL. The in-memory client does not
+// connect to a Server URL, it always returns an error.
+func (c *inMemoryClient) SetServerURL(context.Context, string) error {
+	return errInMemoryServerURL
+}
+
+// AgentDescription implements OpAMPClient.AgentDescription.
+func (c *inMemoryClient) AgentDescription() *protobufs.AgentDescription {
+	return c.common.AgentDescription()
+}
+
+// SetAgentDescription implements OpAMPClient.SetAgentDescription.
+func (c *inMemoryClient) SetAgentDescription(descr *protobufs.AgentDescription) error {
+	return c.common.SetAgentDescription(descr)
+}
+
+// RequestInstanceUid implements OpAMPClient.RequestInstanceUid.
+func (c *inMemoryClient) RequestInstanceUid() {
+	c.common.RequestInstanceUid()
+}
+
+// SetHealth implements OpAMPClient.SetHealth.
+func (c *inMemoryClient) SetHealth(health *protobufs.AgentHealth) error {
+	return c.common.SetHealth(health)
+}
+
+// UpdateEffectiveConfig implements OpAMPClient.UpdateEffectiveConfig.
+func (c *inMemoryClient) UpdateEffectiveConfig(ctx context.Context) error {
+	return c.common.UpdateEffectiveConfig(ctx)
+}
+
+// SetRemoteConfigStatus implements OpAMPClient.SetRemoteConfigStatus.
+func (c *inMemoryClient) SetRemoteConfigStatus(status *protobufs.RemoteConfigStatus) error {
+	return c.common.SetRemoteConfigStatus(status)
+}
+
+// SetPackageStatuses implements OpAMPClient.SetPackageStatuses.
+func (c *inMemoryClient) SetPackageStatuses(statuses *protobufs.PackageStatuses) error {
+	return c.common.SetPackageStatuses(statuses)
+}
+
+// CompressionStats implements OpAMPClient.CompressionStats. The messages are never
+// compressed.
+func (c *inMemoryClient) CompressionStats() types.CompressionStats {
+	return c.common.CompressionStats()
+}
+
+// ConnectionState implements OpAMPClient.ConnectionState. The client is connected
+// from Start() until Stop().
+func (c *inMemoryClient) ConnectionState() types.ConnectionState {
+	return c.common.ConnectionState()
+}
+
+func (c *inMemoryClient) Flush(ctx context.Context) error {
+	return c.common.Flush(ctx)
+}
+
+func (c *inMemoryClient) runUntilStopped(ctx context.Context) {
+	c.common.Callbacks.OnConnect(types.ConnectionInfo{Transport: types.TransportInMemory})
+
+	c.sender.Run(
+		ctx,
+		c.common.Callbacks,
+		&c.common.ClientSyncedState,
+		c.common.PackagesStateProvider,
+		c.common.PackageDownloads,
+		c.common.Capabilities,
+		c.common.SpecCompliance,
+		c.common.ResponseVerifier,
+	)
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/clienttest"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestInMemoryClient(t *testing.T) {
+	recorder := clienttest.NewRecorder()
+	client := NewInMemory(nil, recorder)
+
+	var connInfo types.ConnectionInfo
+	var settings types.StartSettings
+	settings.Capabilities = protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+		protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig
+	settings.Callbacks = types.CallbacksStruct{
+		OnConnectFunc: func(info types.ConnectionInfo) {
+			connInfo = info
+		},
+		OnMessageFunc: func(ctx context.Context, msg *types.MessageData) {
+			// Called by Receive, which returns when the status is set.
+			assert.NoError(t, client.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+				LastRemoteConfigHash: msg.RemoteConfig.ConfigHash,
+				Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+			}))
+		},
+	}
+	prepareClient(t, &settings, client)
+	require.NoError(t, client.Start(context.Background(), settings))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The first message is sent right away.
+	msg, err := recorder.Next(ctx)
+	require.NoError(t, err)
+	assert.EqualValues(t, settings.InstanceUid, msg.InstanceUid)
+	assert.EqualValues(t, 0, msg.SequenceNum)
+	assert.True(t, proto.Equal(createAgentDescr(), msg.AgentDescription))
+	assert.EqualValues(t, types.TransportInMemory, connInfo.Transport)
+
+	// Receive the remote config, the Agent reports that it applied it.
+	remoteConfig := &protobufs.AgentRemoteConfig{
+		Config: &protobufs.AgentConfigMap{
+			ConfigMap: map[string]*protobufs.AgentConfigFile{
+				"": {Body: []byte("receivers: {}")},
+			},
+		},
+		ConfigHash: []byte("hash"),
+	}
+	require.NoError(t, client.Receive(ctx, &protobufs.ServerToAgent{
+		InstanceUid:  settings.InstanceUid,
+		RemoteConfig: remoteConfig,
+	}))
+
+	msg, err = recorder.Next(ctx)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, msg.SequenceNum)
+	assert.True(t, proto.Equal(&protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: []byte("hash"),
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+	}, msg.RemoteConfigStatus))
+
+	assert.Len(t, recorder.Messages(), 2)
+	assert.EqualValues(t, 2, client.CompressionStats().Messages)
+
+	// The messages cannot be received after the client is stopped.
+	require.NoError(t, client.Stop(context.Background()))
+	assert.Error(t, client.Receive(ctx, &protobufs.ServerToAgent{InstanceUid: settings.InstanceUid}))
+}
+
+func TestInMemoryClientRestart(t *testing.T) {
+	recorder := clienttest.NewRecorder()
+	client := NewInMemory(nil, recorder)
+
+	var settings types.StartSettings
+	prepareClient(t, &settings, client)
+	require.NoError(t, client.Start(context.Background(), settings))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := recorder.Next(ctx)
+	require.NoError(t, err)
+
+	// The restarted client keeps the instance uid and continues the sequence.
+	require.NoError(t, client.Restart(ctx, types.StartSettings{}))
+	msg, err := recorder.Next(ctx)
+	require.NoError(t, err)
+	assert.EqualValues(t, settings.InstanceUid, msg.InstanceUid)
+	assert.EqualValues(t, 1, msg.SequenceNum)
+	require.NoError(t, client.Receive(ctx, &protobufs.ServerToAgent{InstanceUid: settings.InstanceUid}))
+
+	require.NoError(t, client.Stop(context.Background()))
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const bsdiffMagic = "BSDIFF40"
+
+var (
+	errCorruptPatch  = errors.New("corrupt patch")
+	errPatchTooLarge = errors.New("patched content exceeds the size limit")
+)
+
+// Size of the chunks in which the patched content is produced.
+const bspatchChunkSize = 32 * 1024
+
+// bspatch applies a patch in the BSDIFF40 format produced by bsdiff
+// (https://www.daemonology.net/bsdiff/) to old and writes the new content to w.
+// The content is streamed in small chunks, the size declared by the patch is
+// checked against maxSize before anything is produced. Returns the size of the
+// new content.
+func bspatch(old []byte, patch []byte, w io.Writer, maxSize int64) (int64, error) {
+	if len(patch) < 32 || string(patch[:8]) != bsdiffMagic {
+		return 0, errCorruptPatch
+	}
+	ctrlLen := offtin(patch[8:16])
+	diffLen := offtin(patch[16:24])
+	newSize := offtin(patch[24:32])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || 32+ctrlLen+diffLen > int64(len(patch)) {
+		return 0, errCorruptPatch
+	}
+	if newSize > maxSize {
+		return 0, errPatchTooLarge
+	}
+
+	body := patch[32:]
+	ctrlReader := bzip2.NewReader(bytes.NewReader(body[:ctrlLen]))
+	diffReader := bzip2.NewReader(bytes.NewReader(body[ctrlLen : ctrlLen+diffLen]))
+	extraReader := bzip2.NewReader(bytes.NewReader(body[ctrlLen+diffLen:]))
+
+	chunk := make([]byte, bspatchChunkSize)
+	var newPos, oldPos int64
+	var ctrlBuf [24]byte
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrlReader, ctrlBuf[:]); err != nil {
+			return 0, errCorruptPatch
+		}
+		addLen := offtin(ctrlBuf[0:8])
+		copyLen := offtin(ctrlBuf[8:16])
+		seek := offtin(ctrlBuf[16:24])
+
+		// Add the diff bytes to the old content.
+		if addLen < 0 || newPos+addLen > newSize {
+			return 0, errCorruptPatch
+		}
+		for remaining := addLen; remaining > 0; {
+			n := int64(len(chunk))
+			if remaining < n {
+				n = remaining
+			}
+			if _, err := io.ReadFull(diffReader, chunk[:n]); err != nil {
+				return 0, errCorruptPatch
+			}
+			for i := int64(0); i < n; i++ {
+				if oldPos+i >= 0 && oldPos+i < int64(len(old)) {
+					chunk[i] += old[oldPos+i]
+				}
+			}
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return 0, err
+			}
+			newPos += n
+			oldPos += n
+			remaining -= n
+		}
+
+		// Copy the extra bytes.
+		if copyLen < 0 || newPos+copyLen > newSize {
+			return 0, errCorruptPatch
+		}
+		copied, err := io.CopyBuffer(w, io.LimitReader(extraReader, copyLen), chunk)
+		if err != nil {
+			return 0, err
+		}
+		if copied != copyLen {
+			return 0, errCorruptPatch
+		}
+		newPos += copyLen
+		oldPos += seek
+	}
+
+	return newPos, nil
+}
+
+// offtin decodes the sign-magnitude little-endian integer used by bsdiff.
+func offtin(b []byte) int64 {
+	v := binary.LittleEndian.Uint64(b)
+	x := int64(v &^ (1 << 63))
+	if v&(1<<63) != 0 {
+		x = -x
+	}
+	return x
+}
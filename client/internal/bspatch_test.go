@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBsdiffPatch is a BSDIFF40 patch that transforms "Package File Content" into
+// "Package File Content v2 with more data".
+const testBsdiffPatch = "42534449464634302c0000000000000027000000000000002600000000000000425a6839314159" +
+	"2653598a86ee4b000005e0004808140020002129a6d066817c0ae1772453850908a86ee4b0425a" +
+	"6839314159265359b1d9abf0000000600040004000200021008283177245385090b1d9abf0425a" +
+	"6839314159265359977e8f0b0000011980400010002662958020003100d00104da4d3328280" +
+	"26ecca92b106f8bb9229c28484bbf478580"
+
+func TestBspatch(t *testing.T) {
+	patch, err := hex.DecodeString(testBsdiffPatch)
+	require.NoError(t, err)
+
+	var newContent bytes.Buffer
+	size, err := bspatch([]byte("Package File Content"), patch, &newContent, 1024)
+	require.NoError(t, err)
+	assert.EqualValues(t, "Package File Content v2 with more data", newContent.String())
+	assert.EqualValues(t, newContent.Len(), size)
+}
+
+func TestBspatchCorrupt(t *testing.T) {
+	patch, err := hex.DecodeString(testBsdiffPatch)
+	require.NoError(t, err)
+
+	_, err = bspatch(nil, []byte("not a patch"), io.Discard, 1024)
+	assert.ErrorIs(t, err, errCorruptPatch)
+
+	// Truncated patch.
+	_, err = bspatch([]byte("Package File Content"), patch[:40], io.Discard, 1024)
+	assert.ErrorIs(t, err, errCorruptPatch)
+}
+
+func TestBspatchTooLarge(t *testing.T) {
+	patch, err := hex.DecodeString(testBsdiffPatch)
+	require.NoError(t, err)
+
+	// The new content is 38 bytes.
+	var newContent bytes.Buffer
+	_, err = bspatch([]byte("Package File Content"), patch, &newContent, 37)
+	assert.ErrorIs(t, err, errPatchTooLarge)
+	assert.Zero(t, newContent.Len())
+
+	// A patch header declaring a huge size is refused before any allocation.
+	binary.LittleEndian.PutUint64(patch[24:32], 1<<40)
+	_, err = bspatch([]byte("Package File Content"), patch, io.Discard, defaultMaxPatchedFileSize)
+	assert.ErrorIs(t, err, errPatchTooLarge)
+}
@@ -2,11 +2,19 @@ package internal
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/oklog/ulid/v2"
 
 	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
 	"github.com/open-telemetry/opamp-go/protobufs"
 	"google.golang.org/protobuf/proto"
 )
@@ -19,14 +27,13 @@ var (
 	ErrReportsRemoteConfigNotSet    = errors.New("ReportsRemoteConfig capability is not set")
 	ErrPackagesStateProviderNotSet  = errors.New("PackagesStateProvider must be set")
 	ErrAcceptsPackagesNotSet        = errors.New("AcceptsPackages and ReportsPackageStatuses must be set")
+	ErrAlreadyStarted               = errors.New("already started")
+	ErrNotStarted                   = errors.New("cannot stop because not started")
 
-	errAlreadyStarted               = errors.New("already started")
-	errCannotStopNotStarted         = errors.New("cannot stop because not started")
 	errReportsPackageStatusesNotSet = errors.New("ReportsPackageStatuses capability is not set")
 )
 
-// ClientCommon contains the OpAMP logic that is common between WebSocket and
-// plain HTTP transports.
+// ClientCommon contains the OpAMP logic that is common between the transports.
 type ClientCommon struct {
 	Logger    types.Logger
 	Callbacks types.Callbacks
@@ -40,9 +47,51 @@ type ClientCommon struct {
 	// PackagesStateProvider provides access to the local state of packages.
 	PackagesStateProvider types.PackagesStateProvider
 
+	// Settings of the package file downloads.
+	PackageDownloads PackageDownloadSettings
+
+	// Verifies the new OpAMP Server endpoints offered by the Server. Set by the
+	// transport-specific client at Start() time.
+	EndpointTransition *EndpointTransition
+
+	// Optional recorder of the client's metrics.
+	Metrics types.MetricsRecorder
+
+	// Accounts the buffers against the memory limit, nil if there is no limit.
+	MemoryBudget *MemoryBudget
+
+	// Rejects the messages that violate the specification, nil if the strict mode
+	// is not enabled.
+	SpecCompliance *SpecCompliance
+
+	// Rejects the messages that are not signed by the Server, nil if the
+	// verification is not enabled.
+	ResponseVerifier *ResponseVerifier
+
+	// The policy of retrying the connections and requests after failures.
+	RetryPolicy types.RetryPolicy
+
+	// Removes the secrets used to connect to the Server from the logs and errors.
+	// Logger already redacts the messages.
+	Redactor *Redactor
+
 	// The transport-specific sender.
 	sender Sender
 
+	// The state of the connection to the Server.
+	connectionState connectionStateTracker
+
+	// The message journaled in the Outbox by the previous run, replayed with the
+	// first message.
+	journaled *protobufs.AgentToServer
+
+	// The command the previous run did not acknowledge, passed to OnCommand again
+	// once the client is started.
+	redeliveredCommand *protobufs.ServerToAgentCommand
+
+	// The settings of the last successful Start(), to restart the client with.
+	startSettings types.StartSettings
+
 	// True if Start() is successful.
 	isStarted bool
 
@@ -57,10 +106,19 @@ type ClientCommon struct {
 	stoppedSignal chan struct{}
 }
 
-// NewClientCommon creates a new ClientCommon.
-func NewClientCommon(logger types.Logger, sender Sender) ClientCommon {
+// IncrementCounter increments the counter with the specified name if the
+// MetricsRecorder is set.
+func (c *ClientCommon) IncrementCounter(name string) {
+	if c.Metrics != nil {
+		c.Metrics.IncrementCounter(name)
+	}
+}
+
+// NewClientCommon creates a new ClientCommon. The logger must be the one returned by
+// redactor.Logger.
+func NewClientCommon(logger types.Logger, redactor *Redactor, sender Sender) ClientCommon {
 	return ClientCommon{
-		Logger: logger, sender: sender, stoppedSignal: make(chan struct{}, 1),
+		Logger: logger, Redactor: redactor, sender: sender, stoppedSignal: make(chan struct{}, 1),
 	}
 }
 
@@ -70,10 +128,53 @@ func (c *ClientCommon) PrepareStart(
 	_ context.Context, settings types.StartSettings,
 ) error {
 	if c.isStarted {
-		return errAlreadyStarted
+		return ErrAlreadyStarted
 	}
 
+	if err := sharedinternal.ValidateHTTPHeader(settings.Header); err != nil {
+		return fmt.Errorf("invalid Header: %w", err)
+	}
+	if err := sharedinternal.ValidateCompressionLevel(settings.CompressionLevel); err != nil {
+		return err
+	}
+	if err := ValidateRetryPolicy(settings.RetryPolicy); err != nil {
+		return err
+	}
+	c.RetryPolicy = settings.RetryPolicy
+	c.Redactor.SetSecrets(settings.Header, settings.OpAMPServerURL)
+	c.Redactor.AddURL(settings.ProxyURL)
+
 	c.Capabilities = settings.Capabilities
+	c.Metrics = settings.Metrics
+	c.sender.SetMetrics(settings.Metrics)
+	c.SpecCompliance = NewSpecCompliance(settings, c.Logger)
+	c.ResponseVerifier = NewResponseVerifier(settings, c.Logger)
+	c.MemoryBudget = NewMemoryBudget(settings.MemoryLimit, settings.Metrics)
+	c.sender.SetMemoryBudget(c.MemoryBudget)
+	c.sender.SetCoalescingWindow(settings.CoalescingWindow)
+	c.journaled = c.sender.SetOutbox(settings.Outbox, c.Logger)
+
+	// The state is saved to the storage once it is prepared.
+	c.ClientSyncedState.SetStorage(nil, nil)
+	stored := &types.ClientState{}
+	if settings.Storage != nil {
+		state, err := settings.Storage.Load()
+		if err != nil {
+			return fmt.Errorf("cannot load the client state: %w", err)
+		}
+		if state != nil {
+			stored = state
+		}
+		// The command is redelivered once, the saved state no longer has it.
+		c.redeliveredCommand = stored.PendingCommand
+		if settings.InstanceUid == "" {
+			settings.InstanceUid = stored.InstanceUid
+		}
+		if settings.InstanceUid == "" {
+			// The Agent starts for the first time.
+			settings.InstanceUid = ulid.MustNew(ulid.Timestamp(time.Now()), rand.Reader).String()
+		}
+	}
 
 	// According to OpAMP spec this capability MUST be set, since all Agents MUST report status.
 	c.Capabilities |= protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus
@@ -87,6 +188,13 @@ func (c *ClientCommon) PrepareStart(
 	}
 
 	// Prepare remote config status.
+	if settings.RemoteConfigStatus == nil && c.journaled.GetRemoteConfigStatus() != nil {
+		// The status the previous run did not deliver.
+		settings.RemoteConfigStatus = c.journaled.RemoteConfigStatus
+	}
+	if settings.RemoteConfigStatus == nil {
+		settings.RemoteConfigStatus = stored.RemoteConfigStatus
+	}
 	if settings.RemoteConfigStatus == nil {
 		// RemoteConfigStatus is not provided. Start with empty.
 		settings.RemoteConfigStatus = &protobufs.RemoteConfigStatus{
@@ -100,6 +208,11 @@ func (c *ClientCommon) PrepareStart(
 
 	// Prepare package statuses.
 	c.PackagesStateProvider = settings.PackagesStateProvider
+	c.PackageDownloads = PackageDownloadSettings{
+		Downloaders:        settings.Downloaders,
+		MaxPatchedFileSize: settings.MaxPatchedFileSize,
+		MemoryBudget:       c.MemoryBudget,
+	}
 	var packageStatuses *protobufs.PackageStatuses
 	if settings.PackagesStateProvider != nil {
 		if c.Capabilities&protobufs.AgentCapabilities_AgentCapabilities_AcceptsPackages == 0 ||
@@ -107,9 +220,21 @@ func (c *ClientCommon) PrepareStart(
 			return ErrAcceptsPackagesNotSet
 		}
 
-		// Set package status from the value previously saved in the PackagesStateProvider.
+		// Set package status from the value previously saved in the PackagesStateProvider,
+		// or the newer one saved in the storage or the one the previous run did not
+		// deliver, reconciled with the packages that are actually installed.
+		saved := c.journaled.GetPackageStatuses()
+		if saved == nil {
+			saved = stored.PackageStatuses
+		}
 		var err error
-		packageStatuses, err = settings.PackagesStateProvider.LastReportedStatuses()
+		if saved != nil {
+			packageStatuses, err = reconcilePackageInventory(
+				proto.Clone(saved).(*protobufs.PackageStatuses), settings.PackagesStateProvider,
+			)
+		} else {
+			packageStatuses, err = PackageInventory(settings.PackagesStateProvider)
+		}
 		if err != nil {
 			return err
 		}
@@ -120,6 +245,10 @@ func (c *ClientCommon) PrepareStart(
 		}
 	}
 
+	if err := ValidateStartSettings(settings); err != nil {
+		return err
+	}
+
 	if packageStatuses == nil {
 		// PackageStatuses is not provided. Start with empty.
 		packageStatuses = &protobufs.PackageStatuses{}
@@ -134,18 +263,42 @@ func (c *ClientCommon) PrepareStart(
 		// Make sure it is always safe to call Callbacks.
 		c.Callbacks = types.CallbacksStruct{}
 	}
+	c.Callbacks = InstrumentCallbacks(c.Callbacks, settings.CallbackTimeout, c.Logger, c.Metrics)
+	c.Callbacks = connectionStateCallbacks{Callbacks: c.Callbacks, tracker: &c.connectionState}
+	c.Callbacks = boundOfferCallbacks(c.Callbacks, c, settings)
+	if settings.ReportRemoteConfigApplying {
+		c.Callbacks = remoteConfigApplyingCallbacks{Callbacks: c.Callbacks, client: c}
+	}
 
 	if err := c.sender.SetInstanceUid(settings.InstanceUid); err != nil {
 		return err
 	}
 
+	if c.ClientSyncedState.ConnectionSettingsStatus() == nil && stored.ConnectionSettingsStatus != nil {
+		if err := c.ClientSyncedState.SetConnectionSettingsStatus(stored.ConnectionSettingsStatus); err != nil {
+			return err
+		}
+	}
+	c.ClientSyncedState.SetInstanceUid(settings.InstanceUid)
+	c.ClientSyncedState.SetStorage(settings.Storage, c.Logger)
+	c.ClientSyncedState.Save()
+
+	c.startSettings = settings
 	return nil
 }
 
-// Stop stops the client. It returns an error if the client is not started.
+// Stop stops the client. It returns an error if the client is not started. Once
+// stopped the client may be started again.
 func (c *ClientCommon) Stop(ctx context.Context) error {
+	return c.StopAfter(ctx, nil)
+}
+
+// StopAfter stops the client like Stop, but calls disconnect first, once the client
+// is stopping and no longer reconnects, e.g. to close the connection gracefully.
+// disconnect must return once ctx is done. nil disconnect is not called.
+func (c *ClientCommon) StopAfter(ctx context.Context, disconnect func(ctx context.Context)) error {
 	if !c.isStarted {
-		return errCannotStopNotStarted
+		return ErrNotStarted
 	}
 
 	c.isStoppingMutex.Lock()
@@ -153,6 +306,9 @@ func (c *ClientCommon) Stop(ctx context.Context) error {
 	c.isStoppingFlag = true
 	c.isStoppingMutex.Unlock()
 
+	if disconnect != nil {
+		disconnect(ctx)
+	}
 	cancelFunc()
 
 	// Wait until stopping is finished.
@@ -161,9 +317,73 @@ func (c *ClientCommon) Stop(ctx context.Context) error {
 		return ctx.Err()
 	case <-c.stoppedSignal:
 	}
+
+	c.isStoppingMutex.Lock()
+	c.isStarted = false
+	c.isStoppingFlag = false
+	c.isStoppingMutex.Unlock()
+
+	c.connectionState.stopped(c.Callbacks)
 	return nil
 }
 
+// RestartSettings returns the settings to restart the client with: the settings
+// with the current instance uid and remote config status of the client, unless they
+// are set.
+func (c *ClientCommon) RestartSettings(settings types.StartSettings) types.StartSettings {
+	if settings.InstanceUid == "" {
+		settings.InstanceUid = c.sender.NextMessage().InstanceUid()
+	}
+	if settings.RemoteConfigStatus == nil {
+		settings.RemoteConfigStatus = c.ClientSyncedState.RemoteConfigStatus()
+	}
+	return settings
+}
+
+// ParseServerURL parses the OpAMP Server URL. Returns an error without the secrets
+// of the URL if it is invalid, or if its scheme is not one of the schemes.
+func ParseServerURL(serverURL string, schemes ...string) (*url.URL, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		// Don't leak the secrets of the URL to the error.
+		return nil, fmt.Errorf("invalid OpAMP Server URL: %w", errors.Unwrap(err))
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf(
+		"unsupported OpAMP Server URL scheme %q, must be one of %s", u.Scheme, strings.Join(schemes, ", "),
+	)
+}
+
+// ServerURLSettings returns the settings to restart the client with to connect to
+// the Server at serverURL: the settings of the last Start() with the OpAMPServerURL
+// replaced and without the ServerURLResolver, see RestartSettings. Returns ErrNotStarted if the client is not started,
+// or an error if the scheme of serverURL is not one of the schemes or the settings
+// are invalid.
+func (c *ClientCommon) ServerURLSettings(serverURL string, schemes ...string) (types.StartSettings, error) {
+	if !c.isStarted {
+		return types.StartSettings{}, ErrNotStarted
+	}
+
+	if _, err := ParseServerURL(serverURL, schemes...); err != nil {
+		return types.StartSettings{}, err
+	}
+
+	settings := c.startSettings
+	settings.OpAMPServerURL = serverURL
+	settings.ServerURLResolver = nil
+	if err := ValidateStartSettings(settings); err != nil {
+		return types.StartSettings{}, err
+	}
+	// Keep the current instance uid and remote config status.
+	settings.InstanceUid = ""
+	settings.RemoteConfigStatus = nil
+	return c.RestartSettings(settings), nil
+}
+
 // IsStopping returns true if Stop() was called.
 func (c *ClientCommon) IsStopping() bool {
 	c.isStoppingMutex.RLock()
@@ -186,6 +406,9 @@ func (c *ClientCommon) StartConnectAndRun(runner func(ctx context.Context)) {
 		return
 	}
 	c.runCancel = runCancel
+	c.connectionState.starting(c.Callbacks)
+	// Set before the runner starts, so that the callbacks observe it.
+	c.isStarted = true
 
 	go func() {
 		defer func() {
@@ -194,10 +417,112 @@ func (c *ClientCommon) StartConnectAndRun(runner func(ctx context.Context)) {
 			c.stoppedSignal <- struct{}{}
 		}()
 
+		if command := c.redeliveredCommand; command != nil {
+			c.redeliveredCommand = nil
+			executeCommand(runCtx, c.Logger, c.Callbacks, c.sender, &c.ClientSyncedState, c.Capabilities, command)
+		}
 		runner(runCtx)
 	}()
+}
 
-	c.isStarted = true
+// ConnectionState returns the current state of the connection to the Server.
+func (c *ClientCommon) ConnectionState() types.ConnectionState {
+	return c.connectionState.get()
+}
+
+// Flush sends the pending message and blocks until it is delivered or ctx is done.
+func (c *ClientCommon) Flush(ctx context.Context) error {
+	c.isStoppingMutex.RLock()
+	started := c.isStarted
+	c.isStoppingMutex.RUnlock()
+	if !started {
+		return ErrNotStarted
+	}
+	return c.sender.Flush(ctx)
+}
+
+// ConnectionLost records that the connection to the Server was lost with err and
+// the client is reconnecting. Does nothing if the client is stopping.
+func (c *ClientCommon) ConnectionLost(err error) {
+	if c.IsStopping() {
+		return
+	}
+	c.connectionState.failed(c.Callbacks, c.Redactor.RedactError(err))
+}
+
+// EnsureConnected calls tryConnectOnce until it succeeds, retrying according to the
+// RetryPolicy. tryConnectOnce returns an error if connecting fails and an optional
+// retryAfter duration to indicate to retry after the specified time as instructed by
+// the Server. Returns nil when connected or the error if ctx is cancelled. Used by
+// the transports that keep a connection open, i.e. WebSocket and gRPC.
+func (c *ClientCommon) EnsureConnected(
+	ctx context.Context,
+	tryConnectOnce func(ctx context.Context) (err error, retryAfter sharedinternal.OptionalDuration),
+) error {
+	retryBackoff := NewBackOff(c.RetryPolicy)
+
+	interval := time.Duration(0)
+
+	for {
+		timer := time.NewTimer(interval)
+		interval = retryBackoff.NextBackOff()
+		if interval == backoff.Stop {
+			// Retried for MaxElapsedTime, start over from the initial interval.
+			retryBackoff.Reset()
+			interval = retryBackoff.NextBackOff()
+		}
+
+		select {
+		case <-timer.C:
+			{
+				if err, retryAfter := tryConnectOnce(ctx); err != nil {
+					if errors.Is(err, context.Canceled) {
+						c.Logger.Debugf("Client is stopped, will not try anymore.")
+						return err
+					} else {
+						c.Logger.Errorf("Connection failed (%v), will retry.", err)
+					}
+					// Retry again a bit later.
+
+					if retryAfter.Defined && retryAfter.Duration > interval {
+						// If the Server suggested connecting later than our interval
+						// then honour Server's request, otherwise wait at least
+						// as much as we calculated.
+						interval = retryAfter.Duration
+					}
+
+					continue
+				}
+				// Connected successfully.
+				return nil
+			}
+
+		case <-ctx.Done():
+			c.Logger.Debugf("Client is stopped, will not try anymore.")
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// ReconnectOnTokenRefresh calls closeConn when the OAuth2 token the connection was
+// established with expires, i.e. at the refresh time of the token, unless ctx is
+// done before. Closing the connection makes the client reconnect with a new token.
+func (c *ClientCommon) ReconnectOnTokenRefresh(ctx context.Context, refresh time.Time, closeConn func()) {
+	delay := time.Until(refresh)
+	if delay <= 0 {
+		// The token is too short-lived to be refreshed before it is used, don't
+		// reconnect in a loop.
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		c.Logger.Debugf("The OAuth2 token expired, reconnecting.")
+		closeConn()
+	case <-ctx.Done():
+	}
 }
 
 // PrepareFirstMessage prepares the initial state of NextMessage struct that client
@@ -211,15 +536,28 @@ func (c *ClientCommon) PrepareFirstMessage(ctx context.Context) error {
 	c.sender.NextMessage().Update(
 		func(msg *protobufs.AgentToServer) {
 			msg.AgentDescription = c.ClientSyncedState.AgentDescription()
+			msg.Health = c.ClientSyncedState.Health()
 			msg.EffectiveConfig = cfg
 			msg.RemoteConfigStatus = c.ClientSyncedState.RemoteConfigStatus()
 			msg.PackageStatuses = c.ClientSyncedState.PackageStatuses()
 			msg.Capabilities = uint64(c.Capabilities)
+			if c.journaled != nil {
+				// Replay the other statuses and the flags the previous run did not
+				// deliver, once.
+				mergeUnsent(msg, c.journaled)
+				c.journaled = nil
+			}
 		},
 	)
 	return nil
 }
 
+// CompressionStats returns the sizes of the messages sent to the Server so far
+// before and after the compression.
+func (c *ClientCommon) CompressionStats() types.CompressionStats {
+	return c.sender.CompressionStats()
+}
+
 // AgentDescription returns the current state of the AgentDescription.
 func (c *ClientCommon) AgentDescription() *protobufs.AgentDescription {
 	// Return a cloned copy to allow caller to do whatever they want with the result.
@@ -243,19 +581,36 @@ func (c *ClientCommon) SetAgentDescription(descr *protobufs.AgentDescription) er
 	return nil
 }
 
-// SetHealth sends a status update to the Server with the new AgentHealth
-// and remembers the AgentHealth in the client state so that it can be sent
+// RequestInstanceUid sets the RequestInstanceUid flag in the next message and
+// schedules sending it. The flag is sent again with the next message if sending
+// fails.
+func (c *ClientCommon) RequestInstanceUid() {
+	c.sender.NextMessage().Update(func(msg *protobufs.AgentToServer) {
+		msg.Flags |= uint64(protobufs.AgentToServerFlags_AgentToServerFlags_RequestInstanceUid)
+	})
+	c.sender.JournalPending()
+	c.sender.ScheduleSend()
+}
+
+// SetHealth sends a status update to the Server with the new AgentHealth if it
+// changed and remembers the AgentHealth in the client state so that it can be sent
 // to the Server when the Server asks for it.
 func (c *ClientCommon) SetHealth(health *protobufs.AgentHealth) error {
+	changed := !proto.Equal(health, c.ClientSyncedState.AgentHealth())
 	// store the AgentHealth to send on reconnect
 	if err := c.ClientSyncedState.SetHealth(health); err != nil {
 		return err
 	}
+	if !changed {
+		// The Server already has it, or it is pending to be sent.
+		return nil
+	}
 	c.sender.NextMessage().Update(
 		func(msg *protobufs.AgentToServer) {
 			msg.Health = c.ClientSyncedState.Health()
 		},
 	)
+	c.sender.JournalPending()
 	c.sender.ScheduleSend()
 	return nil
 }
@@ -272,6 +627,12 @@ func (c *ClientCommon) UpdateEffectiveConfig(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("GetEffectiveConfig failed: %w", err)
 	}
+	if available := c.MemoryBudget.available(); available >= 0 && int64(proto.Size(cfg)) > available {
+		// Don't buffer it, the Agent may retry once the pending message is sent.
+		c.MemoryBudget.exceeded()
+		c.Logger.Errorf("Cannot send the effective config: %v", ErrMemoryLimitExceeded)
+		return ErrMemoryLimitExceeded
+	}
 
 	// Send it to the Server.
 	c.sender.NextMessage().Update(
@@ -310,12 +671,20 @@ func (c *ClientCommon) SetRemoteConfigStatus(status *protobufs.RemoteConfigStatu
 	}
 
 	if statusChanged {
-		// Let the Server know about the new status.
+		// Let the Agent persist the status, so that it is reported after a restart
+		// even if it cannot be sent before.
+		if c.Callbacks != nil {
+			c.Callbacks.SaveRemoteConfigStatus(context.Background(), c.ClientSyncedState.RemoteConfigStatus())
+		}
+
+		// Let the Server know about the new status. If sending fails the status is
+		// sent with the next message or after reconnecting.
 		c.sender.NextMessage().Update(
 			func(msg *protobufs.AgentToServer) {
 				msg.RemoteConfigStatus = c.ClientSyncedState.RemoteConfigStatus()
 			},
 		)
+		c.sender.JournalPending()
 		// TODO: if this call is coming from OnMessage callback don't schedule the send
 		// immediately, wait until the end of OnMessage to send one message only.
 		c.sender.ScheduleSend()
@@ -352,6 +721,7 @@ func (c *ClientCommon) SetPackageStatuses(statuses *protobufs.PackageStatuses) e
 				msg.PackageStatuses = c.ClientSyncedState.PackageStatuses()
 			},
 		)
+		c.sender.JournalPending()
 		// TODO: if this call is coming from OnMessage callback don't schedule the send
 		// immediately, wait until the end of OnMessage to send one message only.
 		c.sender.ScheduleSend()
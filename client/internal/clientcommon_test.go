@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestSetAgentDescriptionSchedulesReport(t *testing.T) {
+	sender := NewInMemorySender(TestLogger{t}, nil)
+	common := NewClientCommon(TestLogger{t}, NewRedactor(), sender)
+
+	descr := &protobufs.AgentDescription{
+		NonIdentifyingAttributes: []*protobufs.KeyValue{
+			{Key: "os.type", Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: "linux"}}},
+		},
+	}
+	require.NoError(t, common.SetAgentDescription(descr))
+	msg := sender.NextMessage().PopPending()
+	require.NotNil(t, msg)
+	assert.True(t, proto.Equal(descr, msg.AgentDescription))
+
+	// The attributes discovered later are reported.
+	descr.NonIdentifyingAttributes = append(descr.NonIdentifyingAttributes, &protobufs.KeyValue{
+		Key: "cloud.region", Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: "eu-west-1"}},
+	})
+	require.NoError(t, common.SetAgentDescription(descr))
+	msg = sender.NextMessage().PopPending()
+	require.NotNil(t, msg)
+	assert.True(t, proto.Equal(descr, msg.AgentDescription))
+}
+
+func TestSetHealthSchedulesChanges(t *testing.T) {
+	sender := NewInMemorySender(TestLogger{t}, nil)
+	common := NewClientCommon(TestLogger{t}, NewRedactor(), sender)
+
+	health := &protobufs.AgentHealth{Healthy: true, StartTimeUnixNano: 123}
+	require.NoError(t, common.SetHealth(health))
+	msg := sender.NextMessage().PopPending()
+	require.NotNil(t, msg)
+	assert.True(t, proto.Equal(health, msg.Health))
+
+	// Setting the same health does not schedule a report.
+	require.NoError(t, common.SetHealth(proto.Clone(health).(*protobufs.AgentHealth)))
+	assert.Nil(t, sender.NextMessage().PopPending())
+
+	// The changed health is reported.
+	health = &protobufs.AgentHealth{Healthy: false, StartTimeUnixNano: 123, LastError: "crashed"}
+	require.NoError(t, common.SetHealth(health))
+	msg = sender.NextMessage().PopPending()
+	require.NotNil(t, msg)
+	assert.True(t, proto.Equal(health, msg.Health))
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"sync"
 
+	"github.com/open-telemetry/opamp-go/client/types"
 	"github.com/open-telemetry/opamp-go/protobufs"
 	"google.golang.org/protobuf/proto"
 )
@@ -13,11 +14,14 @@ var (
 	errLastRemoteConfigHashNil          = errors.New("LastRemoteConfigHash is nil")
 	errPackageStatusesMissing           = errors.New("PackageStatuses is not set")
 	errServerProvidedAllPackagesHashNil = errors.New("ServerProvidedAllPackagesHash is nil")
+	errConnectionSettingsStatusMissing  = errors.New("ConnectionSettingsStatus is not set")
 )
 
 // ClientSyncedState stores the state of the Agent messages that the OpAMP Client needs to
-// have access to synchronize to the Server. 4 messages can be stored in this store:
-// AgentDescription, AgentHealth, RemoteConfigStatus and PackageStatuses.
+// have access to synchronize to the Server. 5 messages can be stored in this store:
+// AgentDescription, AgentHealth, RemoteConfigStatus, PackageStatuses and
+// ConnectionSettingsStatus. The ConnectionSettingsStatus is reported to the Server
+// in the AgentHealth, see types.ConnectionSettingsStatus.
 //
 // See OpAMP spec for more details on how state synchronization works:
 // https://github.com/open-telemetry/opamp-spec/blob/main/specification.md#Agent-to-Server-state-synchronization
@@ -29,6 +33,10 @@ var (
 // via GetEffectiveConfig callback when it is needed by OpAMP client and then it is
 // discarded from memory. See implementation of UpdateEffectiveConfig().
 //
+// If the ClientStorage is set the instance uid, the RemoteConfigStatus, the
+// PackageStatuses, the ConnectionSettingsStatus and the pending command are saved to
+// it whenever they are set.
+//
 // It is safe to call methods of this struct concurrently.
 type ClientSyncedState struct {
 	mutex sync.Mutex
@@ -37,6 +45,49 @@ type ClientSyncedState struct {
 	health             *protobufs.AgentHealth
 	remoteConfigStatus *protobufs.RemoteConfigStatus
 	packageStatuses    *protobufs.PackageStatuses
+
+	connectionSettingsStatus *types.ConnectionSettingsStatus
+
+	// The instance uid and the command not acknowledged yet, only kept to be saved
+	// to the storage.
+	instanceUid    string
+	pendingCommand *protobufs.ServerToAgentCommand
+
+	// Serializes the saving, so that the last saved state is the current one.
+	storageMutex sync.Mutex
+	storage      types.ClientStorage
+	logger       types.Logger
+}
+
+// SetStorage sets the storage the state is saved to, nil disables the saving. Must
+// not be called concurrently with the other methods.
+func (s *ClientSyncedState) SetStorage(storage types.ClientStorage, logger types.Logger) {
+	s.storage = storage
+	s.logger = logger
+}
+
+// Save saves the current state to the storage, if set. The state is saved whenever
+// it is set, Save is only needed to save it for the first time.
+func (s *ClientSyncedState) Save() {
+	if s.storage == nil {
+		return
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	s.mutex.Lock()
+	state := &types.ClientState{
+		InstanceUid:              s.instanceUid,
+		RemoteConfigStatus:       s.remoteConfigStatus,
+		ConnectionSettingsStatus: s.connectionSettingsStatus,
+		PackageStatuses:          s.packageStatuses,
+		PendingCommand:           s.pendingCommand,
+	}
+	s.mutex.Unlock()
+
+	if err := s.storage.Save(state); err != nil {
+		s.logger.Errorf("Cannot save the client state: %v", err)
+	}
 }
 
 func (s *ClientSyncedState) AgentDescription() *protobufs.AgentDescription {
@@ -45,7 +96,16 @@ func (s *ClientSyncedState) AgentDescription() *protobufs.AgentDescription {
 	return s.agentDescription
 }
 
+// Health returns the AgentHealth reported to the Server: the AgentHealth set by the
+// Agent with the rejection of the last connection settings offer, if any.
 func (s *ClientSyncedState) Health() *protobufs.AgentHealth {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return withConnectionSettingsRejection(s.health, s.connectionSettingsStatus)
+}
+
+// AgentHealth returns the AgentHealth set by the Agent.
+func (s *ClientSyncedState) AgentHealth() *protobufs.AgentHealth {
 	defer s.mutex.Unlock()
 	s.mutex.Lock()
 	return s.health
@@ -63,6 +123,36 @@ func (s *ClientSyncedState) PackageStatuses() *protobufs.PackageStatuses {
 	return s.packageStatuses
 }
 
+func (s *ClientSyncedState) ConnectionSettingsStatus() *types.ConnectionSettingsStatus {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return s.connectionSettingsStatus
+}
+
+// SetInstanceUid sets the instance uid in the state.
+func (s *ClientSyncedState) SetInstanceUid(instanceUid string) {
+	s.mutex.Lock()
+	changed := s.instanceUid != instanceUid
+	s.instanceUid = instanceUid
+	s.mutex.Unlock()
+
+	if changed {
+		s.Save()
+	}
+}
+
+// SetPendingCommand sets the command not acknowledged yet, nil once it is.
+func (s *ClientSyncedState) SetPendingCommand(command *protobufs.ServerToAgentCommand) {
+	s.mutex.Lock()
+	changed := s.pendingCommand != command
+	s.pendingCommand = command
+	s.mutex.Unlock()
+
+	if changed {
+		s.Save()
+	}
+}
+
 // SetAgentDescription sets the AgentDescription in the state.
 func (s *ClientSyncedState) SetAgentDescription(descr *protobufs.AgentDescription) error {
 	if descr == nil {
@@ -105,10 +195,11 @@ func (s *ClientSyncedState) SetRemoteConfigStatus(status *protobufs.RemoteConfig
 
 	clone := proto.Clone(status).(*protobufs.RemoteConfigStatus)
 
-	defer s.mutex.Unlock()
 	s.mutex.Lock()
 	s.remoteConfigStatus = clone
+	s.mutex.Unlock()
 
+	s.Save()
 	return nil
 }
 
@@ -120,9 +211,27 @@ func (s *ClientSyncedState) SetPackageStatuses(status *protobufs.PackageStatuses
 
 	clone := proto.Clone(status).(*protobufs.PackageStatuses)
 
-	defer s.mutex.Unlock()
 	s.mutex.Lock()
 	s.packageStatuses = clone
+	s.mutex.Unlock()
+
+	s.Save()
+	return nil
+}
+
+// SetConnectionSettingsStatus sets the ConnectionSettingsStatus in the state.
+func (s *ClientSyncedState) SetConnectionSettingsStatus(status *types.ConnectionSettingsStatus) error {
+	if status == nil {
+		return errConnectionSettingsStatusMissing
+	}
+
+	clone := *status
+	clone.Hash = append([]byte(nil), status.Hash...)
+
+	s.mutex.Lock()
+	s.connectionSettingsStatus = &clone
+	s.mutex.Unlock()
 
+	s.Save()
 	return nil
 }
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// executeCommand passes the command to the OnCommand callback. The command is
+// pending in the clientSyncedState, and so in the ClientStorage, until the callback
+// acknowledges it by returning. If the command failed and the Agent reports its
+// health the error is set as the LastError of the AgentHealth in the
+// clientSyncedState and sent to the Server. The protocol has no command result,
+// so only the error is forwarded. It stays in the AgentHealth until the Agent
+// sets its health again.
+func executeCommand(
+	ctx context.Context,
+	logger types.Logger,
+	callbacks types.Callbacks,
+	sender Sender,
+	clientSyncedState *ClientSyncedState,
+	capabilities protobufs.AgentCapabilities,
+	command *protobufs.ServerToAgentCommand,
+) {
+	clientSyncedState.SetPendingCommand(command)
+	err := callbacks.OnCommand(ctx, command)
+	clientSyncedState.SetPendingCommand(nil)
+	if err == nil {
+		return
+	}
+
+	logger.Errorf("The %s command failed: %v", command.Type, err)
+	if capabilities&protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth == 0 {
+		return
+	}
+	health := &protobufs.AgentHealth{}
+	if current := clientSyncedState.AgentHealth(); current != nil {
+		health = proto.Clone(current).(*protobufs.AgentHealth)
+	}
+	health.LastError = fmt.Sprintf("%s command failed: %v", command.Type, err)
+	// Store it, so that a later SetHealth is compared against what the Server has
+	// and the full state report carries it.
+	if err := clientSyncedState.SetHealth(health); err != nil {
+		logger.Errorf("Could not store the health: %v", err)
+		return
+	}
+	sender.NextMessage().Update(
+		func(msg *protobufs.AgentToServer) {
+			msg.Health = clientSyncedState.Health()
+		},
+	)
+	sender.JournalPending()
+	sender.ScheduleSend()
+}
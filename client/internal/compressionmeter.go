@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"sync/atomic"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// compressionMeter accumulates the sizes of the sent messages before and after the
+// compression. Can be used concurrently.
+type compressionMeter struct {
+	// Accessed atomically, kept first for 64-bit alignment.
+	messages           int64
+	compressedMessages int64
+	uncompressedBytes  int64
+	compressedBytes    int64
+
+	// Receives the sizes of the messages. nil if not set.
+	sizes types.SizeRecorder
+}
+
+// setMetrics sets the recorder of the sizes if the metrics implement
+// types.SizeRecorder. Must be called before any message is recorded.
+func (m *compressionMeter) setMetrics(metrics types.MetricsRecorder) {
+	m.sizes, _ = metrics.(types.SizeRecorder)
+}
+
+// record records the sent message. compressed is the size of the message as sent,
+// which equals uncompressed if the message was not compressed.
+func (m *compressionMeter) record(uncompressed, compressed int, isCompressed bool) {
+	atomic.AddInt64(&m.messages, 1)
+	if isCompressed {
+		atomic.AddInt64(&m.compressedMessages, 1)
+	}
+	atomic.AddInt64(&m.uncompressedBytes, int64(uncompressed))
+	atomic.AddInt64(&m.compressedBytes, int64(compressed))
+
+	if m.sizes != nil {
+		m.sizes.RecordSize(types.MetricSentUncompressedBytes, int64(uncompressed))
+		m.sizes.RecordSize(types.MetricSentCompressedBytes, int64(compressed))
+	}
+}
+
+func (m *compressionMeter) stats() types.CompressionStats {
+	return types.CompressionStats{
+		Messages:           atomic.LoadInt64(&m.messages),
+		CompressedMessages: atomic.LoadInt64(&m.compressedMessages),
+		UncompressedBytes:  atomic.LoadInt64(&m.uncompressedBytes),
+		CompressedBytes:    atomic.LoadInt64(&m.compressedBytes),
+	}
+}
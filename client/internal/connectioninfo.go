@@ -0,0 +1,21 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// SetConnectionInfoTLS fills the TLS related fields of the ConnectionInfo from the
+// TLS connection state. Does nothing if the state is nil (not a TLS connection).
+func SetConnectionInfoTLS(info *types.ConnectionInfo, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+	info.TLSVersion = state.Version
+	if len(state.PeerCertificates) > 0 {
+		fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+		info.ServerCertificateFingerprint = fingerprint[:]
+	}
+}
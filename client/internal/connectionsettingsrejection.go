@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"bytes"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// appliedConnectionSettingsStatus returns the status of the offers with the
+// specified hash when they are accepted.
+func appliedConnectionSettingsStatus(hash []byte) *types.ConnectionSettingsStatus {
+	return &types.ConnectionSettingsStatus{Hash: hash}
+}
+
+// rejectedConnectionSettingsStatus returns the status of the offers with the
+// specified hash when they are rejected.
+func rejectedConnectionSettingsStatus(
+	hash []byte, reason types.ConnectionSettingsRejectionReason, message string,
+) *types.ConnectionSettingsStatus {
+	return &types.ConnectionSettingsStatus{Hash: hash, Reason: reason, Message: message}
+}
+
+// isReportedConnectionSettings returns true if the offers with the specified hash
+// were already applied or rejected, as recorded in the status.
+func isReportedConnectionSettings(status *types.ConnectionSettingsStatus, hash []byte) bool {
+	return status != nil && len(hash) > 0 && bytes.Equal(status.Hash, hash)
+}
+
+// withConnectionSettingsRejection returns the AgentHealth reported to the Server:
+// a copy of the health with the rejection of the last offer at the first line of
+// the LastError if the offer was rejected, see types.ConnectionSettingsStatus. The
+// health as is otherwise, nil if health is nil.
+func withConnectionSettingsRejection(
+	health *protobufs.AgentHealth, status *types.ConnectionSettingsStatus,
+) *protobufs.AgentHealth {
+	if health == nil || !status.Rejected() {
+		return health
+	}
+	reported := proto.Clone(health).(*protobufs.AgentHealth)
+	reported.LastError = status.String()
+	if health.LastError != "" {
+		reported.LastError += "\n" + health.LastError
+	}
+	return reported
+}
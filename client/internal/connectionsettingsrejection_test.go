@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestIsReportedConnectionSettings(t *testing.T) {
+	rejected := rejectedConnectionSettingsStatus([]byte{0xab, 0xcd}, types.RejectionReasonPolicyDenied, "denied")
+	assert.True(t, rejected.Rejected())
+
+	assert.True(t, isReportedConnectionSettings(rejected, []byte{0xab, 0xcd}))
+	assert.False(t, isReportedConnectionSettings(rejected, []byte{0xab}))
+	assert.False(t, isReportedConnectionSettings(rejected, nil))
+	assert.True(t, isReportedConnectionSettings(appliedConnectionSettingsStatus([]byte{0xab, 0xcd}), []byte{0xab, 0xcd}))
+	assert.False(t, isReportedConnectionSettings(nil, []byte{0xab, 0xcd}))
+}
+
+func TestWithConnectionSettingsRejection(t *testing.T) {
+	health := &protobufs.AgentHealth{Healthy: true, LastError: "disk full"}
+	rejected := rejectedConnectionSettingsStatus([]byte{0xab, 0xcd}, types.RejectionReasonPolicyDenied, "not\nallowed")
+
+	reported := withConnectionSettingsRejection(health, rejected)
+	assert.Equal(t, "opamp.connection_settings.rejected reason=policy_denied hash=abcd: not allowed\ndisk full", reported.LastError)
+	assert.True(t, reported.Healthy)
+	assert.Equal(t, "disk full", health.LastError, "the health of the Agent must not change")
+
+	// The Server extracts the rejection and the error of the Agent.
+	status, rest := types.ParseConnectionSettingsStatus(reported.LastError)
+	require.NotNil(t, status)
+	assert.Equal(t, []byte{0xab, 0xcd}, status.Hash)
+	assert.Equal(t, types.RejectionReasonPolicyDenied, status.Reason)
+	assert.Equal(t, "not allowed", status.Message)
+	assert.Equal(t, "disk full", rest)
+
+	// Nothing to report once the offer is applied, or without the health.
+	assert.Same(t, health, withConnectionSettingsRejection(health, appliedConnectionSettingsStatus([]byte{1})))
+	assert.Nil(t, withConnectionSettingsRejection(nil, rejected))
+}
+
+func TestParseConnectionSettingsStatus(t *testing.T) {
+	tests := []struct {
+		text   string
+		status *types.ConnectionSettingsStatus
+		rest   string
+	}{
+		{
+			text:   "opamp.connection_settings.applied hash=0102",
+			status: &types.ConnectionSettingsStatus{Hash: []byte{1, 2}},
+		},
+		{
+			text:   "opamp.connection_settings.rejected reason=untrusted_ca hash=0102: x509: unknown authority",
+			status: &types.ConnectionSettingsStatus{Hash: []byte{1, 2}, Reason: types.RejectionReasonUntrustedCA, Message: "x509: unknown authority"},
+		},
+		{text: "disk full", rest: "disk full"},
+		{text: "", rest: ""},
+		{text: "opamp.connection_settings.applied hash=zz", rest: "opamp.connection_settings.applied hash=zz"},
+		{text: "opamp.connection_settings.rejected hash=0102: denied", rest: "opamp.connection_settings.rejected hash=0102: denied"},
+		{text: "opamp.connection_settings.rejected reason=other hash=0102", rest: "opamp.connection_settings.rejected reason=other hash=0102"},
+	}
+	for _, test := range tests {
+		status, rest := types.ParseConnectionSettingsStatus(test.text)
+		assert.Equal(t, test.status, status, test.text)
+		assert.Equal(t, test.rest, rest, test.text)
+	}
+}
+
+func TestRejectionReasonOf(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason types.ConnectionSettingsRejectionReason
+	}{
+		{
+			err:    types.RejectConnectionSettings(types.RejectionReasonPolicyDenied, "endpoint %s is not allowed", "x"),
+			reason: types.RejectionReasonPolicyDenied,
+		},
+		{
+			err:    fmt.Errorf("dial: %w", x509.UnknownAuthorityError{}),
+			reason: types.RejectionReasonUntrustedCA,
+		},
+		{
+			err:    fmt.Errorf("dial: %w", x509.HostnameError{Host: "example.com", Certificate: &x509.Certificate{}}),
+			reason: types.RejectionReasonHostnameMismatch,
+		},
+		{
+			err:    errors.New("something else"),
+			reason: types.RejectionReasonOther,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.reason, types.RejectionReasonOf(test.err), test.err.Error())
+	}
+}
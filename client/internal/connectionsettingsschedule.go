@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+const otherConnectionKindPrefix = "other:"
+
+// scheduledOffer is a connection settings offer of a single kind waiting for its
+// activation time.
+type scheduledOffer struct {
+	activateAt time.Time
+	offers     *protobufs.ConnectionSettingsOffers
+}
+
+// connectionSettingsSchedule keeps the connection settings offers that are not valid
+// yet. Only the latest offer of each kind of connection settings (OpAMP, own metrics,
+// own traces, own logs and each of the other connections) is kept: a newer offer of
+// the same kind replaces the pending one, whether the newer offer is pending or not.
+//
+// The schedule does not process the offers itself. Due() becomes readable when some
+// offers are due, the owner then fetches them using popDue() and processes them on
+// the same goroutine that processes the received messages.
+type connectionSettingsSchedule struct {
+	mutex   sync.Mutex
+	pending map[string]scheduledOffer
+	timer   *time.Timer
+	stopped bool
+
+	due chan struct{}
+}
+
+func newConnectionSettingsSchedule() *connectionSettingsSchedule {
+	return &connectionSettingsSchedule{
+		pending: map[string]scheduledOffer{},
+		due:     make(chan struct{}, 1),
+	}
+}
+
+// update records the received offers. The pending offers of the kinds present in
+// received are dropped and replaced by the offers in pending, keyed by their
+// activation time.
+func (s *connectionSettingsSchedule) update(
+	received *protobufs.ConnectionSettingsOffers, pending map[time.Time]*protobufs.ConnectionSettingsOffers,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	for kind := range connectionSettingsKinds(received) {
+		delete(s.pending, kind)
+	}
+	for activateAt, offers := range pending {
+		for kind, offer := range connectionSettingsKinds(offers) {
+			s.pending[kind] = scheduledOffer{activateAt: activateAt, offers: offer}
+		}
+	}
+	s.resetTimer()
+}
+
+// Due returns a channel that becomes readable when some of the pending offers are due.
+func (s *connectionSettingsSchedule) Due() <-chan struct{} {
+	return s.due
+}
+
+// popDue removes the offers that are due at the specified time from the schedule and
+// returns them. The offers of different kinds are merged if they were received in
+// the same ConnectionSettingsOffers message, i.e. have the same hash.
+func (s *connectionSettingsSchedule) popDue(now time.Time) []*protobufs.ConnectionSettingsOffers {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var due []*protobufs.ConnectionSettingsOffers
+	byHash := map[string]*protobufs.ConnectionSettingsOffers{}
+	for kind, scheduled := range s.pending {
+		if scheduled.activateAt.After(now) {
+			continue
+		}
+		delete(s.pending, kind)
+
+		merged, ok := byHash[string(scheduled.offers.Hash)]
+		if !ok {
+			merged = &protobufs.ConnectionSettingsOffers{}
+			byHash[string(scheduled.offers.Hash)] = merged
+			due = append(due, merged)
+		}
+		proto.Merge(merged, scheduled.offers)
+	}
+
+	if !s.stopped {
+		s.resetTimer()
+	}
+	return due
+}
+
+// stop drops all pending offers. The schedule cannot be used after this.
+func (s *connectionSettingsSchedule) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stopped = true
+	s.pending = map[string]scheduledOffer{}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// resetTimer arms the timer for the earliest pending offer. Must be called with
+// the mutex held.
+func (s *connectionSettingsSchedule) resetTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	var earliest time.Time
+	for _, scheduled := range s.pending {
+		if earliest.IsZero() || scheduled.activateAt.Before(earliest) {
+			earliest = scheduled.activateAt
+		}
+	}
+	if earliest.IsZero() {
+		return
+	}
+
+	s.timer = time.AfterFunc(time.Until(earliest), func() {
+		select {
+		case s.due <- struct{}{}:
+		default:
+			// Already signalled, not consumed yet.
+		}
+	})
+}
+
+// connectionSettingsKinds splits the offers into the offers of each kind of connection
+// settings present in offers. Every returned offer keeps the hash of offers.
+func connectionSettingsKinds(offers *protobufs.ConnectionSettingsOffers) map[string]*protobufs.ConnectionSettingsOffers {
+	kinds := map[string]*protobufs.ConnectionSettingsOffers{}
+	if offers == nil {
+		return kinds
+	}
+
+	kind := func(name string) *protobufs.ConnectionSettingsOffers {
+		offer := &protobufs.ConnectionSettingsOffers{Hash: offers.Hash}
+		kinds[name] = offer
+		return offer
+	}
+	if offers.Opamp != nil {
+		kind("opamp").Opamp = offers.Opamp
+	}
+	if offers.OwnMetrics != nil {
+		kind("own_metrics").OwnMetrics = offers.OwnMetrics
+	}
+	if offers.OwnTraces != nil {
+		kind("own_traces").OwnTraces = offers.OwnTraces
+	}
+	if offers.OwnLogs != nil {
+		kind("own_logs").OwnLogs = offers.OwnLogs
+	}
+	for name, other := range offers.OtherConnections {
+		kind(otherConnectionKindPrefix + name).OtherConnections = map[string]*protobufs.OtherConnectionSettings{
+			name: other,
+		}
+	}
+	return kinds
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestConnectionSettingsScheduleReplacesOffers(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+
+	s := newConnectionSettingsSchedule()
+	defer s.stop()
+
+	first := &protobufs.ConnectionSettingsOffers{
+		Hash:       []byte{1},
+		Opamp:      &protobufs.OpAMPConnectionSettings{DestinationEndpoint: "ws://first"},
+		OwnMetrics: &protobufs.TelemetryConnectionSettings{DestinationEndpoint: "http://metrics"},
+	}
+	s.update(first, map[time.Time]*protobufs.ConnectionSettingsOffers{later: first})
+
+	// A newer offer of the same kind replaces the pending one, even if it is active.
+	second := &protobufs.ConnectionSettingsOffers{
+		Hash:  []byte{2},
+		Opamp: &protobufs.OpAMPConnectionSettings{DestinationEndpoint: "ws://second"},
+	}
+	s.update(second, nil)
+
+	assert.Empty(t, s.popDue(now), "nothing is due yet")
+
+	due := s.popDue(later)
+	require.Len(t, due, 1)
+	assert.Nil(t, due[0].Opamp)
+	assert.EqualValues(t, "http://metrics", due[0].OwnMetrics.DestinationEndpoint)
+	assert.EqualValues(t, []byte{1}, due[0].Hash)
+
+	assert.Empty(t, s.popDue(later), "due offers are removed")
+}
+
+func TestConnectionSettingsScheduleDue(t *testing.T) {
+	s := newConnectionSettingsSchedule()
+
+	offers := &protobufs.ConnectionSettingsOffers{
+		Hash:  []byte{1},
+		Opamp: &protobufs.OpAMPConnectionSettings{DestinationEndpoint: "ws://soon"},
+		OtherConnections: map[string]*protobufs.OtherConnectionSettings{
+			"a": {DestinationEndpoint: "http://a"},
+		},
+	}
+	s.update(offers, map[time.Time]*protobufs.ConnectionSettingsOffers{
+		time.Now().Add(10 * time.Millisecond): offers,
+	})
+
+	select {
+	case <-s.Due():
+	case <-time.After(5 * time.Second):
+		t.Fatal("offers did not become due")
+	}
+
+	// Offers of the same message are merged.
+	due := s.popDue(time.Now())
+	require.Len(t, due, 1)
+	assert.EqualValues(t, "ws://soon", due[0].Opamp.DestinationEndpoint)
+	assert.EqualValues(t, "http://a", due[0].OtherConnections["a"].DestinationEndpoint)
+
+	// Stopped schedule does not keep offers.
+	s.stop()
+	s.update(offers, map[time.Time]*protobufs.ConnectionSettingsOffers{time.Now(): offers})
+	assert.Empty(t, s.popDue(time.Now()))
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// offerWindow is the time window in which a connection settings offer is valid.
+// Zero values mean there is no limit.
+type offerWindow struct {
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// extractOfferWindow removes the window headers from the headers and returns the window.
+func extractOfferWindow(headers *protobufs.Headers) (window offerWindow, err error) {
+	if headers == nil {
+		return window, nil
+	}
+
+	kept := headers.Headers[:0]
+	for _, header := range headers.Headers {
+		var target *time.Time
+		switch {
+		case strings.EqualFold(header.Key, types.ConnectionSettingsNotBeforeHeader):
+			target = &window.notBefore
+		case strings.EqualFold(header.Key, types.ConnectionSettingsNotAfterHeader):
+			target = &window.notAfter
+		default:
+			kept = append(kept, header)
+			continue
+		}
+
+		t, parseErr := time.Parse(time.RFC3339, header.Value)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid %s header: %v", header.Key, parseErr)
+			continue
+		}
+		*target = t
+	}
+	headers.Headers = kept
+
+	return window, err
+}
+
+// splitConnectionSettingsOffers splits the offers into the ones that are valid at the
+// specified time and the ones that become valid later, grouped by the activation
+// time. Expired and invalid offers are dropped. The window headers are removed from
+// the active offers and kept in the pending ones, so that they are checked again on
+// activation. The offers passed to this function are not modified.
+func splitConnectionSettingsOffers(
+	logger types.Logger, offers *protobufs.ConnectionSettingsOffers, now time.Time,
+) (active *protobufs.ConnectionSettingsOffers, pending map[time.Time]*protobufs.ConnectionSettingsOffers) {
+	active = proto.Clone(offers).(*protobufs.ConnectionSettingsOffers)
+	pending = map[time.Time]*protobufs.ConnectionSettingsOffers{}
+
+	pendingFor := func(t time.Time) *protobufs.ConnectionSettingsOffers {
+		if pending[t] == nil {
+			pending[t] = &protobufs.ConnectionSettingsOffers{Hash: offers.Hash}
+		}
+		return pending[t]
+	}
+
+	// check returns true if the offer is active now. If the offer is not active yet
+	// it is added to pending offers using add.
+	check := func(name string, headers *protobufs.Headers, add func(*protobufs.ConnectionSettingsOffers)) bool {
+		window, err := extractOfferWindow(headers)
+		switch {
+		case err != nil:
+			logger.Errorf("Ignoring %s connection settings: %v", name, err)
+			return false
+		case !window.notAfter.IsZero() && !now.Before(window.notAfter):
+			logger.Debugf("Ignoring %s connection settings, the offer expired at %v", name, window.notAfter)
+			return false
+		case !window.notBefore.IsZero() && now.Before(window.notBefore):
+			logger.Debugf("Scheduling %s connection settings for activation at %v", name, window.notBefore)
+			add(pendingFor(window.notBefore))
+			return false
+		}
+		return true
+	}
+
+	if active.Opamp != nil && !check("OpAMP", active.Opamp.Headers, func(p *protobufs.ConnectionSettingsOffers) {
+		p.Opamp = offers.Opamp
+	}) {
+		active.Opamp = nil
+	}
+	if active.OwnMetrics != nil && !check("own metrics", active.OwnMetrics.Headers, func(p *protobufs.ConnectionSettingsOffers) {
+		p.OwnMetrics = offers.OwnMetrics
+	}) {
+		active.OwnMetrics = nil
+	}
+	if active.OwnTraces != nil && !check("own traces", active.OwnTraces.Headers, func(p *protobufs.ConnectionSettingsOffers) {
+		p.OwnTraces = offers.OwnTraces
+	}) {
+		active.OwnTraces = nil
+	}
+	if active.OwnLogs != nil && !check("own logs", active.OwnLogs.Headers, func(p *protobufs.ConnectionSettingsOffers) {
+		p.OwnLogs = offers.OwnLogs
+	}) {
+		active.OwnLogs = nil
+	}
+	for name, other := range active.OtherConnections {
+		name := name
+		if !check(name, other.Headers, func(p *protobufs.ConnectionSettingsOffers) {
+			if p.OtherConnections == nil {
+				p.OtherConnections = map[string]*protobufs.OtherConnectionSettings{}
+			}
+			p.OtherConnections[name] = offers.OtherConnections[name]
+		}) {
+			delete(active.OtherConnections, name)
+		}
+	}
+	if active.OtherConnections != nil && len(active.OtherConnections) == 0 {
+		active.OtherConnections = nil
+	}
+
+	return active, pending
+}
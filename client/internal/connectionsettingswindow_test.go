@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func windowHeaders(notBefore, notAfter string) *protobufs.Headers {
+	headers := &protobufs.Headers{Headers: []*protobufs.Header{{Key: "Authorization", Value: "secret"}}}
+	if notBefore != "" {
+		headers.Headers = append(headers.Headers, &protobufs.Header{Key: types.ConnectionSettingsNotBeforeHeader, Value: notBefore})
+	}
+	if notAfter != "" {
+		headers.Headers = append(headers.Headers, &protobufs.Header{Key: types.ConnectionSettingsNotAfterHeader, Value: notAfter})
+	}
+	return headers
+}
+
+func TestSplitConnectionSettingsOffers(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+
+	offers := &protobufs.ConnectionSettingsOffers{
+		Hash: []byte{1},
+		// Active, within the window.
+		Opamp: &protobufs.OpAMPConnectionSettings{
+			Headers: windowHeaders(now.Add(-time.Hour).Format(time.RFC3339), later.Format(time.RFC3339)),
+		},
+		// Not active yet.
+		OwnMetrics: &protobufs.TelemetryConnectionSettings{
+			Headers: windowHeaders(later.Format(time.RFC3339), ""),
+		},
+		// Expired.
+		OwnTraces: &protobufs.TelemetryConnectionSettings{
+			Headers: windowHeaders("", now.Format(time.RFC3339)),
+		},
+		// Invalid window.
+		OwnLogs: &protobufs.TelemetryConnectionSettings{
+			Headers: windowHeaders("tomorrow", ""),
+		},
+		OtherConnections: map[string]*protobufs.OtherConnectionSettings{
+			"no-window": {DestinationEndpoint: "http://other.com"},
+			"later":     {Headers: windowHeaders(later.Format(time.RFC3339), "")},
+		},
+	}
+
+	active, pending := splitConnectionSettingsOffers(&sharedinternal.NopLogger{}, offers, now)
+
+	require.NotNil(t, active.Opamp)
+	assert.Len(t, active.Opamp.Headers.Headers, 1, "window headers must be removed")
+	assert.Nil(t, active.OwnMetrics)
+	assert.Nil(t, active.OwnTraces)
+	assert.Nil(t, active.OwnLogs)
+	assert.Len(t, active.OtherConnections, 1)
+	assert.NotNil(t, active.OtherConnections["no-window"])
+
+	require.Len(t, pending, 1)
+	scheduled := pending[later]
+	require.NotNil(t, scheduled)
+	assert.EqualValues(t, []byte{1}, scheduled.Hash)
+	assert.NotNil(t, scheduled.OwnMetrics)
+	assert.NotNil(t, scheduled.OtherConnections["later"])
+	assert.Nil(t, scheduled.Opamp)
+
+	// The original offers must not be modified.
+	assert.Len(t, offers.Opamp.Headers.Headers, 3)
+	assert.NotNil(t, offers.OwnTraces)
+}
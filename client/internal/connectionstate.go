@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// errConnectionLost is the error of the lost connection when the transport did not
+// report any.
+var errConnectionLost = errors.New("connection to the Server lost")
+
+// connectionStateTracker keeps the ConnectionState of the client and reports its
+// transitions to the OnConnectionStateChange callback.
+type connectionStateTracker struct {
+	// Serializes the transitions so that the callback observes them in order.
+	transitionMutex sync.Mutex
+
+	mutex sync.Mutex
+	state types.ConnectionState
+}
+
+// get returns the current state.
+func (t *connectionStateTracker) get() types.ConnectionState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.state
+}
+
+// transition updates the state with update and calls the OnConnectionStateChange
+// callback if the status changed.
+func (t *connectionStateTracker) transition(
+	callbacks types.Callbacks, update func(state *types.ConnectionState),
+) {
+	t.transitionMutex.Lock()
+	defer t.transitionMutex.Unlock()
+
+	t.mutex.Lock()
+	prevStatus := t.state.Status
+	update(&t.state)
+	state := t.state
+	t.mutex.Unlock()
+
+	if state.Status != prevStatus && callbacks != nil {
+		callbacks.OnConnectionStateChange(state)
+	}
+}
+
+// starting resets the state when the client starts connecting.
+func (t *connectionStateTracker) starting(callbacks types.Callbacks) {
+	t.transition(callbacks, func(state *types.ConnectionState) {
+		*state = types.ConnectionState{Status: types.ConnectionConnecting}
+	})
+}
+
+// connected records that the client connected, unless it is already connected.
+func (t *connectionStateTracker) connected(callbacks types.Callbacks, info types.ConnectionInfo) {
+	t.transition(callbacks, func(state *types.ConnectionState) {
+		if state.Status == types.ConnectionConnected {
+			// HTTP transport reports every successful request.
+			state.Info = info
+			return
+		}
+		state.Status = types.ConnectionConnected
+		state.ConnectedSince = time.Now()
+		state.Info = info
+	})
+}
+
+// failed records that connecting failed or the connection was lost with err and
+// the client is reconnecting.
+func (t *connectionStateTracker) failed(callbacks types.Callbacks, err error) {
+	if err == nil {
+		err = errConnectionLost
+	}
+	t.transition(callbacks, func(state *types.ConnectionState) {
+		*state = types.ConnectionState{Status: types.ConnectionConnecting, LastError: err}
+	})
+}
+
+// stopped records that the client stopped, keeping the last error.
+func (t *connectionStateTracker) stopped(callbacks types.Callbacks) {
+	t.transition(callbacks, func(state *types.ConnectionState) {
+		*state = types.ConnectionState{Status: types.ConnectionDisconnected, LastError: state.LastError}
+	})
+}
+
+// connectionStateCallbacks records the connection state from the OnConnect and
+// OnConnectFailed calls of the transports before passing them to the wrapped
+// Callbacks.
+type connectionStateCallbacks struct {
+	types.Callbacks
+	tracker *connectionStateTracker
+}
+
+func (c connectionStateCallbacks) OnConnect(info types.ConnectionInfo) {
+	c.tracker.connected(c.Callbacks, info)
+	c.Callbacks.OnConnect(info)
+}
+
+func (c connectionStateCallbacks) OnConnectFailed(err error) {
+	c.tracker.failed(c.Callbacks, err)
+	c.Callbacks.OnConnectFailed(err)
+}
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// DefaultEndpointGracePeriod is the time the new OpAMP Server endpoint must stay
+// healthy before the Agent is told to cut over to it.
+const DefaultEndpointGracePeriod = 10 * time.Second
+
+// Number of health checks performed during the grace period.
+const endpointHealthChecks = 5
+
+// EndpointVerifier verifies that the OpAMP Server at the endpoint offered in the
+// settings is reachable and stays healthy for gracePeriod.
+type EndpointVerifier func(
+	ctx context.Context, settings *protobufs.OpAMPConnectionSettings, gracePeriod time.Duration,
+) error
+
+// CertificateSwitcher switches the connection to the current OpAMP Server endpoint
+// to the client certificate offered in the accepted settings and reconnects.
+type CertificateSwitcher func(offered *protobufs.TLSCertificate) error
+
+// EndpointSwitcher switches the connection to the destination endpoint of the
+// accepted settings, with the offered headers and client certificate, and reconnects.
+type EndpointSwitcher func(settings *protobufs.OpAMPConnectionSettings) error
+
+// EndpointTransition verifies the new OpAMP Server endpoints and client certificates
+// offered by the Server. The current connection stays in use while the verification
+// is in progress, the Agent is only told to cut over to the new endpoint once it
+// proved healthy. An offered certificate is verified by connecting to the current
+// endpoint with it if the offer does not specify a new endpoint.
+type EndpointTransition struct {
+	verifier         EndpointVerifier
+	switcher         CertificateSwitcher
+	endpointSwitcher EndpointSwitcher
+	gracePeriod      time.Duration
+
+	// The endpoint that is being verified, empty for the current endpoint.
+	endpoint      string
+	inProgress    bool
+	endpointMutex sync.Mutex
+}
+
+// NewEndpointTransition creates a new EndpointTransition that uses the verifier to
+// check the health of the offered endpoints, the switcher to start using the
+// accepted client certificates and the endpointSwitcher to start using the accepted
+// endpoints. endpointSwitcher is nil if the Agent switches to the accepted endpoints
+// itself. If gracePeriod is 0 then DefaultEndpointGracePeriod is used.
+func NewEndpointTransition(
+	verifier EndpointVerifier, switcher CertificateSwitcher, endpointSwitcher EndpointSwitcher,
+	gracePeriod time.Duration,
+) *EndpointTransition {
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultEndpointGracePeriod
+	}
+	return &EndpointTransition{
+		verifier: verifier, switcher: switcher, endpointSwitcher: endpointSwitcher, gracePeriod: gracePeriod,
+	}
+}
+
+// NeedsVerification returns true if the settings offer a new endpoint or a new client
+// certificate, which must be verified before the settings are accepted.
+func NeedsVerification(settings *protobufs.OpAMPConnectionSettings) bool {
+	return settings.DestinationEndpoint != "" || settings.Certificate != nil
+}
+
+// InProgress returns the endpoint that is being verified if there is a transition
+// in progress. The endpoint is empty if the current endpoint is verified with the
+// offered certificate.
+func (t *EndpointTransition) InProgress() (endpoint string, inProgress bool) {
+	t.endpointMutex.Lock()
+	defer t.endpointMutex.Unlock()
+	return t.endpoint, t.inProgress
+}
+
+// SwitchCertificate starts using the client certificate of the accepted settings
+// for the connection to the current endpoint. Does nothing if the settings do not
+// offer a certificate. A certificate offered together with a new endpoint was only
+// verified with the new endpoint, it is used when the Agent cuts over to it.
+func (t *EndpointTransition) SwitchCertificate(settings *protobufs.OpAMPConnectionSettings) error {
+	if settings.Certificate == nil || settings.DestinationEndpoint != "" || t.switcher == nil {
+		return nil
+	}
+	return t.switcher(settings.Certificate)
+}
+
+// SwitchEndpoint starts using the destination endpoint of the accepted settings, with
+// the offered headers and client certificate. Does nothing if the settings do not
+// offer an endpoint or the Agent switches to the accepted endpoints itself.
+func (t *EndpointTransition) SwitchEndpoint(settings *protobufs.OpAMPConnectionSettings) error {
+	if settings.DestinationEndpoint == "" || t.endpointSwitcher == nil {
+		return nil
+	}
+	return t.endpointSwitcher(settings)
+}
+
+// Start verifies the endpoint offered in the settings in the background and calls
+// done with the result of the verification. The error is nil if the endpoint stayed
+// healthy during the grace period.
+func (t *EndpointTransition) Start(
+	ctx context.Context,
+	logger types.Logger,
+	settings *protobufs.OpAMPConnectionSettings,
+	done func(err error),
+) {
+	t.endpointMutex.Lock()
+	t.endpoint = settings.DestinationEndpoint
+	t.inProgress = true
+	t.endpointMutex.Unlock()
+
+	go func() {
+		if settings.DestinationEndpoint != "" {
+			logger.Debugf("Verifying OpAMP Server endpoint %s before switching to it", settings.DestinationEndpoint)
+		} else {
+			logger.Debugf("Verifying the offered client certificate before switching to it")
+		}
+		err := t.verifier(ctx, settings, t.gracePeriod)
+
+		t.endpointMutex.Lock()
+		t.endpoint = ""
+		t.inProgress = false
+		t.endpointMutex.Unlock()
+
+		done(err)
+	}()
+}
+
+// VerifyEndpointHealth calls check immediately and then periodically until the
+// grace period elapses. Returns the first error returned by check or the ctx error
+// if the ctx is done before the grace period elapses.
+func VerifyEndpointHealth(ctx context.Context, gracePeriod time.Duration, check func() error) error {
+	deadline := time.NewTimer(gracePeriod)
+	defer deadline.Stop()
+	ticker := time.NewTicker(gracePeriod / endpointHealthChecks)
+	defer ticker.Stop()
+
+	if err := check(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := check(); err != nil {
+				return err
+			}
+		case <-deadline.C:
+			// Check one last time, the endpoint must be healthy at the end of
+			// the grace period too.
+			return check()
+		}
+	}
+}
+
+// OfferedRequestHeader returns the HTTP headers to use when connecting to the offered
+// OpAMP Server endpoint. These are the current headers overridden by the headers
+// that are specified in the offer.
+func OfferedRequestHeader(current http.Header, offered *protobufs.Headers) http.Header {
+	header := current.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	for _, h := range offered.GetHeaders() {
+		header.Set(h.Key, h.Value)
+	}
+	return header
+}
+
+var errInvalidOfferedCA = errors.New("offered CA certificate is invalid")
+
+// OfferedTLSConfig returns the TLS config to use when connecting to the offered
+// OpAMP Server endpoint. This is the current config with the client certificate and
+// the CA certificate replaced by the ones specified in the offer, if any. Returns a
+// ConnectionSettingsRejectedError if the offered certificates are invalid.
+func OfferedTLSConfig(current *tls.Config, offered *protobufs.TLSCertificate) (*tls.Config, error) {
+	config, err := offeredTLSConfig(current, offered)
+	if err != nil {
+		return nil, types.RejectConnectionSettings(types.RejectionReasonInvalidCertificate, "%w", err)
+	}
+	return config, nil
+}
+
+func offeredTLSConfig(current *tls.Config, offered *protobufs.TLSCertificate) (*tls.Config, error) {
+	if offered == nil {
+		return current, nil
+	}
+
+	config := &tls.Config{}
+	if current != nil {
+		config = current.Clone()
+	}
+	if len(offered.PublicKey) > 0 || len(offered.PrivateKey) > 0 {
+		cert, err := tls.X509KeyPair(offered.PublicKey, offered.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkValidity(cert, time.Now()); err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(offered.CaPublicKey) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(offered.CaPublicKey) {
+			return nil, errInvalidOfferedCA
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// checkValidity returns an error if the leaf certificate of the chain is not valid
+// at the time, so that an expired certificate is not switched to.
+func checkValidity(cert tls.Certificate, now time.Time) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("offered client certificate is not valid before %v", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("offered client certificate expired at %v", leaf.NotAfter)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestVerifyEndpointHealth(t *testing.T) {
+	gracePeriod := 100 * time.Millisecond
+
+	checks := 0
+	err := VerifyEndpointHealth(context.Background(), gracePeriod, func() error {
+		checks++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, checks, 2, "must check at the start and at the end of the grace period")
+
+	errUnhealthy := errors.New("unhealthy")
+	checks = 0
+	err = VerifyEndpointHealth(context.Background(), gracePeriod, func() error {
+		checks++
+		if checks == 3 {
+			return errUnhealthy
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, errUnhealthy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = VerifyEndpointHealth(ctx, time.Hour, func() error { return nil })
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestOfferedRequestHeader(t *testing.T) {
+	current := http.Header{}
+	current.Set("Authorization", "old")
+	current.Set("X-Agent", "agent")
+
+	header := OfferedRequestHeader(current, &protobufs.Headers{
+		Headers: []*protobufs.Header{{Key: "Authorization", Value: "new"}},
+	})
+	assert.Equal(t, "new", header.Get("Authorization"))
+	assert.Equal(t, "agent", header.Get("X-Agent"))
+	assert.Equal(t, "old", current.Get("Authorization"), "current headers must not change")
+
+	assert.Empty(t, OfferedRequestHeader(nil, nil))
+}
+
+func TestOfferedTLSConfig(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	current := &tls.Config{ServerName: "server"}
+	config, err := OfferedTLSConfig(current, nil)
+	require.NoError(t, err)
+	assert.Same(t, current, config)
+
+	config, err = OfferedTLSConfig(current, &protobufs.TLSCertificate{
+		PublicKey:   certPem,
+		PrivateKey:  keyPem,
+		CaPublicKey: certPem,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "server", config.ServerName)
+	assert.Len(t, config.Certificates, 1)
+	assert.NotNil(t, config.RootCAs)
+	assert.Empty(t, current.Certificates, "current config must not change")
+
+	_, err = OfferedTLSConfig(nil, &protobufs.TLSCertificate{CaPublicKey: []byte("invalid")})
+	assert.ErrorIs(t, err, errInvalidOfferedCA)
+
+	_, err = OfferedTLSConfig(nil, &protobufs.TLSCertificate{PublicKey: certPem})
+	assert.Error(t, err)
+	assert.Equal(t, types.RejectionReasonInvalidCertificate, types.RejectionReasonOf(err))
+
+	// An expired certificate is rejected.
+	template.NotAfter = time.Now().Add(-time.Hour)
+	der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	expiredPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	_, err = OfferedTLSConfig(nil, &protobufs.TLSCertificate{PublicKey: expiredPem, PrivateKey: keyPem})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expired")
+	assert.Equal(t, types.RejectionReasonInvalidCertificate, types.RejectionReasonOf(err))
+}
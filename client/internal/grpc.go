@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// GRPCConnectMethod is the full name of the gRPC method the client calls to connect
+// to the Server. It is a bidirectional streaming method: the client streams the
+// AgentToServer messages and the Server streams the ServerToAgent messages.
+const GRPCConnectMethod = "/opamp.proto.OpAMPService/Connect"
+
+// GRPCConnectStream describes the stream of GRPCConnectMethod.
+var GRPCConnectStream = grpc.StreamDesc{
+	StreamName:    "Connect",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// GRPCTarget returns the gRPC dial target of the Server at serverURL, i.e. its host
+// and port. The port defaults to 443 for the grpcs scheme and to 80 otherwise.
+func GRPCTarget(serverURL *url.URL) string {
+	if serverURL.Port() != "" {
+		return serverURL.Host
+	}
+	return net.JoinHostPort(serverURL.Hostname(), defaultPort(serverURL.Scheme))
+}
+
+// GRPCMetadata returns the header as the metadata of a gRPC call. The names of the
+// headers are lowercased.
+func GRPCMetadata(header http.Header) metadata.MD {
+	md := metadata.MD{}
+	for name, values := range header {
+		md.Append(name, values...)
+	}
+	return md
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// grpcReceiver implements the gRPC client's receiving portion of OpAMP protocol.
+type grpcReceiver struct {
+	stream    grpc.ClientStream
+	logger    types.Logger
+	processor receivedProcessor
+}
+
+// NewGRPCReceiver creates a new Receiver that uses a gRPC stream to receive
+// messages from the server.
+func NewGRPCReceiver(
+	logger types.Logger,
+	callbacks types.Callbacks,
+	stream grpc.ClientStream,
+	sender *GRPCSender,
+	clientSyncedState *ClientSyncedState,
+	packagesStateProvider types.PackagesStateProvider,
+	packageDownloads PackageDownloadSettings,
+	endpointTransition *EndpointTransition,
+	capabilities protobufs.AgentCapabilities,
+	specCompliance *SpecCompliance,
+	responseVerifier *ResponseVerifier,
+) *grpcReceiver {
+	return &grpcReceiver{
+		stream:    stream,
+		logger:    logger,
+		processor: newReceivedProcessor(logger, callbacks, sender, clientSyncedState, packagesStateProvider, packageDownloads, endpointTransition, capabilities, specCompliance, responseVerifier),
+	}
+}
+
+// ReceiverLoop runs the receiver loop until receiving from the stream fails, see
+// wsReceiver.ReceiverLoop. To stop the receiver cancel the context of the stream.
+// Returns the error that ended the loop.
+func (r *grpcReceiver) ReceiverLoop(ctx context.Context) error {
+	err := r.processor.receiveLoop(ctx, func(msg *protobufs.ServerToAgent) error {
+		return r.stream.RecvMsg(msg)
+	})
+	// io.EOF means that the Server ended the stream.
+	if ctx.Err() == nil && !errors.Is(err, io.EOF) {
+		r.logger.Errorf("Unexpected error while receiving: %v", err)
+	}
+	return err
+}
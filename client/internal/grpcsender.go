@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"compress/gzip"
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// GRPCSender implements the gRPC client's sending portion of OpAMP protocol.
+type GRPCSender struct {
+	SenderCommon
+	stream grpc.ClientStream
+	logger types.Logger
+	// Indicates that the sender has fully stopped.
+	stopped chan struct{}
+	// Send a heartbeat if no message was sent for this long. Disabled if 0.
+	heartbeatInterval time.Duration
+	// Calculates the compressed sizes of the sent messages. nil if the messages
+	// are not compressed.
+	gzipper *grpcMessageGzipper
+}
+
+// NewGRPCSender creates a new Sender that uses a gRPC stream to send messages to
+// the server.
+func NewGRPCSender(logger types.Logger) *GRPCSender {
+	return &GRPCSender{
+		logger:       logger,
+		SenderCommon: NewSenderCommon(),
+	}
+}
+
+// Start the sender and send the first message that was set via NextMessage().Update()
+// earlier. To stop the GRPCSender cancel the ctx.
+func (s *GRPCSender) Start(ctx context.Context, stream grpc.ClientStream) error {
+	s.stream = stream
+	err := s.sendNextMessage()
+
+	// Run the sender in the background.
+	s.stopped = make(chan struct{})
+	go s.run(ctx)
+
+	return err
+}
+
+// SetHeartbeatInterval enables sending a heartbeat message if no other message was
+// sent for the interval, see WSSender.SetHeartbeatInterval. Must be called before
+// Start.
+func (s *GRPCSender) SetHeartbeatInterval(interval time.Duration) {
+	s.heartbeatInterval = interval
+}
+
+// SetCompression sets whether the messages are compressed with gzip on the stream,
+// so that their compressed sizes are measured, see CompressionStats. Must be called
+// before Start.
+func (s *GRPCSender) SetCompression(enabled bool) {
+	s.gzipper = nil
+	if enabled {
+		s.gzipper = newGRPCMessageGzipper()
+	}
+}
+
+// WaitToStop blocks until the sender is stopped. To stop the sender cancel the context
+// that was passed to Start().
+func (s *GRPCSender) WaitToStop() {
+	<-s.stopped
+}
+
+func (s *GRPCSender) run(ctx context.Context) {
+	s.runStreamLoop(ctx, s.heartbeatInterval, s.sendMessage)
+	close(s.stopped)
+}
+
+func (s *GRPCSender) sendNextMessage() error {
+	// The statuses must reach the Server, they are sent after reconnecting if
+	// sending fails.
+	return s.sendPending(s.sendMessage)
+}
+
+func (s *GRPCSender) sendMessage(msg *protobufs.AgentToServer) error {
+	if err := s.stream.SendMsg(msg); err != nil {
+		s.logger.Errorf("Cannot send gRPC message: %v", err)
+		return err
+	}
+
+	size := proto.Size(msg)
+	if s.gzipper == nil {
+		s.compression.record(size, size, false)
+	} else {
+		// The stream compresses the message internally, compress it once more to
+		// learn its compressed size.
+		s.compression.record(size, s.gzipper.gzippedSize(msg), true)
+	}
+	return nil
+}
+
+// grpcMessageGzipper calculates the size of the messages compressed by the gzip
+// compressor of gRPC. Not safe for concurrent use.
+type grpcMessageGzipper struct {
+	writer *gzip.Writer
+	size   grpcByteCounter
+}
+
+func newGRPCMessageGzipper() *grpcMessageGzipper {
+	g := &grpcMessageGzipper{}
+	g.writer = gzip.NewWriter(&g.size)
+	return g
+}
+
+// gzippedSize returns the size of the compressed message, without the gRPC message
+// header.
+func (g *grpcMessageGzipper) gzippedSize(msg *protobufs.AgentToServer) int {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		// The stream marshaled the message already, this cannot fail.
+		return proto.Size(msg)
+	}
+	g.size = 0
+	g.writer.Reset(&g.size)
+	// Writes to grpcByteCounter cannot fail.
+	_, _ = g.writer.Write(data)
+	_ = g.writer.Close()
+	return int(g.size)
+}
+
+// grpcByteCounter is an io.Writer that counts the written bytes.
+type grpcByteCounter int64
+
+func (c *grpcByteCounter) Write(p []byte) (int, error) {
+	*c += grpcByteCounter(len(p))
+	return len(p), nil
+}
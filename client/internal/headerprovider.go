@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
+)
+
+// HeaderProvider returns the additional headers to send with the next request, see
+// StartSettings.HeaderProvider.
+type HeaderProvider func(ctx context.Context) (http.Header, error)
+
+// ProvidedHeader returns the headers to send with the next request: a copy of the
+// header with the headers returned by the provider added, replacing the values of
+// the headers with the same names. The secrets of the provided headers are passed
+// to the redactor. Returns the header as is if the provider is nil.
+func ProvidedHeader(
+	ctx context.Context, header http.Header, provider HeaderProvider, redactor *Redactor,
+) (http.Header, error) {
+	if provider == nil {
+		return header, nil
+	}
+
+	provided, err := provider(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("HeaderProvider failed: %w", err)
+	}
+	if err := sharedinternal.ValidateHTTPHeader(provided); err != nil {
+		return nil, fmt.Errorf("HeaderProvider returned invalid header: %w", err)
+	}
+	redactor.SetProvidedHeader(provided)
+
+	merged := header.Clone()
+	if merged == nil {
+		merged = http.Header{}
+	}
+	for name, values := range provided {
+		merged[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+	return merged, nil
+}
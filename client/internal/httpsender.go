@@ -8,7 +8,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -33,16 +36,44 @@ const encodingTypeGZip = "gzip"
 type HTTPSender struct {
 	SenderCommon
 
+	// The URL of the Server. Replaced by the URL the Server permanently redirects
+	// to and by the accepted offered endpoint, guarded by clientMutex.
 	url                string
 	logger             types.Logger
-	client             *http.Client
+	proxy              func(*http.Request) (*url.URL, error)
+	dialContext        func(ctx context.Context, network, addr string) (net.Conn, error)
 	callbacks          types.Callbacks
 	pollingIntervalMs  int64
 	compressionEnabled bool
+	retryPolicy        types.RetryPolicy
 
-	// Headers to send with all requests.
+	// The transport set by the user, nil if the transport is built from the TLS
+	// config and the proxy.
+	roundTripper http.RoundTripper
+
+	// Decides which redirects the client follows.
+	checkRedirect func(req *http.Request, via []*http.Request) error
+
+	// The client that sends the requests and its TLS config. They change when the
+	// sender switches to the client certificate offered by the Server.
+	client      *http.Client
+	tlsConfig   *tls.Config
+	clientMutex sync.RWMutex
+
+	// Headers to send with all requests. Replaced by the headers offered with the
+	// accepted endpoint, guarded by clientMutex.
 	requestHeader http.Header
 
+	// Returns the additional headers before every request. nil if not set.
+	headerProvider HeaderProvider
+
+	// Records the sent requests and the received responses. nil if the capture is
+	// not enabled.
+	wireCapture *internal.WireCapture
+
+	// Removes the secrets from the errors passed to the callbacks. nil if not set.
+	redactor *Redactor
+
 	// Processor to handle received messages.
 	receiveProcessor receivedProcessor
 }
@@ -53,14 +84,21 @@ func NewHTTPSender(logger types.Logger) *HTTPSender {
 	h := &HTTPSender{
 		SenderCommon:      NewSenderCommon(),
 		logger:            logger,
-		client:            http.DefaultClient,
 		pollingIntervalMs: defaultPollingIntervalMs,
+		checkRedirect:     CheckRedirect(nil, logger),
 	}
+	h.client = h.newClient(http.DefaultTransport)
 	// initialize the headers with no additional headers
 	h.SetRequestHeader(nil)
 	return h
 }
 
+// SetRedactor sets the Redactor used to remove the secrets from the errors passed
+// to the callbacks.
+func (h *HTTPSender) SetRedactor(redactor *Redactor) {
+	h.redactor = redactor
+}
+
 // Run starts the processing loop that will perform the HTTP request/response.
 // When there are no more messages to send Run will suspend until either there is
 // a new message to send or the polling interval elapses.
@@ -73,11 +111,18 @@ func (h *HTTPSender) Run(
 	callbacks types.Callbacks,
 	clientSyncedState *ClientSyncedState,
 	packagesStateProvider types.PackagesStateProvider,
+	packageDownloads PackageDownloadSettings,
+	endpointTransition *EndpointTransition,
 	capabilities protobufs.AgentCapabilities,
+	specCompliance *SpecCompliance,
+	responseVerifier *ResponseVerifier,
 ) {
+	h.clientMutex.Lock()
 	h.url = url
+	h.clientMutex.Unlock()
 	h.callbacks = callbacks
-	h.receiveProcessor = newReceivedProcessor(h.logger, callbacks, h, clientSyncedState, packagesStateProvider, capabilities)
+	h.receiveProcessor = newReceivedProcessor(h.logger, callbacks, h, clientSyncedState, packagesStateProvider, packageDownloads, endpointTransition, capabilities, specCompliance, responseVerifier)
+	defer h.receiveProcessor.stop()
 
 	for {
 		pollingTimer := time.NewTimer(time.Millisecond * time.Duration(atomic.LoadInt64(&h.pollingIntervalMs)))
@@ -85,6 +130,9 @@ func (h *HTTPSender) Run(
 		case <-h.hasPendingMessage:
 			// Have something to send. Stop the polling timer and send what we have.
 			pollingTimer.Stop()
+			if !h.waitToSend(ctx) {
+				return
+			}
 			h.makeOneRequestRoundtrip(ctx)
 
 		case <-pollingTimer.C:
@@ -95,6 +143,10 @@ func (h *HTTPSender) Run(
 			h.ScheduleSend()
 			break
 
+		case <-h.receiveProcessor.connectionSettingsDue():
+			pollingTimer.Stop()
+			h.receiveProcessor.processDueConnectionSettings(ctx)
+
 		case <-ctx.Done():
 			return
 		}
@@ -107,7 +159,8 @@ func (h *HTTPSender) SetRequestHeader(header http.Header) {
 	if header == nil {
 		header = http.Header{}
 	}
-	h.requestHeader = header
+	// The header of the user is not modified.
+	h.requestHeader = header.Clone()
 	h.requestHeader.Set(headerContentType, contentTypeProtobuf)
 }
 
@@ -127,8 +180,8 @@ func (h *HTTPSender) makeOneRequestRoundtrip(ctx context.Context) {
 	h.receiveResponse(ctx, resp)
 }
 
-func (h *HTTPSender) sendRequestWithRetries(ctx context.Context) (*http.Response, error) {
-	req, err := h.prepareRequest(ctx)
+func (h *HTTPSender) sendRequestWithRetries(ctx context.Context) (_ *http.Response, err error) {
+	req, msgToSend, err := h.prepareRequest(ctx)
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			h.logger.Debugf("Client is stopped, will not try anymore.")
@@ -141,31 +194,59 @@ func (h *HTTPSender) sendRequestWithRetries(ctx context.Context) (*http.Response
 		// Nothing to send.
 		return nil, nil
 	}
+	defer func() {
+		if err != nil {
+			// The statuses must reach the Server, send them with the next request.
+			h.restoreUnsent(msgToSend)
+		}
+	}()
 
 	// Repeatedly try requests with a backoff strategy.
-	infiniteBackoff := backoff.NewExponentialBackOff()
-	// Make backoff run forever.
-	infiniteBackoff.MaxElapsedTime = 0
+	retryBackoff := NewBackOff(h.retryPolicy)
 
 	interval := time.Duration(0)
+	attempt := 0
 
 	for {
 		timer := time.NewTimer(interval)
-		interval = infiniteBackoff.NextBackOff()
+		interval = retryBackoff.NextBackOff()
+		if interval == backoff.Stop {
+			timer.Stop()
+			return nil, fmt.Errorf("giving up sending the request after %v", h.retryPolicy.MaxElapsedTime)
+		}
 
 		select {
 		case <-timer.C:
 			{
-				resp, err := h.client.Do(req)
+				if attempt > 0 && req.GetBody != nil {
+					// The body was consumed by the previous attempt.
+					if req.Body, err = req.GetBody(); err != nil {
+						return nil, err
+					}
+				}
+				attempt++
+
+				var resp *http.Response
+				req.Header, err = ProvidedHeader(ctx, h.currentRequestHeader(), h.headerProvider, h.redactor)
+				if err == nil {
+					resp, err = h.currentClient().Do(req)
+				}
 				if err == nil {
 					switch resp.StatusCode {
 					case http.StatusOK:
+						h.followPermanentRedirect(resp)
+						h.delivered()
+						// The body of the request is the message, possibly compressed.
+						h.compression.record(proto.Size(msgToSend), int(req.ContentLength), h.compressionEnabled)
 						// We consider it connected if we receive 200 status from the Server.
-						h.callbacks.OnConnect()
+						h.callbacks.OnConnect(h.connectionInfo(resp))
 						return resp, nil
 
 					case http.StatusTooManyRequests, http.StatusServiceUnavailable:
-						interval = recalculateInterval(interval, resp)
+						_ = resp.Body.Close()
+						retryAfter := internal.ExtractRetryAfterHeader(resp)
+						interval = recalculateInterval(interval, retryAfter)
+						h.throttled(resp, retryAfter, interval)
 						err = fmt.Errorf("server response code=%d", resp.StatusCode)
 
 					default:
@@ -177,7 +258,7 @@ func (h *HTTPSender) sendRequestWithRetries(ctx context.Context) (*http.Response
 				}
 
 				h.logger.Errorf("Failed to do HTTP request (%v), will retry", err)
-				h.callbacks.OnConnectFailed(err)
+				h.callbacks.OnConnectFailed(h.redactor.RedactError(err))
 			}
 
 		case <-ctx.Done():
@@ -187,8 +268,35 @@ func (h *HTTPSender) sendRequestWithRetries(ctx context.Context) (*http.Response
 	}
 }
 
-func recalculateInterval(interval time.Duration, resp *http.Response) time.Duration {
-	retryAfter := internal.ExtractRetryAfterHeader(resp)
+// followPermanentRedirect sends the following requests to the URL the Server
+// permanently redirected the request to, if it did.
+func (h *HTTPSender) followPermanentRedirect(resp *http.Response) {
+	redirected, ok := PermanentlyRedirectedURL(resp)
+	if !ok {
+		return
+	}
+	h.clientMutex.Lock()
+	h.url = redirected.String()
+	h.clientMutex.Unlock()
+	h.logger.Debugf("The Server moved permanently to %s.", internal.RedactURL(redirected.String()))
+}
+
+// connectionInfo describes the connection used to receive the response.
+func (h *HTTPSender) connectionInfo(resp *http.Response) types.ConnectionInfo {
+	info := types.ConnectionInfo{
+		Endpoint:           internal.RedactURL(h.currentURL()),
+		Transport:          types.TransportHTTP,
+		CompressionEnabled: h.compressionEnabled,
+	}
+	if resp.Request != nil {
+		// The Server may have redirected the request.
+		info.Endpoint = internal.RedactURL(resp.Request.URL.String())
+	}
+	SetConnectionInfoTLS(&info, resp.TLS)
+	return info
+}
+
+func recalculateInterval(interval time.Duration, retryAfter internal.OptionalDuration) time.Duration {
 	if retryAfter.Defined && retryAfter.Duration > interval {
 		// If the Server suggested connecting later than our interval
 		// then honour Server's request, otherwise wait at least
@@ -198,17 +306,35 @@ func recalculateInterval(interval time.Duration, resp *http.Response) time.Durat
 	return interval
 }
 
-func (h *HTTPSender) prepareRequest(ctx context.Context) (*http.Request, error) {
+// throttled delays the following requests, including the polls, for as long as
+// the Server asked in the Retry-After header of the 429 or 503 response, and
+// reports the throttling via the OnError callback. The request is retried after
+// the interval.
+func (h *HTTPSender) throttled(resp *http.Response, retryAfter internal.OptionalDuration, interval time.Duration) {
+	if retryAfter.Defined {
+		h.Throttle(retryAfter.Duration)
+	}
+	h.callbacks.OnError(&types.ServerError{
+		Type:       protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable,
+		Message:    fmt.Sprintf("HTTP %d %s", resp.StatusCode, http.StatusText(resp.StatusCode)),
+		RetryAfter: retryAfter.Duration,
+		Throttle:   interval,
+	})
+}
+
+// prepareRequest returns the request that sends the pending message, and the message.
+func (h *HTTPSender) prepareRequest(ctx context.Context) (*http.Request, *protobufs.AgentToServer, error) {
 	msgToSend := h.nextMessage.PopPending()
 	if msgToSend == nil || proto.Equal(msgToSend, &protobufs.AgentToServer{}) {
 		// There is no pending message or the message is empty.
 		// Nothing to send.
-		return nil, nil
+		h.wakeFlush()
+		return nil, nil, nil
 	}
 
 	data, err := proto.Marshal(msgToSend)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var body io.Reader
@@ -218,23 +344,24 @@ func (h *HTTPSender) prepareRequest(ctx context.Context) (*http.Request, error)
 		g := gzip.NewWriter(&buf)
 		if _, err = g.Write(data); err != nil {
 			h.logger.Errorf("Failed to compress message: %v", err)
-			return nil, err
+			return nil, nil, err
 		}
 		if err = g.Close(); err != nil {
 			h.logger.Errorf("Failed to close the writer: %v", err)
-			return nil, err
+			return nil, nil, err
 		}
 		body = &buf
 	} else {
 		body = bytes.NewReader(data)
 	}
-	req, err := http.NewRequestWithContext(ctx, OpAMPPlainHTTPMethod, h.url, body)
+	req, err := http.NewRequestWithContext(ctx, OpAMPPlainHTTPMethod, h.currentURL(), body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	req.Header = h.requestHeader
-	return req, nil
+	req.Header = h.currentRequestHeader()
+	h.wireCapture.Capture(internal.WireAgentToServer, internal.WirePlainHTTP, data, msgToSend)
+	return req, msgToSend, nil
 }
 
 func (h *HTTPSender) receiveResponse(ctx context.Context, resp *http.Response) {
@@ -248,28 +375,283 @@ func (h *HTTPSender) receiveResponse(ctx context.Context, resp *http.Response) {
 
 	var response protobufs.ServerToAgent
 	if err := proto.Unmarshal(msgBytes, &response); err != nil {
+		h.wireCapture.Capture(internal.WireServerToAgent, internal.WirePlainHTTP, msgBytes, nil)
 		h.logger.Errorf("cannot unmarshal response: %v", err)
 		return
 	}
+	h.wireCapture.Capture(internal.WireServerToAgent, internal.WirePlainHTTP, msgBytes, &response)
 
 	h.receiveProcessor.ProcessReceivedMessage(ctx, &response)
 }
 
+// VerifyEndpoint verifies that the OpAMP Server at the endpoint offered in the settings,
+// or at the current endpoint if none is offered, accepts status reports during the
+// grace period. The reports are sent using the headers and the TLS certificates
+// specified in the offer.
+func (h *HTTPSender) VerifyEndpoint(
+	ctx context.Context, settings *protobufs.OpAMPConnectionSettings, gracePeriod time.Duration,
+) error {
+	endpoint := settings.DestinationEndpoint
+	if endpoint == "" {
+		h.clientMutex.RLock()
+		endpoint = h.currentURL()
+		h.clientMutex.RUnlock()
+	}
+	h.redactor.AddHeader(OfferedRequestHeader(nil, settings.Headers))
+
+	client := h.currentClient()
+	if settings.Certificate != nil {
+		offeredClient, _, err := h.offeredClient(settings.Certificate)
+		if err != nil {
+			return err
+		}
+		client = offeredClient
+		defer client.CloseIdleConnections()
+	}
+
+	return VerifyEndpointHealth(ctx, gracePeriod, func() error {
+		header, err := ProvidedHeader(ctx, h.currentRequestHeader(), h.headerProvider, h.redactor)
+		if err != nil {
+			return err
+		}
+		header = OfferedRequestHeader(header, settings.Headers)
+		// Status reports used for verification are small, don't compress them.
+		header.Del(headerContentEncoding)
+		return h.probeEndpoint(ctx, client, endpoint, header)
+	})
+}
+
+// SwitchCertificate starts using the client certificate offered by the Server for
+// the following requests.
+func (h *HTTPSender) SwitchCertificate(offered *protobufs.TLSCertificate) error {
+	client, tlsConfig, err := h.offeredClient(offered)
+	if err != nil {
+		return err
+	}
+
+	h.clientMutex.Lock()
+	previous := h.client
+	h.client = client
+	h.tlsConfig = tlsConfig
+	h.clientMutex.Unlock()
+
+	if previous.Transport != http.DefaultTransport {
+		// Don't keep the connections that use the previous certificate.
+		previous.CloseIdleConnections()
+	}
+	return nil
+}
+
+// SwitchEndpoint starts sending the following requests to the destination endpoint
+// of the accepted settings, with the offered headers and client certificate. A
+// status report is sent to the destination endpoint right away, so that the Server
+// there does not wait for the next poll to see the Agent.
+func (h *HTTPSender) SwitchEndpoint(settings *protobufs.OpAMPConnectionSettings) error {
+	if _, err := ParseServerURL(settings.DestinationEndpoint, "http", "https"); err != nil {
+		return err
+	}
+	if settings.Certificate != nil {
+		if err := h.SwitchCertificate(settings.Certificate); err != nil {
+			return err
+		}
+	}
+	h.redactor.AddURL(settings.DestinationEndpoint)
+
+	h.clientMutex.Lock()
+	defer h.clientMutex.Unlock()
+	h.url = settings.DestinationEndpoint
+	h.requestHeader = OfferedRequestHeader(h.requestHeader, settings.Headers)
+	h.NextMessage().Update(func(msg *protobufs.AgentToServer) {})
+	h.ScheduleSend()
+	return nil
+}
+
+// currentURL returns the URL to send the requests to.
+func (h *HTTPSender) currentURL() string {
+	h.clientMutex.RLock()
+	defer h.clientMutex.RUnlock()
+	return h.url
+}
+
+// currentRequestHeader returns the headers to send with all requests.
+func (h *HTTPSender) currentRequestHeader() http.Header {
+	h.clientMutex.RLock()
+	defer h.clientMutex.RUnlock()
+	return h.requestHeader
+}
+
+func (h *HTTPSender) currentClient() *http.Client {
+	h.clientMutex.RLock()
+	defer h.clientMutex.RUnlock()
+	return h.client
+}
+
+// offeredClient returns the client that connects using the offered certificate and
+// its TLS config.
+func (h *HTTPSender) offeredClient(offered *protobufs.TLSCertificate) (*http.Client, *tls.Config, error) {
+	h.clientMutex.RLock()
+	current := h.tlsConfig
+	h.clientMutex.RUnlock()
+
+	tlsConfig, err := OfferedTLSConfig(current, offered)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport := h.newTransport(tlsConfig)
+	if h.roundTripper != nil {
+		custom, ok := h.roundTripper.(*http.Transport)
+		if !ok {
+			return nil, nil, fmt.Errorf("cannot use the offered certificate with a %T transport", h.roundTripper)
+		}
+		transport = custom.Clone()
+		transport.TLSClientConfig = tlsConfig
+	}
+	return h.newClient(transport), tlsConfig, nil
+}
+
+// probeMessage returns the status report sent to the offered endpoint. It describes
+// the Agent the same way as the reports sent to the current endpoint, so that the
+// Server can check whether it accepts the Agent.
+func (h *HTTPSender) probeMessage() *protobufs.AgentToServer {
+	msg := &protobufs.AgentToServer{
+		InstanceUid:  h.nextMessage.InstanceUid(),
+		Capabilities: uint64(h.receiveProcessor.capabilities),
+	}
+	if state := h.receiveProcessor.clientSyncedState; state != nil {
+		msg.AgentDescription = state.AgentDescription()
+		msg.Health = state.Health()
+	}
+	return msg
+}
+
+func (h *HTTPSender) probeEndpoint(
+	ctx context.Context, client *http.Client, endpoint string, header http.Header,
+) error {
+	data, err := proto.Marshal(h.probeMessage())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, OpAMPPlainHTTPMethod, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid response from server: %d", resp.StatusCode)
+	}
+
+	msgBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot read response body: %v", err)
+	}
+
+	var response protobufs.ServerToAgent
+	if err := proto.Unmarshal(msgBytes, &response); err != nil {
+		return fmt.Errorf("cannot unmarshal response: %v", err)
+	}
+	if response.ErrorResponse != nil {
+		return fmt.Errorf("server responded with error: %s", response.ErrorResponse.ErrorMessage)
+	}
+	return nil
+}
+
 // SetPollingInterval sets the interval between polling. Has effect starting from the
 // next polling cycle.
 func (h *HTTPSender) SetPollingInterval(duration time.Duration) {
 	atomic.StoreInt64(&h.pollingIntervalMs, duration.Milliseconds())
 }
 
-func (h *HTTPSender) EnableCompression() {
-	h.compressionEnabled = true
-	h.requestHeader.Set(headerContentEncoding, encodingTypeGZip)
+// SetRetryPolicy sets the policy of retrying the failed requests. Must be called
+// before Run.
+func (h *HTTPSender) SetRetryPolicy(policy types.RetryPolicy) {
+	h.retryPolicy = policy
+}
+
+// SetCompression sets whether the requests are compressed with gzip. Must be called
+// after SetRequestHeader.
+func (h *HTTPSender) SetCompression(enabled bool) {
+	h.compressionEnabled = enabled
+	if enabled {
+		h.requestHeader.Set(headerContentEncoding, encodingTypeGZip)
+	} else {
+		h.requestHeader.Del(headerContentEncoding)
+	}
 }
 
 func (h *HTTPSender) AddTLSConfig(config *tls.Config) {
+	h.tlsConfig = config
 	if config != nil {
-		h.client.Transport = &http.Transport{
-			TLSClientConfig: config,
-		}
+		h.client = h.newClient(h.newTransport(config))
+	}
+}
+
+// SetHeaderProvider sets the func that returns the additional headers before every
+// request. Should not be called concurrently with any other method.
+func (h *HTTPSender) SetHeaderProvider(provider HeaderProvider) {
+	h.headerProvider = provider
+}
+
+// SetProxy sets the func that selects the proxy of the requests, see ProxyFunc.
+// Should not be called concurrently with any other method.
+func (h *HTTPSender) SetProxy(proxy func(*http.Request) (*url.URL, error)) {
+	h.proxy = proxy
+	h.client = h.newClient(h.newTransport(h.tlsConfig))
+}
+
+// SetDialContext sets the func that opens the connections to the Server. Should not
+// be called concurrently with any other method.
+func (h *HTTPSender) SetDialContext(dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	h.dialContext = dialContext
+	h.client = h.newClient(h.newTransport(h.tlsConfig))
+}
+
+// SetRoundTripper sets the transport of the requests, replacing the transport built
+// from the TLS config and the proxy. nil restores the built transport. Should not be
+// called concurrently with any other method.
+func (h *HTTPSender) SetRoundTripper(roundTripper http.RoundTripper) {
+	h.roundTripper = roundTripper
+	if roundTripper == nil {
+		h.client = h.newClient(h.newTransport(h.tlsConfig))
+		return
+	}
+	h.client = h.newClient(roundTripper)
+}
+
+// SetWireCapture sets the capture that records the sent requests and the received
+// responses, nil disables the capture. Must be called before Run.
+func (h *HTTPSender) SetWireCapture(capture *internal.WireCapture) {
+	h.wireCapture = capture
+}
+
+// SetRedirectPolicy sets the policy that decides which redirects are followed, see
+// types.RedirectPolicy. Must be called before the transport is set.
+func (h *HTTPSender) SetRedirectPolicy(policy types.RedirectPolicy) {
+	h.checkRedirect = CheckRedirect(policy, h.logger)
+}
+
+// newClient returns the client that sends the requests using the transport.
+func (h *HTTPSender) newClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{Transport: transport, CheckRedirect: h.checkRedirect}
+}
+
+// newTransport returns the transport that connects using the TLS config and the
+// proxy of the sender.
+func (h *HTTPSender) newTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if h.proxy != nil {
+		transport.Proxy = h.proxy
+	}
+	if h.dialContext != nil {
+		transport.DialContext = h.dialContext
 	}
+	return transport
 }
@@ -3,7 +3,9 @@ package internal
 import (
 	"context"
 	"crypto/tls"
+	"io"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -12,6 +14,8 @@ import (
 	sharedinternal "github.com/open-telemetry/opamp-go/internal"
 	"github.com/open-telemetry/opamp-go/protobufs"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestHTTPSenderRetryForStatusTooManyRequests(t *testing.T) {
@@ -42,7 +46,7 @@ func TestHTTPSenderRetryForStatusTooManyRequests(t *testing.T) {
 		}
 	})
 	sender.callbacks = types.CallbacksStruct{
-		OnConnectFunc: func() {
+		OnConnectFunc: func(info types.ConnectionInfo) {
 		},
 		OnConnectFailedFunc: func(_ error) {
 		},
@@ -57,6 +61,98 @@ func TestHTTPSenderRetryForStatusTooManyRequests(t *testing.T) {
 	srv.Close()
 }
 
+func TestHTTPSenderThrottledByRetryAfter(t *testing.T) {
+	var attempts int64
+	var bodies [][]byte
+	var bodiesMux sync.Mutex
+	srv := StartMockServer(t)
+	srv.OnRequest = func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodiesMux.Lock()
+		bodies = append(bodies, body)
+		bodiesMux.Unlock()
+		if atomic.AddInt64(&attempts, 1) == 1 {
+			w.Header().Set("Retry-After", time.Now().Add(2*time.Second).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+	defer srv.Close()
+
+	sender := NewHTTPSender(&sharedinternal.NopLogger{})
+	sender.NextMessage().Update(func(msg *protobufs.AgentToServer) {
+		msg.InstanceUid = "test"
+	})
+	var serverErr *types.ServerError
+	sender.callbacks = types.CallbacksStruct{
+		OnErrorFunc: func(err *types.ServerError) {
+			serverErr = err
+		},
+	}
+	sender.url = "http://" + srv.Endpoint
+
+	resp, err := sender.sendRequestWithRetries(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The throttling is reported.
+	require.NotNil(t, serverErr)
+	assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable, serverErr.Type)
+	assert.Equal(t, "HTTP 503 Service Unavailable", serverErr.Message)
+	assert.InDelta(t, time.Second, serverErr.RetryAfter, float64(time.Second))
+	assert.GreaterOrEqual(t, serverErr.Throttle, serverErr.RetryAfter)
+
+	// The following requests are delayed too.
+	assert.Greater(t, atomic.LoadInt64(&sender.throttledUntil), int64(0))
+
+	// The retried request has the same body.
+	bodiesMux.Lock()
+	defer bodiesMux.Unlock()
+	require.Len(t, bodies, 2)
+	assert.NotEmpty(t, bodies[0])
+	assert.Equal(t, bodies[0], bodies[1])
+}
+
+func TestHTTPSenderGivesUpAfterMaxElapsedTime(t *testing.T) {
+	var attempts int64
+	srv := StartMockServer(t)
+	srv.OnRequest = func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	defer srv.Close()
+
+	sender := NewHTTPSender(&sharedinternal.NopLogger{})
+	sender.SetRetryPolicy(types.RetryPolicy{
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     20 * time.Millisecond,
+		MaxElapsedTime:  200 * time.Millisecond,
+	})
+	status := &protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: []byte{1},
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+	}
+	sender.NextMessage().Update(func(msg *protobufs.AgentToServer) {
+		msg.InstanceUid = "test"
+		msg.RemoteConfigStatus = status
+	})
+	sender.callbacks = types.CallbacksStruct{}
+	sender.url = "http://" + srv.Endpoint
+
+	start := time.Now()
+	resp, err := sender.sendRequestWithRetries(context.Background())
+	assert.Error(t, err)
+	assert.Nil(t, resp)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Greater(t, atomic.LoadInt64(&attempts), int64(1))
+
+	// The status that was not sent is sent with the next request.
+	next := sender.NextMessage().PopPending()
+	require.NotNil(t, next)
+	assert.True(t, proto.Equal(status, next.RemoteConfigStatus))
+}
+
 func TestAddTLSConfig(t *testing.T) {
 	sender := NewHTTPSender(&sharedinternal.NopLogger{})
 
@@ -68,7 +164,11 @@ func TestAddTLSConfig(t *testing.T) {
 	}
 
 	sender.AddTLSConfig(tlsConfig)
-	assert.Equal(t, sender.client.Transport, &http.Transport{TLSClientConfig: tlsConfig})
+	assert.Equal(t, tlsConfig, sender.client.Transport.(*http.Transport).TLSClientConfig)
+	// The proxy is still taken from the environment.
+	assert.NotNil(t, sender.client.Transport.(*http.Transport).Proxy)
+	// The default client is not modified.
+	assert.NotSame(t, http.DefaultClient, sender.client)
 }
 
 func GenerateCertificate() (tls.Certificate, error) {
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"io"
 
@@ -14,15 +15,19 @@ type InMemPackagesStore struct {
 	pkgState             map[string]types.PackageState
 	fileContents         map[string][]byte
 	fileHashes           map[string][]byte
+	packageFiles         map[string]map[string][]byte
 	lastReportedStatuses *protobufs.PackageStatuses
 }
 
 var _ types.PackagesStateProvider = (*InMemPackagesStore)(nil)
+var _ types.PackageFilesUpdater = (*InMemPackagesStore)(nil)
+var _ types.PackageContentReader = (*InMemPackagesStore)(nil)
 
 func NewInMemPackagesStore() *InMemPackagesStore {
 	return &InMemPackagesStore{
 		fileContents: map[string][]byte{},
 		fileHashes:   map[string][]byte{},
+		packageFiles: map[string]map[string][]byte{},
 		pkgState:     map[string]types.PackageState{},
 	}
 }
@@ -68,6 +73,39 @@ func (l *InMemPackagesStore) UpdateContent(_ context.Context, packageName string
 	return nil
 }
 
+func (l *InMemPackagesStore) ReadContent(_ context.Context, packageName string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(l.fileContents[packageName])), nil
+}
+
+func (l *InMemPackagesStore) BeginFilesUpdate(_ context.Context, packageName string) (types.PackageFilesUpdate, error) {
+	return &inMemFilesUpdate{store: l, packageName: packageName, files: map[string][]byte{}}, nil
+}
+
+// inMemFilesUpdate keeps the written files aside until the update is committed.
+type inMemFilesUpdate struct {
+	store       *InMemPackagesStore
+	packageName string
+	files       map[string][]byte
+}
+
+func (u *inMemFilesUpdate) WriteFile(_ context.Context, path string, data io.Reader) error {
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	u.files[path] = b
+	return nil
+}
+
+func (u *inMemFilesUpdate) Commit(_ context.Context) error {
+	u.store.packageFiles[u.packageName] = u.files
+	return nil
+}
+
+func (u *inMemFilesUpdate) Abort() error {
+	return nil
+}
+
 func (l *InMemPackagesStore) SetPackageState(packageName string, state types.PackageState) error {
 	l.pkgState[packageName] = state
 	return nil
@@ -87,6 +125,11 @@ func (l *InMemPackagesStore) GetContent() map[string][]byte {
 	return l.fileContents
 }
 
+// GetFiles returns the files of multi-file packages.
+func (l *InMemPackagesStore) GetFiles() map[string]map[string][]byte {
+	return l.packageFiles
+}
+
 func (l *InMemPackagesStore) LastReportedStatuses() (*protobufs.PackageStatuses, error) {
 	return l.lastReportedStatuses, nil
 }
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+var errNotRunning = errors.New("the client is not running")
+
+// receivedMessage is a message passed to InMemorySender.Receive.
+type receivedMessage struct {
+	msg *protobufs.ServerToAgent
+	// Closed when the message is processed.
+	processed chan struct{}
+}
+
+// InMemorySender passes the messages to a types.Sender instead of sending them over
+// the network and processes the messages passed to Receive as if they were received
+// from the Server. Once run, it loops like the HTTPSender, except that it does not
+// poll.
+type InMemorySender struct {
+	SenderCommon
+	logger types.Logger
+	sender types.Sender
+
+	// The messages passed to Receive, processed by Run.
+	received chan receivedMessage
+	// Closed when Run returns. Replaced by Restart.
+	stopped    chan struct{}
+	stoppedMux sync.Mutex
+
+	// Processor to handle received messages.
+	receiveProcessor receivedProcessor
+}
+
+// NewInMemorySender creates a new InMemorySender that passes the messages to the sender.
+func NewInMemorySender(logger types.Logger, sender types.Sender) *InMemorySender {
+	return &InMemorySender{
+		SenderCommon: NewSenderCommon(),
+		logger:       logger,
+		sender:       sender,
+		received:     make(chan receivedMessage),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// Run starts the processing loop that passes the messages to the sender and
+// processes the received messages. Must be called once, or once after every call to
+// Restart. Run continues until ctx is cancelled.
+func (s *InMemorySender) Run(
+	ctx context.Context,
+	callbacks types.Callbacks,
+	clientSyncedState *ClientSyncedState,
+	packagesStateProvider types.PackagesStateProvider,
+	packageDownloads PackageDownloadSettings,
+	capabilities protobufs.AgentCapabilities,
+	specCompliance *SpecCompliance,
+	responseVerifier *ResponseVerifier,
+) {
+	defer close(s.stoppedChan())
+
+	// There is no endpoint to transition to, the offered settings are accepted
+	// without verification.
+	s.receiveProcessor = newReceivedProcessor(
+		s.logger, callbacks, s, clientSyncedState, packagesStateProvider, packageDownloads, nil, capabilities, specCompliance, responseVerifier,
+	)
+	defer s.receiveProcessor.stop()
+
+	for {
+		select {
+		case <-s.hasPendingMessage:
+			if !s.waitToSend(ctx) {
+				return
+			}
+			s.sendNextMessage(ctx)
+
+		case received := <-s.received:
+			s.receiveProcessor.ProcessReceivedMessage(ctx, received.msg)
+			close(received.processed)
+
+		case <-s.receiveProcessor.connectionSettingsDue():
+			s.receiveProcessor.processDueConnectionSettings(ctx)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *InMemorySender) sendNextMessage(ctx context.Context) {
+	msgToSend := s.nextMessage.PopPending()
+	if msgToSend == nil || proto.Equal(msgToSend, &protobufs.AgentToServer{}) {
+		s.wakeFlush()
+		return
+	}
+	if err := s.sender.Send(ctx, msgToSend); err != nil {
+		s.logger.Errorf("Cannot send message: %v", err)
+		// The statuses must reach the Server, send them with the next message.
+		s.restoreUnsent(msgToSend)
+		return
+	}
+	s.delivered()
+	size := proto.Size(msgToSend)
+	s.compression.record(size, size, false)
+}
+
+// Restart prepares the sender to be run again after Run returned.
+func (s *InMemorySender) Restart() {
+	s.stoppedMux.Lock()
+	defer s.stoppedMux.Unlock()
+	s.stopped = make(chan struct{})
+}
+
+func (s *InMemorySender) stoppedChan() chan struct{} {
+	s.stoppedMux.Lock()
+	defer s.stoppedMux.Unlock()
+	return s.stopped
+}
+
+// Receive processes the message as if it was received from the Server. Returns when
+// Run processed the message, i.e. when the callbacks returned, or when ctx is done.
+// Returns an error if Run returned. Must not be called from the callbacks or from
+// the types.Sender, which are called by Run.
+func (s *InMemorySender) Receive(ctx context.Context, msg *protobufs.ServerToAgent) error {
+	received := receivedMessage{msg: msg, processed: make(chan struct{})}
+	stopped := s.stoppedChan()
+	select {
+	case s.received <- received:
+	case <-stopped:
+		return errNotRunning
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-received.processed:
+		return nil
+	case <-stopped:
+		return errNotRunning
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
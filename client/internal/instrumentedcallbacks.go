@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// instrumentedCallbacks measures the duration of every call of the wrapped Callbacks
+// and enforces the timeout of the calls, see StartSettings.CallbackTimeout.
+type instrumentedCallbacks struct {
+	callbacks types.Callbacks
+	timeout   time.Duration
+	logger    types.Logger
+	metrics   types.MetricsRecorder
+	durations types.DurationRecorder
+}
+
+var _ types.Callbacks = (*instrumentedCallbacks)(nil)
+
+// InstrumentCallbacks returns the Callbacks that measure and bound the calls of the
+// callbacks. Returns the callbacks as is if there is nothing to measure or bound.
+func InstrumentCallbacks(
+	callbacks types.Callbacks, timeout time.Duration, logger types.Logger, metrics types.MetricsRecorder,
+) types.Callbacks {
+	durations, _ := metrics.(types.DurationRecorder)
+	if timeout <= 0 && durations == nil {
+		return callbacks
+	}
+	return &instrumentedCallbacks{
+		callbacks: callbacks,
+		timeout:   timeout,
+		logger:    logger,
+		metrics:   metrics,
+		durations: durations,
+	}
+}
+
+// measure returns the func to call when the callback returns.
+func (c *instrumentedCallbacks) measure(callback string) func() {
+	startedAt := time.Now()
+	return func() { c.finished(callback, time.Since(startedAt)) }
+}
+
+// withTimeout returns the context to pass to the callback, cancelled after the
+// timeout, and the func to call when the callback returns.
+func (c *instrumentedCallbacks) withTimeout(ctx context.Context, callback string) (context.Context, func()) {
+	done := c.measure(callback)
+	if c.timeout <= 0 {
+		return ctx, done
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	return ctx, func() {
+		cancel()
+		done()
+	}
+}
+
+func (c *instrumentedCallbacks) finished(callback string, duration time.Duration) {
+	if c.durations != nil {
+		c.durations.RecordDuration(types.MetricCallbackDurationPrefix+callback, duration)
+	}
+	if c.timeout > 0 && duration > c.timeout {
+		c.logger.Errorf("Callback %s took %v, longer than the timeout of %v", callback, duration, c.timeout)
+		if c.metrics != nil {
+			c.metrics.IncrementCounter(types.MetricCallbackTimeoutsPrefix + callback)
+		}
+	}
+}
+
+func (c *instrumentedCallbacks) OnConnect(info types.ConnectionInfo) {
+	defer c.measure("OnConnect")()
+	c.callbacks.OnConnect(info)
+}
+
+func (c *instrumentedCallbacks) OnConnectFailed(err error) {
+	defer c.measure("OnConnectFailed")()
+	c.callbacks.OnConnectFailed(err)
+}
+
+func (c *instrumentedCallbacks) OnError(err *types.ServerError) {
+	defer c.measure("OnError")()
+	c.callbacks.OnError(err)
+}
+
+func (c *instrumentedCallbacks) OnMessage(ctx context.Context, msg *types.MessageData) {
+	ctx, done := c.withTimeout(ctx, "OnMessage")
+	defer done()
+	c.callbacks.OnMessage(ctx, msg)
+}
+
+func (c *instrumentedCallbacks) OnOpampConnectionSettings(
+	ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
+) error {
+	ctx, done := c.withTimeout(ctx, "OnOpampConnectionSettings")
+	defer done()
+	return c.callbacks.OnOpampConnectionSettings(ctx, settings)
+}
+
+func (c *instrumentedCallbacks) OnOpampConnectionSettingsAccepted(settings *protobufs.OpAMPConnectionSettings) {
+	defer c.measure("OnOpampConnectionSettingsAccepted")()
+	c.callbacks.OnOpampConnectionSettingsAccepted(settings)
+}
+
+func (c *instrumentedCallbacks) SaveRemoteConfigStatus(ctx context.Context, status *protobufs.RemoteConfigStatus) {
+	ctx, done := c.withTimeout(ctx, "SaveRemoteConfigStatus")
+	defer done()
+	c.callbacks.SaveRemoteConfigStatus(ctx, status)
+}
+
+func (c *instrumentedCallbacks) SaveInstanceUid(ctx context.Context, instanceUid string) {
+	ctx, done := c.withTimeout(ctx, "SaveInstanceUid")
+	defer done()
+	c.callbacks.SaveInstanceUid(ctx, instanceUid)
+}
+
+func (c *instrumentedCallbacks) GetEffectiveConfig(ctx context.Context) (*protobufs.EffectiveConfig, error) {
+	ctx, done := c.withTimeout(ctx, "GetEffectiveConfig")
+	defer done()
+	return c.callbacks.GetEffectiveConfig(ctx)
+}
+
+func (c *instrumentedCallbacks) OnCommand(ctx context.Context, command *protobufs.ServerToAgentCommand) error {
+	ctx, done := c.withTimeout(ctx, "OnCommand")
+	defer done()
+	return c.callbacks.OnCommand(ctx, command)
+}
+
+func (c *instrumentedCallbacks) OnFlagsHandled(handling types.FlagsHandling) {
+	defer c.measure("OnFlagsHandled")()
+	c.callbacks.OnFlagsHandled(handling)
+}
+
+func (c *instrumentedCallbacks) OnSpecViolation(violation types.SpecViolation) {
+	defer c.measure("OnSpecViolation")()
+	c.callbacks.OnSpecViolation(violation)
+}
+
+func (c *instrumentedCallbacks) OnConnectionStateChange(state types.ConnectionState) {
+	defer c.measure("OnConnectionStateChange")()
+	c.callbacks.OnConnectionStateChange(state)
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+type recordingMetrics struct {
+	mux       sync.Mutex
+	counters  map[string]int
+	durations map[string][]time.Duration
+}
+
+func (m *recordingMetrics) IncrementCounter(name string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.counters[name]++
+}
+
+func (m *recordingMetrics) RecordDuration(name string, duration time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.durations[name] = append(m.durations[name], duration)
+}
+
+func TestInstrumentCallbacksNoop(t *testing.T) {
+	callbacks := types.CallbacksStruct{}
+	// Nothing to measure or bound.
+	assert.Equal(t, callbacks, InstrumentCallbacks(callbacks, 0, &sharedinternal.NopLogger{}, nil))
+}
+
+func TestInstrumentCallbacksDurations(t *testing.T) {
+	metrics := &recordingMetrics{counters: map[string]int{}, durations: map[string][]time.Duration{}}
+	callbacks := InstrumentCallbacks(types.CallbacksStruct{
+		OnCommandFunc: func(ctx context.Context, command *protobufs.ServerToAgentCommand) error {
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		},
+	}, 0, &sharedinternal.NopLogger{}, metrics)
+
+	assert.NoError(t, callbacks.OnCommand(context.Background(), &protobufs.ServerToAgentCommand{}))
+	callbacks.OnMessage(context.Background(), &types.MessageData{})
+
+	assert.Len(t, metrics.durations[types.MetricCallbackDurationPrefix+"OnCommand"], 1)
+	assert.GreaterOrEqual(t, metrics.durations[types.MetricCallbackDurationPrefix+"OnCommand"][0], 10*time.Millisecond)
+	assert.Len(t, metrics.durations[types.MetricCallbackDurationPrefix+"OnMessage"], 1)
+	assert.Empty(t, metrics.counters)
+}
+
+func TestInstrumentCallbacksTimeout(t *testing.T) {
+	metrics := &recordingMetrics{counters: map[string]int{}, durations: map[string][]time.Duration{}}
+	callbacks := InstrumentCallbacks(types.CallbacksStruct{
+		GetEffectiveConfigFunc: func(ctx context.Context) (*protobufs.EffectiveConfig, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		OnConnectFunc: func(info types.ConnectionInfo) {
+			time.Sleep(20 * time.Millisecond)
+		},
+	}, 10*time.Millisecond, &sharedinternal.NopLogger{}, metrics)
+
+	// The context of the callback is cancelled after the timeout.
+	_, err := callbacks.GetEffectiveConfig(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The callbacks without a context cannot be cancelled, but are counted.
+	callbacks.OnConnect(types.ConnectionInfo{})
+
+	assert.Equal(t, map[string]int{
+		types.MetricCallbackTimeoutsPrefix + "GetEffectiveConfig": 1,
+		types.MetricCallbackTimeoutsPrefix + "OnConnect":          1,
+	}, metrics.counters)
+}
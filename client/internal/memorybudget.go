@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// ErrMemoryLimitExceeded is returned when a buffer of the client does not fit in the
+// memory limit, see StartSettings.MemoryLimit.
+var ErrMemoryLimitExceeded = errors.New("memory limit of the client exceeded")
+
+// MemoryBudget accounts the memory used by the buffers of the client against the
+// soft memory limit. The methods are safe to call on a nil MemoryBudget, which
+// means there is no limit, and may be called concurrently.
+type MemoryBudget struct {
+	limit   int64
+	metrics types.MetricsRecorder
+
+	mutex sync.Mutex
+	used  int64
+	// Closed and replaced when memory is released.
+	released chan struct{}
+}
+
+// NewMemoryBudget returns the budget of limit bytes, nil if limit is 0, i.e. there
+// is no limit.
+func NewMemoryBudget(limit int64, metrics types.MetricsRecorder) *MemoryBudget {
+	if limit == 0 {
+		return nil
+	}
+	return &MemoryBudget{limit: limit, metrics: metrics, released: make(chan struct{})}
+}
+
+// available returns the number of bytes that can still be reserved, -1 if there is
+// no limit.
+func (b *MemoryBudget) available() int64 {
+	if b == nil {
+		return -1
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.used >= b.limit {
+		return 0
+	}
+	return b.limit - b.used
+}
+
+// reserve reserves n bytes. Returns false and reserves nothing if they do not fit.
+func (b *MemoryBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// adjust changes the reserved bytes by delta even if the limit is exceeded, e.g. to
+// account for a buffer that cannot be refused.
+func (b *MemoryBudget) adjust(delta int64) {
+	if b == nil || delta == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used += delta
+	if delta < 0 {
+		close(b.released)
+		b.released = make(chan struct{})
+	}
+}
+
+// release releases n reserved bytes.
+func (b *MemoryBudget) release(n int64) {
+	b.adjust(-n)
+}
+
+// waitAvailable blocks while the budget is exhausted. Returns false if ctx is done
+// before memory is released.
+func (b *MemoryBudget) waitAvailable(ctx context.Context) bool {
+	for {
+		if b == nil {
+			return true
+		}
+		b.mutex.Lock()
+		exhausted := b.used >= b.limit
+		released := b.released
+		b.mutex.Unlock()
+		if !exhausted {
+			return true
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// exceeded counts that the client degraded because of the limit.
+func (b *MemoryBudget) exceeded() {
+	if b != nil && b.metrics != nil {
+		b.metrics.IncrementCounter(types.MetricMemoryLimitExceeded)
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(10, nil)
+	assert.EqualValues(t, 10, b.available())
+
+	assert.True(t, b.reserve(6))
+	assert.False(t, b.reserve(5))
+	assert.EqualValues(t, 4, b.available())
+
+	// Adjusting may exceed the limit.
+	b.adjust(6)
+	assert.EqualValues(t, 0, b.available())
+
+	b.release(6)
+	b.release(6)
+	assert.EqualValues(t, 10, b.available())
+}
+
+func TestMemoryBudgetNoLimit(t *testing.T) {
+	var b *MemoryBudget = NewMemoryBudget(0, nil)
+	assert.Nil(t, b)
+	assert.EqualValues(t, -1, b.available())
+	assert.True(t, b.reserve(1<<40))
+	b.release(1 << 40)
+	assert.True(t, b.waitAvailable(context.Background()))
+}
+
+func TestMemoryBudgetWaitAvailable(t *testing.T) {
+	b := NewMemoryBudget(10, nil)
+	assert.True(t, b.reserve(10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, b.waitAvailable(ctx))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.release(1)
+	}()
+	assert.True(t, b.waitAvailable(context.Background()))
+}
+
+func TestNextMessageMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(1000, nil)
+	msg := NewNextMessage()
+	msg.SetMemoryBudget(b)
+
+	// The pending message is accounted.
+	msg.Update(func(msg *protobufs.AgentToServer) {
+		msg.EffectiveConfig = &protobufs.EffectiveConfig{
+			ConfigMap: &protobufs.AgentConfigMap{ConfigMap: map[string]*protobufs.AgentConfigFile{
+				"": {Body: make([]byte, 100)},
+			}},
+		}
+	})
+	assert.Less(t, b.available(), int64(900))
+
+	// It is released once it is popped, only the sequence number of the next
+	// message is left.
+	popped := msg.PopPending()
+	assert.Greater(t, b.available(), int64(990))
+
+	// And accounted again if it is restored.
+	msg.RestoreUnsent(popped)
+	assert.Less(t, b.available(), int64(900))
+
+	msg.SetMemoryBudget(nil)
+	assert.EqualValues(t, 1000, b.available())
+}
+
+func TestReadAllReserved(t *testing.T) {
+	b := NewMemoryBudget(10, nil)
+	s := &packagesSyncer{packageDownloads: PackageDownloadSettings{MemoryBudget: b}}
+
+	data, err := s.readAllReserved(io.NopCloser(bytes.NewReader(make([]byte, 6))), -1)
+	require.NoError(t, err)
+	assert.Len(t, data, 6)
+	assert.EqualValues(t, 4, b.available())
+
+	// The data does not fit anymore, e.g. the patch after the local content.
+	_, err = s.readAllReserved(io.NopCloser(bytes.NewReader(make([]byte, 6))), maxPackagePatchSize)
+	assert.ErrorIs(t, err, ErrMemoryLimitExceeded)
+	assert.EqualValues(t, 4, b.available())
+
+	b.release(int64(len(data)))
+	assert.EqualValues(t, 10, b.available())
+}
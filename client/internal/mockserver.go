@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"crypto/tls"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -84,10 +86,40 @@ func StartMockServer(t *testing.T) *MockServer {
 	return srv
 }
 
+// StartUnixMockServer starts a mock server that listens on the unix domain socket,
+// which is its Endpoint.
+func StartUnixMockServer(t *testing.T, socket string) *MockServer {
+	srv, m := newMockServer(t)
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.srv = httptest.NewUnstartedServer(m)
+	_ = srv.srv.Listener.Close()
+	srv.srv.Listener = ln
+	srv.srv.Start()
+	srv.Endpoint = socket
+
+	return srv
+}
+
 func StartTLSMockServer(t *testing.T) *MockServer {
+	return startTLSMockServer(t, nil)
+}
+
+// StartTLSMockServerWithClientAuth starts a TLS mock server that asks the clients for
+// their certificates, available in the TLS state of the requests passed to OnConnect.
+func StartTLSMockServerWithClientAuth(t *testing.T) *MockServer {
+	return startTLSMockServer(t, &tls.Config{ClientAuth: tls.RequestClientCert})
+}
+
+func startTLSMockServer(t *testing.T, tlsConfig *tls.Config) *MockServer {
 	srv, m := newMockServer(t)
 
-	srv.srv = httptest.NewTLSServer(m)
+	srv.srv = httptest.NewUnstartedServer(m)
+	srv.srv.TLS = tlsConfig
+	srv.srv.StartTLS()
 
 	u, err := url.Parse(srv.srv.URL)
 	if err != nil {
@@ -180,6 +212,12 @@ func (m *MockServer) handleReceivedBytes(msgBytes []byte, alwaysRespond bool) []
 
 	var response *protobufs.ServerToAgent
 
+	if m.isExpectMode && request.AgentDisconnect != nil {
+		// The WebSocket client sends AgentDisconnect when it stops, after the
+		// expected messages.
+		return nil
+	}
+
 	if m.isExpectMode {
 		// We are in expect mode. Call user-defined handler for the message.
 		// Note that the user-defined handler may be supplied after we receive the message
@@ -14,7 +14,11 @@ type NextMessage struct {
 	nextMessage *protobufs.AgentToServer
 	// Indicates that nextMessage is pending to be sent.
 	messagePending bool
-	// Mutex to protect the above 2 fields.
+	// The budget nextMessage is accounted in, nil if there is no memory limit, and
+	// the size accounted for it.
+	budget *MemoryBudget
+	size   int64
+	// Mutex to protect the above fields.
 	messageMutex sync.Mutex
 }
 
@@ -25,15 +29,56 @@ func NewNextMessage() NextMessage {
 	}
 }
 
+// SetMemoryBudget sets the budget the size of the next message is accounted in, nil
+// disables the accounting.
+func (s *NextMessage) SetMemoryBudget(budget *MemoryBudget) {
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+	s.budget.release(s.size)
+	s.budget = budget
+	s.size = 0
+	s.account()
+}
+
+// account accounts the current size of the next message in the budget. Must be
+// called with messageMutex locked.
+func (s *NextMessage) account() {
+	if s.budget == nil {
+		return
+	}
+	size := int64(proto.Size(s.nextMessage))
+	s.budget.adjust(size - s.size)
+	s.size = size
+}
+
 // Update applies the specified modifier function to the next message that
 // will be sent and marks the message as pending to be sent.
 func (s *NextMessage) Update(modifier func(msg *protobufs.AgentToServer)) {
 	s.messageMutex.Lock()
 	modifier(s.nextMessage)
 	s.messagePending = true
+	s.account()
 	s.messageMutex.Unlock()
 }
 
+// InstanceUid returns the instance UID of the next message to be sent.
+func (s *NextMessage) InstanceUid() string {
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+	return s.nextMessage.InstanceUid
+}
+
+// Pending returns a copy of the next message to be sent if it is pending, nil
+// otherwise. Unlike PopPending the message stays pending.
+func (s *NextMessage) Pending() *protobufs.AgentToServer {
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+	if !s.messagePending {
+		return nil
+	}
+	return proto.Clone(s.nextMessage).(*protobufs.AgentToServer)
+}
+
 // PopPending returns the next message to be sent, if it is pending or nil otherwise.
 // Clears the "pending" flag.
 func (s *NextMessage) PopPending() *protobufs.AgentToServer {
@@ -55,7 +100,41 @@ func (s *NextMessage) PopPending() *protobufs.AgentToServer {
 		}
 
 		s.nextMessage = msg
+		s.account()
 	}
 	s.messageMutex.Unlock()
 	return msgToSend
 }
+
+// RestoreUnsent puts the statuses and the flags of the message that could not be
+// sent back into the next message, so that they are sent with it, and marks the next
+// message pending. The statuses that were updated since the message was popped are newer
+// and are kept.
+func (s *NextMessage) RestoreUnsent(unsent *protobufs.AgentToServer) {
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+	mergeUnsent(s.nextMessage, unsent)
+	s.messagePending = true
+	s.account()
+}
+
+// mergeUnsent puts the statuses and the flags of the unsent message into msg, the
+// statuses that are set in msg are newer and are kept.
+func mergeUnsent(msg, unsent *protobufs.AgentToServer) {
+	if msg.AgentDescription == nil {
+		msg.AgentDescription = unsent.AgentDescription
+	}
+	if msg.Health == nil {
+		msg.Health = unsent.Health
+	}
+	if msg.EffectiveConfig == nil {
+		msg.EffectiveConfig = unsent.EffectiveConfig
+	}
+	if msg.RemoteConfigStatus == nil {
+		msg.RemoteConfigStatus = unsent.RemoteConfigStatus
+	}
+	if msg.PackageStatuses == nil {
+		msg.PackageStatuses = unsent.PackageStatuses
+	}
+	msg.Flags |= unsent.Flags
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestNextMessageRestoreUnsent(t *testing.T) {
+	next := NewNextMessage()
+	next.Update(func(msg *protobufs.AgentToServer) {
+		msg.InstanceUid = "test"
+		msg.Health = &protobufs.AgentHealth{Healthy: true}
+		msg.RemoteConfigStatus = &protobufs.RemoteConfigStatus{ErrorMessage: "old"}
+		msg.Flags = uint64(protobufs.AgentToServerFlags_AgentToServerFlags_RequestInstanceUid)
+	})
+	unsent := next.PopPending()
+	require.NotNil(t, unsent)
+	assert.Nil(t, next.PopPending())
+
+	// A newer status is set before the unsent message is restored.
+	next.Update(func(msg *protobufs.AgentToServer) {
+		msg.RemoteConfigStatus = &protobufs.RemoteConfigStatus{ErrorMessage: "new"}
+	})
+	next.RestoreUnsent(unsent)
+
+	msg := next.PopPending()
+	require.NotNil(t, msg)
+	assert.EqualValues(t, unsent.SequenceNum+1, msg.SequenceNum)
+	assert.True(t, msg.Health.Healthy)
+	assert.Equal(t, "new", msg.RemoteConfigStatus.ErrorMessage)
+	assert.Equal(t, unsent.Flags, msg.Flags)
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// offerTimeoutCallbacks bounds the processing of the offers of the Server by the
+// wrapped Callbacks and reports the offers that timed out to the Server, see
+// StartSettings.RemoteConfigTimeout, PackagesAvailableTimeout and
+// EffectiveConfigTimeout.
+type offerTimeoutCallbacks struct {
+	types.Callbacks
+	client *ClientCommon
+
+	remoteConfigTimeout      time.Duration
+	packagesAvailableTimeout time.Duration
+	effectiveConfigTimeout   time.Duration
+}
+
+// boundOfferCallbacks returns the Callbacks that bound the processing of the offers
+// according to the settings. Returns the callbacks as is if there is nothing to
+// bound.
+func boundOfferCallbacks(
+	callbacks types.Callbacks, client *ClientCommon, settings types.StartSettings,
+) types.Callbacks {
+	if settings.RemoteConfigTimeout <= 0 && settings.PackagesAvailableTimeout <= 0 &&
+		settings.EffectiveConfigTimeout <= 0 {
+		return callbacks
+	}
+	return offerTimeoutCallbacks{
+		Callbacks:                callbacks,
+		client:                   client,
+		remoteConfigTimeout:      settings.RemoteConfigTimeout,
+		packagesAvailableTimeout: settings.PackagesAvailableTimeout,
+		effectiveConfigTimeout:   settings.EffectiveConfigTimeout,
+	}
+}
+
+func (c offerTimeoutCallbacks) OnMessage(ctx context.Context, msg *types.MessageData) {
+	// Every offer is reported when its own timeout elapses, the context is
+	// cancelled when the first one does.
+	var timeout time.Duration
+	var timers []*time.Timer
+	bound := func(offerTimeout time.Duration, timedOut func()) {
+		if offerTimeout <= 0 {
+			return
+		}
+		timers = append(timers, time.AfterFunc(offerTimeout, timedOut))
+		if timeout == 0 || offerTimeout < timeout {
+			timeout = offerTimeout
+		}
+	}
+	if config := msg.RemoteConfig; config != nil {
+		bound(c.remoteConfigTimeout, func() { c.remoteConfigTimedOut(config) })
+	}
+	if available := msg.PackagesAvailable; available != nil {
+		bound(c.packagesAvailableTimeout, func() { c.packagesAvailableTimedOut(available) })
+	}
+	if timeout == 0 {
+		c.Callbacks.OnMessage(ctx, msg)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer func() {
+		cancel()
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}()
+	c.Callbacks.OnMessage(ctx, msg)
+}
+
+// remoteConfigTimedOut reports the FAILED status of the offered config, unless the
+// Agent reported its outcome already.
+func (c offerTimeoutCallbacks) remoteConfigTimedOut(config *protobufs.AgentRemoteConfig) {
+	c.client.Logger.Errorf("Processing of the remote config did not complete within %v", c.remoteConfigTimeout)
+	if c.client.Capabilities&protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig == 0 ||
+		config.ConfigHash == nil {
+		return
+	}
+	status := c.client.ClientSyncedState.RemoteConfigStatus()
+	if status != nil && bytes.Equal(status.LastRemoteConfigHash, config.ConfigHash) &&
+		(status.Status == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED ||
+			status.Status == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED) {
+		return
+	}
+	err := c.client.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: config.ConfigHash,
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+		ErrorMessage:         fmt.Sprintf("processing of the remote config timed out after %v", c.remoteConfigTimeout),
+	})
+	if err != nil {
+		c.client.Logger.Errorf("Cannot report the timed out remote config: %v", err)
+	}
+}
+
+// packagesAvailableTimedOut reports the PackageStatuses with the error of the
+// offered packages, unless the Agent started syncing them or reported their
+// statuses already.
+func (c offerTimeoutCallbacks) packagesAvailableTimedOut(available *protobufs.PackagesAvailable) {
+	c.client.Logger.Errorf("Processing of the available packages did not complete within %v", c.packagesAvailableTimeout)
+	if c.client.Capabilities&protobufs.AgentCapabilities_AgentCapabilities_ReportsPackageStatuses == 0 ||
+		available.AllPackagesHash == nil {
+		return
+	}
+	statuses := &protobufs.PackageStatuses{}
+	if reported := c.client.ClientSyncedState.PackageStatuses(); reported != nil {
+		if bytes.Equal(reported.ServerProvidedAllPackagesHash, available.AllPackagesHash) {
+			return
+		}
+		statuses = proto.Clone(reported).(*protobufs.PackageStatuses)
+	}
+	statuses.ServerProvidedAllPackagesHash = available.AllPackagesHash
+	statuses.ErrorMessage = fmt.Sprintf("processing of the available packages timed out after %v", c.packagesAvailableTimeout)
+	if err := c.client.SetPackageStatuses(statuses); err != nil {
+		c.client.Logger.Errorf("Cannot report the timed out packages: %v", err)
+	}
+}
+
+func (c offerTimeoutCallbacks) GetEffectiveConfig(ctx context.Context) (*protobufs.EffectiveConfig, error) {
+	if c.effectiveConfigTimeout <= 0 {
+		return c.Callbacks.GetEffectiveConfig(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.effectiveConfigTimeout)
+	defer cancel()
+	timer := time.AfterFunc(c.effectiveConfigTimeout, func() {
+		c.client.Logger.Errorf("GetEffectiveConfig did not return within %v", c.effectiveConfigTimeout)
+	})
+	defer timer.Stop()
+	return c.Callbacks.GetEffectiveConfig(ctx)
+}
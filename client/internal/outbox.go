@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// outboxJournal keeps the undelivered state of the messages in the Outbox. The
+// journaled state is the state of the pending message merged with the state of the
+// messages that were sent but are not known to be delivered yet.
+type outboxJournal struct {
+	outbox types.Outbox
+	logger types.Logger
+
+	// Protects the fields below and serializes the Outbox calls.
+	mutex sync.Mutex
+	// The journaled message, nil if nothing is journaled.
+	journaled *protobufs.AgentToServer
+}
+
+// load returns the message journaled by the previous run, nil if none. The message
+// stays journaled until it is delivered.
+func (j *outboxJournal) load() *protobufs.AgentToServer {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	msg, err := j.outbox.Load()
+	if err != nil {
+		j.logger.Errorf("Cannot load the journaled message, its statuses are lost: %v", err)
+		return nil
+	}
+	j.journaled = undeliveredState(msg)
+	return j.journaled
+}
+
+// save journals the state of the pending message of next. Safe to call on a nil
+// journal.
+func (j *outboxJournal) save(next *NextMessage) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	msg := undeliveredState(next.Pending())
+	if msg == nil {
+		// Nothing new to journal.
+		return
+	}
+	if j.journaled != nil {
+		mergeUnsent(msg, j.journaled)
+	}
+	j.journaled = msg
+	if err := j.outbox.Save(msg); err != nil {
+		j.logger.Errorf("Cannot journal the unsent message: %v", err)
+	}
+}
+
+// delivered journals only the state of the pending message of next, the state of
+// the messages sent before is delivered. Safe to call on a nil journal.
+func (j *outboxJournal) delivered(next *NextMessage) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	msg := undeliveredState(next.Pending())
+	if msg == nil {
+		if j.journaled == nil {
+			return
+		}
+		j.journaled = nil
+		if err := j.outbox.Clear(); err != nil {
+			j.logger.Errorf("Cannot clear the journaled message: %v", err)
+		}
+		return
+	}
+	j.journaled = msg
+	if err := j.outbox.Save(msg); err != nil {
+		j.logger.Errorf("Cannot journal the unsent message: %v", err)
+	}
+}
+
+// undeliveredState returns the message with only the instance uid, the statuses and
+// the flags of msg, nil if msg has none of these statuses and flags. The
+// AgentDescription and the EffectiveConfig are not journaled, they are sent with the
+// first message after Start() anyway.
+func undeliveredState(msg *protobufs.AgentToServer) *protobufs.AgentToServer {
+	if msg == nil {
+		return nil
+	}
+	if msg.RemoteConfigStatus == nil && msg.PackageStatuses == nil && msg.Health == nil && msg.Flags == 0 {
+		return nil
+	}
+	return &protobufs.AgentToServer{
+		InstanceUid:        msg.InstanceUid,
+		RemoteConfigStatus: msg.RemoteConfigStatus,
+		PackageStatuses:    msg.PackageStatuses,
+		Health:             msg.Health,
+		Flags:              msg.Flags,
+	}
+}
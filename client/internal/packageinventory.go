@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+const errMsgInstallInterrupted = "installation was interrupted"
+
+// PackageInventory builds the PackageStatuses that reflect the packages installed in
+// the local package store. The statuses previously saved in the store are used as
+// a base, so that the information about the packages offered by the Server is kept,
+// and are then reconciled with the actual local packages:
+//   - installed packages that are missing in the statuses are added,
+//   - packages that no longer exist locally are removed unless their install failed,
+//   - installations that were in progress when the Agent stopped are reported as failed.
+//
+// ServerProvidedAllPackagesHash is set to the hash of the last fully synced offer if
+// the saved statuses do not specify it.
+func PackageInventory(provider types.PackagesStateProvider) (*protobufs.PackageStatuses, error) {
+	statuses, err := provider.LastReportedStatuses()
+	if err != nil {
+		return nil, err
+	}
+	return reconcilePackageInventory(statuses, provider)
+}
+
+// reconcilePackageInventory reconciles the statuses with the packages installed in
+// the local package store as PackageInventory does with the saved statuses.
+func reconcilePackageInventory(
+	statuses *protobufs.PackageStatuses, provider types.PackagesStateProvider,
+) (*protobufs.PackageStatuses, error) {
+	if statuses == nil {
+		statuses = &protobufs.PackageStatuses{}
+	}
+	if statuses.Packages == nil {
+		statuses.Packages = map[string]*protobufs.PackageStatus{}
+	}
+
+	if statuses.ServerProvidedAllPackagesHash == nil {
+		allHash, err := provider.AllPackagesHash()
+		if err != nil {
+			return nil, err
+		}
+		statuses.ServerProvidedAllPackagesHash = allHash
+	}
+
+	names, err := provider.Packages()
+	if err != nil {
+		return nil, err
+	}
+
+	installed := map[string]bool{}
+	for _, name := range names {
+		state, err := provider.PackageState(name)
+		if err != nil {
+			return nil, err
+		}
+		if !state.Exists {
+			continue
+		}
+		installed[name] = true
+
+		status := statuses.Packages[name]
+		if status == nil {
+			// Not offered by the Server yet, e.g. pre-installed with the Agent.
+			status = &protobufs.PackageStatus{Name: name}
+			statuses.Packages[name] = status
+		}
+		status.AgentHasVersion = state.Version
+		status.AgentHasHash = state.Hash
+		reconcilePackageStatus(status)
+	}
+
+	for name, status := range statuses.Packages {
+		if installed[name] {
+			continue
+		}
+		if status.Status == protobufs.PackageStatusEnum_PackageStatusEnum_InstallFailed {
+			// Keep reporting the failure, the Agent has nothing installed.
+			status.AgentHasVersion = ""
+			status.AgentHasHash = nil
+			continue
+		}
+		if status.Status == protobufs.PackageStatusEnum_PackageStatusEnum_Installing {
+			status.AgentHasVersion = ""
+			status.AgentHasHash = nil
+			reconcilePackageStatus(status)
+			continue
+		}
+		delete(statuses.Packages, name)
+	}
+
+	return statuses, nil
+}
+
+// reconcilePackageStatus sets the Status according to what the Agent has and what
+// the Server offered.
+func reconcilePackageStatus(status *protobufs.PackageStatus) {
+	switch {
+	case status.ServerOfferedHash == nil || bytes.Equal(status.ServerOfferedHash, status.AgentHasHash):
+		status.Status = protobufs.PackageStatusEnum_PackageStatusEnum_Installed
+		status.ErrorMessage = ""
+	case status.Status == protobufs.PackageStatusEnum_PackageStatusEnum_Installing:
+		// We were stopped in the middle of installation.
+		status.Status = protobufs.PackageStatusEnum_PackageStatusEnum_InstallFailed
+		status.ErrorMessage = errMsgInstallInterrupted
+	}
+}
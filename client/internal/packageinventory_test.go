@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func installPackage(t *testing.T, store *InMemPackagesStore, name string, version string, hash []byte) {
+	require.NoError(t, store.CreatePackage(name, protobufs.PackageType_PackageType_TopLevel))
+	require.NoError(t, store.SetPackageState(name, types.PackageState{
+		Exists:  true,
+		Type:    protobufs.PackageType_PackageType_TopLevel,
+		Hash:    hash,
+		Version: version,
+	}))
+}
+
+func TestPackageInventoryEmptyStore(t *testing.T) {
+	statuses, err := PackageInventory(NewInMemPackagesStore())
+	require.NoError(t, err)
+	assert.Empty(t, statuses.Packages)
+	assert.Nil(t, statuses.ServerProvidedAllPackagesHash)
+}
+
+func TestPackageInventory(t *testing.T) {
+	store := NewInMemPackagesStore()
+	require.NoError(t, store.SetAllPackagesHash([]byte{9, 9}))
+
+	// Installed and reported before.
+	installPackage(t, store, "synced", "1.0.0", []byte{1})
+	// Pre-installed, never reported.
+	installPackage(t, store, "preinstalled", "0.1.0", []byte{2})
+	// Agent was stopped while upgrading it to 2.0.0.
+	installPackage(t, store, "interrupted", "1.0.0", []byte{3})
+
+	require.NoError(t, store.SetLastReportedStatuses(&protobufs.PackageStatuses{
+		Packages: map[string]*protobufs.PackageStatus{
+			"synced": {
+				Name:              "synced",
+				AgentHasVersion:   "1.0.0",
+				AgentHasHash:      []byte{1},
+				ServerOfferedHash: []byte{1},
+				Status:            protobufs.PackageStatusEnum_PackageStatusEnum_Installed,
+			},
+			"interrupted": {
+				Name:                 "interrupted",
+				AgentHasVersion:      "1.0.0",
+				AgentHasHash:         []byte{3},
+				ServerOfferedVersion: "2.0.0",
+				ServerOfferedHash:    []byte{4},
+				Status:               protobufs.PackageStatusEnum_PackageStatusEnum_Installing,
+			},
+			"deleted": {
+				Name:              "deleted",
+				AgentHasHash:      []byte{5},
+				ServerOfferedHash: []byte{5},
+				Status:            protobufs.PackageStatusEnum_PackageStatusEnum_Installed,
+			},
+			"failed": {
+				Name:              "failed",
+				ServerOfferedHash: []byte{6},
+				Status:            protobufs.PackageStatusEnum_PackageStatusEnum_InstallFailed,
+				ErrorMessage:      "cannot download",
+			},
+		},
+	}))
+
+	statuses, err := PackageInventory(store)
+	require.NoError(t, err)
+
+	assert.EqualValues(t, []byte{9, 9}, statuses.ServerProvidedAllPackagesHash)
+	require.Len(t, statuses.Packages, 4)
+
+	assert.EqualValues(t, protobufs.PackageStatusEnum_PackageStatusEnum_Installed, statuses.Packages["synced"].Status)
+
+	preinstalled := statuses.Packages["preinstalled"]
+	require.NotNil(t, preinstalled)
+	assert.EqualValues(t, "0.1.0", preinstalled.AgentHasVersion)
+	assert.EqualValues(t, []byte{2}, preinstalled.AgentHasHash)
+	assert.EqualValues(t, protobufs.PackageStatusEnum_PackageStatusEnum_Installed, preinstalled.Status)
+
+	interrupted := statuses.Packages["interrupted"]
+	assert.EqualValues(t, protobufs.PackageStatusEnum_PackageStatusEnum_InstallFailed, interrupted.Status)
+	assert.EqualValues(t, errMsgInstallInterrupted, interrupted.ErrorMessage)
+	assert.EqualValues(t, "1.0.0", interrupted.AgentHasVersion)
+
+	assert.Nil(t, statuses.Packages["deleted"])
+	assert.EqualValues(t, "cannot download", statuses.Packages["failed"].ErrorMessage)
+}
+
+func TestPackageInventoryKeepsServerProvidedHash(t *testing.T) {
+	store := NewInMemPackagesStore()
+	require.NoError(t, store.SetAllPackagesHash([]byte{1}))
+	require.NoError(t, store.SetLastReportedStatuses(&protobufs.PackageStatuses{
+		ServerProvidedAllPackagesHash: []byte{2},
+	}))
+
+	statuses, err := PackageInventory(store)
+	require.NoError(t, err)
+	// The last offer was not fully synced yet, keep reporting the hash of that offer.
+	assert.EqualValues(t, []byte{2}, statuses.ServerProvidedAllPackagesHash)
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Maximum size of a package manifest. Protects from reading huge files in memory.
+const maxPackageManifestSize = 10 * 1024 * 1024
+
+var (
+	errFilesUpdaterNotImplemented = errors.New("PackagesStateProvider does not implement PackageFilesUpdater")
+	errManifestHashMismatch       = errors.New("manifest does not match the content hash")
+)
+
+// isPackageManifest returns true if the file is a manifest of a multi-file package.
+func isPackageManifest(file *protobufs.DownloadableFile) bool {
+	u, err := url.Parse(file.DownloadUrl)
+	return err == nil && u.Fragment == types.PackageManifestURLFragment
+}
+
+// downloadManifestPackage downloads the manifest of a multi-file package and all
+// files listed in it. The files of the package and the package content (set to the
+// manifest) are only updated if all files are successfully downloaded and verified.
+func (s *packagesSyncer) downloadManifestPackage(
+	ctx context.Context, pkgName string, file *protobufs.DownloadableFile,
+) error {
+	updater, ok := s.localState.(types.PackageFilesUpdater)
+	if !ok {
+		return errFilesUpdaterNotImplemented
+	}
+
+	manifestBytes, manifest, err := s.fetchManifest(ctx, file)
+	if err != nil {
+		return fmt.Errorf("cannot download manifest from %s: %v", file.DownloadUrl, err)
+	}
+
+	baseURL, err := url.Parse(file.DownloadUrl)
+	if err != nil {
+		return err
+	}
+
+	update, err := updater.BeginFilesUpdate(ctx, pkgName)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, f := range manifest.Files {
+		if err := s.downloadManifestFile(ctx, update, baseURL, f); err != nil {
+			s.logger.Errorf("Package %s: %v", pkgName, err)
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		if err := update.Abort(); err != nil {
+			s.logger.Errorf("Package %s: cannot discard downloaded files: %v", pkgName, err)
+		}
+		return fmt.Errorf(
+			"%d of %d files failed: %s", len(failures), len(manifest.Files), strings.Join(failures, "; "),
+		)
+	}
+
+	if err := update.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot replace package files: %v", err)
+	}
+
+	return s.localState.UpdateContent(ctx, pkgName, bytes.NewReader(manifestBytes), file.ContentHash)
+}
+
+func (s *packagesSyncer) fetchManifest(
+	ctx context.Context, file *protobufs.DownloadableFile,
+) ([]byte, *types.PackageManifest, error) {
+	content, err := s.openDownload(ctx, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = content.Close() }()
+
+	b, err := io.ReadAll(io.LimitReader(content, maxPackageManifestSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) > maxPackageManifestSize {
+		return nil, nil, errors.New("manifest is too large")
+	}
+	if hash := sha256.Sum256(b); !bytes.Equal(hash[:], file.ContentHash) {
+		return nil, nil, errManifestHashMismatch
+	}
+
+	var manifest types.PackageManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	for _, f := range manifest.Files {
+		if err := validateManifestPath(f.Path); err != nil {
+			return nil, nil, err
+		}
+	}
+	return b, &manifest, nil
+}
+
+// validateManifestPath ensures the file cannot be written outside of the package.
+func validateManifestPath(p string) error {
+	if p == "" || strings.HasPrefix(p, "/") || strings.Contains(p, `\`) ||
+		path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("invalid file path %q in manifest", p)
+	}
+	return nil
+}
+
+func (s *packagesSyncer) downloadManifestFile(
+	ctx context.Context,
+	update types.PackageFilesUpdate,
+	baseURL *url.URL,
+	f types.PackageManifestFile,
+) error {
+	expectedHash, err := hex.DecodeString(f.SHA256)
+	if err != nil || len(expectedHash) != sha256.Size {
+		return fmt.Errorf("file %s: invalid sha256 in manifest", f.Path)
+	}
+
+	fileURL, err := baseURL.Parse(f.DownloadUrl)
+	if err != nil {
+		return fmt.Errorf("file %s: %v", f.Path, err)
+	}
+
+	content, err := s.openDownload(ctx, &protobufs.DownloadableFile{DownloadUrl: fileURL.String()})
+	if err != nil {
+		return fmt.Errorf("file %s: cannot download from %s: %v", f.Path, fileURL, err)
+	}
+	defer func() { _ = content.Close() }()
+
+	verifying := &hashVerifyingReader{r: content, hash: sha256.New(), expected: expectedHash}
+	if err := update.WriteFile(ctx, f.Path, verifying); err != nil {
+		return fmt.Errorf("file %s: %v", f.Path, err)
+	}
+	return nil
+}
+
+var errFileHashMismatch = errors.New("content does not match the hash")
+
+// hashVerifyingReader computes the hash of the content while it is read and
+// returns an error instead of io.EOF if the hash does not match.
+type hashVerifyingReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected []byte
+}
+
+func (r *hashVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.expected) {
+		return n, errFileHashMismatch
+	}
+	return n, err
+}
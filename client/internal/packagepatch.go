@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Maximum size of a patch file. Protects from reading huge files in memory.
+const maxPackagePatchSize = 256 * 1024 * 1024
+
+var (
+	errContentReaderNotImplemented = errors.New("PackagesStateProvider does not implement PackageContentReader")
+	errPatchBaseMismatch           = errors.New("local content does not match the patch base")
+	errPatchResultMismatch         = errors.New("patched content does not match the content hash")
+)
+
+// packagePatch describes a package file that is offered as a patch.
+type packagePatch struct {
+	baseHash []byte
+	fullURL  string
+}
+
+// parsePackagePatch returns the patch description if the file is offered as a patch.
+func parsePackagePatch(file *protobufs.DownloadableFile) (*packagePatch, bool) {
+	u, err := url.Parse(file.DownloadUrl)
+	if err != nil || u.Fragment == "" {
+		return nil, false
+	}
+	params, err := url.ParseQuery(u.EscapedFragment())
+	if err != nil {
+		return nil, false
+	}
+	base, ok := params[types.PackagePatchBaseURLFragmentKey]
+	if !ok || len(base) == 0 {
+		return nil, false
+	}
+	baseHash, err := hex.DecodeString(base[0])
+	if err != nil {
+		return nil, false
+	}
+	return &packagePatch{
+		baseHash: baseHash,
+		fullURL:  params.Get(types.PackagePatchFullURLFragmentKey),
+	}, true
+}
+
+// downloadPatchedFile updates the package content by applying the patch offered by
+// the Server. Falls back to downloading the full file if the patch cannot be applied.
+func (s *packagesSyncer) downloadPatchedFile(
+	ctx context.Context, pkgName string, file *protobufs.DownloadableFile, patch *packagePatch,
+) error {
+	err := s.applyPatch(ctx, pkgName, file, patch)
+	if err == nil {
+		return nil
+	}
+	if patch.fullURL == "" {
+		return fmt.Errorf("cannot apply patch from %s: %v", file.DownloadUrl, err)
+	}
+
+	s.logger.Debugf("Package %s: cannot apply patch (%v), downloading full file.", pkgName, err)
+	return s.downloadFile(ctx, pkgName, &protobufs.DownloadableFile{
+		DownloadUrl: patch.fullURL,
+		ContentHash: file.ContentHash,
+		Signature:   file.Signature,
+	})
+}
+
+func (s *packagesSyncer) applyPatch(
+	ctx context.Context, pkgName string, file *protobufs.DownloadableFile, patch *packagePatch,
+) error {
+	contentReader, ok := s.localState.(types.PackageContentReader)
+	if !ok {
+		return errContentReaderNotImplemented
+	}
+
+	localHash, err := s.localState.FileContentHash(pkgName)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(localHash, patch.baseHash) {
+		return errPatchBaseMismatch
+	}
+
+	oldReader, err := contentReader.ReadContent(ctx, pkgName)
+	if err != nil {
+		return fmt.Errorf("cannot read local content: %v", err)
+	}
+	// The local content is trusted, its size is not limited.
+	oldContent, err := s.readAllReserved(oldReader, -1)
+	if err != nil {
+		return fmt.Errorf("cannot read local content: %w", err)
+	}
+	defer s.packageDownloads.MemoryBudget.release(int64(len(oldContent)))
+
+	s.logger.Debugf("Downloading package %s patch from %s", pkgName, file.DownloadUrl)
+	patchReader, err := s.openDownload(ctx, file)
+	if err != nil {
+		return fmt.Errorf("cannot download patch: %v", err)
+	}
+	patchContent, err := s.readAllReserved(patchReader, maxPackagePatchSize)
+	if err != nil {
+		return fmt.Errorf("cannot download patch: %w", err)
+	}
+	defer s.packageDownloads.MemoryBudget.release(int64(len(patchContent)))
+	if len(patchContent) > maxPackagePatchSize {
+		return errors.New("patch is too large")
+	}
+
+	// Verify the result before storing anything, without keeping it in memory.
+	maxSize := s.packageDownloads.maxPatchedFileSize()
+	hash := sha256.New()
+	if _, err := bspatch(oldContent, patchContent, hash, maxSize); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), file.ContentHash) {
+		return errPatchResultMismatch
+	}
+
+	// Patching is deterministic, so apply the patch again streaming the verified
+	// content to the local storage.
+	patchedReader, patchedWriter := io.Pipe()
+	go func() {
+		_, err := bspatch(oldContent, patchContent, patchedWriter, maxSize)
+		patchedWriter.CloseWithError(err)
+	}()
+	err = s.localState.UpdateContent(ctx, pkgName, patchedReader, file.ContentHash)
+	// Unblock the patching if UpdateContent did not read everything.
+	_ = patchedReader.Close()
+	return err
+}
+
+// readAllReserved reads all data like readAllAndClose and reserves its size in the
+// memory budget, the caller must release it. Returns ErrMemoryLimitExceeded,
+// without reading more than fits, if the data does not fit in the budget.
+func (s *packagesSyncer) readAllReserved(r io.ReadCloser, limit int64) ([]byte, error) {
+	budget := s.packageDownloads.MemoryBudget
+	available := budget.available()
+	if available >= 0 && (limit < 0 || available < limit) {
+		limit = available
+	}
+	data, err := readAllAndClose(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	if (available >= 0 && int64(len(data)) > available) || !budget.reserve(int64(len(data))) {
+		budget.exceeded()
+		return nil, ErrMemoryLimitExceeded
+	}
+	return data, nil
+}
+
+// readAllAndClose reads all data and closes the reader. Reads at most limit+1 bytes
+// if limit is not negative, so that exceeding the limit can be detected.
+func readAllAndClose(r io.ReadCloser, limit int64) ([]byte, error) {
+	defer func() { _ = r.Close() }()
+	if limit >= 0 {
+		return io.ReadAll(io.LimitReader(r, limit+1))
+	}
+	return io.ReadAll(r)
+}
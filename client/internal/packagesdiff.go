@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// diffPackages returns the difference between the available packages and the
+// packages in the local state. The diff is empty if the local AllPackagesHash is
+// the offered one, as when syncing.
+func diffPackages(
+	available *protobufs.PackagesAvailable, localState types.PackagesStateProvider,
+) (*types.PackagesDiff, error) {
+	diff := &types.PackagesDiff{}
+	hash, err := localState.AllPackagesHash()
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(hash, available.AllPackagesHash) {
+		return diff, nil
+	}
+
+	for name, pkgAvail := range available.Packages {
+		pkgLocal, err := localState.PackageState(name)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !pkgLocal.Exists:
+			diff.Added = append(diff.Added, name)
+		case !bytes.Equal(pkgLocal.Hash, pkgAvail.Hash) || pkgLocal.Type != pkgAvail.Type:
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+
+	localPackages, err := localState.Packages()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range localPackages {
+		if _, offered := available.Packages[name]; !offered {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Changed)
+	sort.Strings(diff.Removed)
+	return diff, nil
+}
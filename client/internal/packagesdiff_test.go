@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestDiffPackages(t *testing.T) {
+	store := NewInMemPackagesStore()
+	require.NoError(t, store.SetAllPackagesHash([]byte{9}))
+	installPackage(t, store, "unchanged", "1.0.0", []byte{1})
+	installPackage(t, store, "upgraded", "1.0.0", []byte{2})
+	installPackage(t, store, "retyped", "1.0.0", []byte{3})
+	installPackage(t, store, "removed", "1.0.0", []byte{4})
+
+	topLevel := protobufs.PackageType_PackageType_TopLevel
+	available := &protobufs.PackagesAvailable{
+		AllPackagesHash: []byte{10},
+		Packages: map[string]*protobufs.PackageAvailable{
+			"unchanged": {Type: topLevel, Hash: []byte{1}},
+			"upgraded":  {Type: topLevel, Hash: []byte{5}},
+			"retyped":   {Type: protobufs.PackageType_PackageType_Addon, Hash: []byte{3}},
+			"b-added":   {Type: topLevel, Hash: []byte{6}},
+			"a-added":   {Type: topLevel, Hash: []byte{7}},
+		},
+	}
+	diff, err := diffPackages(available, store)
+	require.NoError(t, err)
+	assert.Equal(t, &types.PackagesDiff{
+		Added:   []string{"a-added", "b-added"},
+		Changed: []string{"retyped", "upgraded"},
+		Removed: []string{"removed"},
+	}, diff)
+	assert.False(t, diff.IsEmpty())
+
+	// The packages are not compared once the offered packages are synced.
+	available.AllPackagesHash = []byte{9}
+	diff, err = diffPackages(available, store)
+	require.NoError(t, err)
+	assert.True(t, diff.IsEmpty())
+}
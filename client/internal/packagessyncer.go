@@ -5,18 +5,44 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/open-telemetry/opamp-go/client/types"
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
+// Default maximum size of a package file produced by applying a patch.
+const defaultMaxPatchedFileSize = 256 * 1024 * 1024
+
+// PackageDownloadSettings control how the package files are downloaded.
+type PackageDownloadSettings struct {
+	// Downloaders of package files keyed by URL scheme.
+	Downloaders map[string]types.Downloader
+
+	// Maximum size of a package file produced by applying a patch. Defaults to
+	// defaultMaxPatchedFileSize if zero.
+	MaxPatchedFileSize int64
+
+	// The budget the patches are accounted in, nil if there is no memory limit.
+	MemoryBudget *MemoryBudget
+}
+
+func (s PackageDownloadSettings) maxPatchedFileSize() int64 {
+	if s.MaxPatchedFileSize > 0 {
+		return s.MaxPatchedFileSize
+	}
+	return defaultMaxPatchedFileSize
+}
+
 // packagesSyncer performs the package syncing process.
 type packagesSyncer struct {
 	logger            types.Logger
 	available         *protobufs.PackagesAvailable
 	clientSyncedState *ClientSyncedState
 	localState        types.PackagesStateProvider
+	packageDownloads  PackageDownloadSettings
 	sender            Sender
 
 	statuses *protobufs.PackageStatuses
@@ -30,6 +56,7 @@ func NewPackagesSyncer(
 	sender Sender,
 	clientSyncedState *ClientSyncedState,
 	packagesStateProvider types.PackagesStateProvider,
+	packageDownloads PackageDownloadSettings,
 ) *packagesSyncer {
 	return &packagesSyncer{
 		logger:            logger,
@@ -37,6 +64,7 @@ func NewPackagesSyncer(
 		sender:            sender,
 		clientSyncedState: clientSyncedState,
 		localState:        packagesStateProvider,
+		packageDownloads:  packageDownloads,
 		doneCh:            make(chan struct{}),
 	}
 }
@@ -99,6 +127,14 @@ func (s *packagesSyncer) initStatuses() error {
 
 // doSync performs the actual syncing process.
 func (s *packagesSyncer) doSync(ctx context.Context) {
+	if s.packageDownloads.MemoryBudget.available() == 0 {
+		s.packageDownloads.MemoryBudget.exceeded()
+		s.logger.Debugf("Package syncing is deferred until the memory used by the client is below the limit.")
+		if !s.packageDownloads.MemoryBudget.waitAvailable(ctx) {
+			return
+		}
+	}
+
 	hash, err := s.localState.AllPackagesHash()
 	if err != nil {
 		s.logger.Errorf("Package syncing failed: %V", err)
@@ -198,6 +234,10 @@ func (s *packagesSyncer) syncPackage(
 
 	// Sync package file: ensure it exists or download it.
 	err = s.syncPackageFile(ctx, pkgName, pkgAvail.File)
+	if err == nil {
+		// Make sure the installed package works before reporting it as installed.
+		err = s.verifyPackage(ctx, pkgName, pkgAvail.Version)
+	}
 	if err == nil {
 		// Only save the state on success, so that next sync does not retry this package.
 		pkgLocal.Hash = pkgAvail.Hash
@@ -218,6 +258,27 @@ func (s *packagesSyncer) syncPackage(
 	return err
 }
 
+// verifyPackage verifies the package if the local state supports verification.
+// If the verification fails the package content is rolled back.
+func (s *packagesSyncer) verifyPackage(ctx context.Context, pkgName string, version string) error {
+	verifier, ok := s.localState.(types.PackageVerifier)
+	if !ok {
+		return nil
+	}
+
+	err := verifier.VerifyPackage(ctx, pkgName, version)
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("package %s failed verification: %v", pkgName, err)
+	if rollbackErr := verifier.RollbackContent(ctx, pkgName); rollbackErr != nil {
+		s.logger.Errorf("Cannot roll back package %s: %v", pkgName, rollbackErr)
+		return fmt.Errorf("%v, rollback failed: %v", err, rollbackErr)
+	}
+	return err
+}
+
 // syncPackageFile downloads the package file from the server.
 // If the file already exists and contents are
 // unchanged, it is not downloaded again.
@@ -226,7 +287,13 @@ func (s *packagesSyncer) syncPackageFile(
 ) error {
 	shouldDownload, err := s.shouldDownloadFile(pkgName, file)
 	if err == nil && shouldDownload {
-		err = s.downloadFile(ctx, pkgName, file)
+		if isPackageManifest(file) {
+			err = s.downloadManifestPackage(ctx, pkgName, file)
+		} else if patch, ok := parsePackagePatch(file); ok {
+			err = s.downloadPatchedFile(ctx, pkgName, file, patch)
+		} else {
+			err = s.downloadFile(ctx, pkgName, file)
+		}
 	}
 
 	return err
@@ -258,29 +325,52 @@ func (s *packagesSyncer) shouldDownloadFile(
 func (s *packagesSyncer) downloadFile(ctx context.Context, pkgName string, file *protobufs.DownloadableFile) error {
 	s.logger.Debugf("Downloading package %s file from %s", pkgName, file.DownloadUrl)
 
-	req, err := http.NewRequestWithContext(ctx, "GET", file.DownloadUrl, nil)
+	content, err := s.openDownload(ctx, file)
 	if err != nil {
 		return fmt.Errorf("cannot download file from %s: %v", file.DownloadUrl, err)
 	}
+	defer func() { _ = content.Close() }()
 
-	resp, err := http.DefaultClient.Do(req)
+	// TODO: either add a callback to verify file.Signature or pass the Signature
+	// as a parameter to UpdateContent.
+
+	err = s.localState.UpdateContent(ctx, pkgName, content, file.ContentHash)
 	if err != nil {
 		return fmt.Errorf("cannot download file from %s: %v", file.DownloadUrl, err)
 	}
-	defer func() { _ = resp.Body.Close() }()
+	return nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("cannot download file from %s, HTTP response=%v", file.DownloadUrl, resp.StatusCode)
+// openDownload starts downloading the file using the Downloader registered for
+// the URL scheme or using HTTP if there is none.
+func (s *packagesSyncer) openDownload(ctx context.Context, file *protobufs.DownloadableFile) (io.ReadCloser, error) {
+	u, err := url.Parse(file.DownloadUrl)
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: either add a callback to verify file.Signature or pass the Signature
-	// as a parameter to UpdateContent.
+	if downloader, ok := s.packageDownloads.Downloaders[u.Scheme]; ok {
+		return downloader.Download(ctx, file)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("no downloader for URL scheme %q", u.Scheme)
+	}
 
-	err = s.localState.UpdateContent(ctx, pkgName, resp.Body, file.ContentHash)
+	req, err := http.NewRequestWithContext(ctx, "GET", file.DownloadUrl, nil)
 	if err != nil {
-		return fmt.Errorf("cannot download file from %s: %v", file.DownloadUrl, err)
+		return nil, err
 	}
-	return nil
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("HTTP response=%v", resp.StatusCode)
+	}
+	return resp.Body, nil
 }
 
 // deleteUnneededLocalPackages deletes local packages that are not
@@ -334,6 +424,7 @@ func (s *packagesSyncer) reportStatuses(sendImmediately bool) error {
 		func(msg *protobufs.AgentToServer) {
 			msg.PackageStatuses = s.clientSyncedState.PackageStatuses()
 		})
+	s.sender.JournalPending()
 
 	if sendImmediately {
 		s.sender.ScheduleSend()
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// ProxyFunc returns the func that selects the proxy of the requests to the Server,
+// to be used as http.Transport.Proxy and websocket.Dialer.Proxy: the ProxyURL of the
+// settings if set, otherwise the Proxy, otherwise the proxy defined by the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func ProxyFunc(settings types.StartSettings) func(*http.Request) (*url.URL, error) {
+	switch {
+	case settings.ProxyURL != "":
+		proxyURL, err := parseProxyURL(settings.ProxyURL)
+		if err != nil {
+			return func(*http.Request) (*url.URL, error) { return nil, err }
+		}
+		return http.ProxyURL(proxyURL)
+	case settings.Proxy != nil:
+		return settings.Proxy
+	}
+	return http.ProxyFromEnvironment
+}
+
+// HasProxySettings returns true if the proxy is set explicitly in the settings
+// rather than taken from the environment variables.
+func HasProxySettings(settings types.StartSettings) bool {
+	return settings.ProxyURL != "" || settings.Proxy != nil
+}
+
+// parseProxyURL parses the ProxyURL. The errors do not include the URL, since it may
+// contain the credentials of the proxy.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ProxyURL: %w", withoutURL(err))
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid ProxyURL: unsupported scheme %q, must be http, https or socks5", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, errors.New("invalid ProxyURL: host is missing")
+	}
+	return proxyURL, nil
+}
+
+// withoutURL returns the cause of the url.Error, which does not quote the URL, so
+// that the credentials in the URL are not exposed.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
@@ -3,11 +3,19 @@ package internal
 import (
 	"context"
 	"errors"
+	"time"
+
+	"google.golang.org/protobuf/proto"
 
 	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
+// How long the client delays its next message if the Server reports that it is
+// unavailable without suggesting a retry interval.
+const defaultUnavailableThrottle = 5 * time.Second
+
 // receivedProcessor handles the processing of messages received from the Server.
 type receivedProcessor struct {
 	logger types.Logger
@@ -24,8 +32,29 @@ type receivedProcessor struct {
 
 	packagesStateProvider types.PackagesStateProvider
 
+	// Settings of the package file downloads.
+	packageDownloads PackageDownloadSettings
+
+	// Verifies the new OpAMP Server endpoints before the Agent switches to them.
+	// If nil then the offered settings are accepted without verification.
+	endpointTransition *EndpointTransition
+
 	// Agent's capabilities defined at Start() time.
 	capabilities protobufs.AgentCapabilities
+
+	// Connection settings offers that are not valid yet.
+	connectionSettingsSchedule *connectionSettingsSchedule
+
+	// Rejects the received messages that violate the specification, nil if the
+	// strict mode is not enabled.
+	specCompliance *SpecCompliance
+
+	// Rejects the received messages that are not signed by the Server, nil if the
+	// verification is not enabled.
+	responseVerifier *ResponseVerifier
+
+	// True once a message was received.
+	received bool
 }
 
 func newReceivedProcessor(
@@ -34,7 +63,11 @@ func newReceivedProcessor(
 	sender Sender,
 	clientSyncedState *ClientSyncedState,
 	packagesStateProvider types.PackagesStateProvider,
+	packageDownloads PackageDownloadSettings,
+	endpointTransition *EndpointTransition,
 	capabilities protobufs.AgentCapabilities,
+	specCompliance *SpecCompliance,
+	responseVerifier *ResponseVerifier,
 ) receivedProcessor {
 	return receivedProcessor{
 		logger:                logger,
@@ -42,7 +75,13 @@ func newReceivedProcessor(
 		sender:                sender,
 		clientSyncedState:     clientSyncedState,
 		packagesStateProvider: packagesStateProvider,
+		packageDownloads:      packageDownloads,
+		endpointTransition:    endpointTransition,
 		capabilities:          capabilities,
+		specCompliance:        specCompliance,
+		responseVerifier:      responseVerifier,
+
+		connectionSettingsSchedule: newConnectionSettingsSchedule(),
 	}
 }
 
@@ -50,10 +89,24 @@ func newReceivedProcessor(
 // the received message and performs any processing necessary based on what fields are set.
 // This function will call any relevant callbacks.
 func (r *receivedProcessor) ProcessReceivedMessage(ctx context.Context, msg *protobufs.ServerToAgent) {
+	if r.responseVerifier != nil && !r.responseVerifier.accept(msg) {
+		return
+	}
+	first := !r.received
+	r.received = true
+	if r.specCompliance != nil &&
+		!r.specCompliance.accept(r.callbacks, msg, r.sender.NextMessage().InstanceUid(), first) {
+		return
+	}
+
 	if r.callbacks != nil {
 		if msg.Command != nil {
-			r.rcvCommand(msg.Command)
+			r.rcvCommand(ctx, msg.Command)
 			// If a command message exists, other messages will be ignored
+			if msg.Flags != 0 {
+				flags := protobufs.ServerToAgentFlags(msg.Flags)
+				r.callbacks.OnFlagsHandled(types.FlagsHandling{Flags: flags, IgnoredFlags: flags})
+			}
 			return
 		}
 
@@ -62,6 +115,16 @@ func (r *receivedProcessor) ProcessReceivedMessage(ctx context.Context, msg *pro
 			r.logger.Errorf("cannot processed received flags:%v", err)
 		}
 
+		if msg.ConnectionSettings != nil {
+			// Hold back the offers that are not valid yet and drop the expired ones.
+			// The received offers replace the pending offers of the same kind.
+			active, pending := splitConnectionSettingsOffers(r.logger, msg.ConnectionSettings, time.Now())
+			r.connectionSettingsSchedule.update(msg.ConnectionSettings, pending)
+			msg.ConnectionSettings = active
+
+			r.sanitizeConnectionSettings(msg.ConnectionSettings)
+		}
+
 		msgData := &types.MessageData{}
 
 		if msg.RemoteConfig != nil {
@@ -115,14 +178,20 @@ func (r *receivedProcessor) ProcessReceivedMessage(ctx context.Context, msg *pro
 					r.sender,
 					r.clientSyncedState,
 					r.packagesStateProvider,
+					r.packageDownloads,
 				)
+				diff, err := diffPackages(msg.PackagesAvailable, r.packagesStateProvider)
+				if err != nil {
+					r.logger.Errorf("Cannot compare the available packages with the local ones: %v", err)
+				}
+				msgData.PackagesDiff = diff
 			} else {
 				r.logger.Debugf("Ignoring PackagesAvailable, agent does not have AcceptsPackages capability")
 			}
 		}
 
 		if msg.AgentIdentification != nil {
-			err := r.rcvAgentIdentification(msg.AgentIdentification)
+			err := r.rcvAgentIdentification(ctx, msg.AgentIdentification)
 			if err == nil {
 				msgData.AgentIdentification = msg.AgentIdentification
 			}
@@ -154,10 +223,20 @@ func (r *receivedProcessor) rcvFlags(
 	// If the Server asks to report data we fetch it from the client state storage and
 	// send to the Server.
 
+	if flags == 0 {
+		return false, nil
+	}
+	handling := types.FlagsHandling{
+		Flags:        flags,
+		IgnoredFlags: flags &^ protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState,
+	}
+	defer func() { r.callbacks.OnFlagsHandled(handling) }()
+
 	if flags&protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState != 0 {
 		cfg, err := r.callbacks.GetEffectiveConfig(ctx)
 		if err != nil {
 			r.logger.Errorf("Cannot GetEffectiveConfig: %v", err)
+			handling.EffectiveConfigErr = err
 			cfg = nil
 		}
 
@@ -175,6 +254,7 @@ func (r *receivedProcessor) rcvFlags(
 			},
 		)
 		scheduleSend = true
+		handling.FullStateScheduled = true
 	}
 
 	return scheduleSend, nil
@@ -185,40 +265,225 @@ func (r *receivedProcessor) rcvOpampConnectionSettings(ctx context.Context, sett
 		return
 	}
 
-	if r.hasCapability(protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings) {
-		err := r.callbacks.OnOpampConnectionSettings(ctx, settings.Opamp)
-		if err == nil {
-			// TODO: verify connection using new settings.
-			r.callbacks.OnOpampConnectionSettingsAccepted(settings.Opamp)
-		}
-	} else {
+	if !r.hasCapability(protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings) {
 		r.logger.Debugf("Ignoring Opamp, agent does not have AcceptsOpAMPConnectionSettings capability")
+		return
+	}
+
+	if isReportedConnectionSettings(r.clientSyncedState.ConnectionSettingsStatus(), settings.Hash) {
+		r.logger.Debugf("Ignoring Opamp, the offer was already applied or rejected")
+		return
+	}
+
+	if r.endpointTransition != nil {
+		if endpoint, inProgress := r.endpointTransition.InProgress(); inProgress {
+			if endpoint == "" {
+				endpoint = "the current endpoint"
+			}
+			r.logger.Debugf("Ignoring Opamp, transition to %s is in progress", endpoint)
+			return
+		}
+	}
+
+	if err := r.callbacks.OnOpampConnectionSettings(ctx, settings.Opamp); err != nil {
+		r.rejectConnectionSettings(settings.Hash, types.RejectionReasonOf(err), err)
+		return
+	}
+
+	if r.endpointTransition == nil || !NeedsVerification(settings.Opamp) {
+		r.acceptConnectionSettings(settings.Hash, settings.Opamp)
+		return
+	}
+
+	// Keep using the current connection while the new endpoint or certificate is
+	// verified, so that the Agent does not go offline if it turns out to be unusable.
+	opampSettings := settings.Opamp
+	r.endpointTransition.Start(ctx, r.logger, opampSettings, func(err error) {
+		if err != nil && ctx.Err() != nil {
+			// The client is stopping, the endpoint was not really rejected.
+			return
+		}
+		if err != nil {
+			reason := types.RejectionReasonOf(err)
+			if reason == types.RejectionReasonOther {
+				reason = types.RejectionReasonEndpointUnhealthy
+			}
+			r.logger.Errorf(
+				"Rejecting OpAMP connection settings, endpoint %s is not healthy: %v",
+				opampSettings.DestinationEndpoint, err,
+			)
+			r.rejectConnectionSettings(settings.Hash, reason, err)
+			return
+		}
+		if err := r.endpointTransition.SwitchCertificate(opampSettings); err != nil {
+			r.logger.Errorf("Rejecting OpAMP connection settings, cannot switch to the offered certificate: %v", err)
+			r.rejectConnectionSettings(settings.Hash, types.RejectionReasonOf(err), err)
+			return
+		}
+		if err := r.endpointTransition.SwitchEndpoint(opampSettings); err != nil {
+			r.logger.Errorf("Rejecting OpAMP connection settings, cannot switch to the offered endpoint: %v", err)
+			r.rejectConnectionSettings(settings.Hash, types.RejectionReasonOf(err), err)
+			return
+		}
+		r.acceptConnectionSettings(settings.Hash, opampSettings)
+	})
+}
+
+// sanitizeConnectionSettings canonicalizes the headers of the offers and removes the
+// offers with invalid headers. The rejection of an invalid OpAMP offer is reported
+// to the Server.
+func (r *receivedProcessor) sanitizeConnectionSettings(settings *protobufs.ConnectionSettingsOffers) {
+	sharedinternal.SanitizeConnectionSettingsOffers(settings, func(offer string, err error) {
+		r.logger.Errorf("Ignoring %s connection settings offer: %v", offer, err)
+		if offer == "opamp" && r.hasCapability(protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings) {
+			r.rejectConnectionSettings(settings.Hash, types.RejectionReasonInvalidHeaders, err)
+		}
+	})
+}
+
+func (r *receivedProcessor) acceptConnectionSettings(hash []byte, settings *protobufs.OpAMPConnectionSettings) {
+	r.reportConnectionSettingsStatus(appliedConnectionSettingsStatus(hash))
+	r.callbacks.OnOpampConnectionSettingsAccepted(settings)
+}
+
+func (r *receivedProcessor) rejectConnectionSettings(
+	hash []byte, reason types.ConnectionSettingsRejectionReason, err error,
+) {
+	r.reportConnectionSettingsStatus(rejectedConnectionSettingsStatus(hash, reason, err.Error()))
+}
+
+// reportConnectionSettingsStatus records the status of the last connection settings
+// offer and reports it to the Server in the AgentHealth if the Agent reports its
+// health and the reported health changed, see types.ConnectionSettingsStatus.
+func (r *receivedProcessor) reportConnectionSettingsStatus(status *types.ConnectionSettingsStatus) {
+	reported := r.clientSyncedState.Health()
+	if err := r.clientSyncedState.SetConnectionSettingsStatus(status); err != nil {
+		r.logger.Errorf("Cannot report connection settings status: %v", err)
+		return
+	}
+
+	health := r.clientSyncedState.Health()
+	if r.capabilities&protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth == 0 || proto.Equal(reported, health) {
+		return
+	}
+	r.sender.NextMessage().Update(
+		func(msg *protobufs.AgentToServer) {
+			msg.Health = health
+		},
+	)
+	r.sender.ScheduleSend()
+}
+
+// connectionSettingsDue returns a channel that becomes readable when some of the
+// pending connection settings offers become valid. processDueConnectionSettings must
+// be called then, on the goroutine that calls ProcessReceivedMessage.
+func (r *receivedProcessor) connectionSettingsDue() <-chan struct{} {
+	return r.connectionSettingsSchedule.Due()
+}
+
+// processDueConnectionSettings processes the pending connection settings offers that
+// became valid as if they were just received from the Server.
+func (r *receivedProcessor) processDueConnectionSettings(ctx context.Context) {
+	for _, offers := range r.connectionSettingsSchedule.popDue(time.Now()) {
+		r.ProcessReceivedMessage(ctx, &protobufs.ServerToAgent{ConnectionSettings: offers})
+	}
+}
+
+// stop drops the pending connection settings offers.
+func (r *receivedProcessor) stop() {
+	r.connectionSettingsSchedule.stop()
+}
+
+// receiveLoop receives the messages with receive on a separate goroutine until
+// receive fails and returns the error. The received messages and the connection
+// settings offers that become valid later are processed one at a time on the calling
+// goroutine. It is the receiving loop of the transports that keep a connection open,
+// i.e. WebSocket and gRPC. The pending connection settings offers are dropped when
+// the loop returns.
+func (r *receivedProcessor) receiveLoop(
+	ctx context.Context, receive func(msg *protobufs.ServerToAgent) error,
+) error {
+	runContext, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	defer r.stop()
+
+	messages := make(chan *protobufs.ServerToAgent)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			var message protobufs.ServerToAgent
+			if err := receive(&message); err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- &message:
+			case <-runContext.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case message := <-messages:
+			r.ProcessReceivedMessage(runContext, message)
+
+		case <-r.connectionSettingsDue():
+			r.processDueConnectionSettings(runContext)
+
+		case err := <-readErr:
+			return err
+		}
 	}
 }
 
 func (r *receivedProcessor) processErrorResponse(body *protobufs.ServerErrorResponse) {
-	// TODO: implement this.
-	r.logger.Errorf("received an error from server: %s", body.ErrorMessage)
+	err := types.NewServerError(body)
+	if err.Type == protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable {
+		// Give the Server time to recover, honour its suggested retry interval.
+		err.Throttle = err.RetryAfter
+		if err.Throttle <= 0 {
+			err.Throttle = defaultUnavailableThrottle
+		}
+		r.sender.Throttle(err.Throttle)
+	}
+	r.logger.Errorf("Received an error from server: %v", err)
+	r.callbacks.OnError(err)
 }
 
-func (r *receivedProcessor) rcvAgentIdentification(agentId *protobufs.AgentIdentification) error {
+func (r *receivedProcessor) rcvAgentIdentification(
+	ctx context.Context, agentId *protobufs.AgentIdentification,
+) error {
 	if agentId.NewInstanceUid == "" {
 		err := errors.New("empty instance uid is not allowed")
 		r.logger.Debugf(err.Error())
 		return err
 	}
+	if err := ValidateInstanceUid(agentId.NewInstanceUid); err != nil {
+		r.logger.Errorf("Error while setting instance uid: %v", err)
+		return err
+	}
+
+	if agentId.NewInstanceUid != r.sender.NextMessage().InstanceUid() {
+		// Let the Agent persist the instance uid before any message carries it, so
+		// that the Agent keeps using it after a restart.
+		r.callbacks.SaveInstanceUid(ctx, agentId.NewInstanceUid)
+		r.clientSyncedState.SetInstanceUid(agentId.NewInstanceUid)
+	}
 
+	// All messages that are sent from now on carry the new instance uid.
 	err := r.sender.SetInstanceUid(agentId.NewInstanceUid)
 	if err != nil {
-		r.logger.Errorf("Error while setting instance uid: %v, err")
+		r.logger.Errorf("Error while setting instance uid: %v", err)
 		return err
 	}
 
 	return nil
 }
 
-func (r *receivedProcessor) rcvCommand(command *protobufs.ServerToAgentCommand) {
+func (r *receivedProcessor) rcvCommand(ctx context.Context, command *protobufs.ServerToAgentCommand) {
 	if command != nil {
-		r.callbacks.OnCommand(command)
+		executeCommand(ctx, r.logger, r.callbacks, r.sender, r.clientSyncedState, r.capabilities, command)
 	}
 }
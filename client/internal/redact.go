@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/internal"
+)
+
+// The text that replaces the redacted secrets.
+const redactedText = internal.RedactedText
+
+// Secrets shorter than this are not redacted, replacing them would mangle the
+// messages without protecting anything.
+const minSecretLength = 4
+
+// RedactHeader returns a copy of the header with the values of the sensitive
+// headers replaced. Use it to log the headers.
+func RedactHeader(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		if !internal.IsSensitiveHeader(name) {
+			redacted[name] = append([]string(nil), values...)
+			continue
+		}
+		redacted[name] = make([]string, len(values))
+		for i := range values {
+			redacted[name][i] = redactedText
+		}
+	}
+	return redacted
+}
+
+// Redactor removes the secrets used to connect to the Server, i.e. the values of
+// the sensitive headers and the credentials in the Server URL, from log messages
+// and error strings. Safe for concurrent use. A nil Redactor redacts nothing.
+type Redactor struct {
+	mux     sync.RWMutex
+	secrets []string
+	// The secrets of the header returned by the last HeaderProvider call.
+	provided []string
+}
+
+// NewRedactor creates a Redactor that does not know any secrets yet.
+func NewRedactor() *Redactor {
+	return &Redactor{}
+}
+
+// SetSecrets replaces the known secrets by the ones found in the header and in the
+// serverURL.
+func (r *Redactor) SetSecrets(header http.Header, serverURL string) {
+	if r == nil {
+		return
+	}
+	secrets := headerSecrets(header)
+	secrets = append(secrets, urlSecrets(serverURL)...)
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.secrets = nil
+	r.addSecrets(secrets)
+}
+
+// AddHeader adds the secrets found in the header to the known secrets, e.g. when
+// the Server offers new headers to connect with.
+func (r *Redactor) AddHeader(header http.Header) {
+	if r == nil {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.addSecrets(headerSecrets(header))
+}
+
+// AddURL adds the secrets found in the URL to the known secrets, e.g. the password
+// of the proxy.
+func (r *Redactor) AddURL(rawURL string) {
+	if r == nil {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.addSecrets(urlSecrets(rawURL))
+}
+
+// SetProvidedHeader replaces the secrets found in the header returned by the previous
+// HeaderProvider call by the secrets found in the header, so that the short-lived
+// tokens don't accumulate.
+func (r *Redactor) SetProvidedHeader(header http.Header) {
+	if r == nil {
+		return
+	}
+	var provided []string
+	for _, secret := range headerSecrets(header) {
+		if len(secret) >= minSecretLength {
+			provided = append(provided, secret)
+		}
+	}
+	sort.SliceStable(provided, func(i, j int) bool {
+		return len(provided[i]) > len(provided[j])
+	})
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.provided = provided
+}
+
+func (r *Redactor) addSecrets(secrets []string) {
+	for _, secret := range secrets {
+		if len(secret) < minSecretLength {
+			continue
+		}
+		known := false
+		for _, s := range r.secrets {
+			if s == secret {
+				known = true
+				break
+			}
+		}
+		if !known {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+	// Replace the longest secrets first, so that a secret that contains another
+	// one is removed completely.
+	sort.SliceStable(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+func headerSecrets(header http.Header) []string {
+	var secrets []string
+	for name, values := range header {
+		if !internal.IsSensitiveHeader(name) {
+			continue
+		}
+		for _, value := range values {
+			secrets = append(secrets, value)
+			// The credentials of "<scheme> <credentials>" values may appear alone.
+			if i := strings.IndexByte(value, ' '); i >= 0 {
+				secrets = append(secrets, strings.TrimSpace(value[i+1:]))
+			}
+		}
+	}
+	return secrets
+}
+
+func urlSecrets(rawURL string) []string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// The URL may still be quoted in the parsing error, redact its credentials.
+		return rawURLSecrets(rawURL)
+	}
+	var secrets []string
+	if password, ok := u.User.Password(); ok {
+		secrets = append(secrets, password, url.QueryEscape(password))
+	}
+	for name, values := range u.Query() {
+		if internal.IsSensitiveName(name) {
+			secrets = append(secrets, values...)
+		}
+	}
+	return secrets
+}
+
+// rawURLSecrets returns the password of a URL that cannot be parsed.
+func rawURLSecrets(rawURL string) []string {
+	rest := rawURL
+	if i := strings.Index(rest, "://"); i >= 0 {
+		rest = rest[i+3:]
+	}
+	at := strings.LastIndexByte(rest, '@')
+	if at < 0 {
+		return nil
+	}
+	userinfo := rest[:at]
+	if i := strings.IndexByte(userinfo, ':'); i >= 0 {
+		return []string{userinfo[i+1:]}
+	}
+	return nil
+}
+
+// Redact returns s with all known secrets replaced.
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redactedText)
+	}
+	for _, secret := range r.provided {
+		s = strings.ReplaceAll(s, secret, redactedText)
+	}
+	return s
+}
+
+// RedactError returns an error with the message of err with all known secrets
+// replaced. The returned error wraps err. Returns err itself if its message
+// contains no secrets.
+func (r *Redactor) RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	redacted := r.Redact(msg)
+	if redacted == msg {
+		return err
+	}
+	return &redactedError{msg: redacted, err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Logger returns a Logger that removes the known secrets from the messages before
+// passing them to the logger.
+func (r *Redactor) Logger(logger types.Logger) types.Logger {
+	return &redactingLogger{logger: logger, redactor: r}
+}
+
+type redactingLogger struct {
+	logger   types.Logger
+	redactor *Redactor
+}
+
+func (l *redactingLogger) Debugf(format string, v ...interface{}) {
+	l.logger.Debugf("%s", l.redactor.Redact(fmt.Sprintf(format, v...)))
+}
+
+func (l *redactingLogger) Errorf(format string, v ...interface{}) {
+	l.logger.Errorf("%s", l.redactor.Redact(fmt.Sprintf(format, v...)))
+}
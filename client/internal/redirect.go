@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/internal"
+)
+
+// The maximum number of redirects followed in a row, as by net/http.
+const maxRedirects = 10
+
+// isPermanentRedirect returns true if the status code is a permanent redirect.
+func isPermanentRedirect(statusCode int) bool {
+	return statusCode == http.StatusMovedPermanently || statusCode == http.StatusPermanentRedirect
+}
+
+// redirectPolicy returns the policy, or the default one if it is nil.
+func redirectPolicy(policy types.RedirectPolicy) types.RedirectPolicy {
+	if policy == nil {
+		return types.SameOriginRedirects
+	}
+	return policy
+}
+
+// CheckRedirect returns the http.Client.CheckRedirect func that follows the redirects
+// allowed by the policy, see types.RedirectPolicy.
+func CheckRedirect(policy types.RedirectPolicy, logger types.Logger) func(req *http.Request, via []*http.Request) error {
+	policy = redirectPolicy(policy)
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		from := via[len(via)-1].URL
+		if err := policy(from, req.URL); err != nil {
+			return err
+		}
+		logger.Debugf("Following the redirect from %s to %s.", internal.RedactURL(from.String()), internal.RedactURL(req.URL.String()))
+		return nil
+	}
+}
+
+// PermanentlyRedirectedURL returns the URL the response was received from if the
+// request was redirected to it by permanent redirects only.
+func PermanentlyRedirectedURL(resp *http.Response) (*url.URL, bool) {
+	if resp.Request == nil || resp.Request.Response == nil {
+		// Not redirected.
+		return nil, false
+	}
+	for req := resp.Request; req.Response != nil; req = req.Response.Request {
+		if !isPermanentRedirect(req.Response.StatusCode) {
+			return nil, false
+		}
+	}
+	return resp.Request.URL, true
+}
+
+// WSRedirector follows the redirects of the WebSocket handshakes allowed by the
+// policy. The WebSocket dialer does not follow redirects.
+type WSRedirector struct {
+	policy types.RedirectPolicy
+	logger types.Logger
+
+	// The number of the redirects followed and whether all of them are permanent.
+	redirects int
+	permanent bool
+}
+
+// NewWSRedirector creates a new WSRedirector that follows the redirects allowed by
+// the policy, see types.RedirectPolicy.
+func NewWSRedirector(policy types.RedirectPolicy, logger types.Logger) *WSRedirector {
+	return &WSRedirector{policy: redirectPolicy(policy), logger: logger, permanent: true}
+}
+
+// Next returns the URL to connect to after the handshake with serverURL failed with
+// the response resp, or false if resp is not a redirect. Returns an error if the
+// redirect is not allowed.
+func (r *WSRedirector) Next(serverURL *url.URL, resp *http.Response) (*url.URL, bool, error) {
+	if resp == nil || resp.StatusCode < 300 || resp.StatusCode > 399 {
+		return nil, false, nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		// A 3xx response without a Location, e.g. 304 Not Modified, is no redirect.
+		return nil, false, nil
+	}
+	// The handshake request uses the http scheme, the redirect is resolved against it.
+	switch location.Scheme {
+	case "http":
+		location.Scheme = "ws"
+	case "https":
+		location.Scheme = "wss"
+	}
+
+	if r.redirects >= maxRedirects {
+		return nil, false, fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if err := r.policy(serverURL, location); err != nil {
+		return nil, false, err
+	}
+	r.redirects++
+	r.permanent = r.permanent && isPermanentRedirect(resp.StatusCode)
+	r.logger.Debugf("Following the redirect from %s to %s.", internal.RedactURL(serverURL.String()), internal.RedactURL(location.String()))
+	return location, true, nil
+}
+
+// Permanent returns true if redirects were followed and all of them are permanent.
+func (r *WSRedirector) Permanent() bool {
+	return r.redirects > 0 && r.permanent
+}
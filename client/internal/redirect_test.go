@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+func redirectResponse(statusCode int, from *url.URL, location string) *http.Response {
+	// The WebSocket handshake is an http request.
+	reqURL := *from
+	reqURL.Scheme = "http"
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{"Location": []string{location}},
+		Request:    &http.Request{URL: &reqURL},
+	}
+}
+
+func TestWSRedirector(t *testing.T) {
+	from, err := url.Parse("ws://opamp.example.com/v1/opamp")
+	require.NoError(t, err)
+
+	r := NewWSRedirector(types.FollowRedirects, TestLogger{t})
+	assert.False(t, r.Permanent())
+
+	// Not a redirect.
+	_, redirected, err := r.Next(from, &http.Response{StatusCode: http.StatusUnauthorized})
+	assert.NoError(t, err)
+	assert.False(t, redirected)
+
+	// The relative location is resolved and keeps the ws scheme.
+	to, redirected, err := r.Next(from, redirectResponse(http.StatusPermanentRedirect, from, "/v2/opamp"))
+	require.NoError(t, err)
+	assert.True(t, redirected)
+	assert.Equal(t, "ws://opamp.example.com/v2/opamp", to.String())
+	assert.True(t, r.Permanent())
+
+	// A temporary redirect to https is followed with wss.
+	to, redirected, err = r.Next(to, redirectResponse(http.StatusTemporaryRedirect, to, "https://other.example.com/v1/opamp"))
+	require.NoError(t, err)
+	assert.True(t, redirected)
+	assert.Equal(t, "wss://other.example.com/v1/opamp", to.String())
+	assert.False(t, r.Permanent())
+
+	for i := 2; i < maxRedirects; i++ {
+		_, _, err = r.Next(from, redirectResponse(http.StatusFound, from, "/v1/opamp"))
+		require.NoError(t, err)
+	}
+	_, _, err = r.Next(from, redirectResponse(http.StatusFound, from, "/v1/opamp"))
+	assert.EqualError(t, err, "stopped after 10 redirects")
+}
+
+func TestWSRedirectorDefaultPolicy(t *testing.T) {
+	from, err := url.Parse("ws://opamp.example.com/v1/opamp")
+	require.NoError(t, err)
+
+	r := NewWSRedirector(nil, TestLogger{t})
+	_, _, err = r.Next(from, redirectResponse(http.StatusMovedPermanently, from, "/v2/opamp"))
+	assert.NoError(t, err)
+	_, _, err = r.Next(from, redirectResponse(http.StatusMovedPermanently, from, "http://opamp.example.com:8080/v1/opamp"))
+	assert.EqualError(t, err, "redirect to another origin ws://opamp.example.com:8080 is not allowed")
+}
+
+func TestPermanentlyRedirectedURL(t *testing.T) {
+	original := &http.Request{URL: &url.URL{Scheme: "http", Host: "a", Path: "/v1/opamp"}}
+	moved := &http.Request{
+		URL:      &url.URL{Scheme: "http", Host: "b", Path: "/v1/opamp"},
+		Response: &http.Response{StatusCode: http.StatusPermanentRedirect, Request: original},
+	}
+
+	_, ok := PermanentlyRedirectedURL(&http.Response{Request: original})
+	assert.False(t, ok)
+
+	redirected, ok := PermanentlyRedirectedURL(&http.Response{Request: moved})
+	assert.True(t, ok)
+	assert.Equal(t, "http://b/v1/opamp", redirected.String())
+
+	// A temporary redirect in the chain.
+	moved.Response.StatusCode = http.StatusTemporaryRedirect
+	_, ok = PermanentlyRedirectedURL(&http.Response{Request: moved})
+	assert.False(t, ok)
+}
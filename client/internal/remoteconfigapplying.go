@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// remoteConfigApplyingCallbacks reports the APPLYING status of a new RemoteConfig
+// before passing it to the wrapped Callbacks, see
+// StartSettings.ReportRemoteConfigApplying.
+type remoteConfigApplyingCallbacks struct {
+	types.Callbacks
+	client *ClientCommon
+}
+
+func (c remoteConfigApplyingCallbacks) OnMessage(ctx context.Context, msg *types.MessageData) {
+	if config := msg.RemoteConfig; config != nil && config.ConfigHash != nil && c.isNew(config) {
+		err := c.client.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: config.ConfigHash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING,
+		})
+		if err != nil {
+			c.client.Logger.Errorf("Cannot report the remote config as applying: %v", err)
+		}
+	}
+	c.Callbacks.OnMessage(ctx, msg)
+}
+
+// isNew returns false if the config is being applied or was applied already, i.e.
+// the Server sent it again.
+func (c remoteConfigApplyingCallbacks) isNew(config *protobufs.AgentRemoteConfig) bool {
+	status := c.client.ClientSyncedState.RemoteConfigStatus()
+	return status == nil || !bytes.Equal(status.LastRemoteConfigHash, config.ConfigHash) ||
+		(status.Status != protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING &&
+			status.Status != protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED)
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"crypto/ed25519"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// ResponseVerifier rejects the messages received from the Server that are not
+// signed with the key of the Server, see StartSettings.ResponseVerificationKey.
+type ResponseVerifier struct {
+	key     ed25519.PublicKey
+	logger  types.Logger
+	metrics types.MetricsRecorder
+}
+
+// NewResponseVerifier returns the ResponseVerifier for the settings, nil if the
+// ResponseVerificationKey is not set.
+func NewResponseVerifier(settings types.StartSettings, logger types.Logger) *ResponseVerifier {
+	if settings.ResponseVerificationKey == nil {
+		return nil
+	}
+	return &ResponseVerifier{key: settings.ResponseVerificationKey, logger: logger, metrics: settings.Metrics}
+}
+
+// accept returns true if msg has no field that must be signed or its signature
+// is valid. Otherwise the message is logged and counted.
+func (v *ResponseVerifier) accept(msg *protobufs.ServerToAgent) bool {
+	err := sharedinternal.VerifyServerToAgent(msg, v.key)
+	if err == nil {
+		return true
+	}
+	v.logger.Errorf("Rejecting the message from the Server: %v", err)
+	if v.metrics != nil {
+		v.metrics.IncrementCounter(types.MetricUnverifiedResponses)
+	}
+	return false
+}
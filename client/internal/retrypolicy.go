@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/cenkalti/backoff/v4"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// ValidateRetryPolicy returns an error if the fields of the policy are out of range.
+func ValidateRetryPolicy(policy types.RetryPolicy) error {
+	switch {
+	case policy.InitialInterval < 0 || policy.MaxInterval < 0 || policy.MaxElapsedTime < 0:
+		return fmt.Errorf("invalid RetryPolicy: negative durations are not allowed")
+	case policy.Multiplier != 0 && policy.Multiplier < 1:
+		return fmt.Errorf("invalid RetryPolicy: Multiplier %v is less than 1", policy.Multiplier)
+	case policy.RandomizationFactor > 1:
+		return fmt.Errorf("invalid RetryPolicy: RandomizationFactor %v is greater than 1", policy.RandomizationFactor)
+	}
+	return nil
+}
+
+// NewBackOff returns the backoff implementing the policy. The zero fields of the
+// policy use the values of types.DefaultRetryPolicy.
+func NewBackOff(policy types.RetryPolicy) *backoff.ExponentialBackOff {
+	defaults := types.DefaultRetryPolicy
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = policy.InitialInterval
+	if b.InitialInterval == 0 {
+		b.InitialInterval = defaults.InitialInterval
+	}
+	b.MaxInterval = policy.MaxInterval
+	if b.MaxInterval == 0 {
+		b.MaxInterval = defaults.MaxInterval
+	}
+	b.Multiplier = policy.Multiplier
+	if b.Multiplier == 0 {
+		b.Multiplier = defaults.Multiplier
+	}
+	switch {
+	case policy.RandomizationFactor == 0:
+		b.RandomizationFactor = defaults.RandomizationFactor
+	case policy.RandomizationFactor < 0:
+		b.RandomizationFactor = 0
+	default:
+		b.RandomizationFactor = policy.RandomizationFactor
+	}
+	b.MaxElapsedTime = policy.MaxElapsedTime
+	b.Reset()
+	return b
+}
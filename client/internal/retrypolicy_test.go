@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+func TestValidateRetryPolicy(t *testing.T) {
+	assert.NoError(t, ValidateRetryPolicy(types.RetryPolicy{}))
+	assert.NoError(t, ValidateRetryPolicy(types.DefaultRetryPolicy))
+	assert.NoError(t, ValidateRetryPolicy(types.RetryPolicy{RandomizationFactor: -1}))
+	assert.Error(t, ValidateRetryPolicy(types.RetryPolicy{InitialInterval: -time.Second}))
+	assert.Error(t, ValidateRetryPolicy(types.RetryPolicy{Multiplier: 0.5}))
+	assert.Error(t, ValidateRetryPolicy(types.RetryPolicy{RandomizationFactor: 1.5}))
+}
+
+func TestNewBackOff(t *testing.T) {
+	// The zero policy uses the defaults.
+	b := NewBackOff(types.RetryPolicy{})
+	assert.Equal(t, types.DefaultRetryPolicy.InitialInterval, b.InitialInterval)
+	assert.Equal(t, types.DefaultRetryPolicy.MaxInterval, b.MaxInterval)
+	assert.Equal(t, types.DefaultRetryPolicy.Multiplier, b.Multiplier)
+	assert.Equal(t, types.DefaultRetryPolicy.RandomizationFactor, b.RandomizationFactor)
+	assert.EqualValues(t, 0, b.MaxElapsedTime)
+
+	// Without jitter the intervals grow exactly by the multiplier up to the maximum.
+	b = NewBackOff(types.RetryPolicy{
+		InitialInterval:     100 * time.Millisecond,
+		MaxInterval:         350 * time.Millisecond,
+		Multiplier:          2,
+		RandomizationFactor: -1,
+	})
+	var intervals []time.Duration
+	for i := 0; i < 4; i++ {
+		intervals = append(intervals, b.NextBackOff())
+	}
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 350 * time.Millisecond, 350 * time.Millisecond,
+	}, intervals)
+
+	// The jitter randomizes the intervals around the computed value.
+	b = NewBackOff(types.RetryPolicy{InitialInterval: time.Second, RandomizationFactor: 0.2})
+	for i := 0; i < 10; i++ {
+		b.Reset()
+		interval := b.NextBackOff()
+		assert.GreaterOrEqual(t, interval, 800*time.Millisecond)
+		assert.LessOrEqual(t, interval, 1200*time.Millisecond)
+	}
+
+	// The backoff stops after MaxElapsedTime.
+	b = NewBackOff(types.RetryPolicy{InitialInterval: time.Millisecond, MaxElapsedTime: 10 * time.Millisecond})
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, backoff.Stop, b.NextBackOff())
+}
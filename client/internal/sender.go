@@ -1,9 +1,16 @@
 package internal
 
 import (
+	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/oklog/ulid/v2"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
@@ -22,25 +29,80 @@ type Sender interface {
 
 	// SetInstanceUid sets a new instanceUid to be used for all subsequent messages to be sent.
 	SetInstanceUid(instanceUid string) error
+
+	// Throttle delays sending of the next message until the duration elapses, e.g.
+	// because the Server reported that it is unavailable.
+	Throttle(duration time.Duration)
+
+	// SetMetrics sets the recorder of the sizes of the sent messages. Must be
+	// called before the sender is started.
+	SetMetrics(metrics types.MetricsRecorder)
+
+	// SetOutbox sets the Outbox that journals the undelivered state of the messages,
+	// nil disables the journaling. Returns the message journaled by the previous
+	// run, nil if none. Must be called before the sender is started.
+	SetOutbox(outbox types.Outbox, logger types.Logger) *protobufs.AgentToServer
+
+	// SetMemoryBudget sets the budget the pending message is accounted in, nil
+	// disables the accounting. Must be called before the sender is started.
+	SetMemoryBudget(budget *MemoryBudget)
+
+	// SetCoalescingWindow sets the time to wait after a message is scheduled before
+	// it is sent, so that the updates made meanwhile are sent with it. 0 disables
+	// the waiting. Must be called before the sender is started.
+	SetCoalescingWindow(window time.Duration)
+
+	// JournalPending journals the state of the pending message in the Outbox, if
+	// set, e.g. after a status is updated. Can be called concurrently with any
+	// other method.
+	JournalPending()
+
+	// CompressionStats returns the sizes of the messages sent so far before and
+	// after the compression. Can be called concurrently with any other method.
+	CompressionStats() types.CompressionStats
+
+	// Flush schedules the pending message to be sent and blocks until there is no
+	// pending message left or ctx is done. Can be called concurrently with any
+	// other method.
+	Flush(ctx context.Context) error
 }
 
-// SenderCommon is partial Sender implementation that is common between WebSocket and plain
-// HTTP transports. This struct is intended to be embedded in the WebSocket and
-// HTTP Sender implementations.
+// SenderCommon is partial Sender implementation that is common between the
+// transports. This struct is intended to be embedded in the WebSocket, HTTP, gRPC
+// and in-memory Sender implementations.
 type SenderCommon struct {
+	// The time in Unix nanoseconds until which no message is sent. Accessed
+	// atomically, kept first for 64-bit alignment.
+	throttledUntil int64
+
 	// Indicates that there is a pending message to send.
 	hasPendingMessage chan struct{}
 
 	// The next message to send.
 	nextMessage NextMessage
+
+	// The sizes of the sent messages. A pointer to keep its counters 64-bit aligned.
+	compression *compressionMeter
+
+	// Journals the undelivered state of the messages, nil if there is no Outbox.
+	outbox *outboxJournal
+
+	// The time to wait after a message is scheduled before sending it.
+	coalescingWindow time.Duration
+
+	// Closed and reset when a popped message is delivered or dropped, to wake up
+	// the Flush calls. nil if no Flush call is waiting.
+	flushMutex  sync.Mutex
+	flushSignal chan struct{}
 }
 
 // NewSenderCommon creates a new SenderCommon. This is intended to be used by
-// the WebSocket and HTTP Sender implementations.
+// the Sender implementations.
 func NewSenderCommon() SenderCommon {
 	return SenderCommon{
 		hasPendingMessage: make(chan struct{}, 1),
 		nextMessage:       NewNextMessage(),
+		compression:       &compressionMeter{},
 	}
 }
 
@@ -66,11 +128,7 @@ func (h *SenderCommon) NextMessage() *NextMessage {
 // Can be called concurrently, normally is called when a message is received from the
 // Server that instructs us to change our instance UID.
 func (h *SenderCommon) SetInstanceUid(instanceUid string) error {
-	if instanceUid == "" {
-		return errors.New("cannot set instance uid to empty value")
-	}
-
-	if _, err := ulid.ParseStrict(instanceUid); err != nil {
+	if err := ValidateInstanceUid(instanceUid); err != nil {
 		return err
 	}
 
@@ -81,3 +139,209 @@ func (h *SenderCommon) SetInstanceUid(instanceUid string) error {
 
 	return nil
 }
+
+// ValidateInstanceUid returns an error if the instanceUid is empty or not a ULID.
+func ValidateInstanceUid(instanceUid string) error {
+	if instanceUid == "" {
+		return errors.New("cannot set instance uid to empty value")
+	}
+	_, err := ulid.ParseStrict(instanceUid)
+	return err
+}
+
+// Throttle delays sending of the next message until the duration elapses. Can be
+// called concurrently with any other method.
+func (h *SenderCommon) Throttle(duration time.Duration) {
+	atomic.StoreInt64(&h.throttledUntil, time.Now().Add(duration).UnixNano())
+}
+
+// SetMetrics sets the recorder of the sizes of the sent messages. Must be called
+// before the sender is started.
+func (h *SenderCommon) SetMetrics(metrics types.MetricsRecorder) {
+	h.compression.setMetrics(metrics)
+}
+
+// SetOutbox sets the Outbox that journals the undelivered state of the messages and
+// returns the message journaled by the previous run. Must be called before the
+// sender is started.
+func (h *SenderCommon) SetOutbox(outbox types.Outbox, logger types.Logger) *protobufs.AgentToServer {
+	if outbox == nil {
+		h.outbox = nil
+		return nil
+	}
+	h.outbox = &outboxJournal{outbox: outbox, logger: logger}
+	return h.outbox.load()
+}
+
+// SetMemoryBudget sets the budget the pending message is accounted in. Must be
+// called before the sender is started.
+func (h *SenderCommon) SetMemoryBudget(budget *MemoryBudget) {
+	h.nextMessage.SetMemoryBudget(budget)
+}
+
+// SetCoalescingWindow sets the time to wait after a message is scheduled before it
+// is sent. Must be called before the sender is started.
+func (h *SenderCommon) SetCoalescingWindow(window time.Duration) {
+	h.coalescingWindow = window
+}
+
+// JournalPending journals the state of the pending message if the Outbox is set.
+// Can be called concurrently with any other method.
+func (h *SenderCommon) JournalPending() {
+	h.outbox.save(&h.nextMessage)
+}
+
+// CompressionStats returns the sizes of the messages sent so far before and after
+// the compression. Can be called concurrently with any other method.
+func (h *SenderCommon) CompressionStats() types.CompressionStats {
+	return h.compression.stats()
+}
+
+// Flush schedules the pending message to be sent and blocks until there is no
+// pending message left or ctx is done. A message that is being sent when Flush is
+// called is not waited for, unless it fails and becomes pending again.
+func (h *SenderCommon) Flush(ctx context.Context) error {
+	for {
+		h.flushMutex.Lock()
+		if h.flushSignal == nil {
+			h.flushSignal = make(chan struct{})
+		}
+		signal := h.flushSignal
+		h.flushMutex.Unlock()
+
+		// Checked after taking the signal, so that a delivery in between is not missed.
+		if h.nextMessage.Pending() == nil {
+			return nil
+		}
+		h.ScheduleSend()
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// wakeFlush wakes up the Flush calls after a popped message is delivered or
+// dropped.
+func (h *SenderCommon) wakeFlush() {
+	h.flushMutex.Lock()
+	defer h.flushMutex.Unlock()
+	if h.flushSignal != nil {
+		close(h.flushSignal)
+		h.flushSignal = nil
+	}
+}
+
+// delivered records that the popped message was delivered to the Server.
+func (h *SenderCommon) delivered() {
+	h.outbox.delivered(&h.nextMessage)
+	h.wakeFlush()
+}
+
+// waitThrottled blocks while sending is throttled. Returns false if ctx is done
+// before the throttling ends.
+func (h *SenderCommon) waitThrottled(ctx context.Context) bool {
+	delay := time.Until(time.Unix(0, atomic.LoadInt64(&h.throttledUntil)))
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// waitToSend blocks after a message is scheduled until it may be sent: for the
+// coalescing window, so that the updates made meanwhile are sent with it, and while
+// sending is throttled. Returns false if ctx is done before.
+func (h *SenderCommon) waitToSend(ctx context.Context) bool {
+	if h.coalescingWindow > 0 {
+		timer := time.NewTimer(h.coalescingWindow)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+	return h.waitThrottled(ctx)
+}
+
+// sendPending passes the pending message to send, unless there is none or it has no
+// fields populated. If send fails the message is restored, so that its statuses are
+// sent with the next message.
+func (h *SenderCommon) sendPending(send func(msg *protobufs.AgentToServer) error) error {
+	msgToSend := h.nextMessage.PopPending()
+	if msgToSend == nil || proto.Equal(msgToSend, &protobufs.AgentToServer{}) {
+		h.wakeFlush()
+		return nil
+	}
+	if err := send(msgToSend); err != nil {
+		h.restoreUnsent(msgToSend)
+		return err
+	}
+	h.delivered()
+	return nil
+}
+
+// restoreUnsent restores the message that could not be sent, see
+// NextMessage.RestoreUnsent, and journals its state.
+func (h *SenderCommon) restoreUnsent(unsent *protobufs.AgentToServer) {
+	h.nextMessage.RestoreUnsent(unsent)
+	h.outbox.save(&h.nextMessage)
+}
+
+// runStreamLoop sends the pending messages with send until ctx is done. It is the
+// sending loop of the transports that keep a connection open, i.e. WebSocket and
+// gRPC. A heartbeat message, which carries only the instance uid, the sequence
+// number and the capabilities, is sent if no other message was sent for the
+// heartbeatInterval. The heartbeats are disabled if heartbeatInterval is 0.
+func (h *SenderCommon) runStreamLoop(
+	ctx context.Context, heartbeatInterval time.Duration, send func(msg *protobufs.AgentToServer) error,
+) {
+	var heartbeat *time.Timer
+	var heartbeatC <-chan time.Time
+	if heartbeatInterval > 0 {
+		heartbeat = time.NewTimer(heartbeatInterval)
+		defer heartbeat.Stop()
+		heartbeatC = heartbeat.C
+	}
+
+	for {
+		select {
+		case <-h.hasPendingMessage:
+			if !h.waitToSend(ctx) {
+				return
+			}
+			_ = h.sendPending(send)
+
+		case <-heartbeatC:
+			// Nothing was sent for the interval. Mark the next message pending, it
+			// carries at least the instance uid, sequence number and capabilities.
+			h.nextMessage.Update(func(msg *protobufs.AgentToServer) {})
+			if !h.waitThrottled(ctx) {
+				return
+			}
+			_ = h.sendPending(send)
+
+		case <-ctx.Done():
+			return
+		}
+
+		if heartbeat != nil {
+			// Any sent message resets the heartbeat interval.
+			if !heartbeat.Stop() {
+				select {
+				case <-heartbeat.C:
+				default:
+				}
+			}
+			heartbeat.Reset(heartbeatInterval)
+		}
+	}
+}
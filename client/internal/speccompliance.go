@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// SpecCompliance rejects the messages received from the Server that violate the
+// OpAMP specification, see StartSettings.StrictSpecCompliance.
+type SpecCompliance struct {
+	logger  types.Logger
+	metrics types.MetricsRecorder
+}
+
+// NewSpecCompliance returns the SpecCompliance for the settings, nil if the
+// StrictSpecCompliance is not set.
+func NewSpecCompliance(settings types.StartSettings, logger types.Logger) *SpecCompliance {
+	if !settings.StrictSpecCompliance {
+		return nil
+	}
+	return &SpecCompliance{logger: logger, metrics: settings.Metrics}
+}
+
+// accept returns true if msg does not violate the specification. Otherwise the
+// violations are logged, counted and reported to the callbacks. instanceUid is the
+// instance uid of the Agent, first is true if msg is the first message received
+// from the Server.
+func (s *SpecCompliance) accept(
+	callbacks types.Callbacks, msg *protobufs.ServerToAgent, instanceUid string, first bool,
+) bool {
+	violations := sharedinternal.ServerToAgentViolations(msg, instanceUid, first)
+	if len(violations) == 0 {
+		return true
+	}
+	s.logger.Errorf("Rejecting the message from the Server, it violates the OpAMP specification: %s",
+		strings.Join(violations, "; "))
+	if s.metrics != nil {
+		s.metrics.IncrementCounter(types.MetricSpecViolations)
+	}
+	if callbacks != nil {
+		callbacks.OnSpecViolation(types.SpecViolation{Message: msg, Violations: violations})
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+var ErrOpAMPServerURLMissing = errors.New("OpAMPServerURL must be set")
+
+// capabilityCallbacks lists for the capabilities the CallbacksStruct funcs that must
+// be set to act on the corresponding messages from the Server.
+var capabilityCallbacks = []struct {
+	capability protobufs.AgentCapabilities
+	callback   string
+	isSet      func(c *types.CallbacksStruct) bool
+}{
+	{
+		protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig,
+		"OnMessageFunc",
+		func(c *types.CallbacksStruct) bool { return c.OnMessageFunc != nil },
+	},
+	{
+		protobufs.AgentCapabilities_AgentCapabilities_AcceptsPackages,
+		"OnMessageFunc",
+		func(c *types.CallbacksStruct) bool { return c.OnMessageFunc != nil },
+	},
+	{
+		protobufs.AgentCapabilities_AgentCapabilities_AcceptsOtherConnectionSettings,
+		"OnMessageFunc",
+		func(c *types.CallbacksStruct) bool { return c.OnMessageFunc != nil },
+	},
+	{
+		protobufs.AgentCapabilities_AgentCapabilities_ReportsEffectiveConfig,
+		"GetEffectiveConfigFunc",
+		func(c *types.CallbacksStruct) bool { return c.GetEffectiveConfigFunc != nil },
+	},
+	{
+		protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings,
+		"OnOpampConnectionSettingsFunc",
+		func(c *types.CallbacksStruct) bool { return c.OnOpampConnectionSettingsFunc != nil },
+	},
+	{
+		protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand,
+		"OnCommandFunc",
+		func(c *types.CallbacksStruct) bool { return c.OnCommandFunc != nil },
+	},
+}
+
+// ValidateStartSettings checks that the settings are consistent, so that Start()
+// fails instead of the client misbehaving at runtime. The callbacks can only be
+// checked if they are a CallbacksStruct, other Callbacks implement all methods.
+func ValidateStartSettings(settings types.StartSettings) error {
+	if settings.OpAMPServerURL == "" {
+		if settings.ServerURLResolver == nil {
+			return ErrOpAMPServerURLMissing
+		}
+	} else if err := validateServerURL(settings); err != nil {
+		return err
+	}
+
+	for _, d := range []struct {
+		name     string
+		negative bool
+	}{
+		{"OpAMPEndpointGracePeriod", settings.OpAMPEndpointGracePeriod < 0},
+		{"WatchdogInterval", settings.WatchdogInterval < 0},
+		{"WatchdogMaxMissedIntervals", settings.WatchdogMaxMissedIntervals < 0},
+		{"HeartbeatInterval", settings.HeartbeatInterval < 0},
+		{"CoalescingWindow", settings.CoalescingWindow < 0},
+		{"CallbackTimeout", settings.CallbackTimeout < 0},
+		{"RemoteConfigTimeout", settings.RemoteConfigTimeout < 0},
+		{"PackagesAvailableTimeout", settings.PackagesAvailableTimeout < 0},
+		{"EffectiveConfigTimeout", settings.EffectiveConfigTimeout < 0},
+		{"MaxPatchedFileSize", settings.MaxPatchedFileSize < 0},
+		{"MemoryLimit", settings.MemoryLimit < 0},
+	} {
+		if d.negative {
+			return fmt.Errorf("%s must not be negative", d.name)
+		}
+	}
+
+	if settings.ProxyURL != "" {
+		if settings.Proxy != nil {
+			return errors.New("ProxyURL and Proxy must not be both set")
+		}
+		if _, err := parseProxyURL(settings.ProxyURL); err != nil {
+			return err
+		}
+	}
+
+	if len(settings.Downloaders) > 0 && settings.PackagesStateProvider == nil {
+		return errors.New("Downloaders are set but PackagesStateProvider is not set, packages cannot be downloaded")
+	}
+
+	if settings.ReportRemoteConfigApplying &&
+		settings.Capabilities&protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig == 0 {
+		return errors.New("ReportRemoteConfigApplying is set but the ReportsRemoteConfig capability is not set")
+	}
+
+	if settings.ResponseVerificationKey != nil && len(settings.ResponseVerificationKey) != ed25519.PublicKeySize {
+		return errors.New("ResponseVerificationKey is not a valid Ed25519 public key")
+	}
+
+	var callbacks *types.CallbacksStruct
+	switch c := settings.Callbacks.(type) {
+	case types.CallbacksStruct:
+		callbacks = &c
+	case *types.CallbacksStruct:
+		callbacks = c
+	}
+	if callbacks == nil {
+		return nil
+	}
+	for _, cc := range capabilityCallbacks {
+		if settings.Capabilities&cc.capability != 0 && !cc.isSet(callbacks) {
+			return fmt.Errorf(
+				"%s capability is set but Callbacks.%s is not set to handle it",
+				capabilityName(cc.capability), cc.callback,
+			)
+		}
+	}
+	return nil
+}
+
+// validateServerURL validates the OpAMPServerURL and the settings that depend on it.
+func validateServerURL(settings types.StartSettings) error {
+	serverURL, err := url.Parse(settings.OpAMPServerURL)
+	if err != nil {
+		if settings.TLSConfig != nil {
+			return fmt.Errorf("invalid OpAMPServerURL: %w", withoutURL(err))
+		}
+		// The clients report the invalid URL when they connect.
+		serverURL = &url.URL{}
+	}
+	if settings.TLSConfig != nil {
+		switch serverURL.Scheme {
+		case "ws", "http", "grpc":
+			return fmt.Errorf(
+				"TLSConfig is set but OpAMPServerURL uses the plain %s scheme, use %ss instead",
+				serverURL.Scheme, serverURL.Scheme,
+			)
+		}
+	}
+	if serverURL.Scheme == UnixSocketScheme {
+		return validateUnixSocketSettings(settings, serverURL)
+	}
+	return nil
+}
+
+// capabilityName returns the name of the capability without the enum prefix, e.g.
+// "AcceptsRemoteConfig".
+func capabilityName(capability protobufs.AgentCapabilities) string {
+	return strings.TrimPrefix(capability.String(), "AgentCapabilities_")
+}
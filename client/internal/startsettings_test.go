@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestValidateStartSettings(t *testing.T) {
+	const url = "ws://localhost:4320/v1/opamp"
+	onMessage := func(ctx context.Context, msg *types.MessageData) {}
+
+	tests := []struct {
+		name     string
+		settings types.StartSettings
+		err      string
+	}{
+		{
+			name:     "minimal",
+			settings: types.StartSettings{OpAMPServerURL: url},
+		},
+		{
+			name:     "no url",
+			settings: types.StartSettings{},
+			err:      "OpAMPServerURL must be set",
+		},
+		{
+			name: "resolver without url",
+			settings: types.StartSettings{
+				ServerURLResolver: func(context.Context) (string, error) { return url, nil },
+			},
+		},
+		{
+			name:     "tls with plain scheme",
+			settings: types.StartSettings{OpAMPServerURL: url, TLSConfig: &tls.Config{}},
+			err:      "TLSConfig is set but OpAMPServerURL uses the plain ws scheme, use wss instead",
+		},
+		{
+			name:     "tls with secure scheme",
+			settings: types.StartSettings{OpAMPServerURL: "https://localhost:4320/v1/opamp", TLSConfig: &tls.Config{}},
+		},
+		{
+			name:     "tls with plain grpc scheme",
+			settings: types.StartSettings{OpAMPServerURL: "grpc://localhost:4320", TLSConfig: &tls.Config{}},
+			err:      "TLSConfig is set but OpAMPServerURL uses the plain grpc scheme, use grpcs instead",
+		},
+		{
+			name:     "unix socket",
+			settings: types.StartSettings{OpAMPServerURL: "opamp+unix:///var/run/opamp.sock", TLSConfig: &tls.Config{}},
+		},
+		{
+			name:     "unix socket relative path",
+			settings: types.StartSettings{OpAMPServerURL: "opamp+unix://opamp.sock"},
+			err:      "the socket path of a opamp+unix OpAMPServerURL must be absolute, e.g. opamp+unix:///var/run/opamp.sock",
+		},
+		{
+			name:     "unix socket with proxy",
+			settings: types.StartSettings{OpAMPServerURL: "opamp+unix:///var/run/opamp.sock", ProxyURL: "http://proxy:3128"},
+			err:      "ProxyURL and Proxy must not be set with a opamp+unix OpAMPServerURL",
+		},
+		{
+			name:     "negative duration",
+			settings: types.StartSettings{OpAMPServerURL: url, HeartbeatInterval: -time.Second},
+			err:      "HeartbeatInterval must not be negative",
+		},
+		{
+			name:     "proxy url and func",
+			settings: types.StartSettings{OpAMPServerURL: url, ProxyURL: "http://proxy:3128", Proxy: http.ProxyFromEnvironment},
+			err:      "ProxyURL and Proxy must not be both set",
+		},
+		{
+			name:     "proxy url scheme",
+			settings: types.StartSettings{OpAMPServerURL: url, ProxyURL: "ftp://proxy:3128"},
+			err:      `invalid ProxyURL: unsupported scheme "ftp", must be http, https or socks5`,
+		},
+		{
+			name: "downloaders without packages",
+			settings: types.StartSettings{
+				OpAMPServerURL: url,
+				Downloaders:    map[string]types.Downloader{"oci": nil},
+			},
+			err: "Downloaders are set but PackagesStateProvider is not set, packages cannot be downloaded",
+		},
+		{
+			name: "applying without capability",
+			settings: types.StartSettings{
+				OpAMPServerURL:             url,
+				ReportRemoteConfigApplying: true,
+			},
+			err: "ReportRemoteConfigApplying is set but the ReportsRemoteConfig capability is not set",
+		},
+		{
+			name: "capability without callback",
+			settings: types.StartSettings{
+				OpAMPServerURL: url,
+				Callbacks:      types.CallbacksStruct{OnMessageFunc: onMessage},
+				Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+					protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand,
+			},
+			err: "AcceptsRestartCommand capability is set but Callbacks.OnCommandFunc is not set to handle it",
+		},
+		{
+			name: "capability without callback in pointer",
+			settings: types.StartSettings{
+				OpAMPServerURL: url,
+				Callbacks:      &types.CallbacksStruct{},
+				Capabilities:   protobufs.AgentCapabilities_AgentCapabilities_ReportsEffectiveConfig,
+			},
+			err: "ReportsEffectiveConfig capability is set but Callbacks.GetEffectiveConfigFunc is not set to handle it",
+		},
+		{
+			name: "invalid response verification key",
+			settings: types.StartSettings{
+				OpAMPServerURL:          url,
+				ResponseVerificationKey: []byte("key"),
+			},
+			err: "ResponseVerificationKey is not a valid Ed25519 public key",
+		},
+		{
+			name: "capabilities with callbacks",
+			settings: types.StartSettings{
+				OpAMPServerURL: url,
+				Callbacks:      types.CallbacksStruct{OnMessageFunc: onMessage},
+				Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+					protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateStartSettings(test.settings)
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.err)
+			}
+		})
+	}
+}
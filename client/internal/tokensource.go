@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// The time before the expiry when oauth2 considers the token expired and gets a
+// new one from the source.
+const tokenExpiryDelta = 10 * time.Second
+
+// TokenRefreshTime returns the time when the source returned by TokenSource gets a
+// new token to replace the token, zero if the token does not expire.
+func TokenRefreshTime(token *oauth2.Token) time.Time {
+	if token.Expiry.IsZero() {
+		return time.Time{}
+	}
+	return token.Expiry.Add(-tokenExpiryDelta)
+}
+
+// TokenSource returns the source of the tokens to attach to the requests, see
+// StartSettings.TokenSource. The token is cached until it expires. Returns nil if
+// source is nil.
+func TokenSource(source oauth2.TokenSource) oauth2.TokenSource {
+	if source == nil {
+		return nil
+	}
+	return oauth2.ReuseTokenSource(nil, source)
+}
+
+// TokenHeaderProvider returns the HeaderProvider that adds the Authorization header
+// with the current token of the source to the headers returned by the provider.
+// onToken is called with the attached token if it is not nil. Returns the provider
+// as is if the source is nil.
+func TokenHeaderProvider(
+	source oauth2.TokenSource, provider HeaderProvider, onToken func(token *oauth2.Token),
+) HeaderProvider {
+	if source == nil {
+		return provider
+	}
+	return func(ctx context.Context) (http.Header, error) {
+		header := http.Header{}
+		if provider != nil {
+			provided, err := provider(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if provided != nil {
+				header = provided.Clone()
+			}
+		}
+
+		token, err := source.Token()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get OAuth2 token: %w", err)
+		}
+		header.Set("Authorization", token.Type()+" "+token.AccessToken)
+		if onToken != nil {
+			onToken(token)
+		}
+		return header, nil
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// UnixSocketScheme is the scheme of the OpAMPServerURL of a Server that listens on a
+// unix domain socket, e.g. "opamp+unix:///var/run/opamp.sock".
+const UnixSocketScheme = "opamp+unix"
+
+// The host and the path of the requests sent over the unix domain socket. The host
+// is not resolved, the requests use the default path of the opamp-go Server.
+const (
+	unixSocketHost = "localhost"
+	unixSocketPath = "/v1/opamp"
+)
+
+// validateUnixSocketSettings returns an error if the settings cannot be used to
+// connect to the Server at the unix domain socket URL u.
+func validateUnixSocketSettings(settings types.StartSettings, u *url.URL) error {
+	if u.Host != "" || !path.IsAbs(u.Path) {
+		return fmt.Errorf(
+			"the socket path of a %s OpAMPServerURL must be absolute, e.g. %s:///var/run/opamp.sock",
+			UnixSocketScheme, UnixSocketScheme,
+		)
+	}
+	if HasProxySettings(settings) {
+		return fmt.Errorf("ProxyURL and Proxy must not be set with a %s OpAMPServerURL", UnixSocketScheme)
+	}
+	if settings.DialContext != nil {
+		return fmt.Errorf("DialContext must not be set with a %s OpAMPServerURL", UnixSocketScheme)
+	}
+	return nil
+}
+
+// ResolveUnixSocket returns the settings to connect to the Server with. If the
+// OpAMPServerURL has the UnixSocketScheme the returned settings connect to the
+// socket: the OpAMPServerURL has the scheme, or its TLS variant if TLSConfig is set,
+// and DialContext dials the socket. Otherwise the settings are returned as is. The
+// settings must be valid, see ValidateStartSettings.
+func ResolveUnixSocket(settings types.StartSettings, scheme string) types.StartSettings {
+	u, err := url.Parse(settings.OpAMPServerURL)
+	if err != nil || u.Scheme != UnixSocketScheme {
+		return settings
+	}
+
+	if settings.TLSConfig != nil {
+		scheme += "s"
+	}
+	serverURL := &url.URL{Scheme: scheme, Host: unixSocketHost, Path: unixSocketPath}
+	settings.OpAMPServerURL = serverURL.String()
+	settings.DialContext = unixSocketDialer(u.Path, unixSocketHost+":"+defaultPort(scheme))
+	return settings
+}
+
+// unixSocketDialer returns the DialContext that connects to the socket instead of
+// socketAddr. The other addresses, e.g. the endpoints offered by the Server, are
+// dialed as usual.
+func unixSocketDialer(socket, socketAddr string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var dialer net.Dialer
+		if addr == socketAddr {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "wss", "https", "grpcs":
+		return "443"
+	default:
+		return "80"
+	}
+}
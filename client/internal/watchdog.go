@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultWatchdogMaxMissedIntervals is the number of intervals without any sign of
+// life from the Server after which the connection is considered stalled.
+const DefaultWatchdogMaxMissedIntervals = 3
+
+// Watchdog detects a stalled connection, i.e. a connection that appears to be open
+// but on which nothing was received from the Server for a number of intervals.
+// This happens for example when a middlebox silently drops the connection.
+type Watchdog struct {
+	interval          time.Duration
+	maxMissed         int
+	lastSeenUnixNanos int64
+}
+
+// NewWatchdog creates a new Watchdog. If maxMissed is 0 then
+// DefaultWatchdogMaxMissedIntervals is used.
+func NewWatchdog(interval time.Duration, maxMissed int) *Watchdog {
+	if maxMissed <= 0 {
+		maxMissed = DefaultWatchdogMaxMissedIntervals
+	}
+	w := &Watchdog{interval: interval, maxMissed: maxMissed}
+	w.Touch()
+	return w
+}
+
+// Touch records that something was received from the Server. Can be called
+// concurrently with any other method.
+func (w *Watchdog) Touch() {
+	atomic.StoreInt64(&w.lastSeenUnixNanos, time.Now().UnixNano())
+}
+
+// Run calls ping every interval to make the Server respond. If nothing was received
+// from the Server (see Touch) for maxMissed intervals Run calls onStalled and returns.
+// Run also returns if ping fails or if the ctx is done.
+func (w *Watchdog) Run(ctx context.Context, ping func() error, onStalled func(silence time.Duration)) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			silence := time.Since(time.Unix(0, atomic.LoadInt64(&w.lastSeenUnixNanos)))
+			if silence >= time.Duration(w.maxMissed)*w.interval {
+				onStalled(silence)
+				return
+			}
+			if err := ping(); err != nil {
+				// The connection is broken, the receiver will notice it too.
+				return
+			}
+		}
+	}
+}
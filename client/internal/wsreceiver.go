@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 
@@ -10,6 +11,11 @@ import (
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
+// The largest read buffer that is kept for the next message. The buffers of larger
+// messages, e.g. of a large remote config, are released, so that they are not held
+// for the lifetime of the connection.
+const maxRetainedReadBufferSize = 64 * 1024
+
 // wsReceiver implements the WebSocket client's receiving portion of OpAMP protocol.
 type wsReceiver struct {
 	conn      *websocket.Conn
@@ -17,6 +23,16 @@ type wsReceiver struct {
 	sender    *WSSender
 	callbacks types.Callbacks
 	processor receivedProcessor
+
+	// Called every time a message is received, if set.
+	onReceive func()
+
+	// Records the received messages. nil if the capture is not enabled.
+	wireCapture *internal.WireCapture
+
+	// The buffer the messages are read into, reused for the next message. The
+	// decoded messages do not reference it.
+	readBuf bytes.Buffer
 }
 
 // NewWSReceiver creates a new Receiver that uses WebSocket to receive
@@ -28,47 +44,85 @@ func NewWSReceiver(
 	sender *WSSender,
 	clientSyncedState *ClientSyncedState,
 	packagesStateProvider types.PackagesStateProvider,
+	packageDownloads PackageDownloadSettings,
+	endpointTransition *EndpointTransition,
 	capabilities protobufs.AgentCapabilities,
+	specCompliance *SpecCompliance,
+	responseVerifier *ResponseVerifier,
 ) *wsReceiver {
 	w := &wsReceiver{
 		conn:      conn,
 		logger:    logger,
 		sender:    sender,
 		callbacks: callbacks,
-		processor: newReceivedProcessor(logger, callbacks, sender, clientSyncedState, packagesStateProvider, capabilities),
+		processor: newReceivedProcessor(logger, callbacks, sender, clientSyncedState, packagesStateProvider, packageDownloads, endpointTransition, capabilities, specCompliance, responseVerifier),
 	}
 
 	return w
 }
 
-// ReceiverLoop runs the receiver loop. To stop the receiver cancel the context.
-func (r *wsReceiver) ReceiverLoop(ctx context.Context) {
-	runContext, cancelFunc := context.WithCancel(ctx)
+// OnReceive sets the func that is called every time a message is received from the
+// Server, before the message is processed. Must be called before ReceiverLoop.
+func (r *wsReceiver) OnReceive(f func()) {
+	r.onReceive = f
+}
 
-out:
-	for {
-		var message protobufs.ServerToAgent
-		if err := r.receiveMessage(&message); err != nil {
-			if ctx.Err() == nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				r.logger.Errorf("Unexpected error while receiving: %v", err)
-			}
-			break out
-		} else {
-			r.processor.ProcessReceivedMessage(runContext, &message)
-		}
-	}
+// SetWireCapture sets the capture that records the received messages, nil disables
+// the capture. Must be called before ReceiverLoop.
+func (r *wsReceiver) SetWireCapture(capture *internal.WireCapture) {
+	r.wireCapture = capture
+}
 
-	cancelFunc()
+// ReceiverLoop runs the receiver loop until reading from the connection fails. The
+// received messages and the connection settings offers that become valid later are
+// processed one at a time on the calling goroutine. To stop the receiver close the
+// connection. Returns the error that ended the loop.
+func (r *wsReceiver) ReceiverLoop(ctx context.Context) error {
+	err := r.processor.receiveLoop(ctx, r.receiveMessage)
+	if ctx.Err() == nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		r.logger.Errorf("Unexpected error while receiving: %v", err)
+	}
+	return err
 }
 
 func (r *wsReceiver) receiveMessage(msg *protobufs.ServerToAgent) error {
-	_, bytes, err := r.conn.ReadMessage()
+	frame, err := r.readMessage()
 	if err != nil {
 		return err
 	}
-	err = internal.DecodeWSMessage(bytes, msg)
+	defer r.releaseReadBuf()
+	if r.onReceive != nil {
+		r.onReceive()
+	}
+	err = internal.DecodeWSMessage(frame, msg)
 	if err != nil {
+		// Capture the frames that cannot be decoded as is, they are the most
+		// interesting ones.
+		r.wireCapture.Capture(internal.WireServerToAgent, internal.WireWebSocket, frame, nil)
 		return fmt.Errorf("cannot decode received message: %w", err)
 	}
+	r.wireCapture.Capture(internal.WireServerToAgent, internal.WireWebSocket, frame, msg)
 	return err
 }
+
+// readMessage reads the next message into the read buffer, unlike
+// websocket.Conn.ReadMessage, which allocates a new buffer for every message. The
+// returned bytes are only valid until the next call.
+func (r *wsReceiver) readMessage() ([]byte, error) {
+	_, reader, err := r.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	r.readBuf.Reset()
+	if _, err := r.readBuf.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	return r.readBuf.Bytes(), nil
+}
+
+// releaseReadBuf releases the read buffer if it grew too large to be kept.
+func (r *wsReceiver) releaseReadBuf() {
+	if r.readBuf.Cap() > maxRetainedReadBufferSize {
+		r.readBuf = bytes.Buffer{}
+	}
+}
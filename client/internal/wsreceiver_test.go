@@ -3,8 +3,12 @@ package internal
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
@@ -63,7 +67,7 @@ func TestServerToAgentCommand(t *testing.T) {
 			action := none
 
 			callbacks := types.CallbacksStruct{
-				OnCommandFunc: func(command *protobufs.ServerToAgentCommand) error {
+				OnCommandFunc: func(ctx context.Context, command *protobufs.ServerToAgentCommand) error {
 					switch command.Type {
 					case protobufs.CommandType_CommandType_Restart:
 						action = restart
@@ -77,7 +81,7 @@ func TestServerToAgentCommand(t *testing.T) {
 				remoteConfigStatus: &protobufs.RemoteConfigStatus{},
 			}
 			sender := WSSender{}
-			receiver := NewWSReceiver(TestLogger{t}, callbacks, nil, &sender, &clientSyncedState, nil, 0)
+			receiver := NewWSReceiver(TestLogger{t}, callbacks, nil, &sender, &clientSyncedState, nil, PackageDownloadSettings{}, nil, 0, nil, nil)
 			receiver.processor.ProcessReceivedMessage(context.Background(), &protobufs.ServerToAgent{
 				Command: test.command,
 			})
@@ -91,7 +95,7 @@ func TestServerToAgentCommandExclusive(t *testing.T) {
 	calledOnMessageConfig := false
 
 	callbacks := types.CallbacksStruct{
-		OnCommandFunc: func(command *protobufs.ServerToAgentCommand) error {
+		OnCommandFunc: func(ctx context.Context, command *protobufs.ServerToAgentCommand) error {
 			calledCommand = true
 			return nil
 		},
@@ -100,7 +104,7 @@ func TestServerToAgentCommandExclusive(t *testing.T) {
 		},
 	}
 	clientSyncedState := ClientSyncedState{}
-	receiver := NewWSReceiver(TestLogger{t}, callbacks, nil, nil, &clientSyncedState, nil, 0)
+	receiver := NewWSReceiver(TestLogger{t}, callbacks, nil, nil, &clientSyncedState, nil, PackageDownloadSettings{}, nil, 0, nil, nil)
 	receiver.processor.ProcessReceivedMessage(context.Background(), &protobufs.ServerToAgent{
 		Command: &protobufs.ServerToAgentCommand{
 			Type: protobufs.CommandType_CommandType_Restart,
@@ -142,3 +146,46 @@ func TestDecodeMessage(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkWSReceiveMessage(b *testing.B) {
+	// A message with a remote config of a typical size.
+	data, err := proto.Marshal(&protobufs.ServerToAgent{
+		InstanceUid: "01ARZ3NDEKTSV4RRFFQ69G5FAV",
+		RemoteConfig: &protobufs.AgentRemoteConfig{
+			Config: &protobufs.AgentConfigMap{ConfigMap: map[string]*protobufs.AgentConfigFile{
+				"": {Body: make([]byte, 4096), ContentType: "text/yaml"},
+			}},
+			ConfigHash: []byte{1, 2, 3, 4},
+		},
+	})
+	require.NoError(b, err)
+
+	// A Server that sends the message b.N times.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for i := 0; i < b.N; i++ {
+			if err := internal.WriteWSMessageBytes(conn, data); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(b, err)
+	defer conn.Close()
+	receiver := &wsReceiver{conn: conn}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var msg protobufs.ServerToAgent
+		if err := receiver.receiveMessage(&msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
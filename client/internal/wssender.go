@@ -2,6 +2,9 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"google.golang.org/protobuf/proto"
@@ -11,13 +14,26 @@ import (
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
+var errDisconnected = errors.New("the AgentDisconnect message was sent")
+
 // WSSender implements the WebSocket client's sending portion of OpAMP protocol.
 type WSSender struct {
 	SenderCommon
-	conn   *websocket.Conn
 	logger types.Logger
+	// The connection and whether the AgentDisconnect message was sent on it, guarded
+	// by connMutex, which also serializes the writes of the messages.
+	conn         *websocket.Conn
+	disconnected bool
+	connMutex    sync.Mutex
 	// Indicates that the sender has fully stopped.
 	stopped chan struct{}
+	// Send a heartbeat if no message was sent for this long. Disabled if 0.
+	heartbeatInterval time.Duration
+	// Calculates the compressed sizes of the sent messages. nil if the messages
+	// are not compressed on the current connection.
+	deflater *internal.WSMessageDeflater
+	// Records the sent messages. nil if the capture is not enabled.
+	wireCapture *internal.WireCapture
 }
 
 // NewSender creates a new Sender that uses WebSocket to send
@@ -32,7 +48,10 @@ func NewSender(logger types.Logger) *WSSender {
 // Start the sender and send the first message that was set via NextMessage().Update()
 // earlier. To stop the WSSender cancel the ctx.
 func (s *WSSender) Start(ctx context.Context, conn *websocket.Conn) error {
+	s.connMutex.Lock()
 	s.conn = conn
+	s.disconnected = false
+	s.connMutex.Unlock()
 	err := s.sendNextMessage()
 
 	// Run the sender in the background.
@@ -42,6 +61,58 @@ func (s *WSSender) Start(ctx context.Context, conn *websocket.Conn) error {
 	return err
 }
 
+// SetHeartbeatInterval enables sending a heartbeat message, which carries only the
+// instance uid, the sequence number and the capabilities, if no other message was
+// sent for the interval. Heartbeats keep idle connections open, e.g. when load
+// balancers drop them. 0 disables the heartbeats. Must be called before Start.
+func (s *WSSender) SetHeartbeatInterval(interval time.Duration) {
+	s.heartbeatInterval = interval
+}
+
+// SetWireCapture sets the capture that records the sent messages, nil disables the
+// capture. Must be called before Start.
+func (s *WSSender) SetWireCapture(capture *internal.WireCapture) {
+	s.wireCapture = capture
+}
+
+// SetCompression sets whether the messages are compressed on the connection, so
+// that their compressed sizes are measured, see CompressionStats. Must be called
+// before Start.
+func (s *WSSender) SetCompression(enabled bool, level int) {
+	s.deflater = nil
+	if enabled {
+		s.deflater = internal.NewWSMessageDeflater(level)
+	}
+}
+
+// Disconnect sends the last message on the connection, which carries AgentDisconnect
+// and the pending changes, followed by the close frame with the normal closure
+// status, so that the Server can tell a shutdown of the Agent from a lost
+// connection. No messages are sent after it until the sender is started again. The
+// writes fail once the deadline of ctx, if any, is reached.
+func (s *WSSender) Disconnect(ctx context.Context) error {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.conn == nil || s.disconnected {
+		return nil
+	}
+	s.disconnected = true
+
+	deadline, _ := ctx.Deadline()
+	if err := s.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	s.nextMessage.Update(func(msg *protobufs.AgentToServer) {
+		msg.AgentDisconnect = &protobufs.AgentDisconnect{}
+	})
+	if err := s.sendPending(s.writeMessage); err != nil {
+		return err
+	}
+	return s.conn.WriteControl(
+		websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline,
+	)
+}
+
 // WaitToStop blocks until the sender is stopped. To stop the sender cancel the context
 // that was passed to Start().
 func (s *WSSender) WaitToStop() {
@@ -49,34 +120,46 @@ func (s *WSSender) WaitToStop() {
 }
 
 func (s *WSSender) run(ctx context.Context) {
-out:
-	for {
-		select {
-		case <-s.hasPendingMessage:
-			s.sendNextMessage()
-
-		case <-ctx.Done():
-			break out
-		}
-	}
-
+	s.runStreamLoop(ctx, s.heartbeatInterval, s.sendMessage)
 	close(s.stopped)
 }
 
 func (s *WSSender) sendNextMessage() error {
-	msgToSend := s.nextMessage.PopPending()
-	if msgToSend != nil && !proto.Equal(msgToSend, &protobufs.AgentToServer{}) {
-		// There is a pending message and the message has some fields populated.
-		return s.sendMessage(msgToSend)
-	}
-	return nil
+	// The statuses must reach the Server, they are sent after reconnecting if
+	// sending fails.
+	return s.sendPending(s.sendMessage)
 }
 
 func (s *WSSender) sendMessage(msg *protobufs.AgentToServer) error {
-	if err := internal.WriteWSMessage(s.conn, msg); err != nil {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.disconnected {
+		return errDisconnected
+	}
+	return s.writeMessage(msg)
+}
+
+// writeMessage writes msg to the connection, connMutex must be held.
+func (s *WSSender) writeMessage(msg *protobufs.AgentToServer) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		s.logger.Errorf("Cannot marshal WS message: %v", err)
+		return err
+	}
+	if err := internal.WriteWSMessageBytes(s.conn, data); err != nil {
 		s.logger.Errorf("Cannot write WS message: %v", err)
 		// TODO: check if it is a connection error then propagate error back to Client and reconnect.
 		return err
 	}
+	s.wireCapture.CaptureWSData(internal.WireAgentToServer, data, msg)
+
+	size := internal.WSMessageSize(data)
+	if s.deflater == nil {
+		s.compression.record(size, size, false)
+	} else {
+		// The connection compresses the message internally, compress it once
+		// more to learn its compressed size.
+		s.compression.record(size, s.deflater.DeflatedSize(data), true)
+	}
 	return nil
 }
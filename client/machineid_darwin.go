@@ -0,0 +1,22 @@
+package client
+
+import (
+	"errors"
+	"os/exec"
+	"regexp"
+)
+
+var platformUUIDRegexp = regexp.MustCompile(`"IOPlatformUUID" = "([^"]+)"`)
+
+// machineId returns the IOPlatformUUID of the host.
+func machineId() (string, error) {
+	out, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+	if err != nil {
+		return "", err
+	}
+	match := platformUUIDRegexp.FindSubmatch(out)
+	if match == nil {
+		return "", errors.New("IOPlatformUUID not found")
+	}
+	return string(match[1]), nil
+}
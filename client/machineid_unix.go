@@ -0,0 +1,28 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package client
+
+import (
+	"bytes"
+	"os"
+)
+
+// Locations of the machine id file on systems that have one.
+var machineIdFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id", "/etc/hostid"}
+
+// machineId returns the machine id of the host.
+func machineId() (string, error) {
+	var lastErr error
+	for _, fileName := range machineIdFiles {
+		id, err := os.ReadFile(fileName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if id = bytes.TrimSpace(id); len(id) > 0 {
+			return string(id), nil
+		}
+	}
+	return "", lastErr
+}
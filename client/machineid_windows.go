@@ -0,0 +1,33 @@
+package client
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// machineId returns the MachineGuid of the host from the registry.
+func machineId() (string, error) {
+	var key syscall.Handle
+	err := syscall.RegOpenKeyEx(
+		syscall.HKEY_LOCAL_MACHINE,
+		syscall.StringToUTF16Ptr(`SOFTWARE\Microsoft\Cryptography`),
+		0,
+		syscall.KEY_READ|syscall.KEY_WOW64_64KEY,
+		&key,
+	)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = syscall.RegCloseKey(key) }()
+
+	buf := make([]uint16, 64)
+	size := uint32(len(buf) * 2)
+	var valueType uint32
+	err = syscall.RegQueryValueEx(
+		key, syscall.StringToUTF16Ptr("MachineGuid"), nil, &valueType, (*byte)(unsafe.Pointer(&buf[0])), &size,
+	)
+	if err != nil {
+		return "", err
+	}
+	return syscall.UTF16ToString(buf[:size/2]), nil
+}
@@ -0,0 +1,47 @@
+package nativelog
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// The event id of the logged events. The Windows Event Log requires one, the
+// events of the OpAMP Client are not distinguished by id.
+const eventID = 1
+
+// EventLogLogger is a types.Logger that writes the messages to the Windows Event
+// Log. The Event Log has no debug level, Debugf logs Information events and
+// Errorf logs Error events. Safe for concurrent use.
+type EventLogLogger struct {
+	log *eventlog.Log
+}
+
+var _ types.Logger = (*EventLogLogger)(nil)
+
+// NewEventLog creates a new EventLogLogger that logs as the event source, e.g. the
+// name of the Agent. The source must be registered, e.g. by the installer of the
+// Agent using eventlog.InstallAsEventCreate, otherwise the Event Viewer shows the
+// events without the messages.
+func NewEventLog(source string) (*EventLogLogger, error) {
+	log, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open event log source %q: %w", source, err)
+	}
+	return &EventLogLogger{log: log}, nil
+}
+
+func (l *EventLogLogger) Debugf(format string, v ...interface{}) {
+	_ = l.log.Info(eventID, fmt.Sprintf(format, v...))
+}
+
+func (l *EventLogLogger) Errorf(format string, v ...interface{}) {
+	_ = l.log.Error(eventID, fmt.Sprintf(format, v...))
+}
+
+// Close closes the event log. The logger must not be used after that.
+func (l *EventLogLogger) Close() error {
+	return l.log.Close()
+}
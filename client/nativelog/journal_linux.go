@@ -0,0 +1,133 @@
+package nativelog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// The socket of the native protocol of systemd-journald.
+const journalSocket = "/run/systemd/journal/socket"
+
+// The syslog priorities of the messages, see syslog(3).
+const (
+	journalPriorityError = 3
+	journalPriorityDebug = 7
+)
+
+// JournalLogger is a types.Logger that sends the messages to the systemd journal
+// using the native protocol of systemd-journald. Debugf logs with the debug
+// priority (7) and Errorf with the error priority (3). Safe for concurrent use.
+type JournalLogger struct {
+	identifier string
+	conn       *net.UnixConn
+	addr       *net.UnixAddr
+
+	// The messages that cannot be sent to the journal are written to fallback.
+	fallback   io.Writer
+	fallbackMu sync.Mutex
+}
+
+var _ types.Logger = (*JournalLogger)(nil)
+
+// NewJournal creates a new JournalLogger that logs with the identifier as the
+// SYSLOG_IDENTIFIER, e.g. the name of the Agent. Returns an error if
+// systemd-journald is not running. The messages that cannot be sent to the journal
+// are written to os.Stderr.
+func NewJournal(identifier string) (*JournalLogger, error) {
+	return newJournal(identifier, journalSocket)
+}
+
+func newJournal(identifier, socket string) (*JournalLogger, error) {
+	if _, err := os.Stat(socket); err != nil {
+		return nil, fmt.Errorf("systemd-journald is not available: %w", err)
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &JournalLogger{
+		identifier: identifier,
+		conn:       conn,
+		addr:       &net.UnixAddr{Name: socket, Net: "unixgram"},
+		fallback:   os.Stderr,
+	}, nil
+}
+
+func (l *JournalLogger) Debugf(format string, v ...interface{}) {
+	l.send(journalPriorityDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *JournalLogger) Errorf(format string, v ...interface{}) {
+	l.send(journalPriorityError, fmt.Sprintf(format, v...))
+}
+
+// Close closes the connection to the journal. The logger must not be used after that.
+func (l *JournalLogger) Close() error {
+	return l.conn.Close()
+}
+
+func (l *JournalLogger) send(priority int, message string) {
+	var data bytes.Buffer
+	appendJournalField(&data, "PRIORITY", fmt.Sprint(priority))
+	if l.identifier != "" {
+		appendJournalField(&data, "SYSLOG_IDENTIFIER", l.identifier)
+	}
+	appendJournalField(&data, "MESSAGE", message)
+
+	_, _, err := l.conn.WriteMsgUnix(data.Bytes(), nil, l.addr)
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		// Too large for a datagram, pass the message in a file descriptor.
+		err = l.sendFile(data.Bytes())
+	}
+	if err != nil {
+		l.fallbackMu.Lock()
+		defer l.fallbackMu.Unlock()
+		_, _ = fmt.Fprintf(l.fallback, "%s\n", strings.TrimRight(message, "\n"))
+	}
+}
+
+// sendFile passes the data to the journal in a file descriptor of an unlinked
+// temporary file, as the native protocol requires for large messages.
+func (l *JournalLogger) sendFile(data []byte) error {
+	f, err := os.CreateTemp("/dev/shm", "opamp-journal-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if err := os.Remove(f.Name()); err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	_, _, err = l.conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), l.addr)
+	return err
+}
+
+// appendJournalField appends the field in the format of the native protocol. The
+// values with newlines are length-prefixed.
+func appendJournalField(data *bytes.Buffer, name, value string) {
+	data.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		data.WriteByte('=')
+		data.WriteString(value)
+		data.WriteByte('\n')
+		return
+	}
+	data.WriteByte('\n')
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	data.Write(size[:])
+	data.WriteString(value)
+	data.WriteByte('\n')
+}
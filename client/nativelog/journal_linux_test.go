@@ -0,0 +1,67 @@
+package nativelog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenJournal listens on a socket that stands in for the journal.
+func listenJournal(t *testing.T) (string, *net.UnixConn) {
+	socket := filepath.Join(t.TempDir(), "journal.socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return socket, conn
+}
+
+func readJournalEntry(t *testing.T, conn *net.UnixConn) []byte {
+	buf := make([]byte, 64*1024)
+	n, _, err := conn.ReadFromUnix(buf)
+	require.NoError(t, err)
+	return buf[:n]
+}
+
+func TestJournalLogger(t *testing.T) {
+	socket, conn := listenJournal(t)
+	logger, err := newJournal("agent", socket)
+	require.NoError(t, err)
+	defer logger.Close()
+
+	logger.Debugf("connected to %s", "server")
+	assert.Equal(t, "PRIORITY=7\nSYSLOG_IDENTIFIER=agent\nMESSAGE=connected to server\n", string(readJournalEntry(t, conn)))
+
+	// Multi-line messages are length-prefixed.
+	logger.Errorf("cannot connect:\n%v", "refused")
+	var expected bytes.Buffer
+	expected.WriteString("PRIORITY=3\nSYSLOG_IDENTIFIER=agent\nMESSAGE\n")
+	_ = binary.Write(&expected, binary.LittleEndian, uint64(len("cannot connect:\nrefused")))
+	expected.WriteString("cannot connect:\nrefused\n")
+	assert.Equal(t, expected.String(), string(readJournalEntry(t, conn)))
+}
+
+func TestJournalLoggerFallback(t *testing.T) {
+	socket, conn := listenJournal(t)
+	logger, err := newJournal("", socket)
+	require.NoError(t, err)
+	defer logger.Close()
+	var fallback bytes.Buffer
+	logger.fallback = &fallback
+
+	// The journal is gone, the message is written to the fallback.
+	require.NoError(t, conn.Close())
+	logger.Errorf("cannot connect")
+	assert.Equal(t, "cannot connect\n", fallback.String())
+}
+
+func TestNewJournalNotAvailable(t *testing.T) {
+	_, err := newJournal("agent", filepath.Join(t.TempDir(), "missing.socket"))
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "systemd-journald is not available"))
+}
@@ -0,0 +1,6 @@
+// Package nativelog provides types.Logger implementations that write the logs of
+// the OpAMP Client to the native log destinations of the platforms: the systemd
+// journal on Linux and the Windows Event Log on Windows. The messages logged by
+// Debugf and Errorf are mapped to the debug and error priorities of the
+// destinations, as far as the destination supports them.
+package nativelog
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Option configures the OpAMP Client created by New.
+type Option func(o *options)
+
+// options are the configuration of the client created by New.
+type options struct {
+	logger types.Logger
+
+	// Set the fields of the StartSettings when the client is started.
+	settings []func(settings *types.StartSettings)
+}
+
+func withSettings(f func(settings *types.StartSettings)) Option {
+	return func(o *options) {
+		o.settings = append(o.settings, f)
+	}
+}
+
+// WithLogger sets the logger of the client.
+func WithLogger(logger types.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithInstanceUid sets the StartSettings.InstanceUid.
+func WithInstanceUid(instanceUid string) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.InstanceUid = instanceUid
+	})
+}
+
+// WithCallbacks sets the StartSettings.Callbacks.
+func WithCallbacks(callbacks types.Callbacks) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.Callbacks = callbacks
+	})
+}
+
+// WithCapabilities sets the StartSettings.Capabilities.
+func WithCapabilities(capabilities protobufs.AgentCapabilities) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.Capabilities = capabilities
+	})
+}
+
+// WithHeader sets the StartSettings.Header.
+func WithHeader(header http.Header) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.Header = header
+	})
+}
+
+// WithHeaderProvider sets the StartSettings.HeaderProvider.
+func WithHeaderProvider(provider func(ctx context.Context) (http.Header, error)) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.HeaderProvider = provider
+	})
+}
+
+// WithTokenSource sets the StartSettings.TokenSource.
+func WithTokenSource(source oauth2.TokenSource) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.TokenSource = source
+	})
+}
+
+// WithTLS sets the StartSettings.TLSConfig.
+func WithTLS(config *tls.Config) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.TLSConfig = config
+	})
+}
+
+// WithProxyURL sets the StartSettings.ProxyURL.
+func WithProxyURL(proxyURL string) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.ProxyURL = proxyURL
+	})
+}
+
+// WithDialContext sets the StartSettings.DialContext.
+func WithDialContext(dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.DialContext = dialContext
+	})
+}
+
+// WithRedirectPolicy sets the StartSettings.RedirectPolicy.
+func WithRedirectPolicy(policy types.RedirectPolicy) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.RedirectPolicy = policy
+	})
+}
+
+// WithRetryPolicy sets the StartSettings.RetryPolicy.
+func WithRetryPolicy(policy types.RetryPolicy) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.RetryPolicy = policy
+	})
+}
+
+// WithHeartbeatInterval sets the StartSettings.HeartbeatInterval.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.HeartbeatInterval = interval
+	})
+}
+
+// WithCoalescingWindow sets the StartSettings.CoalescingWindow.
+func WithCoalescingWindow(window time.Duration) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.CoalescingWindow = window
+	})
+}
+
+// WithWatchdog sets the StartSettings.WatchdogInterval and
+// StartSettings.WatchdogMaxMissedIntervals.
+func WithWatchdog(interval time.Duration, maxMissedIntervals int) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.WatchdogInterval = interval
+		settings.WatchdogMaxMissedIntervals = maxMissedIntervals
+	})
+}
+
+// WithCompression enables the compression of the messages, see
+// StartSettings.EnableCompression, with the StartSettings.CompressionLevel. 0 means
+// the default level.
+func WithCompression(level int) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.EnableCompression = true
+		settings.CompressionLevel = level
+	})
+}
+
+// WithMetrics sets the StartSettings.Metrics.
+func WithMetrics(metrics types.MetricsRecorder) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.Metrics = metrics
+	})
+}
+
+// WithCallbackTimeout sets the StartSettings.CallbackTimeout.
+func WithCallbackTimeout(timeout time.Duration) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.CallbackTimeout = timeout
+	})
+}
+
+// WithPackagesStateProvider sets the StartSettings.PackagesStateProvider.
+func WithPackagesStateProvider(provider types.PackagesStateProvider) Option {
+	return withSettings(func(settings *types.StartSettings) {
+		settings.PackagesStateProvider = provider
+	})
+}
+
+// optionsClient is the OpAMP Client created by New. It applies the options to the
+// StartSettings when it is started.
+type optionsClient struct {
+	OpAMPClient
+
+	serverURL string
+	settings  []func(settings *types.StartSettings)
+}
+
+// New creates a new OpAMP Client that connects to the Server at serverURL and is
+// configured by the options. The transport is chosen by the scheme of serverURL: the
+// ws, wss and opamp+unix schemes use WebSocket, http and https plain HTTP and grpc
+// and grpcs gRPC. Returns an error if serverURL is invalid or its scheme is not
+// supported. NewHTTP, NewWebSocket and NewGRPC with the StartSettings remain
+// supported.
+//
+// The client is started with Start, the serverURL and the options are applied over
+// the StartSettings passed to it, e.g.:
+//
+//	c, err := client.New("wss://opamp.example.com/v1/opamp",
+//		client.WithLogger(logger),
+//		client.WithInstanceUid(instanceUid),
+//		client.WithCallbacks(callbacks),
+//	)
+//	...
+//	err = c.Start(ctx, types.StartSettings{})
+//
+// The settings that have no option can still be set in the StartSettings.
+func New(serverURL string, opts ...Option) (*optionsClient, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		// Don't leak the secrets of the URL to the error.
+		return nil, fmt.Errorf("invalid OpAMP Server URL: %w", errors.Unwrap(err))
+	}
+
+	c := &optionsClient{serverURL: serverURL, settings: o.settings}
+	switch u.Scheme {
+	case "ws", "wss", internal.UnixSocketScheme:
+		c.OpAMPClient = NewWebSocket(o.logger)
+	case "http", "https":
+		c.OpAMPClient = NewHTTP(o.logger)
+	case "grpc", "grpcs":
+		c.OpAMPClient = NewGRPC(o.logger)
+	default:
+		return nil, fmt.Errorf("unsupported OpAMP Server URL scheme %q", u.Scheme)
+	}
+	return c, nil
+}
+
+// Start implements OpAMPClient.Start. The serverURL and the options passed to New
+// replace the corresponding fields of the settings.
+func (c *optionsClient) Start(ctx context.Context, settings types.StartSettings) error {
+	return c.OpAMPClient.Start(ctx, c.apply(settings))
+}
+
+// Restart implements OpAMPClient.Restart. The serverURL and the options passed to
+// New replace the corresponding fields of the settings.
+func (c *optionsClient) Restart(ctx context.Context, settings types.StartSettings) error {
+	return c.OpAMPClient.Restart(ctx, c.apply(settings))
+}
+
+// SetServerURL implements OpAMPClient.SetServerURL. The serverURL replaces the one
+// passed to New, also for the later Restart calls.
+func (c *optionsClient) SetServerURL(ctx context.Context, serverURL string) error {
+	if err := c.OpAMPClient.SetServerURL(ctx, serverURL); err != nil {
+		return err
+	}
+	c.serverURL = serverURL
+	return nil
+}
+
+func (c *optionsClient) apply(settings types.StartSettings) types.StartSettings {
+	settings.OpAMPServerURL = c.serverURL
+	for _, set := range c.settings {
+		set(&settings)
+	}
+	return settings
+}
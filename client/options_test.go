@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		serverURL string
+		client    interface{}
+	}{
+		{"ws://localhost:4320/v1/opamp", &wsClient{}},
+		{"wss://localhost:4320/v1/opamp", &wsClient{}},
+		{"opamp+unix:///var/run/opamp.sock", &wsClient{}},
+		{"http://localhost:4320/v1/opamp", &httpClient{}},
+		{"https://localhost:4320/v1/opamp", &httpClient{}},
+		{"grpc://localhost:4320", &grpcClient{}},
+		{"grpcs://localhost:4320", &grpcClient{}},
+	}
+	for _, test := range tests {
+		t.Run(test.serverURL, func(t *testing.T) {
+			client, err := New(test.serverURL)
+			require.NoError(t, err)
+			assert.IsType(t, test.client, client.OpAMPClient)
+		})
+	}
+}
+
+func TestNewInvalidURL(t *testing.T) {
+	_, err := New("ftp://localhost:4320")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unsupported OpAMP Server URL scheme "ftp"`)
+
+	_, err = New("ws://agent:s3cret@localhost:port")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid OpAMP Server URL")
+	assert.NotContains(t, err.Error(), "s3cret")
+}
+
+func TestNewStartWithOptions(t *testing.T) {
+	srv := internal.StartMockServer(t)
+	var header atomic.Value
+	srv.OnConnect = func(r *http.Request) {
+		header.Store(r.Header.Get("X-Agent-Group"))
+	}
+
+	var connected int64
+	settings := types.StartSettings{}
+	prepareSettings(t, &settings, nil)
+	client, err := New("ws://"+srv.Endpoint,
+		WithInstanceUid(settings.InstanceUid),
+		WithHeader(http.Header{"X-Agent-Group": []string{"edge"}}),
+		WithCallbacks(types.CallbacksStruct{
+			OnConnectFunc: func(info types.ConnectionInfo) {
+				atomic.AddInt64(&connected, 1)
+			},
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, client.SetAgentDescription(createAgentDescr()))
+
+	// The options replace the settings passed to Start.
+	require.NoError(t, client.Start(context.Background(), types.StartSettings{OpAMPServerURL: "ws://ignored"}))
+	eventually(t, func() bool { return atomic.LoadInt64(&connected) == 1 })
+	assert.EqualValues(t, "edge", header.Load())
+
+	srv.Close()
+	_ = client.Stop(context.Background())
+}
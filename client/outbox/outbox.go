@@ -0,0 +1,64 @@
+// Package outbox provides a file-based types.Outbox, which journals the state of the
+// Agent that is not yet delivered to the Server, see StartSettings.Outbox.
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/atomicfile"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// File is a types.Outbox that keeps the journaled message in a file, in the
+// protobuf encoding. The file is written atomically, so a crash in the middle of
+// saving keeps the previously journaled message.
+type File struct {
+	path string
+}
+
+var _ types.Outbox = (*File)(nil)
+
+// NewFile creates a File that journals the message in the file at path. The
+// directory of the file must exist, the file is created when the first message is
+// saved. The same path must be passed on every start of the Agent.
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// Save implements types.Outbox.Save.
+func (f *File) Save(msg *protobufs.AgentToServer) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(f.path, data, 0600)
+}
+
+// Load implements types.Outbox.Load.
+func (f *File) Load() (*protobufs.AgentToServer, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg := &protobufs.AgentToServer{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", f.path, err)
+	}
+	return msg, nil
+}
+
+// Clear implements types.Outbox.Clear.
+func (f *File) Clear() error {
+	if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package outbox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	f := NewFile(path)
+
+	// Nothing is journaled yet.
+	msg, err := f.Load()
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+
+	saved := &protobufs.AgentToServer{
+		InstanceUid: "01ARZ3NDEKTSV4RRFFQ69G5FAV",
+		RemoteConfigStatus: &protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: []byte{1, 2, 3},
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		},
+	}
+	require.NoError(t, f.Save(saved))
+
+	// A new File with the same path, as after a restart.
+	msg, err = NewFile(path).Load()
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(saved, msg))
+
+	require.NoError(t, f.Clear())
+	msg, err = f.Load()
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+
+	// Clearing twice is fine.
+	require.NoError(t, f.Clear())
+}
+
+func TestFileCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	require.NoError(t, os.WriteFile(path, []byte{0xff, 0xff}, 0600))
+
+	_, err := NewFile(path).Load()
+	assert.Error(t, err)
+}
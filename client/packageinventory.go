@@ -0,0 +1,19 @@
+package client
+
+import (
+	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// PackageInventory scans the local package store and returns the PackageStatuses
+// that accurately reflect the installed packages. The statuses previously saved in
+// the store are reconciled with the actual local packages, so that for example an
+// installation interrupted by a restart is reported as failed.
+//
+// Start() calls this automatically when StartSettings.PackagesStateProvider is set.
+// The result can also be passed to OpAMPClient.SetPackageStatuses() after the local
+// packages are changed outside of the PackagesSyncer.
+func PackageInventory(provider types.PackagesStateProvider) (*protobufs.PackageStatuses, error) {
+	return internal.PackageInventory(provider)
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ProbeExecutable runs the executable at path with the specified arguments (for example
+// "--version") and verifies that it exits cleanly and that its combined output contains
+// expectedVersion. If expectedVersion is empty only the exit status is verified.
+//
+// This function is intended to be used by implementations of types.PackageVerifier.
+func ProbeExecutable(ctx context.Context, path string, args []string, expectedVersion string) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("executable %s failed: %v", path, err)
+	}
+
+	if expectedVersion != "" && !strings.Contains(output.String(), expectedVersion) {
+		return fmt.Errorf(
+			"executable %s does not report expected version %q, output: %q",
+			path, expectedVersion, strings.TrimSpace(output.String()),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// The default of RestartCommandSettings.Timeout.
+const defaultRestartCommandTimeout = 10 * time.Second
+
+var errRestartRequired = errors.New("RestartCommandSettings.Restart must be set")
+
+// RestartCommandSettings are the settings of RestartCommandHandler.
+type RestartCommandSettings struct {
+	// Restart restarts the Agent, e.g. executes the binary of the Agent again or
+	// restarts the process of the Agent managed by a supervisor. Required.
+	Restart func(ctx context.Context) error
+
+	// Health is reported to the Server before the Agent restarts, e.g. an unhealthy
+	// AgentHealth with LastError set to "restarting". nil reports nothing, which
+	// is required unless the Agent has the ReportsHealth capability.
+	Health *protobufs.AgentHealth
+
+	// KeepRunning keeps the client running while the Agent restarts, e.g. when a
+	// supervisor restarts the Agent it manages. By default the client is stopped
+	// before Restart is called, so that the connection to the Server is closed
+	// gracefully before the process is replaced.
+	KeepRunning bool
+
+	// Timeout bounds flushing the pending statuses and stopping the client, so that
+	// an unreachable Server does not prevent the restart. Restart is not bounded.
+	// 0 means 10 seconds.
+	Timeout time.Duration
+
+	// OnError is called with the error of a step that failed. The restart proceeds
+	// if flushing or stopping fails, if Restart fails the client remains stopped
+	// unless KeepRunning is set. Optional.
+	OnError func(err error)
+}
+
+// RestartCommandHandler returns the function to set as CallbacksStruct.OnCommandFunc
+// that performs the restart command of the Server. The command is acknowledged by
+// returning from OnCommand and the restart is performed afterwards: the Health is
+// reported, the pending statuses are flushed to the Server (see OpAMPClient.Flush),
+// the client is stopped and Restart is called. A restart command received while
+// the Agent is restarting is ignored. The other commands are rejected with an
+// error. Returns an error if settings.Restart is nil.
+func RestartCommandHandler(
+	client OpAMPClient, settings RestartCommandSettings,
+) (func(ctx context.Context, command *protobufs.ServerToAgentCommand) error, error) {
+	if settings.Restart == nil {
+		return nil, errRestartRequired
+	}
+	if settings.Timeout == 0 {
+		settings.Timeout = defaultRestartCommandTimeout
+	}
+
+	var restarting int32
+	return func(_ context.Context, command *protobufs.ServerToAgentCommand) error {
+		if command.Type != protobufs.CommandType_CommandType_Restart {
+			return fmt.Errorf("unsupported command type %v", command.Type)
+		}
+		if !atomic.CompareAndSwapInt32(&restarting, 0, 1) {
+			return nil
+		}
+		// The client cannot be flushed nor stopped until OnCommand returns.
+		go func() {
+			defer atomic.StoreInt32(&restarting, 0)
+			restartOnCommand(client, settings)
+		}()
+		return nil
+	}, nil
+}
+
+// restartOnCommand performs the steps of the restart command, see
+// RestartCommandHandler.
+func restartOnCommand(client OpAMPClient, settings RestartCommandSettings) {
+	onError := func(err error) {
+		if settings.OnError != nil {
+			settings.OnError(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	if settings.Health != nil {
+		if err := client.SetHealth(settings.Health); err != nil {
+			onError(fmt.Errorf("cannot report the health before restarting: %w", err))
+		}
+	}
+	if err := client.Flush(ctx); err != nil {
+		onError(fmt.Errorf("cannot flush the statuses before restarting: %w", err))
+	}
+	if !settings.KeepRunning {
+		if err := client.Stop(ctx); err != nil {
+			onError(fmt.Errorf("cannot stop the client before restarting: %w", err))
+		}
+	}
+	if err := settings.Restart(context.Background()); err != nil {
+		onError(fmt.Errorf("cannot restart: %w", err))
+	}
+}
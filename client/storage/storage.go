@@ -0,0 +1,113 @@
+// Package storage provides a file-based types.ClientStorage, which persists the
+// state of the client across restarts of the Agent, see StartSettings.Storage.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/atomicfile"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// File is a types.ClientStorage that keeps the state in a file. The file is written
+// atomically, so a crash in the middle of saving keeps the previously saved state.
+//
+// The state is encoded as an AgentToServer message in the protobuf encoding, with
+// only the fields of the ClientState set, so that the file stays readable when
+// the protocol evolves. The ConnectionSettingsStatus is kept in the LastError of
+// the Health, as it is reported to the Server. The pending command is kept in the file at the path with the
+// ".command" suffix, encoded as a ServerToAgentCommand, only while there is one.
+type File struct {
+	path        string
+	commandPath string
+}
+
+var _ types.ClientStorage = (*File)(nil)
+
+// NewFile creates a File that keeps the state in the file at path. The directory of
+// the file must exist, the file is created when the state is saved for the first
+// time. The same path must be passed on every start of the Agent.
+func NewFile(path string) *File {
+	return &File{path: path, commandPath: path + ".command"}
+}
+
+// Load implements types.ClientStorage.Load.
+func (f *File) Load() (*types.ClientState, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg := &protobufs.AgentToServer{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", f.path, err)
+	}
+	command, err := f.loadCommand()
+	if err != nil {
+		return nil, err
+	}
+	connectionSettingsStatus, _ := types.ParseConnectionSettingsStatus(msg.Health.GetLastError())
+	return &types.ClientState{
+		InstanceUid:              msg.InstanceUid,
+		RemoteConfigStatus:       msg.RemoteConfigStatus,
+		ConnectionSettingsStatus: connectionSettingsStatus,
+		PackageStatuses:          msg.PackageStatuses,
+		PendingCommand:           command,
+	}, nil
+}
+
+func (f *File) loadCommand() (*protobufs.ServerToAgentCommand, error) {
+	data, err := os.ReadFile(f.commandPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	command := &protobufs.ServerToAgentCommand{}
+	if err := proto.Unmarshal(data, command); err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", f.commandPath, err)
+	}
+	return command, nil
+}
+
+// Save implements types.ClientStorage.Save.
+func (f *File) Save(state *types.ClientState) error {
+	msg := &protobufs.AgentToServer{
+		InstanceUid:        state.InstanceUid,
+		RemoteConfigStatus: state.RemoteConfigStatus,
+		PackageStatuses:    state.PackageStatuses,
+	}
+	if state.ConnectionSettingsStatus != nil {
+		msg.Health = &protobufs.AgentHealth{LastError: state.ConnectionSettingsStatus.String()}
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(f.path, data, 0600); err != nil {
+		return err
+	}
+	return f.saveCommand(state.PendingCommand)
+}
+
+func (f *File) saveCommand(command *protobufs.ServerToAgentCommand) error {
+	if command == nil {
+		if err := os.Remove(f.commandPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := proto.Marshal(command)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(f.commandPath, data, 0600)
+}
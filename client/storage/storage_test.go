@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	f := NewFile(path)
+
+	// Nothing is saved yet.
+	state, err := f.Load()
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	saved := &types.ClientState{
+		InstanceUid: "01ARZ3NDEKTSV4RRFFQ69G5FAV",
+		RemoteConfigStatus: &protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: []byte{1, 2, 3},
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		},
+		ConnectionSettingsStatus: &types.ConnectionSettingsStatus{
+			Hash:    []byte{4, 5, 6},
+			Reason:  types.RejectionReasonPolicyDenied,
+			Message: "not allowed",
+		},
+		PackageStatuses: &protobufs.PackageStatuses{
+			ServerProvidedAllPackagesHash: []byte{7, 8, 9},
+		},
+	}
+	require.NoError(t, f.Save(saved))
+
+	// A new File with the same path, as after a restart.
+	state, err = NewFile(path).Load()
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.EqualValues(t, saved.InstanceUid, state.InstanceUid)
+	assert.True(t, proto.Equal(saved.RemoteConfigStatus, state.RemoteConfigStatus))
+	assert.Equal(t, saved.ConnectionSettingsStatus, state.ConnectionSettingsStatus)
+	assert.True(t, proto.Equal(saved.PackageStatuses, state.PackageStatuses))
+}
+
+func TestFilePendingCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	f := NewFile(path)
+
+	command := &protobufs.ServerToAgentCommand{Type: protobufs.CommandType_CommandType_Restart}
+	require.NoError(t, f.Save(&types.ClientState{InstanceUid: "agent", PendingCommand: command}))
+	state, err := NewFile(path).Load()
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(command, state.PendingCommand))
+
+	// The acknowledged command is removed.
+	require.NoError(t, f.Save(&types.ClientState{InstanceUid: "agent"}))
+	state, err = NewFile(path).Load()
+	require.NoError(t, err)
+	assert.Nil(t, state.PendingCommand)
+	assert.NoFileExists(t, path+".command")
+}
+
+func TestFileCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	require.NoError(t, os.WriteFile(path, []byte{0xff, 0xff}, 0600))
+
+	_, err := NewFile(path).Load()
+	assert.Error(t, err)
+}
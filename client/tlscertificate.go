@@ -0,0 +1,18 @@
+package client
+
+import (
+	"crypto/tls"
+
+	"github.com/open-telemetry/opamp-go/client/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// TLSConfigWithCertificate returns a copy of the TLS config that uses the client
+// certificate and the CA certificate of the TLSCertificate offered by the Server.
+// It allows the Agent to keep using the certificate accepted in
+// Callbacks.OnOpampConnectionSettingsAccepted after a restart, by persisting the
+// certificate and passing the returned config in StartSettings.TLSConfig. The
+// base config may be nil.
+func TLSConfigWithCertificate(base *tls.Config, certificate *protobufs.TLSCertificate) (*tls.Config, error) {
+	return internal.OfferedTLSConfig(base, certificate)
+}
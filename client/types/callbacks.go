@@ -33,6 +33,12 @@ type MessageData struct {
 	PackagesAvailable *protobufs.PackagesAvailable
 	PackageSyncer     PackagesSyncer
 
+	// PackagesDiff tells which of the PackagesAvailable must be synced: the packages
+	// that are added, changed or removed compared to the local state of the
+	// PackagesStateProvider when the message is received. nil if PackagesAvailable
+	// is nil or the local state cannot be read.
+	PackagesDiff *PackagesDiff
+
 	// AgentIdentification indicates a new identification received from the Server.
 	// The Agent must save this identification and use it in the future instantiations
 	// of OpAMPClient.
@@ -45,7 +51,9 @@ type Callbacks interface {
 	// May be called after Start() is called and every time a connection is established to the Server.
 	// For WebSocket clients this is called after the handshake is completed without any error.
 	// For HTTP clients this is called for any request if the response status is OK.
-	OnConnect()
+	// The info describes the endpoint, transport, compression and TLS parameters
+	// of the established connection.
+	OnConnect(info ConnectionInfo)
 
 	// OnConnectFailed is called when the connection to the Server cannot be established.
 	// May be called after Start() is called and tries to connect to the Server.
@@ -55,8 +63,12 @@ type Callbacks interface {
 	// OnError is called when the Server reports an error in response to some previously
 	// sent request. Useful for logging purposes. The Agent should not attempt to process
 	// the error by reconnecting or retrying previous operations. The client handles the
-	// ErrorResponse_UNAVAILABLE case internally by performing retries as necessary.
-	OnError(err *protobufs.ServerErrorResponse)
+	// ServerErrorResponseType_Unavailable case internally by delaying its next message
+	// to the Server, the delay is reported in err.Throttle.
+	// The HTTP client also calls OnError with ServerErrorResponseType_Unavailable
+	// when the Server responds with HTTP 429 or 503 status, honoring the
+	// Retry-After header of the response.
+	OnError(err *ServerError)
 
 	// OnMessage is called when the Agent receives a message that needs processing.
 	// See MessageData definition for the data that may be available for processing.
@@ -75,13 +87,22 @@ type Callbacks interface {
 	//
 	// The Agent should process the offer and return an error if the Agent does not
 	// want to accept the settings (e.g. if the TSL certificate in the settings
-	// cannot be verified).
+	// cannot be verified). The error may be a ConnectionSettingsRejectedError (see
+	// RejectConnectionSettings) to specify the reason of the rejection. The rejection
+	// is reported to the Server in the AgentHealth if the Agent has the
+	// ReportsHealth capability, see ConnectionSettingsStatus.
+	//
+	// If OnOpampConnectionSettings returns nil and the settings specify a
+	// destination endpoint then the client will connect to the new endpoint while
+	// keeping the current connection open. If the new endpoint stays healthy for
+	// StartSettings.OpAMPEndpointGracePeriod then OnOpampConnectionSettingsAccepted
+	// is called, otherwise the settings are rejected and the current connection
+	// continues to be used.
 	//
-	// If OnOpampConnectionSettings returns nil and then the caller will
-	// attempt to reconnect to the OpAMP Server using the new settings.
-	// If the connection fails the settings will be rejected and an error will
-	// be reported to the Server. If the connection succeeds the new settings
-	// will be used by the client from that moment on.
+	// If the settings specify a client certificate but no destination endpoint then
+	// the client verifies the certificate and connects to the current endpoint with
+	// it the same way. If the connection stays healthy the client switches to the
+	// certificate, reconnects and calls OnOpampConnectionSettingsAccepted.
 	//
 	// Only one OnOpampConnectionSettings call can be active at any time.
 	// See OnRemoteConfig for the behavior.
@@ -93,7 +114,14 @@ type Callbacks interface {
 	// OnOpampConnectionSettingsAccepted will be called after the settings are
 	// verified and accepted (OnOpampConnectionSettingsOffer and connection using
 	// new settings succeeds). The Agent should store the settings and use them
-	// in the future. Old connection settings should be forgotten.
+	// in the future. Old connection settings should be forgotten. The client
+	// already switched to the new endpoint when this is called only if
+	// StartSettings.FollowOfferedEndpoint is set.
+	//
+	// The client already uses the accepted client certificate when this is called,
+	// but only until it is stopped. To keep using the certificate after a restart
+	// the Agent must persist settings.Certificate and pass it to Start() in
+	// StartSettings.TLSConfig, see client.TLSConfigWithCertificate.
 	OnOpampConnectionSettingsAccepted(
 		settings *protobufs.OpAMPConnectionSettings,
 	)
@@ -102,28 +130,59 @@ type Callbacks interface {
 	// context if processing takes too long. In that case the method should return
 	// as soon as possible with an error.
 
-	// SaveRemoteConfigStatus is called after OnRemoteConfig returns. The status
-	// will be set either as APPLIED or FAILED depending on whether OnRemoteConfig
-	// returned a success or error.
-	// The Agent must remember this RemoteConfigStatus and supply in the future
-	// calls to Start() in StartSettings.RemoteConfigStatus.
+	// SaveRemoteConfigStatus is called when the RemoteConfigStatus set by
+	// OpAMPClient.SetRemoteConfigStatus changes, before the status is sent to the
+	// Server. The Agent must persist this RemoteConfigStatus and supply it in the
+	// future calls to Start() in StartSettings.RemoteConfigStatus, so that the
+	// status reaches the Server even if the Agent restarts before sending it.
 	SaveRemoteConfigStatus(ctx context.Context, status *protobufs.RemoteConfigStatus)
 
+	// SaveInstanceUid is called when the Server assigned a new instance uid to the
+	// Agent, e.g. after OpAMPClient.RequestInstanceUid, before any message is sent
+	// with it. The Agent must persist the instanceUid and supply it in the future
+	// calls to Start() in StartSettings.InstanceUid. All messages sent after this
+	// returns carry the new instance uid.
+	SaveInstanceUid(ctx context.Context, instanceUid string)
+
 	// GetEffectiveConfig returns the current effective config. Only one
 	// GetEffectiveConfig call can be active at any time. Until GetEffectiveConfig
 	// returns it will not be called again.
 	GetEffectiveConfig(ctx context.Context) (*protobufs.EffectiveConfig, error)
 
-	// OnCommand is called when the Server requests that the connected Agent perform a command.
-	OnCommand(command *protobufs.ServerToAgentCommand) error
+	// OnCommand is called when the Server requests that the connected Agent perform a
+	// command. Returning acknowledges the command: if the ClientStorage is set (see
+	// StartSettings.Storage) the command is saved until OnCommand returns, and if the
+	// Agent restarts before that the command is passed to OnCommand once more after
+	// the next Start(). A command that ends the process, e.g. the restart, must be
+	// scheduled and OnCommand must return before it is performed. The returned error
+	// tells that the command failed. The protocol has no command result, so only the
+	// error is forwarded: if the Agent has the ReportsHealth capability it is set as
+	// "<type> command failed: <error>" in the LastError of the Agent's AgentHealth
+	// and reported to the Server, and it stays there until the Agent calls
+	// SetHealth again. ctx is cancelled after StartSettings.CallbackTimeout, if set.
+	OnCommand(ctx context.Context, command *protobufs.ServerToAgentCommand) error
+
+	// OnFlagsHandled is called after the client handled the flags of a message
+	// received from the Server. Not called for the messages without flags.
+	OnFlagsHandled(handling FlagsHandling)
+
+	// OnSpecViolation is called when the client rejected a message received from the
+	// Server because it violates the OpAMP specification. Only called if
+	// StartSettings.StrictSpecCompliance is set.
+	OnSpecViolation(violation SpecViolation)
+
+	// OnConnectionStateChange is called when the status of the connection to the
+	// Server changes, with the new state, see OpAMPClient.ConnectionState. The
+	// calls are made in the order of the transitions.
+	OnConnectionStateChange(state ConnectionState)
 }
 
 // CallbacksStruct is a struct that implements Callbacks interface and allows
 // to override only the methods that are needed. If a method is not overridden then it is a no-op.
 type CallbacksStruct struct {
-	OnConnectFunc       func()
+	OnConnectFunc       func(info ConnectionInfo)
 	OnConnectFailedFunc func(err error)
-	OnErrorFunc         func(err *protobufs.ServerErrorResponse)
+	OnErrorFunc         func(err *ServerError)
 
 	OnMessageFunc func(ctx context.Context, msg *MessageData)
 
@@ -135,18 +194,25 @@ type CallbacksStruct struct {
 		settings *protobufs.OpAMPConnectionSettings,
 	)
 
-	OnCommandFunc func(command *protobufs.ServerToAgentCommand) error
+	OnCommandFunc func(ctx context.Context, command *protobufs.ServerToAgentCommand) error
+
+	OnFlagsHandledFunc func(handling FlagsHandling)
+
+	OnSpecViolationFunc func(violation SpecViolation)
+
+	OnConnectionStateChangeFunc func(state ConnectionState)
 
 	SaveRemoteConfigStatusFunc func(ctx context.Context, status *protobufs.RemoteConfigStatus)
+	SaveInstanceUidFunc        func(ctx context.Context, instanceUid string)
 	GetEffectiveConfigFunc     func(ctx context.Context) (*protobufs.EffectiveConfig, error)
 }
 
 var _ Callbacks = (*CallbacksStruct)(nil)
 
 // OnConnect implements Callbacks.OnConnect.
-func (c CallbacksStruct) OnConnect() {
+func (c CallbacksStruct) OnConnect(info ConnectionInfo) {
 	if c.OnConnectFunc != nil {
-		c.OnConnectFunc()
+		c.OnConnectFunc(info)
 	}
 }
 
@@ -158,7 +224,7 @@ func (c CallbacksStruct) OnConnectFailed(err error) {
 }
 
 // OnError implements Callbacks.OnError.
-func (c CallbacksStruct) OnError(err *protobufs.ServerErrorResponse) {
+func (c CallbacksStruct) OnError(err *ServerError) {
 	if c.OnErrorFunc != nil {
 		c.OnErrorFunc(err)
 	}
@@ -178,6 +244,13 @@ func (c CallbacksStruct) SaveRemoteConfigStatus(ctx context.Context, status *pro
 	}
 }
 
+// SaveInstanceUid implements Callbacks.SaveInstanceUid.
+func (c CallbacksStruct) SaveInstanceUid(ctx context.Context, instanceUid string) {
+	if c.SaveInstanceUidFunc != nil {
+		c.SaveInstanceUidFunc(ctx, instanceUid)
+	}
+}
+
 // GetEffectiveConfig implements Callbacks.GetEffectiveConfig.
 func (c CallbacksStruct) GetEffectiveConfig(ctx context.Context) (*protobufs.EffectiveConfig, error) {
 	if c.GetEffectiveConfigFunc != nil {
@@ -204,9 +277,30 @@ func (c CallbacksStruct) OnOpampConnectionSettingsAccepted(settings *protobufs.O
 }
 
 // OnCommand implements Callbacks.OnCommand.
-func (c CallbacksStruct) OnCommand(command *protobufs.ServerToAgentCommand) error {
+func (c CallbacksStruct) OnCommand(ctx context.Context, command *protobufs.ServerToAgentCommand) error {
 	if c.OnCommandFunc != nil {
-		return c.OnCommandFunc(command)
+		return c.OnCommandFunc(ctx, command)
 	}
 	return nil
 }
+
+// OnFlagsHandled implements Callbacks.OnFlagsHandled.
+func (c CallbacksStruct) OnFlagsHandled(handling FlagsHandling) {
+	if c.OnFlagsHandledFunc != nil {
+		c.OnFlagsHandledFunc(handling)
+	}
+}
+
+// OnSpecViolation implements Callbacks.OnSpecViolation.
+func (c CallbacksStruct) OnSpecViolation(violation SpecViolation) {
+	if c.OnSpecViolationFunc != nil {
+		c.OnSpecViolationFunc(violation)
+	}
+}
+
+// OnConnectionStateChange implements Callbacks.OnConnectionStateChange.
+func (c CallbacksStruct) OnConnectionStateChange(state ConnectionState) {
+	if c.OnConnectionStateChangeFunc != nil {
+		c.OnConnectionStateChangeFunc(state)
+	}
+}
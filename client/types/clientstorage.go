@@ -0,0 +1,38 @@
+package types
+
+import "github.com/open-telemetry/opamp-go/protobufs"
+
+// ClientState is the state of the client that must survive restarts of the Agent,
+// so that the Agent keeps its identity and the Server does not need to resend what
+// the Agent already has.
+type ClientState struct {
+	// The instance uid of the Agent, the one passed to Start() or assigned by the
+	// Server later.
+	InstanceUid string
+
+	// The last RemoteConfigStatus, including the hash of the last remote config
+	// received from the Server.
+	RemoteConfigStatus *protobufs.RemoteConfigStatus
+
+	// The status of the last OpAMP connection settings offer, including its hash.
+	ConnectionSettingsStatus *ConnectionSettingsStatus
+
+	// The last PackageStatuses, including the hash of the last packages offered by
+	// the Server.
+	PackageStatuses *protobufs.PackageStatuses
+
+	// The command received from the Server that the Agent did not acknowledge yet,
+	// see Callbacks.OnCommand. nil if none.
+	PendingCommand *protobufs.ServerToAgentCommand
+}
+
+// ClientStorage persists the ClientState, see StartSettings.Storage. client/storage
+// provides a file-based implementation. The methods are not called concurrently.
+type ClientStorage interface {
+	// Load returns the state last saved via Save, nil if none is saved yet, e.g.
+	// when the Agent starts for the first time.
+	Load() (*ClientState, error)
+
+	// Save replaces the saved state by state. Must not modify state.
+	Save(state *ClientState) error
+}
@@ -0,0 +1,30 @@
+package types
+
+// CompressionStats describes how well the messages sent to the Server compress, see
+// OpAMPClient.CompressionStats. It helps to decide whether enabling the compression
+// or changing the frequency of the messages is worth it for the Agent's payloads.
+type CompressionStats struct {
+	// The number of messages sent to the Server.
+	Messages int64
+
+	// The number of the sent messages that were compressed. 0 if the compression
+	// is disabled or the Server did not accept it.
+	CompressedMessages int64
+
+	// The size of the sent messages before the compression, in bytes.
+	UncompressedBytes int64
+
+	// The size of the sent messages after the compression, in bytes. The size of
+	// the messages that were not compressed is their uncompressed size.
+	CompressedBytes int64
+}
+
+// Ratio returns the size of the sent messages after the compression relative to
+// their size before the compression, e.g. 0.25 if the messages compress to a
+// quarter of their size. Returns 1 if nothing was sent.
+func (s CompressionStats) Ratio() float64 {
+	if s.UncompressedBytes == 0 {
+		return 1
+	}
+	return float64(s.CompressedBytes) / float64(s.UncompressedBytes)
+}
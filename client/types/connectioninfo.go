@@ -0,0 +1,49 @@
+package types
+
+// Transport is the transport used by the OpAMP Client to connect to the Server.
+type Transport int
+
+const (
+	TransportWebSocket Transport = iota
+	TransportHTTP
+	// TransportInMemory is used by the client created by client.NewInMemory,
+	// which does not connect to a Server.
+	TransportInMemory
+	// TransportGRPC is used by the client created by client.NewGRPC.
+	TransportGRPC
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportWebSocket:
+		return "WebSocket"
+	case TransportHTTP:
+		return "HTTP"
+	case TransportInMemory:
+		return "in-memory"
+	case TransportGRPC:
+		return "gRPC"
+	}
+	return "unknown"
+}
+
+// ConnectionInfo describes how the OpAMP Client is connected to the Server.
+type ConnectionInfo struct {
+	// Endpoint is the URL of the Server the client is connected to.
+	Endpoint string
+
+	// Transport is the transport used for the connection.
+	Transport Transport
+
+	// CompressionEnabled is true if the messages are compressed. For WebSocket transport
+	// this is only true if the Server agreed to use compression.
+	CompressionEnabled bool
+
+	// TLSVersion is the negotiated TLS version (one of tls.VersionTLS* constants)
+	// or 0 if the connection is not encrypted.
+	TLSVersion uint16
+
+	// ServerCertificateFingerprint is the SHA256 hash of the DER encoding of the
+	// Server's leaf certificate. nil if the connection is not encrypted.
+	ServerCertificateFingerprint []byte
+}
@@ -0,0 +1,181 @@
+package types
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConnectionSettingsRejectionReason is a machine-readable reason for rejecting
+// an OpAMP connection settings offer. The reason is reported to the Server, see
+// ConnectionSettingsStatus.
+type ConnectionSettingsRejectionReason string
+
+const (
+	// RejectionReasonUntrustedCA means that the certificate of the offered
+	// endpoint is signed by a CA the Agent does not trust.
+	RejectionReasonUntrustedCA ConnectionSettingsRejectionReason = "untrusted_ca"
+
+	// RejectionReasonHostnameMismatch means that the certificate of the offered
+	// endpoint is not valid for the endpoint's host name.
+	RejectionReasonHostnameMismatch ConnectionSettingsRejectionReason = "hostname_mismatch"
+
+	// RejectionReasonPolicyDenied means that the Agent's local policy does not
+	// allow the offered settings.
+	RejectionReasonPolicyDenied ConnectionSettingsRejectionReason = "policy_denied"
+
+	// RejectionReasonEndpointUnhealthy means that the offered endpoint could not
+	// be reached or did not stay healthy during the grace period.
+	RejectionReasonEndpointUnhealthy ConnectionSettingsRejectionReason = "endpoint_unhealthy"
+
+	// RejectionReasonInvalidHeaders means that the offered headers are invalid,
+	// not allowed or exceed the limits.
+	RejectionReasonInvalidHeaders ConnectionSettingsRejectionReason = "invalid_headers"
+
+	// RejectionReasonInvalidCertificate means that the offered client or CA
+	// certificate cannot be parsed, does not match the private key or is expired.
+	RejectionReasonInvalidCertificate ConnectionSettingsRejectionReason = "invalid_certificate"
+
+	// RejectionReasonOther is used for all other rejections.
+	RejectionReasonOther ConnectionSettingsRejectionReason = "other"
+)
+
+// ConnectionSettingsRejectedError can be returned by Callbacks.OnOpampConnectionSettings
+// to reject the offer with a specific reason.
+type ConnectionSettingsRejectedError struct {
+	Reason ConnectionSettingsRejectionReason
+	Err    error
+}
+
+// RejectConnectionSettings returns a ConnectionSettingsRejectedError with the
+// specified reason and a message formatted according to the format specifier.
+func RejectConnectionSettings(
+	reason ConnectionSettingsRejectionReason, format string, a ...interface{},
+) *ConnectionSettingsRejectedError {
+	return &ConnectionSettingsRejectedError{Reason: reason, Err: fmt.Errorf(format, a...)}
+}
+
+func (e *ConnectionSettingsRejectedError) Error() string {
+	return fmt.Sprintf("connection settings rejected (%s): %v", e.Reason, e.Err)
+}
+
+func (e *ConnectionSettingsRejectedError) Unwrap() error {
+	return e.Err
+}
+
+// RejectionReasonOf returns the reason of the rejection described by err. The reason
+// is taken from a ConnectionSettingsRejectedError in err's chain. Certificate
+// verification errors are classified automatically. All other errors are
+// classified as RejectionReasonOther.
+func RejectionReasonOf(err error) ConnectionSettingsRejectionReason {
+	var rejected *ConnectionSettingsRejectedError
+	if errors.As(err, &rejected) && rejected.Reason != "" {
+		return rejected.Reason
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthority) {
+		return RejectionReasonUntrustedCA
+	}
+
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &hostnameErr) {
+		return RejectionReasonHostnameMismatch
+	}
+
+	return RejectionReasonOther
+}
+
+// ConnectionSettingsStatus is the status of the last OpAMP connection settings offer
+// processed by the client.
+//
+// The version of the OpAMP specification implemented by this library has no field
+// to report the status of the offers, so the client reports the rejection of the
+// last offer in the LastError of the AgentHealth: the first line of LastError is
+// the String of the status, e.g.
+//
+//	opamp.connection_settings.rejected reason=policy_denied hash=0a0b: not allowed
+//
+// followed by the LastError set by the Agent, if any. The rejection is only
+// reported if the Agent has the ReportsHealth capability, and it is cleared when an
+// offer is applied. The Server extracts it with ParseConnectionSettingsStatus. This
+// is a convention of this library: other Servers show it as a part of the error.
+type ConnectionSettingsStatus struct {
+	// The ConnectionSettingsOffers.Hash of the offer.
+	Hash []byte
+
+	// The reason of the rejection, empty if the offer was applied.
+	Reason ConnectionSettingsRejectionReason
+
+	// The error of the rejection, empty if the offer was applied.
+	Message string
+}
+
+const (
+	connectionSettingsAppliedPrefix  = "opamp.connection_settings.applied "
+	connectionSettingsRejectedPrefix = "opamp.connection_settings.rejected "
+)
+
+// Rejected returns true if the offer was rejected.
+func (s *ConnectionSettingsStatus) Rejected() bool {
+	return s != nil && s.Reason != ""
+}
+
+// String returns the status in the single line format described in
+// ConnectionSettingsStatus.
+func (s *ConnectionSettingsStatus) String() string {
+	if !s.Rejected() {
+		return connectionSettingsAppliedPrefix + "hash=" + hex.EncodeToString(s.Hash)
+	}
+	// The status is a single line, the rest of LastError belongs to the Agent.
+	message := strings.NewReplacer("\r", " ", "\n", " ").Replace(s.Message)
+	return fmt.Sprintf("%sreason=%s hash=%s: %s",
+		connectionSettingsRejectedPrefix, s.Reason, hex.EncodeToString(s.Hash), message)
+}
+
+// ParseConnectionSettingsStatus parses the status at the first line of the text,
+// e.g. the LastError of the AgentHealth reported by the Agent, see
+// ConnectionSettingsStatus. Returns the status, nil if the text does not start with
+// one, and the rest of the text.
+func ParseConnectionSettingsStatus(text string) (*ConnectionSettingsStatus, string) {
+	line, rest := text, ""
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		line, rest = text[:i], text[i+1:]
+	}
+
+	if strings.HasPrefix(line, connectionSettingsAppliedPrefix) {
+		hash, ok := parseHashField(strings.TrimPrefix(line, connectionSettingsAppliedPrefix))
+		if !ok {
+			return nil, text
+		}
+		return &ConnectionSettingsStatus{Hash: hash}, rest
+	}
+	if !strings.HasPrefix(line, connectionSettingsRejectedPrefix) {
+		return nil, text
+	}
+	fields := strings.SplitN(strings.TrimPrefix(line, connectionSettingsRejectedPrefix), ": ", 2)
+	words := strings.Fields(fields[0])
+	if len(fields) != 2 || len(words) != 2 || !strings.HasPrefix(words[0], "reason=") {
+		return nil, text
+	}
+	hash, ok := parseHashField(words[1])
+	reason := strings.TrimPrefix(words[0], "reason=")
+	if !ok || reason == "" {
+		return nil, text
+	}
+	return &ConnectionSettingsStatus{
+		Hash:    hash,
+		Reason:  ConnectionSettingsRejectionReason(reason),
+		Message: fields[1],
+	}, rest
+}
+
+func parseHashField(field string) ([]byte, bool) {
+	if !strings.HasPrefix(field, "hash=") {
+		return nil, false
+	}
+	hash, err := hex.DecodeString(strings.TrimPrefix(field, "hash="))
+	return hash, err == nil
+}
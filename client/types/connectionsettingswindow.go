@@ -0,0 +1,15 @@
+package types
+
+// Reserved headers that the Server can include in the Headers of any connection
+// settings offer (OpAMP, own telemetry or other connections) to limit the time window
+// in which the offer is valid. The values are timestamps in RFC 3339 format.
+//
+// An offer with a ConnectionSettingsNotBeforeHeader in the future is held back by
+// the client and delivered to the Agent at the specified time, which allows operators
+// to stage e.g. certificate cutovers fleet-wide. An offer with a
+// ConnectionSettingsNotAfterHeader in the past is discarded. The headers are removed
+// from the offer before it is delivered to the Agent.
+const (
+	ConnectionSettingsNotBeforeHeader = "OpAMP-Not-Before"
+	ConnectionSettingsNotAfterHeader  = "OpAMP-Not-After"
+)
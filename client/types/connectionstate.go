@@ -0,0 +1,49 @@
+package types
+
+import "time"
+
+// ConnectionStatus is the status of the connection of the OpAMP Client to the
+// Server, see ConnectionState.
+type ConnectionStatus int
+
+const (
+	// ConnectionDisconnected means the client is not started or is stopped.
+	ConnectionDisconnected ConnectionStatus = iota
+	// ConnectionConnecting means the client is started but is not connected to the
+	// Server yet, or lost the connection and is reconnecting.
+	ConnectionConnecting
+	// ConnectionConnected means the client is connected to the Server. With HTTP
+	// transport the client is connected once a request succeeded, until a request
+	// fails.
+	ConnectionConnected
+)
+
+func (s ConnectionStatus) String() string {
+	switch s {
+	case ConnectionDisconnected:
+		return "disconnected"
+	case ConnectionConnecting:
+		return "connecting"
+	case ConnectionConnected:
+		return "connected"
+	}
+	return "unknown"
+}
+
+// ConnectionState describes the connection of the OpAMP Client to the Server, see
+// OpAMPClient.ConnectionState and Callbacks.OnConnectionStateChange.
+type ConnectionState struct {
+	// Status is the status of the connection.
+	Status ConnectionStatus
+
+	// LastError is the error of the last failed connection attempt or of the last
+	// lost connection since Start(), nil if none. It is kept once connected again.
+	LastError error
+
+	// ConnectedSince is the time the client connected at, zero unless Status is
+	// ConnectionConnected.
+	ConnectedSince time.Time
+
+	// Info describes the connection, zero unless Status is ConnectionConnected.
+	Info ConnectionInfo
+}
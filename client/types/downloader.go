@@ -0,0 +1,20 @@
+package types
+
+import (
+	"context"
+	"io"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Downloader downloads the content of package files. Downloaders can be registered
+// in StartSettings.Downloaders for the URL schemes that the built-in HTTP downloader
+// does not support.
+type Downloader interface {
+	// Download starts downloading the file and returns a reader of its content.
+	// The caller must close the returned reader. If the Downloader verifies the
+	// content while it is read, the reader must return an error instead of io.EOF
+	// if the verification fails.
+	// The function must cancel and return an error if the context is cancelled.
+	Download(ctx context.Context, file *protobufs.DownloadableFile) (io.ReadCloser, error)
+}
@@ -0,0 +1,25 @@
+package types
+
+import "github.com/open-telemetry/opamp-go/protobufs"
+
+// FlagsHandling describes how the client handled the flags that the Server set in
+// a ServerToAgent message. Useful for debugging the interoperability with the
+// Server implementations.
+type FlagsHandling struct {
+	// Flags set by the Server in the message.
+	Flags protobufs.ServerToAgentFlags
+
+	// FullStateScheduled is true if the client scheduled sending its full state to
+	// the Server in response to ServerToAgentFlags_ReportFullState.
+	FullStateScheduled bool
+
+	// EffectiveConfigErr is the error returned by Callbacks.GetEffectiveConfig when
+	// the full state was prepared. The full state is sent without the effective
+	// config in that case.
+	EffectiveConfigErr error
+
+	// IgnoredFlags are the Flags the client did not act on: the flags unknown to
+	// the client, or all Flags if the message carried a command, since the other
+	// fields of a command message are ignored.
+	IgnoredFlags protobufs.ServerToAgentFlags
+}
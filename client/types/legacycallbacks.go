@@ -0,0 +1,184 @@
+package types
+
+import (
+	"context"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// LegacyCallbacks is the Callbacks interface of the releases before OnConnect
+// received the ConnectionInfo, OnError the ServerError and OnCommand a context, and
+// before the callbacks added since then. Use AdaptLegacyCallbacks to pass an implementation written
+// against those releases to the client, so that the Agent can upgrade the module
+// first and migrate its callbacks to Callbacks later.
+type LegacyCallbacks interface {
+	OnConnect()
+	OnConnectFailed(err error)
+	OnError(err *protobufs.ServerErrorResponse)
+	OnMessage(ctx context.Context, msg *MessageData)
+	OnOpampConnectionSettings(ctx context.Context, settings *protobufs.OpAMPConnectionSettings) error
+	OnOpampConnectionSettingsAccepted(settings *protobufs.OpAMPConnectionSettings)
+	SaveRemoteConfigStatus(ctx context.Context, status *protobufs.RemoteConfigStatus)
+	GetEffectiveConfig(ctx context.Context) (*protobufs.EffectiveConfig, error)
+	OnCommand(command *protobufs.ServerToAgentCommand) error
+}
+
+// AdaptLegacyCallbacks returns the Callbacks that call the LegacyCallbacks:
+// OnConnect is called without the ConnectionInfo, OnError with the
+// ServerErrorResponse the ServerError was created from and OnCommand without the
+// context. The callbacks added to
+// Callbacks since then are passed to the legacy implementation if it also
+// implements them, e.g. once it is partially migrated, and are no-ops otherwise.
+func AdaptLegacyCallbacks(callbacks LegacyCallbacks) Callbacks {
+	return legacyCallbacksAdapter{callbacks}
+}
+
+type legacyCallbacksAdapter struct {
+	LegacyCallbacks
+}
+
+var _ Callbacks = legacyCallbacksAdapter{}
+
+func (a legacyCallbacksAdapter) OnConnect(ConnectionInfo) {
+	a.LegacyCallbacks.OnConnect()
+}
+
+func (a legacyCallbacksAdapter) OnError(err *ServerError) {
+	response := &protobufs.ServerErrorResponse{Type: err.Type, ErrorMessage: err.Message}
+	if err.RetryAfter > 0 {
+		response.Details = &protobufs.ServerErrorResponse_RetryInfo{
+			RetryInfo: &protobufs.RetryInfo{RetryAfterNanoseconds: uint64(err.RetryAfter)},
+		}
+	}
+	a.LegacyCallbacks.OnError(response)
+}
+
+func (a legacyCallbacksAdapter) OnCommand(_ context.Context, command *protobufs.ServerToAgentCommand) error {
+	return a.LegacyCallbacks.OnCommand(command)
+}
+
+func (a legacyCallbacksAdapter) SaveInstanceUid(ctx context.Context, instanceUid string) {
+	if c, ok := a.LegacyCallbacks.(interface {
+		SaveInstanceUid(ctx context.Context, instanceUid string)
+	}); ok {
+		c.SaveInstanceUid(ctx, instanceUid)
+	}
+}
+
+func (a legacyCallbacksAdapter) OnFlagsHandled(handling FlagsHandling) {
+	if c, ok := a.LegacyCallbacks.(interface{ OnFlagsHandled(handling FlagsHandling) }); ok {
+		c.OnFlagsHandled(handling)
+	}
+}
+
+func (a legacyCallbacksAdapter) OnSpecViolation(violation SpecViolation) {
+	if c, ok := a.LegacyCallbacks.(interface{ OnSpecViolation(violation SpecViolation) }); ok {
+		c.OnSpecViolation(violation)
+	}
+}
+
+func (a legacyCallbacksAdapter) OnConnectionStateChange(state ConnectionState) {
+	if c, ok := a.LegacyCallbacks.(interface{ OnConnectionStateChange(state ConnectionState) }); ok {
+		c.OnConnectionStateChange(state)
+	}
+}
+
+// LegacyCallbacksStruct is the CallbacksStruct of the releases described in
+// LegacyCallbacks, a LegacyCallbacks implementation that allows to override only
+// the methods that are needed. If a method is not overridden then it is a no-op.
+// For example the CallbacksStruct written against those releases is passed to the
+// client as:
+//
+//	settings.Callbacks = types.AdaptLegacyCallbacks(types.LegacyCallbacksStruct{
+//		OnConnectFunc: func() { ... },
+//	})
+type LegacyCallbacksStruct struct {
+	OnConnectFunc       func()
+	OnConnectFailedFunc func(err error)
+	OnErrorFunc         func(err *protobufs.ServerErrorResponse)
+
+	OnMessageFunc func(ctx context.Context, msg *MessageData)
+
+	OnOpampConnectionSettingsFunc func(
+		ctx context.Context,
+		settings *protobufs.OpAMPConnectionSettings,
+	) error
+	OnOpampConnectionSettingsAcceptedFunc func(
+		settings *protobufs.OpAMPConnectionSettings,
+	)
+
+	OnCommandFunc func(command *protobufs.ServerToAgentCommand) error
+
+	SaveRemoteConfigStatusFunc func(ctx context.Context, status *protobufs.RemoteConfigStatus)
+	GetEffectiveConfigFunc     func(ctx context.Context) (*protobufs.EffectiveConfig, error)
+}
+
+var _ LegacyCallbacks = (*LegacyCallbacksStruct)(nil)
+
+// OnConnect implements LegacyCallbacks.OnConnect.
+func (c LegacyCallbacksStruct) OnConnect() {
+	if c.OnConnectFunc != nil {
+		c.OnConnectFunc()
+	}
+}
+
+// OnConnectFailed implements LegacyCallbacks.OnConnectFailed.
+func (c LegacyCallbacksStruct) OnConnectFailed(err error) {
+	if c.OnConnectFailedFunc != nil {
+		c.OnConnectFailedFunc(err)
+	}
+}
+
+// OnError implements LegacyCallbacks.OnError.
+func (c LegacyCallbacksStruct) OnError(err *protobufs.ServerErrorResponse) {
+	if c.OnErrorFunc != nil {
+		c.OnErrorFunc(err)
+	}
+}
+
+// OnMessage implements LegacyCallbacks.OnMessage.
+func (c LegacyCallbacksStruct) OnMessage(ctx context.Context, msg *MessageData) {
+	if c.OnMessageFunc != nil {
+		c.OnMessageFunc(ctx, msg)
+	}
+}
+
+// OnOpampConnectionSettings implements LegacyCallbacks.OnOpampConnectionSettings.
+func (c LegacyCallbacksStruct) OnOpampConnectionSettings(
+	ctx context.Context, settings *protobufs.OpAMPConnectionSettings,
+) error {
+	if c.OnOpampConnectionSettingsFunc != nil {
+		return c.OnOpampConnectionSettingsFunc(ctx, settings)
+	}
+	return nil
+}
+
+// OnOpampConnectionSettingsAccepted implements LegacyCallbacks.OnOpampConnectionSettingsAccepted.
+func (c LegacyCallbacksStruct) OnOpampConnectionSettingsAccepted(settings *protobufs.OpAMPConnectionSettings) {
+	if c.OnOpampConnectionSettingsAcceptedFunc != nil {
+		c.OnOpampConnectionSettingsAcceptedFunc(settings)
+	}
+}
+
+// OnCommand implements LegacyCallbacks.OnCommand.
+func (c LegacyCallbacksStruct) OnCommand(command *protobufs.ServerToAgentCommand) error {
+	if c.OnCommandFunc != nil {
+		return c.OnCommandFunc(command)
+	}
+	return nil
+}
+
+// SaveRemoteConfigStatus implements LegacyCallbacks.SaveRemoteConfigStatus.
+func (c LegacyCallbacksStruct) SaveRemoteConfigStatus(ctx context.Context, status *protobufs.RemoteConfigStatus) {
+	if c.SaveRemoteConfigStatusFunc != nil {
+		c.SaveRemoteConfigStatusFunc(ctx, status)
+	}
+}
+
+// GetEffectiveConfig implements LegacyCallbacks.GetEffectiveConfig.
+func (c LegacyCallbacksStruct) GetEffectiveConfig(ctx context.Context) (*protobufs.EffectiveConfig, error) {
+	if c.GetEffectiveConfigFunc != nil {
+		return c.GetEffectiveConfigFunc(ctx)
+	}
+	return nil, nil
+}
@@ -0,0 +1,73 @@
+package types
+
+import "time"
+
+// Names of the counters that the client reports to the MetricsRecorder.
+const (
+	// MetricWatchdogReconnects counts the reconnects forced by the watchdog because
+	// the connection stalled (see StartSettings.WatchdogInterval).
+	MetricWatchdogReconnects = "opamp.client.watchdog.reconnects"
+
+	// MetricCallbackTimeoutsPrefix is the prefix of the counters of the Callbacks
+	// calls that ran longer than StartSettings.CallbackTimeout. The name of the
+	// callback is appended, e.g. "opamp.client.callback.timeouts.OnMessage".
+	MetricCallbackTimeoutsPrefix = "opamp.client.callback.timeouts."
+
+	// MetricSpecViolations counts the messages received from the Server that were
+	// rejected because they violate the OpAMP specification (see
+	// StartSettings.StrictSpecCompliance).
+	MetricSpecViolations = "opamp.client.spec_violations"
+
+	// MetricUnverifiedResponses counts the messages received from the Server that
+	// were rejected because their signature is missing or invalid (see
+	// StartSettings.ResponseVerificationKey).
+	MetricUnverifiedResponses = "opamp.client.unverified_responses"
+
+	// MetricMemoryLimitExceeded counts the times the client degraded because its
+	// buffers did not fit in the memory limit (see StartSettings.MemoryLimit).
+	MetricMemoryLimitExceeded = "opamp.client.memory_limit.exceeded"
+)
+
+// Names of the durations that the client reports to the DurationRecorder.
+const (
+	// MetricCallbackDurationPrefix is the prefix of the durations of the Callbacks
+	// calls. The name of the callback is appended, e.g.
+	// "opamp.client.callback.duration.OnMessage".
+	MetricCallbackDurationPrefix = "opamp.client.callback.duration."
+)
+
+// Names of the sizes that the client reports to the SizeRecorder.
+const (
+	// MetricSentUncompressedBytes is the size of every message sent to the Server
+	// before the compression.
+	MetricSentUncompressedBytes = "opamp.client.sent.uncompressed_bytes"
+
+	// MetricSentCompressedBytes is the size of every message sent to the Server
+	// after the compression, equal to the uncompressed size if the message was not
+	// compressed.
+	MetricSentCompressedBytes = "opamp.client.sent.compressed_bytes"
+)
+
+// MetricsRecorder receives the metrics about the operation of the client. It can
+// be used to export the metrics to the monitoring system of the Agent.
+// The methods may be called concurrently.
+type MetricsRecorder interface {
+	// IncrementCounter increments the counter with the specified name by one.
+	IncrementCounter(name string)
+}
+
+// DurationRecorder may be implemented by the MetricsRecorder to also receive the
+// durations measured by the client, e.g. to record them in histograms.
+// The methods may be called concurrently.
+type DurationRecorder interface {
+	// RecordDuration records a duration of the metric with the specified name.
+	RecordDuration(name string, duration time.Duration)
+}
+
+// SizeRecorder may be implemented by the MetricsRecorder to also receive the sizes
+// measured by the client, e.g. to record them in histograms.
+// The methods may be called concurrently.
+type SizeRecorder interface {
+	// RecordSize records a size in bytes of the metric with the specified name.
+	RecordSize(name string, bytes int64)
+}
@@ -0,0 +1,20 @@
+package types
+
+import "github.com/open-telemetry/opamp-go/protobufs"
+
+// Outbox persists the state of the Agent that is not yet delivered to the Server,
+// so that it survives restarts of the Agent while the Server is unreachable, see
+// StartSettings.Outbox. client/outbox provides a file-based implementation.
+// The methods are not called concurrently.
+type Outbox interface {
+	// Save replaces the journaled message by msg. msg carries only the instance
+	// uid, the statuses and the flags that are not yet delivered.
+	Save(msg *protobufs.AgentToServer) error
+
+	// Load returns the message last saved via Save, nil if none is saved, e.g.
+	// because it was cleared.
+	Load() (*protobufs.AgentToServer, error)
+
+	// Clear removes the journaled message once it is delivered.
+	Clear() error
+}
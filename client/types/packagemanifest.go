@@ -0,0 +1,64 @@
+package types
+
+import (
+	"context"
+	"io"
+)
+
+// PackageManifestURLFragment is the fragment that the Server appends to the
+// DownloadableFile.DownloadUrl of package files that are manifests of multi-file
+// packages, e.g. "https://example.com/agent-1.0.json#opamp-manifest". The content of
+// such file is a JSON encoded PackageManifest. The DownloadableFile.ContentHash of
+// the manifest must be the SHA256 hash of the manifest content, so that the hashes of
+// the files listed in it can be trusted. PackagesSyncer downloads and verifies all
+// files listed in the manifest and stores them using PackageFilesUpdater.
+const PackageManifestURLFragment = "opamp-manifest"
+
+// PackageManifest describes a package that consists of multiple files, e.g. an Agent
+// that is shipped as a directory tree.
+type PackageManifest struct {
+	Files []PackageManifestFile `json:"files"`
+}
+
+// PackageManifestFile is a file of a multi-file package.
+type PackageManifestFile struct {
+	// Path of the file relative to the package root, using "/" as separator.
+	Path string `json:"path"`
+
+	// DownloadUrl is the URL the file can be downloaded from. Relative URLs are
+	// resolved against the URL of the manifest.
+	DownloadUrl string `json:"download_url"`
+
+	// SHA256 is the hex encoded SHA256 hash of the file content.
+	SHA256 string `json:"sha256"`
+}
+
+// PackageFilesUpdater must be implemented by the PackagesStateProvider to accept
+// multi-file packages (see PackageManifestURLFragment).
+// PackagesSyncer.Sync() calls BeginFilesUpdate, writes every file of the package
+// using the returned PackageFilesUpdate and commits it once all files are stored
+// successfully. Then it calls PackagesStateProvider.UpdateContent with the content
+// of the manifest itself.
+type PackageFilesUpdater interface {
+	// BeginFilesUpdate starts replacing the files of the package. The files written
+	// using the returned PackageFilesUpdate must not be visible as the files of the
+	// package until the update is committed.
+	BeginFilesUpdate(ctx context.Context, packageName string) (PackageFilesUpdate, error)
+}
+
+// PackageFilesUpdate is an update of the files of a multi-file package. Either Commit
+// or Abort must be called when the update is finished.
+type PackageFilesUpdate interface {
+	// WriteFile creates the file at the path relative to the package root. The data
+	// must be read until it returns an EOF. If reading from data fails WriteFile
+	// must abort and return an error.
+	// The function must cancel and return an error if the context is cancelled.
+	WriteFile(ctx context.Context, path string, data io.Reader) error
+
+	// Commit atomically replaces the files of the package with the written files.
+	// The files of the package that were not written in this update are deleted.
+	Commit(ctx context.Context) error
+
+	// Abort discards the written files. The files of the package are not changed.
+	Abort() error
+}
@@ -0,0 +1,32 @@
+package types
+
+import (
+	"context"
+	"io"
+)
+
+// Keys of the DownloadableFile.DownloadUrl fragment that the Server uses to offer a
+// package file as a binary patch against the content the Agent already has, e.g.:
+//
+//	https://example.com/agent-1.1-from-1.0.bsdiff#opamp-patch=<base>&full=<full URL>
+//
+// where <base> is the hex encoded content hash of the package file that the patch
+// must be applied to and <full URL> is the URL-escaped URL of the full package file.
+// Patches must be in the BSDIFF40 format produced by bsdiff. For patched files the
+// DownloadableFile.ContentHash must be the SHA256 hash of the patched content, which
+// is verified before the content is updated.
+// If the Agent does not have the base content, or the PackagesStateProvider does not
+// implement PackageContentReader, or the patch cannot be applied, PackagesSyncer
+// downloads the full file instead (if the full URL is specified).
+const (
+	PackagePatchBaseURLFragmentKey = "opamp-patch"
+	PackagePatchFullURLFragmentKey = "full"
+)
+
+// PackageContentReader must be implemented by the PackagesStateProvider to accept
+// package files offered as binary patches (see PackagePatchBaseURLFragmentKey).
+type PackageContentReader interface {
+	// ReadContent returns a reader of the current content of the package file.
+	// The caller must close the reader.
+	ReadContent(ctx context.Context, packageName string) (io.ReadCloser, error)
+}
@@ -0,0 +1,22 @@
+package types
+
+// PackagesDiff is the difference between the packages offered by the Server in
+// PackagesAvailable and the packages in the local storage of the Agent, see
+// MessageData.PackagesDiff. The names are sorted.
+type PackagesDiff struct {
+	// Added are the names of the offered packages that do not exist locally.
+	Added []string
+
+	// Changed are the names of the offered packages that exist locally with a
+	// different hash or type, i.e. that must be downloaded again.
+	Changed []string
+
+	// Removed are the names of the local packages that are no longer offered.
+	Removed []string
+}
+
+// IsEmpty returns true if the local packages are the offered ones, i.e. there is
+// nothing to sync.
+func (d *PackagesDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
@@ -89,3 +89,21 @@ type PackagesStateProvider interface {
 	// periodically during syncing process to save the most recent statuses.
 	SetLastReportedStatuses(statuses *protobufs.PackageStatuses) error
 }
+
+// PackageVerifier is an optional interface that a PackagesStateProvider may implement
+// to verify that the package works after its content is updated, e.g. by running
+// the package executable (see client.ProbeExecutable).
+// If the PackagesStateProvider implements this interface then PackagesSyncer.Sync()
+// calls VerifyPackage after UpdateContent completes successfully and only reports the
+// package as installed if the verification succeeds. If the verification fails
+// RollbackContent is called and the package is reported as failed to install.
+type PackageVerifier interface {
+	// VerifyPackage must verify that the package content is usable and that the
+	// package is of the expected version. Must return an error if the verification
+	// fails. The function must cancel and return an error if the context is cancelled.
+	VerifyPackage(ctx context.Context, packageName string, expectedVersion string) error
+
+	// RollbackContent must restore the package content that existed before the last
+	// UpdateContent call for the package.
+	RollbackContent(ctx context.Context, packageName string) error
+}
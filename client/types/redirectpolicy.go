@@ -0,0 +1,44 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// RedirectPolicy decides whether the client follows a redirect (3xx) response of
+// the Server from the URL from to the URL to. It returns nil to follow the
+// redirect, or an error to fail the request (plain HTTP) or the connection attempt
+// (WebSocket) with it. The failed attempts are retried according to the
+// RetryPolicy. The WebSocket URLs use the ws and wss schemes, also if the Server
+// redirects to an http or https URL.
+//
+// The client follows at most 10 redirects in a row. If all of them are permanent
+// (301 Moved Permanently or 308 Permanent Redirect) the client keeps using the new
+// URL, otherwise it returns to the original URL with the next request or
+// connection. The plain HTTP client resends the message only if the Server
+// redirects with 307 or 308, use one of those for the OpAMP endpoints.
+type RedirectPolicy func(from, to *url.URL) error
+
+// SameOriginRedirects is the RedirectPolicy used if StartSettings.RedirectPolicy is
+// not set: it follows the redirects to the same scheme, host and port only, so that
+// the headers sent to the Server, e.g. the credentials, don't leak to another host.
+func SameOriginRedirects(from, to *url.URL) error {
+	if from.Scheme != to.Scheme || from.Host != to.Host {
+		return fmt.Errorf("redirect to another origin %s://%s is not allowed", to.Scheme, to.Host)
+	}
+	return nil
+}
+
+// FollowRedirects is a RedirectPolicy that follows all redirects.
+func FollowRedirects(from, to *url.URL) error {
+	return nil
+}
+
+// ErrRedirectNotAllowed is returned by NoRedirects.
+var ErrRedirectNotAllowed = errors.New("redirects are not allowed")
+
+// NoRedirects is a RedirectPolicy that follows no redirects.
+func NoRedirects(from, to *url.URL) error {
+	return ErrRedirectNotAllowed
+}
@@ -0,0 +1,42 @@
+package types
+
+import "time"
+
+// RetryPolicy controls how the client retries connecting to the Server (WebSocket)
+// and sending the requests (plain HTTP) after failures. The intervals between the
+// attempts grow exponentially from InitialInterval by Multiplier up to MaxInterval.
+// Every interval is randomized by RandomizationFactor, so that a large fleet of
+// Agents does not reconnect at the same time after an outage of the Server. A
+// longer Retry-After requested by the Server always takes precedence.
+//
+// The zero fields use the values of DefaultRetryPolicy.
+type RetryPolicy struct {
+	// InitialInterval is the interval before the first retry.
+	InitialInterval time.Duration
+
+	// MaxInterval caps the interval between the retries.
+	MaxInterval time.Duration
+
+	// Multiplier the interval grows by after every failed attempt. Must be at least 1.
+	Multiplier float64
+
+	// RandomizationFactor is the jitter of the intervals, at most 1: the client
+	// waits a random duration between interval*(1-RandomizationFactor) and
+	// interval*(1+RandomizationFactor). A negative value disables the jitter.
+	RandomizationFactor float64
+
+	// MaxElapsedTime is for how long the client retries before it gives up. The
+	// WebSocket client then starts retrying again from InitialInterval. The plain
+	// HTTP client drops the message; the Server notices the gap in the sequence
+	// numbers of the next message and asks the Agent to report its full state.
+	// If 0 the client retries forever.
+	MaxElapsedTime time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy used if StartSettings.RetryPolicy is not set.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialInterval:     500 * time.Millisecond,
+	MaxInterval:         time.Minute,
+	Multiplier:          1.5,
+	RandomizationFactor: 0.5,
+}
@@ -0,0 +1,30 @@
+package types
+
+import (
+	"context"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Sender delivers the messages of the OpAMPClient created by client.NewInMemory,
+// which does not connect to a Server itself. It allows driving the client without
+// network, e.g. to assert on the exact messages the client sends in the unit tests
+// of the Agent.
+type Sender interface {
+	// Send delivers the message. If it returns an error the statuses carried by
+	// the message are sent again with the next message, as after a network failure.
+	// Send is not called concurrently.
+	Send(ctx context.Context, msg *protobufs.AgentToServer) error
+}
+
+// SenderFunc is an adapter to use a func as a Sender.
+type SenderFunc func(ctx context.Context, msg *protobufs.AgentToServer) error
+
+// Send implements Sender.Send.
+func (f SenderFunc) Send(ctx context.Context, msg *protobufs.AgentToServer) error {
+	return f(ctx, msg)
+}
+
+// Receiver receives the messages the Server sends to the OpAMPClient created by
+// client.NewInMemory, see client.ConnectInMemory.
+type Receiver func(ctx context.Context, msg *protobufs.ServerToAgent) error
@@ -0,0 +1,49 @@
+package types
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// ServerError is an error reported by the Server in the ErrorResponse of a
+// ServerToAgent message.
+type ServerError struct {
+	// Type of the error.
+	Type protobufs.ServerErrorResponseType
+
+	// Message is the error message in the human readable form.
+	Message string
+
+	// RetryAfter is the interval that the Server asked the Agent to wait before
+	// retrying. Zero if the Server did not include RetryInfo in the error.
+	RetryAfter time.Duration
+
+	// Throttle is how long the client delays sending its next message to the Server
+	// in reaction to the error. Zero if the client does not delay sending.
+	Throttle time.Duration
+}
+
+// NewServerError parses the ErrorResponse received from the Server. The Throttle is
+// left zero.
+func NewServerError(response *protobufs.ServerErrorResponse) *ServerError {
+	return &ServerError{
+		Type:       response.Type,
+		Message:    response.ErrorMessage,
+		RetryAfter: time.Duration(response.GetRetryInfo().GetRetryAfterNanoseconds()),
+	}
+}
+
+func (e *ServerError) Error() string {
+	switch e.Type {
+	case protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest:
+		return fmt.Sprintf("bad request: %s", e.Message)
+	case protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable:
+		if e.RetryAfter > 0 {
+			return fmt.Sprintf("server unavailable, retry after %v: %s", e.RetryAfter, e.Message)
+		}
+		return fmt.Sprintf("server unavailable: %s", e.Message)
+	}
+	return fmt.Sprintf("server error: %s", e.Message)
+}
@@ -0,0 +1,15 @@
+package types
+
+import "github.com/open-telemetry/opamp-go/protobufs"
+
+// SpecViolation describes a message received from the Server that violates the
+// invariants of the OpAMP specification and was rejected by the client, see
+// StartSettings.StrictSpecCompliance.
+type SpecViolation struct {
+	// Message is the rejected message.
+	Message *protobufs.ServerToAgent
+
+	// Violations describe the violated invariants, e.g. "capabilities is not set in
+	// the first message".
+	Violations []string
+}
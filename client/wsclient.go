@@ -2,14 +2,17 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/cenkalti/backoff/v4"
 	"github.com/gorilla/websocket"
+	"golang.org/x/oauth2"
 
 	"github.com/open-telemetry/opamp-go/client/internal"
 	"github.com/open-telemetry/opamp-go/client/types"
@@ -17,24 +20,63 @@ import (
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
+// The schemes of the OpAMPServerURL supported by the WebSocket client.
+var wsSchemes = []string{"ws", "wss", internal.UnixSocketScheme}
+
+// How long Stop waits for the Server to close the connection if its context has no
+// deadline.
+const defaultDisconnectTimeout = 5 * time.Second
+
 // wsClient is an OpAMP Client implementation for WebSocket transport.
 // See specification: https://github.com/open-telemetry/opamp-spec/blob/main/specification.md#websocket-transport
 type wsClient struct {
 	common internal.ClientCommon
 
-	// OpAMP Server URL.
+	// OpAMP Server URL. Replaced by the URL returned by serverURLResolver when
+	// connected and by the accepted offered endpoint, guarded by connMutex.
 	url *url.URL
 
-	// HTTP request headers to use when connecting to OpAMP Server.
+	// Returns the OpAMP Server URL before every connection attempt. nil if not set
+	// or if the client switched to an offered endpoint, guarded by connMutex.
+	serverURLResolver func(ctx context.Context) (string, error)
+
+	// Decides which redirects of the handshake are followed.
+	redirectPolicy types.RedirectPolicy
+
+	// HTTP request headers to use when connecting to OpAMP Server, guarded by
+	// connMutex.
 	requestHeader http.Header
 
-	// Websocket dialer and connection.
-	dialer    websocket.Dialer
-	conn      *websocket.Conn
-	connMutex sync.RWMutex
+	// Returns the additional headers before every connection attempt. nil if not set.
+	headerProvider internal.HeaderProvider
+
+	// The source of the OAuth2 tokens to connect with, nil if not set.
+	tokenSource oauth2.TokenSource
+
+	// Websocket dialer and connection. The TLS config of the dialer changes when
+	// the client switches to the client certificate offered by the Server.
+	dialer           websocket.Dialer
+	compressionLevel int
+	conn             *websocket.Conn
+	connMutex        sync.RWMutex
+
+	// Closed when the receiver loop of conn returned, guarded by connMutex.
+	receiving chan struct{}
+
+	// Records the messages sent and received over the connections. nil if the
+	// capture is not enabled.
+	wireCapture *sharedinternal.WireCapture
+
+	// The time when the OAuth2 token conn was established with is replaced by a new
+	// token, zero if there is none or it does not expire.
+	tokenRefresh time.Time
 
 	// The sender is responsible for sending portion of the OpAMP protocol.
 	sender *internal.WSSender
+
+	// Stalled connection detection settings. Disabled if watchdogInterval is 0.
+	watchdogInterval  time.Duration
+	watchdogMaxMissed int
 }
 
 // NewWebSocket creates a new OpAMP Client that uses WebSocket transport.
@@ -43,9 +85,11 @@ func NewWebSocket(logger types.Logger) *wsClient {
 		logger = &sharedinternal.NopLogger{}
 	}
 
+	redactor := internal.NewRedactor()
+	logger = redactor.Logger(logger)
 	sender := internal.NewSender(logger)
 	w := &wsClient{
-		common: internal.NewClientCommon(logger, sender),
+		common: internal.NewClientCommon(logger, redactor, sender),
 		sender: sender,
 	}
 	return w
@@ -55,41 +99,112 @@ func (c *wsClient) Start(ctx context.Context, settings types.StartSettings) erro
 	if err := c.common.PrepareStart(ctx, settings); err != nil {
 		return err
 	}
+	settings = internal.ResolveUnixSocket(settings, "ws")
 
 	// Prepare connection settings.
-	c.dialer = *websocket.DefaultDialer
-
 	var err error
 	c.url, err = url.Parse(settings.OpAMPServerURL)
 	if err != nil {
-		return err
+		return c.common.Redactor.RedactError(err)
 	}
 
-	c.dialer.EnableCompression = settings.EnableCompression
-
-	if settings.TLSConfig != nil {
-		c.url.Scheme = "wss"
-	}
-	c.dialer.TLSClientConfig = settings.TLSConfig
+	c.serverURLResolver = settings.ServerURLResolver
+	c.redirectPolicy = settings.RedirectPolicy
+	c.dialer = newDialer(settings)
+	c.compressionLevel = settings.CompressionLevel
 
 	c.requestHeader = settings.Header
+	c.headerProvider = settings.HeaderProvider
+	c.tokenSource = internal.TokenSource(settings.TokenSource)
+
+	c.watchdogInterval = settings.WatchdogInterval
+	c.watchdogMaxMissed = settings.WatchdogMaxMissedIntervals
+	c.sender.SetHeartbeatInterval(settings.HeartbeatInterval)
+	c.wireCapture = sharedinternal.NewWireCapture(settings.WireCapture, c.common.Logger)
+	c.sender.SetWireCapture(c.wireCapture)
+
+	var endpointSwitcher internal.EndpointSwitcher
+	if settings.FollowOfferedEndpoint {
+		endpointSwitcher = c.switchEndpoint
+	}
+	c.common.EndpointTransition = internal.NewEndpointTransition(
+		c.verifyEndpoint, c.switchCertificate, endpointSwitcher, settings.OpAMPEndpointGracePeriod,
+	)
 
 	c.common.StartConnectAndRun(c.runUntilStopped)
 
 	return nil
 }
 
+// newDialer returns the dialer to connect to the Server with: a copy of the
+// WebSocketDialer of the settings if set, with only the settings that are set
+// applied, otherwise a dialer based on websocket.DefaultDialer.
+func newDialer(settings types.StartSettings) websocket.Dialer {
+	if settings.WebSocketDialer == nil {
+		dialer := *websocket.DefaultDialer
+		dialer.EnableCompression = settings.EnableCompression
+		dialer.TLSClientConfig = settings.TLSConfig
+		dialer.Proxy = internal.ProxyFunc(settings)
+		dialer.NetDialContext = settings.DialContext
+		return dialer
+	}
+
+	dialer := *settings.WebSocketDialer
+	if settings.EnableCompression {
+		dialer.EnableCompression = true
+	}
+	if settings.TLSConfig != nil {
+		dialer.TLSClientConfig = settings.TLSConfig
+	}
+	if internal.HasProxySettings(settings) {
+		dialer.Proxy = internal.ProxyFunc(settings)
+	}
+	if settings.DialContext != nil {
+		dialer.NetDialContext = settings.DialContext
+	}
+	return dialer
+}
+
 func (c *wsClient) Stop(ctx context.Context) error {
-	// Close connection if any.
+	return c.common.StopAfter(ctx, c.disconnect)
+}
+
+// disconnect closes the connection, if any, gracefully: it sends the AgentDisconnect
+// message and the close frame, and waits until the Server closes the connection too
+// before closing it. The wait ends when ctx is done, or after
+// defaultDisconnectTimeout if ctx has no deadline.
+func (c *wsClient) disconnect(ctx context.Context) {
 	c.connMutex.RLock()
 	conn := c.conn
+	receiving := c.receiving
 	c.connMutex.RUnlock()
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
 
-	if conn != nil {
-		_ = conn.Close()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDisconnectTimeout)
+		defer cancel()
+	}
+	if err := c.sender.Disconnect(ctx); err != nil {
+		// The connection is likely lost already.
+		c.common.Logger.Debugf("Cannot disconnect gracefully: %v", err)
+		return
 	}
+	select {
+	case <-receiving:
+	case <-ctx.Done():
+	}
+}
+
+func (c *wsClient) Restart(ctx context.Context, settings types.StartSettings) error {
+	return restartClient(ctx, c, &c.common, settings)
+}
 
-	return c.common.Stop(ctx)
+func (c *wsClient) SetServerURL(ctx context.Context, serverURL string) error {
+	return setServerURL(ctx, c, &c.common, serverURL, wsSchemes...)
 }
 
 func (c *wsClient) AgentDescription() *protobufs.AgentDescription {
@@ -100,6 +215,10 @@ func (c *wsClient) SetAgentDescription(descr *protobufs.AgentDescription) error
 	return c.common.SetAgentDescription(descr)
 }
 
+func (c *wsClient) RequestInstanceUid() {
+	c.common.RequestInstanceUid()
+}
+
 func (c *wsClient) SetHealth(health *protobufs.AgentHealth) error {
 	return c.common.SetHealth(health)
 }
@@ -116,15 +235,50 @@ func (c *wsClient) SetPackageStatuses(statuses *protobufs.PackageStatuses) error
 	return c.common.SetPackageStatuses(statuses)
 }
 
+func (c *wsClient) CompressionStats() types.CompressionStats {
+	return c.common.CompressionStats()
+}
+
+func (c *wsClient) ConnectionState() types.ConnectionState {
+	return c.common.ConnectionState()
+}
+
+func (c *wsClient) Flush(ctx context.Context) error {
+	return c.common.Flush(ctx)
+}
+
 // Try to connect once. Returns an error if connection fails and optional retryAfter
 // duration to indicate to the caller to retry after the specified time as instructed
 // by the Server.
 func (c *wsClient) tryConnectOnce(ctx context.Context) (err error, retryAfter sharedinternal.OptionalDuration) {
 	var resp *http.Response
-	conn, resp, err := c.dialer.DialContext(ctx, c.url.String(), c.requestHeader)
+	c.connMutex.RLock()
+	dialer := c.dialer
+	requestHeader := c.requestHeader
+	c.connMutex.RUnlock()
+	var tokenRefresh time.Time
+	headerProvider := internal.TokenHeaderProvider(c.tokenSource, c.headerProvider, func(token *oauth2.Token) {
+		tokenRefresh = internal.TokenRefreshTime(token)
+	})
+	header, err := internal.ProvidedHeader(ctx, requestHeader, headerProvider, c.common.Redactor)
 	if err != nil {
 		if c.common.Callbacks != nil && !c.common.IsStopping() {
-			c.common.Callbacks.OnConnectFailed(err)
+			c.common.Callbacks.OnConnectFailed(c.common.Redactor.RedactError(err))
+		}
+		return err, sharedinternal.OptionalDuration{Defined: false}
+	}
+	serverURL, err := c.resolveServerURL(ctx)
+	if err != nil {
+		if c.common.Callbacks != nil && !c.common.IsStopping() {
+			c.common.Callbacks.OnConnectFailed(c.common.Redactor.RedactError(err))
+		}
+		return err, sharedinternal.OptionalDuration{Defined: false}
+	}
+	redirector := internal.NewWSRedirector(c.redirectPolicy, c.common.Logger)
+	conn, resp, endpoint, err := c.dial(ctx, dialer, serverURL, header, redirector)
+	if err != nil {
+		if c.common.Callbacks != nil && !c.common.IsStopping() {
+			c.common.Callbacks.OnConnectFailed(c.common.Redactor.RedactError(err))
 		}
 		if resp != nil {
 			c.common.Logger.Errorf("Server responded with status=%v", resp.Status)
@@ -135,61 +289,218 @@ func (c *wsClient) tryConnectOnce(ctx context.Context) (err error, retryAfter sh
 	}
 
 	// Successfully connected.
+	if c.compressionLevel != 0 {
+		// Validated by PrepareStart. Has no effect if the Server declined the compression.
+		_ = conn.SetCompressionLevel(c.compressionLevel)
+	}
+	if redirector.Permanent() {
+		// Connect to the new URL the next time.
+		serverURL = endpoint
+	}
 	c.connMutex.Lock()
 	c.conn = conn
+	c.receiving = make(chan struct{})
+	c.url = serverURL
+	c.tokenRefresh = tokenRefresh
 	c.connMutex.Unlock()
+	info := c.connectionInfo(conn, resp, endpoint)
+	c.sender.SetCompression(info.CompressionEnabled, c.compressionLevel)
 	if c.common.Callbacks != nil {
-		c.common.Callbacks.OnConnect()
+		c.common.Callbacks.OnConnect(info)
 	}
 
 	return nil, sharedinternal.OptionalDuration{Defined: false}
 }
 
-// Continuously try until connected. Will return nil when successfully
-// connected. Will return error if it is cancelled via context.
-func (c *wsClient) ensureConnected(ctx context.Context) error {
-	infiniteBackoff := backoff.NewExponentialBackOff()
+// dial connects to the Server at serverURL, following the redirects allowed by the
+// redirector. Returns the URL of the endpoint it connected to.
+func (c *wsClient) dial(
+	ctx context.Context, dialer websocket.Dialer, serverURL *url.URL, header http.Header,
+	redirector *internal.WSRedirector,
+) (*websocket.Conn, *http.Response, *url.URL, error) {
+	endpoint := serverURL
+	for {
+		conn, resp, err := dialer.DialContext(ctx, endpoint.String(), header)
+		if err == nil {
+			return conn, resp, endpoint, nil
+		}
+		location, redirected, redirectErr := redirector.Next(endpoint, resp)
+		if redirectErr != nil {
+			return nil, resp, endpoint, redirectErr
+		}
+		if !redirected {
+			return nil, resp, endpoint, err
+		}
+		endpoint = location
+	}
+}
+
+// resolveServerURL returns the URL of the Server to connect to: the URL returned by
+// the serverURLResolver if set, otherwise the OpAMPServerURL.
+func (c *wsClient) resolveServerURL(ctx context.Context) (*url.URL, error) {
+	c.connMutex.RLock()
+	serverURL := c.url
+	resolver := c.serverURLResolver
+	c.connMutex.RUnlock()
+	if resolver == nil {
+		return serverURL, nil
+	}
+
+	resolved, err := resolver(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve the OpAMP Server URL: %w", err)
+	}
+	c.common.Redactor.AddURL(resolved)
+	serverURL, err = url.Parse(resolved)
+	if err != nil {
+		// Don't leak the secrets of the URL to the error.
+		return nil, fmt.Errorf("invalid resolved OpAMP Server URL: %w", errors.Unwrap(err))
+	}
+	if serverURL.Scheme != "ws" && serverURL.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported resolved OpAMP Server URL scheme %q, must be ws or wss", serverURL.Scheme)
+	}
+	return serverURL, nil
+}
 
-	// Make ticker run forever.
-	infiniteBackoff.MaxElapsedTime = 0
+// connectionInfo describes the WebSocket connection established to the endpoint.
+func (c *wsClient) connectionInfo(conn *websocket.Conn, resp *http.Response, endpoint *url.URL) types.ConnectionInfo {
+	info := types.ConnectionInfo{
+		Endpoint:  sharedinternal.RedactURL(endpoint.String()),
+		Transport: types.TransportWebSocket,
+	}
 
-	interval := time.Duration(0)
+	// Compression is only used if the Server accepted the extension.
+	if c.dialer.EnableCompression && resp != nil {
+		for _, ext := range resp.Header.Values("Sec-Websocket-Extensions") {
+			if strings.Contains(ext, "permessage-deflate") {
+				info.CompressionEnabled = true
+			}
+		}
+	}
 
-	for {
-		timer := time.NewTimer(interval)
-		interval = infiniteBackoff.NextBackOff()
+	if tlsConn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		internal.SetConnectionInfoTLS(&info, &state)
+	}
+	return info
+}
 
-		select {
-		case <-timer.C:
-			{
-				if err, retryAfter := c.tryConnectOnce(ctx); err != nil {
-					if errors.Is(err, context.Canceled) {
-						c.common.Logger.Debugf("Client is stopped, will not try anymore.")
-						return err
-					} else {
-						c.common.Logger.Errorf("Connection failed (%v), will retry.", err)
-					}
-					// Retry again a bit later.
-
-					if retryAfter.Defined && retryAfter.Duration > interval {
-						// If the Server suggested connecting later than our interval
-						// then honour Server's request, otherwise wait at least
-						// as much as we calculated.
-						interval = retryAfter.Duration
-					}
-
-					continue
-				}
-				// Connected successfully.
-				return nil
+// verifyEndpoint connects to the OpAMP Server endpoint offered in the settings, or to
+// the current endpoint if none is offered, using the headers and the TLS certificates
+// specified in the offer, and verifies that the connection stays open during the
+// grace period. The connection is only used for the verification, no messages are
+// sent over it.
+func (c *wsClient) verifyEndpoint(
+	ctx context.Context, settings *protobufs.OpAMPConnectionSettings, gracePeriod time.Duration,
+) error {
+	c.connMutex.RLock()
+	endpoint := settings.DestinationEndpoint
+	if endpoint == "" {
+		endpoint = c.url.String()
+	}
+	requestHeader := c.requestHeader
+	c.connMutex.RUnlock()
+	headerProvider := internal.TokenHeaderProvider(c.tokenSource, c.headerProvider, nil)
+	header, err := internal.ProvidedHeader(ctx, requestHeader, headerProvider, c.common.Redactor)
+	if err != nil {
+		return err
+	}
+	header = internal.OfferedRequestHeader(header, settings.Headers)
+	c.common.Redactor.AddHeader(internal.OfferedRequestHeader(nil, settings.Headers))
+	c.connMutex.RLock()
+	dialer := c.dialer
+	c.connMutex.RUnlock()
+	tlsConfig, err := internal.OfferedTLSConfig(dialer.TLSClientConfig, settings.Certificate)
+	if err != nil {
+		return err
+	}
+	dialer.TLSClientConfig = tlsConfig
+
+	conn, resp, err := dialer.DialContext(ctx, endpoint, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%w, server responded with status=%v", err, resp.Status)
+		}
+		return err
+	}
+	defer conn.Close()
+
+	// Read (and discard) anything the Server sends to detect the connection closing.
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				readErr <- err
+				return
 			}
+		}
+	}()
 
-		case <-ctx.Done():
-			c.common.Logger.Debugf("Client is stopped, will not try anymore.")
-			timer.Stop()
-			return ctx.Err()
+	return internal.VerifyEndpointHealth(ctx, gracePeriod, func() error {
+		select {
+		case err := <-readErr:
+			return fmt.Errorf("connection closed: %w", err)
+		default:
+			return nil
 		}
+	})
+}
+
+// switchCertificate starts using the client certificate offered by the Server. The
+// current connection is closed, so that the client reconnects with the certificate.
+func (c *wsClient) switchCertificate(offered *protobufs.TLSCertificate) error {
+	c.connMutex.Lock()
+	tlsConfig, err := internal.OfferedTLSConfig(c.dialer.TLSClientConfig, offered)
+	if err != nil {
+		c.connMutex.Unlock()
+		return err
 	}
+	c.dialer.TLSClientConfig = tlsConfig
+	conn := c.conn
+	c.connMutex.Unlock()
+
+	if conn != nil {
+		c.common.Logger.Debugf("Reconnecting with the offered client certificate.")
+		_ = conn.Close()
+	}
+	return nil
+}
+
+// switchEndpoint starts using the destination endpoint of the accepted settings, with
+// the offered headers and client certificate, instead of the OpAMPServerURL and the
+// ServerURLResolver. The current connection is closed, so that the client reconnects
+// to the endpoint.
+func (c *wsClient) switchEndpoint(settings *protobufs.OpAMPConnectionSettings) error {
+	endpoint, err := internal.ParseServerURL(settings.DestinationEndpoint, "ws", "wss")
+	if err != nil {
+		return err
+	}
+	c.common.Redactor.AddURL(settings.DestinationEndpoint)
+
+	c.connMutex.Lock()
+	tlsConfig, err := internal.OfferedTLSConfig(c.dialer.TLSClientConfig, settings.Certificate)
+	if err != nil {
+		c.connMutex.Unlock()
+		return err
+	}
+	c.dialer.TLSClientConfig = tlsConfig
+	c.url = endpoint
+	c.serverURLResolver = nil
+	c.requestHeader = internal.OfferedRequestHeader(c.requestHeader, settings.Headers)
+	conn := c.conn
+	c.connMutex.Unlock()
+
+	if conn != nil {
+		c.common.Logger.Debugf("Reconnecting to the offered endpoint.")
+		_ = conn.Close()
+	}
+	return nil
+}
+
+// Continuously try until connected. Will return nil when successfully
+// connected. Will return error if it is cancelled via context.
+func (c *wsClient) ensureConnected(ctx context.Context) error {
+	return c.common.EnsureConnected(ctx, c.tryConnectOnce)
 }
 
 // runOneCycle performs the following actions:
@@ -204,6 +515,10 @@ func (c *wsClient) runOneCycle(ctx context.Context) {
 		// are being stopped.
 		return
 	}
+	c.connMutex.RLock()
+	receiving := c.receiving
+	c.connMutex.RUnlock()
+	defer close(receiving)
 
 	if c.common.IsStopping() {
 		_ = c.conn.Close()
@@ -214,6 +529,7 @@ func (c *wsClient) runOneCycle(ctx context.Context) {
 	err := c.common.PrepareFirstMessage(ctx)
 	if err != nil {
 		c.common.Logger.Errorf("cannot prepare the first message:%v", err)
+		c.common.ConnectionLost(err)
 		return
 	}
 
@@ -227,6 +543,7 @@ func (c *wsClient) runOneCycle(ctx context.Context) {
 		// We could not send the report, the only thing we can do is start over.
 		_ = c.conn.Close()
 		procCancel()
+		c.common.ConnectionLost(err)
 		return
 	}
 
@@ -238,12 +555,25 @@ func (c *wsClient) runOneCycle(ctx context.Context) {
 		c.sender,
 		&c.common.ClientSyncedState,
 		c.common.PackagesStateProvider,
+		c.common.PackageDownloads,
+		c.common.EndpointTransition,
 		c.common.Capabilities,
+		c.common.SpecCompliance,
+		c.common.ResponseVerifier,
 	)
-	r.ReceiverLoop(ctx)
+	r.SetWireCapture(c.wireCapture)
+	if c.watchdogInterval > 0 {
+		r.OnReceive(c.startWatchdog(procCtx, c.conn).Touch)
+	}
+	if !c.tokenRefresh.IsZero() {
+		conn := c.conn
+		go c.common.ReconnectOnTokenRefresh(procCtx, c.tokenRefresh, func() { _ = conn.Close() })
+	}
+	err = r.ReceiverLoop(ctx)
 
 	// Stop the background processors.
 	procCancel()
+	c.common.ConnectionLost(err)
 
 	// If we exited receiverLoop it means there is a connection error, we cannot
 	// read messages anymore. We need to start over.
@@ -255,6 +585,28 @@ func (c *wsClient) runOneCycle(ctx context.Context) {
 	c.sender.WaitToStop()
 }
 
+// startWatchdog starts the detection of the stalled conn. If the Server stops
+// responding the conn is closed, which makes the receiver loop exit and the client
+// reconnect. The returned Watchdog must be touched when a message is received.
+func (c *wsClient) startWatchdog(ctx context.Context, conn *websocket.Conn) *internal.Watchdog {
+	watchdog := internal.NewWatchdog(c.watchdogInterval, c.watchdogMaxMissed)
+	conn.SetPongHandler(func(string) error {
+		watchdog.Touch()
+		return nil
+	})
+
+	ping := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.watchdogInterval))
+	}
+	onStalled := func(silence time.Duration) {
+		c.common.Logger.Errorf("Nothing received from the Server for %v, reconnecting.", silence)
+		c.common.IncrementCounter(types.MetricWatchdogReconnects)
+		_ = conn.Close()
+	}
+	go watchdog.Run(ctx, ping, onStalled)
+	return watchdog
+}
+
 func (c *wsClient) runUntilStopped(ctx context.Context) {
 	// Iterates until we detect that the client is stopping.
 	for {
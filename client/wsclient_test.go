@@ -1,11 +1,15 @@
 package client
 
 import (
+	"compress/flate"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
@@ -31,7 +35,7 @@ func TestDisconnectWSByServer(t *testing.T) {
 	var connectErr atomic.Value
 	settings := types.StartSettings{
 		Callbacks: types.CallbacksStruct{
-			OnConnectFunc: func() {
+			OnConnectFunc: func(info types.ConnectionInfo) {
 				atomic.StoreInt64(&connected, 1)
 			},
 			OnConnectFailedFunc: func(err error) {
@@ -59,11 +63,82 @@ func TestDisconnectWSByServer(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestWSStopDisconnects(t *testing.T) {
+	// Start a Server that records the close frame of the client.
+	srv := internal.StartMockServer(t)
+	var closeCode int64
+	srv.OnWSConnect = func(c *websocket.Conn) {
+		c.SetCloseHandler(func(code int, text string) error {
+			atomic.StoreInt64(&closeCode, int64(code))
+			message := websocket.FormatCloseMessage(code, "")
+			return c.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		})
+	}
+	var lastMsg atomic.Value
+	srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+		lastMsg.Store(msg)
+		return nil
+	}
+
+	settings := types.StartSettings{OpAMPServerURL: "ws://" + srv.Endpoint}
+	client := NewWebSocket(nil)
+	startClient(t, settings, client)
+	eventually(t, func() bool { return lastMsg.Load() != nil })
+
+	// The last message carries AgentDisconnect and is followed by the close frame,
+	// Stop returns once the Server closed the connection.
+	assert.NoError(t, client.Stop(context.Background()))
+	msg := lastMsg.Load().(*protobufs.AgentToServer)
+	assert.NotNil(t, msg.AgentDisconnect)
+	assert.EqualValues(t, 1, msg.SequenceNum)
+	assert.EqualValues(t, websocket.CloseNormalClosure, atomic.LoadInt64(&closeCode))
+
+	srv.Close()
+}
+
+func TestWSStopDisconnectTimeout(t *testing.T) {
+	// Start a Server that never closes the connection.
+	srv := internal.StartMockServer(t)
+	srv.OnWSConnect = func(c *websocket.Conn) {
+		c.SetCloseHandler(func(code int, text string) error { return nil })
+	}
+	var connected int64
+	settings := types.StartSettings{
+		OpAMPServerURL: "ws://" + srv.Endpoint,
+		Callbacks: types.CallbacksStruct{
+			OnConnectFunc: func(info types.ConnectionInfo) { atomic.StoreInt64(&connected, 1) },
+		},
+	}
+	client := NewWebSocket(nil)
+	startClient(t, settings, client)
+	eventually(t, func() bool { return atomic.LoadInt64(&connected) == 1 })
+
+	// The client stops waiting for the Server when ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := client.Stop(ctx); err != nil {
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.NoError(t, client.Stop(context.Background()))
+	}
+	assert.Less(t, time.Since(start), defaultDisconnectTimeout)
+
+	srv.Close()
+}
+
 func TestVerifyWSCompress(t *testing.T) {
 
-	tests := []bool{false, true}
-	for _, withCompression := range tests {
-		t.Run(fmt.Sprintf("%v", withCompression), func(t *testing.T) {
+	tests := []struct {
+		withCompression  bool
+		compressionLevel int
+	}{
+		{withCompression: false},
+		{withCompression: true},
+		{withCompression: true, compressionLevel: flate.BestCompression},
+	}
+	for _, test := range tests {
+		withCompression := test.withCompression
+		t.Run(fmt.Sprintf("%v/level=%d", withCompression, test.compressionLevel), func(t *testing.T) {
 
 			// Start a Server.
 			srv := internal.StartMockServer(t)
@@ -112,6 +187,7 @@ func TestVerifyWSCompress(t *testing.T) {
 
 			if withCompression {
 				settings.EnableCompression = true
+				settings.CompressionLevel = test.compressionLevel
 			}
 
 			client := NewWebSocket(nil)
@@ -164,6 +240,19 @@ func TestVerifyWSCompress(t *testing.T) {
 
 			fmt.Printf("sent %d, received %d\n", proxy.ClientToServerBytes(), proxy.ServerToClientBytes())
 
+			// The messages sent on the wire are at least as large as reported.
+			stats := client.CompressionStats()
+			assert.GreaterOrEqual(t, stats.Messages, int64(2))
+			assert.Greater(t, stats.UncompressedBytes, int64(len(uncompressedCfg)))
+			assert.LessOrEqual(t, stats.CompressedBytes, int64(proxy.ClientToServerBytes()))
+			if withCompression {
+				assert.Equal(t, stats.Messages, stats.CompressedMessages)
+				assert.Less(t, stats.Ratio(), 0.1)
+			} else {
+				assert.Zero(t, stats.CompressedMessages)
+				assert.Equal(t, stats.UncompressedBytes, stats.CompressedBytes)
+			}
+
 			if withCompression {
 				// With compression the entire bytes exchanged should be less than the config body.
 				// This is only possible if there is any compression happening.
@@ -177,3 +266,211 @@ func TestVerifyWSCompress(t *testing.T) {
 		})
 	}
 }
+
+type testMetrics struct {
+	watchdogReconnects  int64
+	specViolations      int64
+	memoryLimitExceeded int64
+	unverifiedResponses int64
+}
+
+func (m *testMetrics) IncrementCounter(name string) {
+	switch name {
+	case types.MetricWatchdogReconnects:
+		atomic.AddInt64(&m.watchdogReconnects, 1)
+	case types.MetricSpecViolations:
+		atomic.AddInt64(&m.specViolations, 1)
+	case types.MetricMemoryLimitExceeded:
+		atomic.AddInt64(&m.memoryLimitExceeded, 1)
+	case types.MetricUnverifiedResponses:
+		atomic.AddInt64(&m.unverifiedResponses, 1)
+	}
+}
+
+func TestWSWatchdog(t *testing.T) {
+	tests := []struct {
+		name    string
+		stalled bool
+	}{
+		{name: "healthy", stalled: false},
+		{name: "stalled", stalled: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := internal.StartMockServer(t)
+			srv.OnWSConnect = func(c *websocket.Conn) {
+				if test.stalled {
+					// Don't respond to pings, so that the connection looks stalled.
+					c.SetPingHandler(func(string) error { return nil })
+				}
+			}
+
+			var connected int64
+			metrics := &testMetrics{}
+			settings := types.StartSettings{
+				OpAMPServerURL:   "ws://" + srv.Endpoint,
+				WatchdogInterval: 50 * time.Millisecond,
+				Metrics:          metrics,
+				Callbacks: types.CallbacksStruct{
+					OnConnectFunc: func(info types.ConnectionInfo) {
+						atomic.AddInt64(&connected, 1)
+					},
+				},
+			}
+			client := NewWebSocket(nil)
+			startClient(t, settings, client)
+
+			eventually(t, func() bool { return atomic.LoadInt64(&connected) == 1 })
+
+			if test.stalled {
+				// The watchdog must close the connection and the client must reconnect.
+				eventually(t, func() bool { return atomic.LoadInt64(&connected) >= 2 })
+				assert.GreaterOrEqual(t, atomic.LoadInt64(&metrics.watchdogReconnects), int64(1))
+			} else {
+				// Pongs keep the connection alive well beyond the stall threshold.
+				time.Sleep(500 * time.Millisecond)
+				assert.EqualValues(t, 1, atomic.LoadInt64(&connected))
+				assert.EqualValues(t, 0, atomic.LoadInt64(&metrics.watchdogReconnects))
+			}
+
+			err := client.Stop(context.Background())
+			assert.NoError(t, err)
+			srv.Close()
+		})
+	}
+}
+
+func TestWSHeartbeat(t *testing.T) {
+	var mux sync.Mutex
+	var received []*protobufs.AgentToServer
+	srv := internal.StartMockServer(t)
+	srv.OnMessage = func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+		mux.Lock()
+		received = append(received, msg)
+		mux.Unlock()
+		return nil
+	}
+	count := func() int {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(received)
+	}
+
+	settings := types.StartSettings{
+		OpAMPServerURL:    "ws://" + srv.Endpoint,
+		HeartbeatInterval: 50 * time.Millisecond,
+	}
+	client := NewWebSocket(nil)
+	startClient(t, settings, client)
+
+	// The first status report is followed by the heartbeats.
+	eventually(t, func() bool { return count() >= 4 })
+	assert.NoError(t, client.Stop(context.Background()))
+	srv.Close()
+
+	mux.Lock()
+	defer mux.Unlock()
+	assert.NotNil(t, received[0].AgentDescription)
+	for i, msg := range received[1:] {
+		// The heartbeats carry no status, only the identification of the Agent.
+		assert.EqualValues(t, i+1, msg.SequenceNum)
+		assert.Equal(t, received[0].InstanceUid, msg.InstanceUid)
+		assert.Equal(t, received[0].Capabilities, msg.Capabilities)
+		assert.Nil(t, msg.AgentDescription)
+	}
+}
+
+func TestWSServerURLResolver(t *testing.T) {
+	srv1 := internal.StartMockServer(t)
+	var srv1Conn atomic.Value
+	srv1.OnWSConnect = func(c *websocket.Conn) {
+		srv1Conn.Store(c)
+	}
+	srv2 := internal.StartMockServer(t)
+	var srv2Connected int64
+	srv2.OnWSConnect = func(c *websocket.Conn) {
+		atomic.StoreInt64(&srv2Connected, 1)
+	}
+
+	// The resolver fails once, then returns the URL of the current Server.
+	var target atomic.Value
+	target.Store("ws://" + srv1.Endpoint)
+	var resolved int64
+	resolver := func(ctx context.Context) (string, error) {
+		if atomic.AddInt64(&resolved, 1) == 1 {
+			return "", fmt.Errorf("no Server registered")
+		}
+		return target.Load().(string), nil
+	}
+
+	var connectErr atomic.Value
+	var endpoint atomic.Value
+	settings := types.StartSettings{
+		ServerURLResolver: resolver,
+		Callbacks: types.CallbacksStruct{
+			OnConnectFunc: func(info types.ConnectionInfo) {
+				endpoint.Store(info.Endpoint)
+			},
+			OnConnectFailedFunc: func(err error) {
+				connectErr.Store(err)
+			},
+		},
+		RetryPolicy: types.RetryPolicy{InitialInterval: 10 * time.Millisecond},
+	}
+	client := NewWebSocket(nil)
+	prepareClient(t, &settings, client)
+	settings.OpAMPServerURL = ""
+	assert.NoError(t, client.Start(context.Background(), settings))
+
+	eventually(t, func() bool { return srv1Conn.Load() != nil })
+	assert.Contains(t, connectErr.Load().(error).Error(), "cannot resolve the OpAMP Server URL: no Server registered")
+	assert.Equal(t, "ws://"+srv1.Endpoint, endpoint.Load())
+
+	// The resolver is called again when the client reconnects.
+	target.Store("ws://" + srv2.Endpoint)
+	srv1.Close()
+	_ = srv1Conn.Load().(*websocket.Conn).Close()
+	eventually(t, func() bool { return atomic.LoadInt64(&srv2Connected) == 1 })
+	eventually(t, func() bool { return endpoint.Load() == "ws://"+srv2.Endpoint })
+
+	assert.NoError(t, client.Stop(context.Background()))
+	srv2.Close()
+}
+
+func TestServerURLResolverNotSupported(t *testing.T) {
+	resolver := func(ctx context.Context) (string, error) { return "", nil }
+	for _, client := range []OpAMPClient{NewHTTP(nil), NewGRPC(nil)} {
+		settings := types.StartSettings{OpAMPServerURL: "http://localhost:4320", ServerURLResolver: resolver}
+		prepareClient(t, &settings, client)
+		err := client.Start(context.Background(), settings)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "ServerURLResolver is not supported")
+	}
+}
+
+func TestNewDialerKeepsCustomDialerSettings(t *testing.T) {
+	custom := &websocket.Dialer{
+		HandshakeTimeout:  time.Second,
+		EnableCompression: true,
+		TLSClientConfig:   &tls.Config{ServerName: "custom"},
+	}
+
+	// The unset settings do not override the custom dialer.
+	dialer := newDialer(types.StartSettings{WebSocketDialer: custom})
+	assert.Equal(t, time.Second, dialer.HandshakeTimeout)
+	assert.True(t, dialer.EnableCompression)
+	assert.Equal(t, "custom", dialer.TLSClientConfig.ServerName)
+	assert.Nil(t, dialer.Proxy)
+
+	// The set settings are applied to a copy of the custom dialer.
+	dialer = newDialer(types.StartSettings{
+		WebSocketDialer: custom,
+		TLSConfig:       &tls.Config{ServerName: "settings"},
+		ProxyURL:        "http://proxy:3128",
+	})
+	assert.Equal(t, "settings", dialer.TLSClientConfig.ServerName)
+	assert.NotNil(t, dialer.Proxy)
+	assert.Equal(t, "custom", custom.TLSClientConfig.ServerName)
+	assert.Nil(t, custom.Proxy)
+}
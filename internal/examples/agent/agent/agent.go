@@ -19,6 +19,9 @@ import (
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
+// ServerURL is the URL of the OpAMP Server the Agent connects to.
+const ServerURL = "ws://127.0.0.1:4320/v1/opamp"
+
 const localConfig = `
 exporters:
   otlp:
@@ -82,17 +85,17 @@ func (agent *Agent) start() error {
 	agent.opampClient = client.NewWebSocket(agent.logger)
 
 	settings := types.StartSettings{
-		OpAMPServerURL: "ws://127.0.0.1:4320/v1/opamp",
+		OpAMPServerURL: ServerURL,
 		InstanceUid:    agent.instanceId.String(),
 		Callbacks: types.CallbacksStruct{
-			OnConnectFunc: func() {
-				agent.logger.Debugf("Connected to the server.")
+			OnConnectFunc: func(info types.ConnectionInfo) {
+				agent.logger.Debugf("Connected to the server %s via %s.", info.Endpoint, info.Transport)
 			},
 			OnConnectFailedFunc: func(err error) {
 				agent.logger.Errorf("Failed to connect to the server: %v", err)
 			},
-			OnErrorFunc: func(err *protobufs.ServerErrorResponse) {
-				agent.logger.Errorf("Server returned an error response: %v", err.ErrorMessage)
+			OnErrorFunc: func(err *types.ServerError) {
+				agent.logger.Errorf("Server returned an error response: %v", err)
 			},
 			SaveRemoteConfigStatusFunc: func(_ context.Context, status *protobufs.RemoteConfigStatus) {
 				agent.remoteConfigStatus = status
@@ -167,6 +170,13 @@ func (agent *Agent) createAgentIdentity() {
 			},
 		},
 	}
+
+	// Report the host fingerprint to let the Server detect cloned hosts.
+	if fingerprint, err := client.HostFingerprintAttribute(); err == nil {
+		agent.agentDescription.NonIdentifyingAttributes = append(
+			agent.agentDescription.NonIdentifyingAttributes, fingerprint,
+		)
+	}
 }
 
 func (agent *Agent) updateAgentIdentity(instanceId ulid.ULID) {
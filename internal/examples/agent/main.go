@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/client/types"
 	"github.com/open-telemetry/opamp-go/internal/examples/agent/agent"
 )
 
@@ -16,8 +21,23 @@ func main() {
 	var agentVersion string
 	flag.StringVar(&agentVersion, "v", "1.0.0", "Agent Version String")
 
+	var diagnose bool
+	flag.BoolVar(&diagnose, "diagnose", false, "Check the connection to the OpAMP Server, print the result as JSON and exit")
+
 	flag.Parse()
 
+	if diagnose {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		diagnosis := client.Diagnose(ctx, types.StartSettings{OpAMPServerURL: agent.ServerURL})
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(diagnosis); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	agent := agent.NewAgent(&agent.Logger{log.Default()}, agentType, agentVersion)
 
 	interrupt := make(chan os.Signal, 1)
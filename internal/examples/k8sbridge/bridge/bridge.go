@@ -0,0 +1,248 @@
+// Package bridge mirrors the Agents connected to an OpAMP Server into Kubernetes
+// custom resources, so that the fleet can be observed with kubectl and managed by
+// operator-style controllers.
+package bridge
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+// AgentSpec is the spec of the OpAMPAgent custom resource.
+type AgentSpec struct {
+	InstanceUid    string `json:"instanceUid"`
+	ServiceName    string `json:"serviceName,omitempty"`
+	ServiceVersion string `json:"serviceVersion,omitempty"`
+}
+
+// AgentStatus is the status of the OpAMPAgent custom resource.
+type AgentStatus struct {
+	Connected            bool      `json:"connected"`
+	LastSeen             time.Time `json:"lastSeen"`
+	Healthy              *bool     `json:"healthy,omitempty"`
+	RemoteConfigStatus   string    `json:"remoteConfigStatus,omitempty"`
+	RemoteConfigError    string    `json:"remoteConfigError,omitempty"`
+	LastRemoteConfigHash string    `json:"lastRemoteConfigHash,omitempty"`
+}
+
+// AgentResource is the OpAMPAgent custom resource that mirrors an Agent.
+type AgentResource struct {
+	Name   string
+	Spec   AgentSpec
+	Status AgentStatus
+
+	// True if the Agent reported its description to the bridge.
+	described bool
+}
+
+// Bridge is an OpAMP Server that mirrors the state of the connected Agents into
+// OpAMPAgent custom resources.
+type Bridge struct {
+	kube     *KubeClient
+	opampSrv server.OpAMPServer
+	logger   *log.Logger
+
+	mux sync.Mutex
+	// The resources of all Agents that ever connected, keyed by instance uid.
+	agents map[string]*AgentResource
+	// Instance uids of the Agents connected via each connection.
+	connections map[types.Connection]map[string]bool
+	// Instance uids of the Agents whose resources must be applied.
+	dirty map[string]bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(kube *KubeClient, logger *log.Logger) *Bridge {
+	return &Bridge{
+		kube:        kube,
+		logger:      logger,
+		opampSrv:    server.New(&serverLogger{logger}),
+		agents:      map[string]*AgentResource{},
+		connections: map[types.Connection]map[string]bool{},
+		dirty:       map[string]bool{},
+		done:        make(chan struct{}),
+	}
+}
+
+// Start starts accepting the Agents' connections on the listenEndpoint and
+// applying the custom resources every syncInterval.
+func (b *Bridge) Start(listenEndpoint string, syncInterval time.Duration) error {
+	settings := server.StartSettings{
+		Settings: server.Settings{
+			Callbacks: server.CallbacksStruct{
+				OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+					return types.ConnectionResponse{Accept: true, ConnectionCallbacks: server.ConnectionCallbacksStruct{
+						OnMessageFunc:         b.onMessage,
+						OnConnectionCloseFunc: b.onConnectionClose,
+					}}
+				},
+			},
+		},
+		ListenEndpoint: listenEndpoint,
+	}
+	if err := b.opampSrv.Start(settings); err != nil {
+		return err
+	}
+
+	b.wg.Add(1)
+	go b.runSync(syncInterval)
+	return nil
+}
+
+func (b *Bridge) Stop() {
+	b.opampSrv.Stop(context.Background())
+	close(b.done)
+	b.wg.Wait()
+}
+
+func (b *Bridge) onMessage(conn types.Connection, msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	agent := b.agents[msg.InstanceUid]
+	if agent == nil {
+		agent = &AgentResource{Name: resourceName(msg.InstanceUid), Spec: AgentSpec{InstanceUid: msg.InstanceUid}}
+		b.agents[msg.InstanceUid] = agent
+	}
+	if b.connections[conn] == nil {
+		b.connections[conn] = map[string]bool{}
+	}
+	b.connections[conn][msg.InstanceUid] = true
+
+	if descr := msg.AgentDescription; descr != nil {
+		agent.Spec.ServiceName = identifyingAttribute(descr, "service.name")
+		agent.Spec.ServiceVersion = identifyingAttribute(descr, "service.version")
+		agent.described = true
+	}
+	if msg.Health != nil {
+		healthy := msg.Health.Healthy
+		agent.Status.Healthy = &healthy
+	}
+	if status := msg.RemoteConfigStatus; status != nil {
+		agent.Status.RemoteConfigStatus = remoteConfigStatusName(status.Status)
+		agent.Status.RemoteConfigError = status.ErrorMessage
+		agent.Status.LastRemoteConfigHash = hex.EncodeToString(status.LastRemoteConfigHash)
+	}
+	agent.Status.Connected = true
+	agent.Status.LastSeen = time.Now().UTC().Truncate(time.Second)
+	b.dirty[msg.InstanceUid] = true
+
+	var flags uint64
+	if !agent.described {
+		// We don't know the Agent's description, e.g. the bridge was restarted.
+		flags = uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState)
+	}
+	return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid, Flags: flags}
+}
+
+func (b *Bridge) onConnectionClose(conn types.Connection) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for instanceUid := range b.connections[conn] {
+		if agent := b.agents[instanceUid]; agent != nil {
+			agent.Status.Connected = false
+			b.dirty[instanceUid] = true
+		}
+	}
+	delete(b.connections, conn)
+}
+
+func (b *Bridge) runSync(interval time.Duration) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			// Mirror the disconnection of the Agents on shutdown.
+			b.sync()
+			return
+		case <-ticker.C:
+			b.sync()
+		}
+	}
+}
+
+// sync applies the resources of the Agents that changed since the last sync.
+func (b *Bridge) sync() {
+	b.mux.Lock()
+	var changed []AgentResource
+	for instanceUid := range b.dirty {
+		changed = append(changed, *b.agents[instanceUid])
+	}
+	b.dirty = map[string]bool{}
+	b.mux.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for i := range changed {
+		agent := &changed[i]
+		if err := b.kube.ApplyAgent(ctx, agent); err != nil {
+			b.logger.Printf("Cannot apply resource of agent %s: %v", agent.Spec.InstanceUid, err)
+			// Retry on the next sync.
+			b.mux.Lock()
+			b.dirty[agent.Spec.InstanceUid] = true
+			b.mux.Unlock()
+		}
+	}
+}
+
+// Prefix of the names of the OpAMPAgent resources.
+const resourceNamePrefix = "agent-"
+
+// Maximum length of the Kubernetes resource names.
+const maxResourceNameLength = 63
+
+// resourceName converts the instance uid to a valid Kubernetes resource name.
+func resourceName(instanceUid string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(instanceUid))
+	if maxLength := maxResourceNameLength - len(resourceNamePrefix); len(name) > maxLength {
+		name = name[:maxLength]
+	}
+	return resourceNamePrefix + strings.TrimRight(name, "-")
+}
+
+func identifyingAttribute(descr *protobufs.AgentDescription, key string) string {
+	for _, attr := range descr.IdentifyingAttributes {
+		if attr.Key == key {
+			return attr.GetValue().GetStringValue()
+		}
+	}
+	return ""
+}
+
+func remoteConfigStatusName(status protobufs.RemoteConfigStatuses) string {
+	return strings.TrimPrefix(status.String(), "RemoteConfigStatuses_")
+}
+
+type serverLogger struct {
+	logger *log.Logger
+}
+
+func (l *serverLogger) Debugf(format string, v ...interface{}) {
+	l.logger.Printf(format, v...)
+}
+
+func (l *serverLogger) Errorf(format string, v ...interface{}) {
+	l.logger.Printf(format, v...)
+}
@@ -0,0 +1,133 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Files mounted into the Pods that authenticate the Pod's service account.
+const (
+	serviceAccountDir   = "/var/run/secrets/kubernetes.io/serviceaccount"
+	serviceAccountToken = serviceAccountDir + "/token"
+	serviceAccountCA    = serviceAccountDir + "/ca.crt"
+)
+
+// Name of the field manager used for server-side apply.
+const fieldManager = "opamp-bridge"
+
+const (
+	crdGroup    = "opamp.opentelemetry.io"
+	crdVersion  = "v1alpha1"
+	crdKind     = "OpAMPAgent"
+	crdResource = "opampagents"
+)
+
+// KubeClient is a minimal client of the Kubernetes API that manages the OpAMPAgent
+// custom resources. It uses plain REST calls to keep the example free of the large
+// Kubernetes client libraries.
+type KubeClient struct {
+	apiServer  string
+	token      string
+	namespace  string
+	httpClient *http.Client
+}
+
+// NewInClusterKubeClient creates a KubeClient that uses the service account of the
+// Pod it runs in. The custom resources are created in the namespace.
+func NewInClusterKubeClient(namespace string) (*KubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	token, err := os.ReadFile(serviceAccountToken)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountCA)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid CA certificate in %s", serviceAccountCA)
+	}
+
+	return NewKubeClient(
+		"https://"+net.JoinHostPort(host, port),
+		strings.TrimSpace(string(token)),
+		namespace,
+		&tls.Config{RootCAs: rootCAs},
+	), nil
+}
+
+// NewKubeClient creates a KubeClient that talks to the apiServer using the bearer
+// token, e.g. the token of a service account when running outside of the cluster.
+func NewKubeClient(apiServer, token, namespace string, tlsConfig *tls.Config) *KubeClient {
+	return &KubeClient{
+		apiServer:  strings.TrimSuffix(apiServer, "/"),
+		token:      token,
+		namespace:  namespace,
+		httpClient: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}
+}
+
+func (c *KubeClient) resourceURL(name string, subresource string) string {
+	url := fmt.Sprintf("%s/apis/%s/%s/namespaces/%s/%s/%s",
+		c.apiServer, crdGroup, crdVersion, c.namespace, crdResource, name)
+	if subresource != "" {
+		url += "/" + subresource
+	}
+	return url + "?fieldManager=" + fieldManager + "&force=true"
+}
+
+// ApplyAgent creates or updates the OpAMPAgent resource and its status using
+// server-side apply.
+func (c *KubeClient) ApplyAgent(ctx context.Context, agent *AgentResource) error {
+	object := map[string]interface{}{
+		"apiVersion": crdGroup + "/" + crdVersion,
+		"kind":       crdKind,
+		"metadata":   map[string]interface{}{"name": agent.Name, "namespace": c.namespace},
+		"spec":       agent.Spec,
+	}
+	if err := c.apply(ctx, c.resourceURL(agent.Name, ""), object); err != nil {
+		return err
+	}
+
+	object["status"] = agent.Status
+	delete(object, "spec")
+	return c.apply(ctx, c.resourceURL(agent.Name, "status"), object)
+}
+
+func (c *KubeClient) apply(ctx context.Context, url string, object interface{}) error {
+	// JSON is a subset of YAML, so the object can be sent as an apply patch.
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/apply-patch+yaml")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("apply %s: %s: %s", url, resp.Status, msg)
+	}
+	return nil
+}
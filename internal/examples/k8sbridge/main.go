@@ -0,0 +1,47 @@
+// The k8sbridge example is an OpAMP Server that mirrors the connected Agents into
+// OpAMPAgent Kubernetes custom resources (see crd.yaml). Run it in a Pod with a
+// service account that is allowed to patch opampagents and opampagents/status.
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/internal/examples/k8sbridge/bridge"
+)
+
+// How often the changes of the Agents are applied to the custom resources.
+const syncInterval = 5 * time.Second
+
+var logger = log.New(log.Default().Writer(), "[BRIDGE] ", log.Default().Flags()|log.Lmsgprefix|log.Lmicroseconds)
+
+func main() {
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "default"
+	}
+	listenEndpoint := os.Getenv("OPAMP_LISTEN_ENDPOINT")
+	if listenEndpoint == "" {
+		listenEndpoint = "0.0.0.0:4320"
+	}
+
+	kube, err := bridge.NewInClusterKubeClient(namespace)
+	if err != nil {
+		logger.Fatalf("Cannot create Kubernetes client: %v", err)
+	}
+
+	b := bridge.New(kube, logger)
+	if err := b.Start(listenEndpoint, syncInterval); err != nil {
+		logger.Fatalf("Cannot start OpAMP bridge: %v", err)
+	}
+	logger.Printf("OpAMP bridge running on %s, mirroring Agents to namespace %s", listenEndpoint, namespace)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+
+	logger.Println("OpAMP bridge shutting down...")
+	b.Stop()
+}
@@ -0,0 +1,272 @@
+// Package adminapi implements the gRPC admin API of the example Server defined in
+// admin.proto.
+package adminapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/open-telemetry/opamp-go/internal/examples/server/data"
+	"github.com/open-telemetry/opamp-go/internal/examples/server/webauth"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+var (
+	errTokenRequired = errors.New("admin API token or guard must be set")
+	errTLSRequired   = errors.New("admin API must use TLS when listening on a non-loopback address")
+)
+
+// Settings of the admin API.
+type Settings struct {
+	// The address to listen on, e.g. "127.0.0.1:4322".
+	ListenEndpoint string
+
+	// The token the callers must present in the "authorization: Bearer <token>"
+	// metadata. Must be set unless Guard is set.
+	Token string
+
+	// Optional guard that authenticates and authorizes the calls instead of the
+	// Token, e.g. the one protecting the UI and the REST API. The credentials are
+	// read from the "authorization" metadata. ListAgents and GetAgent are read
+	// operations, SetCustomConfig and SendCommand are write operations.
+	Guard *webauth.Guard
+
+	// Optional TLS config. Must be set if ListenEndpoint is not a loopback address,
+	// so that the token is not sent in plain text over the network.
+	TLSConfig *tls.Config
+}
+
+// Server serves the AgentAdmin service for the Agents in the registry.
+type Server struct {
+	UnimplementedAgentAdminServer
+
+	agents     *data.Agents
+	grpcServer *grpc.Server
+	logger     *log.Logger
+}
+
+func NewServer(agents *data.Agents) *Server {
+	return &Server{
+		agents: agents,
+		logger: log.New(log.Default().Writer(), "[ADMIN] ", log.Default().Flags()|log.Lmsgprefix|log.Lmicroseconds),
+	}
+}
+
+// Start starts serving the gRPC API.
+func (s *Server) Start(settings Settings) error {
+	if settings.Token == "" && settings.Guard == nil {
+		return errTokenRequired
+	}
+	if settings.TLSConfig == nil && !isLoopback(settings.ListenEndpoint) {
+		return errTLSRequired
+	}
+
+	listener, err := net.Listen("tcp", settings.ListenEndpoint)
+	if err != nil {
+		return err
+	}
+
+	var auth callAuth = tokenAuth(settings.Token)
+	if settings.Guard != nil {
+		auth = guardAuth{settings.Guard}
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(
+			ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+		) (interface{}, error) {
+			if err := auth.check(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(
+			srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+		) error {
+			if err := auth.check(stream.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+	if settings.TLSConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(settings.TLSConfig)))
+	}
+
+	s.grpcServer = grpc.NewServer(opts...)
+	RegisterAgentAdminServer(s.grpcServer, s)
+	go func() {
+		if err := s.grpcServer.Serve(listener); err != nil {
+			s.logger.Printf("gRPC admin API stopped: %v", err)
+		}
+	}()
+	s.logger.Printf("gRPC admin API listening on %s", listener.Addr())
+	return nil
+}
+
+func (s *Server) Stop() {
+	if s.grpcServer != nil {
+		s.grpcServer.GracefulStop()
+	}
+}
+
+// isLoopback returns true if the host of the endpoint is a loopback address.
+func isLoopback(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// callAuth checks that the call of the method is allowed.
+type callAuth interface {
+	check(ctx context.Context, fullMethod string) error
+}
+
+// tokenAuth checks the bearer token of the calls.
+type tokenAuth string
+
+func (t tokenAuth) check(ctx context.Context, _ string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		const prefix = "Bearer "
+		if len(value) > len(prefix) && strings.EqualFold(value[:len(prefix)], prefix) &&
+			subtle.ConstantTimeCompare([]byte(value[len(prefix):]), []byte(t)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing token")
+}
+
+// methodOperations are the operations performed by the methods of the AgentAdmin
+// service.
+var methodOperations = map[string]webauth.Operation{
+	"/opamp.examples.admin.AgentAdmin/ListAgents":      webauth.OperationRead,
+	"/opamp.examples.admin.AgentAdmin/GetAgent":        webauth.OperationRead,
+	"/opamp.examples.admin.AgentAdmin/SetCustomConfig": webauth.OperationWrite,
+	"/opamp.examples.admin.AgentAdmin/SendCommand":     webauth.OperationWrite,
+}
+
+// guardAuth checks the calls using the guard of the admin endpoints.
+type guardAuth struct {
+	guard *webauth.Guard
+}
+
+func (g guardAuth) check(ctx context.Context, fullMethod string) error {
+	op, ok := methodOperations[fullMethod]
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "unknown method %s", fullMethod)
+	}
+
+	// The guard authenticates http requests, so pass it one carrying the
+	// credentials of the call.
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fullMethod, nil)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		r.Header.Add("Authorization", value)
+	}
+
+	switch g.guard.Check(op, r) {
+	case nil:
+		return nil
+	case webauth.ErrUnauthenticated:
+		return status.Error(codes.Unauthenticated, "invalid or missing credentials")
+	default:
+		return status.Errorf(codes.PermissionDenied, "%s access denied", op)
+	}
+}
+
+func toAgent(agent *data.Agent) *Agent {
+	return &Agent{
+		InstanceUid:  string(agent.InstanceId),
+		Offline:      agent.Offline,
+		CustomConfig: agent.CustomInstanceConfig,
+		Status:       agent.Status,
+	}
+}
+
+func (s *Server) ListAgents(request *ListAgentsRequest, stream AgentAdmin_ListAgentsServer) error {
+	query, err := data.ParseAgentQuery(request.Query)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	agents := s.agents.GetAllAgentsReadonlyClone()
+	ids := make([]data.InstanceId, 0, len(agents))
+	for id, agent := range agents {
+		if query.Matches(agent) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		if err := stream.Send(toAgent(agents[id])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) GetAgent(_ context.Context, request *GetAgentRequest) (*Agent, error) {
+	agent := s.agents.GetAgentReadonlyClone(data.InstanceId(request.InstanceUid))
+	if agent == nil {
+		return nil, status.Errorf(codes.NotFound, "agent %s not found", request.InstanceUid)
+	}
+	return toAgent(agent), nil
+}
+
+func (s *Server) SetCustomConfig(_ context.Context, request *SetCustomConfigRequest) (*SetCustomConfigResponse, error) {
+	instanceId := data.InstanceId(request.InstanceUid)
+	if s.agents.FindAgent(instanceId) == nil {
+		return nil, status.Errorf(codes.NotFound, "agent %s not found", request.InstanceUid)
+	}
+	config := &protobufs.AgentConfigMap{
+		ConfigMap: map[string]*protobufs.AgentConfigFile{
+			"": {Body: []byte(request.Config)},
+		},
+	}
+	s.agents.SetCustomConfigForAgent(instanceId, config, nil)
+	return &SetCustomConfigResponse{}, nil
+}
+
+func (s *Server) SendCommand(_ context.Context, request *SendCommandRequest) (*SendCommandResponse, error) {
+	if request.Command == nil {
+		return nil, status.Error(codes.InvalidArgument, "command must be set")
+	}
+	instanceId := data.InstanceId(request.InstanceUid)
+	agent := s.agents.GetAgentReadonlyClone(instanceId)
+	if agent == nil {
+		return nil, status.Errorf(codes.NotFound, "agent %s not found", request.InstanceUid)
+	}
+	if request.Command.Type == protobufs.CommandType_CommandType_Restart &&
+		agent.Status.GetCapabilities()&uint64(protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "agent %s does not accept restart command", request.InstanceUid)
+	}
+
+	err := s.agents.SendToAgent(instanceId, &protobufs.ServerToAgent{InstanceUid: request.InstanceUid, Command: request.Command})
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot send command to agent %s: %v", request.InstanceUid, err)
+	}
+	return &SendCommandResponse{}, nil
+}
@@ -0,0 +1,145 @@
+package adminapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/open-telemetry/opamp-go/internal/examples/server/data"
+	"github.com/open-telemetry/opamp-go/internal/examples/server/webauth"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// tokenAuthenticator maps the Authorization headers to the principals.
+type tokenAuthenticator map[string]*webauth.Principal
+
+func (a tokenAuthenticator) Authenticate(r *http.Request) (*webauth.Principal, error) {
+	value := r.Header.Get("Authorization")
+	if value == "" {
+		return nil, webauth.ErrNoCredentials
+	}
+	principal, ok := a[value]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return principal, nil
+}
+
+func TestMethodOperations(t *testing.T) {
+	// Every method of the service must be classified, otherwise it is denied.
+	var methods []string
+	for _, method := range AgentAdmin_ServiceDesc.Methods {
+		methods = append(methods, "/"+AgentAdmin_ServiceDesc.ServiceName+"/"+method.MethodName)
+	}
+	for _, stream := range AgentAdmin_ServiceDesc.Streams {
+		methods = append(methods, "/"+AgentAdmin_ServiceDesc.ServiceName+"/"+stream.StreamName)
+	}
+	assert.Len(t, methodOperations, len(methods))
+	for _, method := range methods {
+		assert.Contains(t, methodOperations, method)
+	}
+}
+
+func TestGuardAuth(t *testing.T) {
+	authenticator := tokenAuthenticator{
+		"Bearer reader": {Subject: "reader", Roles: []string{"viewer"}},
+		"Bearer writer": {Subject: "writer", Roles: []string{"admin"}},
+	}
+	authorizer := webauth.RoleAuthorizer{ReadRoles: []string{"viewer"}, WriteRoles: []string{"admin"}}
+	auth := guardAuth{webauth.NewGuard(authenticator, authorizer, log.New(io.Discard, "", 0))}
+
+	const (
+		listAgents      = "/opamp.examples.admin.AgentAdmin/ListAgents"
+		getAgent        = "/opamp.examples.admin.AgentAdmin/GetAgent"
+		setCustomConfig = "/opamp.examples.admin.AgentAdmin/SetCustomConfig"
+		sendCommand     = "/opamp.examples.admin.AgentAdmin/SendCommand"
+	)
+	tests := []struct {
+		name          string
+		authorization string
+		method        string
+		wantCode      codes.Code
+	}{
+		{"no credentials", "", listAgents, codes.Unauthenticated},
+		{"invalid credentials", "Bearer forged", getAgent, codes.Unauthenticated},
+		{"reader lists", "Bearer reader", listAgents, codes.OK},
+		{"reader gets", "Bearer reader", getAgent, codes.OK},
+		{"reader sets config", "Bearer reader", setCustomConfig, codes.PermissionDenied},
+		{"reader sends command", "Bearer reader", sendCommand, codes.PermissionDenied},
+		{"writer lists", "Bearer writer", listAgents, codes.OK},
+		{"writer sets config", "Bearer writer", setCustomConfig, codes.OK},
+		{"writer sends command", "Bearer writer", sendCommand, codes.OK},
+		{"unknown method", "Bearer writer", "/opamp.examples.admin.AgentAdmin/Other", codes.PermissionDenied},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.authorization != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", test.authorization))
+			}
+			err := auth.check(ctx, test.method)
+			assert.Equal(t, test.wantCode, status.Code(err))
+		})
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	auth := tokenAuth("secret")
+	for authorization, want := range map[string]codes.Code{
+		"":              codes.Unauthenticated,
+		"Bearer other":  codes.Unauthenticated,
+		"Basic secret":  codes.Unauthenticated,
+		"Bearer secret": codes.OK,
+		"bearer secret": codes.OK,
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", authorization))
+		assert.Equal(t, want, status.Code(auth.check(ctx, "/opamp.examples.admin.AgentAdmin/SendCommand")), authorization)
+	}
+}
+
+// listStream collects the Agents sent by ListAgents.
+type listStream struct {
+	grpc.ServerStream
+	agents []string
+}
+
+func (s *listStream) Send(agent *Agent) error {
+	s.agents = append(s.agents, agent.InstanceUid)
+	return nil
+}
+
+func TestListAgentsQuery(t *testing.T) {
+	for id, name := range map[data.InstanceId]string{"a": "otelcol", "b": "fluentbit", "c": "otelcol"} {
+		agent := data.AllAgents.FindOrCreateAgent(id, nil)
+		agent.Status = &protobufs.AgentToServer{
+			AgentDescription: &protobufs.AgentDescription{
+				IdentifyingAttributes: []*protobufs.KeyValue{{
+					Key:   "service.name",
+					Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: name}},
+				}},
+			},
+		}
+	}
+	s := NewServer(&data.AllAgents)
+
+	stream := &listStream{}
+	require.NoError(t, s.ListAgents(&ListAgentsRequest{Query: "service.name=otelcol"}, stream))
+	assert.Equal(t, []string{"a", "c"}, stream.agents)
+
+	stream = &listStream{}
+	require.NoError(t, s.ListAgents(&ListAgentsRequest{}, stream))
+	assert.Equal(t, []string{"a", "b", "c"}, stream.agents)
+
+	err := s.ListAgents(&ListAgentsRequest{Query: "health>healthy"}, &listStream{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
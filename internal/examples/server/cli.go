@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/open-telemetry/opamp-go/internal/examples/server/adminapi"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+const cliUsage = `Usage:
+  server                                                 run the server
+  server agents list [--query QUERY] [ADMIN FLAGS]       list the agents matching the query,
+                                                         e.g. "service.name=otelcol health=healthy"
+  server config push --agent ID [--file PATH] [ADMIN FLAGS]
+                                                         push custom config to the agent,
+                                                         reads the config from stdin if
+                                                         no file is specified
+  server command restart --agent ID [ADMIN FLAGS]        restart the agent
+
+Admin flags:
+  --admin ADDR     address of the server's gRPC admin API
+  --token TOKEN    admin API token, OPAMP_ADMIN_API_TOKEN by default
+  --ca PATH        CA certificate file, enables TLS
+`
+
+// Default address of the gRPC admin API of a locally running server.
+const defaultAdminAddr = "127.0.0.1:4322"
+
+// Timeout of the CLI commands.
+const cliTimeout = 10 * time.Second
+
+// runCLI runs the subcommand specified by args, e.g. ["agents", "list"].
+func runCLI(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) < 2 {
+		return errors.New("missing subcommand")
+	}
+
+	flags := flag.NewFlagSet(args[0]+" "+args[1], flag.ContinueOnError)
+	adminAddr := flags.String("admin", defaultAdminAddr, "address of the server's gRPC admin API")
+	agentId := flags.String("agent", "", "instance id of the agent")
+	file := flags.String("file", "", "config file to push, stdin if empty")
+	query := flags.String("query", "", "query selecting the agents to list, all if empty")
+	token := flags.String("token", os.Getenv("OPAMP_ADMIN_API_TOKEN"), "admin API token")
+	caFile := flags.String("ca", "", "CA certificate file of the admin API, enables TLS")
+	if err := flags.Parse(args[2:]); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cliTimeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+*token)
+
+	transport := grpc.WithInsecure()
+	if *caFile != "" {
+		creds, err := credentials.NewClientTLSFromFile(*caFile, "")
+		if err != nil {
+			return fmt.Errorf("cannot load CA certificate: %w", err)
+		}
+		transport = grpc.WithTransportCredentials(creds)
+	}
+
+	conn, err := grpc.DialContext(ctx, *adminAddr, transport, grpc.WithBlock())
+	if err != nil {
+		return fmt.Errorf("cannot connect to admin API at %s: %w", *adminAddr, err)
+	}
+	defer conn.Close()
+	client := adminapi.NewAgentAdminClient(conn)
+
+	switch args[0] + " " + args[1] {
+	case "agents list":
+		return listAgents(ctx, client, *query, stdout)
+
+	case "config push":
+		if *agentId == "" {
+			return errors.New("--agent must be specified")
+		}
+		return pushConfig(ctx, client, *agentId, *file, stdin)
+
+	case "command restart":
+		if *agentId == "" {
+			return errors.New("--agent must be specified")
+		}
+		_, err := client.SendCommand(ctx, &adminapi.SendCommandRequest{
+			InstanceUid: *agentId,
+			Command:     &protobufs.ServerToAgentCommand{Type: protobufs.CommandType_CommandType_Restart},
+		})
+		return err
+	}
+	return fmt.Errorf("unknown subcommand %q", args[0]+" "+args[1])
+}
+
+func listAgents(ctx context.Context, client adminapi.AgentAdminClient, query string, stdout io.Writer) error {
+	stream, err := client.ListAgents(ctx, &adminapi.ListAgentsRequest{Query: query})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE ID\tSERVICE\tVERSION\tHEALTHY")
+	for {
+		agent, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		status := agent.Status
+		healthy := "unknown"
+		if status.GetHealth() != nil {
+			healthy = fmt.Sprint(status.Health.Healthy)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", agent.InstanceUid,
+			identifyingAttribute(status, "service.name"),
+			identifyingAttribute(status, "service.version"),
+			healthy)
+	}
+	return w.Flush()
+}
+
+func identifyingAttribute(status *protobufs.AgentToServer, key string) string {
+	for _, attr := range status.GetAgentDescription().GetIdentifyingAttributes() {
+		if attr.Key == key {
+			return attr.GetValue().GetStringValue()
+		}
+	}
+	return ""
+}
+
+func pushConfig(
+	ctx context.Context, client adminapi.AgentAdminClient, agentId, file string, stdin io.Reader,
+) error {
+	var config []byte
+	var err error
+	if file == "" {
+		config, err = io.ReadAll(stdin)
+	} else {
+		config, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read config: %w", err)
+	}
+
+	_, err = client.SetCustomConfig(ctx, &adminapi.SetCustomConfigRequest{
+		InstanceUid: agentId,
+		Config:      string(config),
+	})
+	return err
+}
@@ -46,6 +46,26 @@ type Agent struct {
 
 	// Channels to notify when this Agent's status is updated next time.
 	statusUpdateWatchers []chan<- struct{}
+
+	// Transport used by the Agent to send the last message.
+	Transport Transport
+
+	// The time when the last message was received from the Agent.
+	LastSeen time.Time
+
+	// Offline is true if the Agent disconnected or did not send any messages
+	// for longer than the offline timeout.
+	Offline bool
+
+	// The client certificate the Agent presented when it last connected, nil if the
+	// Agent did not use a client certificate.
+	ClientCertificate *CertificateInfo
+
+	// The client certificates offered to the Agent, the most recent last.
+	CertificateOffers []CertificateOffer
+
+	// Connection settings to send in the response to the next status report.
+	pendingConnectionSettings *protobufs.ConnectionSettingsOffers
 }
 
 func NewAgent(
@@ -67,9 +87,33 @@ func (agent *Agent) CloneReadonly() *Agent {
 		CustomInstanceConfig: agent.CustomInstanceConfig,
 		remoteConfig:         proto.Clone(agent.remoteConfig).(*protobufs.AgentRemoteConfig),
 		StartedAt:            agent.StartedAt,
+		Transport:            agent.Transport,
+		LastSeen:             agent.LastSeen,
+		Offline:              agent.Offline,
+		ClientCertificate:    agent.ClientCertificate,
+		CertificateOffers:    append([]CertificateOffer(nil), agent.CertificateOffers...),
 	}
 }
 
+// setConn sets the connection to use for sending messages to the Agent.
+func (agent *Agent) setConn(conn types.Connection) {
+	agent.connMutex.Lock()
+	defer agent.connMutex.Unlock()
+	agent.conn = conn
+}
+
+// clearConn forgets the connection if it is the current connection of the Agent.
+// Returns false if the Agent already uses another connection.
+func (agent *Agent) clearConn(conn types.Connection) bool {
+	agent.connMutex.Lock()
+	defer agent.connMutex.Unlock()
+	if agent.conn != conn {
+		return false
+	}
+	agent.conn = nil
+	return true
+}
+
 // UpdateStatus updates the status of the Agent struct based on the newly received
 // status report and sets appropriate fields in the response message to be sent
 // to the Agent.
@@ -159,6 +203,13 @@ func (agent *Agent) updateRemoteConfigStatus(newStatus *protobufs.AgentToServer)
 	}
 }
 
+func (agent *Agent) updatePackageStatuses(newStatus *protobufs.AgentToServer) {
+	// Update package statuses if they are included, the Agent always reports all packages.
+	if newStatus.PackageStatuses != nil {
+		agent.Status.PackageStatuses = newStatus.PackageStatuses
+	}
+}
+
 func (agent *Agent) updateStatusField(newStatus *protobufs.AgentToServer) (agentDescrChanged bool) {
 	if agent.Status == nil {
 		// First time this Agent reports a status, remember it.
@@ -169,6 +220,7 @@ func (agent *Agent) updateStatusField(newStatus *protobufs.AgentToServer) (agent
 	agentDescrChanged = agent.updateAgentDescription(newStatus) || agentDescrChanged
 	agent.updateRemoteConfigStatus(newStatus)
 	agent.updateHealth(newStatus)
+	agent.updatePackageStatuses(newStatus)
 
 	return agentDescrChanged
 }
@@ -241,6 +293,12 @@ func (agent *Agent) processStatusUpdate(
 		agent.calcConnectionSettings(response)
 	}
 
+	if agent.pendingConnectionSettings != nil {
+		// Connection settings were offered while the Agent was not connected.
+		response.ConnectionSettings = agent.pendingConnectionSettings
+		agent.pendingConnectionSettings = nil
+	}
+
 	// If remote config is changed and different from what the Agent has then
 	// send the new remote config to the Agent.
 	if configChanged ||
@@ -395,9 +453,33 @@ func (agent *Agent) calcConnectionSettings(response *protobufs.ServerToAgent) {
 	}
 }
 
-func (agent *Agent) SendToAgent(msg *protobufs.ServerToAgent) {
+func (agent *Agent) SendToAgent(msg *protobufs.ServerToAgent) error {
+	agent.connMutex.Lock()
+	defer agent.connMutex.Unlock()
+
+	if agent.conn == nil {
+		// The Agent was restored from a snapshot and did not connect yet.
+		return ErrAgentNotConnected
+	}
+	return agent.conn.Send(context.Background(), msg)
+}
+
+// isConnected returns true if the Agent is connected to this Server and the Server
+// can send messages to it.
+func (agent *Agent) isConnected() bool {
+	agent.mux.RLock()
+	defer agent.mux.RUnlock()
+	return !agent.Offline && agent.Transport == TransportWebSocket
+}
+
+// Disconnect closes the connection of the Agent, e.g. when the Agent is no longer
+// admitted by the Server.
+func (agent *Agent) Disconnect() error {
 	agent.connMutex.Lock()
 	defer agent.connMutex.Unlock()
 
-	agent.conn.Send(context.Background(), msg)
+	if agent.conn == nil {
+		return ErrAgentNotConnected
+	}
+	return agent.conn.Disconnect()
 }
@@ -1,7 +1,9 @@
 package data
 
 import (
+	"bytes"
 	"sync"
+	"time"
 
 	"github.com/open-telemetry/opamp-go/protobufs"
 	"github.com/open-telemetry/opamp-go/protobufshelpers"
@@ -12,18 +14,45 @@ type Agents struct {
 	mux         sync.RWMutex
 	agentsById  map[InstanceId]*Agent
 	connections map[types.Connection]map[InstanceId]bool
+	listeners   []func(event AgentEvent)
+
+	// The channels of the watchers, see Watch.
+	watchMux sync.Mutex
+	watchers map[chan AgentChange]bool
+
+	// Connection leases shared with other Servers, nil if not enabled.
+	leases *Leases
+
+	// The packages published to the release channels, see PublishPackage.
+	packagesMux        sync.RWMutex
+	packageChannels    map[string]map[string]PackageRelease
+	packageDownloadURL PackageDownloadURLFunc
 }
 
-// RemoveConnection removes the connection all Agent instances associated with the
-// connection.
-func (agents *Agents) RemoveConnection(conn types.Connection) {
+// RemoveConnection removes the connection from all Agent instances associated with the
+// connection. The Agents are kept in the registry. Agents connected via WebSocket are
+// marked offline since their connection is gone, unless they already reconnected
+// using another connection. Plain HTTP Agents close the connection after each
+// request, so they are only marked offline when they stop polling (see CheckOffline).
+func (agents *Agents) RemoveConnection(conn types.Connection, transport Transport) {
 	agents.mux.Lock()
-	defer agents.mux.Unlock()
-
+	var disconnected []*Agent
 	for instanceId := range agents.connections[conn] {
-		delete(agents.agentsById, instanceId)
+		if agent := agents.agentsById[instanceId]; agent != nil {
+			disconnected = append(disconnected, agent)
+		}
 	}
 	delete(agents.connections, conn)
+	agents.mux.Unlock()
+
+	if transport != TransportWebSocket {
+		return
+	}
+	for _, agent := range disconnected {
+		if agent.clearConn(conn) {
+			agents.MarkOffline(agent)
+		}
+	}
 }
 
 func (agents *Agents) SetCustomConfigForAgent(
@@ -34,7 +63,37 @@ func (agents *Agents) SetCustomConfigForAgent(
 	agent := agents.FindAgent(agentId)
 	if agent != nil {
 		agent.SetCustomConfig(config, notifyNextStatusUpdate)
+		agents.emit(AgentEvent{Type: AgentConfigPushed, InstanceId: agentId, Time: time.Now()})
+		agents.notifyUpdated(agentId, FieldCustomConfig)
+	}
+}
+
+// RecordRemoteConfigStatus emits AgentConfigApplied or AgentConfigFailed event if
+// the remote config status reported by the Agent differs from the previously
+// reported one. Must be called before the status is updated (see Agent.UpdateStatus).
+func (agents *Agents) RecordRemoteConfigStatus(agent *Agent, status *protobufs.RemoteConfigStatus) {
+	if status == nil {
+		return
+	}
+
+	agent.mux.RLock()
+	prev := agent.Status.GetRemoteConfigStatus()
+	agent.mux.RUnlock()
+	if prev.GetStatus() == status.Status && bytes.Equal(prev.GetLastRemoteConfigHash(), status.LastRemoteConfigHash) {
+		return
+	}
+
+	event := AgentEvent{InstanceId: agent.InstanceId, Time: time.Now()}
+	switch status.Status {
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED:
+		event.Type = AgentConfigApplied
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED:
+		event.Type = AgentConfigFailed
+		event.Details = status.ErrorMessage
+	default:
+		return
 	}
+	agents.emit(event)
 }
 
 func isEqualAgentDescr(d1, d2 *protobufs.AgentDescription) bool {
@@ -69,21 +128,28 @@ func (agents *Agents) FindAgent(agentId InstanceId) *Agent {
 
 func (agents *Agents) FindOrCreateAgent(agentId InstanceId, conn types.Connection) *Agent {
 	agents.mux.Lock()
-	defer agents.mux.Unlock()
 
 	// Ensure the Agent is in the agentsById map.
 	agent := agents.agentsById[agentId]
-	if agent == nil {
+	created := agent == nil
+	if created {
 		agent = NewAgent(agentId, conn)
 		agents.agentsById[agentId] = agent
+	} else if !agents.connections[conn][agentId] {
+		// A known Agent reconnected using a new connection.
+		agent.setConn(conn)
+	}
 
-		// Ensure the Agent's instance id is associated with the connection.
-		if agents.connections[conn] == nil {
-			agents.connections[conn] = map[InstanceId]bool{}
-		}
-		agents.connections[conn][agentId] = true
+	// Ensure the Agent's instance id is associated with the connection.
+	if agents.connections[conn] == nil {
+		agents.connections[conn] = map[InstanceId]bool{}
 	}
+	agents.connections[conn][agentId] = true
+	agents.mux.Unlock()
 
+	if created {
+		agents.notifyWatchers(AgentChange{Type: ChangeAdded, InstanceId: agentId, Time: time.Now()})
+	}
 	return agent
 }
 
@@ -0,0 +1,279 @@
+package data
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Maximum number of certificate offers remembered per Agent.
+const maxCertificateOffers = 10
+
+var errNoCertificateInPEM = errors.New("no certificate found in PEM data")
+
+// CertificateInfo describes a TLS client certificate of an Agent.
+type CertificateInfo struct {
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"not_after"`
+	// Hex-encoded SHA256 of the DER encoded certificate.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// CertificateOffer is a client certificate that was offered to an Agent in the
+// OpAMP connection settings.
+type CertificateOffer struct {
+	CertificateInfo
+	// Hex-encoded hash of the ConnectionSettingsOffers the certificate was sent in.
+	OffersHash string    `json:"offers_hash"`
+	OfferedAt  time.Time `json:"offered_at"`
+	// The time the Agent first presented the certificate when connecting to the
+	// Server. Zero if the Agent did not use the certificate yet.
+	PresentedAt time.Time `json:"presented_at"`
+}
+
+// ExpiringCertificate is a certificate of an Agent that is nearing expiry.
+type ExpiringCertificate struct {
+	InstanceId InstanceId `json:"instance_id"`
+	// The certificate the Agent presented when it last connected.
+	Certificate CertificateInfo `json:"certificate"`
+	// The certificate offered to the Agent that the Agent did not present yet, if any.
+	PendingOffer *CertificateOffer `json:"pending_offer,omitempty"`
+}
+
+// CertificateIssuer issues client certificates for Agents.
+type CertificateIssuer interface {
+	IssueCertificate(instanceId InstanceId) (*protobufs.TLSCertificate, error)
+}
+
+func newCertificateInfo(cert *x509.Certificate) *CertificateInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &CertificateInfo{
+		Subject:     cert.Subject.String(),
+		NotAfter:    cert.NotAfter,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+}
+
+func parseCertificatePEM(pemBytes []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errNoCertificateInPEM
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// RecordClientCertificate records the certificate the Agent presented when connecting
+// to the Server. An offered certificate is only considered to be in use once the
+// Agent presents it. Does nothing if cert is nil, i.e. the Agent did not use a client
+// certificate.
+func (agents *Agents) RecordClientCertificate(agent *Agent, cert *x509.Certificate) {
+	if cert == nil {
+		return
+	}
+	info := newCertificateInfo(cert)
+
+	agent.mux.Lock()
+	defer agent.mux.Unlock()
+	agent.ClientCertificate = info
+	for i := range agent.CertificateOffers {
+		offer := &agent.CertificateOffers[i]
+		if offer.Fingerprint == info.Fingerprint && offer.PresentedAt.IsZero() {
+			offer.PresentedAt = time.Now()
+		}
+	}
+}
+
+// pendingCertificateOffer returns the last certificate offered to the Agent if the
+// Agent neither presented nor rejected it yet. Must be called on a readonly clone of
+// the Agent or with agent.mux held.
+func (agent *Agent) pendingCertificateOffer() *CertificateOffer {
+	if len(agent.CertificateOffers) == 0 {
+		return nil
+	}
+	offer := agent.CertificateOffers[len(agent.CertificateOffers)-1]
+	if !offer.PresentedAt.IsZero() {
+		return nil
+	}
+	if rejection, rejected := connectionSettingsRejection(agent.Status.GetHealth()); rejected &&
+		rejection.OffersHash == offer.OffersHash {
+		return nil
+	}
+	return &offer
+}
+
+// ExpiringCertificates returns the Agents that present certificates that expire
+// before now+within, including the Agents with already expired certificates.
+// Offered certificates are not taken into account until the Agents present them.
+func (agents *Agents) ExpiringCertificates(within time.Duration, now time.Time) []ExpiringCertificate {
+	result := []ExpiringCertificate{}
+	deadline := now.Add(within)
+	for _, agent := range agents.GetAllAgentsReadonlyClone() {
+		cert := agent.ClientCertificate
+		if cert == nil || cert.NotAfter.After(deadline) {
+			continue
+		}
+		result = append(result, ExpiringCertificate{
+			InstanceId:   agent.InstanceId,
+			Certificate:  *cert,
+			PendingOffer: agent.pendingCertificateOffer(),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Certificate.NotAfter.Equal(result[j].Certificate.NotAfter) {
+			return result[i].Certificate.NotAfter.Before(result[j].Certificate.NotAfter)
+		}
+		return result[i].InstanceId < result[j].InstanceId
+	})
+	return result
+}
+
+// RotateExpiringCertificates offers new certificates issued by the issuer to the
+// Agents that present certificates that expire before now+within, unless the Agent
+// already has a pending offer of a certificate that does not expire by then. Returns
+// the Agents that the new certificates were offered to.
+func (agents *Agents) RotateExpiringCertificates(
+	issuer CertificateIssuer, within time.Duration, now time.Time,
+) ([]InstanceId, error) {
+	rotated := []InstanceId{}
+	for _, expiring := range agents.ExpiringCertificates(within, now) {
+		if offer := expiring.PendingOffer; offer != nil && offer.NotAfter.After(now.Add(within)) {
+			// Waiting for the Agent to reconnect with the offered certificate.
+			continue
+		}
+		agent := agents.FindAgent(expiring.InstanceId)
+		if agent == nil {
+			continue
+		}
+		cert, err := issuer.IssueCertificate(expiring.InstanceId)
+		if err != nil {
+			return rotated, fmt.Errorf("cannot issue certificate for Agent %s: %v", expiring.InstanceId, err)
+		}
+		if err := agent.OfferCertificate(cert, now); err != nil {
+			return rotated, fmt.Errorf("cannot offer certificate to Agent %s: %v", expiring.InstanceId, err)
+		}
+		rotated = append(rotated, expiring.InstanceId)
+	}
+	return rotated, nil
+}
+
+// OfferCertificate offers a new client certificate to the Agent in the OpAMP
+// connection settings. The offer is sent immediately to Agents connected via
+// WebSocket and in the response to the next status report otherwise.
+func (agent *Agent) OfferCertificate(cert *protobufs.TLSCertificate, now time.Time) error {
+	parsed, err := parseCertificatePEM(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	info := newCertificateInfo(parsed)
+
+	hash := sha256.Sum256(cert.PublicKey)
+	offers := &protobufs.ConnectionSettingsOffers{
+		Hash:  hash[:],
+		Opamp: &protobufs.OpAMPConnectionSettings{Certificate: cert},
+	}
+
+	agent.mux.Lock()
+	agent.CertificateOffers = append(agent.CertificateOffers, CertificateOffer{
+		CertificateInfo: *info,
+		OffersHash:      hex.EncodeToString(offers.Hash),
+		OfferedAt:       now,
+	})
+	if len(agent.CertificateOffers) > maxCertificateOffers {
+		agent.CertificateOffers = agent.CertificateOffers[len(agent.CertificateOffers)-maxCertificateOffers:]
+	}
+
+	if agent.Transport != TransportWebSocket {
+		// Can't send to plain HTTP Agents, include in the next response.
+		agent.pendingConnectionSettings = offers
+		agent.mux.Unlock()
+		return nil
+	}
+	agent.mux.Unlock()
+
+	agent.SendToAgent(&protobufs.ServerToAgent{ConnectionSettings: offers})
+	return nil
+}
+
+// CertificateAuthority is a simple in-memory CA that issues client certificates for
+// Agents. It is intended for demonstration purposes only.
+type CertificateAuthority struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	validity time.Duration
+}
+
+// NewCertificateAuthority creates a new CA with a self-signed certificate. The
+// certificates issued by the CA are valid for the specified duration.
+func NewCertificateAuthority(validity time.Duration) (*CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: "OpAMP Example Server CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{cert: cert, key: key, validity: validity}, nil
+}
+
+// IssueCertificate issues a new client certificate for the Agent. Implements
+// CertificateIssuer.
+func (ca *CertificateAuthority) IssueCertificate(instanceId InstanceId) (*protobufs.TLSCertificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: string(instanceId)},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(ca.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protobufs.TLSCertificate{
+		PublicKey:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}, nil
+}
@@ -0,0 +1,54 @@
+package data
+
+import (
+	"encoding/hex"
+	"sort"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// ConnectionSettingsRejection describes the last connection settings offer that an
+// Agent rejected, as reported by the opamp-go clients at the first line of the
+// LastError of the AgentHealth (see types.ConnectionSettingsStatus). The rejections
+// of the Agents that do not report their health, or use other clients, are not
+// known.
+type ConnectionSettingsRejection struct {
+	InstanceId InstanceId `json:"instance_id"`
+	Reason     string     `json:"reason"`
+	Message    string     `json:"message"`
+	// Hex-encoded hash of the rejected offers.
+	OffersHash string `json:"offers_hash"`
+}
+
+// ConnectionSettingsRejections returns the Agents that rejected the last connection
+// settings offer. If reason is not empty only the rejections with that reason are
+// returned.
+func (agents *Agents) ConnectionSettingsRejections(reason string) []ConnectionSettingsRejection {
+	result := []ConnectionSettingsRejection{}
+	for _, agent := range agents.GetAllAgentsReadonlyClone() {
+		rejection, ok := connectionSettingsRejection(agent.Status.GetHealth())
+		if !ok || (reason != "" && rejection.Reason != reason) {
+			continue
+		}
+		rejection.InstanceId = agent.InstanceId
+		result = append(result, rejection)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].InstanceId < result[j].InstanceId
+	})
+	return result
+}
+
+func connectionSettingsRejection(health *protobufs.AgentHealth) (ConnectionSettingsRejection, bool) {
+	status, _ := types.ParseConnectionSettingsStatus(health.GetLastError())
+	if !status.Rejected() {
+		return ConnectionSettingsRejection{}, false
+	}
+	return ConnectionSettingsRejection{
+		Reason:     string(status.Reason),
+		Message:    status.Message,
+		OffersHash: hex.EncodeToString(status.Hash),
+	}, true
+}
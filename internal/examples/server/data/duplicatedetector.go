@@ -0,0 +1,63 @@
+package data
+
+import (
+	"sync"
+
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// DuplicateDetector detects Agents that report the same instance id from different
+// hosts. This typically happens when a VM with an already running Agent is cloned
+// and the clone keeps the instance id of the original. The detector compares the
+// host fingerprint reported in the non-identifying attributes (see
+// client.HostFingerprintAttribute) with the fingerprint first seen for the instance id.
+type DuplicateDetector struct {
+	mux          sync.Mutex
+	fingerprints map[InstanceId]string
+}
+
+func NewDuplicateDetector() *DuplicateDetector {
+	return &DuplicateDetector{fingerprints: map[InstanceId]string{}}
+}
+
+// IsDuplicate returns true if the AgentDescription reports a host fingerprint that is
+// different from the one previously seen for the same instance id. The first fingerprint
+// seen for an instance id is remembered. Agents that do not report a fingerprint are
+// never considered duplicates.
+func (d *DuplicateDetector) IsDuplicate(instanceId InstanceId, descr *protobufs.AgentDescription) bool {
+	fingerprint := hostFingerprint(descr)
+	if fingerprint == "" {
+		return false
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	prev, ok := d.fingerprints[instanceId]
+	if !ok {
+		d.fingerprints[instanceId] = fingerprint
+		return false
+	}
+	return prev != fingerprint
+}
+
+// Forget removes the fingerprint remembered for the instance id, e.g. when the Agent
+// is removed from the registry.
+func (d *DuplicateDetector) Forget(instanceId InstanceId) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	delete(d.fingerprints, instanceId)
+}
+
+func hostFingerprint(descr *protobufs.AgentDescription) string {
+	if descr == nil {
+		return ""
+	}
+	for _, attr := range descr.NonIdentifyingAttributes {
+		if attr.Key == client.HostFingerprintAttributeKey {
+			return attr.Value.GetStringValue()
+		}
+	}
+	return ""
+}
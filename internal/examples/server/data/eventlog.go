@@ -0,0 +1,183 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Number of events that can wait to be written to the database. Events that do not
+// fit are dropped to avoid blocking the processing of the Agents' messages.
+const eventLogQueueSize = 1024
+
+// How often to delete the events older than the retention period.
+const eventLogPruneInterval = time.Hour
+
+// EventLog persists the AgentEvents to a SQL database to provide an audit history
+// of the Agents. The SQL is written for SQLite, the driver must be linked into the
+// binary, e.g. by importing github.com/mattn/go-sqlite3.
+type EventLog struct {
+	db        *sql.DB
+	retention time.Duration
+	queue     chan AgentEvent
+	dropped   int64
+}
+
+// EventQuery selects the events returned by EventLog.Query. Zero value fields
+// do not restrict the result.
+type EventQuery struct {
+	InstanceId InstanceId
+	Type       string
+	Since      time.Time
+	Until      time.Time
+	// Maximum number of returned events, the newest events are returned.
+	Limit int
+}
+
+// LoggedEvent is an AgentEvent read from the EventLog.
+type LoggedEvent struct {
+	Id         int64      `json:"id"`
+	Time       time.Time  `json:"time"`
+	InstanceId InstanceId `json:"instance_id"`
+	Type       string     `json:"type"`
+	Details    string     `json:"details,omitempty"`
+}
+
+// OpenEventLog creates the events table in the db if it does not exist yet.
+// The events older than retention are deleted periodically by Run.
+func OpenEventLog(db *sql.DB, retention time.Duration) (*EventLog, error) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS agent_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time_unix_nano INTEGER NOT NULL,
+			instance_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			details TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS agent_events_instance_id ON agent_events (instance_id, time_unix_nano)`,
+		`CREATE INDEX IF NOT EXISTS agent_events_time ON agent_events (time_unix_nano)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, fmt.Errorf("cannot create event log schema: %w", err)
+		}
+	}
+	return &EventLog{db: db, retention: retention, queue: make(chan AgentEvent, eventLogQueueSize)}, nil
+}
+
+// Listener returns the listener to add to the Agents (see Agents.AddEventListener).
+// The listener only queues the events, Run writes them to the database.
+func (l *EventLog) Listener() func(event AgentEvent) {
+	return func(event AgentEvent) {
+		select {
+		case l.queue <- event:
+		default:
+			atomic.AddInt64(&l.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of events that were dropped because the queue was full.
+func (l *EventLog) Dropped() int64 {
+	return atomic.LoadInt64(&l.dropped)
+}
+
+// Run writes the queued events to the database and deletes the expired events until
+// done is closed.
+func (l *EventLog) Run(done <-chan struct{}, onError func(err error)) {
+	ticker := time.NewTicker(eventLogPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case event := <-l.queue:
+			if err := l.Record(event); err != nil {
+				onError(err)
+			}
+		case <-ticker.C:
+			if err := l.Prune(time.Now()); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Record writes the event to the database.
+func (l *EventLog) Record(event AgentEvent) error {
+	_, err := l.db.Exec(
+		`INSERT INTO agent_events (time_unix_nano, instance_id, type, details) VALUES (?, ?, ?, ?)`,
+		event.Time.UnixNano(), string(event.InstanceId), event.Type.String(), event.Details,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot record %s event of agent %s: %w", event.Type, event.InstanceId, err)
+	}
+	return nil
+}
+
+// Prune deletes the events older than the retention period.
+func (l *EventLog) Prune(now time.Time) error {
+	if l.retention <= 0 {
+		return nil
+	}
+	_, err := l.db.Exec(`DELETE FROM agent_events WHERE time_unix_nano < ?`, now.Add(-l.retention).UnixNano())
+	if err != nil {
+		return fmt.Errorf("cannot prune event log: %w", err)
+	}
+	return nil
+}
+
+// Query returns the events matching the query, the newest first.
+func (l *EventLog) Query(query EventQuery) ([]LoggedEvent, error) {
+	var conditions []string
+	var args []interface{}
+	if query.InstanceId != "" {
+		conditions = append(conditions, "instance_id = ?")
+		args = append(args, string(query.InstanceId))
+	}
+	if query.Type != "" {
+		conditions = append(conditions, "type = ?")
+		args = append(args, query.Type)
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "time_unix_nano >= ?")
+		args = append(args, query.Since.UnixNano())
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "time_unix_nano < ?")
+		args = append(args, query.Until.UnixNano())
+	}
+
+	statement := `SELECT id, time_unix_nano, instance_id, type, details FROM agent_events`
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY time_unix_nano DESC, id DESC"
+	if query.Limit > 0 {
+		statement += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+
+	rows, err := l.db.Query(statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query event log: %w", err)
+	}
+	defer rows.Close()
+
+	var events []LoggedEvent
+	for rows.Next() {
+		var event LoggedEvent
+		var timeUnixNano int64
+		var instanceId string
+		if err := rows.Scan(&event.Id, &timeUnixNano, &instanceId, &event.Type, &event.Details); err != nil {
+			return nil, fmt.Errorf("cannot read event log: %w", err)
+		}
+		event.Time = time.Unix(0, timeUnixNano).UTC()
+		event.InstanceId = InstanceId(instanceId)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
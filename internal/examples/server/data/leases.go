@@ -0,0 +1,273 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// ErrAgentNotConnected is returned by Agents.SendToAgent if the Agent is not
+// connected to this Server nor, according to the connection leases, to any other
+// Server.
+var ErrAgentNotConnected = errors.New("agent is not connected")
+
+// AgentConnectedElsewhereError is returned by Agents.SendToAgent if the Agent is
+// connected to another Server and the message could not be forwarded there.
+type AgentConnectedElsewhereError struct {
+	Lease ConnectionLease
+}
+
+func (e *AgentConnectedElsewhereError) Error() string {
+	return fmt.Sprintf("agent %s is connected to server %s", e.Lease.InstanceId, e.Lease.ServerId)
+}
+
+// ConnectionLease states that the Agent is connected to the Server. The lease is
+// valid until it expires, the Server renews the leases of its Agents periodically,
+// so the leases of a crashed Server expire soon.
+type ConnectionLease struct {
+	InstanceId InstanceId
+	// Id of the Server the Agent is connected to.
+	ServerId string
+	// Address that other Servers can use to reach the Server, e.g. to forward
+	// the messages for the Agent.
+	ServerAddr string
+	ExpiresAt  time.Time
+}
+
+// LeaseStore is the state store shared by the Servers that stores the connection
+// leases. Implementations must be safe for concurrent use.
+type LeaseStore interface {
+	// Put stores the lease, replacing the lease of the Agent held by another Server.
+	Put(lease ConnectionLease) error
+	// Renew replaces the lease if the Agent's lease is still held by lease.ServerId.
+	// Returns false if the lease is held by another Server or is expired.
+	Renew(lease ConnectionLease) (bool, error)
+	// Get returns the Agent's lease, expired leases are not returned.
+	Get(instanceId InstanceId) (ConnectionLease, bool, error)
+	// Release deletes the Agent's lease if it is held by serverId.
+	Release(instanceId InstanceId, serverId string) error
+}
+
+// MemoryLeaseStore is a LeaseStore that keeps the leases in memory. It can be shared
+// by multiple Servers running in the same process, e.g. in tests. Servers running
+// in different processes need a LeaseStore backed by a shared database.
+type MemoryLeaseStore struct {
+	mux    sync.Mutex
+	leases map[InstanceId]ConnectionLease
+	now    func() time.Time
+}
+
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: map[InstanceId]ConnectionLease{}, now: time.Now}
+}
+
+func (s *MemoryLeaseStore) Put(lease ConnectionLease) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.leases[lease.InstanceId] = lease
+	return nil
+}
+
+func (s *MemoryLeaseStore) Renew(lease ConnectionLease) (bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	prev, ok := s.leases[lease.InstanceId]
+	if !ok || prev.ServerId != lease.ServerId || !prev.ExpiresAt.After(s.now()) {
+		return false, nil
+	}
+	s.leases[lease.InstanceId] = lease
+	return true, nil
+}
+
+func (s *MemoryLeaseStore) Get(instanceId InstanceId) (ConnectionLease, bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	lease, ok := s.leases[instanceId]
+	if !ok || !lease.ExpiresAt.After(s.now()) {
+		return ConnectionLease{}, false, nil
+	}
+	return lease, true, nil
+}
+
+func (s *MemoryLeaseStore) Release(instanceId InstanceId, serverId string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if lease, ok := s.leases[instanceId]; ok && lease.ServerId == serverId {
+		delete(s.leases, instanceId)
+	}
+	return nil
+}
+
+// LeaseForwarder forwards the message to the Agent connected to the Server
+// that holds the lease.
+type LeaseForwarder func(lease ConnectionLease, msg *protobufs.ServerToAgent) error
+
+// Leases publishes the connection leases of the Agents connected to this Server.
+type Leases struct {
+	store      LeaseStore
+	serverId   string
+	serverAddr string
+	ttl        time.Duration
+
+	// Optional, if nil the messages for the Agents connected to other Servers
+	// are not forwarded.
+	forward LeaseForwarder
+
+	mux  sync.Mutex
+	held map[InstanceId]bool
+
+	onError func(err error)
+	now     func() time.Time
+}
+
+// NewLeases creates Leases for the Server identified by serverId and reachable by
+// other Servers at serverAddr. The leases expire after ttl unless renewed.
+func NewLeases(
+	store LeaseStore, serverId, serverAddr string, ttl time.Duration, forward LeaseForwarder, onError func(err error),
+) *Leases {
+	return &Leases{
+		store:      store,
+		serverId:   serverId,
+		serverAddr: serverAddr,
+		ttl:        ttl,
+		forward:    forward,
+		held:       map[InstanceId]bool{},
+		onError:    onError,
+		now:        time.Now,
+	}
+}
+
+func (l *Leases) lease(instanceId InstanceId) ConnectionLease {
+	return ConnectionLease{
+		InstanceId: instanceId,
+		ServerId:   l.serverId,
+		ServerAddr: l.serverAddr,
+		ExpiresAt:  l.now().Add(l.ttl),
+	}
+}
+
+// Acquire publishes that the Agent is connected to this Server.
+func (l *Leases) Acquire(instanceId InstanceId) {
+	if err := l.store.Put(l.lease(instanceId)); err != nil {
+		l.onError(fmt.Errorf("cannot acquire lease of agent %s: %w", instanceId, err))
+		return
+	}
+	l.mux.Lock()
+	l.held[instanceId] = true
+	l.mux.Unlock()
+}
+
+// Release publishes that the Agent is not connected to this Server anymore.
+func (l *Leases) Release(instanceId InstanceId) {
+	l.mux.Lock()
+	delete(l.held, instanceId)
+	l.mux.Unlock()
+
+	if err := l.store.Release(instanceId, l.serverId); err != nil {
+		l.onError(fmt.Errorf("cannot release lease of agent %s: %w", instanceId, err))
+	}
+}
+
+// Renew renews the leases held by this Server. The leases taken over by other
+// Servers, e.g. because the Agent reconnected to another Server, are dropped.
+func (l *Leases) Renew() {
+	l.mux.Lock()
+	var held []InstanceId
+	for instanceId := range l.held {
+		held = append(held, instanceId)
+	}
+	l.mux.Unlock()
+
+	for _, instanceId := range held {
+		renewed, err := l.store.Renew(l.lease(instanceId))
+		if err != nil {
+			l.onError(fmt.Errorf("cannot renew lease of agent %s: %w", instanceId, err))
+			continue
+		}
+		if !renewed {
+			l.mux.Lock()
+			delete(l.held, instanceId)
+			l.mux.Unlock()
+		}
+	}
+}
+
+// RunRenewer renews the held leases every third of the TTL until done is closed.
+// The held leases are released when done is closed.
+func (l *Leases) RunRenewer(done <-chan struct{}) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			l.mux.Lock()
+			var held []InstanceId
+			for instanceId := range l.held {
+				held = append(held, instanceId)
+			}
+			l.mux.Unlock()
+			for _, instanceId := range held {
+				l.Release(instanceId)
+			}
+			return
+		case <-ticker.C:
+			l.Renew()
+		}
+	}
+}
+
+// EnableLeases makes the registry publish the connection leases of the Agents that
+// come online and release them when the Agents go offline.
+// Must be called before any Agent connects.
+func (agents *Agents) EnableLeases(leases *Leases) {
+	agents.mux.Lock()
+	agents.leases = leases
+	agents.mux.Unlock()
+
+	agents.AddEventListener(func(event AgentEvent) {
+		switch event.Type {
+		case AgentOnline:
+			leases.Acquire(event.InstanceId)
+		case AgentOffline:
+			leases.Release(event.InstanceId)
+		}
+	})
+}
+
+// SendToAgent sends the message to the Agent. If the Agent is not connected to this
+// Server the message is forwarded to the Server that holds the Agent's lease.
+// Returns ErrAgentNotConnected if the Agent is not connected to any Server and
+// AgentConnectedElsewhereError if the Agent is connected to another Server but the
+// message could not be forwarded.
+func (agents *Agents) SendToAgent(instanceId InstanceId, msg *protobufs.ServerToAgent) error {
+	if agent := agents.FindAgent(instanceId); agent != nil && agent.isConnected() {
+		return agent.SendToAgent(msg)
+	}
+
+	agents.mux.RLock()
+	leases := agents.leases
+	agents.mux.RUnlock()
+	if leases == nil {
+		return ErrAgentNotConnected
+	}
+
+	lease, ok, err := leases.store.Get(instanceId)
+	if err != nil {
+		return fmt.Errorf("cannot get lease of agent %s: %w", instanceId, err)
+	}
+	if !ok || lease.ServerId == leases.serverId {
+		// Our own lease can be stale only if the Agent went offline a moment ago.
+		return ErrAgentNotConnected
+	}
+	if leases.forward == nil {
+		return &AgentConnectedElsewhereError{Lease: lease}
+	}
+	if err := leases.forward(lease, msg); err != nil {
+		return fmt.Errorf("%w: %v", &AgentConnectedElsewhereError{Lease: lease}, err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package data
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+const testLeaseTTL = 30 * time.Second
+
+// testClock is a clock that only moves when advanced.
+type testClock struct {
+	mux sync.Mutex
+	t   time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestLeaseStore(clock *testClock) *MemoryLeaseStore {
+	store := NewMemoryLeaseStore()
+	store.now = clock.now
+	return store
+}
+
+func newTestLeases(t *testing.T, store LeaseStore, clock *testClock, serverId string, forward LeaseForwarder) *Leases {
+	leases := NewLeases(store, serverId, serverId+":4320", testLeaseTTL, forward, func(err error) {
+		t.Errorf("lease error: %v", err)
+	})
+	leases.now = clock.now
+	return leases
+}
+
+func (l *Leases) isHeld(instanceId InstanceId) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.held[instanceId]
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	store := newTestLeaseStore(clock)
+	leases := newTestLeases(t, store, clock, "server1", nil)
+
+	leases.Acquire("agent")
+	lease, ok, err := store.Get("agent")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, ConnectionLease{
+		InstanceId: "agent",
+		ServerId:   "server1",
+		ServerAddr: "server1:4320",
+		ExpiresAt:  clock.now().Add(testLeaseTTL),
+	}, lease)
+
+	// Renewing before the expiry extends the lease.
+	clock.advance(testLeaseTTL * 2 / 3)
+	leases.Renew()
+	clock.advance(testLeaseTTL * 2 / 3)
+	_, ok, err = store.Get("agent")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, leases.isHeld("agent"))
+
+	// The lease is not returned once it expires, e.g. because the Server crashed.
+	clock.advance(testLeaseTTL)
+	_, ok, err = store.Get("agent")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// An expired lease is not renewed and is no longer held.
+	leases.Renew()
+	assert.False(t, leases.isHeld("agent"))
+	_, ok, err = store.Get("agent")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestLeaseExpiresExactlyAtTTL(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	store := newTestLeaseStore(clock)
+	leases := newTestLeases(t, store, clock, "server1", nil)
+
+	leases.Acquire("agent")
+	clock.advance(testLeaseTTL - time.Nanosecond)
+	_, ok, _ := store.Get("agent")
+	assert.True(t, ok)
+	clock.advance(time.Nanosecond)
+	_, ok, _ = store.Get("agent")
+	assert.False(t, ok)
+}
+
+func TestLeaseContention(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	store := newTestLeaseStore(clock)
+	server1 := newTestLeases(t, store, clock, "server1", nil)
+	server2 := newTestLeases(t, store, clock, "server2", nil)
+
+	server1.Acquire("agent")
+
+	// The Agent reconnected to server2 before server1 noticed it is gone.
+	clock.advance(time.Second)
+	server2.Acquire("agent")
+	lease, ok, err := store.Get("agent")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "server2", lease.ServerId)
+
+	// server1 loses the lease when it tries to renew it, server2 keeps it.
+	server1.Renew()
+	server2.Renew()
+	assert.False(t, server1.isHeld("agent"))
+	assert.True(t, server2.isHeld("agent"))
+
+	// server1 releasing the Agent late does not remove the lease of server2.
+	server1.Release("agent")
+	lease, ok, err = store.Get("agent")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "server2", lease.ServerId)
+
+	// Once server2 releases it, server1 can take it back.
+	server2.Release("agent")
+	_, ok, err = store.Get("agent")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	server1.Acquire("agent")
+	lease, ok, err = store.Get("agent")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "server1", lease.ServerId)
+}
+
+func TestSendToAgentConnectedElsewhere(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	store := newTestLeaseStore(clock)
+	var forwarded []ConnectionLease
+	forward := func(lease ConnectionLease, msg *protobufs.ServerToAgent) error {
+		forwarded = append(forwarded, lease)
+		if lease.ServerId == "unreachable" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	agents := newTestAgents()
+	agents.EnableLeases(newTestLeases(t, store, clock, "server1", forward))
+	msg := &protobufs.ServerToAgent{InstanceUid: "agent"}
+
+	// No Server holds the lease.
+	assert.ErrorIs(t, agents.SendToAgent("agent", msg), ErrAgentNotConnected)
+
+	// The message is forwarded to the Server holding the lease.
+	newTestLeases(t, store, clock, "server2", nil).Acquire("agent")
+	require.NoError(t, agents.SendToAgent("agent", msg))
+	require.Len(t, forwarded, 1)
+	assert.Equal(t, "server2", forwarded[0].ServerId)
+
+	newTestLeases(t, store, clock, "unreachable", nil).Acquire("agent")
+	var elsewhere *AgentConnectedElsewhereError
+	require.True(t, errors.As(agents.SendToAgent("agent", msg), &elsewhere))
+	assert.Equal(t, "unreachable", elsewhere.Lease.ServerId)
+
+	// The lease of the other Server expired.
+	clock.advance(2 * testLeaseTTL)
+	assert.ErrorIs(t, agents.SendToAgent("agent", msg), ErrAgentNotConnected)
+	assert.Len(t, forwarded, 2)
+}
@@ -0,0 +1,228 @@
+package data
+
+import (
+	"time"
+)
+
+// Transport is the transport an Agent uses to talk to the Server.
+type Transport int
+
+const (
+	TransportWebSocket Transport = iota
+	TransportPlainHTTP
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportWebSocket:
+		return "WebSocket"
+	case TransportPlainHTTP:
+		return "HTTP"
+	}
+	return "unknown"
+}
+
+// OfflineTimeouts defines for how long an Agent may stay silent before it is
+// declared offline. The timeout depends on the transport: plain HTTP Agents poll
+// periodically, while WebSocket Agents may legitimately stay silent on an open
+// connection unless they send heartbeats. Zero value disables the timeout for
+// the transport.
+type OfflineTimeouts struct {
+	WebSocket time.Duration
+	PlainHTTP time.Duration
+
+	// Evict is for how long an offline Agent is kept in the registry after it was
+	// last seen. Zero keeps offline Agents forever.
+	Evict time.Duration
+}
+
+// DefaultOfflineTimeouts allows plain HTTP Agents to miss 2 polls with the
+// default 30 seconds polling interval. WebSocket Agents are declared offline
+// when their connection is closed. Offline Agents are removed after a day.
+var DefaultOfflineTimeouts = OfflineTimeouts{
+	PlainHTTP: 90 * time.Second,
+	Evict:     24 * time.Hour,
+}
+
+func (t OfflineTimeouts) forTransport(transport Transport) time.Duration {
+	if transport == TransportPlainHTTP {
+		return t.PlainHTTP
+	}
+	return t.WebSocket
+}
+
+// AgentEventType is the type of the AgentEvent.
+type AgentEventType int
+
+const (
+	// AgentOnline indicates that a new or previously offline Agent sent a message.
+	AgentOnline AgentEventType = iota
+	// AgentOffline indicates that the Agent disconnected or was silent for too long.
+	AgentOffline
+	// AgentConfigPushed indicates that a new custom config was set for the Agent.
+	AgentConfigPushed
+	// AgentConfigApplied indicates that the Agent reported the remote config as applied.
+	AgentConfigApplied
+	// AgentConfigFailed indicates that the Agent reported that it failed to apply
+	// the remote config.
+	AgentConfigFailed
+	// AgentRemoved indicates that the Agent was offline for too long and was
+	// removed from the registry.
+	AgentRemoved
+)
+
+func (t AgentEventType) String() string {
+	switch t {
+	case AgentOnline:
+		return "online"
+	case AgentOffline:
+		return "offline"
+	case AgentConfigPushed:
+		return "config_pushed"
+	case AgentConfigApplied:
+		return "config_applied"
+	case AgentConfigFailed:
+		return "config_failed"
+	case AgentRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// AgentEvent describes a change in the Agent's lifecycle or config.
+type AgentEvent struct {
+	Type       AgentEventType
+	InstanceId InstanceId
+	Time       time.Time
+	// Optional human-readable details, e.g. the error message of AgentConfigFailed.
+	Details string
+}
+
+// AddEventListener adds a listener that will be called for every AgentEvent.
+// The listener is called synchronously and must return quickly.
+func (agents *Agents) AddEventListener(listener func(event AgentEvent)) {
+	agents.mux.Lock()
+	defer agents.mux.Unlock()
+	agents.listeners = append(agents.listeners, listener)
+}
+
+func (agents *Agents) emit(event AgentEvent) {
+	agents.mux.RLock()
+	listeners := agents.listeners
+	agents.mux.RUnlock()
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// MarkSeen records that a message was received from the Agent via the specified
+// transport. Emits AgentOnline event if the Agent is new or was offline.
+func (agents *Agents) MarkSeen(agent *Agent, transport Transport) {
+	now := time.Now()
+
+	agent.mux.Lock()
+	cameOnline := agent.Offline || agent.LastSeen.IsZero()
+	var changed []string
+	if agent.Offline {
+		changed = append(changed, FieldOffline)
+	}
+	if agent.Transport != transport && !agent.LastSeen.IsZero() {
+		changed = append(changed, FieldTransport)
+	}
+	agent.Offline = false
+	agent.LastSeen = now
+	agent.Transport = transport
+	agent.mux.Unlock()
+
+	if cameOnline {
+		agents.emit(AgentEvent{Type: AgentOnline, InstanceId: agent.InstanceId, Time: now})
+	}
+	agents.notifyUpdated(agent.InstanceId, changed...)
+}
+
+// MarkOffline marks the Agent offline. Emits AgentOffline event if the Agent
+// was online.
+func (agents *Agents) MarkOffline(agent *Agent) {
+	agent.mux.Lock()
+	wentOffline := !agent.Offline
+	agent.Offline = true
+	agent.mux.Unlock()
+
+	if wentOffline {
+		agents.emit(AgentEvent{Type: AgentOffline, InstanceId: agent.InstanceId, Time: time.Now()})
+		agents.notifyUpdated(agent.InstanceId, FieldOffline)
+	}
+}
+
+// CheckOffline marks offline all Agents that did not send any message within
+// the timeout defined for their transport.
+func (agents *Agents) CheckOffline(now time.Time, timeouts OfflineTimeouts) {
+	agents.mux.RLock()
+	var all []*Agent
+	for _, agent := range agents.agentsById {
+		all = append(all, agent)
+	}
+	agents.mux.RUnlock()
+
+	for _, agent := range all {
+		agent.mux.RLock()
+		timeout := timeouts.forTransport(agent.Transport)
+		expired := !agent.Offline && timeout > 0 && now.Sub(agent.LastSeen) > timeout
+		agent.mux.RUnlock()
+
+		if expired {
+			agents.MarkOffline(agent)
+		}
+	}
+}
+
+// EvictOffline removes from the registry the offline Agents that were not seen for
+// longer than the timeout. Emits AgentRemoved event for every removed Agent.
+func (agents *Agents) EvictOffline(now time.Time, timeout time.Duration) {
+	var removed []InstanceId
+
+	agents.mux.Lock()
+	for instanceId, agent := range agents.agentsById {
+		agent.mux.RLock()
+		expired := agent.Offline && now.Sub(agent.LastSeen) > timeout
+		agent.mux.RUnlock()
+
+		if expired {
+			delete(agents.agentsById, instanceId)
+			removed = append(removed, instanceId)
+		}
+	}
+	for conn, instanceIds := range agents.connections {
+		for _, instanceId := range removed {
+			delete(instanceIds, instanceId)
+		}
+		if len(instanceIds) == 0 {
+			delete(agents.connections, conn)
+		}
+	}
+	agents.mux.Unlock()
+
+	for _, instanceId := range removed {
+		agents.emit(AgentEvent{Type: AgentRemoved, InstanceId: instanceId, Time: now})
+		agents.notifyWatchers(AgentChange{Type: ChangeRemoved, InstanceId: instanceId, Time: now})
+	}
+}
+
+// RunOfflineChecker periodically calls CheckOffline and EvictOffline until the done
+// channel is closed.
+func (agents *Agents) RunOfflineChecker(timeouts OfflineTimeouts, checkInterval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			agents.CheckOffline(now, timeouts)
+			if timeouts.Evict > 0 {
+				agents.EvictOffline(now, timeouts.Evict)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// PackageChannelAttribute is the attribute of the Agent description that selects
+// the release channel the Agent gets its packages from, e.g. "beta".
+const PackageChannelAttribute = "opamp.package.channel"
+
+// DefaultPackageChannel is the release channel of the Agents that do not select one.
+const DefaultPackageChannel = "stable"
+
+// PackageRelease is a version of a package published to a release channel.
+type PackageRelease struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+
+	// File is the name of the package file passed to the PackageDownloadURLFunc.
+	File        string `json:"file"`
+	ContentHash []byte `json:"content_hash"`
+}
+
+// PackageDownloadURLFunc returns the URL the Agent downloads the package file from,
+// e.g. a URL signed for the Agent.
+type PackageDownloadURLFunc func(instanceId InstanceId, file string) (string, error)
+
+// SetPackageDownloadURL sets the func that returns the download URLs of the package
+// files offered to the Agents. If not set the File of the PackageRelease is used as
+// the URL.
+func (agents *Agents) SetPackageDownloadURL(downloadURL PackageDownloadURLFunc) {
+	agents.packagesMux.Lock()
+	defer agents.packagesMux.Unlock()
+	agents.packageDownloadURL = downloadURL
+}
+
+// PublishPackage publishes the release to the channel, replacing the release of the
+// package published before. The packages of the channel are offered to the
+// connected Agents of the channel, the other Agents get them with their next status
+// report. Only the Agents that accept packages and report their statuses are
+// offered the packages of their channel automatically. Returns the Agents that the
+// packages were sent to.
+func (agents *Agents) PublishPackage(channel string, release PackageRelease) ([]InstanceId, error) {
+	if channel == "" || release.Name == "" || release.File == "" {
+		return nil, errors.New("channel, package name and file must be set")
+	}
+	agents.packagesMux.Lock()
+	if agents.packageChannels == nil {
+		agents.packageChannels = map[string]map[string]PackageRelease{}
+	}
+	if agents.packageChannels[channel] == nil {
+		agents.packageChannels[channel] = map[string]PackageRelease{}
+	}
+	agents.packageChannels[channel][release.Name] = release
+	agents.packagesMux.Unlock()
+
+	return agents.offerChannelPackagesToAll(channel)
+}
+
+// UnpublishPackage removes the package from the channel. The Agents of the channel
+// are offered the remaining packages, so that they delete it. Returns the Agents
+// that the packages were sent to.
+func (agents *Agents) UnpublishPackage(channel string, name string) ([]InstanceId, error) {
+	agents.packagesMux.Lock()
+	delete(agents.packageChannels[channel], name)
+	agents.packagesMux.Unlock()
+
+	return agents.offerChannelPackagesToAll(channel)
+}
+
+// PackageChannels returns the releases published to every channel, sorted by
+// package name.
+func (agents *Agents) PackageChannels() map[string][]PackageRelease {
+	agents.packagesMux.RLock()
+	defer agents.packagesMux.RUnlock()
+
+	result := map[string][]PackageRelease{}
+	for channel, releases := range agents.packageChannels {
+		list := make([]PackageRelease, 0, len(releases))
+		for _, release := range releases {
+			list = append(list, release)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		result[channel] = list
+	}
+	return result
+}
+
+// packageChannel returns the release channel selected by the Agent.
+func packageChannel(agent *Agent) string {
+	if channel, ok := agentAttribute(agent.Status.GetAgentDescription(), PackageChannelAttribute); ok && channel != "" {
+		return channel
+	}
+	return DefaultPackageChannel
+}
+
+// acceptsChannelPackages returns true if the packages of the channel are offered to
+// the Agent automatically.
+func acceptsChannelPackages(agent *Agent) bool {
+	return agent.Status != nil &&
+		agent.hasCapability(protobufs.AgentCapabilities_AgentCapabilities_AcceptsPackages) &&
+		agent.hasCapability(protobufs.AgentCapabilities_AgentCapabilities_ReportsPackageStatuses)
+}
+
+// channelPackagesAvailable returns the PackagesAvailable of the channel for the
+// Agent, nil if no package was published to the channel.
+func (agents *Agents) channelPackagesAvailable(instanceId InstanceId, channel string) (*protobufs.PackagesAvailable, error) {
+	agents.packagesMux.RLock()
+	defer agents.packagesMux.RUnlock()
+
+	releases, ok := agents.packageChannels[channel]
+	if !ok {
+		return nil, nil
+	}
+	packages := map[string]*protobufs.PackageAvailable{}
+	for name, release := range releases {
+		downloadURL := release.File
+		if agents.packageDownloadURL != nil {
+			var err error
+			if downloadURL, err = agents.packageDownloadURL(instanceId, release.File); err != nil {
+				return nil, err
+			}
+		}
+		packages[name] = &protobufs.PackageAvailable{
+			Type:    protobufs.PackageType_PackageType_TopLevel,
+			Version: release.Version,
+			File: &protobufs.DownloadableFile{
+				DownloadUrl: downloadURL,
+				ContentHash: release.ContentHash,
+			},
+		}
+	}
+	return packagesAvailable(packages), nil
+}
+
+// offerChannelPackages sets the packages of the channel of the Agent in the
+// response, unless the Agent reported that it has them already.
+func (agents *Agents) offerChannelPackages(agent *Agent, response *protobufs.ServerToAgent) {
+	agent = agent.CloneReadonly()
+	if response.PackagesAvailable != nil || !acceptsChannelPackages(agent) {
+		return
+	}
+	// If the download URLs cannot be made the Agent is offered the packages in the
+	// response to its next status report.
+	available, err := agents.channelPackagesAvailable(agent.InstanceId, packageChannel(agent))
+	if err != nil || available == nil || bytes.Equal(
+		agent.Status.PackageStatuses.GetServerProvidedAllPackagesHash(), available.AllPackagesHash,
+	) {
+		return
+	}
+	response.PackagesAvailable = available
+}
+
+// offerChannelPackagesToAll offers the packages of the channel to the connected
+// Agents of the channel. Returns the Agents that the packages were sent to.
+func (agents *Agents) offerChannelPackagesToAll(channel string) ([]InstanceId, error) {
+	offered := []InstanceId{}
+	for instanceId, agent := range agents.GetAllAgentsReadonlyClone() {
+		if !acceptsChannelPackages(agent) || packageChannel(agent) != channel {
+			continue
+		}
+		available, err := agents.channelPackagesAvailable(instanceId, channel)
+		if err != nil {
+			return offered, fmt.Errorf("cannot offer packages to Agent %s: %v", instanceId, err)
+		}
+		if available == nil {
+			// Nothing was ever published to the channel.
+			break
+		}
+		err = agents.SendToAgent(instanceId, &protobufs.ServerToAgent{
+			InstanceUid:       string(instanceId),
+			PackagesAvailable: available,
+		})
+		if errors.Is(err, ErrAgentNotConnected) {
+			// Offered in the response to the next status report.
+			continue
+		}
+		if err != nil {
+			return offered, fmt.Errorf("cannot offer packages to Agent %s: %v", instanceId, err)
+		}
+		offered = append(offered, instanceId)
+	}
+	sort.Slice(offered, func(i, j int) bool { return offered[i] < offered[j] })
+	return offered, nil
+}
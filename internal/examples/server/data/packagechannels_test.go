@@ -0,0 +1,173 @@
+package data
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+const packageCapabilities = protobufs.AgentCapabilities_AgentCapabilities_AcceptsPackages |
+	protobufs.AgentCapabilities_AgentCapabilities_ReportsPackageStatuses
+
+// channelFleet is a fleet of Agents that records the packages offered to them.
+type channelFleet struct {
+	agents *Agents
+
+	mux     sync.Mutex
+	offered map[InstanceId]*protobufs.PackagesAvailable
+}
+
+func newChannelFleet() *channelFleet {
+	return &channelFleet{agents: newTestAgents(), offered: map[InstanceId]*protobufs.PackagesAvailable{}}
+}
+
+// add adds a connected Agent of the channel, the default channel if empty.
+func (f *channelFleet) add(instanceId InstanceId, channel string, capabilities protobufs.AgentCapabilities) *Agent {
+	conn := &testConn{onSend: func(msg *protobufs.ServerToAgent) error {
+		f.mux.Lock()
+		defer f.mux.Unlock()
+		f.offered[instanceId] = msg.PackagesAvailable
+		return nil
+	}}
+	agent := f.agents.FindOrCreateAgent(instanceId, conn)
+	agent.Status = &protobufs.AgentToServer{
+		InstanceUid:      string(instanceId),
+		Capabilities:     uint64(capabilities),
+		AgentDescription: &protobufs.AgentDescription{},
+	}
+	if channel != "" {
+		agent.Status.AgentDescription.NonIdentifyingAttributes = []*protobufs.KeyValue{
+			stringKV(PackageChannelAttribute, channel),
+		}
+	}
+	return agent
+}
+
+func (f *channelFleet) offeredTo(instanceId InstanceId) *protobufs.PackagesAvailable {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.offered[instanceId]
+}
+
+func TestPackageChannel(t *testing.T) {
+	fleet := newChannelFleet()
+	tests := []struct {
+		name  string
+		agent *Agent
+		want  string
+	}{
+		{"selected", fleet.add("beta", "beta", packageCapabilities), "beta"},
+		{"not selected", fleet.add("default", "", packageCapabilities), DefaultPackageChannel},
+		{"no description", NewAgent("new", nil), DefaultPackageChannel},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, packageChannel(test.agent))
+		})
+	}
+
+	agent := fleet.add("blank", "", packageCapabilities)
+	agent.Status.AgentDescription.NonIdentifyingAttributes = []*protobufs.KeyValue{stringKV(PackageChannelAttribute, "")}
+	assert.Equal(t, DefaultPackageChannel, packageChannel(agent))
+}
+
+func TestPublishPackageToChannel(t *testing.T) {
+	fleet := newChannelFleet()
+	fleet.add("beta1", "beta", packageCapabilities)
+	fleet.add("beta2", "beta", packageCapabilities)
+	fleet.add("stable", "", packageCapabilities)
+	fleet.add("beta-no-packages", "beta", protobufs.AgentCapabilities_AgentCapabilities_AcceptsPackages)
+	offline := fleet.add("beta-offline", "beta", packageCapabilities)
+	offline.Offline = true
+	fleet.agents.SetPackageDownloadURL(func(instanceId InstanceId, file string) (string, error) {
+		return "https://packages.example.com/" + file + "?agent=" + string(instanceId), nil
+	})
+
+	release := PackageRelease{Name: "otelcol", Version: "0.70.0", File: "otelcol-0.70.0.tar.gz", ContentHash: []byte{1}}
+	offered, err := fleet.agents.PublishPackage("beta", release)
+	require.NoError(t, err)
+	// Only the connected Agents of the channel that accept packages are offered them.
+	assert.Equal(t, []InstanceId{"beta1", "beta2"}, offered)
+
+	available := fleet.offeredTo("beta1")
+	require.NotNil(t, available)
+	require.Contains(t, available.Packages, "otelcol")
+	assert.Equal(t, "0.70.0", available.Packages["otelcol"].Version)
+	assert.Equal(t, "https://packages.example.com/otelcol-0.70.0.tar.gz?agent=beta1", available.Packages["otelcol"].File.DownloadUrl)
+	assert.NotEmpty(t, available.AllPackagesHash)
+	assert.Nil(t, fleet.offeredTo("stable"))
+
+	// The default channel is separate.
+	stableRelease := PackageRelease{Name: "otelcol", Version: "0.65.0", File: "otelcol-0.65.0.tar.gz"}
+	offered, err = fleet.agents.PublishPackage(DefaultPackageChannel, stableRelease)
+	require.NoError(t, err)
+	assert.Equal(t, []InstanceId{"stable"}, offered)
+	assert.Equal(t, "0.65.0", fleet.offeredTo("stable").Packages["otelcol"].Version)
+
+	assert.Equal(t, map[string][]PackageRelease{
+		"beta":                {release},
+		DefaultPackageChannel: {stableRelease},
+	}, fleet.agents.PackageChannels())
+
+	// Unpublishing offers the remaining packages, so that the Agents delete it.
+	offered, err = fleet.agents.UnpublishPackage("beta", "otelcol")
+	require.NoError(t, err)
+	assert.Equal(t, []InstanceId{"beta1", "beta2"}, offered)
+	assert.Empty(t, fleet.offeredTo("beta1").Packages)
+}
+
+func TestPublishPackageInvalid(t *testing.T) {
+	fleet := newChannelFleet()
+	for _, release := range []PackageRelease{{File: "f"}, {Name: "n"}} {
+		_, err := fleet.agents.PublishPackage("beta", release)
+		assert.Error(t, err)
+	}
+	_, err := fleet.agents.PublishPackage("", PackageRelease{Name: "n", File: "f"})
+	assert.Error(t, err)
+	assert.Empty(t, fleet.agents.PackageChannels())
+}
+
+func TestUnknownPackageChannel(t *testing.T) {
+	fleet := newChannelFleet()
+	nightly := fleet.add("nightly", "nightly", packageCapabilities)
+	_, err := fleet.agents.PublishPackage("beta", PackageRelease{Name: "otelcol", Version: "0.70.0", File: "f"})
+	require.NoError(t, err)
+
+	// Nothing was published to the channel selected by the Agent.
+	response := &protobufs.ServerToAgent{}
+	fleet.agents.offerChannelPackages(nightly, response)
+	assert.Nil(t, response.PackagesAvailable)
+	assert.Nil(t, fleet.offeredTo("nightly"))
+
+	// Nobody selected the channel.
+	offered, err := fleet.agents.PublishPackage("unused", PackageRelease{Name: "otelcol", File: "f"})
+	require.NoError(t, err)
+	assert.Empty(t, offered)
+}
+
+func TestOfferChannelPackagesInResponse(t *testing.T) {
+	fleet := newChannelFleet()
+	agent := fleet.add("beta", "beta", packageCapabilities)
+	agent.Offline = true
+	_, err := fleet.agents.PublishPackage("beta", PackageRelease{Name: "otelcol", Version: "0.70.0", File: "f"})
+	require.NoError(t, err)
+
+	// The Agent was not connected, it is offered the packages in the response to its
+	// next status report.
+	response := &protobufs.ServerToAgent{}
+	fleet.agents.offerChannelPackages(agent, response)
+	require.NotNil(t, response.PackagesAvailable)
+	assert.Contains(t, response.PackagesAvailable.Packages, "otelcol")
+
+	// Not offered again once the Agent reported that it has them.
+	agent.Status.PackageStatuses = &protobufs.PackageStatuses{
+		ServerProvidedAllPackagesHash: response.PackagesAvailable.AllPackagesHash,
+	}
+	response = &protobufs.ServerToAgent{}
+	fleet.agents.offerChannelPackages(agent, response)
+	assert.Nil(t, response.PackagesAvailable)
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"crypto/sha256"
+	"sort"
+	"strings"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server"
+)
+
+// PackageInstallation is a package reported by an Agent in its PackageStatuses.
+type PackageInstallation struct {
+	InstanceId   InstanceId `json:"instance_id"`
+	PackageName  string     `json:"package"`
+	Version      string     `json:"version"`
+	Status       string     `json:"status"`
+	ErrorMessage string     `json:"error,omitempty"`
+}
+
+// PackageQuery selects packages reported by the Agents. Empty fields match everything.
+type PackageQuery struct {
+	// Name of the package.
+	Name string
+
+	// Only match packages with the version lower than BelowVersion,
+	// according to server.CompareVersions.
+	BelowVersion string
+}
+
+func (q PackageQuery) matches(name string, status *protobufs.PackageStatus) bool {
+	if q.Name != "" && q.Name != name {
+		return false
+	}
+	if q.BelowVersion != "" && server.CompareVersions(status.AgentHasVersion, q.BelowVersion) >= 0 {
+		return false
+	}
+	return true
+}
+
+// QueryPackages returns the packages matching the query that the Agents reported,
+// e.g. all Agents that have package X below version Y. The result is sorted by
+// instance id and package name.
+func (agents *Agents) QueryPackages(query PackageQuery) []PackageInstallation {
+	result := []PackageInstallation{}
+	for _, agent := range agents.GetAllAgentsReadonlyClone() {
+		if agent.Status == nil || agent.Status.PackageStatuses == nil {
+			continue
+		}
+		for name, status := range agent.Status.PackageStatuses.Packages {
+			if status.AgentHasVersion == "" || !query.matches(name, status) {
+				// Only report packages that the Agent actually has.
+				continue
+			}
+			result = append(result, PackageInstallation{
+				InstanceId:   agent.InstanceId,
+				PackageName:  name,
+				Version:      status.AgentHasVersion,
+				Status:       strings.TrimPrefix(status.Status.String(), "PackageStatusEnum_"),
+				ErrorMessage: status.ErrorMessage,
+			})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].InstanceId != result[j].InstanceId {
+			return result[i].InstanceId < result[j].InstanceId
+		}
+		return result[i].PackageName < result[j].PackageName
+	})
+	return result
+}
+
+// OfferPackages sends the packages to the Agent in a PackagesAvailable message. The
+// packages replace all packages previously offered to the Agent. The hashes of the
+// packages and the hash of all packages are calculated from the package names,
+// versions and file content hashes.
+func (agents *Agents) OfferPackages(instanceId InstanceId, packages map[string]*protobufs.PackageAvailable) error {
+	return agents.SendToAgent(instanceId, &protobufs.ServerToAgent{
+		InstanceUid:       string(instanceId),
+		PackagesAvailable: packagesAvailable(packages),
+	})
+}
+
+// packagesAvailable returns the PackagesAvailable offering the packages, with the
+// hashes of the packages and the hash of all packages set.
+func packagesAvailable(packages map[string]*protobufs.PackageAvailable) *protobufs.PackagesAvailable {
+	names := make([]string, 0, len(packages))
+	for name := range packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	allHash := sha256.New()
+	for _, name := range names {
+		pkg := packages[name]
+		h := sha256.New()
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write([]byte(pkg.Version))
+		h.Write([]byte{0})
+		h.Write(pkg.File.GetContentHash())
+		pkg.Hash = h.Sum(nil)
+		allHash.Write(pkg.Hash)
+	}
+
+	return &protobufs.PackagesAvailable{
+		Packages:        packages,
+		AllPackagesHash: allHash.Sum(nil),
+	}
+}
@@ -0,0 +1,185 @@
+package data
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// RepeatedStatusLimits define when an Agent that keeps re-sending the identical full
+// state is throttled.
+type RepeatedStatusLimits struct {
+	// Number of consecutive identical full state reports after which the reports of
+	// the Agent are not processed anymore until the state changes.
+	MaxRepeats int
+
+	// The Agent is asked to wait for RetryAfter before sending the next report.
+	RetryAfter time.Duration
+}
+
+var DefaultRepeatedStatusLimits = RepeatedStatusLimits{
+	MaxRepeats: 3,
+	RetryAfter: 30 * time.Second,
+}
+
+// RepeatedStatusOffender describes an Agent that re-sent the identical full state.
+type RepeatedStatusOffender struct {
+	InstanceId InstanceId
+	// Total number of full state reports identical to the previous report.
+	Repeats int
+	// Number of reports that were not processed because of throttling.
+	Suppressed int
+	LastRepeat time.Time
+}
+
+type repeatedStatus struct {
+	RepeatedStatusOffender
+	lastHash [sha256.Size]byte
+	// Number of consecutive identical full state reports.
+	consecutive int
+	// The Server asked the Agent to report the full state, so the next full state
+	// report is expected even if it is identical to the previous one.
+	fullStateRequested bool
+}
+
+// RepeatedStatusDetector detects Agents that send the identical full state in every
+// report instead of reporting only the changes, as buggy Agent implementations do.
+// Processing the full state is expensive, so the reports of such Agents are throttled.
+type RepeatedStatusDetector struct {
+	limits RepeatedStatusLimits
+
+	mux    sync.Mutex
+	agents map[InstanceId]*repeatedStatus
+}
+
+func NewRepeatedStatusDetector(limits RepeatedStatusLimits) *RepeatedStatusDetector {
+	return &RepeatedStatusDetector{limits: limits, agents: map[InstanceId]*repeatedStatus{}}
+}
+
+// Check records the status report and returns a non-nil response if the report must
+// not be processed because the Agent sent the identical full state too many times in
+// a row. The response asks the Agent to back off.
+func (d *RepeatedStatusDetector) Check(
+	instanceId InstanceId, msg *protobufs.AgentToServer, now time.Time,
+) *protobufs.ServerToAgent {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	status := d.agents[instanceId]
+	if msg.AgentDescription == nil {
+		// Compressed report, i.e. the Agent reports only the changes.
+		if status != nil {
+			if status.Repeats == 0 && !status.fullStateRequested {
+				// Nothing worth remembering about a well-behaved Agent.
+				delete(d.agents, instanceId)
+			} else {
+				status.consecutive = 0
+			}
+		}
+		return nil
+	}
+
+	hash, ok := fullStateHash(msg)
+	if !ok {
+		return nil
+	}
+
+	if status == nil {
+		status = &repeatedStatus{RepeatedStatusOffender: RepeatedStatusOffender{InstanceId: instanceId}}
+		d.agents[instanceId] = status
+	} else if status.fullStateRequested {
+		status.fullStateRequested = false
+		status.consecutive = 0
+	} else if status.lastHash == hash {
+		status.consecutive++
+		status.Repeats++
+		status.LastRepeat = now
+	} else {
+		status.consecutive = 0
+	}
+	status.lastHash = hash
+
+	if status.consecutive < d.limits.MaxRepeats {
+		return nil
+	}
+
+	status.Suppressed++
+	return &protobufs.ServerToAgent{
+		ErrorResponse: &protobufs.ServerErrorResponse{
+			Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable,
+			ErrorMessage: "identical full state reported repeatedly, report only the changes",
+			Details: &protobufs.ServerErrorResponse_RetryInfo{
+				RetryInfo: &protobufs.RetryInfo{RetryAfterNanoseconds: uint64(d.limits.RetryAfter)},
+			},
+		},
+	}
+}
+
+// FullStateRequested records that the Server asked the Agent to report its full
+// state (ReportFullState flag), so that the next full state report is not counted
+// as a repeat.
+func (d *RepeatedStatusDetector) FullStateRequested(instanceId InstanceId) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	status := d.agents[instanceId]
+	if status == nil {
+		status = &repeatedStatus{RepeatedStatusOffender: RepeatedStatusOffender{InstanceId: instanceId}}
+		d.agents[instanceId] = status
+	}
+	status.fullStateRequested = true
+}
+
+// Forget removes the state kept for the Agent, e.g. when the Agent is removed from
+// the registry.
+func (d *RepeatedStatusDetector) Forget(instanceId InstanceId) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	delete(d.agents, instanceId)
+}
+
+// WorstOffenders returns up to limit Agents that repeated the full state the most,
+// sorted by the number of repeats in descending order. If limit is 0 all the Agents
+// that repeated the full state are returned.
+func (d *RepeatedStatusDetector) WorstOffenders(limit int) []RepeatedStatusOffender {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	var offenders []RepeatedStatusOffender
+	for _, status := range d.agents {
+		if status.Repeats > 0 {
+			offenders = append(offenders, status.RepeatedStatusOffender)
+		}
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].Repeats != offenders[j].Repeats {
+			return offenders[i].Repeats > offenders[j].Repeats
+		}
+		return offenders[i].InstanceId < offenders[j].InstanceId
+	})
+	if limit > 0 && len(offenders) > limit {
+		offenders = offenders[:limit]
+	}
+	return offenders
+}
+
+// fullStateHash returns the hash of the reported state, ignoring the fields that
+// change in every report.
+func fullStateHash(msg *protobufs.AgentToServer) (hash [sha256.Size]byte, ok bool) {
+	state := proto.Clone(msg).(*protobufs.AgentToServer)
+	state.InstanceUid = ""
+	state.SequenceNum = 0
+	bytes, err := proto.MarshalOptions{Deterministic: true}.Marshal(state)
+	if err != nil {
+		return hash, false
+	}
+	return sha256.Sum256(bytes), true
+}
+
+// RepeatedStatuses detects the Agents that keep re-sending the identical full state.
+var RepeatedStatuses = NewRepeatedStatusDetector(DefaultRepeatedStatusLimits)
@@ -0,0 +1,297 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// How often the health of the restarted Agents is checked.
+var restartHealthCheckInterval = time.Second
+
+// RestartState is the state of the restart of an Agent in a RestartRollout.
+type RestartState string
+
+const (
+	// RestartPending means the Agent was not restarted yet.
+	RestartPending RestartState = "pending"
+	// RestartInProgress means the restart command was sent and the Server waits
+	// for the Agent to report that it is healthy.
+	RestartInProgress RestartState = "in_progress"
+	// RestartSucceeded means the Agent restarted and reported that it is healthy.
+	RestartSucceeded RestartState = "succeeded"
+	// RestartFailed means the command could not be sent or the Agent did not report
+	// that it is healthy in time.
+	RestartFailed RestartState = "failed"
+	// RestartSkipped means the Agent cannot be restarted, e.g. it is offline or does
+	// not accept the restart command.
+	RestartSkipped RestartState = "skipped"
+)
+
+// RestartRolloutSettings control how a RestartRollout restarts the Agents.
+type RestartRolloutSettings struct {
+	// WaveSize is the number of Agents restarted in one wave. The next wave starts
+	// after all Agents of the previous wave are verified. 1 if zero.
+	WaveSize int
+
+	// MaxConcurrent is the maximum number of Agents of a wave that restart at the
+	// same time. WaveSize if zero.
+	MaxConcurrent int
+
+	// HealthTimeout is for how long to wait for a restarted Agent to report that it
+	// is healthy with a new start time. 2 minutes if zero.
+	HealthTimeout time.Duration
+
+	// MaxFailures is the number of failed restarts tolerated. The rollout is aborted
+	// after the wave in which more restarts failed.
+	MaxFailures int
+
+	// PauseBetweenWaves is for how long to wait before starting the next wave, e.g.
+	// to let the restarted Agents settle.
+	PauseBetweenWaves time.Duration
+}
+
+// RestartOutcome is the state of the restart of an Agent.
+type RestartOutcome struct {
+	InstanceId InstanceId   `json:"instance_id"`
+	Wave       int          `json:"wave"`
+	State      RestartState `json:"state"`
+	// Why the restart failed or was skipped.
+	Error string `json:"error,omitempty"`
+}
+
+// RestartRolloutStatus is the progress of a RestartRollout.
+type RestartRolloutStatus struct {
+	Waves          int              `json:"waves"`
+	CompletedWaves int              `json:"completed_waves"`
+	Agents         []RestartOutcome `json:"agents"`
+	Done           bool             `json:"done"`
+	// Aborted is why the rollout stopped before all waves completed, empty if it did not.
+	Aborted string `json:"aborted,omitempty"`
+}
+
+// RestartRollout restarts a set of Agents in waves, so that the whole fleet does
+// not restart at the same time. An Agent is restarted successfully when it reports
+// that it is healthy with a start time that differs from the one before the restart.
+type RestartRollout struct {
+	agents   *Agents
+	settings RestartRolloutSettings
+	cancel   chan struct{}
+	done     chan struct{}
+
+	cancelOnce sync.Once
+
+	mux    sync.Mutex
+	status RestartRolloutStatus
+}
+
+// RestartableAgents returns the online Agents that accept the restart command,
+// sorted by instance id.
+func (agents *Agents) RestartableAgents() []InstanceId {
+	result := []InstanceId{}
+	for instanceId, agent := range agents.GetAllAgentsReadonlyClone() {
+		if !agent.Offline &&
+			agent.Status.GetCapabilities()&uint64(protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand) != 0 {
+			result = append(result, instanceId)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// StartRestartRollout starts restarting the Agents in the order of instanceIds in the
+// background.
+func (agents *Agents) StartRestartRollout(instanceIds []InstanceId, settings RestartRolloutSettings) *RestartRollout {
+	if settings.WaveSize <= 0 {
+		settings.WaveSize = 1
+	}
+	if settings.MaxConcurrent <= 0 || settings.MaxConcurrent > settings.WaveSize {
+		settings.MaxConcurrent = settings.WaveSize
+	}
+	if settings.HealthTimeout <= 0 {
+		settings.HealthTimeout = 2 * time.Minute
+	}
+
+	r := &RestartRollout{
+		agents:   agents,
+		settings: settings,
+		cancel:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	r.status.Agents = []RestartOutcome{}
+	for i, instanceId := range instanceIds {
+		r.status.Agents = append(r.status.Agents, RestartOutcome{
+			InstanceId: instanceId,
+			Wave:       i / settings.WaveSize,
+			State:      RestartPending,
+		})
+	}
+	r.status.Waves = (len(instanceIds) + settings.WaveSize - 1) / settings.WaveSize
+
+	go r.run()
+	return r
+}
+
+// Status returns the current progress of the rollout.
+func (r *RestartRollout) Status() RestartRolloutStatus {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	status := r.status
+	status.Agents = append([]RestartOutcome(nil), r.status.Agents...)
+	return status
+}
+
+// Cancel stops the rollout. The Agents that are restarting are not verified and the
+// following waves are not started.
+func (r *RestartRollout) Cancel() {
+	r.cancelOnce.Do(func() { close(r.cancel) })
+}
+
+// Done returns a channel that is closed when the rollout is finished.
+func (r *RestartRollout) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *RestartRollout) run() {
+	defer func() {
+		r.mux.Lock()
+		r.status.Done = true
+		r.mux.Unlock()
+		close(r.done)
+	}()
+
+	for wave := 0; wave < r.status.Waves; wave++ {
+		if wave > 0 && r.settings.PauseBetweenWaves > 0 {
+			select {
+			case <-time.After(r.settings.PauseBetweenWaves):
+			case <-r.cancel:
+			}
+		}
+		if r.cancelled() {
+			r.abort("cancelled")
+			return
+		}
+
+		r.runWave(wave)
+
+		r.mux.Lock()
+		failures := 0
+		for _, outcome := range r.status.Agents {
+			if outcome.State == RestartFailed {
+				failures++
+			}
+		}
+		if !r.cancelled() {
+			r.status.CompletedWaves++
+		}
+		r.mux.Unlock()
+
+		if r.cancelled() {
+			r.abort("cancelled")
+			return
+		}
+		if failures > r.settings.MaxFailures {
+			r.abort(fmt.Sprintf("%d restarts failed, at most %d tolerated", failures, r.settings.MaxFailures))
+			return
+		}
+	}
+}
+
+func (r *RestartRollout) cancelled() bool {
+	select {
+	case <-r.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *RestartRollout) abort(reason string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.status.Aborted = reason
+}
+
+// runWave restarts the Agents of the wave, at most MaxConcurrent at the same time.
+func (r *RestartRollout) runWave(wave int) {
+	sem := make(chan struct{}, r.settings.MaxConcurrent)
+	var wg sync.WaitGroup
+	for i := range r.status.Agents {
+		if r.status.Agents[i].Wave != wave {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-r.cancel:
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem }()
+			defer wg.Done()
+			state, err := r.restartAgent(i)
+			r.setState(i, state, err)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (r *RestartRollout) setState(i int, state RestartState, err error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.status.Agents[i].State = state
+	if err != nil {
+		r.status.Agents[i].Error = err.Error()
+	}
+}
+
+// restartAgent sends the restart command to the Agent and waits until the Agent
+// reports that it is healthy again.
+func (r *RestartRollout) restartAgent(i int) (RestartState, error) {
+	r.mux.Lock()
+	instanceId := r.status.Agents[i].InstanceId
+	r.mux.Unlock()
+
+	agent := r.agents.GetAgentReadonlyClone(instanceId)
+	if agent == nil {
+		return RestartSkipped, fmt.Errorf("agent %s not found", instanceId)
+	}
+	if agent.Offline {
+		return RestartSkipped, fmt.Errorf("agent %s is offline", instanceId)
+	}
+	if agent.Status.GetCapabilities()&uint64(protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand) == 0 {
+		return RestartSkipped, fmt.Errorf("agent %s does not accept restart command", instanceId)
+	}
+	startedAt := agent.StartedAt
+
+	r.setState(i, RestartInProgress, nil)
+	err := r.agents.SendToAgent(instanceId, &protobufs.ServerToAgent{
+		InstanceUid: string(instanceId),
+		Command:     &protobufs.ServerToAgentCommand{Type: protobufs.CommandType_CommandType_Restart},
+	})
+	if err != nil {
+		return RestartFailed, fmt.Errorf("cannot send restart command: %v", err)
+	}
+
+	deadline := time.NewTimer(r.settings.HealthTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(restartHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.cancel:
+			return RestartFailed, fmt.Errorf("rollout cancelled before the agent reported healthy")
+		case <-deadline.C:
+			return RestartFailed, fmt.Errorf("agent did not report healthy within %v", r.settings.HealthTimeout)
+		case <-ticker.C:
+		}
+		agent = r.agents.GetAgentReadonlyClone(instanceId)
+		if agent != nil && !agent.Offline && agent.Status.GetHealth().GetHealthy() && !agent.StartedAt.Equal(startedAt) {
+			return RestartSucceeded, nil
+		}
+	}
+}
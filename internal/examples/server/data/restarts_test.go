@@ -0,0 +1,328 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// testConn is a WebSocket connection of an Agent that calls onSend for the messages
+// sent to the Agent.
+type testConn struct {
+	onSend func(msg *protobufs.ServerToAgent) error
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (c *testConn) Send(_ context.Context, msg *protobufs.ServerToAgent) error {
+	if c.onSend == nil {
+		return nil
+	}
+	return c.onSend(msg)
+}
+
+func (c *testConn) Disconnect() error {
+	return nil
+}
+
+// restartBehavior is what an Agent does when it receives the restart command.
+type restartBehavior int
+
+const (
+	// restartHealthy restarts and reports that it is healthy.
+	restartHealthy restartBehavior = iota
+	// restartSendFails cannot be sent the command.
+	restartSendFails
+	// restartOffline goes offline and does not come back.
+	restartOffline
+)
+
+// restartFleet is a fleet of Agents that accept the restart command.
+type restartFleet struct {
+	agents *Agents
+
+	mux  sync.Mutex
+	sent []InstanceId
+	// Called when the command is sent to the Agent, before it restarts.
+	onRestart func(instanceId InstanceId)
+}
+
+func newRestartFleet(t *testing.T) *restartFleet {
+	interval := restartHealthCheckInterval
+	restartHealthCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { restartHealthCheckInterval = interval })
+	return &restartFleet{agents: newTestAgents()}
+}
+
+func (f *restartFleet) add(instanceId InstanceId, behavior restartBehavior) {
+	conn := &testConn{}
+	agent := f.agents.FindOrCreateAgent(instanceId, conn)
+	agent.Status = &protobufs.AgentToServer{
+		InstanceUid:  string(instanceId),
+		Capabilities: uint64(protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand),
+		Health:       &protobufs.AgentHealth{Healthy: true},
+	}
+	agent.StartedAt = time.Now().Add(-time.Hour)
+
+	conn.onSend = func(msg *protobufs.ServerToAgent) error {
+		f.mux.Lock()
+		f.sent = append(f.sent, instanceId)
+		onRestart := f.onRestart
+		f.mux.Unlock()
+		if onRestart != nil {
+			onRestart(instanceId)
+		}
+
+		switch behavior {
+		case restartSendFails:
+			return errors.New("connection closed")
+		case restartOffline:
+			f.setOffline(instanceId)
+		default:
+			agent.mux.Lock()
+			agent.StartedAt = time.Now()
+			agent.mux.Unlock()
+		}
+		return nil
+	}
+}
+
+func (f *restartFleet) setOffline(instanceId InstanceId) {
+	agent := f.agents.FindAgent(instanceId)
+	agent.mux.Lock()
+	defer agent.mux.Unlock()
+	agent.Offline = true
+}
+
+func (f *restartFleet) sentCommands() []InstanceId {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return append([]InstanceId(nil), f.sent...)
+}
+
+func waitRollout(t *testing.T, r *RestartRollout) RestartRolloutStatus {
+	select {
+	case <-r.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("the rollout did not finish")
+	}
+	return r.Status()
+}
+
+func outcomeStates(status RestartRolloutStatus) map[InstanceId]RestartState {
+	states := map[InstanceId]RestartState{}
+	for _, outcome := range status.Agents {
+		states[outcome.InstanceId] = outcome.State
+	}
+	return states
+}
+
+func TestRestartRolloutWaves(t *testing.T) {
+	tests := []struct {
+		name      string
+		agents    int
+		waveSize  int
+		wantWaves []int
+	}{
+		{"default wave size", 3, 0, []int{0, 1, 2}},
+		{"even", 4, 2, []int{0, 0, 1, 1}},
+		{"last wave smaller", 5, 2, []int{0, 0, 1, 1, 2}},
+		{"one wave", 3, 10, []int{0, 0, 0}},
+		{"no agents", 0, 2, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fleet := newRestartFleet(t)
+			var ids []InstanceId
+			for i := 0; i < test.agents; i++ {
+				id := InstanceId(rune('a' + i))
+				fleet.add(id, restartHealthy)
+				ids = append(ids, id)
+			}
+
+			r := fleet.agents.StartRestartRollout(ids, RestartRolloutSettings{WaveSize: test.waveSize})
+			status := waitRollout(t, r)
+
+			var waves []int
+			for _, outcome := range status.Agents {
+				waves = append(waves, outcome.Wave)
+				assert.Equal(t, RestartSucceeded, outcome.State, outcome.InstanceId)
+			}
+			assert.Equal(t, test.wantWaves, waves)
+			wantWaveCount := 0
+			if len(test.wantWaves) > 0 {
+				wantWaveCount = test.wantWaves[len(test.wantWaves)-1] + 1
+			}
+			assert.Equal(t, wantWaveCount, status.Waves)
+			assert.Equal(t, wantWaveCount, status.CompletedWaves)
+			assert.True(t, status.Done)
+			assert.Empty(t, status.Aborted)
+		})
+	}
+}
+
+func TestRestartRolloutWavesInOrder(t *testing.T) {
+	fleet := newRestartFleet(t)
+	ids := []InstanceId{"a", "b", "c", "d", "e"}
+	for _, id := range ids {
+		fleet.add(id, restartHealthy)
+	}
+
+	// A wave starts only after all Agents of the previous wave restarted.
+	var r *RestartRollout
+	var started sync.WaitGroup
+	started.Add(1)
+	fleet.onRestart = func(instanceId InstanceId) {
+		started.Wait()
+		status := r.Status()
+		for _, outcome := range status.Agents {
+			if outcome.InstanceId == instanceId {
+				assert.Equal(t, outcome.Wave, status.CompletedWaves, instanceId)
+			}
+		}
+	}
+	r = fleet.agents.StartRestartRollout(ids, RestartRolloutSettings{WaveSize: 2, MaxConcurrent: 1})
+	started.Done()
+	waitRollout(t, r)
+
+	// With one restart at a time the Agents restart in the order of the rollout.
+	assert.Equal(t, ids, fleet.sentCommands())
+}
+
+func TestRestartRolloutFailureThreshold(t *testing.T) {
+	tests := []struct {
+		name        string
+		behaviors   []restartBehavior
+		maxFailures int
+		wantStates  []RestartState
+		wantAborted bool
+		wantWaves   int
+	}{
+		{
+			name:        "first failure aborts",
+			behaviors:   []restartBehavior{restartSendFails, restartHealthy, restartHealthy},
+			wantStates:  []RestartState{RestartFailed, RestartPending, RestartPending},
+			wantAborted: true,
+			wantWaves:   1,
+		},
+		{
+			name:        "failures within threshold",
+			behaviors:   []restartBehavior{restartSendFails, restartHealthy, restartHealthy},
+			maxFailures: 1,
+			wantStates:  []RestartState{RestartFailed, RestartSucceeded, RestartSucceeded},
+			wantWaves:   3,
+		},
+		{
+			name:        "aborts after the wave exceeding the threshold",
+			behaviors:   []restartBehavior{restartSendFails, restartHealthy, restartSendFails, restartHealthy},
+			maxFailures: 1,
+			wantStates:  []RestartState{RestartFailed, RestartSucceeded, RestartFailed, RestartPending},
+			wantAborted: true,
+			wantWaves:   3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fleet := newRestartFleet(t)
+			var ids []InstanceId
+			for i, behavior := range test.behaviors {
+				id := InstanceId(rune('a' + i))
+				fleet.add(id, behavior)
+				ids = append(ids, id)
+			}
+
+			r := fleet.agents.StartRestartRollout(ids, RestartRolloutSettings{MaxFailures: test.maxFailures})
+			status := waitRollout(t, r)
+
+			var states []RestartState
+			for _, outcome := range status.Agents {
+				states = append(states, outcome.State)
+			}
+			assert.Equal(t, test.wantStates, states)
+			assert.Equal(t, test.wantWaves, status.CompletedWaves)
+			if test.wantAborted {
+				assert.Contains(t, status.Aborted, "restarts failed")
+			} else {
+				assert.Empty(t, status.Aborted)
+			}
+		})
+	}
+}
+
+func TestRestartRolloutAgentOffline(t *testing.T) {
+	fleet := newRestartFleet(t)
+	fleet.add("a", restartOffline)
+	fleet.add("b", restartHealthy)
+	fleet.add("c", restartHealthy)
+	fleet.add("d", restartHealthy)
+
+	// "c" goes offline while the first wave restarts, before its own wave.
+	fleet.onRestart = func(instanceId InstanceId) {
+		if instanceId == "a" {
+			fleet.setOffline("c")
+		}
+	}
+
+	r := fleet.agents.StartRestartRollout(
+		[]InstanceId{"a", "b", "c", "d"},
+		RestartRolloutSettings{WaveSize: 2, HealthTimeout: 200 * time.Millisecond, MaxFailures: 1},
+	)
+	status := waitRollout(t, r)
+
+	assert.Equal(t, map[InstanceId]RestartState{
+		// Did not come back healthy.
+		"a": RestartFailed,
+		"b": RestartSucceeded,
+		"c": RestartSkipped,
+		"d": RestartSucceeded,
+	}, outcomeStates(status))
+	for _, outcome := range status.Agents {
+		switch outcome.InstanceId {
+		case "a":
+			assert.Contains(t, outcome.Error, "did not report healthy")
+		case "c":
+			assert.Contains(t, outcome.Error, "offline")
+		}
+	}
+	assert.Equal(t, 2, status.CompletedWaves)
+	assert.Empty(t, status.Aborted)
+	assert.NotContains(t, fleet.sentCommands(), InstanceId("c"))
+}
+
+func TestRestartRolloutCancel(t *testing.T) {
+	fleet := newRestartFleet(t)
+	fleet.add("a", restartOffline)
+	fleet.add("b", restartHealthy)
+
+	sent := make(chan struct{}, 1)
+	fleet.onRestart = func(InstanceId) { sent <- struct{}{} }
+	r := fleet.agents.StartRestartRollout([]InstanceId{"a", "b"}, RestartRolloutSettings{HealthTimeout: time.Minute})
+	<-sent
+	r.Cancel()
+	status := waitRollout(t, r)
+
+	assert.Equal(t, map[InstanceId]RestartState{"a": RestartFailed, "b": RestartPending}, outcomeStates(status))
+	assert.Equal(t, "cancelled", status.Aborted)
+	assert.Equal(t, 0, status.CompletedWaves)
+}
+
+func TestRestartableAgents(t *testing.T) {
+	fleet := newRestartFleet(t)
+	fleet.add("b", restartHealthy)
+	fleet.add("a", restartHealthy)
+	fleet.add("offline", restartHealthy)
+	fleet.setOffline("offline")
+	fleet.agents.FindOrCreateAgent("no-restart", &testConn{}).Status = &protobufs.AgentToServer{}
+
+	require.Equal(t, []InstanceId{"a", "b"}, fleet.agents.RestartableAgents())
+}
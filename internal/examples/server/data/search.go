@@ -0,0 +1,232 @@
+package data
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server"
+)
+
+// The fields of the Agent that the query terms can match, in addition to the
+// attributes of the AgentDescription.
+const (
+	queryFieldHealth     = "health"
+	queryFieldConfigHash = "config_hash"
+	queryFieldOffline    = "offline"
+	queryFieldTransport  = "transport"
+)
+
+// Query operators, the two-character ones first so that they are matched first.
+var queryOperators = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+// AgentQuery selects Agents from the registry, see ParseAgentQuery.
+type AgentQuery struct {
+	terms []queryTerm
+}
+
+type queryTerm struct {
+	field string
+	op    string
+	value string
+}
+
+// ParseAgentQuery parses a query made of space separated "<field><op><value>" terms,
+// all of which must match. The fields are:
+//
+//	health       "healthy", "unhealthy" or "unknown" if the Agent did not report its health
+//	config_hash  hex hash of the remote config the Agent reported it has
+//	offline      "true" or "false"
+//	transport    "WebSocket" or "HTTP"
+//
+// Any other field is the key of an identifying or non-identifying attribute of the
+// AgentDescription, e.g. "service.name". The operators are = and !=, and for the
+// attributes also <, <=, > and >= that compare versions using server.CompareVersions.
+// A missing attribute only matches !=. Values containing spaces can be quoted using
+// Go syntax, e.g.
+//
+//	service.name=otelcol service.version>=0.60.0 service.version<0.70.0 health=healthy
+//	host.name!="my host"
+//
+// An empty query matches all Agents.
+func ParseAgentQuery(query string) (*AgentQuery, error) {
+	tokens, err := splitQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	q := &AgentQuery{}
+	for _, token := range tokens {
+		term, err := parseQueryTerm(token)
+		if err != nil {
+			return nil, err
+		}
+		q.terms = append(q.terms, term)
+	}
+	return q, nil
+}
+
+// splitQuery splits the query on spaces that are not inside quoted values.
+func splitQuery(query string) ([]string, error) {
+	var tokens []string
+	var token strings.Builder
+	quoted, escaped := false, false
+	for _, r := range query {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && unicode.IsSpace(r):
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+			continue
+		}
+		token.WriteRune(r)
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted value in query %q", query)
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
+
+func parseQueryTerm(token string) (queryTerm, error) {
+	i := strings.IndexAny(token, "!=<>")
+	if i <= 0 {
+		return queryTerm{}, fmt.Errorf("invalid query term %q, must be <field><op><value>", token)
+	}
+	term := queryTerm{field: token[:i]}
+	for _, op := range queryOperators {
+		if strings.HasPrefix(token[i:], op) {
+			term.op = op
+			break
+		}
+	}
+	if term.op == "" {
+		return queryTerm{}, fmt.Errorf("invalid operator in query term %q", token)
+	}
+
+	term.value = token[i+len(term.op):]
+	if strings.HasPrefix(term.value, `"`) {
+		value, err := strconv.Unquote(term.value)
+		if err != nil {
+			return queryTerm{}, fmt.Errorf("invalid quoted value in query term %q", token)
+		}
+		term.value = value
+	}
+
+	switch term.field {
+	case queryFieldHealth, queryFieldConfigHash, queryFieldOffline, queryFieldTransport:
+		if term.op != "=" && term.op != "!=" {
+			return queryTerm{}, fmt.Errorf("field %s only supports = and != in query term %q", term.field, token)
+		}
+	}
+	return term, nil
+}
+
+// Matches returns true if the Agent matches all terms of the query. Must be called on
+// a readonly clone of the Agent or with agent.mux held.
+func (q *AgentQuery) Matches(agent *Agent) bool {
+	for _, term := range q.terms {
+		if !term.matches(agent) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t queryTerm) matches(agent *Agent) bool {
+	var value string
+	found := true
+	switch t.field {
+	case queryFieldHealth:
+		switch health := agent.Status.GetHealth(); {
+		case health == nil:
+			value = "unknown"
+		case health.Healthy:
+			value = "healthy"
+		default:
+			value = "unhealthy"
+		}
+	case queryFieldConfigHash:
+		value = hex.EncodeToString(agent.Status.GetRemoteConfigStatus().GetLastRemoteConfigHash())
+	case queryFieldOffline:
+		value = strconv.FormatBool(agent.Offline)
+	case queryFieldTransport:
+		value = agent.Transport.String()
+	default:
+		value, found = agentAttribute(agent.Status.GetAgentDescription(), t.field)
+	}
+
+	if !found {
+		return t.op == "!="
+	}
+	switch t.op {
+	case "=":
+		return value == t.value
+	case "!=":
+		return value != t.value
+	}
+	cmp := server.CompareVersions(value, t.value)
+	switch t.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// agentAttribute returns the value of the identifying or non-identifying attribute
+// with the key as a string.
+func agentAttribute(description *protobufs.AgentDescription, key string) (string, bool) {
+	for _, attrs := range [][]*protobufs.KeyValue{
+		description.GetIdentifyingAttributes(), description.GetNonIdentifyingAttributes(),
+	} {
+		for _, attr := range attrs {
+			if attr.Key != key {
+				continue
+			}
+			switch v := attr.Value.GetValue().(type) {
+			case *protobufs.AnyValue_StringValue:
+				return v.StringValue, true
+			case *protobufs.AnyValue_IntValue:
+				return strconv.FormatInt(v.IntValue, 10), true
+			case *protobufs.AnyValue_DoubleValue:
+				return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64), true
+			case *protobufs.AnyValue_BoolValue:
+				return strconv.FormatBool(v.BoolValue), true
+			case *protobufs.AnyValue_BytesValue:
+				return hex.EncodeToString(v.BytesValue), true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// Search returns the instance ids of the Agents matching the query, sorted.
+func (agents *Agents) Search(query *AgentQuery) []InstanceId {
+	result := []InstanceId{}
+	for instanceId, agent := range agents.GetAllAgentsReadonlyClone() {
+		if query.Matches(agent) {
+			result = append(result, instanceId)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
@@ -0,0 +1,145 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+func newTestAgents() *Agents {
+	return &Agents{
+		agentsById:  map[InstanceId]*Agent{},
+		connections: map[types.Connection]map[InstanceId]bool{},
+	}
+}
+
+// testAgent returns an Agent reporting the service name and version.
+func testAgent(id InstanceId, name, version string) *Agent {
+	agent := NewAgent(id, nil)
+	agent.Status = &protobufs.AgentToServer{
+		InstanceUid: string(id),
+		AgentDescription: &protobufs.AgentDescription{
+			IdentifyingAttributes: []*protobufs.KeyValue{
+				stringKV("service.name", name),
+				stringKV("service.version", version),
+			},
+		},
+	}
+	return agent
+}
+
+func TestParseAgentQueryMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"no operator", "service.name"},
+		{"no field", "=otelcol"},
+		{"unterminated quote", `host.name="my host`},
+		{"invalid quoted value", `host.name="a"b`},
+		{"version operator on health", "health>=healthy"},
+		{"version operator on offline", "offline<true"},
+		{"version operator on config hash", "config_hash>ab"},
+		{"version operator on transport", "transport<=HTTP"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseAgentQuery(test.query)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseAgentQuery(t *testing.T) {
+	q, err := ParseAgentQuery(`  service.name=otelcol   host.name!="my host"  service.version>=0.60.0 `)
+	require.NoError(t, err)
+	assert.Equal(t, []queryTerm{
+		{field: "service.name", op: "=", value: "otelcol"},
+		{field: "host.name", op: "!=", value: "my host"},
+		{field: "service.version", op: ">=", value: "0.60.0"},
+	}, q.terms)
+
+	q, err = ParseAgentQuery("")
+	require.NoError(t, err)
+	assert.Empty(t, q.terms)
+}
+
+func TestAgentQueryMatches(t *testing.T) {
+	agent := testAgent("1", "otelcol", "0.65.0")
+	agent.Status.AgentDescription.NonIdentifyingAttributes = []*protobufs.KeyValue{
+		stringKV("host.name", "my host"),
+		{Key: "cpus", Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_IntValue{IntValue: 8}}},
+	}
+	agent.Status.Health = &protobufs.AgentHealth{Healthy: true}
+	agent.Status.RemoteConfigStatus = &protobufs.RemoteConfigStatus{LastRemoteConfigHash: []byte{0xab, 0xcd}}
+	agent.Transport = TransportPlainHTTP
+
+	unknownHealth := testAgent("2", "otelcol", "0.65.0")
+
+	tests := []struct {
+		query string
+		agent *Agent
+		want  bool
+	}{
+		{"", agent, true},
+		{"service.name=otelcol", agent, true},
+		{"service.name=other", agent, false},
+		{"service.name!=other", agent, true},
+		{`host.name="my host"`, agent, true},
+		{"cpus=8", agent, true},
+		{"missing=x", agent, false},
+		{"missing!=x", agent, true},
+		{"service.version>=0.60.0", agent, true},
+		{"service.version>=0.60.0 service.version<0.70.0", agent, true},
+		{"service.version<0.65.0", agent, false},
+		{"service.version<=0.65", agent, true},
+		{"service.version>0.65.0-rc.1", agent, true},
+		{"service.version>0.100.0", agent, false},
+		{"service.name=otelcol service.version>0.70.0", agent, false},
+		{"health=healthy", agent, true},
+		{"health=unhealthy", agent, false},
+		{"health!=healthy", agent, false},
+		{"health=unknown", unknownHealth, true},
+		{"health=healthy", unknownHealth, false},
+		{"config_hash=abcd", agent, true},
+		{"config_hash=ab", agent, false},
+		{"config_hash=", unknownHealth, true},
+		{"offline=false", agent, true},
+		{"transport=HTTP", agent, true},
+		{"transport=WebSocket", unknownHealth, true},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			q, err := ParseAgentQuery(test.query)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, q.Matches(test.agent))
+		})
+	}
+}
+
+func TestAgentsSearch(t *testing.T) {
+	agents := newTestAgents()
+	for _, agent := range []*Agent{
+		testAgent("c", "otelcol", "0.70.0"),
+		testAgent("a", "otelcol", "0.60.0"),
+		testAgent("b", "fluentbit", "2.0.0"),
+	} {
+		agents.agentsById[agent.InstanceId] = agent
+	}
+
+	q, err := ParseAgentQuery("service.name=otelcol")
+	require.NoError(t, err)
+	assert.Equal(t, []InstanceId{"a", "c"}, agents.Search(q))
+
+	q, err = ParseAgentQuery("service.version>=1.0")
+	require.NoError(t, err)
+	assert.Equal(t, []InstanceId{"b"}, agents.Search(q))
+
+	q, err = ParseAgentQuery("service.name=other")
+	require.NoError(t, err)
+	assert.Equal(t, []InstanceId{}, agents.Search(q))
+}
@@ -0,0 +1,354 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// AgentSnapshot is the last-known state of an Agent that is persisted in the
+// registry snapshots. Pending connection settings and certificate offers are not
+// persisted, they are only valid while the Server is running.
+type AgentSnapshot struct {
+	InstanceId           InstanceId
+	Status               *protobufs.AgentToServer
+	StartedAt            time.Time
+	EffectiveConfig      string
+	CustomInstanceConfig string
+	Transport            Transport
+	LastSeen             time.Time
+	ClientCertificate    *CertificateInfo
+}
+
+// SnapshotCodec serializes the registry snapshots.
+type SnapshotCodec interface {
+	Encode(w io.Writer, snapshots []AgentSnapshot) error
+	Decode(r io.Reader) ([]AgentSnapshot, error)
+}
+
+// SnapshotCodecByName returns the codec with the specified name: "json" or "protobuf".
+func SnapshotCodecByName(name string) (SnapshotCodec, error) {
+	switch name {
+	case "json":
+		return JSONSnapshotCodec{}, nil
+	case "protobuf":
+		return ProtobufSnapshotCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown snapshot format %q", name)
+}
+
+// Snapshot returns the last-known state of all Agents.
+func (agents *Agents) Snapshot() []AgentSnapshot {
+	var snapshots []AgentSnapshot
+	for _, agent := range agents.GetAllAgentsReadonlyClone() {
+		snapshots = append(snapshots, AgentSnapshot{
+			InstanceId:           agent.InstanceId,
+			Status:               agent.Status,
+			StartedAt:            agent.StartedAt,
+			EffectiveConfig:      agent.EffectiveConfig,
+			CustomInstanceConfig: agent.CustomInstanceConfig,
+			Transport:            agent.Transport,
+			LastSeen:             agent.LastSeen,
+			ClientCertificate:    agent.ClientCertificate,
+		})
+	}
+	return snapshots
+}
+
+// Restore adds the Agents from the snapshots to the registry. The restored Agents
+// are offline until they connect again. Agents that are already in the registry
+// are not changed.
+func (agents *Agents) Restore(snapshots []AgentSnapshot) {
+	agents.mux.Lock()
+	defer agents.mux.Unlock()
+
+	for _, snapshot := range snapshots {
+		if agents.agentsById[snapshot.InstanceId] != nil {
+			continue
+		}
+		agent := NewAgent(snapshot.InstanceId, nil)
+		agent.Status = snapshot.Status
+		agent.StartedAt = snapshot.StartedAt
+		agent.EffectiveConfig = snapshot.EffectiveConfig
+		agent.CustomInstanceConfig = snapshot.CustomInstanceConfig
+		agent.Transport = snapshot.Transport
+		agent.LastSeen = snapshot.LastSeen
+		agent.ClientCertificate = snapshot.ClientCertificate
+		agent.Offline = true
+		agent.calcRemoteConfig()
+		agents.agentsById[snapshot.InstanceId] = agent
+	}
+}
+
+// SaveSnapshot writes the snapshot of the registry to the file at path. The file is
+// replaced atomically, so that a crash while saving does not corrupt the previous
+// snapshot.
+func (agents *Agents) SaveSnapshot(path string, codec SnapshotCodec) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := codec.Encode(tmp, agents.Snapshot()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores the registry from the snapshot file at path. A missing
+// file is not an error, there is nothing to restore in that case.
+func (agents *Agents) LoadSnapshot(path string, codec SnapshotCodec) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	snapshots, err := codec.Decode(f)
+	if err != nil {
+		return 0, fmt.Errorf("cannot decode snapshot %s: %w", path, err)
+	}
+	agents.Restore(snapshots)
+	return len(snapshots), nil
+}
+
+// RunSnapshotter saves the snapshot of the registry to the file at path every
+// interval until done is closed. The snapshot is saved one last time when done is
+// closed.
+func (agents *Agents) RunSnapshotter(
+	path string, codec SnapshotCodec, interval time.Duration, done <-chan struct{}, onError func(err error),
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			if err := agents.SaveSnapshot(path, codec); err != nil {
+				onError(err)
+			}
+			return
+		case <-ticker.C:
+			if err := agents.SaveSnapshot(path, codec); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// JSONSnapshotCodec serializes the snapshots as human-readable JSON.
+type JSONSnapshotCodec struct{}
+
+type jsonAgentSnapshot struct {
+	InstanceId           InstanceId       `json:"instance_id"`
+	Status               json.RawMessage  `json:"status,omitempty"`
+	StartedAt            time.Time        `json:"started_at"`
+	EffectiveConfig      string           `json:"effective_config,omitempty"`
+	CustomInstanceConfig string           `json:"custom_instance_config,omitempty"`
+	Transport            Transport        `json:"transport"`
+	LastSeen             time.Time        `json:"last_seen"`
+	ClientCertificate    *CertificateInfo `json:"client_certificate,omitempty"`
+}
+
+func (JSONSnapshotCodec) Encode(w io.Writer, snapshots []AgentSnapshot) error {
+	encoded := make([]jsonAgentSnapshot, 0, len(snapshots))
+	for _, s := range snapshots {
+		var status json.RawMessage
+		if s.Status != nil {
+			var err error
+			if status, err = protojson.Marshal(s.Status); err != nil {
+				return err
+			}
+		}
+		encoded = append(encoded, jsonAgentSnapshot{
+			InstanceId:           s.InstanceId,
+			Status:               status,
+			StartedAt:            s.StartedAt,
+			EffectiveConfig:      s.EffectiveConfig,
+			CustomInstanceConfig: s.CustomInstanceConfig,
+			Transport:            s.Transport,
+			LastSeen:             s.LastSeen,
+			ClientCertificate:    s.ClientCertificate,
+		})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(encoded)
+}
+
+func (JSONSnapshotCodec) Decode(r io.Reader) ([]AgentSnapshot, error) {
+	var decoded []jsonAgentSnapshot
+	if err := json.NewDecoder(r).Decode(&decoded); err != nil {
+		return nil, err
+	}
+	snapshots := make([]AgentSnapshot, 0, len(decoded))
+	for _, s := range decoded {
+		var status *protobufs.AgentToServer
+		if len(s.Status) > 0 {
+			status = &protobufs.AgentToServer{}
+			if err := protojson.Unmarshal(s.Status, status); err != nil {
+				return nil, err
+			}
+		}
+		snapshots = append(snapshots, AgentSnapshot{
+			InstanceId:           s.InstanceId,
+			Status:               status,
+			StartedAt:            s.StartedAt,
+			EffectiveConfig:      s.EffectiveConfig,
+			CustomInstanceConfig: s.CustomInstanceConfig,
+			Transport:            s.Transport,
+			LastSeen:             s.LastSeen,
+			ClientCertificate:    s.ClientCertificate,
+		})
+	}
+	return snapshots, nil
+}
+
+// ProtobufSnapshotCodec serializes the snapshots in the compact protobuf wire format.
+// Each snapshot is encoded as a KeyValueList in an ArrayValue.
+type ProtobufSnapshotCodec struct{}
+
+// Keys of the KeyValueList that encodes an AgentSnapshot.
+const (
+	snapshotInstanceIdKey           = "instance_id"
+	snapshotStatusKey               = "status"
+	snapshotStartedAtKey            = "started_at"
+	snapshotEffectiveConfigKey      = "effective_config"
+	snapshotCustomInstanceConfigKey = "custom_instance_config"
+	snapshotTransportKey            = "transport"
+	snapshotLastSeenKey             = "last_seen"
+	snapshotCertSubjectKey          = "client_certificate.subject"
+	snapshotCertNotAfterKey         = "client_certificate.not_after"
+	snapshotCertFingerprintKey      = "client_certificate.fingerprint"
+)
+
+func (ProtobufSnapshotCodec) Encode(w io.Writer, snapshots []AgentSnapshot) error {
+	array := &protobufs.ArrayValue{}
+	for _, s := range snapshots {
+		kvs := []*protobufs.KeyValue{
+			stringKV(snapshotInstanceIdKey, string(s.InstanceId)),
+			timeKV(snapshotStartedAtKey, s.StartedAt),
+			stringKV(snapshotEffectiveConfigKey, s.EffectiveConfig),
+			stringKV(snapshotCustomInstanceConfigKey, s.CustomInstanceConfig),
+			intKV(snapshotTransportKey, int64(s.Transport)),
+			timeKV(snapshotLastSeenKey, s.LastSeen),
+		}
+		if s.Status != nil {
+			status, err := proto.Marshal(s.Status)
+			if err != nil {
+				return err
+			}
+			kvs = append(kvs, &protobufs.KeyValue{
+				Key:   snapshotStatusKey,
+				Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_BytesValue{BytesValue: status}},
+			})
+		}
+		if cert := s.ClientCertificate; cert != nil {
+			kvs = append(kvs,
+				stringKV(snapshotCertSubjectKey, cert.Subject),
+				timeKV(snapshotCertNotAfterKey, cert.NotAfter),
+				stringKV(snapshotCertFingerprintKey, cert.Fingerprint),
+			)
+		}
+		array.Values = append(array.Values, &protobufs.AnyValue{
+			Value: &protobufs.AnyValue_KvlistValue{KvlistValue: &protobufs.KeyValueList{Values: kvs}},
+		})
+	}
+
+	bytes, err := proto.Marshal(array)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bytes)
+	return err
+}
+
+func (ProtobufSnapshotCodec) Decode(r io.Reader) ([]AgentSnapshot, error) {
+	bytes, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var array protobufs.ArrayValue
+	if err := proto.Unmarshal(bytes, &array); err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]AgentSnapshot, 0, len(array.Values))
+	for _, value := range array.Values {
+		var s AgentSnapshot
+		var cert CertificateInfo
+		hasCert := false
+		for _, kv := range value.GetKvlistValue().GetValues() {
+			v := kv.GetValue()
+			switch kv.Key {
+			case snapshotInstanceIdKey:
+				s.InstanceId = InstanceId(v.GetStringValue())
+			case snapshotStatusKey:
+				s.Status = &protobufs.AgentToServer{}
+				if err := proto.Unmarshal(v.GetBytesValue(), s.Status); err != nil {
+					return nil, err
+				}
+			case snapshotStartedAtKey:
+				s.StartedAt = unixNanoTime(v.GetIntValue())
+			case snapshotEffectiveConfigKey:
+				s.EffectiveConfig = v.GetStringValue()
+			case snapshotCustomInstanceConfigKey:
+				s.CustomInstanceConfig = v.GetStringValue()
+			case snapshotTransportKey:
+				s.Transport = Transport(v.GetIntValue())
+			case snapshotLastSeenKey:
+				s.LastSeen = unixNanoTime(v.GetIntValue())
+			case snapshotCertSubjectKey:
+				cert.Subject, hasCert = v.GetStringValue(), true
+			case snapshotCertNotAfterKey:
+				cert.NotAfter, hasCert = unixNanoTime(v.GetIntValue()), true
+			case snapshotCertFingerprintKey:
+				cert.Fingerprint, hasCert = v.GetStringValue(), true
+			}
+		}
+		if hasCert {
+			s.ClientCertificate = &cert
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, nil
+}
+
+func stringKV(key, value string) *protobufs.KeyValue {
+	return &protobufs.KeyValue{Key: key, Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: value}}}
+}
+
+func intKV(key string, value int64) *protobufs.KeyValue {
+	return &protobufs.KeyValue{Key: key, Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_IntValue{IntValue: value}}}
+}
+
+// timeKV encodes the time as Unix nanoseconds, zero time is encoded as 0.
+func timeKV(key string, t time.Time) *protobufs.KeyValue {
+	if t.IsZero() {
+		return intKV(key, 0)
+	}
+	return intKV(key, t.UnixNano())
+}
+
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos).UTC()
+}
@@ -0,0 +1,140 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// populatedTestAgents returns a registry with Agents that have all persisted
+// fields set.
+func populatedTestAgents() *Agents {
+	agents := newTestAgents()
+
+	full := testAgent("full", "otelcol", "0.65.0")
+	full.Status.Health = &protobufs.AgentHealth{Healthy: true, StartTimeUnixNano: 1234}
+	full.Status.RemoteConfigStatus = &protobufs.RemoteConfigStatus{LastRemoteConfigHash: []byte{1, 2, 3}}
+	full.StartedAt = time.Date(2022, 10, 1, 12, 30, 0, 123456789, time.UTC)
+	full.EffectiveConfig = "receivers: {}\n"
+	full.CustomInstanceConfig = "exporters: {}\n"
+	full.Transport = TransportPlainHTTP
+	full.LastSeen = time.Date(2022, 10, 2, 8, 0, 0, 1, time.UTC)
+	full.ClientCertificate = &CertificateInfo{
+		Subject:     "CN=agent",
+		NotAfter:    time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+		Fingerprint: "abcdef",
+	}
+
+	// The Agent did not report anything yet.
+	empty := NewAgent("empty", nil)
+
+	for _, agent := range []*Agent{full, empty} {
+		agents.agentsById[agent.InstanceId] = agent
+	}
+	return agents
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, name := range []string{"json", "protobuf"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := SnapshotCodecByName(name)
+			require.NoError(t, err)
+			path := filepath.Join(t.TempDir(), "snapshot")
+
+			saved := populatedTestAgents()
+			require.NoError(t, saved.SaveSnapshot(path, codec))
+
+			restored := newTestAgents()
+			n, err := restored.LoadSnapshot(path, codec)
+			require.NoError(t, err)
+			assert.Equal(t, 2, n)
+
+			want := saved.GetAllAgentsReadonlyClone()
+			got := restored.GetAllAgentsReadonlyClone()
+			require.Len(t, got, len(want))
+			for id, w := range want {
+				g := got[id]
+				require.NotNil(t, g, id)
+				assert.True(t, proto.Equal(w.Status, g.Status), id)
+				assert.True(t, w.StartedAt.Equal(g.StartedAt), id)
+				assert.Equal(t, w.EffectiveConfig, g.EffectiveConfig, id)
+				assert.Equal(t, w.CustomInstanceConfig, g.CustomInstanceConfig, id)
+				assert.Equal(t, w.Transport, g.Transport, id)
+				assert.True(t, w.LastSeen.Equal(g.LastSeen), id)
+				if w.ClientCertificate == nil {
+					assert.Nil(t, g.ClientCertificate, id)
+				} else if assert.NotNil(t, g.ClientCertificate, id) {
+					assert.Equal(t, w.ClientCertificate.Subject, g.ClientCertificate.Subject)
+					assert.True(t, w.ClientCertificate.NotAfter.Equal(g.ClientCertificate.NotAfter))
+					assert.Equal(t, w.ClientCertificate.Fingerprint, g.ClientCertificate.Fingerprint)
+				}
+				// The restored Agents are offline until they connect again.
+				assert.True(t, g.Offline, id)
+			}
+			assert.Equal(t, "exporters: {}\n", string(got["full"].remoteConfig.Config.ConfigMap[""].Body))
+		})
+	}
+}
+
+func TestLoadSnapshotCorrupt(t *testing.T) {
+	for _, name := range []string{"json", "protobuf"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := SnapshotCodecByName(name)
+			require.NoError(t, err)
+			dir := t.TempDir()
+
+			path := filepath.Join(dir, "snapshot")
+			require.NoError(t, populatedTestAgents().SaveSnapshot(path, codec))
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			for file, content := range map[string][]byte{
+				"truncated": data[:len(data)/2],
+				"garbage":   []byte("\xff\xff\xff not a snapshot"),
+			} {
+				corrupt := filepath.Join(dir, file)
+				require.NoError(t, os.WriteFile(corrupt, content, 0600))
+
+				agents := newTestAgents()
+				n, err := agents.LoadSnapshot(corrupt, codec)
+				assert.Error(t, err, file)
+				assert.Equal(t, 0, n, file)
+				assert.Empty(t, agents.GetAllAgentsReadonlyClone(), file)
+			}
+		})
+	}
+}
+
+func TestLoadSnapshotMissing(t *testing.T) {
+	agents := newTestAgents()
+	n, err := agents.LoadSnapshot(filepath.Join(t.TempDir(), "missing"), JSONSnapshotCodec{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRestoreKeepsKnownAgents(t *testing.T) {
+	agents := newTestAgents()
+	connected := testAgent("full", "otelcol", "0.70.0")
+	agents.agentsById[connected.InstanceId] = connected
+
+	agents.Restore(populatedTestAgents().Snapshot())
+
+	got := agents.GetAllAgentsReadonlyClone()
+	assert.Len(t, got, 2)
+	// The Agent that connected before the snapshot was loaded is not overwritten.
+	assert.False(t, got["full"].Offline)
+	version, _ := agentAttribute(got["full"].Status.AgentDescription, "service.version")
+	assert.Equal(t, "0.70.0", version)
+}
+
+func TestSnapshotCodecByNameUnknown(t *testing.T) {
+	_, err := SnapshotCodecByName("yaml")
+	assert.Error(t, err)
+}
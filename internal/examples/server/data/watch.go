@@ -0,0 +1,138 @@
+package data
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// AgentChangeType is the type of the AgentChange.
+type AgentChangeType string
+
+const (
+	// ChangeAdded indicates that a new Agent was added to the registry.
+	ChangeAdded AgentChangeType = "added"
+	// ChangeUpdated indicates that the state of the Agent changed.
+	ChangeUpdated AgentChangeType = "updated"
+	// ChangeRemoved indicates that the Agent was removed from the registry.
+	ChangeRemoved AgentChangeType = "removed"
+)
+
+// The names of the Agent fields reported in AgentChange.Fields.
+const (
+	FieldAgentDescription         = "agent_description"
+	FieldCapabilities             = "capabilities"
+	FieldHealth                   = "health"
+	FieldEffectiveConfig          = "effective_config"
+	FieldRemoteConfigStatus       = "remote_config_status"
+	FieldPackageStatuses          = "package_statuses"
+	FieldConnectionSettingsStatus = "connection_settings_status"
+	FieldCustomConfig             = "custom_config"
+	FieldOffline                  = "offline"
+	FieldTransport                = "transport"
+)
+
+// AgentChange is a change of the registry delivered to the watchers, see Agents.Watch.
+type AgentChange struct {
+	Type       AgentChangeType `json:"type"`
+	InstanceId InstanceId      `json:"instance_id"`
+	Time       time.Time       `json:"time"`
+	// The fields of the Agent that changed, only set for ChangeUpdated.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// Watch returns a channel that receives the changes of the registry until cancel is
+// called. The channel buffers up to buffer changes. If the receiver does not keep up
+// and the buffer is full the channel is closed, since the receiver missed changes;
+// it should then read the registry again and start a new watch.
+func (agents *Agents) Watch(buffer int) (changes <-chan AgentChange, cancel func()) {
+	ch := make(chan AgentChange, buffer)
+
+	agents.watchMux.Lock()
+	if agents.watchers == nil {
+		agents.watchers = map[chan AgentChange]bool{}
+	}
+	agents.watchers[ch] = true
+	agents.watchMux.Unlock()
+
+	cancel = func() {
+		agents.watchMux.Lock()
+		defer agents.watchMux.Unlock()
+		// The channel is already closed if it overflowed.
+		if agents.watchers[ch] {
+			delete(agents.watchers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// hasWatchers returns true if anyone watches the registry, so that the changes are
+// only calculated when needed.
+func (agents *Agents) hasWatchers() bool {
+	agents.watchMux.Lock()
+	defer agents.watchMux.Unlock()
+	return len(agents.watchers) > 0
+}
+
+// notifyWatchers delivers the change to all watchers without blocking.
+func (agents *Agents) notifyWatchers(change AgentChange) {
+	agents.watchMux.Lock()
+	defer agents.watchMux.Unlock()
+	for ch := range agents.watchers {
+		select {
+		case ch <- change:
+		default:
+			delete(agents.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// notifyUpdated delivers ChangeUpdated with the fields if any field changed.
+func (agents *Agents) notifyUpdated(instanceId InstanceId, fields ...string) {
+	if len(fields) == 0 {
+		return
+	}
+	agents.notifyWatchers(AgentChange{Type: ChangeUpdated, InstanceId: instanceId, Time: time.Now(), Fields: fields})
+}
+
+// UpdateAgentStatus updates the status of the Agent using Agent.UpdateStatus and
+// notifies the watchers about the changed fields. The packages of the release
+// channel of the Agent are offered in the response if the Agent does not have them.
+func (agents *Agents) UpdateAgentStatus(agent *Agent, statusMsg *protobufs.AgentToServer, response *protobufs.ServerToAgent) {
+	defer agents.offerChannelPackages(agent, response)
+	if !agents.hasWatchers() {
+		agent.UpdateStatus(statusMsg, response)
+		return
+	}
+	before := agent.CloneReadonly()
+	agent.UpdateStatus(statusMsg, response)
+	agents.notifyUpdated(agent.InstanceId, changedFields(before, agent.CloneReadonly())...)
+}
+
+// changedFields returns the names of the fields that differ between the readonly
+// clones of the Agent.
+func changedFields(before, after *Agent) []string {
+	var fields []string
+	check := func(name string, changed bool) {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+	check(FieldAgentDescription, !proto.Equal(before.Status.GetAgentDescription(), after.Status.GetAgentDescription()))
+	check(FieldCapabilities, before.Status.GetCapabilities() != after.Status.GetCapabilities())
+	check(FieldHealth, !proto.Equal(before.Status.GetHealth(), after.Status.GetHealth()))
+	check(FieldEffectiveConfig, !proto.Equal(before.Status.GetEffectiveConfig(), after.Status.GetEffectiveConfig()))
+	check(FieldRemoteConfigStatus, !proto.Equal(before.Status.GetRemoteConfigStatus(), after.Status.GetRemoteConfigStatus()))
+	check(FieldPackageStatuses, !proto.Equal(before.Status.GetPackageStatuses(), after.Status.GetPackageStatuses()))
+	beforeRejection, _ := connectionSettingsRejection(before.Status.GetHealth())
+	afterRejection, _ := connectionSettingsRejection(after.Status.GetHealth())
+	check(FieldConnectionSettingsStatus, beforeRejection != afterRejection)
+	check(FieldCustomConfig, before.CustomInstanceConfig != after.CustomInstanceConfig)
+	check(FieldOffline, before.Offline != after.Offline)
+	check(FieldTransport, before.Transport != after.Transport)
+	return fields
+}
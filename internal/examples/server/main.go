@@ -1,18 +1,42 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
+	"github.com/open-telemetry/opamp-go/internal/examples/server/adminapi"
 	"github.com/open-telemetry/opamp-go/internal/examples/server/data"
 	"github.com/open-telemetry/opamp-go/internal/examples/server/opampsrv"
 	"github.com/open-telemetry/opamp-go/internal/examples/server/uisrv"
+	"github.com/open-telemetry/opamp-go/internal/examples/server/webauth"
+	"github.com/open-telemetry/opamp-go/server"
 )
 
+// For how long the events are kept in the event log.
+const eventLogRetention = 30 * 24 * time.Hour
+
+// The URL the Agents download the package files from, unless OPAMP_PACKAGES_URL is set.
+const defaultPackagesURL = "http://localhost:4321/packages/"
+
 var logger = log.New(log.Default().Writer(), "[MAIN] ", log.Default().Flags()|log.Lmsgprefix|log.Lmicroseconds)
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCLI(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n%s", err, cliUsage)
+			os.Exit(1)
+		}
+		return
+	}
+
 	curDir, err := os.Getwd()
 	if err != nil {
 		panic(err)
@@ -20,10 +44,62 @@ func main() {
 
 	logger.Println("OpAMP Server starting...")
 
-	uisrv.Start(curDir)
 	opampSrv := opampsrv.NewServer(&data.AllAgents)
+	if dsn := os.Getenv("OPAMP_EVENT_LOG_DSN"); dsn != "" {
+		eventLog, err := openEventLog(dsn)
+		if err != nil {
+			logger.Fatalf("Cannot open event log: %v", err)
+		}
+		opampSrv.EnableEventLog(eventLog)
+		uisrv.SetEventLog(eventLog)
+	}
+	if dir := os.Getenv("OPAMP_PACKAGES_DIR"); dir != "" {
+		signer, err := packagesURLSigner()
+		if err != nil {
+			logger.Fatalf("Cannot create package URL signer: %v", err)
+		}
+		baseURL := os.Getenv("OPAMP_PACKAGES_URL")
+		if baseURL == "" {
+			baseURL = defaultPackagesURL
+		}
+		uisrv.EnablePackageDownloads(dir, baseURL, signer)
+	}
+	var guard *webauth.Guard
+	if issuer := os.Getenv("OPAMP_OIDC_ISSUER"); issuer != "" {
+		guard, err = webAuthGuard(issuer)
+		if err != nil {
+			logger.Fatalf("Cannot set up OIDC authentication: %v", err)
+		}
+		uisrv.SetWebAuth(guard)
+	}
+	uisrv.Start(curDir)
+	if path := os.Getenv("OPAMP_ADMISSION_RULES"); path != "" {
+		opampSrv.WatchAdmissionRules(path)
+	}
+	if path := os.Getenv("OPAMP_SNAPSHOT_FILE"); path != "" {
+		format := os.Getenv("OPAMP_SNAPSHOT_FORMAT")
+		if format == "" {
+			format = "json"
+		}
+		codec, err := data.SnapshotCodecByName(format)
+		if err != nil {
+			logger.Fatalf("Invalid OPAMP_SNAPSHOT_FORMAT: %v", err)
+		}
+		opampSrv.EnableSnapshots(path, codec)
+	}
 	opampSrv.Start()
 
+	adminSrv := adminapi.NewServer(&data.AllAgents)
+	if endpoint := os.Getenv("OPAMP_ADMIN_API_ENDPOINT"); endpoint != "" {
+		settings, err := adminAPISettings(endpoint, guard)
+		if err != nil {
+			logger.Fatalf("Invalid gRPC admin API settings: %v", err)
+		}
+		if err := adminSrv.Start(settings); err != nil {
+			logger.Fatalf("Cannot start gRPC admin API: %v", err)
+		}
+	}
+
 	logger.Println("OpAMP Server running...")
 
 	interrupt := make(chan os.Signal, 1)
@@ -32,5 +108,92 @@ func main() {
 
 	logger.Println("OpAMP Server shutting down...")
 	uisrv.Shutdown()
+	adminSrv.Stop()
 	opampSrv.Stop()
 }
+
+// adminAPISettings returns the settings of the gRPC admin API listening on the
+// endpoint. If the guard is set the calls are authenticated and authorized by it, as
+// the UI and the REST API, otherwise the token is read from OPAMP_ADMIN_API_TOKEN.
+// The API uses TLS if OPAMP_ADMIN_API_CERT and OPAMP_ADMIN_API_KEY specify the
+// certificate and key files.
+func adminAPISettings(endpoint string, guard *webauth.Guard) (adminapi.Settings, error) {
+	settings := adminapi.Settings{
+		ListenEndpoint: endpoint,
+		Token:          os.Getenv("OPAMP_ADMIN_API_TOKEN"),
+		Guard:          guard,
+	}
+	certFile, keyFile := os.Getenv("OPAMP_ADMIN_API_CERT"), os.Getenv("OPAMP_ADMIN_API_KEY")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return settings, err
+		}
+		settings.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	return settings, nil
+}
+
+// webAuthGuard returns the guard that protects the UI and the REST API with OpenID
+// Connect tokens issued by the issuer for the audience in OPAMP_OIDC_AUDIENCE. The
+// roles are read from the claim in OPAMP_OIDC_ROLES_CLAIM, "roles" by default.
+// OPAMP_UI_READ_ROLES and OPAMP_UI_WRITE_ROLES list the comma separated roles allowed
+// to view and to change the fleet; if a list is empty all authenticated users are allowed.
+func webAuthGuard(issuer string) (*webauth.Guard, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	authenticator, err := webauth.NewOIDCAuthenticator(ctx, webauth.OIDCSettings{
+		IssuerURL:  issuer,
+		Audience:   os.Getenv("OPAMP_OIDC_AUDIENCE"),
+		RolesClaim: os.Getenv("OPAMP_OIDC_ROLES_CLAIM"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	authorizer := webauth.RoleAuthorizer{
+		ReadRoles:  splitList(os.Getenv("OPAMP_UI_READ_ROLES")),
+		WriteRoles: splitList(os.Getenv("OPAMP_UI_WRITE_ROLES")),
+	}
+	guardLogger := log.New(log.Default().Writer(), "[AUTH] ", log.Default().Flags()|log.Lmsgprefix|log.Lmicroseconds)
+	return webauth.NewGuard(authenticator, authorizer, guardLogger), nil
+}
+
+// splitList splits the comma separated list, ignoring the empty elements.
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// packagesURLSigner returns the signer of the package download URLs. The key is read
+// from OPAMP_PACKAGES_SIGNING_KEY. A random key is generated if it is not set, in which
+// case the URLs handed out before a restart are no longer valid.
+func packagesURLSigner() (*server.URLSigner, error) {
+	key := []byte(os.Getenv("OPAMP_PACKAGES_SIGNING_KEY"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return server.NewURLSigner(key), nil
+}
+
+// openEventLog opens the event log in the SQL database specified by the dsn. The
+// driver is specified by OPAMP_EVENT_LOG_DRIVER, "sqlite3" by default, and must be
+// linked into the binary.
+func openEventLog(dsn string) (*data.EventLog, error) {
+	driver := os.Getenv("OPAMP_EVENT_LOG_DRIVER")
+	if driver == "" {
+		driver = "sqlite3"
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return data.OpenEventLog(db, eventLogRetention)
+}
@@ -0,0 +1,77 @@
+package opampsrv
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/internal/examples/server/data"
+	"github.com/open-telemetry/opamp-go/server"
+)
+
+// How often to check the admission rules file for changes.
+const admissionRulesCheckInterval = 5 * time.Second
+
+// WatchAdmissionRules loads the admission rules from the JSON file at path (see
+// server.AdmissionRules for the format) and reloads them every time the file changes,
+// until the Server is stopped.
+func (srv *Server) WatchAdmissionRules(path string) {
+	modTime, err := srv.loadAdmissionRules(path)
+	if err != nil {
+		srv.logger.Printf("Cannot load admission rules from %s: %v", path, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(admissionRulesCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-srv.done:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(path)
+				if err != nil || info.ModTime().Equal(modTime) {
+					continue
+				}
+				newModTime, err := srv.loadAdmissionRules(path)
+				if err != nil {
+					// Keep using the previous rules.
+					srv.logger.Printf("Cannot reload admission rules from %s: %v", path, err)
+					continue
+				}
+				modTime = newModTime
+			}
+		}
+	}()
+}
+
+func (srv *Server) loadAdmissionRules(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var rules server.AdmissionRules
+	if err := json.Unmarshal(bytes, &rules); err != nil {
+		return time.Time{}, err
+	}
+	refused := srv.admission.SetRules(rules)
+	srv.logger.Printf("Loaded admission rules from %s: %d allowed, %d denied",
+		path, len(rules.Allow), len(rules.Deny))
+
+	// Disconnect the connected Agents that are refused by the new rules. The Server
+	// rejects them when they reconnect.
+	for instanceUid, reason := range refused {
+		if agent := srv.agents.FindAgent(data.InstanceId(instanceUid)); agent != nil {
+			srv.logger.Printf("Disconnecting agent %s refused by the new admission rules: %v", instanceUid, reason)
+			if err := agent.Disconnect(); err != nil {
+				srv.logger.Printf("Cannot disconnect agent %s: %v", instanceUid, err)
+			}
+		}
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,14 @@
+package opampsrv
+
+import (
+	"github.com/open-telemetry/opamp-go/internal/examples/server/data"
+)
+
+// EnableEventLog makes the Server persist the Agents' lifecycle and config events
+// to the eventLog until the Server is stopped. Must be called before Start.
+func (srv *Server) EnableEventLog(eventLog *data.EventLog) {
+	srv.agents.AddEventListener(eventLog.Listener())
+	go eventLog.Run(srv.done, func(err error) {
+		srv.logger.Printf("Event log error: %v", err)
+	})
+}
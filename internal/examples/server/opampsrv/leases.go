@@ -0,0 +1,23 @@
+package opampsrv
+
+import (
+	"time"
+
+	"github.com/open-telemetry/opamp-go/internal/examples/server/data"
+)
+
+// How long the connection leases of the Agents stay valid unless renewed.
+const leaseTTL = 30 * time.Second
+
+// EnableLeases makes the Server publish to the shared store the connection leases
+// of the Agents connected to it, so that the Servers sharing the store know where
+// each Agent is connected. serverId must be unique among the Servers. The forward
+// func is optional, if set it is used to forward the messages to the Agents
+// connected to other Servers. Must be called before Start.
+func (srv *Server) EnableLeases(store data.LeaseStore, serverId string, forward data.LeaseForwarder) {
+	leases := data.NewLeases(store, serverId, listenEndpoint, leaseTTL, forward, func(err error) {
+		srv.logger.Printf("Connection lease error: %v", err)
+	})
+	srv.agents.EnableLeases(leases)
+	go leases.RunRenewer(srv.done)
+}
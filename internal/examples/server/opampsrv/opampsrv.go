@@ -2,8 +2,14 @@ package opampsrv
 
 import (
 	"context"
+	"crypto/x509"
 	"log"
+	"math/rand"
 	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/oklog/ulid/v2"
 
 	"github.com/open-telemetry/opamp-go/internal/examples/server/data"
 	"github.com/open-telemetry/opamp-go/protobufs"
@@ -11,14 +17,37 @@ import (
 	"github.com/open-telemetry/opamp-go/server/types"
 )
 
+// The endpoint to accept the OpAMP connections on.
+const listenEndpoint = "127.0.0.1:4320"
+
+// How often to check for Agents that stopped sending messages.
+const offlineCheckInterval = 10 * time.Second
+
 type Server struct {
 	opampSrv server.OpAMPServer
 	agents   *data.Agents
+	logger   *log.Logger
+
+	// Closed when the Server is stopped.
+	done chan struct{}
+
+	// Detects cloned Agents that reuse the instance id of another Agent.
+	duplicates *data.DuplicateDetector
+
+	// Admits only the Agents allowed by the admission rules.
+	admission *server.AdmissionFilter
+
+	// Closed when the snapshotter saved the last snapshot, nil if the snapshots
+	// are not enabled.
+	snapshotterStopped chan struct{}
 }
 
 func NewServer(agents *data.Agents) *Server {
 	srv := &Server{
-		agents: agents,
+		agents:     agents,
+		duplicates: data.NewDuplicateDetector(),
+		admission:  server.NewAdmissionFilter(server.AdmissionRules{}),
+		done:       make(chan struct{}),
 	}
 
 	logger := log.New(
@@ -27,6 +56,7 @@ func NewServer(agents *data.Agents) *Server {
 		log.Default().Flags()|log.Lmsgprefix|log.Lmicroseconds,
 	)
 
+	srv.logger = logger
 	srv.opampSrv = server.New(&Logger{logger})
 
 	return srv
@@ -35,40 +65,106 @@ func NewServer(agents *data.Agents) *Server {
 func (srv *Server) Start() {
 	settings := server.StartSettings{
 		Settings: server.Settings{
+			AgentPolicy: srv.admission.Admit,
 			Callbacks: server.CallbacksStruct{
 				OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+					transport := data.TransportPlainHTTP
+					if websocket.IsWebSocketUpgrade(request) {
+						transport = data.TransportWebSocket
+					}
+					var clientCert *x509.Certificate
+					if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+						clientCert = request.TLS.PeerCertificates[0]
+					}
 					return types.ConnectionResponse{Accept: true, ConnectionCallbacks: server.ConnectionCallbacksStruct{
-						OnMessageFunc:         srv.onMessage,
-						OnConnectionCloseFunc: srv.onDisconnect,
+						OnMessageFunc: func(conn types.Connection, msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+							return srv.onMessage(conn, msg, transport, clientCert)
+						},
+						OnConnectionCloseFunc: func(conn types.Connection) {
+							srv.agents.RemoveConnection(conn, transport)
+						},
 					}}
 				},
 			},
 		},
-		ListenEndpoint: "127.0.0.1:4320",
+		ListenEndpoint: listenEndpoint,
 	}
 
+	srv.agents.AddEventListener(func(event data.AgentEvent) {
+		srv.logger.Printf("Agent %s: %s %s", event.InstanceId, event.Type, event.Details)
+		if event.Type == data.AgentRemoved {
+			// Forget everything remembered about the Agent.
+			srv.admission.Forget(string(event.InstanceId))
+			srv.duplicates.Forget(event.InstanceId)
+			data.RepeatedStatuses.Forget(event.InstanceId)
+		}
+	})
+	go srv.agents.RunOfflineChecker(data.DefaultOfflineTimeouts, offlineCheckInterval, srv.done)
+
 	srv.opampSrv.Start(settings)
 }
 
 func (srv *Server) Stop() {
+	close(srv.done)
 	srv.opampSrv.Stop(context.Background())
+	if srv.snapshotterStopped != nil {
+		<-srv.snapshotterStopped
+	}
 }
 
-func (srv *Server) onDisconnect(conn types.Connection) {
-	srv.agents.RemoveConnection(conn)
-}
-
-func (srv *Server) onMessage(conn types.Connection, msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+func (srv *Server) onMessage(
+	conn types.Connection, msg *protobufs.AgentToServer, transport data.Transport, clientCert *x509.Certificate,
+) *protobufs.ServerToAgent {
 	instanceId := data.InstanceId(msg.InstanceUid)
 
+	if msg.Flags&uint64(protobufs.AgentToServerFlags_AgentToServerFlags_RequestInstanceUid) != 0 {
+		// Assign the requested instance id and ask the Agent to report its full state
+		// with it.
+		newInstanceId := newInstanceUid()
+		srv.logger.Printf("Agent %s requested a new instance id, assigning %s", instanceId, newInstanceId)
+		return &protobufs.ServerToAgent{
+			AgentIdentification: &protobufs.AgentIdentification{NewInstanceUid: newInstanceId},
+			Flags:               uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState),
+		}
+	}
+
+	if srv.duplicates.IsDuplicate(instanceId, msg.AgentDescription) {
+		// Another host already uses this instance id. Ask the Agent to use a new one.
+		newInstanceId := newInstanceUid()
+		srv.logger.Printf("Agent %s is a duplicate of another Agent, assigning new instance id %s",
+			instanceId, newInstanceId)
+		return &protobufs.ServerToAgent{
+			AgentIdentification: &protobufs.AgentIdentification{NewInstanceUid: newInstanceId},
+		}
+	}
+
 	agent := srv.agents.FindOrCreateAgent(instanceId, conn)
+	srv.agents.MarkSeen(agent, transport)
+	srv.agents.RecordClientCertificate(agent, clientCert)
+
+	if response := data.RepeatedStatuses.Check(instanceId, msg, time.Now()); response != nil {
+		// The Agent keeps sending the identical full state, don't waste resources on
+		// processing it again.
+		return response
+	}
 
 	// Start building the response.
 	response := &protobufs.ServerToAgent{}
 
+	srv.agents.RecordRemoteConfigStatus(agent, msg.RemoteConfigStatus)
+
 	// Process the status report and continue building the response.
-	agent.UpdateStatus(msg, response)
+	srv.agents.UpdateAgentStatus(agent, msg, response)
+	if response.Flags&uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState) != 0 {
+		// The full state the Agent sends next is requested, not repeated.
+		data.RepeatedStatuses.FullStateRequested(instanceId)
+	}
 
 	// Send the response back to the Agent.
 	return response
 }
+
+func newInstanceUid() string {
+	entropy := ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0)
+	return ulid.MustNew(ulid.Timestamp(time.Now()), entropy).String()
+}
@@ -0,0 +1,31 @@
+package opampsrv
+
+import (
+	"time"
+
+	"github.com/open-telemetry/opamp-go/internal/examples/server/data"
+)
+
+// How often to save the snapshot of the Agents registry.
+const snapshotInterval = time.Minute
+
+// EnableSnapshots restores the Agents registry from the snapshot file at path and
+// then saves the snapshot periodically and when the Server is stopped, so that the
+// last-known state of the offline Agents survives a restart of the Server.
+// Must be called before Start.
+func (srv *Server) EnableSnapshots(path string, codec data.SnapshotCodec) {
+	count, err := srv.agents.LoadSnapshot(path, codec)
+	if err != nil {
+		srv.logger.Printf("Cannot restore Agents from snapshot: %v", err)
+	} else if count > 0 {
+		srv.logger.Printf("Restored %d Agents from snapshot %s", count, path)
+	}
+
+	srv.snapshotterStopped = make(chan struct{})
+	go func() {
+		defer close(srv.snapshotterStopped)
+		srv.agents.RunSnapshotter(path, codec, snapshotInterval, srv.done, func(err error) {
+			srv.logger.Printf("Cannot save snapshot of Agents: %v", err)
+		})
+	}()
+}
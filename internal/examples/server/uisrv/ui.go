@@ -2,28 +2,115 @@ package uisrv
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/open-telemetry/opamp-go/internal/examples/server/data"
+	"github.com/open-telemetry/opamp-go/internal/examples/server/webauth"
 	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server"
 )
 
 var htmlDir string
 var srv *http.Server
 
+// Validity of the client certificates issued when rotating certificates.
+const certificateValidity = 90 * 24 * time.Hour
+
+// Default period for which certificates are considered to be nearing expiry.
+const defaultCertificateExpiryWithin = 30 * 24 * time.Hour
+
+// Issues the client certificates that are offered to the Agents.
+var certificateIssuer data.CertificateIssuer
+
+// Protects the UI pages and the REST API, nil if not enabled.
+var guard *webauth.Guard
+
+// The persisted history of the Agents' events, nil if not enabled.
+var eventLog *data.EventLog
+
+// Default number of events returned by /api/events.
+const defaultEventsLimit = 100
+
+// For how long the download URLs of the offered packages are valid.
+const packageURLTTL = time.Hour
+
+// The last restart rollout started using /api/restarts.
+var restartRollout struct {
+	mux     sync.Mutex
+	rollout *data.RestartRollout
+}
+
+// The package files served to the Agents, see EnablePackageDownloads.
+var packages struct {
+	dir     string
+	baseURL string
+	signer  *server.URLSigner
+}
+
 var logger = log.New(log.Default().Writer(), "[UI] ", log.Default().Flags()|log.Lmsgprefix|log.Lmicroseconds)
 
 func Start(rootDir string) {
 	htmlDir = path.Join(rootDir, "uisrv/html")
 
+	ca, err := data.NewCertificateAuthority(certificateValidity)
+	if err != nil {
+		logger.Fatalf("Cannot create certificate authority: %v", err)
+	}
+	certificateIssuer = ca
+
+	read := func(h http.HandlerFunc) http.HandlerFunc { return guard.Protect(webauth.OperationRead, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return guard.Protect(webauth.OperationWrite, h) }
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", renderRoot)
-	mux.HandleFunc("/agent", renderAgent)
-	mux.HandleFunc("/save_config", saveCustomConfigForInstance)
+	mux.HandleFunc("/", read(renderRoot))
+	mux.HandleFunc("/agent", read(renderAgent))
+	mux.HandleFunc("/save_config", write(saveCustomConfigForInstance))
+	mux.HandleFunc("/api/agents", read(searchAgents))
+	mux.HandleFunc("/api/agents/watch", read(watchAgents))
+	mux.HandleFunc("/api/packages", read(queryPackages))
+	mux.HandleFunc("/api/connection-settings/rejections", read(queryConnectionSettingsRejections))
+	mux.HandleFunc("/api/certificates/expiring", read(queryExpiringCertificates))
+	mux.HandleFunc("/api/certificates/rotate", write(rotateExpiringCertificates))
+	mux.HandleFunc("/api/status/repeated", read(queryRepeatedStatusOffenders))
+	mux.HandleFunc("/api/events", read(queryEvents))
+	queryRestarts, controlRestarts := read(queryRestartRollout), write(controlRestartRollout)
+	mux.HandleFunc("/api/restarts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			queryRestarts(w, r)
+		} else {
+			controlRestarts(w, r)
+		}
+	})
+	if packages.signer != nil {
+		// The Agents download the packages using signed URLs, not the admin credentials.
+		mux.Handle("/packages/", packagesHandler(packages.dir, packages.signer))
+		mux.HandleFunc("/api/packages/offer", write(offerPackage))
+		data.AllAgents.SetPackageDownloadURL(func(instanceId data.InstanceId, file string) (string, error) {
+			return packages.signer.Sign(packages.baseURL+url.PathEscape(file), string(instanceId), packageURLTTL)
+		})
+		queryChannels, controlChannels := read(queryPackageChannels), write(controlPackageChannels)
+		mux.HandleFunc("/api/packages/channels", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				queryChannels(w, r)
+			} else {
+				controlChannels(w, r)
+			}
+		})
+	}
 	srv = &http.Server{
 		Addr:    "0.0.0.0:4321",
 		Handler: mux,
@@ -31,6 +118,36 @@ func Start(rootDir string) {
 	go srv.ListenAndServe()
 }
 
+// SetWebAuth protects the UI pages and the REST API with the guard. Browsers must
+// send the credentials expected by the guard, e.g. via an authenticating proxy.
+// Must be called before Start.
+func SetWebAuth(g *webauth.Guard) {
+	guard = g
+}
+
+// SetEventLog enables the /api/events endpoint that queries the eventLog.
+// Must be called before Start.
+func SetEventLog(l *data.EventLog) {
+	eventLog = l
+}
+
+// EnablePackageDownloads enables serving the package files stored in dir at /packages/
+// and offering them to the Agents using /api/packages/offer or publishing them to the
+// release channels using /api/packages/channels. The Agents download the
+// files from baseURL, which must point to /packages/ of this server, using URLs
+// signed by signer. Must be called before Start.
+func EnablePackageDownloads(dir string, baseURL string, signer *server.URLSigner) {
+	packages.dir = dir
+	packages.baseURL = strings.TrimSuffix(baseURL, "/") + "/"
+	packages.signer = signer
+}
+
+// packagesHandler serves the files stored in dir at /packages/. Only requests using
+// URLs signed by signer that did not expire are served.
+func packagesHandler(dir string, signer *server.URLSigner) http.Handler {
+	return signer.Handler(http.StripPrefix("/packages/", http.FileServer(http.Dir(dir))))
+}
+
 func Shutdown() {
 	srv.Shutdown(context.Background())
 }
@@ -103,3 +220,448 @@ func saveCustomConfigForInstance(w http.ResponseWriter, r *http.Request) {
 
 	http.Redirect(w, r, "/agent?instanceid="+string(instanceId), http.StatusSeeOther)
 }
+
+// searchAgents returns the instance ids of the Agents matching the query in the "q"
+// parameter as JSON, see data.ParseAgentQuery for the syntax, e.g.
+// /api/agents?q=config_hash=0a1b2c lists the Agents that run the config with that hash.
+func searchAgents(w http.ResponseWriter, r *http.Request) {
+	query, err := data.ParseAgentQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data.AllAgents.Search(query)); err != nil {
+		logger.Printf("Error writing agent search response: %v", err)
+	}
+}
+
+// How often a comment is sent to the idle watch streams to keep the connections open.
+const watchKeepAliveInterval = 30 * time.Second
+
+// watchAgents streams the changes of the registry as server-sent events, one
+// data.AgentChange JSON per event, so that the UIs don't need to poll. The stream
+// ends if the client does not keep up; the client should then read the Agents again
+// and reconnect.
+func watchAgents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	changes, cancel := data.AllAgents.Watch(100)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			bytes, err := json.Marshal(change)
+			if err != nil {
+				logger.Printf("Error encoding agent change: %v", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", change.Type, bytes); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// queryPackages returns the packages reported by the Agents as JSON. The packages
+// can be filtered using "name" and "below" (version) query parameters, e.g.
+// /api/packages?name=otelcol&below=0.60.0 lists the Agents that need an upgrade.
+func queryPackages(w http.ResponseWriter, r *http.Request) {
+	query := data.PackageQuery{
+		Name:         r.URL.Query().Get("name"),
+		BelowVersion: r.URL.Query().Get("below"),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data.AllAgents.QueryPackages(query)); err != nil {
+		logger.Printf("Error writing package query response: %v", err)
+	}
+}
+
+// queryConnectionSettingsRejections returns the Agents that rejected the last
+// connection settings offer as JSON. The rejections can be filtered using the
+// "reason" query parameter, e.g. /api/connection-settings/rejections?reason=untrusted_ca
+// lists the Agents that do not trust the CA of a rotated certificate.
+func queryConnectionSettingsRejections(w http.ResponseWriter, r *http.Request) {
+	rejections := data.AllAgents.ConnectionSettingsRejections(r.URL.Query().Get("reason"))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rejections); err != nil {
+		logger.Printf("Error writing connection settings rejections response: %v", err)
+	}
+}
+
+// parseWithin parses the "within" query parameter that specifies how soon the
+// certificates expire, e.g. "within=720h".
+func parseWithin(r *http.Request) (time.Duration, error) {
+	within := r.URL.Query().Get("within")
+	if within == "" {
+		return defaultCertificateExpiryWithin, nil
+	}
+	return time.ParseDuration(within)
+}
+
+// queryExpiringCertificates returns the Agents that run on certificates that expire
+// soon as JSON, e.g. /api/certificates/expiring?within=168h lists the certificates
+// that expire within a week.
+func queryExpiringCertificates(w http.ResponseWriter, r *http.Request) {
+	within, err := parseWithin(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data.AllAgents.ExpiringCertificates(within, time.Now())); err != nil {
+		logger.Printf("Error writing expiring certificates response: %v", err)
+	}
+}
+
+// rotateExpiringCertificates offers new certificates to the Agents that run on
+// certificates that expire soon and returns the instance ids of these Agents as JSON.
+// Must be called using POST, e.g. POST /api/certificates/rotate?within=168h.
+func rotateExpiringCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	within, err := parseWithin(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rotated, err := data.AllAgents.RotateExpiringCertificates(certificateIssuer, within, time.Now())
+	if err != nil {
+		logger.Printf("Error rotating certificates: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rotated); err != nil {
+		logger.Printf("Error writing certificate rotation response: %v", err)
+	}
+}
+
+// queryRepeatedStatusOffenders returns the Agents that re-send the identical full
+// state, worst offenders first, as JSON. The number of the returned Agents can be
+// limited using the "limit" query parameter, e.g. /api/status/repeated?limit=10.
+func queryRepeatedStatusOffenders(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data.RepeatedStatuses.WorstOffenders(limit)); err != nil {
+		logger.Printf("Error writing repeated status offenders response: %v", err)
+	}
+}
+
+// queryEvents returns the persisted events of the Agents as JSON, the newest first.
+// The events can be filtered using the "agent", "type" and "since" query parameters
+// and limited using the "limit" query parameter, e.g.
+// /api/events?agent=01G7Q&type=config_failed&since=2022-07-01T00:00:00Z&limit=10.
+func queryEvents(w http.ResponseWriter, r *http.Request) {
+	if eventLog == nil {
+		http.Error(w, "event log is not enabled", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	query := data.EventQuery{
+		InstanceId: data.InstanceId(params.Get("agent")),
+		Type:       params.Get("type"),
+		Limit:      defaultEventsLimit,
+	}
+	if s := params.Get("since"); s != "" {
+		since, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query.Since = since
+	}
+	if s := params.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+
+	events, err := eventLog.Query(query)
+	if err != nil {
+		logger.Printf("Error querying event log: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		logger.Printf("Error writing events response: %v", err)
+	}
+}
+
+// queryRestartRollout returns the progress of the last restart rollout as JSON.
+func queryRestartRollout(w http.ResponseWriter, _ *http.Request) {
+	restartRollout.mux.Lock()
+	rollout := restartRollout.rollout
+	restartRollout.mux.Unlock()
+	if rollout == nil {
+		http.Error(w, "no restart rollout was started", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rollout.Status()); err != nil {
+		logger.Printf("Error writing restart rollout response: %v", err)
+	}
+}
+
+// controlRestartRollout starts a restart rollout on POST and cancels the running one
+// on DELETE. The Agents to restart are listed in the "instanceids" query parameter,
+// all online Agents that accept the restart command are restarted if it is empty.
+// The waves are controlled using the "wave_size", "max_concurrent", "health_timeout",
+// "max_failures" and "pause" query parameters, e.g.
+// POST /api/restarts?wave_size=10&max_concurrent=5&health_timeout=2m&max_failures=1&pause=30s.
+func controlRestartRollout(w http.ResponseWriter, r *http.Request) {
+	restartRollout.mux.Lock()
+	defer restartRollout.mux.Unlock()
+	running := restartRollout.rollout != nil && !restartRollout.rollout.Status().Done
+
+	switch r.Method {
+	case http.MethodDelete:
+		if !running {
+			http.Error(w, "no restart rollout is running", http.StatusNotFound)
+			return
+		}
+		restartRollout.rollout.Cancel()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if running {
+		http.Error(w, "a restart rollout is already running", http.StatusConflict)
+		return
+	}
+
+	settings, err := parseRestartRolloutSettings(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var instanceIds []data.InstanceId
+	for _, id := range strings.Split(r.URL.Query().Get("instanceids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			instanceIds = append(instanceIds, data.InstanceId(id))
+		}
+	}
+	if len(instanceIds) == 0 {
+		instanceIds = data.AllAgents.RestartableAgents()
+	}
+
+	restartRollout.rollout = data.AllAgents.StartRestartRollout(instanceIds, settings)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(restartRollout.rollout.Status()); err != nil {
+		logger.Printf("Error writing restart rollout response: %v", err)
+	}
+}
+
+func parseRestartRolloutSettings(params url.Values) (data.RestartRolloutSettings, error) {
+	var settings data.RestartRolloutSettings
+	ints := map[string]*int{
+		"wave_size":      &settings.WaveSize,
+		"max_concurrent": &settings.MaxConcurrent,
+		"max_failures":   &settings.MaxFailures,
+	}
+	for name, v := range ints {
+		if s := params.Get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return settings, fmt.Errorf("invalid %s: %q", name, s)
+			}
+			*v = n
+		}
+	}
+	durations := map[string]*time.Duration{
+		"health_timeout": &settings.HealthTimeout,
+		"pause":          &settings.PauseBetweenWaves,
+	}
+	for name, v := range durations {
+		if s := params.Get(name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				return settings, fmt.Errorf("invalid %s: %q", name, s)
+			}
+			*v = d
+		}
+	}
+	return settings, nil
+}
+
+// offerPackage offers the package file to the Agent, replacing the packages previously
+// offered to it. The download URL is signed for the Agent and expires after
+// packageURLTTL. Must be called using POST, e.g.
+// POST /api/packages/offer?instanceid=01G7Q&name=otelcol&version=0.60.0&file=otelcol-0.60.0.tar.gz.
+func offerPackage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	instanceId := data.InstanceId(params.Get("instanceid"))
+	name, version, file := params.Get("name"), params.Get("version"), params.Get("file")
+	if instanceId == "" || name == "" || file == "" || file != filepath.Base(file) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	contentHash, err := fileContentHash(filepath.Join(packages.dir, file))
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Printf("Error hashing package file %s: %v", file, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	downloadURL, err := packages.signer.Sign(packages.baseURL+url.PathEscape(file), string(instanceId), packageURLTTL)
+	if err != nil {
+		logger.Printf("Error signing package URL: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = data.AllAgents.OfferPackages(instanceId, map[string]*protobufs.PackageAvailable{
+		name: {
+			Type:    protobufs.PackageType_PackageType_TopLevel,
+			Version: version,
+			File: &protobufs.DownloadableFile{
+				DownloadUrl: downloadURL,
+				ContentHash: contentHash,
+			},
+		},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryPackageChannels returns the packages published to every release channel as
+// JSON.
+func queryPackageChannels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data.AllAgents.PackageChannels()); err != nil {
+		logger.Printf("Error writing package channels response: %v", err)
+	}
+}
+
+// controlPackageChannels publishes a package file to a release channel using POST,
+// e.g. POST /api/packages/channels?channel=beta&name=otelcol&version=0.61.0&file=otelcol-0.61.0.tar.gz,
+// or removes the package from the channel using DELETE, e.g.
+// DELETE /api/packages/channels?channel=beta&name=otelcol. The Agents select the
+// channel using the data.PackageChannelAttribute attribute. Returns the Agents the
+// packages of the channel were sent to as JSON.
+func controlPackageChannels(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	channel, name := params.Get("channel"), params.Get("name")
+	if channel == "" || name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var offered []data.InstanceId
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		file := params.Get("file")
+		if file == "" || file != filepath.Base(file) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		contentHash, hashErr := fileContentHash(filepath.Join(packages.dir, file))
+		if os.IsNotExist(hashErr) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if hashErr != nil {
+			logger.Printf("Error hashing package file %s: %v", file, hashErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		offered, err = data.AllAgents.PublishPackage(channel, data.PackageRelease{
+			Name:        name,
+			Version:     params.Get("version"),
+			File:        file,
+			ContentHash: contentHash,
+		})
+	case http.MethodDelete:
+		offered, err = data.AllAgents.UnpublishPackage(channel, name)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		logger.Printf("Error offering the packages of channel %s: %v", channel, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(offered); err != nil {
+		logger.Printf("Error writing package channels response: %v", err)
+	}
+}
+
+// fileContentHash returns the SHA256 hash of the file content.
+func fileContentHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
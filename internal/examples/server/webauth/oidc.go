@@ -0,0 +1,363 @@
+package webauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // Registers the SHA256 hash for the signatures.
+	_ "crypto/sha512" // Registers the SHA384 and SHA512 hashes for the signatures.
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tolerated clock difference between the Server and the identity provider.
+const clockSkew = time.Minute
+
+// The signing keys of the identity provider are fetched again at most this often when
+// a token is signed with an unknown key.
+const keysRefreshInterval = time.Minute
+
+var (
+	errMalformedToken = errors.New("malformed token")
+	errUnknownKey     = errors.New("token is signed with an unknown key")
+	errBadSignature   = errors.New("invalid token signature")
+)
+
+// OIDCSettings are the settings of an OIDCAuthenticator.
+type OIDCSettings struct {
+	// IssuerURL is the URL of the OpenID Provider, e.g. "https://accounts.example.com".
+	// The provider configuration is discovered at IssuerURL/.well-known/openid-configuration.
+	IssuerURL string
+
+	// Audience the tokens must be issued for, usually the client ID of the admin
+	// application at the provider. Must be set.
+	Audience string
+
+	// RolesClaim is the claim listing the roles of the caller, either a list of
+	// strings or a space separated string. "roles" if empty.
+	RolesClaim string
+
+	// HTTPClient used to fetch the provider configuration and the keys.
+	// http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// OIDCAuthenticator authenticates the requests carrying an OpenID Connect token
+// (a JWT signed by the OpenID Provider) in the "Authorization: Bearer <token>"
+// header. The RS256, RS384, RS512, ES256, ES384 and ES512 signatures are supported.
+type OIDCAuthenticator struct {
+	settings OIDCSettings
+	jwksURI  string
+
+	mux         sync.Mutex
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// NewOIDCAuthenticator discovers the configuration of the OpenID Provider and fetches
+// its signing keys.
+func NewOIDCAuthenticator(ctx context.Context, settings OIDCSettings) (*OIDCAuthenticator, error) {
+	if settings.Audience == "" {
+		return nil, errors.New("OIDC audience must be set")
+	}
+	if settings.RolesClaim == "" {
+		settings.RolesClaim = "roles"
+	}
+	if settings.HTTPClient == nil {
+		settings.HTTPClient = http.DefaultClient
+	}
+	settings.IssuerURL = strings.TrimSuffix(settings.IssuerURL, "/")
+
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(ctx, settings.HTTPClient, settings.IssuerURL+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("cannot discover OpenID Provider configuration: %v", err)
+	}
+	if discovery.Issuer != settings.IssuerURL {
+		return nil, fmt.Errorf("OpenID Provider issuer %q does not match %q", discovery.Issuer, settings.IssuerURL)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("OpenID Provider configuration has no jwks_uri")
+	}
+
+	a := &OIDCAuthenticator{settings: settings, jwksURI: discovery.JWKSURI}
+	if err := a.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *OIDCAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	const prefix = "Bearer "
+	value := r.Header.Get("Authorization")
+	if len(value) <= len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return nil, ErrNoCredentials
+	}
+	claims, err := a.verify(r.Context(), value[len(prefix):], time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{}
+	if sub, ok := claims["sub"].(string); ok {
+		principal.Subject = sub
+	}
+	switch roles := claims[a.settings.RolesClaim].(type) {
+	case string:
+		principal.Roles = strings.Fields(roles)
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				principal.Roles = append(principal.Roles, s)
+			}
+		}
+	}
+	return principal, nil
+}
+
+// verify verifies the signature and the claims of the token and returns the claims.
+func (a *OIDCAuthenticator) verify(ctx context.Context, token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != a.settings.IssuerURL {
+		return nil, fmt.Errorf("token issuer %q is not trusted", iss)
+	}
+	if !hasAudience(claims["aud"], a.settings.Audience) {
+		return nil, errors.New("token is not issued for this audience")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	return claims, nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the signing key with the kid. Fetches the keys again if the kid is
+// unknown, e.g. because the provider rotated its keys.
+func (a *OIDCAuthenticator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mux.Lock()
+	key, ok := a.keys[kid]
+	refresh := !ok && time.Since(a.keysFetched) > keysRefreshInterval
+	a.mux.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !refresh {
+		return nil, errUnknownKey
+	}
+	if err := a.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if key, ok = a.keys[kid]; !ok {
+		return nil, errUnknownKey
+	}
+	return key, nil
+}
+
+func (a *OIDCAuthenticator) refreshKeys(ctx context.Context) error {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, a.settings.HTTPClient, a.jwksURI, &jwks); err != nil {
+		return fmt.Errorf("cannot fetch OpenID Provider keys: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip the keys of unsupported types.
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.keys = keys
+	a.keysFetched = time.Now()
+	return nil
+}
+
+// jsonWebKey is a public key as defined in RFC 7517.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA keys.
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token signature algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+			return errBadSignature
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return errBadSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errBadSignature
+		}
+	default:
+		return errBadSignature
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errMalformedToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errMalformedToken
+	}
+	return nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: response code=%d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
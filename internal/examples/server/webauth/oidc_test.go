@@ -0,0 +1,350 @@
+package webauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAudience = "opamp-admin"
+
+// testProvider is an OpenID Provider serving its configuration and keys.
+type testProvider struct {
+	server     *httptest.Server
+	rsaKey     *rsa.PrivateKey
+	ecdsaKey   *ecdsa.PrivateKey
+	jwksServed int32
+
+	mux  sync.Mutex
+	jwks []jsonWebKey
+}
+
+func startTestProvider(t *testing.T) *testProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	p := &testProvider{rsaKey: rsaKey, ecdsaKey: ecdsaKey}
+	p.jwks = []jsonWebKey{rsaJWK("rsa", &rsaKey.PublicKey), ecdsaJWK("ec", &ecdsaKey.PublicKey)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   p.server.URL,
+			"jwks_uri": p.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&p.jwksServed, 1)
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": p.jwks})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *testProvider) addKey(jwk jsonWebKey) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.jwks = append(p.jwks, jwk)
+}
+
+func (p *testProvider) authenticator(t *testing.T) *OIDCAuthenticator {
+	a, err := NewOIDCAuthenticator(context.Background(), OIDCSettings{
+		IssuerURL: p.server.URL,
+		Audience:  testAudience,
+	})
+	require.NoError(t, err)
+	return a
+}
+
+// claims returns valid claims issued by p.
+func (p *testProvider) claims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   p.server.URL,
+		"aud":   testAudience,
+		"sub":   "alice",
+		"exp":   now.Add(time.Hour).Unix(),
+		"nbf":   now.Add(-time.Minute).Unix(),
+		"roles": []string{"reader"},
+	}
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecdsaJWK(kid string, key *ecdsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "EC",
+		Kid: kid,
+		Use: "sig",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+// signToken returns a token with the header and the claims signed by key. key is
+// an *rsa.PrivateKey, an *ecdsa.PrivateKey or nil for an unsigned token.
+func signToken(t *testing.T, header map[string]string, claims map[string]interface{}, key crypto.Signer) string {
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(header) + "." + encode(claims)
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		digest := crypto.SHA256.New()
+		digest.Write([]byte(signed))
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest.Sum(nil))
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		digest := crypto.SHA256.New()
+		digest.Write([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		require.NoError(t, err)
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	provider := startTestProvider(t)
+	a := provider.authenticator(t)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		header  map[string]string
+		modify  func(claims map[string]interface{})
+		key     crypto.Signer
+		wantErr string
+	}{
+		{
+			name:   "valid RS256",
+			header: map[string]string{"alg": "RS256", "kid": "rsa"},
+			key:    provider.rsaKey,
+		},
+		{
+			name:   "valid ES256",
+			header: map[string]string{"alg": "ES256", "kid": "ec"},
+			key:    provider.ecdsaKey,
+		},
+		{
+			name:   "audience list",
+			header: map[string]string{"alg": "RS256", "kid": "rsa"},
+			modify: func(claims map[string]interface{}) {
+				claims["aud"] = []string{"other", testAudience}
+			},
+			key: provider.rsaKey,
+		},
+		{
+			name:   "expired",
+			header: map[string]string{"alg": "RS256", "kid": "rsa"},
+			modify: func(claims map[string]interface{}) {
+				claims["exp"] = now.Add(-2 * clockSkew).Unix()
+			},
+			key:     provider.rsaKey,
+			wantErr: "token is expired",
+		},
+		{
+			name:   "expired within clock skew",
+			header: map[string]string{"alg": "RS256", "kid": "rsa"},
+			modify: func(claims map[string]interface{}) {
+				claims["exp"] = now.Add(-clockSkew / 2).Unix()
+			},
+			key: provider.rsaKey,
+		},
+		{
+			name:   "no expiry",
+			header: map[string]string{"alg": "RS256", "kid": "rsa"},
+			modify: func(claims map[string]interface{}) {
+				delete(claims, "exp")
+			},
+			key:     provider.rsaKey,
+			wantErr: "token is expired",
+		},
+		{
+			name:   "not valid yet",
+			header: map[string]string{"alg": "RS256", "kid": "rsa"},
+			modify: func(claims map[string]interface{}) {
+				claims["nbf"] = now.Add(2 * clockSkew).Unix()
+			},
+			key:     provider.rsaKey,
+			wantErr: "token is not valid yet",
+		},
+		{
+			name:   "wrong issuer",
+			header: map[string]string{"alg": "RS256", "kid": "rsa"},
+			modify: func(claims map[string]interface{}) {
+				claims["iss"] = "https://evil.example.com"
+			},
+			key:     provider.rsaKey,
+			wantErr: "is not trusted",
+		},
+		{
+			name:   "wrong audience",
+			header: map[string]string{"alg": "RS256", "kid": "rsa"},
+			modify: func(claims map[string]interface{}) {
+				claims["aud"] = "other"
+			},
+			key:     provider.rsaKey,
+			wantErr: "not issued for this audience",
+		},
+		{
+			name:    "ES256 alg with RSA key",
+			header:  map[string]string{"alg": "ES256", "kid": "rsa"},
+			key:     provider.rsaKey,
+			wantErr: errBadSignature.Error(),
+		},
+		{
+			name:    "RS256 alg with EC key",
+			header:  map[string]string{"alg": "RS256", "kid": "ec"},
+			key:     provider.ecdsaKey,
+			wantErr: errBadSignature.Error(),
+		},
+		{
+			name:    "signed by another key",
+			header:  map[string]string{"alg": "ES256", "kid": "ec"},
+			key:     mustECDSAKey(t),
+			wantErr: errBadSignature.Error(),
+		},
+		{
+			name:    "alg none",
+			header:  map[string]string{"alg": "none", "kid": "rsa"},
+			wantErr: "unsupported token signature algorithm",
+		},
+		{
+			name:    "unknown kid",
+			header:  map[string]string{"alg": "RS256", "kid": "unknown"},
+			key:     provider.rsaKey,
+			wantErr: errUnknownKey.Error(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := provider.claims(now)
+			if test.modify != nil {
+				test.modify(claims)
+			}
+			token := signToken(t, test.header, claims, test.key)
+			got, err := a.verify(context.Background(), token, now)
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "alice", got["sub"])
+		})
+	}
+}
+
+func TestOIDCVerifyMalformed(t *testing.T) {
+	provider := startTestProvider(t)
+	a := provider.authenticator(t)
+
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!!.e30.", "e30.!!.", "e30.e30.!!"} {
+		_, err := a.verify(context.Background(), token, time.Now())
+		assert.Error(t, err, token)
+	}
+}
+
+func TestOIDCRefreshesKeysOnUnknownKid(t *testing.T) {
+	provider := startTestProvider(t)
+	a := provider.authenticator(t)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&provider.jwksServed))
+
+	// The provider rotated in a new key.
+	rotated := mustECDSAKey(t)
+	provider.addKey(ecdsaJWK("rotated", &rotated.PublicKey))
+	now := time.Now()
+	token := signToken(t, map[string]string{"alg": "ES256", "kid": "rotated"}, provider.claims(now), rotated)
+
+	// The keys were just fetched, so they are not fetched again.
+	_, err := a.verify(context.Background(), token, now)
+	assert.ErrorIs(t, err, errUnknownKey)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&provider.jwksServed))
+
+	a.mux.Lock()
+	a.keysFetched = time.Now().Add(-2 * keysRefreshInterval)
+	a.mux.Unlock()
+	_, err = a.verify(context.Background(), token, now)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&provider.jwksServed))
+}
+
+func TestOIDCAuthenticate(t *testing.T) {
+	provider := startTestProvider(t)
+	a := provider.authenticator(t)
+	claims := provider.claims(time.Now())
+	claims["roles"] = "reader writer"
+	token := signToken(t, map[string]string{"alg": "RS256", "kid": "rsa"}, claims, provider.rsaKey)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/agents", nil)
+	_, err := a.Authenticate(r)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	r.Header.Set("Authorization", "Basic "+token)
+	_, err = a.Authenticate(r)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	r.Header.Set("Authorization", "bearer "+token)
+	principal, err := a.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Subject: "alice", Roles: []string{"reader", "writer"}}, principal)
+
+	r.Header.Set("Authorization", "Bearer "+strings.TrimSuffix(token, token[len(token)-4:]))
+	_, err = a.Authenticate(r)
+	assert.Error(t, err)
+}
+
+func TestNewOIDCAuthenticatorIssuerMismatch(t *testing.T) {
+	provider := startTestProvider(t)
+	_, err := NewOIDCAuthenticator(context.Background(), OIDCSettings{
+		IssuerURL: provider.server.URL + "/other",
+		Audience:  testAudience,
+	})
+	assert.Error(t, err)
+
+	_, err = NewOIDCAuthenticator(context.Background(), OIDCSettings{IssuerURL: provider.server.URL})
+	assert.Error(t, err)
+}
+
+func mustECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
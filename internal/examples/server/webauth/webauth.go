@@ -0,0 +1,157 @@
+// Package webauth protects the admin endpoints of the example Server (the UI, the REST
+// API and the gRPC admin API) with pluggable authentication and role-based
+// authorization. It is separate from the authentication of the Agents connecting via
+// OpAMP.
+package webauth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// ErrNoCredentials is returned by Authenticator.Authenticate if the request does not
+// carry any credentials.
+var ErrNoCredentials = errors.New("no credentials")
+
+var (
+	// ErrUnauthenticated is returned by Guard.Check if the request carries no valid
+	// credentials.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden is returned by Guard.Check if the principal is not authorized to
+	// perform the operation.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Principal is the authenticated caller of the admin endpoints.
+type Principal struct {
+	// Subject identifies the caller, e.g. the "sub" claim of an OIDC token.
+	Subject string
+	// Roles granted to the caller.
+	Roles []string
+}
+
+// HasAnyRole returns true if the principal has at least one of the roles.
+func (p *Principal) HasAnyRole(roles []string) bool {
+	for _, role := range roles {
+		for _, granted := range p.Roles {
+			if role == granted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates the callers of the admin endpoints.
+type Authenticator interface {
+	// Authenticate returns the principal that sent the request. Returns an error if
+	// the request carries no valid credentials.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Operation is the kind of access an admin endpoint requires.
+type Operation int
+
+const (
+	// OperationRead is viewing the fleet: listing Agents, querying their status.
+	OperationRead Operation = iota
+	// OperationWrite is changing the fleet: setting configs, offering packages or
+	// certificates.
+	OperationWrite
+)
+
+func (o Operation) String() string {
+	switch o {
+	case OperationRead:
+		return "read"
+	case OperationWrite:
+		return "write"
+	}
+	return "unknown"
+}
+
+// Authorizer decides whether the principal may perform the operation requested by r.
+type Authorizer interface {
+	Authorize(principal *Principal, op Operation, r *http.Request) bool
+}
+
+// AuthorizerFunc is an Authorizer implemented by a function.
+type AuthorizerFunc func(principal *Principal, op Operation, r *http.Request) bool
+
+// Authorize implements Authorizer.
+func (f AuthorizerFunc) Authorize(principal *Principal, op Operation, r *http.Request) bool {
+	return f(principal, op, r)
+}
+
+// RoleAuthorizer authorizes the operations based on the roles of the principal.
+type RoleAuthorizer struct {
+	// Roles allowed to read. The principals allowed to write may also read. If empty
+	// all authenticated principals may read.
+	ReadRoles []string
+	// Roles allowed to write. If empty all authenticated principals may write.
+	WriteRoles []string
+}
+
+// Authorize implements Authorizer.
+func (a RoleAuthorizer) Authorize(principal *Principal, op Operation, _ *http.Request) bool {
+	canWrite := len(a.WriteRoles) == 0 || principal.HasAnyRole(a.WriteRoles)
+	if op == OperationWrite {
+		return canWrite
+	}
+	return canWrite || len(a.ReadRoles) == 0 || principal.HasAnyRole(a.ReadRoles)
+}
+
+// Guard protects the handlers of the admin endpoints.
+type Guard struct {
+	authenticator Authenticator
+	authorizer    Authorizer
+	logger        *log.Logger
+}
+
+// NewGuard creates a Guard that authenticates the requests using the authenticator
+// and authorizes them using the authorizer.
+func NewGuard(authenticator Authenticator, authorizer Authorizer, logger *log.Logger) *Guard {
+	return &Guard{authenticator: authenticator, authorizer: authorizer, logger: logger}
+}
+
+// Protect returns a handler that calls h only for the authenticated requests whose
+// principal is authorized to perform op. Responds with 401 Unauthorized to the
+// requests without valid credentials and with 403 Forbidden to the requests that are
+// not authorized. A nil Guard does not protect h.
+func (g *Guard) Protect(op Operation, h http.HandlerFunc) http.HandlerFunc {
+	if g == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch g.Check(op, r) {
+		case nil:
+			h(w, r)
+		case ErrUnauthenticated:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="opamp-admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}
+}
+
+// Check authenticates r and checks that its principal is authorized to perform op.
+// Returns ErrUnauthenticated if r carries no valid credentials and ErrForbidden if
+// the principal is not authorized. Used directly by the endpoints that are not
+// served by http handlers, e.g. the gRPC admin API, with a request carrying the
+// credentials of the call.
+func (g *Guard) Check(op Operation, r *http.Request) error {
+	principal, err := g.authenticator.Authenticate(r)
+	if err != nil {
+		if !errors.Is(err, ErrNoCredentials) {
+			g.logger.Printf("Rejected %s %s: %v", r.Method, r.URL.Path, err)
+		}
+		return ErrUnauthenticated
+	}
+	if !g.authorizer.Authorize(principal, op, r) {
+		g.logger.Printf("Denied %s access to %s %s for %q", op, r.Method, r.URL.Path, principal.Subject)
+		return ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package webauth
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tokenAuthenticator maps the Authorization headers to the principals.
+type tokenAuthenticator map[string]*Principal
+
+func (a tokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	value := r.Header.Get("Authorization")
+	if value == "" {
+		return nil, ErrNoCredentials
+	}
+	principal, ok := a[value]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return principal, nil
+}
+
+func TestRoleAuthorizer(t *testing.T) {
+	reader := &Principal{Subject: "reader", Roles: []string{"viewer"}}
+	writer := &Principal{Subject: "writer", Roles: []string{"admin"}}
+	nobody := &Principal{Subject: "nobody"}
+
+	tests := []struct {
+		name       string
+		authorizer RoleAuthorizer
+		principal  *Principal
+		op         Operation
+		want       bool
+	}{
+		{"reader reads", RoleAuthorizer{ReadRoles: []string{"viewer"}, WriteRoles: []string{"admin"}}, reader, OperationRead, true},
+		{"reader writes", RoleAuthorizer{ReadRoles: []string{"viewer"}, WriteRoles: []string{"admin"}}, reader, OperationWrite, false},
+		{"writer reads", RoleAuthorizer{ReadRoles: []string{"viewer"}, WriteRoles: []string{"admin"}}, writer, OperationRead, true},
+		{"writer writes", RoleAuthorizer{ReadRoles: []string{"viewer"}, WriteRoles: []string{"admin"}}, writer, OperationWrite, true},
+		{"no role reads", RoleAuthorizer{ReadRoles: []string{"viewer"}, WriteRoles: []string{"admin"}}, nobody, OperationRead, false},
+		{"no role writes", RoleAuthorizer{ReadRoles: []string{"viewer"}, WriteRoles: []string{"admin"}}, nobody, OperationWrite, false},
+		{"anyone reads", RoleAuthorizer{WriteRoles: []string{"admin"}}, nobody, OperationRead, true},
+		{"anyone writes", RoleAuthorizer{ReadRoles: []string{"viewer"}}, nobody, OperationWrite, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, test.authorizer.Authorize(test.principal, test.op, nil))
+		})
+	}
+}
+
+func TestGuardProtect(t *testing.T) {
+	authenticator := tokenAuthenticator{
+		"Bearer reader": {Subject: "reader", Roles: []string{"viewer"}},
+		"Bearer writer": {Subject: "writer", Roles: []string{"admin"}},
+	}
+	authorizer := RoleAuthorizer{ReadRoles: []string{"viewer"}, WriteRoles: []string{"admin"}}
+	guard := NewGuard(authenticator, authorizer, log.New(io.Discard, "", 0))
+
+	tests := []struct {
+		name          string
+		guard         *Guard
+		authorization string
+		op            Operation
+		wantStatus    int
+	}{
+		{"no credentials", guard, "", OperationRead, http.StatusUnauthorized},
+		{"invalid credentials", guard, "Bearer forged", OperationRead, http.StatusUnauthorized},
+		{"reader reads", guard, "Bearer reader", OperationRead, http.StatusOK},
+		{"reader writes", guard, "Bearer reader", OperationWrite, http.StatusForbidden},
+		{"writer reads", guard, "Bearer writer", OperationRead, http.StatusOK},
+		{"writer writes", guard, "Bearer writer", OperationWrite, http.StatusOK},
+		{"nil guard", nil, "", OperationWrite, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := false
+			h := test.guard.Protect(test.op, func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			r := httptest.NewRequest(http.MethodPost, "/api/agents", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			assert.Equal(t, test.wantStatus, w.Code)
+			assert.Equal(t, test.wantStatus == http.StatusOK, called)
+			if test.wantStatus == http.StatusUnauthorized {
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Package approval implements the manual approval of the remote configs offered by
+// the Server. A remote config is staged until a local hook approves or rejects it.
+package approval
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client/atomicfile"
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/config"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// How often the file and HTTP hooks are polled for a decision.
+const pollInterval = time.Second
+
+// Decision is the result of an approval.
+type Decision struct {
+	Approved bool `json:"approved"`
+	// Optional explanation, typically of the rejection.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Approver decides whether a remote config can be applied.
+type Approver interface {
+	// Approve blocks until the remote config is approved or rejected or until
+	// the ctx is done, e.g. because a newer remote config superseded it.
+	Approve(ctx context.Context, remoteConfig *protobufs.AgentRemoteConfig) (Decision, error)
+}
+
+// New creates the Approver for the mode of the cfg. Returns nil if approval is
+// not enabled.
+func New(cfg *config.Approval) (Approver, error) {
+	if cfg == nil || cfg.Mode == "" {
+		return nil, nil
+	}
+	switch cfg.Mode {
+	case "file":
+		if cfg.Directory == "" {
+			return nil, fmt.Errorf("approval directory must be set in file mode")
+		}
+		if err := os.MkdirAll(cfg.Directory, 0700); err != nil {
+			return nil, err
+		}
+		return &FileApprover{dir: cfg.Directory}, nil
+	case "http":
+		if cfg.Endpoint == "" {
+			return nil, fmt.Errorf("approval endpoint must be set in http mode")
+		}
+		return &HTTPApprover{endpoint: cfg.Endpoint, httpClient: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "prompt":
+		return NewPromptApprover(os.Stdin, os.Stdout), nil
+	}
+	return nil, fmt.Errorf("unknown approval mode %q", cfg.Mode)
+}
+
+// FileApprover stages the remote config in <hash>.yaml in a directory and waits
+// until the <hash>.approved or <hash>.rejected file is created next to it. The
+// content of the rejected file is used as the reason of the rejection.
+type FileApprover struct {
+	dir string
+}
+
+func (a *FileApprover) Approve(ctx context.Context, remoteConfig *protobufs.AgentRemoteConfig) (Decision, error) {
+	base := filepath.Join(a.dir, hex.EncodeToString(remoteConfig.ConfigHash))
+	if err := atomicfile.WriteFile(base+".yaml", renderConfig(remoteConfig), 0600); err != nil {
+		return Decision{}, fmt.Errorf("cannot stage config: %w", err)
+	}
+	defer os.Remove(base + ".yaml")
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(base + ".approved"); err == nil {
+			_ = os.Remove(base + ".approved")
+			return Decision{Approved: true}, nil
+		}
+		if reason, err := os.ReadFile(base + ".rejected"); err == nil {
+			_ = os.Remove(base + ".rejected")
+			return Decision{Reason: strings.TrimSpace(string(reason))}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return Decision{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// HTTPApprover POSTs the remote config as JSON to an endpoint. The endpoint responds
+// with 200 and a JSON Decision, or with 202 if the decision is not made yet, in which
+// case the request is repeated later.
+type HTTPApprover struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+// approvalRequest is the body of the requests sent by HTTPApprover.
+type approvalRequest struct {
+	Hash   string            `json:"hash"`
+	Config map[string]string `json:"config"`
+}
+
+func (a *HTTPApprover) Approve(ctx context.Context, remoteConfig *protobufs.AgentRemoteConfig) (Decision, error) {
+	request := approvalRequest{Hash: hex.EncodeToString(remoteConfig.ConfigHash), Config: map[string]string{}}
+	for name, file := range remoteConfig.GetConfig().GetConfigMap() {
+		request.Config[name] = string(file.Body)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		decision, decided, err := a.ask(ctx, body)
+		if err != nil || decided {
+			return decision, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return Decision{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *HTTPApprover) ask(ctx context.Context, body []byte) (decision Decision, decided bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return Decision{}, false, fmt.Errorf("approval request to %s failed: %w", a.endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+			return Decision{}, false, fmt.Errorf("invalid approval response from %s: %w", a.endpoint, err)
+		}
+		return decision, true, nil
+	case http.StatusAccepted:
+		return Decision{}, false, nil
+	}
+	return Decision{}, false, fmt.Errorf("approval request to %s returned %d", a.endpoint, resp.StatusCode)
+}
+
+// PromptApprover prints the remote config and asks the user to approve it on the
+// terminal.
+type PromptApprover struct {
+	out   io.Writer
+	lines chan string
+}
+
+// NewPromptApprover creates a PromptApprover that reads the answers from in and
+// prints the prompts to out.
+func NewPromptApprover(in io.Reader, out io.Writer) *PromptApprover {
+	a := &PromptApprover{out: out, lines: make(chan string)}
+	// Reading cannot be interrupted, so a single reader is shared by all prompts.
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			a.lines <- strings.TrimSpace(scanner.Text())
+		}
+		close(a.lines)
+	}()
+	return a
+}
+
+func (a *PromptApprover) Approve(ctx context.Context, remoteConfig *protobufs.AgentRemoteConfig) (Decision, error) {
+	fmt.Fprintf(a.out, "Received remote config, hash=%x:\n%s\nApply this config? [y/n]: ",
+		remoteConfig.ConfigHash, renderConfig(remoteConfig))
+	for {
+		select {
+		case <-ctx.Done():
+			return Decision{}, ctx.Err()
+		case line, ok := <-a.lines:
+			if !ok {
+				return Decision{}, io.EOF
+			}
+			switch strings.ToLower(line) {
+			case "y", "yes":
+				return Decision{Approved: true}, nil
+			case "n", "no":
+				return Decision{Reason: "rejected by the operator"}, nil
+			}
+			fmt.Fprint(a.out, "Please answer y or n: ")
+		}
+	}
+}
+
+// renderConfig renders the config files of the remote config as a YAML stream for
+// human review.
+func renderConfig(remoteConfig *protobufs.AgentRemoteConfig) []byte {
+	configMap := remoteConfig.GetConfig().GetConfigMap()
+	names := make([]string, 0, len(configMap))
+	for name := range configMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "---\n# Config file %q\n", name)
+		buf.Write(configMap[name].Body)
+		if !bytes.HasSuffix(configMap[name].Body, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
@@ -120,11 +120,13 @@ func (c *Commander) Stop(ctx context.Context) error {
 		// Not started, nothing to do.
 		return nil
 	}
+	// The goroutine below may outlive Stop while c.cmd is replaced by the next Start.
+	process := c.cmd.Process
 
-	c.logger.Debugf("Stopping agent process, PID=%v", c.cmd.Process.Pid)
+	c.logger.Debugf("Stopping agent process, PID=%v", process.Pid)
 
 	// Gracefully signal process to stop.
-	if err := c.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+	if err := process.Signal(syscall.SIGTERM); err != nil {
 		return err
 	}
 
@@ -143,15 +145,15 @@ func (c *Commander) Stop(ctx context.Context) error {
 			break
 		case <-finished:
 			// Process is successfully finished.
-			c.logger.Debugf("Agent process PID=%v successfully stopped.", c.cmd.Process.Pid)
+			c.logger.Debugf("Agent process PID=%v successfully stopped.", process.Pid)
 			return
 		}
 
 		// Time is out. Kill the process.
 		c.logger.Debugf(
 			"Agent process PID=%d is not responding to SIGTERM. Sending SIGKILL to kill forcedly.",
-			c.cmd.Process.Pid)
-		if innerErr = c.cmd.Process.Signal(syscall.SIGKILL); innerErr != nil {
+			process.Pid)
+		if innerErr = process.Signal(syscall.SIGKILL); innerErr != nil {
 			return
 		}
 	}()
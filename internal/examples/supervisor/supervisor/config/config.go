@@ -1,9 +1,25 @@
 package config
 
+import "time"
+
 // Supervisor is the Supervisor config file format.
 type Supervisor struct {
-	Server *OpAMPServer
-	Agent  *Agent
+	Server     *OpAMPServer
+	Agent      *Agent
+	Packages   *Packages
+	Approval   *Approval
+	HealthGate *HealthGate
+	Status     *Status
+
+	// Package installations and remote config changes received outside of these
+	// windows are deferred until a window opens. The changes are applied
+	// immediately if no windows are defined.
+	MaintenanceWindows []MaintenanceWindow
+
+	// Names of the detectors of the host attributes that are reported as the
+	// Agent's non-identifying attributes, in the order of precedence. Defaults
+	// to all built-in detectors, see detectors.DefaultNames.
+	Detectors []string
 }
 
 type OpAMPServer struct {
@@ -12,4 +28,69 @@ type OpAMPServer struct {
 
 type Agent struct {
 	Executable string
+
+	// The "<host>:<port>" the Agent's health_check extension listens on.
+	// Defaults to localhost:13133.
+	HealthCheckEndpoint string
+}
+
+type Packages struct {
+	// Directory where the packages offered by the Server are stored. Accepting
+	// packages is disabled if not set.
+	Directory string
+}
+
+type Approval struct {
+	// How the remote configs are approved: "file", "http" or "prompt". Remote
+	// configs are applied without approval if not set.
+	Mode string
+
+	// Directory where the pending configs are staged in "file" mode. A config is
+	// approved or rejected by creating the <hash>.approved or <hash>.rejected file
+	// next to the staged <hash>.yaml file.
+	Directory string
+
+	// URL that is asked to approve the pending configs in "http" mode.
+	Endpoint string
+}
+
+type HealthGate struct {
+	// For how long the Agent is watched after a remote config is applied before the
+	// config is reported as APPLIED. The gate is disabled if zero.
+	SoakPeriod time.Duration
+
+	// How often the Agent's health and metrics are checked during the soak period.
+	// Defaults to 5s.
+	CheckInterval time.Duration
+
+	// The Agent's internal metrics endpoint in Prometheus format.
+	// Defaults to http://localhost:8888/metrics.
+	MetricsEndpoint string
+
+	// Names of the counters of the Agent's internal metrics that count errors.
+	// Defaults to the Collector's refused, dropped and failed to send counters.
+	ErrorMetrics []string
+
+	// Maximum rate of errors per second counted by ErrorMetrics. Zero allows no errors.
+	MaxErrorRate float64
+
+	// Maximum number of failed health checks. Zero allows no failed checks.
+	MaxFailedHealthChecks int
+}
+
+type Status struct {
+	// Local endpoint that serves the state of the Supervisor, either "unix:<path>"
+	// or a loopback "<host>:<port>". The endpoint is disabled if not set.
+	Endpoint string
+}
+
+type MaintenanceWindow struct {
+	// Days of the week when the window opens, e.g. [sat, sun]. Every day if empty.
+	Days []string
+
+	// Time of the day in the local time zone when the window opens, e.g. "02:30".
+	Start string
+
+	// How long the window stays open.
+	Duration time.Duration
 }
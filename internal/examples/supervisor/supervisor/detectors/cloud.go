@@ -0,0 +1,140 @@
+package detectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Timeout of the requests to the metadata services. The services respond quickly
+// if they exist, so a short timeout keeps the detection fast outside of the cloud.
+const metadataTimeout = time.Second
+
+const (
+	ec2MetadataURL   = "http://169.254.169.254/latest"
+	gcpMetadataURL   = "http://metadata.google.internal/computeMetadata/v1"
+	azureMetadataURL = "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01&format=json"
+)
+
+var metadataClient = &http.Client{Timeout: metadataTimeout}
+
+func getMetadata(ctx context.Context, method, url string, header map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s returned %d", method, url, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+}
+
+// detectEC2 reads the instance identity document using IMDSv2.
+func detectEC2(ctx context.Context) ([]*protobufs.KeyValue, error) {
+	token, err := getMetadata(ctx, http.MethodPut, ec2MetadataURL+"/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return nil, fmt.Errorf("not running on EC2: %w", err)
+	}
+	body, err := getMetadata(ctx, http.MethodGet, ec2MetadataURL+"/dynamic/instance-identity/document",
+		map[string]string{"X-aws-ec2-metadata-token": string(token)})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read EC2 instance identity: %w", err)
+	}
+
+	var doc struct {
+		AccountId        string `json:"accountId"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+		InstanceId       string `json:"instanceId"`
+		InstanceType     string `json:"instanceType"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("invalid EC2 instance identity: %w", err)
+	}
+	return []*protobufs.KeyValue{
+		keyVal("cloud.provider", "aws"),
+		keyVal("cloud.platform", "aws_ec2"),
+		keyVal("cloud.account.id", doc.AccountId),
+		keyVal("cloud.region", doc.Region),
+		keyVal("cloud.availability_zone", doc.AvailabilityZone),
+		keyVal("host.id", doc.InstanceId),
+		keyVal("host.type", doc.InstanceType),
+	}, nil
+}
+
+// detectGCP reads the metadata of the Compute Engine instance.
+func detectGCP(ctx context.Context) ([]*protobufs.KeyValue, error) {
+	header := map[string]string{"Metadata-Flavor": "Google"}
+	get := func(path string) (string, error) {
+		body, err := getMetadata(ctx, http.MethodGet, gcpMetadataURL+path, header)
+		return string(body), err
+	}
+
+	projectId, err := get("/project/project-id")
+	if err != nil {
+		return nil, fmt.Errorf("not running on GCP: %w", err)
+	}
+	instanceId, err := get("/instance/id")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read GCP instance id: %w", err)
+	}
+	// The zone is in the projects/<number>/zones/<zone> format.
+	zone, err := get("/instance/zone")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read GCP instance zone: %w", err)
+	}
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	attrs := []*protobufs.KeyValue{
+		keyVal("cloud.provider", "gcp"),
+		keyVal("cloud.platform", "gcp_compute_engine"),
+		keyVal("cloud.account.id", projectId),
+		keyVal("cloud.availability_zone", zone),
+		keyVal("host.id", instanceId),
+	}
+	// The region is the zone without its last dash-separated part.
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		attrs = append(attrs, keyVal("cloud.region", zone[:i]))
+	}
+	return attrs, nil
+}
+
+// detectAzure reads the compute metadata of the Azure VM.
+func detectAzure(ctx context.Context) ([]*protobufs.KeyValue, error) {
+	body, err := getMetadata(ctx, http.MethodGet, azureMetadataURL, map[string]string{"Metadata": "true"})
+	if err != nil {
+		return nil, fmt.Errorf("not running on Azure: %w", err)
+	}
+
+	var compute struct {
+		Location       string `json:"location"`
+		SubscriptionId string `json:"subscriptionId"`
+		VmId           string `json:"vmId"`
+		VmSize         string `json:"vmSize"`
+	}
+	if err := json.Unmarshal(body, &compute); err != nil {
+		return nil, fmt.Errorf("invalid Azure compute metadata: %w", err)
+	}
+	return []*protobufs.KeyValue{
+		keyVal("cloud.provider", "azure"),
+		keyVal("cloud.platform", "azure_vm"),
+		keyVal("cloud.account.id", compute.SubscriptionId),
+		keyVal("cloud.region", compute.Location),
+		keyVal("host.id", compute.VmId),
+		keyVal("host.type", compute.VmSize),
+	}, nil
+}
@@ -0,0 +1,136 @@
+// Package detectors detects the attributes of the host the Agent runs on, which
+// the Supervisor reports as the non-identifying attributes of the Agent.
+package detectors
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Detector detects attributes of the environment the Agent runs in. The attribute
+// keys follow the OpenTelemetry resource semantic conventions.
+type Detector interface {
+	Detect(ctx context.Context) ([]*protobufs.KeyValue, error)
+}
+
+// DetectorFunc is a function that implements the Detector interface.
+type DetectorFunc func(ctx context.Context) ([]*protobufs.KeyValue, error)
+
+func (f DetectorFunc) Detect(ctx context.Context) ([]*protobufs.KeyValue, error) {
+	return f(ctx)
+}
+
+// DefaultNames are the names of the detectors used if none are configured.
+var DefaultNames = []string{"host", "os", "ec2", "gcp", "azure"}
+
+var registry = map[string]Detector{
+	"host":  DetectorFunc(detectHost),
+	"os":    DetectorFunc(detectOS),
+	"ec2":   DetectorFunc(detectEC2),
+	"gcp":   DetectorFunc(detectGCP),
+	"azure": DetectorFunc(detectAzure),
+}
+
+// Register makes the detector available under the name, e.g. to add detectors
+// of environments that are not supported out of the box.
+func Register(name string, detector Detector) {
+	registry[name] = detector
+}
+
+// Chain returns the detectors with the names in the order of the names.
+func Chain(names []string) ([]Detector, error) {
+	chain := make([]Detector, 0, len(names))
+	for _, name := range names {
+		detector, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown detector %q", name)
+		}
+		chain = append(chain, detector)
+	}
+	return chain, nil
+}
+
+// Detect runs the chain of detectors concurrently and merges the detected
+// attributes. The detectors earlier in the chain take precedence if several
+// detectors detect the same attribute. The detectors that fail, typically because
+// they do not apply to the environment, are reported via onError.
+func Detect(ctx context.Context, chain []Detector, onError func(err error)) []*protobufs.KeyValue {
+	results := make([][]*protobufs.KeyValue, len(chain))
+	errs := make([]error, len(chain))
+
+	var wg sync.WaitGroup
+	for i, detector := range chain {
+		wg.Add(1)
+		go func(i int, detector Detector) {
+			defer wg.Done()
+			results[i], errs[i] = detector.Detect(ctx)
+		}(i, detector)
+	}
+	wg.Wait()
+
+	var attrs []*protobufs.KeyValue
+	seen := map[string]bool{}
+	for i := range chain {
+		if errs[i] != nil {
+			onError(errs[i])
+			continue
+		}
+		for _, attr := range results[i] {
+			if !seen[attr.Key] {
+				seen[attr.Key] = true
+				attrs = append(attrs, attr)
+			}
+		}
+	}
+	return attrs
+}
+
+func keyVal(key, val string) *protobufs.KeyValue {
+	return &protobufs.KeyValue{
+		Key: key,
+		Value: &protobufs.AnyValue{
+			Value: &protobufs.AnyValue_StringValue{StringValue: val},
+		},
+	}
+}
+
+// Values of host.arch for the GOARCH values that differ.
+var hostArchs = map[string]string{
+	"386": "x86",
+	"arm": "arm32",
+}
+
+func detectHost(context.Context) ([]*protobufs.KeyValue, error) {
+	arch := runtime.GOARCH
+	if a, ok := hostArchs[arch]; ok {
+		arch = a
+	}
+	attrs := []*protobufs.KeyValue{keyVal("host.arch", arch)}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("cannot detect host name: %w", err)
+	}
+	return append(attrs, keyVal("host.name", hostname)), nil
+}
+
+func detectOS(context.Context) ([]*protobufs.KeyValue, error) {
+	attrs := []*protobufs.KeyValue{keyVal("os.type", runtime.GOOS)}
+
+	version, description, err := osVersion()
+	if err != nil {
+		return nil, fmt.Errorf("cannot detect OS version: %w", err)
+	}
+	if version != "" {
+		attrs = append(attrs, keyVal("os.version", version))
+	}
+	if description != "" {
+		attrs = append(attrs, keyVal("os.description", description))
+	}
+	return attrs, nil
+}
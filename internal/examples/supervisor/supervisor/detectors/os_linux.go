@@ -0,0 +1,40 @@
+package detectors
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// osVersion reads the OS version from the os-release file.
+func osVersion() (version, description string, err error) {
+	f, err := os.Open("/etc/os-release")
+	if os.IsNotExist(err) {
+		f, err = os.Open("/usr/lib/os-release")
+	}
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		value := line[i+1:]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		switch line[:i] {
+		case "VERSION_ID":
+			version = value
+		case "PRETTY_NAME":
+			description = value
+		}
+	}
+	return version, description, scanner.Err()
+}
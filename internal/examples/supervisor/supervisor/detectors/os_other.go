@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package detectors
+
+// osVersion is not supported on this OS, only the os.type is reported.
+func osVersion() (version, description string, err error) {
+	return "", "", nil
+}
@@ -0,0 +1,257 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/open-telemetry/opamp-go/internal/testhelpers"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+// The tests run the Supervisor against a scripted mock OpAMP Server. The Agent
+// supervised in the tests is the test binary itself: when started with
+// fakeAgentEnv set it imitates the Collector instead of running the tests.
+const (
+	fakeAgentEnv = "SUPERVISOR_TEST_FAKE_AGENT"
+	// The file in the Supervisor's working directory where the fake Agent records
+	// every start.
+	agentStartsFile = "agent-starts.log"
+	waitTimeout     = 15 * time.Second
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeAgentEnv) != "" {
+		runFakeAgent()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runFakeAgent serves the health_check extension on the endpoint found in the
+// config passed with --config until the process is terminated.
+func runFakeAgent() {
+	configPath := os.Args[len(os.Args)-1]
+	k := koanf.New("::")
+	if err := k.Load(file.Provider(configPath), yaml.Parser()); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	f, err := os.OpenFile(agentStartsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		os.Exit(1)
+	}
+	_, _ = fmt.Fprintln(f, os.Getpid())
+	_ = f.Close()
+
+	endpoint := k.String("extensions::health_check::endpoint")
+	err = http.ListenAndServe(endpoint, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	fmt.Fprintf(os.Stderr, "cannot serve health check: %v\n", err)
+	os.Exit(1)
+}
+
+// mockServer is an OpAMP Server that accumulates the state reported by the Agent
+// and lets the test push messages to the Agent.
+type mockServer struct {
+	t        *testing.T
+	endpoint string
+	srv      server.OpAMPServer
+
+	mux  sync.Mutex
+	conn types.Connection
+	// The last reported value of every field of AgentToServer. nil if the Agent
+	// did not report since the Server was started.
+	state *protobufs.AgentToServer
+}
+
+func startMockServer(t *testing.T) *mockServer {
+	m := &mockServer{t: t, endpoint: testhelpers.GetAvailableLocalAddress()}
+	m.start()
+	return m
+}
+
+func (m *mockServer) start() {
+	m.srv = server.New(&Logger{Logger: testLogger(m.t, "server")})
+	err := m.srv.Start(server.StartSettings{
+		ListenEndpoint: m.endpoint,
+		Settings: server.Settings{Callbacks: server.CallbacksStruct{
+			OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+				return types.ConnectionResponse{Accept: true, ConnectionCallbacks: server.ConnectionCallbacksStruct{
+					OnMessageFunc: m.onMessage,
+				}}
+			},
+		}},
+	})
+	require.NoError(m.t, err)
+	testhelpers.WaitForEndpoint(m.endpoint)
+}
+
+// stop stops the Server and forgets everything the Agent reported, like a Server
+// that is restarted.
+func (m *mockServer) stop() {
+	require.NoError(m.t, m.srv.Stop(context.Background()))
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.conn != nil {
+		// Stopping the Server does not close the WebSocket connections, drop them
+		// like a crashed Server would.
+		_ = m.conn.Disconnect()
+	}
+	m.conn = nil
+	m.state = nil
+}
+
+func (m *mockServer) url() string {
+	return "ws://" + m.endpoint + "/v1/opamp"
+}
+
+func (m *mockServer) onMessage(conn types.Connection, msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.conn = conn
+
+	if m.state == nil {
+		m.state = &protobufs.AgentToServer{}
+	}
+
+	// The Agent only reports the fields that changed, remember the last values.
+	state := m.state.ProtoReflect()
+	msg.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		state.Set(fd, v)
+		return true
+	})
+	return &protobufs.ServerToAgent{InstanceUid: msg.InstanceUid}
+}
+
+// push sends the msg to the Agent once it is connected.
+func (m *mockServer) push(msg *protobufs.ServerToAgent) {
+	var conn types.Connection
+	eventually(m.t, "agent connects", func() bool {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		conn = m.conn
+		return conn != nil
+	})
+	require.NoError(m.t, conn.Send(context.Background(), msg))
+}
+
+// eventually waits until the state reported by the Agent satisfies cond.
+func (m *mockServer) eventually(what string, cond func(state *protobufs.AgentToServer) bool) {
+	eventually(m.t, what, func() bool {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		return m.state != nil && cond(m.state)
+	})
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// harness runs a Supervisor in a temporary working directory against a mock
+// OpAMP Server.
+type harness struct {
+	t          *testing.T
+	dir        string
+	server     *mockServer
+	supervisor *Supervisor
+}
+
+// startHarness starts the mock Server and a Supervisor configured to connect to it.
+// The extraConfig is appended to the Supervisor's config file.
+func startHarness(t *testing.T, extraConfig string) *harness {
+	h := &harness{t: t, dir: t.TempDir(), server: startMockServer(t)}
+	t.Cleanup(func() { h.server.stop() })
+
+	executable, err := os.Executable()
+	require.NoError(t, err)
+	healthEndpoint := testhelpers.GetAvailableLocalAddress()
+
+	cfg := fmt.Sprintf(`
+server:
+  endpoint: %s
+agent:
+  executable: %s
+  healthcheckendpoint: %s
+detectors: [host]
+%s`, h.server.url(), executable, healthEndpoint, extraConfig)
+	require.NoError(t, os.WriteFile(filepath.Join(h.dir, "supervisor.yaml"), []byte(cfg), 0600))
+
+	// Start the Agent right away with an initial config.
+	initialConfig := fmt.Sprintf("extensions:\n  health_check:\n    endpoint: %s\n", healthEndpoint)
+	require.NoError(t, os.WriteFile(filepath.Join(h.dir, "effective.yaml"), []byte(initialConfig), 0600))
+
+	// The Supervisor works in the current directory.
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(h.dir))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	require.NoError(t, os.Setenv(fakeAgentEnv, "1"))
+	t.Cleanup(func() { _ = os.Unsetenv(fakeAgentEnv) })
+
+	h.supervisor, err = NewSupervisor(&Logger{Logger: testLogger(t, "supervisor")})
+	require.NoError(t, err)
+	t.Cleanup(h.supervisor.Shutdown)
+	return h
+}
+
+// agentStarts returns how many times the Agent was started.
+func (h *harness) agentStarts() int {
+	b, err := os.ReadFile(filepath.Join(h.dir, agentStartsFile))
+	if err != nil {
+		return 0
+	}
+	return bytes.Count(b, []byte("\n"))
+}
+
+// waitHealthy waits until the Server is told that the Agent is healthy.
+func (h *harness) waitHealthy() {
+	h.server.eventually("agent is healthy", func(state *protobufs.AgentToServer) bool {
+		return state.GetHealth().GetHealthy()
+	})
+}
+
+func (h *harness) effectiveConfig() string {
+	b, err := os.ReadFile(filepath.Join(h.dir, "effective.yaml"))
+	require.NoError(h.t, err)
+	return string(b)
+}
+
+// reportedEffectiveConfig returns the effective config reported to the Server.
+func reportedEffectiveConfig(state *protobufs.AgentToServer) string {
+	return string(state.GetEffectiveConfig().GetConfigMap().GetConfigMap()[""].GetBody())
+}
+
+// testLogger logs to stderr when the tests run in verbose mode.
+func testLogger(t *testing.T, name string) *log.Logger {
+	if !testing.Verbose() {
+		return log.New(io.Discard, "", 0)
+	}
+	return log.New(os.Stderr, t.Name()+" "+name+": ", log.Lmicroseconds)
+}
@@ -0,0 +1,200 @@
+// Package healthgate watches the Agent for a soak period after a new config is
+// applied to decide whether the config is good or must be rolled back.
+package healthgate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/config"
+)
+
+const (
+	defaultCheckInterval   = 5 * time.Second
+	defaultMetricsEndpoint = "http://localhost:8888/metrics"
+)
+
+// The Collector's internal counters of the telemetry that was lost.
+var defaultErrorMetrics = []string{
+	"otelcol_receiver_refused_spans",
+	"otelcol_receiver_refused_metric_points",
+	"otelcol_receiver_refused_log_records",
+	"otelcol_processor_dropped_spans",
+	"otelcol_processor_dropped_metric_points",
+	"otelcol_processor_dropped_log_records",
+	"otelcol_exporter_send_failed_spans",
+	"otelcol_exporter_send_failed_metric_points",
+	"otelcol_exporter_send_failed_log_records",
+}
+
+// HealthChecker checks the health of the Agent, see healthchecker.HttpHealthChecker.
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// Gate decides whether the Agent stays healthy with a new config.
+type Gate struct {
+	soakPeriod            time.Duration
+	checkInterval         time.Duration
+	metricsEndpoint       string
+	errorMetrics          map[string]bool
+	maxErrorRate          float64
+	maxFailedHealthChecks int
+	httpClient            *http.Client
+}
+
+// New creates the Gate configured by cfg. Returns nil if the gate is not enabled.
+func New(cfg *config.HealthGate) *Gate {
+	if cfg == nil || cfg.SoakPeriod <= 0 {
+		return nil
+	}
+	g := &Gate{
+		soakPeriod:            cfg.SoakPeriod,
+		checkInterval:         cfg.CheckInterval,
+		metricsEndpoint:       cfg.MetricsEndpoint,
+		errorMetrics:          map[string]bool{},
+		maxErrorRate:          cfg.MaxErrorRate,
+		maxFailedHealthChecks: cfg.MaxFailedHealthChecks,
+		httpClient:            &http.Client{Timeout: 10 * time.Second},
+	}
+	if g.checkInterval <= 0 {
+		g.checkInterval = defaultCheckInterval
+	}
+	if g.metricsEndpoint == "" {
+		g.metricsEndpoint = defaultMetricsEndpoint
+	}
+	errorMetrics := cfg.ErrorMetrics
+	if len(errorMetrics) == 0 {
+		errorMetrics = defaultErrorMetrics
+	}
+	for _, name := range errorMetrics {
+		g.errorMetrics[name] = true
+	}
+	return g
+}
+
+// Soak watches the Agent for the soak period. Returns nil if the Agent stayed
+// healthy and its error rate stayed below the threshold, otherwise returns an
+// error describing why the config is considered bad. Returns ctx.Err() if the
+// ctx is done before the soak period is over.
+func (g *Gate) Soak(ctx context.Context, checker HealthChecker) error {
+	ticker := time.NewTicker(g.checkInterval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(g.soakPeriod)
+	defer deadline.Stop()
+
+	failedChecks := 0
+	var lastHealthErr error
+
+	// The first and the last successful read of the error counters.
+	var firstErrors, lastErrors float64
+	var firstRead, lastRead time.Time
+	var lastMetricsErr error
+
+	check := func() {
+		checkCtx, cancel := context.WithTimeout(ctx, g.checkInterval)
+		defer cancel()
+
+		if err := checker.Check(checkCtx); err != nil {
+			failedChecks++
+			lastHealthErr = err
+		}
+
+		errors, err := g.readErrors(checkCtx)
+		if err != nil {
+			lastMetricsErr = err
+			return
+		}
+		if errors < lastErrors {
+			// The counters are reset, the Agent was restarted.
+			firstRead = time.Time{}
+		}
+		if firstRead.IsZero() {
+			firstErrors, firstRead = errors, time.Now()
+		}
+		lastErrors, lastRead = errors, time.Now()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-ticker.C:
+			check()
+			if failedChecks > g.maxFailedHealthChecks {
+				return fmt.Errorf("agent failed %d health checks, last error: %v", failedChecks, lastHealthErr)
+			}
+
+		case <-deadline.C:
+			if lastRead.IsZero() {
+				return fmt.Errorf("cannot read agent metrics: %v", lastMetricsErr)
+			}
+			if elapsed := lastRead.Sub(firstRead).Seconds(); elapsed > 0 {
+				if rate := (lastErrors - firstErrors) / elapsed; rate > g.maxErrorRate {
+					return fmt.Errorf("agent error rate %.2f/s exceeds the limit of %.2f/s", rate, g.maxErrorRate)
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// readErrors returns the sum of the error counters of the Agent.
+func (g *Gate) readErrors(ctx context.Context) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.metricsEndpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("metrics endpoint %s returned %d", g.metricsEndpoint, resp.StatusCode)
+	}
+	return sumCounters(resp.Body, g.errorMetrics)
+}
+
+// sumCounters sums the samples of the named metrics in the Prometheus text format.
+func sumCounters(r io.Reader, names map[string]bool) (float64, error) {
+	var sum float64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		// The sample is: name{labels} value [timestamp]
+		nameEnd := strings.IndexAny(line, "{ ")
+		if nameEnd < 0 || !names[line[:nameEnd]] {
+			continue
+		}
+		rest := line[nameEnd:]
+		if rest[0] == '{' {
+			labelsEnd := strings.LastIndex(rest, "}")
+			if labelsEnd < 0 {
+				return 0, fmt.Errorf("invalid sample %q", line)
+			}
+			rest = rest[labelsEnd+1:]
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return 0, fmt.Errorf("invalid sample %q", line)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid sample %q: %v", line, err)
+		}
+		sum += value
+	}
+	return sum, scanner.Err()
+}
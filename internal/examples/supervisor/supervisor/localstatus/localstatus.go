@@ -0,0 +1,176 @@
+// Package localstatus serves the state of the Supervisor, the Agent and the OpAMP
+// connection on a local endpoint for on-host debugging and node-level health checks.
+package localstatus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status is the state served on the /status path.
+type Status struct {
+	Supervisor   SupervisorStatus   `json:"supervisor"`
+	Agent        AgentStatus        `json:"agent"`
+	OpAMP        OpAMPStatus        `json:"opamp"`
+	RemoteConfig RemoteConfigStatus `json:"remote_config"`
+	// The most recent events, oldest first.
+	Events []Event `json:"events"`
+}
+
+type SupervisorStatus struct {
+	InstanceUid string    `json:"instance_uid"`
+	StartedAt   time.Time `json:"started_at"`
+	// Hex-encoded hashes of the remote configs that are not in effect yet, empty
+	// if there are none.
+	PendingApprovalHash string `json:"pending_approval_hash,omitempty"`
+	SoakingHash         string `json:"soaking_hash,omitempty"`
+	DeferredHash        string `json:"deferred_hash,omitempty"`
+	DeferredPackages    bool   `json:"deferred_packages,omitempty"`
+}
+
+type AgentStatus struct {
+	Running   bool      `json:"running"`
+	StartedAt time.Time `json:"started_at"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type OpAMPStatus struct {
+	Endpoint  string `json:"endpoint"`
+	Connected bool   `json:"connected"`
+	// The time of the last successful connection or connection attempt.
+	LastChange time.Time `json:"last_change"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+type RemoteConfigStatus struct {
+	// Hex-encoded hash of the last remote config received from the Server.
+	LastHash     string `json:"last_hash,omitempty"`
+	Status       string `json:"status,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	// Hash of the effective config the Agent runs with.
+	EffectiveConfigHash string `json:"effective_config_hash,omitempty"`
+}
+
+// Event is something that happened to the Supervisor or the Agent.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Events keeps the most recent events. Safe for concurrent use.
+type Events struct {
+	mux    sync.Mutex
+	events []Event
+	max    int
+}
+
+// NewEvents creates Events that keeps at most max events.
+func NewEvents(max int) *Events {
+	return &Events{max: max}
+}
+
+// Add records an event with a message formatted according to the format specifier.
+func (e *Events) Add(format string, v ...interface{}) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.events = append(e.events, Event{Time: time.Now(), Message: fmt.Sprintf(format, v...)})
+	if len(e.events) > e.max {
+		e.events = e.events[len(e.events)-e.max:]
+	}
+}
+
+// List returns a copy of the recorded events, oldest first.
+func (e *Events) List() []Event {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return append([]Event{}, e.events...)
+}
+
+// Server serves the Status as JSON on the /status path and the health of the Agent
+// on the /healthz path. The /healthz path responds with 200 if the Agent is running
+// and healthy and with 503 otherwise.
+type Server struct {
+	listener net.Listener
+	srv      *http.Server
+}
+
+// Start starts serving the Status returned by the status func on the endpoint. The
+// endpoint is either "unix:<path>" for a unix socket or a loopback "<host>:<port>".
+// Other addresses are refused since the status is meant for the local host only.
+func Start(endpoint string, status func() Status) (*Server, error) {
+	listener, err := listen(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(status())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		agent := status().Agent
+		switch {
+		case !agent.Running:
+			http.Error(w, "agent is not running", http.StatusServiceUnavailable)
+		case !agent.Healthy:
+			http.Error(w, "agent is not healthy: "+agent.LastError, http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write([]byte("ok\n"))
+		}
+	})
+
+	s := &Server{listener: listener, srv: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}}
+	go func() { _ = s.srv.Serve(listener) }()
+	return s, nil
+}
+
+func listen(endpoint string) (net.Listener, error) {
+	if strings.HasPrefix(endpoint, "unix:") {
+		path := strings.TrimPrefix(strings.TrimPrefix(endpoint, "unix:"), "//")
+		// Remove the socket left by a previous run.
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status endpoint %q: %v", endpoint, err)
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("status endpoint %q is not a loopback address", endpoint)
+		}
+	}
+	return net.Listen("tcp", endpoint)
+}
+
+// Addr returns the address the Server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Shutdown stops the Server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
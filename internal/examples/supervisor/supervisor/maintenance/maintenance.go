@@ -0,0 +1,116 @@
+// Package maintenance implements the maintenance windows in which the Supervisor
+// applies the disruptive changes received from the Server.
+package maintenance
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/config"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Longest supported window. Allows to find the open windows by looking one week back.
+const maxWindowDuration = 7 * 24 * time.Hour
+
+type window struct {
+	// Days of the week when the window opens. Every day if empty.
+	days map[time.Weekday]bool
+	// Time of the day when the window opens.
+	hour, minute int
+	duration     time.Duration
+}
+
+// Schedule is a set of recurring maintenance windows.
+type Schedule struct {
+	windows  []window
+	location *time.Location
+}
+
+// NewSchedule creates the Schedule of the windows in the local time zone. Returns
+// nil if there are no windows.
+func NewSchedule(windows []config.MaintenanceWindow) (*Schedule, error) {
+	if len(windows) == 0 {
+		return nil, nil
+	}
+
+	s := &Schedule{location: time.Local}
+	for i, cfg := range windows {
+		var w window
+		start, err := time.Parse("15:04", cfg.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start %q of maintenance window %d: %v", cfg.Start, i, err)
+		}
+		w.hour, w.minute = start.Hour(), start.Minute()
+
+		if cfg.Duration <= 0 || cfg.Duration > maxWindowDuration {
+			return nil, fmt.Errorf("duration of maintenance window %d must be between 0 and %v", i, maxWindowDuration)
+		}
+		w.duration = cfg.Duration
+
+		if len(cfg.Days) > 0 {
+			w.days = map[time.Weekday]bool{}
+		}
+		for _, day := range cfg.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q of maintenance window %d", day, i)
+			}
+			w.days[weekday] = true
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+// IsOpen returns true if a window is open at the time t.
+func (s *Schedule) IsOpen(t time.Time) bool {
+	t = t.In(s.location)
+	for _, w := range s.windows {
+		// Look for the window opened in the past week that is still open.
+		for day := -7; day <= 0; day++ {
+			start, ok := w.startOn(t.AddDate(0, 0, day))
+			if ok && !start.After(t) && t.Before(start.Add(w.duration)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NextOpening returns the earliest time after t when a window opens.
+func (s *Schedule) NextOpening(t time.Time) time.Time {
+	t = t.In(s.location)
+	var next time.Time
+	for _, w := range s.windows {
+		for day := 0; day <= 7; day++ {
+			start, ok := w.startOn(t.AddDate(0, 0, day))
+			if ok && start.After(t) {
+				if next.IsZero() || start.Before(next) {
+					next = start
+				}
+				break
+			}
+		}
+	}
+	return next
+}
+
+// startOn returns the time when the window opens on the day of t. Returns false if
+// the window does not open on that day.
+func (w *window) startOn(t time.Time) (time.Time, bool) {
+	if w.days != nil && !w.days[t.Weekday()] {
+		return time.Time{}, false
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), w.hour, w.minute, 0, 0, t.Location()), true
+}
@@ -0,0 +1,106 @@
+package packagestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/open-telemetry/opamp-go/client/atomicfile"
+	"github.com/open-telemetry/opamp-go/client/types"
+)
+
+// BeginFilesUpdate starts an update of the files of a multi-file package. The files
+// are written to a staging directory next to the "files" sub-directory of the package
+// and replace it when the update is committed.
+func (s *Store) BeginFilesUpdate(ctx context.Context, packageName string) (types.PackageFilesUpdate, error) {
+	update := &filesUpdate{store: s, packageName: packageName}
+	err := s.withPackageLock(ctx, packageName, func() error {
+		pkgDir := s.packageDir(packageName)
+		if err := os.MkdirAll(pkgDir, 0700); err != nil {
+			return err
+		}
+		var err error
+		update.dir, err = os.MkdirTemp(pkgDir, packageFilesDir+stagingFilesSuffix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// recoverFiles restores the files of the package if a commit of a files update was
+// interrupted and removes the staging directories left behind. Must be called
+// while holding the lock of the package.
+func (s *Store) recoverFiles(packageName string) error {
+	filesDir := s.FilesDir(packageName)
+	if _, err := os.Stat(filesDir); os.IsNotExist(err) {
+		if err := os.Rename(filesDir+previousFilesSuffix, filesDir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.RemoveAll(filesDir + previousFilesSuffix); err != nil {
+		return err
+	}
+
+	staging, err := filepath.Glob(filesDir + stagingFilesSuffix + "*")
+	if err != nil {
+		return err
+	}
+	for _, dir := range staging {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filesUpdate is an update of the files of a multi-file package that is staged in
+// its own directory.
+type filesUpdate struct {
+	store       *Store
+	packageName string
+	dir         string
+}
+
+func (u *filesUpdate) WriteFile(ctx context.Context, path string, data io.Reader) error {
+	filePath := filepath.Join(u.dir, filepath.FromSlash(path))
+	if !strings.HasPrefix(filePath, u.dir+string(filepath.Separator)) {
+		return fmt.Errorf("invalid file path %q", path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFrom(filePath, &ctxReader{ctx: ctx, r: data}, 0700)
+}
+
+// Commit replaces the "files" directory of the package with the staging directory.
+// The previous directory is kept aside until the new one is in place, so that it
+// can be restored if the Supervisor is interrupted in between.
+func (u *filesUpdate) Commit(ctx context.Context) error {
+	return u.store.withPackageLock(ctx, u.packageName, func() error {
+		filesDir := u.store.FilesDir(u.packageName)
+		previousDir := filesDir + previousFilesSuffix
+		if err := os.RemoveAll(previousDir); err != nil {
+			return err
+		}
+		if err := os.Rename(filesDir, previousDir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(u.dir, filesDir); err != nil {
+			if restoreErr := os.Rename(previousDir, filesDir); restoreErr != nil && !os.IsNotExist(restoreErr) {
+				u.store.logger.Errorf("Cannot restore files of package %s: %v", u.packageName, restoreErr)
+			}
+			return err
+		}
+		return os.RemoveAll(previousDir)
+	})
+}
+
+func (u *filesUpdate) Abort() error {
+	return os.RemoveAll(u.dir)
+}
@@ -0,0 +1,109 @@
+package packagestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// How often to retry acquiring a lock that is held by someone else.
+const lockRetryInterval = 100 * time.Millisecond
+
+// errLockHeld is returned by tryLockFile if the lock is held by someone else.
+var errLockHeld = errors.New("lock is held by another owner")
+
+// fileLock is an advisory lock that works across processes. The lock is an OS
+// file lock (flock on Unix, LockFileEx on Windows) on a lock file, so the OS
+// releases it when the owning process dies and a dead owner can never be confused
+// with a live one.
+//
+// While the lock is held the lock file contains the owner's PID, boot id and the
+// time the lock was acquired. The file is emptied on release, so a non-empty file
+// found by the next owner means the previous owner died while holding the lock,
+// e.g. the Supervisor was restarted in the middle of an install.
+type fileLock struct {
+	file *os.File
+}
+
+// acquireLock acquires the lock at path. Waits until the lock is released by its
+// current owner or until the ctx is done. Returns true in recovered if the previous
+// owner died while holding the lock, in which case the caller should assume the
+// data protected by the lock may be left in an incomplete state.
+func acquireLock(ctx context.Context, path string) (lock *fileLock, recovered bool, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot open lock file %s: %v", path, err)
+	}
+
+	for {
+		err := tryLockFile(f)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLockHeld) {
+			f.Close()
+			return nil, false, fmt.Errorf("cannot lock %s: %v", path, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, false, fmt.Errorf("cannot acquire lock %s: %v", path, ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	lock = &fileLock{file: f}
+	info, err := f.Stat()
+	if err != nil {
+		lock.Release()
+		return nil, false, fmt.Errorf("cannot read lock file %s: %v", path, err)
+	}
+	recovered = info.Size() > 0
+
+	if err := lock.writeOwner(); err != nil {
+		lock.Release()
+		return nil, false, fmt.Errorf("cannot write lock file %s: %v", path, err)
+	}
+	return lock, recovered, nil
+}
+
+// writeOwner records the owner of the lock in the lock file, for troubleshooting.
+// The boot id tells apart the processes with the same PID before and after a reboot.
+func (l *fileLock) writeOwner() error {
+	owner := fmt.Sprintf("pid=%d boot_id=%s acquired=%s\n",
+		os.Getpid(), bootId(), time.Now().UTC().Format(time.RFC3339))
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt([]byte(owner), 0); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Release empties the lock file to mark the clean release and releases the lock.
+// The lock file itself is kept, removing it would let another process lock a file
+// that is no longer reachable by the path.
+func (l *fileLock) Release() error {
+	err := l.file.Truncate(0)
+	if unlockErr := unlockFile(l.file); err == nil {
+		err = unlockErr
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// bootId returns the id of the current boot of the OS if it is known.
+func bootId() string {
+	b, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,302 @@
+package packagestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/atomicfile"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+const (
+	packagesDirName      = "packages"
+	allPackagesHashFile  = "allpackages.hash"
+	lastStatusesFile     = "statuses.pb"
+	packageStateFile     = "state.json"
+	packageContentFile   = "content"
+	packageHashFile      = "content.hash"
+	packageFilesDir      = "files"
+	stagingFilesSuffix   = ".staging-"
+	previousFilesSuffix  = ".previous"
+	lockFileExt          = ".lock"
+	defaultLockWaitLimit = 30 * time.Second
+)
+
+// Store is a PackagesStateProvider that keeps the packages in a directory on disk.
+//
+// Every package is stored in its own sub-directory and is protected by an advisory
+// lock file, so that several Supervisor processes sharing the directory cannot
+// modify the same package at the same time. If a Supervisor dies in the middle of
+// an install its lock is detected as stale by the next user and the package content
+// is invalidated so that it is downloaded again. All files are written atomically
+// (see atomicfile package), so a crash never leaves a partially written file behind.
+type Store struct {
+	logger types.Logger
+	dir    string
+
+	// For how long to wait for a package lock held by someone else when the
+	// operation has no context of its own.
+	lockWaitLimit time.Duration
+}
+
+var _ types.PackagesStateProvider = (*Store)(nil)
+var _ types.PackageFilesUpdater = (*Store)(nil)
+var _ types.PackageFilesUpdate = (*filesUpdate)(nil)
+var _ types.PackageContentReader = (*Store)(nil)
+
+// packageStateJSON is the format of the package state file.
+type packageStateJSON struct {
+	Type    protobufs.PackageType `json:"type"`
+	Hash    []byte                `json:"hash,omitempty"`
+	Version string                `json:"version,omitempty"`
+}
+
+// New creates a Store that keeps the packages in the specified directory.
+// The directory is created if it does not exist.
+func New(logger types.Logger, dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, packagesDirName), 0700); err != nil {
+		return nil, fmt.Errorf("cannot create package store directory: %v", err)
+	}
+	return &Store{logger: logger, dir: dir, lockWaitLimit: defaultLockWaitLimit}, nil
+}
+
+func (s *Store) packageDir(packageName string) string {
+	return filepath.Join(s.dir, packagesDirName, url.PathEscape(packageName))
+}
+
+// withPackageLock calls f while holding the lock of the package.
+func (s *Store) withPackageLock(ctx context.Context, packageName string, f func() error) error {
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.lockWaitLimit)
+		defer cancel()
+	}
+
+	lock, recovered, err := acquireLock(ctx, s.packageDir(packageName)+lockFileExt)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			s.logger.Errorf("Cannot release lock of package %s: %v", packageName, err)
+		}
+	}()
+
+	if recovered {
+		s.logger.Errorf("Recovered stale lock of package %s, invalidating its content.", packageName)
+		// The previous owner may have been interrupted while writing the content.
+		// Forget the content hash so that the content is downloaded again.
+		pkgDir := s.packageDir(packageName)
+		if err := os.Remove(filepath.Join(pkgDir, packageHashFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := atomicfile.RemoveTemporaryFiles(pkgDir); err != nil {
+			return err
+		}
+		if err := s.recoverFiles(packageName); err != nil {
+			return err
+		}
+	}
+
+	return f()
+}
+
+func (s *Store) AllPackagesHash() ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, allPackagesHashFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (s *Store) SetAllPackagesHash(hash []byte) error {
+	return atomicfile.WriteFile(filepath.Join(s.dir, allPackagesHashFile), hash, 0600)
+}
+
+func (s *Store) Packages() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, packagesDirName))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			// Lock files.
+			continue
+		}
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			s.logger.Errorf("Ignoring unexpected package directory %s", entry.Name())
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *Store) PackageState(packageName string) (state types.PackageState, err error) {
+	b, err := os.ReadFile(filepath.Join(s.packageDir(packageName), packageStateFile))
+	if os.IsNotExist(err) {
+		return types.PackageState{Exists: false}, nil
+	}
+	if err != nil {
+		return types.PackageState{}, err
+	}
+
+	var stateJSON packageStateJSON
+	if err := json.Unmarshal(b, &stateJSON); err != nil {
+		return types.PackageState{}, fmt.Errorf("cannot parse state of package %s: %v", packageName, err)
+	}
+	return types.PackageState{
+		Exists:  true,
+		Type:    stateJSON.Type,
+		Hash:    stateJSON.Hash,
+		Version: stateJSON.Version,
+	}, nil
+}
+
+func (s *Store) SetPackageState(packageName string, state types.PackageState) error {
+	return s.withPackageLock(context.Background(), packageName, func() error {
+		current, err := s.PackageState(packageName)
+		if err != nil {
+			return err
+		}
+		if !current.Exists {
+			return fmt.Errorf("package %s does not exist", packageName)
+		}
+		if current.Type != state.Type {
+			return fmt.Errorf("cannot change type of package %s", packageName)
+		}
+		return s.writePackageState(packageName, state)
+	})
+}
+
+func (s *Store) writePackageState(packageName string, state types.PackageState) error {
+	b, err := json.Marshal(packageStateJSON{Type: state.Type, Hash: state.Hash, Version: state.Version})
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(s.packageDir(packageName), packageStateFile), b, 0600)
+}
+
+func (s *Store) CreatePackage(packageName string, typ protobufs.PackageType) error {
+	return s.withPackageLock(context.Background(), packageName, func() error {
+		err := os.Mkdir(s.packageDir(packageName), 0700)
+		if os.IsExist(err) {
+			return fmt.Errorf("package %s already exists", packageName)
+		}
+		if err != nil {
+			return err
+		}
+		return s.writePackageState(packageName, types.PackageState{Type: typ})
+	})
+}
+
+func (s *Store) FileContentHash(packageName string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(s.packageDir(packageName), packageHashFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (s *Store) UpdateContent(ctx context.Context, packageName string, data io.Reader, contentHash []byte) error {
+	return s.withPackageLock(ctx, packageName, func() error {
+		pkgDir := s.packageDir(packageName)
+
+		// Invalidate the content first. The hash is only written after the content
+		// is completely written, so the content is never trusted if we are interrupted.
+		if err := os.Remove(filepath.Join(pkgDir, packageHashFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		err := atomicfile.WriteFrom(filepath.Join(pkgDir, packageContentFile), &ctxReader{ctx: ctx, r: data}, 0600)
+		if err != nil {
+			return err
+		}
+
+		return atomicfile.WriteFile(filepath.Join(pkgDir, packageHashFile), contentHash, 0600)
+	})
+}
+
+// ReadContent opens the content file of the package. Allows the Server to offer
+// package updates as patches.
+func (s *Store) ReadContent(_ context.Context, packageName string) (io.ReadCloser, error) {
+	return os.Open(s.ContentPath(packageName))
+}
+
+func (s *Store) DeletePackage(packageName string) error {
+	return s.withPackageLock(context.Background(), packageName, func() error {
+		return os.RemoveAll(s.packageDir(packageName))
+	})
+}
+
+func (s *Store) LastReportedStatuses() (*protobufs.PackageStatuses, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, lastStatusesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var statuses protobufs.PackageStatuses
+	if err := proto.Unmarshal(b, &statuses); err != nil {
+		return nil, err
+	}
+	return &statuses, nil
+}
+
+func (s *Store) SetLastReportedStatuses(statuses *protobufs.PackageStatuses) error {
+	b, err := proto.Marshal(statuses)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(s.dir, lastStatusesFile), b, 0600)
+}
+
+// ContentPath returns the path to the content file of the package.
+func (s *Store) ContentPath(packageName string) string {
+	return filepath.Join(s.packageDir(packageName), packageContentFile)
+}
+
+// FilesDir returns the directory where the files of a multi-file package are stored.
+func (s *Store) FilesDir(packageName string) string {
+	return filepath.Join(s.packageDir(packageName), packageFilesDir)
+}
+
+// ctxReader aborts reading when the context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+var errInvalidPackageName = errors.New("invalid package name")
+
+// validatePackageName ensures the package directory cannot escape the store directory.
+func validatePackageName(packageName string) error {
+	if packageName == "" || packageName == "." || packageName == ".." {
+		return errInvalidPackageName
+	}
+	return nil
+}
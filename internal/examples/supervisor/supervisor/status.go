@@ -0,0 +1,155 @@
+package supervisor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/localstatus"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Number of the most recent events served on the local status endpoint.
+const maxStatusEvents = 100
+
+// startStatusServer starts serving the local status if the status endpoint is
+// configured.
+func (s *Supervisor) startStatusServer() error {
+	if s.config.Status == nil || s.config.Status.Endpoint == "" {
+		return nil
+	}
+	var err error
+	s.statusServer, err = localstatus.Start(s.config.Status.Endpoint, s.localStatus)
+	if err != nil {
+		return err
+	}
+	s.logger.Debugf("Serving local status on %s.", s.statusServer.Addr())
+	return nil
+}
+
+// setHealth reports the health of the Agent to the Server and records it for the
+// local status.
+func (s *Supervisor) setHealth(health *protobufs.AgentHealth) error {
+	s.statusMux.Lock()
+	if s.agentHealth == nil || s.agentHealth.Healthy != health.Healthy || s.agentHealth.LastError != health.LastError {
+		if health.Healthy {
+			s.events.Add("Agent is healthy.")
+		} else if health.LastError != "" {
+			s.events.Add("Agent is not healthy: %s", health.LastError)
+		}
+	}
+	s.agentHealth = health
+	s.statusMux.Unlock()
+
+	return s.opampClient.SetHealth(health)
+}
+
+// setRemoteConfigStatus reports the status of the remote config to the Server and
+// records it for the local status.
+func (s *Supervisor) setRemoteConfigStatus(status *protobufs.RemoteConfigStatus) {
+	s.statusMux.Lock()
+	s.remoteConfigStatus = status
+	s.statusMux.Unlock()
+
+	msg := fmt.Sprintf("Remote config hash=%x is %s.", status.LastRemoteConfigHash, remoteConfigStatusName(status.Status))
+	if status.ErrorMessage != "" {
+		msg = fmt.Sprintf("%s %s", msg, status.ErrorMessage)
+	}
+	s.events.Add("%s", msg)
+
+	_ = s.opampClient.SetRemoteConfigStatus(status)
+}
+
+func remoteConfigStatusName(status protobufs.RemoteConfigStatuses) string {
+	switch status {
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED:
+		return "APPLIED"
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING:
+		return "APPLYING"
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED:
+		return "FAILED"
+	}
+	return "UNSET"
+}
+
+func (s *Supervisor) onConnect(info types.ConnectionInfo) {
+	s.logger.Debugf("Connected to the server %s via %s.", info.Endpoint, info.Transport)
+	s.events.Add("Connected to the server %s.", info.Endpoint)
+
+	s.statusMux.Lock()
+	defer s.statusMux.Unlock()
+	s.opampStatus = localstatus.OpAMPStatus{
+		Endpoint:   info.Endpoint,
+		Connected:  true,
+		LastChange: time.Now(),
+	}
+}
+
+func (s *Supervisor) onConnectFailed(err error) {
+	s.logger.Errorf("Failed to connect to the server: %v", err)
+
+	s.statusMux.Lock()
+	defer s.statusMux.Unlock()
+	if s.opampStatus.Connected || s.opampStatus.LastError != err.Error() {
+		// Don't flood the events while the Server stays unreachable.
+		s.events.Add("Failed to connect to the server: %v", err)
+	}
+	s.opampStatus.Connected = false
+	s.opampStatus.LastChange = time.Now()
+	s.opampStatus.LastError = err.Error()
+}
+
+// localStatus returns the current state served on the local status endpoint.
+func (s *Supervisor) localStatus() localstatus.Status {
+	status := localstatus.Status{
+		Supervisor: localstatus.SupervisorStatus{StartedAt: s.supervisorStartedAt},
+		Events:     s.events.List(),
+	}
+
+	s.statusMux.Lock()
+	status.Supervisor.InstanceUid = s.instanceId.String()
+	status.Agent.Running = s.commander != nil && s.commander.IsRunning()
+	status.Agent.StartedAt = s.agentStartedAt
+	if s.agentHealth != nil {
+		status.Agent.Healthy = s.agentHealth.Healthy
+		status.Agent.LastError = s.agentHealth.LastError
+	}
+	status.OpAMP = s.opampStatus
+	if status.OpAMP.Endpoint == "" {
+		status.OpAMP.Endpoint = s.config.Server.Endpoint
+	}
+	if s.remoteConfigStatus != nil {
+		status.RemoteConfig.LastHash = hex.EncodeToString(s.remoteConfigStatus.LastRemoteConfigHash)
+		status.RemoteConfig.Status = remoteConfigStatusName(s.remoteConfigStatus.Status)
+		status.RemoteConfig.ErrorMessage = s.remoteConfigStatus.ErrorMessage
+	}
+	s.statusMux.Unlock()
+
+	if cfg, ok := s.effectiveConfig.Load().(string); ok {
+		hash := sha256.Sum256([]byte(cfg))
+		status.RemoteConfig.EffectiveConfigHash = hex.EncodeToString(hash[:])
+	}
+
+	s.pendingMux.Lock()
+	if s.pendingApproval != nil {
+		status.Supervisor.PendingApprovalHash = hex.EncodeToString(s.pendingApproval.remoteConfig.ConfigHash)
+	}
+	s.pendingMux.Unlock()
+
+	s.soakMux.Lock()
+	if s.soaking != nil {
+		status.Supervisor.SoakingHash = hex.EncodeToString(s.soaking.remoteConfig.ConfigHash)
+	}
+	s.soakMux.Unlock()
+
+	s.deferredMux.Lock()
+	if s.deferredConfig != nil {
+		status.Supervisor.DeferredHash = hex.EncodeToString(s.deferredConfig.ConfigHash)
+	}
+	status.Supervisor.DeferredPackages = s.deferredPackages != nil
+	s.deferredMux.Unlock()
+
+	return status
+}
@@ -1,13 +1,14 @@
 package supervisor
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"math/rand"
 	"os"
-	"runtime"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,10 +19,17 @@ import (
 	"github.com/knadh/koanf/providers/rawbytes"
 	"github.com/oklog/ulid/v2"
 	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/client/atomicfile"
 	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/approval"
 	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/commander"
 	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/config"
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/detectors"
 	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/healthchecker"
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/healthgate"
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/localstatus"
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/maintenance"
+	"github.com/open-telemetry/opamp-go/internal/examples/supervisor/supervisor/packagestore"
 	"github.com/open-telemetry/opamp-go/protobufs"
 )
 
@@ -51,6 +59,9 @@ type Supervisor struct {
 	// The version of the Agent being Supervised.
 	agentVersion string
 
+	// Detect the attributes of the host reported in the Agent's description.
+	detectors []detectors.Detector
+
 	// Agent's instance id.
 	instanceId ulid.ULID
 
@@ -65,14 +76,65 @@ type Supervisor struct {
 	// Location of the effective config file.
 	effectiveConfigFilePath string
 
-	// Last received remote config.
+	// Last applied remote config.
 	remoteConfig *protobufs.AgentRemoteConfig
+	// Protects remoteConfig and the composing of the effective config, which
+	// happens concurrently when remote configs are approved in the background.
+	remoteConfigMux sync.Mutex
+
+	// Approves the remote configs before they are applied. nil if manual approval
+	// is not enabled.
+	approver approval.Approver
+	// The remote config waiting for approval. nil if there is none.
+	pendingApproval *pendingApproval
+	pendingMux      sync.Mutex
+
+	// Watches the Agent after a remote config is applied to roll the config back
+	// if the Agent becomes unhealthy. nil if the health gate is not enabled.
+	healthGate *healthgate.Gate
+	// The applied remote config that waits for the health gate. nil if there is none.
+	soaking *soakingConfig
+	soakMux sync.Mutex
+	// Receives the results of the health gate.
+	soakResults chan soakResult
+
+	// Maintenance windows in which the disruptive changes are applied. nil if the
+	// changes are applied immediately.
+	maintenance *maintenance.Schedule
+	// The changes received outside of the maintenance windows that are applied
+	// when a window opens. nil if there are none.
+	deferredConfig   *protobufs.AgentRemoteConfig
+	deferredPackages types.PackagesSyncer
+	deferredMux      sync.Mutex
+
+	// Closed when the Supervisor is shut down.
+	done chan struct{}
 
 	// A channel to indicate there is a new config to apply.
 	hasNewConfig chan struct{}
 
+	// A channel to indicate that the Server requested to restart the Agent.
+	restartRequested chan struct{}
+
 	// The OpAMP client to connect to the OpAMP Server.
 	opampClient client.OpAMPClient
+
+	// Serves the state of the Supervisor locally. nil if the status endpoint is
+	// not enabled.
+	statusServer *localstatus.Server
+	// The recent events shown in the local status.
+	events              *localstatus.Events
+	supervisorStartedAt time.Time
+	// The last reported state of the Agent and of the OpAMP connection.
+	agentStartedAt     time.Time
+	agentHealth        *protobufs.AgentHealth
+	opampStatus        localstatus.OpAMPStatus
+	remoteConfigStatus *protobufs.RemoteConfigStatus
+	statusMux          sync.Mutex
+
+	// Local storage of packages offered by the Server. nil if accepting packages
+	// is not enabled.
+	packages *packagestore.Store
 }
 
 func NewSupervisor(logger types.Logger) (*Supervisor, error) {
@@ -80,7 +142,12 @@ func NewSupervisor(logger types.Logger) (*Supervisor, error) {
 		logger:                  logger,
 		agentVersion:            agentVersion,
 		hasNewConfig:            make(chan struct{}, 1),
+		restartRequested:        make(chan struct{}, 1),
+		soakResults:             make(chan soakResult),
+		done:                    make(chan struct{}),
 		effectiveConfigFilePath: "effective.yaml",
+		events:                  localstatus.NewEvents(maxStatusEvents),
+		supervisorStartedAt:     time.Now(),
 	}
 
 	if err := s.loadConfig(); err != nil {
@@ -93,11 +160,32 @@ func NewSupervisor(logger types.Logger) (*Supervisor, error) {
 
 	s.loadAgentEffectiveConfig()
 
+	var err error
+	s.approver, err = approval.New(s.config.Approval)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create config approver: %v", err)
+	}
+
+	detectorNames := s.config.Detectors
+	if len(detectorNames) == 0 {
+		detectorNames = detectors.DefaultNames
+	}
+	s.detectors, err = detectors.Chain(detectorNames)
+	if err != nil {
+		return nil, err
+	}
+
+	s.healthGate = healthgate.New(s.config.HealthGate)
+
+	s.maintenance, err = maintenance.NewSchedule(s.config.MaintenanceWindows)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid maintenance windows: %v", err)
+	}
+
 	if err := s.startOpAMP(); err != nil {
 		return nil, fmt.Errorf("Cannot start OpAMP client: %v", err)
 	}
 
-	var err error
 	s.commander, err = commander.NewCommander(
 		s.logger,
 		s.config.Agent,
@@ -107,8 +195,16 @@ func NewSupervisor(logger types.Logger) (*Supervisor, error) {
 		return nil, err
 	}
 
+	if err := s.startStatusServer(); err != nil {
+		return nil, fmt.Errorf("Cannot start local status endpoint: %v", err)
+	}
+
 	go s.runAgentProcess()
 
+	if s.maintenance != nil {
+		go s.runMaintenanceWindows()
+	}
+
 	return s, nil
 }
 
@@ -135,32 +231,41 @@ func (s *Supervisor) startOpAMP() error {
 		OpAMPServerURL: s.config.Server.Endpoint,
 		InstanceUid:    s.instanceId.String(),
 		Callbacks: types.CallbacksStruct{
-			OnConnectFunc: func() {
-				s.logger.Debugf("Connected to the server.")
-			},
-			OnConnectFailedFunc: func(err error) {
-				s.logger.Errorf("Failed to connect to the server: %v", err)
-			},
-			OnErrorFunc: func(err *protobufs.ServerErrorResponse) {
-				s.logger.Errorf("Server returned an error response: %v", err.ErrorMessage)
+			OnConnectFunc:       s.onConnect,
+			OnConnectFailedFunc: s.onConnectFailed,
+			OnErrorFunc: func(err *types.ServerError) {
+				s.logger.Errorf("Server returned an error response: %v", err)
 			},
 			GetEffectiveConfigFunc: func(ctx context.Context) (*protobufs.EffectiveConfig, error) {
 				return s.createEffectiveConfigMsg(), nil
 			},
 			OnMessageFunc: s.onMessage,
+			OnCommandFunc: s.onCommand,
 		},
 		Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
 			protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig |
 			protobufs.AgentCapabilities_AgentCapabilities_ReportsEffectiveConfig |
 			protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnMetrics |
-			protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth,
+			protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth |
+			protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand,
+	}
+	if s.config.Packages != nil && s.config.Packages.Directory != "" {
+		var err error
+		s.packages, err = packagestore.New(s.logger, s.config.Packages.Directory)
+		if err != nil {
+			return err
+		}
+		settings.PackagesStateProvider = s.packages
+		settings.Capabilities |= protobufs.AgentCapabilities_AgentCapabilities_AcceptsPackages |
+			protobufs.AgentCapabilities_AgentCapabilities_ReportsPackageStatuses
 	}
+
 	err := s.opampClient.SetAgentDescription(s.createAgentDescription())
 	if err != nil {
 		return err
 	}
 
-	err = s.opampClient.SetHealth(&protobufs.AgentHealth{Healthy: false})
+	err = s.setHealth(&protobufs.AgentHealth{Healthy: false})
 	if err != nil {
 		return err
 	}
@@ -194,23 +299,49 @@ func keyVal(key, val string) *protobufs.KeyValue {
 	}
 }
 
+// Maximum time to detect the host attributes, e.g. to query the cloud metadata.
+const detectTimeout = 2 * time.Second
+
 func (s *Supervisor) createAgentDescription() *protobufs.AgentDescription {
-	hostname, _ := os.Hostname()
+	ctx, cancel := context.WithTimeout(context.Background(), detectTimeout)
+	defer cancel()
 
 	// Create Agent description.
-	return &protobufs.AgentDescription{
+	descr := &protobufs.AgentDescription{
 		IdentifyingAttributes: []*protobufs.KeyValue{
 			keyVal("service.name", agentType),
 			keyVal("service.version", s.agentVersion),
 		},
-		NonIdentifyingAttributes: []*protobufs.KeyValue{
-			keyVal("os.type", runtime.GOOS),
-			keyVal("host.name", hostname),
-		},
+		NonIdentifyingAttributes: detectors.Detect(ctx, s.detectors, func(err error) {
+			s.logger.Debugf("Host attribute detector failed: %v", err)
+		}),
 	}
+
+	// Report the host fingerprint to let the Server detect cloned hosts.
+	if fingerprint, err := client.HostFingerprintAttribute(); err == nil {
+		descr.NonIdentifyingAttributes = append(descr.NonIdentifyingAttributes, fingerprint)
+	} else {
+		s.logger.Debugf("Cannot fingerprint the host: %v", err)
+	}
+
+	return descr
+}
+
+// Default endpoint of the Agent's health_check extension.
+const defaultHealthCheckEndpoint = "localhost:13133"
+
+func (s *Supervisor) healthCheckEndpoint() string {
+	if s.config.Agent != nil && s.config.Agent.HealthCheckEndpoint != "" {
+		return s.config.Agent.HealthCheckEndpoint
+	}
+	return defaultHealthCheckEndpoint
 }
 
 func (s *Supervisor) composeExtraLocalConfig() string {
+	healthCheckConfig := ""
+	if s.config.Agent != nil && s.config.Agent.HealthCheckEndpoint != "" {
+		healthCheckConfig = "    endpoint: " + s.config.Agent.HealthCheckEndpoint
+	}
 
 	return fmt.Sprintf(`
 service:
@@ -230,11 +361,12 @@ service:
 
 extensions:
   health_check:
-    # TODO: choose the endpoint dynamically.
+%s
 `,
 		agentType,
 		s.agentVersion,
 		s.instanceId.String(),
+		healthCheckConfig,
 	)
 }
 
@@ -332,7 +464,7 @@ func (s *Supervisor) composeEffectiveConfig(config *protobufs.AgentRemoteConfig)
 
 	// Sort to make sure the order of merging is stable.
 	var names []string
-	for name := range config.Config.ConfigMap {
+	for name := range config.GetConfig().GetConfigMap() {
 		if name == "" {
 			// skip instance config
 			continue
@@ -347,7 +479,11 @@ func (s *Supervisor) composeEffectiveConfig(config *protobufs.AgentRemoteConfig)
 
 	// Merge received configs.
 	for _, name := range names {
-		item := config.Config.ConfigMap[name]
+		item := config.GetConfig().GetConfigMap()[name]
+		if item == nil {
+			// No config received yet, e.g. it waits for approval.
+			continue
+		}
 		var k2 = koanf.New(".")
 		err := k2.Load(rawbytes.Provider(item.Body), yaml.Parser())
 		if err != nil {
@@ -393,6 +529,8 @@ func (s *Supervisor) composeEffectiveConfig(config *protobufs.AgentRemoteConfig)
 // Recalculate the Agent's effective config and if the config changes signal to the
 // background goroutine that the config needs to be applied to the Agent.
 func (s *Supervisor) recalcEffectiveConfig() (configChanged bool, err error) {
+	s.remoteConfigMux.Lock()
+	defer s.remoteConfigMux.Unlock()
 
 	configChanged, err = s.composeEffectiveConfig(s.remoteConfig)
 	if err != nil {
@@ -408,10 +546,14 @@ func (s *Supervisor) startAgent() {
 	if err != nil {
 		errMsg := fmt.Sprintf("Cannot start the agent: %v", err)
 		s.logger.Errorf(errMsg)
-		s.opampClient.SetHealth(&protobufs.AgentHealth{Healthy: false, LastError: errMsg})
+		s.setHealth(&protobufs.AgentHealth{Healthy: false, LastError: errMsg})
 		return
 	}
 	s.startedAt = time.Now()
+	s.statusMux.Lock()
+	s.agentStartedAt = s.startedAt
+	s.statusMux.Unlock()
+	s.events.Add("Agent process started, PID=%d.", s.commander.Pid())
 
 	// Prepare health checker
 	healthCheckBackoff := backoff.NewExponentialBackOff()
@@ -422,9 +564,7 @@ func (s *Supervisor) startAgent() {
 	}
 	s.healthCheckTicker = backoff.NewTicker(healthCheckBackoff)
 
-	// TODO: choose the port dynamically.
-	healthEndpoint := "http://localhost:13133"
-	s.healthChecker = healthchecker.NewHttpHealthChecker(healthEndpoint)
+	s.healthChecker = healthchecker.NewHttpHealthChecker("http://" + s.healthCheckEndpoint())
 }
 
 func (s *Supervisor) healthCheck() {
@@ -457,7 +597,7 @@ func (s *Supervisor) healthCheck() {
 	}
 
 	// Report via OpAMP.
-	if err2 := s.opampClient.SetHealth(health); err2 != nil {
+	if err2 := s.setHealth(health); err2 != nil {
 		s.logger.Errorf("Could not report health. SetHealth returned: %v", err2)
 		return
 	}
@@ -475,11 +615,25 @@ func (s *Supervisor) runAgentProcess() {
 	restartTimer.Stop()
 
 	for {
+		// No health checks until the Agent is started for the first time.
+		var healthCheckC <-chan time.Time
+		if s.healthCheckTicker != nil {
+			healthCheckC = s.healthCheckTicker.C
+		}
+
 		select {
+		case <-s.done:
+			restartTimer.Stop()
+			return
+
 		case <-s.hasNewConfig:
 			restartTimer.Stop()
 			s.stopAgentApplyConfig()
 			s.startAgent()
+			s.startSoak()
+
+		case result := <-s.soakResults:
+			s.onSoakResult(result)
 
 		case <-s.commander.Done():
 			errMsg := fmt.Sprintf(
@@ -487,7 +641,8 @@ func (s *Supervisor) runAgentProcess() {
 				s.commander.Pid(), s.commander.ExitCode(),
 			)
 			s.logger.Debugf(errMsg)
-			s.opampClient.SetHealth(&protobufs.AgentHealth{Healthy: false, LastError: errMsg})
+			s.events.Add("%s", errMsg)
+			s.setHealth(&protobufs.AgentHealth{Healthy: false, LastError: errMsg})
 
 			// TODO: decide why the agent stopped. If it was due to bad config, report it to server.
 
@@ -495,10 +650,17 @@ func (s *Supervisor) runAgentProcess() {
 			restartTimer.Stop()
 			restartTimer.Reset(5 * time.Second)
 
+		case <-s.restartRequested:
+			restartTimer.Stop()
+			s.logger.Debugf("Restarting the agent as requested by the server.")
+			s.events.Add("Restarting the agent as requested by the server.")
+			s.commander.Stop(context.Background())
+			s.startAgent()
+
 		case <-restartTimer.C:
 			s.startAgent()
 
-		case <-s.healthCheckTicker.C:
+		case <-healthCheckC:
 			s.healthCheck()
 		}
 	}
@@ -512,22 +674,34 @@ func (s *Supervisor) stopAgentApplyConfig() {
 }
 
 func (s *Supervisor) writeEffectiveConfigToFile(cfg string, filePath string) {
-	f, err := os.Create(filePath)
-	if err != nil {
+	if err := atomicfile.WriteFile(filePath, []byte(cfg), 0600); err != nil {
 		s.logger.Errorf("Cannot write effective config file: %v", err)
 	}
-	defer f.Close()
-
-	f.WriteString(cfg)
 }
 
 func (s *Supervisor) Shutdown() {
 	s.logger.Debugf("Supervisor shutting down...")
+	close(s.done)
+	s.pendingMux.Lock()
+	if s.pendingApproval != nil {
+		s.pendingApproval.cancel()
+		s.pendingApproval = nil
+	}
+	s.pendingMux.Unlock()
+	s.soakMux.Lock()
+	if s.soaking != nil && s.soaking.cancel != nil {
+		s.soaking.cancel()
+	}
+	s.soaking = nil
+	s.soakMux.Unlock()
+	if s.statusServer != nil {
+		_ = s.statusServer.Shutdown(context.Background())
+	}
 	if s.commander != nil {
 		s.commander.Stop(context.Background())
 	}
 	if s.opampClient != nil {
-		s.opampClient.SetHealth(
+		s.setHealth(
 			&protobufs.AgentHealth{
 				Healthy: false, LastError: "Supervisor is shutdown",
 			},
@@ -539,22 +713,12 @@ func (s *Supervisor) Shutdown() {
 func (s *Supervisor) onMessage(ctx context.Context, msg *types.MessageData) {
 	configChanged := false
 	if msg.RemoteConfig != nil {
-		s.remoteConfig = msg.RemoteConfig
-		s.logger.Debugf("Received remote config from server, hash=%x.", s.remoteConfig.ConfigHash)
-
-		var err error
-		configChanged, err = s.recalcEffectiveConfig()
-		if err != nil {
-			s.opampClient.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
-				LastRemoteConfigHash: msg.RemoteConfig.ConfigHash,
-				Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
-				ErrorMessage:         err.Error(),
-			})
+		s.logger.Debugf("Received remote config from server, hash=%x.", msg.RemoteConfig.ConfigHash)
+		s.events.Add("Received remote config hash=%x.", msg.RemoteConfig.ConfigHash)
+		if s.approver == nil {
+			configChanged = s.scheduleRemoteConfig(msg.RemoteConfig)
 		} else {
-			s.opampClient.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
-				LastRemoteConfigHash: msg.RemoteConfig.ConfigHash,
-				Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
-			})
+			s.stageRemoteConfig(msg.RemoteConfig)
 		}
 	}
 
@@ -571,23 +735,393 @@ func (s *Supervisor) onMessage(ctx context.Context, msg *types.MessageData) {
 		s.logger.Debugf("Agent identify is being changed from id=%v to id=%v",
 			s.instanceId.String(),
 			newInstanceId.String())
+		s.statusMux.Lock()
 		s.instanceId = newInstanceId
+		s.statusMux.Unlock()
 
 		// TODO: update metrics pipeline by altering configuration and setting
 		// the instance id when Collector implements https://github.com/open-telemetry/opentelemetry-collector/pull/5402.
 	}
 
+	if msg.PackageSyncer != nil {
+		if s.maintenance == nil || s.maintenance.IsOpen(time.Now()) {
+			// The newest offer supersedes the deferred one.
+			s.deferredMux.Lock()
+			s.deferredPackages = nil
+			s.deferredMux.Unlock()
+			if err := msg.PackageSyncer.Sync(ctx); err != nil {
+				s.logger.Errorf("Cannot sync packages: %v", err)
+			}
+		} else {
+			s.deferPackages(msg.PackagesAvailable, msg.PackageSyncer)
+		}
+	}
+
 	if configChanged {
-		err := s.opampClient.UpdateEffectiveConfig(ctx)
-		if err != nil {
-			s.logger.Errorf(err.Error())
+		s.onConfigChanged(ctx)
+	}
+}
+
+func (s *Supervisor) onCommand(_ context.Context, command *protobufs.ServerToAgentCommand) error {
+	if command.Type != protobufs.CommandType_CommandType_Restart {
+		return fmt.Errorf("unsupported command type %v", command.Type)
+	}
+
+	// The Agent is restarted by the background goroutine.
+	select {
+	case s.restartRequested <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// onConfigChanged reports the new effective config and signals to the background
+// goroutine that the config needs to be applied to the Agent.
+func (s *Supervisor) onConfigChanged(ctx context.Context) {
+	err := s.opampClient.UpdateEffectiveConfig(ctx)
+	if err != nil {
+		s.logger.Errorf(err.Error())
+	}
+
+	s.logger.Debugf("Config is changed. Signal to restart the agent.")
+	// Signal that there is a new config.
+	select {
+	case s.hasNewConfig <- struct{}{}:
+	default:
+	}
+}
+
+// applyRemoteConfig makes the remoteConfig part of the effective config and reports
+// the result to the Server.
+func (s *Supervisor) applyRemoteConfig(remoteConfig *protobufs.AgentRemoteConfig) (configChanged bool) {
+	s.remoteConfigMux.Lock()
+	previous := s.remoteConfig
+	s.remoteConfig = remoteConfig
+	s.remoteConfigMux.Unlock()
+
+	configChanged, err := s.recalcEffectiveConfig()
+	if err != nil {
+		s.setRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: remoteConfig.ConfigHash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+			ErrorMessage:         err.Error(),
+		})
+	} else if configChanged && s.healthGate != nil {
+		s.stageSoak(remoteConfig, previous)
+	} else {
+		s.setRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: remoteConfig.ConfigHash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		})
+	}
+	return configChanged
+}
+
+// pendingApproval is a remote config waiting for approval.
+type pendingApproval struct {
+	remoteConfig *protobufs.AgentRemoteConfig
+	cancel       context.CancelFunc
+}
+
+// stageRemoteConfig starts the approval of the remoteConfig in the background and
+// reports it as pending until it is approved or rejected. A remote config waiting
+// for approval is superseded by the newer one.
+func (s *Supervisor) stageRemoteConfig(remoteConfig *protobufs.AgentRemoteConfig) {
+	s.pendingMux.Lock()
+	defer s.pendingMux.Unlock()
+
+	if s.pendingApproval != nil {
+		if bytes.Equal(s.pendingApproval.remoteConfig.ConfigHash, remoteConfig.ConfigHash) {
+			// Already waiting for approval.
+			return
+		}
+		s.logger.Debugf("Remote config hash=%x is superseded, cancelling its approval.",
+			s.pendingApproval.remoteConfig.ConfigHash)
+		s.pendingApproval.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pending := &pendingApproval{remoteConfig: remoteConfig, cancel: cancel}
+	s.pendingApproval = pending
+
+	// There is no dedicated pending status, APPLYING tells the Server that the
+	// config was received but is not in effect yet.
+	s.logger.Debugf("Remote config hash=%x is waiting for approval.", remoteConfig.ConfigHash)
+	s.setRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: remoteConfig.ConfigHash,
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING,
+	})
+
+	go s.awaitApproval(ctx, pending)
+}
+
+func (s *Supervisor) awaitApproval(ctx context.Context, pending *pendingApproval) {
+	decision, err := s.approver.Approve(ctx, pending.remoteConfig)
+
+	s.pendingMux.Lock()
+	if s.pendingApproval != pending {
+		// Superseded by a newer remote config or the Supervisor is shut down.
+		s.pendingMux.Unlock()
+		return
+	}
+	s.pendingApproval = nil
+	s.pendingMux.Unlock()
+	pending.cancel()
+
+	hash := pending.remoteConfig.ConfigHash
+	switch {
+	case err != nil:
+		s.logger.Errorf("Cannot get approval of remote config hash=%x: %v", hash, err)
+		s.setRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: hash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+			ErrorMessage:         fmt.Sprintf("cannot get approval: %v", err),
+		})
+
+	case !decision.Approved:
+		s.logger.Debugf("Remote config hash=%x is rejected: %s", hash, decision.Reason)
+		errMsg := "rejected by approval hook"
+		if decision.Reason != "" {
+			errMsg += ": " + decision.Reason
+		}
+		s.setRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: hash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+			ErrorMessage:         errMsg,
+		})
+
+	default:
+		s.logger.Debugf("Remote config hash=%x is approved.", hash)
+		if s.scheduleRemoteConfig(pending.remoteConfig) {
+			s.onConfigChanged(context.Background())
+		}
+	}
+}
+
+// soakingConfig is an applied remote config that waits for the health gate.
+type soakingConfig struct {
+	remoteConfig *protobufs.AgentRemoteConfig
+	// The last remote config that passed the health gate, to roll back to.
+	previous *protobufs.AgentRemoteConfig
+	// Cancels the running soak. nil if the soak is not started yet.
+	cancel context.CancelFunc
+}
+
+type soakResult struct {
+	soaking *soakingConfig
+	err     error
+}
+
+// stageSoak records that the remoteConfig must pass the health gate once the Agent
+// is restarted with it and reports the config as APPLYING until then.
+func (s *Supervisor) stageSoak(remoteConfig, previous *protobufs.AgentRemoteConfig) {
+	s.soakMux.Lock()
+	defer s.soakMux.Unlock()
+
+	if s.soaking != nil {
+		// The config being soaked is superseded, roll back to the last good config
+		// if the new one fails too.
+		previous = s.soaking.previous
+		if s.soaking.cancel != nil {
+			s.soaking.cancel()
 		}
+	}
+	s.soaking = &soakingConfig{remoteConfig: remoteConfig, previous: previous}
 
-		s.logger.Debugf("Config is changed. Signal to restart the agent.")
-		// Signal that there is a new config.
+	s.setRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: remoteConfig.ConfigHash,
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING,
+	})
+}
+
+// startSoak starts watching the Agent that was restarted with the config waiting
+// for the health gate, if any.
+func (s *Supervisor) startSoak() {
+	s.soakMux.Lock()
+	soaking := s.soaking
+	if soaking == nil {
+		s.soakMux.Unlock()
+		return
+	}
+	if soaking.cancel != nil {
+		// The Agent was restarted, e.g. because its own metrics config changed,
+		// watch it for the full soak period again.
+		soaking.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	soaking.cancel = cancel
+	s.soakMux.Unlock()
+
+	if !s.commander.IsRunning() {
+		s.onSoakResult(soakResult{soaking: soaking, err: errors.New("agent is not running")})
+		return
+	}
+
+	s.logger.Debugf("Watching the agent for %v with remote config hash=%x.",
+		s.config.HealthGate.SoakPeriod, soaking.remoteConfig.ConfigHash)
+	checker := s.healthChecker
+	go func() {
+		err := s.healthGate.Soak(ctx, checker)
 		select {
-		case s.hasNewConfig <- struct{}{}:
-		default:
+		case s.soakResults <- soakResult{soaking: soaking, err: err}:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// onSoakResult reports the soaked config as APPLIED if it passed the health gate,
+// otherwise rolls back to the previous config and reports the config as FAILED.
+func (s *Supervisor) onSoakResult(result soakResult) {
+	s.soakMux.Lock()
+	if s.soaking != result.soaking {
+		// Superseded by a newer config.
+		s.soakMux.Unlock()
+		return
+	}
+	s.soaking = nil
+	s.soakMux.Unlock()
+	result.soaking.cancel()
+
+	hash := result.soaking.remoteConfig.ConfigHash
+	if result.err == nil {
+		s.logger.Debugf("Remote config hash=%x passed the health gate.", hash)
+		s.setRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: hash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		})
+		return
+	}
+
+	s.logger.Errorf("Remote config hash=%x failed the health gate, rolling back: %v", hash, result.err)
+	s.remoteConfigMux.Lock()
+	s.remoteConfig = result.soaking.previous
+	s.remoteConfigMux.Unlock()
+	if _, err := s.recalcEffectiveConfig(); err != nil {
+		s.logger.Errorf("Cannot roll back the config: %v", err)
+	}
+
+	s.setRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: hash,
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+		ErrorMessage:         fmt.Sprintf("config rolled back: %v", result.err),
+	})
+	if err := s.opampClient.UpdateEffectiveConfig(context.Background()); err != nil {
+		s.logger.Errorf(err.Error())
+	}
+
+	s.stopAgentApplyConfig()
+	s.startAgent()
+}
+
+// scheduleRemoteConfig applies the remoteConfig if a maintenance window is open,
+// otherwise defers it until the next window opens. Every change of the remote
+// config restarts the Agent, so all changes are considered disruptive.
+func (s *Supervisor) scheduleRemoteConfig(remoteConfig *protobufs.AgentRemoteConfig) (configChanged bool) {
+	now := time.Now()
+	open := s.maintenance == nil || s.maintenance.IsOpen(now)
+
+	// Only the newest remote config is applied, it supersedes the deferred one.
+	s.deferredMux.Lock()
+	if open {
+		s.deferredConfig = nil
+	} else {
+		s.deferredConfig = remoteConfig
+	}
+	s.deferredMux.Unlock()
+
+	if open {
+		return s.applyRemoteConfig(remoteConfig)
+	}
+
+	deferral := s.deferralMessage(now)
+	s.logger.Debugf("Remote config hash=%x is %s.", remoteConfig.ConfigHash, deferral)
+	s.setRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: remoteConfig.ConfigHash,
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING,
+		ErrorMessage:         deferral,
+	})
+	return false
+}
+
+// deferPackages defers the syncing of the available packages until the next
+// maintenance window opens and reports the offered packages as pending.
+func (s *Supervisor) deferPackages(available *protobufs.PackagesAvailable, syncer types.PackagesSyncer) {
+	// Only the newest offer is synced when the window opens.
+	s.deferredMux.Lock()
+	s.deferredPackages = syncer
+	s.deferredMux.Unlock()
+
+	deferral := s.deferralMessage(time.Now())
+	s.logger.Debugf("Package installation is %s.", deferral)
+
+	statuses, err := s.packages.LastReportedStatuses()
+	if err != nil {
+		s.logger.Errorf("Cannot read package statuses: %v", err)
+		return
+	}
+	if statuses == nil {
+		statuses = &protobufs.PackageStatuses{}
+	}
+	if statuses.Packages == nil {
+		statuses.Packages = map[string]*protobufs.PackageStatus{}
+	}
+	statuses.ServerProvidedAllPackagesHash = available.GetAllPackagesHash()
+	for name, pkg := range available.GetPackages() {
+		status := statuses.Packages[name]
+		if status == nil {
+			status = &protobufs.PackageStatus{Name: name}
+			statuses.Packages[name] = status
+		}
+		if bytes.Equal(status.AgentHasHash, pkg.Hash) {
+			// Already installed, nothing to defer.
+			continue
+		}
+		status.ServerOfferedVersion = pkg.Version
+		status.ServerOfferedHash = pkg.Hash
+		status.Status = protobufs.PackageStatusEnum_PackageStatusEnum_InstallPending
+		status.ErrorMessage = deferral
+	}
+	if err := s.opampClient.SetPackageStatuses(statuses); err != nil {
+		s.logger.Errorf("Cannot report package statuses: %v", err)
+	}
+}
+
+func (s *Supervisor) deferralMessage(now time.Time) string {
+	return fmt.Sprintf("deferred until the maintenance window opens at %s",
+		s.maintenance.NextOpening(now).Format(time.RFC3339))
+}
+
+// runMaintenanceWindows applies the deferred changes every time a maintenance
+// window opens until the Supervisor is shut down.
+func (s *Supervisor) runMaintenanceWindows() {
+	for {
+		timer := time.NewTimer(time.Until(s.maintenance.NextOpening(time.Now())))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.applyDeferredChanges()
+	}
+}
+
+func (s *Supervisor) applyDeferredChanges() {
+	s.deferredMux.Lock()
+	remoteConfig, packages := s.deferredConfig, s.deferredPackages
+	s.deferredConfig, s.deferredPackages = nil, nil
+	s.deferredMux.Unlock()
+
+	if remoteConfig != nil {
+		s.logger.Debugf("Maintenance window is open, applying remote config hash=%x.", remoteConfig.ConfigHash)
+		if s.applyRemoteConfig(remoteConfig) {
+			s.onConfigChanged(context.Background())
+		}
+	}
+	if packages != nil {
+		s.logger.Debugf("Maintenance window is open, syncing packages.")
+		if err := packages.Sync(context.Background()); err != nil {
+			s.logger.Errorf("Cannot sync packages: %v", err)
 		}
 	}
 }
@@ -0,0 +1,140 @@
+package supervisor
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestSupervisorAppliesRemoteConfig(t *testing.T) {
+	h := startHarness(t, "")
+	h.waitHealthy()
+	starts := h.agentStarts()
+
+	hash := []byte("config-1")
+	h.server.push(&protobufs.ServerToAgent{
+		RemoteConfig: &protobufs.AgentRemoteConfig{
+			Config: &protobufs.AgentConfigMap{ConfigMap: map[string]*protobufs.AgentConfigFile{
+				"": {Body: []byte("receivers:\n  otlp/remote:\n")},
+			}},
+			ConfigHash: hash,
+		},
+	})
+
+	h.server.eventually("remote config is applied", func(state *protobufs.AgentToServer) bool {
+		status := state.GetRemoteConfigStatus()
+		return string(status.GetLastRemoteConfigHash()) == string(hash) &&
+			status.GetStatus() == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED &&
+			strings.Contains(reportedEffectiveConfig(state), "otlp/remote")
+	})
+
+	// The Agent is restarted with the new config.
+	eventually(t, "agent restarts", func() bool { return h.agentStarts() > starts })
+	assert.Contains(t, h.effectiveConfig(), "otlp/remote")
+	h.waitHealthy()
+}
+
+func TestSupervisorUpgradesPackage(t *testing.T) {
+	contents := map[string][]byte{
+		"/agent-1.0.0": []byte("agent 1.0.0"),
+		"/agent-2.0.0": []byte("agent 2.0.0"),
+	}
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := contents[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer files.Close()
+
+	h := startHarness(t, "packages:\n  directory: packages\n")
+
+	offer := func(version string) {
+		content := contents["/agent-"+version]
+		contentHash := sha256.Sum256(content)
+		hash := sha256.Sum256([]byte("agent" + version))
+		h.server.push(&protobufs.ServerToAgent{
+			PackagesAvailable: &protobufs.PackagesAvailable{
+				Packages: map[string]*protobufs.PackageAvailable{
+					"agent": {
+						Type:    protobufs.PackageType_PackageType_TopLevel,
+						Version: version,
+						File: &protobufs.DownloadableFile{
+							DownloadUrl: files.URL + "/agent-" + version,
+							ContentHash: contentHash[:],
+						},
+						Hash: hash[:],
+					},
+				},
+				AllPackagesHash: hash[:],
+			},
+		})
+		h.server.eventually("package "+version+" is installed", func(state *protobufs.AgentToServer) bool {
+			status := state.GetPackageStatuses().GetPackages()["agent"]
+			return status.GetStatus() == protobufs.PackageStatusEnum_PackageStatusEnum_Installed &&
+				status.GetAgentHasVersion() == version
+		})
+		installed, err := os.ReadFile(h.supervisor.packages.ContentPath("agent"))
+		require.NoError(t, err)
+		assert.EqualValues(t, content, installed)
+	}
+
+	offer("1.0.0")
+	offer("2.0.0")
+}
+
+func TestSupervisorRestartsAgentOnCommand(t *testing.T) {
+	h := startHarness(t, "")
+	h.waitHealthy()
+	starts := h.agentStarts()
+
+	h.server.push(&protobufs.ServerToAgent{
+		Command: &protobufs.ServerToAgentCommand{Type: protobufs.CommandType_CommandType_Restart},
+	})
+
+	eventually(t, "agent restarts", func() bool { return h.agentStarts() == starts+1 })
+	h.waitHealthy()
+}
+
+func TestSupervisorSurvivesServerOutage(t *testing.T) {
+	h := startHarness(t, "")
+	h.waitHealthy()
+
+	h.server.stop()
+	time.Sleep(time.Second)
+	h.server.start()
+
+	// The Supervisor reports its state to the restarted Server once it reconnects.
+	h.server.eventually("agent reports its state", func(state *protobufs.AgentToServer) bool {
+		return state.GetAgentDescription() != nil && reportedEffectiveConfig(state) != ""
+	})
+
+	// And the Supervisor keeps accepting remote configs.
+	hash := []byte("config-after-outage")
+	h.server.push(&protobufs.ServerToAgent{
+		RemoteConfig: &protobufs.AgentRemoteConfig{
+			Config: &protobufs.AgentConfigMap{ConfigMap: map[string]*protobufs.AgentConfigFile{
+				"": {Body: []byte("receivers:\n  otlp/after:\n")},
+			}},
+			ConfigHash: hash,
+		},
+	})
+	h.server.eventually("remote config is applied", func(state *protobufs.AgentToServer) bool {
+		status := state.GetRemoteConfigStatus()
+		return string(status.GetLastRemoteConfigHash()) == string(hash) &&
+			status.GetStatus() == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED
+	})
+	assert.FileExists(t, filepath.Join(h.dir, "effective.yaml"))
+}
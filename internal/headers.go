@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Limits of the headers in the connection settings offers and in the headers
+// used to connect to the Server.
+const (
+	MaxHeaderCount       = 64
+	MaxHeaderValueLength = 8 * 1024
+	MaxHeadersSize       = 16 * 1024
+)
+
+var (
+	ErrTooManyHeaders     = fmt.Errorf("too many headers, the limit is %d", MaxHeaderCount)
+	ErrHeadersTooLarge    = fmt.Errorf("headers are too large, the limit is %d bytes", MaxHeadersSize)
+	ErrHeaderValueTooLong = fmt.Errorf("header value is too long, the limit is %d bytes", MaxHeaderValueLength)
+	ErrInvalidHeaderName  = errors.New("invalid header name")
+	ErrInvalidHeaderValue = errors.New("invalid header value")
+	ErrForbiddenHeader    = errors.New("header is not allowed")
+)
+
+// Headers that are managed by the HTTP and WebSocket implementations and that
+// must not be set by the connection settings.
+var forbiddenHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Upgrade":           true,
+}
+
+const forbiddenHeaderPrefix = "Sec-Websocket-"
+
+// ValidateHeader validates the header name and value and returns the canonical
+// form of the name.
+func ValidateHeader(name, value string) (canonicalName string, err error) {
+	if !isToken(name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidHeaderName, name)
+	}
+	canonicalName = http.CanonicalHeaderKey(name)
+	if forbiddenHeaders[canonicalName] || strings.HasPrefix(canonicalName, forbiddenHeaderPrefix) {
+		return "", fmt.Errorf("%w: %s", ErrForbiddenHeader, canonicalName)
+	}
+	if len(value) > MaxHeaderValueLength {
+		return "", fmt.Errorf("%w: %s", ErrHeaderValueTooLong, canonicalName)
+	}
+	if !isValidHeaderValue(value) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidHeaderValue, canonicalName)
+	}
+	return canonicalName, nil
+}
+
+// ValidateHTTPHeader validates the headers used to connect to the Server.
+func ValidateHTTPHeader(header http.Header) error {
+	count, size := 0, 0
+	for name, values := range header {
+		for _, value := range values {
+			if _, err := ValidateHeader(name, value); err != nil {
+				return err
+			}
+			count++
+			size += len(name) + len(value)
+		}
+	}
+	return checkHeaderLimits(count, size)
+}
+
+// SanitizeHeaders validates the headers of a connection settings offer and returns
+// a copy of the headers with canonical names. Returns nil if headers is nil.
+func SanitizeHeaders(headers *protobufs.Headers) (*protobufs.Headers, error) {
+	if headers == nil {
+		return nil, nil
+	}
+
+	sanitized := &protobufs.Headers{Headers: make([]*protobufs.Header, 0, len(headers.Headers))}
+	size := 0
+	for _, h := range headers.Headers {
+		name, err := ValidateHeader(h.Key, h.Value)
+		if err != nil {
+			return nil, err
+		}
+		size += len(name) + len(h.Value)
+		sanitized.Headers = append(sanitized.Headers, &protobufs.Header{Key: name, Value: h.Value})
+	}
+
+	if err := checkHeaderLimits(len(sanitized.Headers), size); err != nil {
+		return nil, err
+	}
+	return sanitized, nil
+}
+
+// SanitizeConnectionSettingsOffers sanitizes the headers of all offers in place (see
+// SanitizeHeaders) and removes the offers with invalid headers. onInvalid is called
+// for every removed offer with the name of the offer and the error.
+func SanitizeConnectionSettingsOffers(
+	offers *protobufs.ConnectionSettingsOffers, onInvalid func(offer string, err error),
+) {
+	if offers == nil {
+		return
+	}
+
+	sanitize := func(offer string, headers **protobufs.Headers) bool {
+		sanitized, err := SanitizeHeaders(*headers)
+		if err != nil {
+			onInvalid(offer, err)
+			return false
+		}
+		*headers = sanitized
+		return true
+	}
+
+	if offers.Opamp != nil && !sanitize("opamp", &offers.Opamp.Headers) {
+		offers.Opamp = nil
+	}
+	if offers.OwnMetrics != nil && !sanitize("own_metrics", &offers.OwnMetrics.Headers) {
+		offers.OwnMetrics = nil
+	}
+	if offers.OwnTraces != nil && !sanitize("own_traces", &offers.OwnTraces.Headers) {
+		offers.OwnTraces = nil
+	}
+	if offers.OwnLogs != nil && !sanitize("own_logs", &offers.OwnLogs.Headers) {
+		offers.OwnLogs = nil
+	}
+	for name, other := range offers.OtherConnections {
+		if other != nil && !sanitize("other_connections/"+name, &other.Headers) {
+			delete(offers.OtherConnections, name)
+		}
+	}
+}
+
+func checkHeaderLimits(count, size int) error {
+	if count > MaxHeaderCount {
+		return ErrTooManyHeaders
+	}
+	if size > MaxHeadersSize {
+		return ErrHeadersTooLarge
+	}
+	return nil
+}
+
+// isToken returns true if s is a valid header field name (RFC 7230 token).
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isValidHeaderValue returns true if s does not contain control characters other
+// than horizontal tab. In particular CR and LF are not allowed.
+func isValidHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestValidateHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		err   error
+		canon string
+	}{
+		{name: "authorization", value: "Bearer x", canon: "Authorization"},
+		{name: "x-custom-header", value: "a\tb", canon: "X-Custom-Header"},
+		{name: "host", value: "example.com", err: ErrForbiddenHeader},
+		{name: "Content-Length", value: "1", err: ErrForbiddenHeader},
+		{name: "sec-websocket-key", value: "x", err: ErrForbiddenHeader},
+		{name: "", value: "x", err: ErrInvalidHeaderName},
+		{name: "Bad Name", value: "x", err: ErrInvalidHeaderName},
+		{name: "X-Injected", value: "a\r\nHost: evil", err: ErrInvalidHeaderValue},
+		{name: "X-Long", value: strings.Repeat("a", MaxHeaderValueLength+1), err: ErrHeaderValueTooLong},
+	}
+
+	for _, test := range tests {
+		canon, err := ValidateHeader(test.name, test.value)
+		if test.err != nil {
+			assert.ErrorIs(t, err, test.err, test.name)
+			continue
+		}
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.canon, canon)
+	}
+}
+
+func TestSanitizeHeaders(t *testing.T) {
+	sanitized, err := SanitizeHeaders(&protobufs.Headers{
+		Headers: []*protobufs.Header{{Key: "x-api-key", Value: "secret"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "X-Api-Key", sanitized.Headers[0].Key)
+
+	tooMany := &protobufs.Headers{}
+	for i := 0; i <= MaxHeaderCount; i++ {
+		tooMany.Headers = append(tooMany.Headers, &protobufs.Header{Key: "X-Header", Value: "v"})
+	}
+	_, err = SanitizeHeaders(tooMany)
+	assert.ErrorIs(t, err, ErrTooManyHeaders)
+
+	tooLarge := &protobufs.Headers{}
+	for i := 0; i < 3; i++ {
+		tooLarge.Headers = append(tooLarge.Headers, &protobufs.Header{
+			Key: "X-Header", Value: strings.Repeat("a", MaxHeaderValueLength),
+		})
+	}
+	_, err = SanitizeHeaders(tooLarge)
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	sanitized, err = SanitizeHeaders(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, sanitized)
+}
+
+func TestSanitizeConnectionSettingsOffers(t *testing.T) {
+	offers := &protobufs.ConnectionSettingsOffers{
+		Opamp: &protobufs.OpAMPConnectionSettings{
+			Headers: &protobufs.Headers{Headers: []*protobufs.Header{{Key: "authorization", Value: "x"}}},
+		},
+		OwnMetrics: &protobufs.TelemetryConnectionSettings{
+			Headers: &protobufs.Headers{Headers: []*protobufs.Header{{Key: "Host", Value: "evil"}}},
+		},
+		OtherConnections: map[string]*protobufs.OtherConnectionSettings{
+			"good": {DestinationEndpoint: "http://good"},
+			"bad": {
+				Headers: &protobufs.Headers{Headers: []*protobufs.Header{{Key: "Content-Length", Value: "0"}}},
+			},
+		},
+	}
+
+	invalid := map[string]error{}
+	SanitizeConnectionSettingsOffers(offers, func(offer string, err error) {
+		invalid[offer] = err
+	})
+
+	assert.Len(t, invalid, 2)
+	assert.ErrorIs(t, invalid["own_metrics"], ErrForbiddenHeader)
+	assert.ErrorIs(t, invalid["other_connections/bad"], ErrForbiddenHeader)
+
+	assert.Equal(t, "Authorization", offers.Opamp.Headers.Headers[0].Key)
+	assert.Nil(t, offers.OwnMetrics)
+	assert.Contains(t, offers.OtherConnections, "good")
+	assert.NotContains(t, offers.OtherConnections, "bad")
+}
+
+func TestValidateHTTPHeader(t *testing.T) {
+	assert.NoError(t, ValidateHTTPHeader(nil))
+	assert.NoError(t, ValidateHTTPHeader(http.Header{"Authorization": {"Bearer x"}}))
+	assert.ErrorIs(t, ValidateHTTPHeader(http.Header{"Host": {"x"}}), ErrForbiddenHeader)
+}
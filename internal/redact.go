@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RedactedText is the text that replaces the redacted secrets.
+const RedactedText = "[REDACTED]"
+
+// Headers whose values are always secret.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// Parts of header and query parameter names that indicate secret values.
+var sensitiveNameParts = []string{"auth", "token", "secret", "key", "password", "signature", "cookie", "session"}
+
+// IsSensitiveHeader returns true if the values of the header with the specified
+// name must not appear in logs.
+func IsSensitiveHeader(name string) bool {
+	if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+		return true
+	}
+	return IsSensitiveName(name)
+}
+
+// IsSensitiveName returns true if the values of the header or the query parameter
+// with the specified name must not appear in logs.
+func IsSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range sensitiveNameParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactURL returns the rawURL with the password and the values of the sensitive
+// query parameters replaced. Returns rawURL if it cannot be parsed.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	redacted := false
+	for name, values := range query {
+		if IsSensitiveName(name) {
+			for i := range values {
+				values[i] = RedactedText
+			}
+			redacted = true
+		}
+	}
+	if redacted {
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
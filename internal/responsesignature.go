@@ -0,0 +1,138 @@
+// Package internal contains the code shared by the client and the server.
+//
+// The response signature (see SignServerToAgent) is an opt-in extension of this
+// library, not part of the OpAMP specification, and does not interoperate with
+// other OpAMP implementations: the signature is carried in the ServerToAgent field
+// ResponseSignatureField, which only this library's client verifies, and only if
+// configured with the key. Only the instance_uid, remote_config,
+// connection_settings, packages_available, agent_identification and command fields
+// are covered. Any other field, e.g. flags, capabilities or error_response, and any
+// field added to ServerToAgent by later versions of the specification is not
+// protected by the signature.
+package internal
+
+import (
+	"crypto/ed25519"
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// ResponseSignatureField is the number of the ServerToAgent field that carries the
+// signature of the message, see SignServerToAgent. The field is an extension of
+// this library, it is not defined by the OpAMP specification and may collide with
+// a field of another implementation: the clients that do not verify the signatures
+// skip it as an unknown field.
+const ResponseSignatureField protowire.Number = 20000
+
+var (
+	ErrResponseSignatureMissing = errors.New("the message from the Server is not signed")
+	ErrResponseSignatureInvalid = errors.New("the signature of the message from the Server is invalid")
+)
+
+// signedFields returns the fields of the message that change the Agent that are
+// covered by the signature, deterministically marshaled, nil if the message has
+// none of them.
+func signedFields(msg *protobufs.ServerToAgent) ([]byte, error) {
+	if msg.RemoteConfig == nil && msg.ConnectionSettings == nil && msg.PackagesAvailable == nil &&
+		msg.AgentIdentification == nil && msg.Command == nil {
+		return nil, nil
+	}
+	// The instance uid binds the signature to the Agent the message is sent to.
+	return proto.MarshalOptions{Deterministic: true}.Marshal(&protobufs.ServerToAgent{
+		InstanceUid:         msg.InstanceUid,
+		RemoteConfig:        msg.RemoteConfig,
+		ConnectionSettings:  msg.ConnectionSettings,
+		PackagesAvailable:   msg.PackagesAvailable,
+		AgentIdentification: msg.AgentIdentification,
+		Command:             msg.Command,
+	})
+}
+
+// SignServerToAgent signs the fields of the message that change the Agent, i.e. the
+// instance uid, the remote config, the connection settings, the available
+// packages, the agent identification and the command, with the key. The other
+// fields are not signed and can be altered undetected. The detached signature
+// replaces the previous one in the ResponseSignatureField. Messages without these
+// fields are not signed. The message must not be modified after.
+func SignServerToAgent(msg *protobufs.ServerToAgent, key ed25519.PrivateKey) error {
+	data, err := signedFields(msg)
+	if err != nil || data == nil {
+		return err
+	}
+	unknown := withoutField(msg.ProtoReflect().GetUnknown(), ResponseSignatureField)
+	unknown = protowire.AppendTag(unknown, ResponseSignatureField, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, ed25519.Sign(key, data))
+	msg.ProtoReflect().SetUnknown(unknown)
+	return nil
+}
+
+// VerifyServerToAgent verifies the signature of the message made by
+// SignServerToAgent with the key. Returns ErrResponseSignatureMissing if the
+// message has fields that must be signed but no signature, and
+// ErrResponseSignatureInvalid if the signature does not match.
+func VerifyServerToAgent(msg *protobufs.ServerToAgent, key ed25519.PublicKey) error {
+	data, err := signedFields(msg)
+	if err != nil || data == nil {
+		return err
+	}
+	signature := fieldBytes(msg.ProtoReflect().GetUnknown(), ResponseSignatureField)
+	if signature == nil {
+		return ErrResponseSignatureMissing
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return ErrResponseSignatureInvalid
+	}
+	return nil
+}
+
+// fieldBytes returns the value of the last bytes field with the number in the
+// encoded fields, nil if there is none.
+func fieldBytes(fields []byte, number protowire.Number) []byte {
+	var value []byte
+	for len(fields) > 0 {
+		num, typ, n := protowire.ConsumeTag(fields)
+		if n < 0 {
+			return nil
+		}
+		fields = fields[n:]
+		if num == number && typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(fields)
+			if m < 0 {
+				return nil
+			}
+			value = v
+			fields = fields[m:]
+			continue
+		}
+		m := protowire.ConsumeFieldValue(num, typ, fields)
+		if m < 0 {
+			return nil
+		}
+		fields = fields[m:]
+	}
+	return value
+}
+
+// withoutField returns the encoded fields without the fields with the number.
+func withoutField(fields []byte, number protowire.Number) []byte {
+	var result []byte
+	for len(fields) > 0 {
+		num, typ, n := protowire.ConsumeTag(fields)
+		if n < 0 {
+			return result
+		}
+		m := protowire.ConsumeFieldValue(num, typ, fields[n:])
+		if m < 0 {
+			return result
+		}
+		if num != number {
+			result = append(result, fields[:n+m]...)
+		}
+		fields = fields[n+m:]
+	}
+	return result
+}
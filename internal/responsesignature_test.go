@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestSignServerToAgent(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	msg := &protobufs.ServerToAgent{
+		InstanceUid: "agent",
+		RemoteConfig: &protobufs.AgentRemoteConfig{
+			Config:     &protobufs.AgentConfigMap{ConfigMap: map[string]*protobufs.AgentConfigFile{"": {Body: []byte("a")}}},
+			ConfigHash: []byte{1},
+		},
+	}
+	assert.ErrorIs(t, VerifyServerToAgent(msg, publicKey), ErrResponseSignatureMissing)
+
+	// Signing again replaces the signature.
+	require.NoError(t, SignServerToAgent(msg, privateKey))
+	require.NoError(t, SignServerToAgent(msg, privateKey))
+
+	// The signature is verified on the received message.
+	data, err := proto.Marshal(msg)
+	require.NoError(t, err)
+	received := &protobufs.ServerToAgent{}
+	require.NoError(t, proto.Unmarshal(data, received))
+	assert.NoError(t, VerifyServerToAgent(received, publicKey))
+	assert.ErrorIs(t, VerifyServerToAgent(received, otherKey), ErrResponseSignatureInvalid)
+
+	// The signed fields cannot be changed, nor the message sent to another Agent.
+	tampered := proto.Clone(received).(*protobufs.ServerToAgent)
+	tampered.RemoteConfig.Config.ConfigMap[""].Body = []byte("b")
+	assert.ErrorIs(t, VerifyServerToAgent(tampered, publicKey), ErrResponseSignatureInvalid)
+	tampered = proto.Clone(received).(*protobufs.ServerToAgent)
+	tampered.InstanceUid = "other"
+	assert.ErrorIs(t, VerifyServerToAgent(tampered, publicKey), ErrResponseSignatureInvalid)
+
+	// The messages that do not change the Agent need no signature.
+	ack := &protobufs.ServerToAgent{InstanceUid: "agent", Flags: 1}
+	require.NoError(t, SignServerToAgent(ack, privateKey))
+	assert.Empty(t, ack.ProtoReflect().GetUnknown())
+	assert.NoError(t, VerifyServerToAgent(ack, publicKey))
+}
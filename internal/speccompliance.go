@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// The bits of the capabilities defined by the version of the specification that
+// the protobufs implement.
+var (
+	definedAgentCapabilities  = definedBits(protobufs.AgentCapabilities_name)
+	definedServerCapabilities = definedBits(protobufs.ServerCapabilities_name)
+)
+
+func definedBits(names map[int32]string) uint64 {
+	var bits uint64
+	for value := range names {
+		bits |= uint64(value)
+	}
+	return bits
+}
+
+// AgentToServerViolations returns the descriptions of the invariants of the OpAMP
+// specification that msg violates, none if msg is compliant. previous is the
+// message received before msg on the same connection, nil if msg is the first one
+// or if the transport does not keep the connection, i.e. plain HTTP.
+func AgentToServerViolations(msg, previous *protobufs.AgentToServer) []string {
+	var violations []string
+	if msg.InstanceUid == "" {
+		violations = append(violations, "instance_uid is not set")
+	}
+	if msg.Capabilities&uint64(protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus) == 0 {
+		violations = append(violations, "the ReportsStatus bit of capabilities is not set")
+	}
+	if undefined := msg.Capabilities &^ definedAgentCapabilities; undefined != 0 {
+		violations = append(violations, fmt.Sprintf("capabilities has undefined bits set: %#x", undefined))
+	}
+
+	if previous != nil {
+		if previous.AgentDisconnect != nil {
+			violations = append(violations, "the message follows the message with agent_disconnect")
+		} else if msg.InstanceUid == previous.InstanceUid && msg.SequenceNum != previous.SequenceNum+1 {
+			violations = append(violations, fmt.Sprintf(
+				"sequence_num %d does not follow the previous sequence_num %d", msg.SequenceNum, previous.SequenceNum,
+			))
+		}
+	}
+
+	for name, status := range msg.GetPackageStatuses().GetPackages() {
+		violations = append(violations, packageStatusViolations(name, status)...)
+	}
+	return violations
+}
+
+func packageStatusViolations(name string, status *protobufs.PackageStatus) []string {
+	var violations []string
+	if status.Name != name {
+		violations = append(violations, fmt.Sprintf("the name of package status %q is %q", name, status.Name))
+	}
+	switch status.Status {
+	case protobufs.PackageStatusEnum_PackageStatusEnum_Installed:
+		if status.ErrorMessage != "" {
+			violations = append(violations, fmt.Sprintf("error_message is set for installed package %q", name))
+		}
+	case protobufs.PackageStatusEnum_PackageStatusEnum_Installing:
+		if len(status.ServerOfferedHash) == 0 {
+			violations = append(violations, fmt.Sprintf("server_offered_hash is not set for installing package %q", name))
+		}
+		if status.ErrorMessage != "" {
+			violations = append(violations, fmt.Sprintf("error_message is set for installing package %q", name))
+		}
+	case protobufs.PackageStatusEnum_PackageStatusEnum_InstallFailed:
+		if len(status.ServerOfferedHash) == 0 {
+			violations = append(violations, fmt.Sprintf("server_offered_hash is not set for failed package %q", name))
+		}
+	}
+	return violations
+}
+
+// ServerToAgentViolations returns the descriptions of the invariants of the OpAMP
+// specification that msg violates, none if msg is compliant. instanceUid is the
+// instance uid of the Agent, first is true if msg is the first message the Agent
+// received from the Server.
+func ServerToAgentViolations(msg *protobufs.ServerToAgent, instanceUid string, first bool) []string {
+	var violations []string
+	if msg.InstanceUid != instanceUid {
+		violations = append(violations, fmt.Sprintf(
+			"instance_uid %q does not match the instance uid of the Agent %q", msg.InstanceUid, instanceUid,
+		))
+	}
+
+	if msg.ErrorResponse != nil {
+		if msg.RemoteConfig != nil || msg.ConnectionSettings != nil || msg.PackagesAvailable != nil ||
+			msg.Flags != 0 || msg.AgentIdentification != nil || msg.Command != nil {
+			violations = append(violations, "error_response is set together with other fields")
+		}
+	} else if first && msg.Capabilities == 0 {
+		violations = append(violations, "capabilities is not set in the first message")
+	}
+	if msg.Capabilities != 0 {
+		if msg.Capabilities&uint64(protobufs.ServerCapabilities_ServerCapabilities_AcceptsStatus) == 0 {
+			violations = append(violations, "the AcceptsStatus bit of capabilities is not set")
+		}
+		if undefined := msg.Capabilities &^ definedServerCapabilities; undefined != 0 {
+			violations = append(violations, fmt.Sprintf("capabilities has undefined bits set: %#x", undefined))
+		}
+	}
+
+	if opamp := msg.GetConnectionSettings().GetOpamp(); opamp != nil {
+		if err := checkEndpoint(opamp.DestinationEndpoint, false, "ws", "wss", "http", "https"); err != nil {
+			violations = append(violations, fmt.Sprintf("the destination_endpoint of opamp %v", err))
+		}
+	}
+	telemetry := map[string]*protobufs.TelemetryConnectionSettings{
+		"own_metrics": msg.GetConnectionSettings().GetOwnMetrics(),
+		"own_traces":  msg.GetConnectionSettings().GetOwnTraces(),
+		"own_logs":    msg.GetConnectionSettings().GetOwnLogs(),
+	}
+	for _, offer := range []string{"own_metrics", "own_traces", "own_logs"} {
+		if settings := telemetry[offer]; settings != nil {
+			if err := checkEndpoint(settings.DestinationEndpoint, true, "http", "https"); err != nil {
+				violations = append(violations, fmt.Sprintf("the destination_endpoint of %s %v", offer, err))
+			}
+		}
+	}
+	return violations
+}
+
+// checkEndpoint returns an error if endpoint is not a URL with one of the schemes,
+// and with a path if withPath is true. The credentials in the endpoint are redacted
+// in the error.
+func checkEndpoint(endpoint string, withPath bool, schemes ...string) error {
+	if endpoint == "" {
+		return errors.New("is not set")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.New("is not a URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", RedactURL(endpoint))
+	}
+	if withPath && (u.Path == "" || u.Path == "/") {
+		return fmt.Errorf("%q has no path", RedactURL(endpoint))
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q has unexpected scheme %q", RedactURL(endpoint), u.Scheme)
+}
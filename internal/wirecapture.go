@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// WireDirection is the direction of a captured message.
+type WireDirection uint8
+
+const (
+	WireAgentToServer WireDirection = 1
+	WireServerToAgent WireDirection = 2
+)
+
+// WireTransport is the transport that carried a captured message.
+type WireTransport uint8
+
+const (
+	WireWebSocket WireTransport = 1
+	WirePlainHTTP WireTransport = 2
+)
+
+// WireRedacted is set in the flags of a record if the credentials of the message
+// were redacted, i.e. the frame is not the one that was sent.
+const WireRedacted uint8 = 1
+
+// The size of the fields of a record that follow the record length: direction,
+// transport, flags and timestamp.
+const wireRecordHeaderSize = 1 + 1 + 1 + 8
+
+// ErrorLogger logs the errors of writing the capture.
+type ErrorLogger interface {
+	Errorf(format string, v ...interface{})
+}
+
+// WireRecord is a message read from a wire capture, see ReadWireRecord.
+type WireRecord struct {
+	Direction WireDirection
+	Transport WireTransport
+	Flags     uint8
+	Time      time.Time
+	// The payload of the WebSocket message, including the header, or the body of
+	// the plain HTTP request or response, after decompression.
+	Frame []byte
+}
+
+// WireCapture writes the frames of the OpAMP messages sent and received over the
+// connections to a writer, one record per message in the format described by the
+// WireCapture field of the client's StartSettings. The frames of the messages that
+// carry credentials are re-encoded with the credentials redacted after decoding.
+// Safe for concurrent use, the records are never interleaved. If writing fails the
+// error is logged and the capture stops. A nil WireCapture captures nothing.
+type WireCapture struct {
+	mux    sync.Mutex
+	w      io.Writer
+	logger ErrorLogger
+	now    func() time.Time
+}
+
+// NewWireCapture creates a new WireCapture that writes to w. Returns nil if w is nil.
+func NewWireCapture(w io.Writer, logger ErrorLogger) *WireCapture {
+	if w == nil {
+		return nil
+	}
+	return &WireCapture{w: w, logger: logger, now: time.Now}
+}
+
+// Capture records the frame of a message. msg is the message decoded from the frame
+// or encoded to it, nil if the frame cannot be decoded.
+func (c *WireCapture) Capture(direction WireDirection, transport WireTransport, frame []byte, msg proto.Message) {
+	if c == nil {
+		return
+	}
+
+	var flags uint8
+	if redacted := redactedMessage(msg); redacted != nil {
+		data, err := proto.Marshal(redacted)
+		if err != nil {
+			// Never write the credentials.
+			return
+		}
+		var header []byte
+		if transport == WireWebSocket {
+			header = frame[:wsHeaderSize(frame)]
+		}
+		frame = append(append([]byte(nil), header...), data...)
+		flags |= WireRedacted
+	}
+
+	record := make([]byte, 4+wireRecordHeaderSize, 4+wireRecordHeaderSize+len(frame))
+	binary.BigEndian.PutUint32(record, uint32(wireRecordHeaderSize+len(frame)))
+	record[4] = byte(direction)
+	record[5] = byte(transport)
+	record[6] = flags
+	binary.BigEndian.PutUint64(record[7:], uint64(c.now().UnixNano()))
+	record = append(record, frame...)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.w == nil {
+		return
+	}
+	if _, err := c.w.Write(record); err != nil {
+		c.logger.Errorf("Cannot write the wire capture, the capture is stopped: %v", err)
+		c.w = nil
+	}
+}
+
+// CaptureWSData records a WebSocket message that carries the marshaled Protobuf
+// message data, see WriteWSMessageBytes.
+func (c *WireCapture) CaptureWSData(direction WireDirection, data []byte, msg proto.Message) {
+	if c == nil {
+		return
+	}
+	var hdrBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdrBuf[:], wsMsgHeader)
+	c.Capture(direction, WireWebSocket, append(hdrBuf[:n:n], data...), msg)
+}
+
+// ReadWireRecord reads the next record written by WireCapture. Returns io.EOF if
+// there are no more records.
+func ReadWireRecord(r io.Reader) (WireRecord, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return WireRecord{}, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size < wireRecordHeaderSize {
+		return WireRecord{}, fmt.Errorf("invalid wire capture record length %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return WireRecord{}, err
+	}
+	return WireRecord{
+		Direction: WireDirection(data[0]),
+		Transport: WireTransport(data[1]),
+		Flags:     data[2],
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(data[3:]))),
+		Frame:     data[wireRecordHeaderSize:],
+	}, nil
+}
+
+// wsHeaderSize returns the size of the header of the WebSocket message, 0 if the
+// message has none, see DecodeWSMessage.
+func wsHeaderSize(frame []byte) int {
+	if len(frame) == 0 || frame[0] != 0 {
+		return 0
+	}
+	_, n := binary.Uvarint(frame)
+	if n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// redactedMessage returns a copy of the message with the credentials it carries
+// redacted, nil if it carries none.
+func redactedMessage(msg proto.Message) proto.Message {
+	m, ok := msg.(*protobufs.ServerToAgent)
+	if !ok || (m.ConnectionSettings == nil && m.PackagesAvailable == nil) {
+		return nil
+	}
+	redacted := proto.Clone(m).(*protobufs.ServerToAgent)
+	if offers := redacted.ConnectionSettings; offers != nil {
+		if offers.Opamp != nil {
+			offers.Opamp.DestinationEndpoint = RedactURL(offers.Opamp.DestinationEndpoint)
+			redactHeaders(offers.Opamp.Headers)
+			redactCertificate(offers.Opamp.Certificate)
+		}
+		for _, settings := range []*protobufs.TelemetryConnectionSettings{
+			offers.OwnMetrics, offers.OwnTraces, offers.OwnLogs,
+		} {
+			if settings != nil {
+				settings.DestinationEndpoint = RedactURL(settings.DestinationEndpoint)
+				redactHeaders(settings.Headers)
+				redactCertificate(settings.Certificate)
+			}
+		}
+		for _, settings := range offers.OtherConnections {
+			if settings != nil {
+				settings.DestinationEndpoint = RedactURL(settings.DestinationEndpoint)
+				redactHeaders(settings.Headers)
+				redactCertificate(settings.Certificate)
+			}
+		}
+	}
+	if available := redacted.PackagesAvailable; available != nil {
+		for _, pkg := range available.Packages {
+			if pkg != nil && pkg.File != nil {
+				pkg.File.DownloadUrl = RedactURL(pkg.File.DownloadUrl)
+			}
+		}
+	}
+	if proto.Equal(redacted, m) {
+		return nil
+	}
+	return redacted
+}
+
+func redactHeaders(headers *protobufs.Headers) {
+	if headers == nil {
+		return
+	}
+	for _, header := range headers.Headers {
+		if header != nil && IsSensitiveHeader(header.Key) {
+			header.Value = RedactedText
+		}
+	}
+}
+
+func redactCertificate(certificate *protobufs.TLSCertificate) {
+	if certificate != nil && len(certificate.PrivateKey) > 0 {
+		certificate.PrivateKey = []byte(RedactedText)
+	}
+}
@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"compress/flate"
 	"encoding/binary"
 	"errors"
+	"fmt"
 
 	"github.com/gorilla/websocket"
 	"google.golang.org/protobuf/proto"
@@ -11,6 +13,72 @@ import (
 // Message header is currently uint64 zero value.
 const wsMsgHeader = uint64(0)
 
+// WSMessageSize returns the size of the WebSocket message that carries the
+// marshaled Protobuf message, including the header.
+func WSMessageSize(data []byte) int {
+	var hdrBuf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(hdrBuf[:], wsMsgHeader) + len(data)
+}
+
+// The compression level gorilla/websocket uses by default.
+const defaultWSCompressionLevel = 1
+
+// The tail of the flushed deflate block that the permessage-deflate extension
+// removes from the compressed messages, see RFC 7692.
+const deflateTailSize = 4
+
+// WSMessageDeflater calculates the size of the WebSocket messages compressed by the
+// permessage-deflate extension. Not safe for concurrent use.
+type WSMessageDeflater struct {
+	writer *flate.Writer
+	size   byteCounter
+}
+
+// NewWSMessageDeflater creates a new WSMessageDeflater for the compression level,
+// which must be valid, see ValidateCompressionLevel.
+func NewWSMessageDeflater(level int) *WSMessageDeflater {
+	if level == 0 {
+		level = defaultWSCompressionLevel
+	}
+	d := &WSMessageDeflater{}
+	// The level is valid, flate.NewWriter cannot fail.
+	d.writer, _ = flate.NewWriter(&d.size, level)
+	return d
+}
+
+// DeflatedSize returns the size of the compressed payload of the WebSocket message
+// that carries the marshaled Protobuf message, including the header.
+func (d *WSMessageDeflater) DeflatedSize(data []byte) int {
+	d.size = 0
+	d.writer.Reset(&d.size)
+
+	var hdrBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdrBuf[:], wsMsgHeader)
+	// Writes to byteCounter cannot fail.
+	_, _ = d.writer.Write(hdrBuf[:n])
+	_, _ = d.writer.Write(data)
+	_ = d.writer.Flush()
+	return int(d.size) - deflateTailSize
+}
+
+// byteCounter is an io.Writer that counts the written bytes.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// ValidateCompressionLevel returns an error if level is not a valid compression level
+// of the WebSocket messages. 0 is valid and means the default level.
+func ValidateCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("invalid CompressionLevel %d, must be between %d and %d",
+			level, flate.HuffmanOnly, flate.BestCompression)
+	}
+	return nil
+}
+
 func DecodeWSMessage(bytes []byte, msg proto.Message) error {
 	// Message header is optional until the end of grace period that ends Feb 1, 2023.
 	// Check if the header is present.
@@ -40,7 +108,13 @@ func WriteWSMessage(conn *websocket.Conn, msg proto.Message) error {
 	if err != nil {
 		return err
 	}
+	return WriteWSMessageBytes(conn, data)
+}
 
+// WriteWSMessageBytes writes the marshaled Protobuf message preceded by the message
+// header, see WSMessageSize. The message may be passed in several parts, which are
+// written one after the other without being copied.
+func WriteWSMessageBytes(conn *websocket.Conn, data ...[]byte) error {
 	writer, err := conn.NextWriter(websocket.BinaryMessage)
 	if err != nil {
 		return err
@@ -59,10 +133,11 @@ func WriteWSMessage(conn *websocket.Conn, msg proto.Message) error {
 	}
 
 	// Write the encoded data.
-	_, err = writer.Write(data)
-	if err != nil {
-		writer.Close()
-		return err
+	for _, part := range data {
+		if _, err = writer.Write(part); err != nil {
+			writer.Close()
+			return err
+		}
 	}
 
 	return writer.Close()
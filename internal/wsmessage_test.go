@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingConn counts the bytes written to the connection.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func TestWSMessageDeflaterDeflatedSize(t *testing.T) {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	for _, level := range []int{0, 9} {
+		var counting *countingConn
+		dialer := websocket.Dialer{
+			EnableCompression: true,
+			NetDial: func(network, addr string) (net.Conn, error) {
+				conn, err := net.Dial(network, addr)
+				counting = &countingConn{Conn: conn}
+				return counting, err
+			},
+		}
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		require.NoError(t, err)
+		if level != 0 {
+			require.NoError(t, conn.SetCompressionLevel(level))
+		}
+
+		data := []byte(strings.Repeat("compressible", 1000))
+		before := atomic.LoadInt64(&counting.written)
+		require.NoError(t, WriteWSMessageBytes(conn, data))
+		written := atomic.LoadInt64(&counting.written) - before
+
+		// The frame of a small payload has a 2 byte header and a 4 byte mask.
+		size := NewWSMessageDeflater(level).DeflatedSize(data)
+		assert.Less(t, size, 126)
+		assert.EqualValues(t, written-6, size, "level %d", level)
+		assert.Equal(t, len(data)+1, WSMessageSize(data))
+
+		_ = conn.Close()
+	}
+}
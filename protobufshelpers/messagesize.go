@@ -0,0 +1,54 @@
+package protobufshelpers
+
+import (
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// FieldSize is the serialized size of a top-level field of a Protobuf message.
+type FieldSize struct {
+	// Field is the name of the field as defined in the .proto file, e.g.
+	// "effective_config".
+	Field string
+	// Size is the number of bytes the field takes in the serialized message,
+	// including the tag and the length prefix.
+	Size int
+}
+
+// MessageSize describes the serialized size of a Protobuf message.
+type MessageSize struct {
+	// Total size of the serialized message in bytes.
+	Total int
+	// Fields are the sizes of the fields that are set in the message, the largest
+	// first. The sizes add up to Total.
+	Fields []FieldSize
+}
+
+// MessageSizeOf returns the serialized size of msg broken down by its top-level
+// fields. Use it on AgentToServer messages to find which fields (e.g. the effective
+// config, the agent description or the package statuses) take most of the bandwidth.
+func MessageSizeOf(msg proto.Message) MessageSize {
+	result := MessageSize{Total: proto.Size(msg)}
+
+	m := msg.ProtoReflect()
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		// Measure a message that has only this field set.
+		single := m.New()
+		single.Set(fd, v)
+		result.Fields = append(result.Fields, FieldSize{
+			Field: string(fd.Name()),
+			Size:  proto.Size(single.Interface()),
+		})
+		return true
+	})
+
+	sort.Slice(result.Fields, func(i, j int) bool {
+		if result.Fields[i].Size != result.Fields[j].Size {
+			return result.Fields[i].Size > result.Fields[j].Size
+		}
+		return result.Fields[i].Field < result.Fields[j].Field
+	})
+	return result
+}
@@ -0,0 +1,45 @@
+package protobufshelpers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestMessageSizeOf(t *testing.T) {
+	msg := &protobufs.AgentToServer{
+		InstanceUid: "01ARZ3NDEKTSV4RRFFQ69G5FAV",
+		SequenceNum: 3,
+		AgentDescription: &protobufs.AgentDescription{
+			IdentifyingAttributes: []*protobufs.KeyValue{
+				{Key: "service.name", Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: "agent"}}},
+			},
+		},
+		EffectiveConfig: &protobufs.EffectiveConfig{
+			ConfigMap: &protobufs.AgentConfigMap{ConfigMap: map[string]*protobufs.AgentConfigFile{
+				"": {Body: []byte(strings.Repeat("receivers: {}\n", 100))},
+			}},
+		},
+	}
+
+	size := MessageSizeOf(msg)
+	fields := []string{}
+	sum := 0
+	for _, field := range size.Fields {
+		fields = append(fields, field.Field)
+		sum += field.Size
+	}
+	assert.EqualValues(t, []string{"effective_config", "instance_uid", "agent_description", "sequence_num"}, fields)
+	assert.Greater(t, size.Fields[0].Size, 1400)
+	assert.EqualValues(t, 2, size.Fields[3].Size)
+	assert.EqualValues(t, size.Total, sum)
+}
+
+func TestMessageSizeOfEmpty(t *testing.T) {
+	size := MessageSizeOf(&protobufs.AgentToServer{})
+	assert.EqualValues(t, 0, size.Total)
+	assert.Empty(t, size.Fields)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// ackBatcher batches the empty acks sent to the Agent on a WebSocket connection, see
+// Settings.AckBatchWindow. At most one empty ack is sent per window: the ones that
+// follow a message sent less than a window ago are replaced with a single ack sent
+// at the end of the window, unless another message is sent before. A nil
+// ackBatcher batches nothing.
+type ackBatcher struct {
+	window time.Duration
+
+	mux sync.Mutex
+	// The time the last message was sent to the Agent.
+	lastSent time.Time
+	// The timer of the deferred ack, nil if no ack is deferred.
+	timer *time.Timer
+	// Incremented when the deferred ack is cancelled, so that a timer that already
+	// fired does not send it.
+	generation uint64
+	closed     bool
+}
+
+func newAckBatcher(window time.Duration) *ackBatcher {
+	if window <= 0 {
+		return nil
+	}
+	return &ackBatcher{window: window}
+}
+
+// deferAck returns true if the empty ack must not be sent now. sendAck is called
+// at the end of the window unless a message is sent before.
+func (b *ackBatcher) deferAck(sendAck func()) bool {
+	if b == nil {
+		return false
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.timer != nil {
+		// The deferred ack acknowledges this message too.
+		return true
+	}
+	wait := b.window - time.Since(b.lastSent)
+	if wait <= 0 || b.closed {
+		return false
+	}
+	generation := b.generation
+	b.timer = time.AfterFunc(wait, func() {
+		b.mux.Lock()
+		if b.generation != generation || b.closed {
+			b.mux.Unlock()
+			return
+		}
+		b.timer = nil
+		b.mux.Unlock()
+		sendAck()
+	})
+	return true
+}
+
+// sent records that a message was sent to the Agent, which makes the deferred ack
+// unnecessary.
+func (b *ackBatcher) sent() {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.lastSent = time.Now()
+	b.cancel()
+}
+
+// close cancels the deferred ack when the connection is closed.
+func (b *ackBatcher) close() {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.closed = true
+	b.cancel()
+}
+
+// cancel cancels the deferred ack. Must be called with mux locked.
+func (b *ackBatcher) cancel() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+		b.generation++
+	}
+}
+
+// isEmptyAck returns true if the response only acknowledges the message of the
+// Agent, i.e. has no field other than the instance uid set.
+func isEmptyAck(response *protobufs.ServerToAgent) bool {
+	empty := true
+	response.ProtoReflect().Range(func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		if field.Name() != "instance_uid" {
+			empty = false
+		}
+		return empty
+	})
+	return empty
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestIsEmptyAck(t *testing.T) {
+	assert.True(t, isEmptyAck(&protobufs.ServerToAgent{}))
+	assert.True(t, isEmptyAck(&protobufs.ServerToAgent{InstanceUid: "agent"}))
+	assert.False(t, isEmptyAck(&protobufs.ServerToAgent{InstanceUid: "agent", Flags: 1}))
+	assert.False(t, isEmptyAck(&protobufs.ServerToAgent{RemoteConfig: &protobufs.AgentRemoteConfig{}}))
+}
+
+func TestAckBatcherDisabled(t *testing.T) {
+	acks := newAckBatcher(0)
+	assert.Nil(t, acks)
+	acks.sent()
+	assert.False(t, acks.deferAck(func() { t.Fatal("unexpected ack") }))
+	acks.close()
+}
+
+func TestAckBatcherDefersAcksWithinWindow(t *testing.T) {
+	acks := newAckBatcher(50 * time.Millisecond)
+	var sentAcks int64
+	sendAck := func() { atomic.AddInt64(&sentAcks, 1) }
+
+	// Nothing was sent yet, the ack is sent right away.
+	assert.False(t, acks.deferAck(sendAck))
+	acks.sent()
+
+	// The acks that follow are replaced with one at the end of the window.
+	assert.True(t, acks.deferAck(sendAck))
+	assert.True(t, acks.deferAck(sendAck))
+	eventually(t, func() bool { return atomic.LoadInt64(&sentAcks) == 1 })
+
+	// The window passed since the last message, the ack is sent right away.
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, acks.deferAck(sendAck))
+	assert.EqualValues(t, 1, atomic.LoadInt64(&sentAcks))
+}
+
+func TestAckBatcherDropsAckWhenMessageSent(t *testing.T) {
+	acks := newAckBatcher(20 * time.Millisecond)
+	var sentAcks int64
+	sendAck := func() { atomic.AddInt64(&sentAcks, 1) }
+
+	acks.sent()
+	assert.True(t, acks.deferAck(sendAck))
+	// Another message acknowledges the Agent's message.
+	acks.sent()
+
+	assert.True(t, acks.deferAck(sendAck))
+	// The connection is closed before the end of the window.
+	acks.close()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 0, atomic.LoadInt64(&sentAcks))
+}
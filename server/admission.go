@@ -0,0 +1,207 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+var (
+	// ErrAgentNotAllowed is returned by AdmissionFilter.Admit if the allow list
+	// is not empty and the Agent does not match any of its rules.
+	ErrAgentNotAllowed = errors.New("agent does not match the allow list")
+
+	// ErrAgentDenied is returned by AdmissionFilter.Admit if the Agent matches
+	// a rule of the deny list.
+	ErrAgentDenied = errors.New("agent matches the deny list")
+)
+
+// AdmissionRule matches Agents by the attributes of their AgentDescription.
+// An Agent matches the rule if it matches all the non-empty fields of the rule.
+type AdmissionRule struct {
+	// ServiceName matches the service.name identifying attribute.
+	ServiceName string `json:"service_name,omitempty"`
+
+	// MinVersion and MaxVersion define the range of the service.version identifying
+	// attribute, MinVersion is inclusive, MaxVersion is exclusive. Versions are
+	// compared as dot-separated numbers, e.g. "1.10.0" > "1.9.2", an optional "v"
+	// prefix is ignored and a pre-release (e.g. "1.0.0-rc1") is lower than the release.
+	MinVersion string `json:"min_version,omitempty"`
+	MaxVersion string `json:"max_version,omitempty"`
+
+	// Attributes match the identifying or the non-identifying attributes with
+	// the string values, e.g. {"deployment.environment": "staging"}.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// AdmissionRules are the allow and deny lists of an AdmissionFilter.
+type AdmissionRules struct {
+	// If not empty, the Agent is admitted only if it matches at least one of the rules.
+	Allow []AdmissionRule `json:"allow,omitempty"`
+
+	// The Agent is refused if it matches any of the rules. Deny takes precedence
+	// over Allow.
+	Deny []AdmissionRule `json:"deny,omitempty"`
+}
+
+// AdmissionFilter admits Agents based on allow and deny lists of AdmissionRules.
+// The rules can be replaced at any time using SetRules, e.g. when the configuration
+// file is changed. Set AdmissionFilter.Admit as Settings.AgentPolicy to use it.
+//
+// The filter remembers the last AgentDescription and the verdict of every Agent it
+// checked, so that the Agents that omit the unchanged description are still checked
+// and the Agents already admitted are re-evaluated when the rules change. Call
+// Forget when an Agent is removed.
+type AdmissionFilter struct {
+	mux    sync.Mutex
+	rules  AdmissionRules
+	agents map[string]*admissionEntry
+}
+
+type admissionEntry struct {
+	descr   *protobufs.AgentDescription
+	verdict error
+}
+
+// NewAdmissionFilter creates a new AdmissionFilter with the specified rules.
+func NewAdmissionFilter(rules AdmissionRules) *AdmissionFilter {
+	return &AdmissionFilter{rules: rules, agents: map[string]*admissionEntry{}}
+}
+
+// SetRules replaces the rules of the filter and re-evaluates the known Agents. Can be
+// called concurrently with Admit. Returns the known Agents that are refused by the
+// new rules, keyed by instance uid, so that the caller can disconnect them.
+func (f *AdmissionFilter) SetRules(rules AdmissionRules) (refused map[string]error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.rules = rules
+	refused = map[string]error{}
+	for instanceUid, entry := range f.agents {
+		entry.verdict = rules.check(entry.descr)
+		if entry.verdict != nil {
+			refused[instanceUid] = entry.verdict
+		}
+	}
+	return refused
+}
+
+// Rules returns the current rules of the filter.
+func (f *AdmissionFilter) Rules() AdmissionRules {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.rules
+}
+
+// Forget removes the remembered description and verdict of the Agent.
+func (f *AdmissionFilter) Forget(instanceUid string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.agents, instanceUid)
+}
+
+// Admit is an AgentPolicy that checks the Agent against the rules. If the message
+// has no AgentDescription the verdict for the last description of the Agent is
+// returned. Agents whose description was never seen are admitted, the Server asks
+// them to report it (see Settings.AgentPolicy).
+func (f *AdmissionFilter) Admit(message *protobufs.AgentToServer) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	entry := f.agents[message.InstanceUid]
+	descr := message.AgentDescription
+	if descr == nil {
+		if entry == nil {
+			return nil
+		}
+		return entry.verdict
+	}
+
+	if entry == nil || entry.descr != descr {
+		entry = &admissionEntry{descr: descr, verdict: f.rules.check(descr)}
+		f.agents[message.InstanceUid] = entry
+	}
+	return entry.verdict
+}
+
+// check returns the reason why the Agent with the description is refused, nil if
+// it is admitted.
+func (rules AdmissionRules) check(descr *protobufs.AgentDescription) error {
+	for _, rule := range rules.Deny {
+		if rule.matches(descr) {
+			return fmt.Errorf("%w: %s", ErrAgentDenied, rule)
+		}
+	}
+
+	if len(rules.Allow) == 0 {
+		return nil
+	}
+	for _, rule := range rules.Allow {
+		if rule.matches(descr) {
+			return nil
+		}
+	}
+	return ErrAgentNotAllowed
+}
+
+func (r AdmissionRule) matches(descr *protobufs.AgentDescription) bool {
+	if r.ServiceName != "" {
+		name, _ := identifyingAttribute(descr, agentTypeAttributeKey)
+		if name != r.ServiceName {
+			return false
+		}
+	}
+
+	if r.MinVersion != "" || r.MaxVersion != "" {
+		version, ok := identifyingAttribute(descr, agentVersionAttributeKey)
+		if !ok {
+			return false
+		}
+		if r.MinVersion != "" && CompareVersions(version, r.MinVersion) < 0 {
+			return false
+		}
+		if r.MaxVersion != "" && CompareVersions(version, r.MaxVersion) >= 0 {
+			return false
+		}
+	}
+
+	for key, value := range r.Attributes {
+		actual, ok := identifyingAttribute(descr, key)
+		if !ok {
+			actual, ok = nonIdentifyingAttribute(descr, key)
+		}
+		if !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (r AdmissionRule) String() string {
+	var parts []string
+	if r.ServiceName != "" {
+		parts = append(parts, "service_name="+r.ServiceName)
+	}
+	if r.MinVersion != "" {
+		parts = append(parts, "min_version="+r.MinVersion)
+	}
+	if r.MaxVersion != "" {
+		parts = append(parts, "max_version="+r.MaxVersion)
+	}
+	if len(r.Attributes) > 0 {
+		parts = append(parts, fmt.Sprintf("attributes=%v", r.Attributes))
+	}
+	return strings.Join(parts, " ")
+}
+
+func nonIdentifyingAttribute(descr *protobufs.AgentDescription, key string) (string, bool) {
+	for _, attr := range descr.GetNonIdentifyingAttributes() {
+		if attr.Key == key {
+			return attr.GetValue().GetStringValue(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func withEnvironment(msg *protobufs.AgentToServer, env string) *protobufs.AgentToServer {
+	msg.AgentDescription.NonIdentifyingAttributes = append(msg.AgentDescription.NonIdentifyingAttributes,
+		&protobufs.KeyValue{
+			Key:   "deployment.environment",
+			Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: env}},
+		})
+	return msg
+}
+
+func TestAdmissionFilter(t *testing.T) {
+	filter := NewAdmissionFilter(AdmissionRules{
+		Allow: []AdmissionRule{{Attributes: map[string]string{"deployment.environment": "staging"}}},
+		Deny:  []AdmissionRule{{ServiceName: "collector", MaxVersion: "0.60.0"}},
+	})
+
+	assert.NoError(t, filter.Admit(withEnvironment(agentMessage(0, "collector", "0.60.0"), "staging")))
+	assert.NoError(t, filter.Admit(withEnvironment(agentMessage(0, "other", "0.1.0"), "staging")))
+	assert.ErrorIs(t, filter.Admit(withEnvironment(agentMessage(0, "collector", "0.59.1"), "staging")), ErrAgentDenied)
+	assert.ErrorIs(t, filter.Admit(withEnvironment(agentMessage(0, "collector", "0.61.0"), "production")), ErrAgentNotAllowed)
+	assert.ErrorIs(t, filter.Admit(agentMessage(0, "collector", "0.61.0")), ErrAgentNotAllowed)
+
+	// Agents whose description was never seen are admitted.
+	assert.NoError(t, filter.Admit(&protobufs.AgentToServer{InstanceUid: "unknown"}))
+
+	// Replace the rules.
+	filter.SetRules(AdmissionRules{})
+	assert.NoError(t, filter.Admit(withEnvironment(agentMessage(0, "collector", "0.59.1"), "production")))
+}
+
+func TestAdmissionFilterRemembersAgents(t *testing.T) {
+	filter := NewAdmissionFilter(AdmissionRules{
+		Deny: []AdmissionRule{{ServiceName: "collector", MaxVersion: "0.60.0"}},
+	})
+
+	denied := agentMessage(0, "collector", "0.59.1")
+	denied.InstanceUid = "denied"
+	admitted := agentMessage(0, "collector", "0.61.0")
+	admitted.InstanceUid = "admitted"
+	assert.ErrorIs(t, filter.Admit(denied), ErrAgentDenied)
+	assert.NoError(t, filter.Admit(admitted))
+
+	// The Agents omit the unchanged description in the next messages.
+	assert.ErrorIs(t, filter.Admit(&protobufs.AgentToServer{InstanceUid: "denied"}), ErrAgentDenied)
+	assert.NoError(t, filter.Admit(&protobufs.AgentToServer{InstanceUid: "admitted"}))
+
+	// The known Agents are re-evaluated when the rules change.
+	refused := filter.SetRules(AdmissionRules{
+		Deny: []AdmissionRule{{ServiceName: "collector", MinVersion: "0.61.0"}},
+	})
+	assert.Len(t, refused, 1)
+	assert.ErrorIs(t, refused["admitted"], ErrAgentDenied)
+	assert.ErrorIs(t, filter.Admit(&protobufs.AgentToServer{InstanceUid: "admitted"}), ErrAgentDenied)
+	assert.NoError(t, filter.Admit(&protobufs.AgentToServer{InstanceUid: "denied"}))
+
+	// Forgotten Agents are unknown again.
+	filter.Forget("admitted")
+	assert.NoError(t, filter.Admit(&protobufs.AgentToServer{InstanceUid: "admitted"}))
+}
+
+func TestAdmissionRuleVersionRange(t *testing.T) {
+	rule := AdmissionRule{MinVersion: "1.2.0", MaxVersion: "v2.0"}
+
+	tests := []struct {
+		version string
+		matches bool
+	}{
+		{"1.1.9", false},
+		{"1.2.0-rc1", false},
+		{"1.2.0", true},
+		{"1.10.0", true},
+		{"v1.99.99+build5", true},
+		{"2.0.0-beta", true},
+		{"2.0.0", false},
+		{"10.0", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.matches, rule.matches(agentMessage(0, "a", test.version).AgentDescription), test.version)
+	}
+}
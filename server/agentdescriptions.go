@@ -0,0 +1,56 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// How long the Server remembers the AgentDescription of a plain HTTP Agent that
+// stopped sending requests.
+const agentDescriptionTTL = time.Hour
+
+// agentDescriptions remembers the last AgentDescription reported by each plain HTTP
+// Agent. The Agents send the description only when it changes, but AgentPolicy must
+// see it on every request.
+type agentDescriptions struct {
+	mux       sync.Mutex
+	entries   map[string]*rememberedDescription
+	lastPrune time.Time
+}
+
+type rememberedDescription struct {
+	descr    *protobufs.AgentDescription
+	lastSeen time.Time
+}
+
+// update remembers the AgentDescription of the message if it has one. Returns the
+// last known description of the Agent, nil if it is not known.
+func (d *agentDescriptions) update(message *protobufs.AgentToServer, now time.Time) *protobufs.AgentDescription {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.entries == nil {
+		d.entries = map[string]*rememberedDescription{}
+	}
+	if now.Sub(d.lastPrune) > agentDescriptionTTL {
+		for instanceUid, entry := range d.entries {
+			if now.Sub(entry.lastSeen) > agentDescriptionTTL {
+				delete(d.entries, instanceUid)
+			}
+		}
+		d.lastPrune = now
+	}
+
+	entry := d.entries[message.InstanceUid]
+	if message.AgentDescription != nil {
+		entry = &rememberedDescription{descr: message.AgentDescription}
+		d.entries[message.InstanceUid] = entry
+	}
+	if entry == nil {
+		return nil
+	}
+	entry.lastSeen = now
+	return entry.descr
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+// agentInfo is what the Server knows about the Agent on a connection, passed to
+// Settings.BeforeSend.
+type agentInfo struct {
+	beforeSend func(message *protobufs.ServerToAgent, target MessageTarget)
+	signingKey ed25519.PrivateKey
+
+	mux              sync.Mutex
+	instanceUid      string
+	agentDescription *protobufs.AgentDescription
+}
+
+func newAgentInfo(settings Settings) *agentInfo {
+	return &agentInfo{beforeSend: settings.BeforeSend, signingKey: settings.ResponseSigningKey}
+}
+
+// update remembers the instance uid and the AgentDescription of the message. The
+// Agents send the description only when it changes, agentDescription is the last
+// known description.
+func (a *agentInfo) update(request *protobufs.AgentToServer, agentDescription *protobufs.AgentDescription) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.instanceUid = request.InstanceUid
+	a.agentDescription = agentDescription
+}
+
+// currentInstanceUid returns the instance uid of the Agent, empty if no message was
+// received yet.
+func (a *agentInfo) currentInstanceUid() string {
+	if a == nil {
+		return ""
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.instanceUid
+}
+
+// modifiesMessages returns true if the messages are modified by BeforeSend or
+// signed for the Agent.
+func (a *agentInfo) modifiesMessages() bool {
+	return a != nil && (a.beforeSend != nil || a.signingKey != nil)
+}
+
+// prepare returns the message to send to the Agent on the conn: a copy of the
+// message modified by BeforeSend if it is set, a copy of the message if it is
+// signed, the message as is otherwise.
+func (a *agentInfo) prepare(conn types.Connection, message *protobufs.ServerToAgent) *protobufs.ServerToAgent {
+	if !a.modifiesMessages() {
+		return message
+	}
+	message = proto.Clone(message).(*protobufs.ServerToAgent)
+	if a.beforeSend == nil {
+		return message
+	}
+	a.mux.Lock()
+	target := MessageTarget{Conn: conn, InstanceUid: a.instanceUid, AgentDescription: a.agentDescription}
+	a.mux.Unlock()
+
+	a.beforeSend(message, target)
+	return message
+}
+
+// sign signs the prepared message if Settings.ResponseSigningKey is set, see
+// internal.SignServerToAgent. The message must not be modified after.
+func (a *agentInfo) sign(message *protobufs.ServerToAgent) error {
+	if a == nil || a.signingKey == nil {
+		return nil
+	}
+	return internal.SignServerToAgent(message, a.signingKey)
+}
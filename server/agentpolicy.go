@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// Keys of the identifying attributes that describe the agent type and version,
+// as defined by OpenTelemetry semantic conventions.
+const (
+	agentTypeAttributeKey    = "service.name"
+	agentVersionAttributeKey = "service.version"
+)
+
+// ErrMissingCapabilities is returned by the policy created by RequireCapabilities
+// if the Agent lacks some of the required capabilities.
+var ErrMissingCapabilities = errors.New("agent lacks required capabilities")
+
+// ErrBlockedAgent is returned by the policy created by BlockAgents if the Agent's
+// type or version is blocked.
+var ErrBlockedAgent = errors.New("agent type or version is blocked")
+
+// AgentPolicy decides if the Server accepts the Agent that sent the message.
+// If the Agent is not accepted AgentPolicy returns an error that describes why.
+// See Settings.AgentPolicy.
+type AgentPolicy func(message *protobufs.AgentToServer) error
+
+// RequireCapabilities returns an AgentPolicy that rejects the Agents that don't
+// have all the specified capabilities.
+func RequireCapabilities(capabilities protobufs.AgentCapabilities) AgentPolicy {
+	return func(message *protobufs.AgentToServer) error {
+		missing := uint64(capabilities) &^ message.Capabilities
+		if missing != 0 {
+			return fmt.Errorf("%w: %#x", ErrMissingCapabilities, missing)
+		}
+		return nil
+	}
+}
+
+// BlockAgents returns an AgentPolicy that rejects the Agents with the blocked
+// type or version. The keys of the map are agent types (the service.name identifying
+// attribute), the values are the blocked versions (the service.version identifying
+// attribute) of that type. An empty list of versions blocks all versions of the type.
+// The policy accepts the Agents whose AgentDescription is not known, the Server
+// provides the last known description to the policy (see Settings.AgentPolicy).
+func BlockAgents(blocked map[string][]string) AgentPolicy {
+	return func(message *protobufs.AgentToServer) error {
+		agentType, ok := identifyingAttribute(message.AgentDescription, agentTypeAttributeKey)
+		if !ok {
+			return nil
+		}
+		versions, ok := blocked[agentType]
+		if !ok {
+			return nil
+		}
+		if len(versions) == 0 {
+			return fmt.Errorf("%w: %s", ErrBlockedAgent, agentType)
+		}
+		agentVersion, _ := identifyingAttribute(message.AgentDescription, agentVersionAttributeKey)
+		for _, version := range versions {
+			if version == agentVersion {
+				return fmt.Errorf("%w: %s %s", ErrBlockedAgent, agentType, agentVersion)
+			}
+		}
+		return nil
+	}
+}
+
+// AllAgentPolicies returns an AgentPolicy that accepts the Agent only if all the
+// specified policies accept it. The error of the first policy that rejects the
+// Agent is returned.
+func AllAgentPolicies(policies ...AgentPolicy) AgentPolicy {
+	return func(message *protobufs.AgentToServer) error {
+		for _, policy := range policies {
+			if err := policy(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func identifyingAttribute(descr *protobufs.AgentDescription, key string) (string, bool) {
+	for _, attr := range descr.GetIdentifyingAttributes() {
+		if attr.Key == key {
+			return attr.GetValue().GetStringValue(), true
+		}
+	}
+	return "", false
+}
+
+// rejectedAgentResponse returns the response that tells the Agent that it is
+// rejected by the AgentPolicy. The Agent should not retry the same request.
+func rejectedAgentResponse(message *protobufs.AgentToServer, err error) *protobufs.ServerToAgent {
+	return &protobufs.ServerToAgent{
+		InstanceUid: message.InstanceUid,
+		ErrorResponse: &protobufs.ServerErrorResponse{
+			Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest,
+			ErrorMessage: fmt.Sprintf("agent rejected by server policy: %v", err),
+		},
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func agentMessage(capabilities protobufs.AgentCapabilities, agentType, version string) *protobufs.AgentToServer {
+	return &protobufs.AgentToServer{
+		Capabilities: uint64(capabilities),
+		AgentDescription: &protobufs.AgentDescription{
+			IdentifyingAttributes: []*protobufs.KeyValue{
+				{Key: agentTypeAttributeKey, Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: agentType}}},
+				{Key: agentVersionAttributeKey, Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: version}}},
+			},
+		},
+	}
+}
+
+func TestRequireCapabilities(t *testing.T) {
+	policy := RequireCapabilities(protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig)
+
+	assert.NoError(t, policy(agentMessage(
+		protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus|protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig,
+		"collector", "1.0",
+	)))
+	assert.ErrorIs(t, policy(agentMessage(protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus, "collector", "1.0")),
+		ErrMissingCapabilities)
+}
+
+func TestBlockAgents(t *testing.T) {
+	policy := BlockAgents(map[string][]string{
+		"legacy":    nil,
+		"collector": {"0.1.0", "0.2.0"},
+	})
+
+	assert.ErrorIs(t, policy(agentMessage(0, "legacy", "5.0")), ErrBlockedAgent)
+	assert.ErrorIs(t, policy(agentMessage(0, "collector", "0.2.0")), ErrBlockedAgent)
+	assert.NoError(t, policy(agentMessage(0, "collector", "0.3.0")))
+	assert.NoError(t, policy(agentMessage(0, "other", "0.1.0")))
+	assert.NoError(t, policy(&protobufs.AgentToServer{}))
+}
+
+func TestAllAgentPolicies(t *testing.T) {
+	policy := AllAgentPolicies(
+		RequireCapabilities(protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth),
+		BlockAgents(map[string][]string{"legacy": nil}),
+	)
+
+	assert.NoError(t, policy(agentMessage(protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth, "collector", "1.0")))
+	assert.ErrorIs(t, policy(agentMessage(0, "collector", "1.0")), ErrMissingCapabilities)
+	assert.ErrorIs(t, policy(agentMessage(protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth, "legacy", "1.0")),
+		ErrBlockedAgent)
+}
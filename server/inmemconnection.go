@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	serverTypes "github.com/open-telemetry/opamp-go/server/types"
+)
+
+var (
+	errInMemoryConnectionClosed = errors.New("the in-memory connection is closed")
+	errInMemoryAgentClosed      = errors.New("the in-memory Agent is closed")
+)
+
+// The URL of the requests passed to OnConnecting for the in-memory connections.
+const inMemoryURL = "memory://opamp" + defaultOpAMPPath
+
+// ConnectInMemory connects an Agent to the Server without network, e.g. to test
+// the Server's logic together with the client created by client.ConnectInMemory.
+// The Agent passes its messages to the returned Sender and receives the messages
+// of the Server via receiver. Must be called after Attach or Start.
+//
+// The connection behaves like a WebSocket connection: it is established, i.e.
+// OnConnecting and OnConnected are called, when the Agent sends its first message
+// and the Server can send messages to the Agent at any time. The messages are passed
+// to receiver in order, on a goroutine of the connection. If the Server disconnects
+// the Agent, the connection is established again with the next message of the Agent.
+// The request passed to OnConnecting has the header and a "memory" RemoteAddr.
+// The returned Sender implements io.Closer, closing it closes the connection.
+func (s *server) ConnectInMemory(header http.Header, receiver types.Receiver) types.Sender {
+	return &inMemoryAgent{server: s, header: header.Clone(), receiver: receiver}
+}
+
+// inMemoryAgent is the Agent's end of the in-memory connections.
+type inMemoryAgent struct {
+	server   *server
+	header   http.Header
+	receiver types.Receiver
+
+	// Serializes the messages of the Agent and the closing of the connections, so
+	// that the ConnectionCallbacks are not called concurrently.
+	mux sync.Mutex
+	// The current connection, nil if not established yet.
+	conn   *inMemoryConnection
+	closed bool
+}
+
+var _ types.Sender = (*inMemoryAgent)(nil)
+
+// Send passes the message of the Agent to the Server, establishing the connection
+// if needed. Returns when the Server processed the message, the response is passed
+// to the receiver on the goroutine of the connection.
+func (a *inMemoryAgent) Send(ctx context.Context, msg *protobufs.AgentToServer) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.closed {
+		return errInMemoryAgentClosed
+	}
+	if a.conn != nil && a.conn.ctx.Err() != nil {
+		// Disconnected by the Server.
+		a.finish(a.conn)
+		a.conn = nil
+	}
+	if a.conn == nil {
+		conn, err := a.connect()
+		if err != nil {
+			return err
+		}
+		a.conn = conn
+	}
+
+	// The Server may keep or modify the message, as the one decoded from the network.
+	request := proto.Clone(msg).(*protobufs.AgentToServer)
+	a.server.handleInMemoryMessage(ctx, a.conn, request)
+	return nil
+}
+
+// Close closes the connection. The Agent cannot send messages after that.
+func (a *inMemoryAgent) Close() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.closed = true
+	if a.conn != nil {
+		a.conn.cancel()
+		a.finish(a.conn)
+		a.conn = nil
+	}
+	return nil
+}
+
+func (a *inMemoryAgent) connect() (*inMemoryConnection, error) {
+	// The URL is valid, http.NewRequest cannot fail.
+	req, _ := http.NewRequest(http.MethodGet, inMemoryURL, nil)
+	if a.header != nil {
+		req.Header = a.header.Clone()
+	}
+	req.RemoteAddr = inMemoryAddr{}.String()
+
+	var connectionCallbacks serverTypes.ConnectionCallbacks
+	if a.server.settings.Callbacks != nil {
+		resp := a.server.settings.Callbacks.OnConnecting(req)
+		if !resp.Accept {
+			return nil, fmt.Errorf("the Server rejected the connection with HTTP status %d", resp.HTTPStatusCode)
+		}
+		connectionCallbacks = resp.ConnectionCallbacks
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &inMemoryConnection{
+		agent:     a,
+		callbacks: connectionCallbacks,
+		tenant:    a.server.settings.TenantQuotas.connect(req, true),
+		info:      newAgentInfo(a.server.settings),
+		ctx:       ctx,
+		cancel:    cancel,
+		queued:    make(chan struct{}, 1),
+	}
+	go conn.deliver()
+
+	if connectionCallbacks != nil {
+		connectionCallbacks.OnConnected(conn)
+	}
+	return conn, nil
+}
+
+// finish calls OnConnectionClose for the connection unless it is called already.
+// Must be called with mux locked.
+func (a *inMemoryAgent) finish(conn *inMemoryConnection) {
+	if conn.finished {
+		return
+	}
+	conn.finished = true
+	conn.tenant.close()
+	if conn.callbacks != nil {
+		conn.callbacks.OnConnectionClose(conn)
+	}
+}
+
+// inMemoryConnection represents an OpAMP connection of an Agent connected via
+// ConnectInMemory.
+type inMemoryConnection struct {
+	agent     *inMemoryAgent
+	callbacks serverTypes.ConnectionCallbacks
+	// Accounts the messages to the tenant of the Agent, nil if the quotas are not
+	// enabled.
+	tenant *tenantConn
+	// The Agent the messages are sent to, for Settings.BeforeSend.
+	info *agentInfo
+
+	// Cancelled when the connection is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The messages to pass to the receiver of the Agent.
+	queue    []*protobufs.ServerToAgent
+	queueMux sync.Mutex
+	// Signals that there are queued messages.
+	queued chan struct{}
+
+	// The following fields are accessed with the mux of the agent locked.
+
+	// The last AgentDescription received on this connection, for AgentPolicy.
+	agentDescription *protobufs.AgentDescription
+	// The last message received on this connection, for StrictSpecCompliance.
+	previous *protobufs.AgentToServer
+	// Set when OnConnectionClose is called.
+	finished bool
+}
+
+var _ serverTypes.Connection = (*inMemoryConnection)(nil)
+
+func (c *inMemoryConnection) RemoteAddr() net.Addr {
+	return inMemoryAddr{}
+}
+
+// Send queues the message for the Agent and returns without waiting for the Agent
+// to process it, so that it can be called from OnMessage. The message is modified
+// by Settings.BeforeSend and signed with Settings.ResponseSigningKey, the message
+// itself is not modified or retained. Returns an error and does not send the
+// message if the connection is closed or any of the offers has invalid headers.
+func (c *inMemoryConnection) Send(_ context.Context, message *protobufs.ServerToAgent) error {
+	if c.ctx.Err() != nil {
+		return errInMemoryConnectionClosed
+	}
+
+	if prepared := c.info.prepare(c, message); prepared != message {
+		message = prepared
+	} else {
+		message = proto.Clone(message).(*protobufs.ServerToAgent)
+	}
+	var invalidErr error
+	internal.SanitizeConnectionSettingsOffers(message.ConnectionSettings, func(offer string, err error) {
+		invalidErr = fmt.Errorf("invalid %s connection settings offer: %w", offer, err)
+	})
+	if invalidErr != nil {
+		return invalidErr
+	}
+	if err := c.info.sign(message); err != nil {
+		return err
+	}
+
+	c.queueMux.Lock()
+	c.queue = append(c.queue, message)
+	c.queueMux.Unlock()
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+	c.tenant.sent(message)
+	return nil
+}
+
+// Disconnect closes the connection. The queued messages are not passed to the Agent.
+func (c *inMemoryConnection) Disconnect() error {
+	c.cancel()
+	// Disconnect may be called from the ConnectionCallbacks, which are called
+	// with the mux of the agent locked.
+	go func() {
+		c.agent.mux.Lock()
+		defer c.agent.mux.Unlock()
+		c.agent.finish(c)
+	}()
+	return nil
+}
+
+// deliver passes the queued messages to the receiver of the Agent until the
+// connection is closed.
+func (c *inMemoryConnection) deliver() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.queued:
+		}
+
+		for c.ctx.Err() == nil {
+			c.queueMux.Lock()
+			if len(c.queue) == 0 {
+				c.queueMux.Unlock()
+				break
+			}
+			message := c.queue[0]
+			c.queue = c.queue[1:]
+			c.queueMux.Unlock()
+
+			if err := c.agent.receiver(c.ctx, message); err != nil {
+				c.agent.server.logger.Debugf("Cannot pass message to the in-memory Agent: %v", err)
+			}
+		}
+	}
+}
+
+// handleInMemoryMessage processes the message received via the in-memory connection
+// as handleWSConnection processes the messages received via WebSocket.
+func (s *server) handleInMemoryMessage(
+	ctx context.Context, conn *inMemoryConnection, request *protobufs.AgentToServer,
+) {
+	response := s.checkSpecCompliance(conn, request, conn.previous)
+	conn.previous = request
+	if response != nil {
+		if err := conn.Send(ctx, response); err != nil {
+			s.logger.Errorf("Cannot send message to the in-memory Agent: %v", err)
+		}
+		return
+	}
+
+	if request.AgentDescription != nil {
+		conn.agentDescription = request.AgentDescription
+	}
+	conn.info.update(request, conn.agentDescription)
+
+	if violation := conn.tenant.received(request, proto.Size(request), time.Now()); violation != nil {
+		if err := conn.Send(ctx, violation.response); err != nil {
+			s.logger.Errorf("Cannot send message to the in-memory Agent: %v", err)
+		}
+		if violation.wsCloseCode != 0 {
+			_ = conn.Disconnect()
+		}
+		return
+	}
+
+	if response := s.checkAgentPolicy(request, conn.agentDescription); response != nil {
+		if err := conn.Send(ctx, response); err != nil {
+			s.logger.Errorf("Cannot send message to the in-memory Agent: %v", err)
+		}
+		_ = conn.Disconnect()
+		return
+	}
+
+	if conn.callbacks != nil {
+		response := conn.callbacks.OnMessage(conn, request)
+		if response.InstanceUid == "" {
+			response.InstanceUid = request.InstanceUid
+		}
+		s.sanitizeResponse(response)
+		s.requestUnknownDescription(response, conn.agentDescription)
+		if err := conn.Send(ctx, response); err != nil {
+			s.logger.Errorf("Cannot send message to the in-memory Agent: %v", err)
+		}
+	}
+}
+
+// inMemoryAddr is the RemoteAddr of the in-memory connections.
+type inMemoryAddr struct{}
+
+func (inMemoryAddr) Network() string { return "memory" }
+
+func (inMemoryAddr) String() string { return "memory" }
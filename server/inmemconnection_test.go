@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/client"
+	clientTypes "github.com/open-telemetry/opamp-go/client/types"
+	sharedinternal "github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+func TestConnectInMemory(t *testing.T) {
+	var connected, closed int32
+	var srvConn atomic.Value
+	var lastStatus atomic.Value
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			assert.EqualValues(t, "secret", request.Header.Get("Authorization"))
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnConnectedFunc: func(conn types.Connection) {
+					assert.EqualValues(t, "memory", conn.RemoteAddr().String())
+					srvConn.Store(conn)
+					atomic.AddInt32(&connected, 1)
+				},
+				OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					if message.RemoteConfigStatus != nil {
+						lastStatus.Store(message.RemoteConfigStatus)
+					}
+					return &protobufs.ServerToAgent{}
+				},
+				OnConnectionCloseFunc: func(conn types.Connection) {
+					atomic.AddInt32(&closed, 1)
+				},
+			}}
+		},
+	}
+	srv := New(&sharedinternal.NopLogger{})
+	_, _, err := srv.Attach(Settings{Callbacks: callbacks})
+	require.NoError(t, err)
+
+	agent := client.ConnectInMemory(nil, srv, http.Header{"Authorization": []string{"secret"}})
+	settings := clientTypes.StartSettings{
+		InstanceUid: "01ARZ3NDEKTSV4RRFFQ69G5FAV",
+		Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+			protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig,
+		Callbacks: clientTypes.CallbacksStruct{
+			OnMessageFunc: func(ctx context.Context, msg *clientTypes.MessageData) {
+				if msg.RemoteConfig != nil {
+					assert.NoError(t, agent.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+						LastRemoteConfigHash: msg.RemoteConfig.ConfigHash,
+						Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+					}))
+				}
+			},
+		},
+	}
+	require.NoError(t, agent.SetAgentDescription(&protobufs.AgentDescription{
+		IdentifyingAttributes: []*protobufs.KeyValue{{
+			Key:   "service.name",
+			Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: "agent"}},
+		}},
+	}))
+	require.NoError(t, agent.Start(context.Background(), settings))
+	eventually(t, func() bool { return atomic.LoadInt32(&connected) == 1 })
+
+	// Push the remote config from the Server, the Agent reports that it applied it.
+	conn := srvConn.Load().(types.Connection)
+	require.NoError(t, conn.Send(context.Background(), &protobufs.ServerToAgent{
+		InstanceUid:  settings.InstanceUid,
+		RemoteConfig: &protobufs.AgentRemoteConfig{ConfigHash: []byte("hash")},
+	}))
+	eventually(t, func() bool {
+		status, ok := lastStatus.Load().(*protobufs.RemoteConfigStatus)
+		return ok && string(status.LastRemoteConfigHash) == "hash"
+	})
+
+	// The Agent connects again with its next message after it is disconnected.
+	require.NoError(t, conn.Disconnect())
+	eventually(t, func() bool { return atomic.LoadInt32(&closed) == 1 })
+	assert.Error(t, conn.Send(context.Background(), &protobufs.ServerToAgent{}))
+	require.NoError(t, agent.SetAgentDescription(&protobufs.AgentDescription{
+		IdentifyingAttributes: []*protobufs.KeyValue{{
+			Key:   "service.name",
+			Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: "agent2"}},
+		}},
+	}))
+	eventually(t, func() bool { return atomic.LoadInt32(&connected) == 2 })
+
+	// Stopping the Agent closes the connection.
+	require.NoError(t, agent.Stop(context.Background()))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&closed))
+}
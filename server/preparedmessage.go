@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+// The number of the ServerToAgent.instance_uid field, patched per Agent.
+var instanceUidFieldNumber = (&protobufs.ServerToAgent{}).ProtoReflect().Descriptor().
+	Fields().ByName("instance_uid").Number()
+
+// PreparedMessage is a ServerToAgent message marshaled once to be sent to many
+// Agents, e.g. to broadcast the same config to a fleet. Sending it to a WebSocket
+// connection writes the marshaled bytes as is, followed by the instance uid of the
+// Agent: the encoded field overrides the InstanceUid of the message when the Agent
+// decodes it. A PreparedMessage is immutable and may be sent concurrently.
+type PreparedMessage struct {
+	message *protobufs.ServerToAgent
+	data    []byte
+}
+
+// PrepareMessage marshals the message to send to many Agents, see
+// PreparedMessage.SendTo. The header names of the connection settings offers are
+// canonicalized, the message itself is not modified and must not be modified
+// until the PreparedMessage is no longer used. Returns an error if any of the
+// offers has invalid headers.
+func PrepareMessage(message *protobufs.ServerToAgent) (*PreparedMessage, error) {
+	if message.ConnectionSettings != nil {
+		message = proto.Clone(message).(*protobufs.ServerToAgent)
+	}
+	var invalidErr error
+	internal.SanitizeConnectionSettingsOffers(message.ConnectionSettings, func(offer string, err error) {
+		invalidErr = fmt.Errorf("invalid %s connection settings offer: %w", offer, err)
+	})
+	if invalidErr != nil {
+		return nil, invalidErr
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return &PreparedMessage{message: message, data: data}, nil
+}
+
+// SendTo sends the message to the Agent on conn with the InstanceUid of the
+// message replaced by the instance uid of the Agent, unless the Server has not
+// received a message on conn yet. Blocks like Connection.Send. If
+// Settings.BeforeSend or Settings.ResponseSigningKey is set the message is modified
+// and marshaled for every Agent as when it is sent via Connection.Send.
+func (m *PreparedMessage) SendTo(ctx context.Context, conn types.Connection) error {
+	switch c := conn.(type) {
+	case wsConnection:
+		return c.sendPrepared(ctx, m)
+	case *inMemoryConnection:
+		return c.Send(ctx, m.forInstance(c.info.currentInstanceUid()))
+	}
+	return conn.Send(ctx, m.message)
+}
+
+// forInstance returns a copy of the message sent to the Agent with instanceUid.
+func (m *PreparedMessage) forInstance(instanceUid string) *protobufs.ServerToAgent {
+	if instanceUid == "" {
+		return m.message
+	}
+	message := proto.Clone(m.message).(*protobufs.ServerToAgent)
+	message.InstanceUid = instanceUid
+	return message
+}
+
+// instanceUidPatch returns the encoded instance_uid field to append to the marshaled
+// message, nil if instanceUid is empty.
+func (m *PreparedMessage) instanceUidPatch(instanceUid string) []byte {
+	if instanceUid == "" {
+		return nil
+	}
+	patch := protowire.AppendTag(nil, instanceUidFieldNumber, protowire.BytesType)
+	return protowire.AppendString(patch, instanceUid)
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// How long a plain HTTP Agent counts as connected after its last request, unless
+// TenantQuotasSettings.HTTPAgentTimeout is set.
+const defaultHTTPAgentTimeout = 2 * time.Minute
+
+// TenantFunc returns the tenant of the Agent that sent the request, e.g. from a
+// header, the URL path or the client certificate. The Agents of the same tenant
+// share the tenant's quota.
+type TenantFunc func(req *http.Request) string
+
+// Quota limits the resources used by the Agents of a tenant. Zero fields mean no limit.
+type Quota struct {
+	// MaxAgents is the maximum number of connected Agents. Messages of additional
+	// Agents are rejected with a BadRequest ServerErrorResponse.
+	MaxAgents int
+
+	// MaxMessagesPerSecond is the maximum rate of messages received from the Agents.
+	// Short bursts of up to one second worth of messages are allowed.
+	MaxMessagesPerSecond float64
+
+	// MaxBytesPerSecond is the maximum rate of bytes received from the Agents,
+	// counted as the size of the uncompressed messages.
+	MaxBytesPerSecond float64
+}
+
+// QuotaExceededAction is what the Server does with a message that exceeds the rate
+// limits of the tenant's Quota.
+type QuotaExceededAction int
+
+const (
+	// QuotaActionThrottle responds to the message with an Unavailable
+	// ServerErrorResponse with the RetryInfo telling the Agent when to retry. The
+	// message is not passed to OnMessage and the connection is kept open.
+	QuotaActionThrottle QuotaExceededAction = iota
+
+	// QuotaActionDisconnect closes the WebSocket connection after sending the same
+	// response as QuotaActionThrottle. Plain HTTP requests are answered with 429 Too
+	// Many Requests and a Retry-After header.
+	QuotaActionDisconnect
+)
+
+// TenantQuotasSettings are the settings of TenantQuotas.
+type TenantQuotasSettings struct {
+	// TenantOf returns the tenant of the Agents. If nil all Agents belong to the
+	// tenant "".
+	TenantOf TenantFunc
+
+	// DefaultQuota applies to the tenants not listed in Quotas.
+	DefaultQuota Quota
+
+	// Quotas of the specific tenants.
+	Quotas map[string]Quota
+
+	// RateExceededAction is what the Server does with the messages that exceed
+	// MaxMessagesPerSecond or MaxBytesPerSecond.
+	RateExceededAction QuotaExceededAction
+
+	// HTTPAgentTimeout is how long a plain HTTP Agent counts as connected after its
+	// last request. Should be longer than the polling interval of the Agents. Two
+	// minutes if zero.
+	HTTPAgentTimeout time.Duration
+}
+
+// TenantUsage is the resource usage of the Agents of a tenant, e.g. for billing or
+// capacity planning. The counters are cumulative since the TenantQuotas was created.
+type TenantUsage struct {
+	Tenant string `json:"tenant"`
+
+	// ConnectedAgents is the current number of connected Agents.
+	ConnectedAgents int `json:"connected_agents"`
+
+	// Messages and bytes received from and sent to the Agents. The bytes are the
+	// sizes of the uncompressed messages.
+	MessagesReceived uint64 `json:"messages_received"`
+	BytesReceived    uint64 `json:"bytes_received"`
+	MessagesSent     uint64 `json:"messages_sent"`
+	BytesSent        uint64 `json:"bytes_sent"`
+
+	// RejectedAgents counts the messages rejected because the tenant reached
+	// MaxAgents, RateLimitedMessages the messages that exceeded the rate limits.
+	RejectedAgents      uint64 `json:"rejected_agents"`
+	RateLimitedMessages uint64 `json:"rate_limited_messages"`
+}
+
+// TenantQuotas tracks the usage of the Agents per tenant and enforces the tenants'
+// quotas. Set it as Settings.TenantQuotas to use it. Safe for concurrent use.
+type TenantQuotas struct {
+	tenantOf         TenantFunc
+	rateAction       QuotaExceededAction
+	httpAgentTimeout time.Duration
+
+	mux          sync.Mutex
+	defaultQuota Quota
+	quotas       map[string]Quota
+	tenants      map[string]*tenantState
+}
+
+type tenantState struct {
+	usage    TenantUsage
+	agents   map[string]*quotaAgent
+	messages rateLimiter
+	bytes    rateLimiter
+}
+
+// quotaAgent is an Agent counted against the MaxAgents of its tenant.
+type quotaAgent struct {
+	// Number of the open WebSocket connections of the Agent.
+	wsConns int
+	// The time of the last plain HTTP request of the Agent.
+	lastSeen time.Time
+}
+
+// NewTenantQuotas creates a new TenantQuotas with the specified settings.
+func NewTenantQuotas(settings TenantQuotasSettings) *TenantQuotas {
+	q := &TenantQuotas{
+		tenantOf:         settings.TenantOf,
+		rateAction:       settings.RateExceededAction,
+		httpAgentTimeout: settings.HTTPAgentTimeout,
+		defaultQuota:     settings.DefaultQuota,
+		quotas:           map[string]Quota{},
+		tenants:          map[string]*tenantState{},
+	}
+	if q.httpAgentTimeout <= 0 {
+		q.httpAgentTimeout = defaultHTTPAgentTimeout
+	}
+	for tenant, quota := range settings.Quotas {
+		q.quotas[tenant] = quota
+	}
+	return q
+}
+
+// SetQuota sets the quota of the tenant. Takes effect for the following messages.
+func (q *TenantQuotas) SetQuota(tenant string, quota Quota) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.quotas[tenant] = quota
+}
+
+// Usage returns the usage of all tenants that had Agents connected, sorted by tenant.
+func (q *TenantQuotas) Usage() []TenantUsage {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	now := time.Now()
+	result := make([]TenantUsage, 0, len(q.tenants))
+	for _, state := range q.tenants {
+		usage := state.usage
+		usage.ConnectedAgents = q.connectedAgents(state, now)
+		result = append(result, usage)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Tenant < result[j].Tenant })
+	return result
+}
+
+func (q *TenantQuotas) quota(tenant string) Quota {
+	if quota, ok := q.quotas[tenant]; ok {
+		return quota
+	}
+	return q.defaultQuota
+}
+
+func (q *TenantQuotas) tenant(name string) *tenantState {
+	state := q.tenants[name]
+	if state == nil {
+		state = &tenantState{usage: TenantUsage{Tenant: name}, agents: map[string]*quotaAgent{}}
+		q.tenants[name] = state
+	}
+	return state
+}
+
+func (q *TenantQuotas) isConnected(agent *quotaAgent, now time.Time) bool {
+	return agent.wsConns > 0 || now.Sub(agent.lastSeen) < q.httpAgentTimeout
+}
+
+// connectedAgents counts the connected Agents of the tenant and forgets the Agents
+// that are no longer connected.
+func (q *TenantQuotas) connectedAgents(state *tenantState, now time.Time) int {
+	for instanceUid, agent := range state.agents {
+		if !q.isConnected(agent, now) {
+			delete(state.agents, instanceUid)
+		}
+	}
+	return len(state.agents)
+}
+
+// connect returns the accounting of a new connection of the Agent that sent req.
+// Returns nil if q is nil.
+func (q *TenantQuotas) connect(req *http.Request, ws bool) *tenantConn {
+	if q == nil {
+		return nil
+	}
+	tenant := ""
+	if q.tenantOf != nil {
+		tenant = q.tenantOf(req)
+	}
+	return &tenantConn{quotas: q, tenant: tenant, ws: ws}
+}
+
+// quotaViolation describes how to reject a message that violates the tenant's quota.
+type quotaViolation struct {
+	// The response to send to the Agent.
+	response *protobufs.ServerToAgent
+	// If not 0 the WebSocket connection is closed with this code after sending the
+	// response.
+	wsCloseCode int
+	// If not 0 the plain HTTP request is answered with this status code and the
+	// httpHeader instead of the response.
+	httpStatus int
+	httpHeader http.Header
+}
+
+// tenantConn accounts the messages of one OpAMP connection to its tenant. A nil
+// tenantConn accounts nothing, it is used when the quotas are not enabled.
+type tenantConn struct {
+	quotas *TenantQuotas
+	tenant string
+	ws     bool
+	// The Agent using the WebSocket connection, empty until the first message.
+	instanceUid string
+}
+
+// received accounts the message of the specified size and checks it against the
+// quota. Returns nil if the message is within the quota.
+func (c *tenantConn) received(message *protobufs.AgentToServer, size int, now time.Time) *quotaViolation {
+	if c == nil {
+		return nil
+	}
+	q := c.quotas
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	state := q.tenant(c.tenant)
+	quota := q.quota(c.tenant)
+	state.usage.MessagesReceived++
+	state.usage.BytesReceived += uint64(size)
+
+	agent := state.agents[message.InstanceUid]
+	if agent == nil || !q.isConnected(agent, now) {
+		if quota.MaxAgents > 0 && q.connectedAgents(state, now) >= quota.MaxAgents {
+			state.usage.RejectedAgents++
+			err := fmt.Errorf("tenant %q reached the limit of %d agents", c.tenant, quota.MaxAgents)
+			return &quotaViolation{
+				response:    rejectedAgentResponse(message, err),
+				wsCloseCode: websocket.ClosePolicyViolation,
+			}
+		}
+		if agent == nil {
+			agent = &quotaAgent{}
+			state.agents[message.InstanceUid] = agent
+		}
+	}
+	if c.ws && c.instanceUid != message.InstanceUid {
+		// The first message on the connection, or the Agent changed its instance uid.
+		if previous := state.agents[c.instanceUid]; c.instanceUid != "" && previous != nil {
+			previous.wsConns--
+		}
+		agent.wsConns++
+		c.instanceUid = message.InstanceUid
+	}
+	if !c.ws {
+		agent.lastSeen = now
+	}
+
+	retryAfter := state.messages.wait(quota.MaxMessagesPerSecond, 1, now)
+	if bytesWait := state.bytes.wait(quota.MaxBytesPerSecond, float64(size), now); bytesWait > retryAfter {
+		retryAfter = bytesWait
+	}
+	if retryAfter > 0 {
+		state.usage.RateLimitedMessages++
+		return q.rateViolation(message, retryAfter)
+	}
+	state.messages.take(quota.MaxMessagesPerSecond, 1, now)
+	state.bytes.take(quota.MaxBytesPerSecond, float64(size), now)
+	return nil
+}
+
+func (q *TenantQuotas) rateViolation(message *protobufs.AgentToServer, retryAfter time.Duration) *quotaViolation {
+	violation := &quotaViolation{
+		response: &protobufs.ServerToAgent{
+			InstanceUid: message.InstanceUid,
+			ErrorResponse: &protobufs.ServerErrorResponse{
+				Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable,
+				ErrorMessage: "tenant exceeded the message rate quota",
+				Details: &protobufs.ServerErrorResponse_RetryInfo{
+					RetryInfo: &protobufs.RetryInfo{RetryAfterNanoseconds: uint64(retryAfter)},
+				},
+			},
+		},
+	}
+	if q.rateAction == QuotaActionDisconnect {
+		violation.wsCloseCode = websocket.CloseTryAgainLater
+		violation.httpStatus = http.StatusTooManyRequests
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		violation.httpHeader = http.Header{"Retry-After": {strconv.Itoa(seconds)}}
+	}
+	return violation
+}
+
+// sent accounts the message sent to the Agent.
+func (c *tenantConn) sent(message *protobufs.ServerToAgent) {
+	if c == nil {
+		return
+	}
+	c.sentBytes(proto.Size(message))
+}
+
+// sentBytes accounts a message of size bytes sent to the Agent.
+func (c *tenantConn) sentBytes(size int) {
+	if c == nil {
+		return
+	}
+	c.quotas.mux.Lock()
+	defer c.quotas.mux.Unlock()
+	state := c.quotas.tenant(c.tenant)
+	state.usage.MessagesSent++
+	state.usage.BytesSent += uint64(size)
+}
+
+// close accounts the closing of the WebSocket connection.
+func (c *tenantConn) close() {
+	if c == nil || c.instanceUid == "" {
+		return
+	}
+	c.quotas.mux.Lock()
+	defer c.quotas.mux.Unlock()
+	if agent := c.quotas.tenant(c.tenant).agents[c.instanceUid]; agent != nil {
+		agent.wsConns--
+	}
+}
+
+// rateLimiter is a token bucket that allows bursts of one second worth of the rate.
+// A take larger than the bucket (e.g. a large message) is allowed when the bucket is
+// full, the following takes then wait until the debt is paid off.
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) burst(rate float64) float64 {
+	return math.Max(rate, 1)
+}
+
+func (l *rateLimiter) refill(rate float64, now time.Time) {
+	if l.last.IsZero() {
+		l.tokens = l.burst(rate)
+	} else if now.After(l.last) {
+		l.tokens = math.Min(l.burst(rate), l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+}
+
+// wait returns how long to wait until n tokens can be taken, 0 if they can be taken
+// now or rate is 0 (no limit).
+func (l *rateLimiter) wait(rate float64, n float64, now time.Time) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	l.refill(rate, now)
+	need := math.Min(n, l.burst(rate))
+	if l.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - l.tokens) / rate * float64(time.Second))
+}
+
+func (l *rateLimiter) take(rate float64, n float64, now time.Time) {
+	if rate <= 0 {
+		return
+	}
+	l.refill(rate, now)
+	l.tokens -= n
+}
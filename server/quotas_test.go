@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func tenantRequest(tenant string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/v1/opamp", nil)
+	req.Header.Set("X-Tenant", tenant)
+	return req
+}
+
+func tenantFromHeader(req *http.Request) string {
+	return req.Header.Get("X-Tenant")
+}
+
+func TestTenantQuotasMaxAgents(t *testing.T) {
+	quotas := NewTenantQuotas(TenantQuotasSettings{
+		TenantOf:     tenantFromHeader,
+		DefaultQuota: Quota{MaxAgents: 1},
+		Quotas:       map[string]Quota{"big": {MaxAgents: 2}},
+	})
+	now := time.Now()
+
+	first := quotas.connect(tenantRequest("small"), true)
+	assert.Nil(t, first.received(&protobufs.AgentToServer{InstanceUid: "1"}, 10, now))
+	// The connected Agent may send more messages.
+	assert.Nil(t, first.received(&protobufs.AgentToServer{InstanceUid: "1"}, 10, now))
+
+	// A second Agent exceeds the quota of the tenant.
+	second := quotas.connect(tenantRequest("small"), true)
+	violation := second.received(&protobufs.AgentToServer{InstanceUid: "2"}, 10, now)
+	require.NotNil(t, violation)
+	assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest, violation.response.ErrorResponse.Type)
+	assert.EqualValues(t, websocket.ClosePolicyViolation, violation.wsCloseCode)
+
+	// Other tenants have their own quotas.
+	for _, uid := range []string{"3", "4"} {
+		assert.Nil(t, quotas.connect(tenantRequest("big"), true).received(&protobufs.AgentToServer{InstanceUid: uid}, 10, now))
+	}
+
+	// The second Agent can connect after the first one disconnects.
+	first.close()
+	assert.Nil(t, second.received(&protobufs.AgentToServer{InstanceUid: "2"}, 10, now))
+
+	usage := quotas.Usage()
+	require.Len(t, usage, 2)
+	assert.Equal(t, TenantUsage{
+		Tenant: "big", ConnectedAgents: 2, MessagesReceived: 2, BytesReceived: 20,
+	}, usage[0])
+	assert.Equal(t, TenantUsage{
+		Tenant: "small", ConnectedAgents: 1, MessagesReceived: 4, BytesReceived: 40, RejectedAgents: 1,
+	}, usage[1])
+}
+
+func TestTenantQuotasHTTPAgentTimeout(t *testing.T) {
+	quotas := NewTenantQuotas(TenantQuotasSettings{
+		DefaultQuota:     Quota{MaxAgents: 1},
+		HTTPAgentTimeout: time.Minute,
+	})
+	now := time.Now()
+
+	assert.Nil(t, quotas.connect(tenantRequest(""), false).received(&protobufs.AgentToServer{InstanceUid: "1"}, 1, now))
+	// The polling Agent still counts as connected.
+	assert.NotNil(t, quotas.connect(tenantRequest(""), false).received(&protobufs.AgentToServer{InstanceUid: "2"}, 1, now.Add(30*time.Second)))
+	// Until it stops polling.
+	assert.Nil(t, quotas.connect(tenantRequest(""), false).received(&protobufs.AgentToServer{InstanceUid: "2"}, 1, now.Add(2*time.Minute)))
+}
+
+func TestTenantQuotasRateLimits(t *testing.T) {
+	quotas := NewTenantQuotas(TenantQuotasSettings{
+		DefaultQuota: Quota{MaxMessagesPerSecond: 2, MaxBytesPerSecond: 1000},
+	})
+	conn := quotas.connect(tenantRequest(""), true)
+	msg := &protobufs.AgentToServer{InstanceUid: "1"}
+	now := time.Now()
+
+	// A burst of one second worth of messages is allowed.
+	assert.Nil(t, conn.received(msg, 10, now))
+	assert.Nil(t, conn.received(msg, 10, now))
+	violation := conn.received(msg, 10, now)
+	require.NotNil(t, violation)
+	assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable, violation.response.ErrorResponse.Type)
+	assert.InDelta(t, 500*time.Millisecond, violation.response.ErrorResponse.GetRetryInfo().RetryAfterNanoseconds, float64(time.Millisecond))
+	assert.Zero(t, violation.wsCloseCode)
+
+	// The rate limited message did not use the quota.
+	now = now.Add(500 * time.Millisecond)
+	assert.Nil(t, conn.received(msg, 10, now))
+
+	// A large message is accepted but the following ones wait until its bytes are
+	// paid off.
+	now = now.Add(time.Second)
+	assert.Nil(t, conn.received(msg, 2980, now))
+	violation = conn.received(msg, 10, now.Add(time.Second))
+	require.NotNil(t, violation)
+	assert.InDelta(t, 990*time.Millisecond, violation.response.ErrorResponse.GetRetryInfo().RetryAfterNanoseconds, float64(time.Millisecond))
+	assert.Nil(t, conn.received(msg, 10, now.Add(2100*time.Millisecond)))
+
+	usage := quotas.Usage()
+	require.Len(t, usage, 1)
+	assert.EqualValues(t, 2, usage[0].RateLimitedMessages)
+	assert.EqualValues(t, 7, usage[0].MessagesReceived)
+}
+
+func TestTenantQuotasDisconnectAction(t *testing.T) {
+	quotas := NewTenantQuotas(TenantQuotasSettings{
+		DefaultQuota:       Quota{MaxMessagesPerSecond: 0.5},
+		RateExceededAction: QuotaActionDisconnect,
+	})
+	conn := quotas.connect(tenantRequest(""), false)
+	now := time.Now()
+
+	assert.Nil(t, conn.received(&protobufs.AgentToServer{InstanceUid: "1"}, 1, now))
+	violation := conn.received(&protobufs.AgentToServer{InstanceUid: "1"}, 1, now)
+	require.NotNil(t, violation)
+	assert.EqualValues(t, websocket.CloseTryAgainLater, violation.wsCloseCode)
+	assert.EqualValues(t, http.StatusTooManyRequests, violation.httpStatus)
+	assert.Equal(t, "2", violation.httpHeader.Get("Retry-After"))
+}
+
+func TestTenantQuotasSetQuota(t *testing.T) {
+	quotas := NewTenantQuotas(TenantQuotasSettings{})
+	now := time.Now()
+	assert.Nil(t, quotas.connect(tenantRequest(""), true).received(&protobufs.AgentToServer{InstanceUid: "1"}, 1, now))
+
+	quotas.SetQuota("", Quota{MaxAgents: 1})
+	assert.NotNil(t, quotas.connect(tenantRequest(""), true).received(&protobufs.AgentToServer{InstanceUid: "2"}, 1, now))
+}
+
+func TestNilTenantConn(t *testing.T) {
+	var quotas *TenantQuotas
+	conn := quotas.connect(tenantRequest(""), true)
+	assert.Nil(t, conn.received(&protobufs.AgentToServer{}, 1, time.Now()))
+	conn.sent(&protobufs.ServerToAgent{})
+	conn.close()
+}
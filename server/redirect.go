@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+// RedirectOffer returns the connection settings offer that tells an Agent to
+// reconnect to the OpAMP Server at endpoint, e.g. to drain this Server instance
+// before it is shut down. The header is sent by the Agent when it connects to the
+// endpoint, e.g. to authenticate with it. The Hash of the offer identifies the
+// endpoint and the header, the opamp-go clients that report their health report
+// the rejection of the offer with its hash in the LastError of the AgentHealth
+// (see the client's types.ConnectionSettingsStatus).
+//
+// Only the Agents with the AcceptsOpAMPConnectionSettings capability accept the
+// offer. The Agent verifies that the endpoint is healthy before it accepts the
+// offer and keeps its current connection until it reconnects, so the state of the
+// Agent stays with this Server until the Agent is connected to the new one. The
+// opamp-go clients reconnect to the endpoint by themselves if their
+// StartSettings.FollowOfferedEndpoint is set. Set the offer as the
+// ConnectionSettings of the response to the Agent, or push it with Redirect.
+func RedirectOffer(endpoint string, header http.Header) *protobufs.ConnectionSettingsOffers {
+	settings := &protobufs.OpAMPConnectionSettings{DestinationEndpoint: endpoint}
+	if len(header) > 0 {
+		settings.Headers = &protobufs.Headers{}
+		keys := make([]string, 0, len(header))
+		for key := range header {
+			keys = append(keys, key)
+		}
+		// The hash of the same header must not depend on the map order.
+		sort.Strings(keys)
+		for _, key := range keys {
+			for _, value := range header[key] {
+				settings.Headers.Headers = append(settings.Headers.Headers, &protobufs.Header{Key: key, Value: value})
+			}
+		}
+	}
+
+	// Marshaling a message without maps cannot fail.
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(settings)
+	hash := sha256.Sum256(data)
+	return &protobufs.ConnectionSettingsOffers{Hash: hash[:], Opamp: settings}
+}
+
+// Redirect sends the RedirectOffer for the endpoint and the header to the Agent with
+// the instanceUid connected over the conn. Can be called only for WebSocket
+// connections, the offer must be set in the response to the plain HTTP requests.
+func Redirect(
+	ctx context.Context, conn types.Connection, instanceUid string, endpoint string, header http.Header,
+) error {
+	return conn.Send(ctx, &protobufs.ServerToAgent{
+		InstanceUid:        instanceUid,
+		ConnectionSettings: RedirectOffer(endpoint, header),
+	})
+}
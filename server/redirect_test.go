@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+func TestRedirectOffer(t *testing.T) {
+	header := http.Header{}
+	header.Add("Authorization", "Bearer token")
+	header.Add("X-Tenant", "a")
+	header.Add("X-Tenant", "b")
+
+	offer := RedirectOffer("wss://opamp-2.example.com/v1/opamp", header)
+	assert.EqualValues(t, "wss://opamp-2.example.com/v1/opamp", offer.Opamp.DestinationEndpoint)
+	var sent []string
+	for _, h := range offer.Opamp.Headers.Headers {
+		sent = append(sent, h.Key+": "+h.Value)
+	}
+	assert.EqualValues(t, []string{"Authorization: Bearer token", "X-Tenant: a", "X-Tenant: b"}, sent)
+	require.Len(t, offer.Hash, 32)
+
+	// The hash only depends on the endpoint and the header.
+	again := RedirectOffer("wss://opamp-2.example.com/v1/opamp", header.Clone())
+	assert.EqualValues(t, offer.Hash, again.Hash)
+	other := RedirectOffer("wss://opamp-3.example.com/v1/opamp", header)
+	assert.NotEqualValues(t, offer.Hash, other.Hash)
+	header.Set("Authorization", "Bearer other")
+	assert.NotEqualValues(t, offer.Hash, RedirectOffer("wss://opamp-2.example.com/v1/opamp", header).Hash)
+
+	noHeader := RedirectOffer("wss://opamp-2.example.com/v1/opamp", nil)
+	assert.Nil(t, noHeader.Opamp.Headers)
+	assert.NotEqualValues(t, offer.Hash, noHeader.Hash)
+}
+
+// sendRecorder is a Connection that records the messages sent to the Agent.
+type sendRecorder struct {
+	types.Connection
+	sent []*protobufs.ServerToAgent
+}
+
+func (c *sendRecorder) Send(_ context.Context, message *protobufs.ServerToAgent) error {
+	c.sent = append(c.sent, message)
+	return nil
+}
+
+func TestRedirect(t *testing.T) {
+	conn := &sendRecorder{}
+	require.NoError(t, Redirect(context.Background(), conn, "agent1", "ws://opamp-2.example.com/v1/opamp", nil))
+
+	require.Len(t, conn.sent, 1)
+	assert.EqualValues(t, "agent1", conn.sent[0].InstanceUid)
+	assert.EqualValues(
+		t, RedirectOffer("ws://opamp-2.example.com/v1/opamp", nil).Hash, conn.sent[0].ConnectionSettings.Hash,
+	)
+	assert.EqualValues(t, "ws://opamp-2.example.com/v1/opamp", conn.sent[0].ConnectionSettings.Opamp.DestinationEndpoint)
+}
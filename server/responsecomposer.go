@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+// ErrResponseConflict is reported by the ResponseComposer if two providers set the
+// same field of the response to different values.
+var ErrResponseConflict = errors.New("response providers set the same field to different values")
+
+// The fields of ServerToAgent that are bit masks. The bits set by the providers are
+// combined, they never conflict.
+var bitMaskResponseFields = map[protoreflect.Name]bool{
+	"flags":        true,
+	"capabilities": true,
+}
+
+// ResponseProvider contributes to the response to a message of an Agent, see
+// ResponseComposer. It sets the fields of the response it is responsible for, e.g.
+// a config manager sets the RemoteConfig. The response is initially empty, the
+// provider does not see the contributions of the other providers.
+type ResponseProvider func(conn types.Connection, message *protobufs.AgentToServer, response *protobufs.ServerToAgent)
+
+type namedResponseProvider struct {
+	name    string
+	provide ResponseProvider
+}
+
+// ResponseComposer composes the response to the messages of the Agents from the
+// contributions of independent providers, e.g. a config manager, a package manager
+// and a connection settings manager. Use its OnMessage as the
+// ConnectionCallbacksStruct.OnMessageFunc, or call it from the OnMessage callback.
+//
+// The bits of the Flags and Capabilities set by the providers are combined. Any other
+// field may only be set by one provider, or by several providers to the same value.
+// If two providers set a field to different values the value of the provider added
+// first is sent and the conflict is reported. InstanceUid is set to the instance uid
+// of the Agent unless a provider sets it.
+type ResponseComposer struct {
+	providers  []namedResponseProvider
+	onConflict func(conn types.Connection, err error)
+}
+
+// NewResponseComposer creates a new ResponseComposer without providers. onConflict
+// is called with an error that wraps ErrResponseConflict when two providers set the
+// same field to different values, e.g. to log it. Optional, the conflicts are
+// ignored if nil.
+func NewResponseComposer(onConflict func(conn types.Connection, err error)) *ResponseComposer {
+	return &ResponseComposer{onConflict: onConflict}
+}
+
+// Add adds the provider, the name identifies it in the reported conflicts. The
+// providers are called in the order they are added. Must be called before the
+// ResponseComposer is used.
+func (c *ResponseComposer) Add(name string, provider ResponseProvider) {
+	c.providers = append(c.providers, namedResponseProvider{name: name, provide: provider})
+}
+
+// OnMessage returns the response to the message composed from the contributions of
+// the providers. May be called concurrently.
+func (c *ResponseComposer) OnMessage(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+	response := &protobufs.ServerToAgent{}
+	composed := response.ProtoReflect()
+	// The name of the provider that set each field.
+	setBy := map[protoreflect.FieldNumber]string{}
+
+	for _, provider := range c.providers {
+		contribution := &protobufs.ServerToAgent{}
+		provider.provide(conn, message, contribution)
+
+		contribution.ProtoReflect().Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+			if bitMaskResponseFields[field.Name()] {
+				composed.Set(field, protoreflect.ValueOfUint64(composed.Get(field).Uint()|value.Uint()))
+				return true
+			}
+			first, ok := setBy[field.Number()]
+			if !ok {
+				composed.Set(field, value)
+				setBy[field.Number()] = provider.name
+				return true
+			}
+			if !equalFieldValues(field, composed.Get(field), value) && c.onConflict != nil {
+				c.onConflict(conn, fmt.Errorf(
+					"%w: %s is set by %s and %s", ErrResponseConflict, field.Name(), first, provider.name,
+				))
+			}
+			return true
+		})
+	}
+
+	if response.InstanceUid == "" {
+		response.InstanceUid = message.InstanceUid
+	}
+	return response
+}
+
+// equalFieldValues returns true if the values of the singular field are equal.
+func equalFieldValues(field protoreflect.FieldDescriptor, a, b protoreflect.Value) bool {
+	switch {
+	case field.IsList() || field.IsMap():
+		// ServerToAgent has no repeated fields, they are never equal.
+		return false
+	case field.Message() != nil:
+		return proto.Equal(a.Message().Interface(), b.Message().Interface())
+	case field.Kind() == protoreflect.BytesKind:
+		return bytes.Equal(a.Bytes(), b.Bytes())
+	default:
+		return a.Interface() == b.Interface()
+	}
+}
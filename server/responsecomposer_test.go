@@ -0,0 +1,72 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+func TestResponseComposer(t *testing.T) {
+	remoteConfig := &protobufs.AgentRemoteConfig{ConfigHash: []byte("config")}
+	packages := &protobufs.PackagesAvailable{AllPackagesHash: []byte("packages")}
+
+	var conflicts []error
+	composer := NewResponseComposer(func(conn types.Connection, err error) {
+		conflicts = append(conflicts, err)
+	})
+	composer.Add("config", func(conn types.Connection, message *protobufs.AgentToServer, response *protobufs.ServerToAgent) {
+		response.RemoteConfig = remoteConfig
+		response.Capabilities = uint64(protobufs.ServerCapabilities_ServerCapabilities_OffersRemoteConfig)
+	})
+	composer.Add("packages", func(conn types.Connection, message *protobufs.AgentToServer, response *protobufs.ServerToAgent) {
+		response.PackagesAvailable = packages
+		response.Capabilities = uint64(protobufs.ServerCapabilities_ServerCapabilities_OffersPackages)
+		response.Flags = uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState)
+	})
+	composer.Add("unrelated", func(conn types.Connection, message *protobufs.AgentToServer, response *protobufs.ServerToAgent) {})
+
+	response := composer.OnMessage(nil, &protobufs.AgentToServer{InstanceUid: "agent"})
+	assert.Empty(t, conflicts)
+	assert.True(t, proto.Equal(&protobufs.ServerToAgent{
+		InstanceUid:       "agent",
+		RemoteConfig:      remoteConfig,
+		PackagesAvailable: packages,
+		Capabilities: uint64(protobufs.ServerCapabilities_ServerCapabilities_OffersRemoteConfig |
+			protobufs.ServerCapabilities_ServerCapabilities_OffersPackages),
+		Flags: uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState),
+	}, response), response)
+}
+
+func TestResponseComposerConflict(t *testing.T) {
+	var conflicts []error
+	composer := NewResponseComposer(func(conn types.Connection, err error) {
+		conflicts = append(conflicts, err)
+	})
+	restart := func(conn types.Connection, message *protobufs.AgentToServer, response *protobufs.ServerToAgent) {
+		response.Command = &protobufs.ServerToAgentCommand{Type: protobufs.CommandType_CommandType_Restart}
+	}
+	composer.Add("config", func(conn types.Connection, message *protobufs.AgentToServer, response *protobufs.ServerToAgent) {
+		response.RemoteConfig = &protobufs.AgentRemoteConfig{ConfigHash: []byte("first")}
+	})
+	composer.Add("restarts", restart)
+	composer.Add("settings", func(conn types.Connection, message *protobufs.AgentToServer, response *protobufs.ServerToAgent) {
+		response.RemoteConfig = &protobufs.AgentRemoteConfig{ConfigHash: []byte("second")}
+	})
+	// Setting the same value is not a conflict.
+	composer.Add("maintenance", restart)
+
+	response := composer.OnMessage(nil, &protobufs.AgentToServer{InstanceUid: "agent"})
+
+	// The value of the provider added first is sent.
+	assert.EqualValues(t, "first", response.RemoteConfig.ConfigHash)
+	assert.EqualValues(t, protobufs.CommandType_CommandType_Restart, response.Command.Type)
+	require.Len(t, conflicts, 1)
+	assert.True(t, errors.Is(conflicts[0], ErrResponseConflict))
+	assert.Contains(t, conflicts[0].Error(), "remote_config is set by config and settings")
+}
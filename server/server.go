@@ -2,10 +2,14 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
+	"time"
 
+	"github.com/open-telemetry/opamp-go/protobufs"
 	"github.com/open-telemetry/opamp-go/server/types"
 )
 
@@ -17,6 +21,104 @@ type Settings struct {
 	// the compression is only effectively enabled if the client also supports compression.
 	// The data will be compressed in both directions.
 	EnableCompression bool
+
+	// CompressionLevel is the flate compression level of the messages sent via
+	// WebSocket when the compression is enabled, from flate.HuffmanOnly (-2) to
+	// flate.BestCompression (9). 0 uses the default level (flate.BestSpeed).
+	CompressionLevel int
+
+	// AgentPolicy is evaluated on every message received from the Agents. Since
+	// the Agents send the AgentDescription only when it changes, the policy sees the
+	// last description the Agent reported; if the Server does not know it yet the
+	// Server asks the Agent to report its full state. If AgentPolicy returns an
+	// error the Agent is rejected: OnMessage is not called, the Server responds with
+	// a BadRequest ServerErrorResponse and, for WebSocket, closes the connection.
+	// Optional, if nil all Agents are accepted.
+	AgentPolicy AgentPolicy
+
+	// TenantQuotas tracks the usage of the Agents per tenant and enforces the
+	// tenants' quotas. Optional, if nil there are no quotas.
+	TenantQuotas *TenantQuotas
+
+	// BeforeSend is called with every ServerToAgent message just before it is sent
+	// to an Agent: the responses returned by OnMessage, the messages sent via
+	// Connection.Send and the responses that reject the Agents. It may modify the
+	// message, e.g. to add a fleet-wide command or to advertise custom capabilities.
+	// The message is a copy, the changes are only sent to the target Agent. The
+	// offers of connection settings with invalid headers are removed after it
+	// returns. May be called concurrently for different connections. Optional.
+	BeforeSend func(message *protobufs.ServerToAgent, target MessageTarget)
+
+	// WireCapture receives the frames of all messages the Server receives from and
+	// sends to the Agents over WebSocket and plain HTTP, e.g. to debug the
+	// interoperability with an OpAMP client that is not written in Go. The records
+	// have the format of the client's StartSettings.WireCapture (see the client/types
+	// package) and the credentials in the messages are redacted in the same way.
+	// The messages of the in-memory connections are not captured. Optional.
+	WireCapture io.Writer
+
+	// StrictSpecCompliance makes the Server reject the messages received from the
+	// Agents that violate the invariants of the OpAMP specification instead of
+	// processing them as far as possible, e.g. when testing an Agent implementation.
+	// OnMessage is not called for the rejected messages, the Server responds with a
+	// BadRequest ServerErrorResponse that describes the violations and keeps the
+	// connection open. The checked invariants are: instance_uid is set,
+	// capabilities has the ReportsStatus bit set and no bits undefined by the
+	// version of the specification implemented by this library, the package
+	// statuses are consistent with their names and states, and on the connections
+	// that carry more than one message, i.e. not plain HTTP, sequence_num is
+	// incremented by 1 for every message of the same instance and no message follows
+	// the one with agent_disconnect.
+	StrictSpecCompliance bool
+
+	// OnSpecViolation is called with the violations when a message is rejected
+	// because of StrictSpecCompliance. May be called concurrently for different
+	// connections. Optional.
+	OnSpecViolation func(conn types.Connection, message *protobufs.AgentToServer, violations []string)
+
+	// AckBatchWindow enables batching the empty acks sent over WebSocket, e.g. for
+	// the fleets that send frequent heartbeats. The responses that only carry the
+	// instance uid of the Agent are not urgent, the delivery of the Agent's message
+	// is already acknowledged by the transport. At most one of them is sent per
+	// window: if a message was sent to the Agent less than AckBatchWindow ago the ack
+	// is deferred to the end of the window and covers all the messages received
+	// meanwhile, it is dropped if another message is sent to the Agent before. The
+	// window must be shorter than the interval at which the Agents expect to hear
+	// from the Server, e.g. the watchdog interval of the client. The plain HTTP
+	// requests are always responded to. 0 disables the batching.
+	AckBatchWindow time.Duration
+
+	// ResponseSigningKey signs the ServerToAgent messages that change the Agents,
+	// i.e. carry a remote config, connection settings, available packages, an
+	// agent identification or a command, so that the Agents that are configured
+	// with the public key (see the client's StartSettings.ResponseVerificationKey)
+	// reject the messages altered on the way, e.g. by a compromised proxy.
+	//
+	// This is an opt-in extension of this library, not part of the OpAMP
+	// specification, and it does not interoperate with other implementations: the
+	// signature is sent in the ServerToAgent field 20000, which is not defined by
+	// the specification. Only the clients of this library verify it, the other
+	// clients ignore it. The signature covers only the instance uid, the remote
+	// config, the connection settings, the available packages, the agent
+	// identification and the command. Any other field, e.g. the flags, the
+	// capabilities or the error response, is not protected. The messages are
+	// signed after BeforeSend. Optional.
+	ResponseSigningKey ed25519.PrivateKey
+}
+
+// MessageTarget describes the Agent a ServerToAgent message is sent to, see
+// Settings.BeforeSend.
+type MessageTarget struct {
+	// Conn is the connection the message is sent over.
+	Conn types.Connection
+
+	// InstanceUid of the Agent, empty if the Server has not received a message on
+	// the connection yet.
+	InstanceUid string
+
+	// AgentDescription is the last description the Agent reported, nil if the
+	// Server does not know it.
+	AgentDescription *protobufs.AgentDescription
 }
 
 type StartSettings struct {
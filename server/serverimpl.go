@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/ed25519"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"google.golang.org/protobuf/proto"
@@ -19,7 +22,9 @@ import (
 )
 
 var (
-	errAlreadyStarted = errors.New("already started")
+	errAlreadyStarted         = errors.New("already started")
+	errNegativeAckBatchWindow = errors.New("AckBatchWindow must not be negative")
+	errInvalidSigningKey      = errors.New("ResponseSigningKey is not a valid Ed25519 private key")
 )
 
 const defaultOpAMPPath = "/v1/opamp"
@@ -39,6 +44,13 @@ type server struct {
 	// The listening HTTP Server after successful Start() call. Nil if Start()
 	// is not called or was not successful.
 	httpServer *http.Server
+
+	// The last AgentDescriptions of the plain HTTP Agents, for AgentPolicy.
+	httpAgentDescriptions agentDescriptions
+
+	// Records the messages received from and sent to the Agents. nil if the capture
+	// is not enabled.
+	wireCapture *internal.WireCapture
 }
 
 var _ OpAMPServer = (*server)(nil)
@@ -52,7 +64,17 @@ func New(logger types.Logger) *server {
 }
 
 func (s *server) Attach(settings Settings) (HTTPHandlerFunc, ConnContext, error) {
+	if err := internal.ValidateCompressionLevel(settings.CompressionLevel); err != nil {
+		return nil, nil, err
+	}
+	if settings.AckBatchWindow < 0 {
+		return nil, nil, errNegativeAckBatchWindow
+	}
+	if settings.ResponseSigningKey != nil && len(settings.ResponseSigningKey) != ed25519.PrivateKeySize {
+		return nil, nil, errInvalidSigningKey
+	}
 	s.settings = settings
+	s.wireCapture = internal.NewWireCapture(settings.WireCapture, s.logger)
 	s.wsUpgrader = websocket.Upgrader{
 		EnableCompression: settings.EnableCompression,
 	}
@@ -162,7 +184,7 @@ func (s *server) httpHandler(w http.ResponseWriter, req *http.Request) {
 
 	if req.Header.Get(headerContentType) == contentTypeProtobuf {
 		// Yes, a plain HTTP request.
-		s.handlePlainHTTPRequest(req, w, connectionCallbacks)
+		s.handlePlainHTTPRequest(req, w, connectionCallbacks, s.settings.TenantQuotas.connect(req, false))
 		return
 	}
 
@@ -175,13 +197,29 @@ func (s *server) httpHandler(w http.ResponseWriter, req *http.Request) {
 
 	// Return from this func to reduce memory usage.
 	// Handle the connection on a separate goroutine.
-	go s.handleWSConnection(conn, connectionCallbacks)
+	go s.handleWSConnection(conn, connectionCallbacks, s.settings.TenantQuotas.connect(req, true))
 }
 
-func (s *server) handleWSConnection(wsConn *websocket.Conn, connectionCallbacks serverTypes.ConnectionCallbacks) {
-	agentConn := wsConnection{wsConn: wsConn}
+func (s *server) handleWSConnection(
+	wsConn *websocket.Conn, connectionCallbacks serverTypes.ConnectionCallbacks, tenant *tenantConn,
+) {
+	agentConn := wsConnection{
+		wsConn:      wsConn,
+		sendMux:     &sync.Mutex{},
+		tenant:      tenant,
+		agent:       newAgentInfo(s.settings),
+		wireCapture: s.wireCapture,
+		acks:        newAckBatcher(s.settings.AckBatchWindow),
+	}
+	if s.settings.CompressionLevel != 0 {
+		// Validated by Attach. Has no effect if the Agent declined the compression.
+		_ = wsConn.SetCompressionLevel(s.settings.CompressionLevel)
+	}
 
 	defer func() {
+		tenant.close()
+		agentConn.acks.close()
+
 		// Close the connection when all is done.
 		defer func() {
 			err := wsConn.Close()
@@ -199,6 +237,11 @@ func (s *server) handleWSConnection(wsConn *websocket.Conn, connectionCallbacks
 		connectionCallbacks.OnConnected(agentConn)
 	}
 
+	// The last AgentDescription received on this connection, for AgentPolicy.
+	var agentDescription *protobufs.AgentDescription
+	// The last message received on this connection, for StrictSpecCompliance.
+	var previous *protobufs.AgentToServer
+
 	// Loop until fail to read from the WebSocket connection.
 	for {
 		// Block until the next message can be read.
@@ -221,15 +264,53 @@ func (s *server) handleWSConnection(wsConn *websocket.Conn, connectionCallbacks
 		var request protobufs.AgentToServer
 		err = internal.DecodeWSMessage(bytes, &request)
 		if err != nil {
+			s.wireCapture.Capture(internal.WireAgentToServer, internal.WireWebSocket, bytes, nil)
 			s.logger.Errorf("Cannot decode message from WebSocket: %v", err)
 			continue
 		}
+		s.wireCapture.Capture(internal.WireAgentToServer, internal.WireWebSocket, bytes, &request)
+
+		response := s.checkSpecCompliance(agentConn, &request, previous)
+		previous = &request
+		if response != nil {
+			if err := agentConn.Send(context.Background(), response); err != nil {
+				s.logger.Errorf("Cannot send message to WebSocket: %v", err)
+			}
+			continue
+		}
+
+		if request.AgentDescription != nil {
+			agentDescription = request.AgentDescription
+		}
+		agentConn.agent.update(&request, agentDescription)
+
+		if violation := tenant.received(&request, len(bytes), time.Now()); violation != nil {
+			if violation.wsCloseCode != 0 {
+				s.rejectWSAgent(agentConn, violation.response, violation.wsCloseCode, "tenant quota exceeded")
+				break
+			}
+			if err := agentConn.Send(context.Background(), violation.response); err != nil {
+				s.logger.Errorf("Cannot send message to WebSocket: %v", err)
+			}
+			continue
+		}
+
+		if response := s.checkAgentPolicy(&request, agentDescription); response != nil {
+			s.rejectWSAgent(agentConn, response, websocket.ClosePolicyViolation, "agent rejected by server policy")
+			break
+		}
 
 		if connectionCallbacks != nil {
 			response := connectionCallbacks.OnMessage(agentConn, &request)
 			if response.InstanceUid == "" {
 				response.InstanceUid = request.InstanceUid
 			}
+			s.sanitizeResponse(response)
+			s.requestUnknownDescription(response, agentDescription)
+			if agentConn.acks != nil && isEmptyAck(response) &&
+				agentConn.acks.deferAck(func() { s.sendDeferredAck(agentConn, response) }) {
+				continue
+			}
 			err = agentConn.Send(context.Background(), response)
 			if err != nil {
 				s.logger.Errorf("Cannot send message to WebSocket: %v", err)
@@ -238,6 +319,13 @@ func (s *server) handleWSConnection(wsConn *websocket.Conn, connectionCallbacks
 	}
 }
 
+// sendDeferredAck sends the empty ack deferred by Settings.AckBatchWindow.
+func (s *server) sendDeferredAck(conn wsConnection, ack *protobufs.ServerToAgent) {
+	if err := conn.Send(context.Background(), ack); err != nil {
+		s.logger.Debugf("Cannot send the deferred ack to WebSocket: %v", err)
+	}
+}
+
 func decompressGzip(data []byte) ([]byte, error) {
 	r, err := gzip.NewReader(bytes.NewBuffer(data))
 	if err != nil {
@@ -275,7 +363,9 @@ func compressGzip(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (s *server) handlePlainHTTPRequest(req *http.Request, w http.ResponseWriter, connectionCallbacks serverTypes.ConnectionCallbacks) {
+func (s *server) handlePlainHTTPRequest(
+	req *http.Request, w http.ResponseWriter, connectionCallbacks serverTypes.ConnectionCallbacks, tenant *tenantConn,
+) {
 	bytes, err := s.readReqBody(req)
 	if err != nil {
 		s.logger.Debugf("Cannot read HTTP body: %v", err)
@@ -287,20 +377,48 @@ func (s *server) handlePlainHTTPRequest(req *http.Request, w http.ResponseWriter
 	var request protobufs.AgentToServer
 	err = proto.Unmarshal(bytes, &request)
 	if err != nil {
+		s.wireCapture.Capture(internal.WireAgentToServer, internal.WirePlainHTTP, bytes, nil)
 		s.logger.Debugf("Cannot decode message from HTTP Body: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	s.wireCapture.Capture(internal.WireAgentToServer, internal.WirePlainHTTP, bytes, &request)
 
 	agentConn := httpConnection{
 		conn: connFromRequest(req),
 	}
+	agent := newAgentInfo(s.settings)
+	agent.update(&request, request.AgentDescription)
 
 	if connectionCallbacks == nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if response := s.checkSpecCompliance(agentConn, &request, nil); response != nil {
+		s.sendHTTPResponse(req, w, agentConn, agent, tenant, response)
+		return
+	}
+
+	if violation := tenant.received(&request, len(bytes), time.Now()); violation != nil {
+		if violation.httpStatus != 0 {
+			for k, v := range violation.httpHeader {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(violation.httpStatus)
+			return
+		}
+		s.sendHTTPResponse(req, w, agentConn, agent, tenant, violation.response)
+		return
+	}
+
+	agentDescription := s.httpAgentDescriptions.update(&request, time.Now())
+	agent.update(&request, agentDescription)
+	if response := s.checkAgentPolicy(&request, agentDescription); response != nil {
+		s.sendHTTPResponse(req, w, agentConn, agent, tenant, response)
+		return
+	}
+
 	connectionCallbacks.OnConnected(agentConn)
 
 	defer func() {
@@ -317,13 +435,39 @@ func (s *server) handlePlainHTTPRequest(req *http.Request, w http.ResponseWriter
 	if response.InstanceUid == "" {
 		response.InstanceUid = request.InstanceUid
 	}
+	s.requestUnknownDescription(response, agentDescription)
+	s.sendHTTPResponse(req, w, agentConn, agent, tenant, response)
+}
+
+// sendHTTPResponse writes the response modified by Settings.BeforeSend and signed
+// with Settings.ResponseSigningKey and accounts it to the tenant of the Agent.
+func (s *server) sendHTTPResponse(
+	req *http.Request,
+	w http.ResponseWriter,
+	agentConn httpConnection,
+	agent *agentInfo,
+	tenant *tenantConn,
+	response *protobufs.ServerToAgent,
+) {
+	response = agent.prepare(agentConn, response)
+	s.sanitizeResponse(response)
+	if err := agent.sign(response); err != nil {
+		s.logger.Errorf("Cannot sign the response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeHTTPResponse(req, w, response)
+	tenant.sent(response)
+}
 
+func (s *server) writeHTTPResponse(req *http.Request, w http.ResponseWriter, response *protobufs.ServerToAgent) {
 	// Marshal the response.
-	bytes, err = proto.Marshal(response)
+	bytes, err := proto.Marshal(response)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	s.wireCapture.Capture(internal.WireServerToAgent, internal.WirePlainHTTP, bytes, response)
 
 	// Send the response.
 	w.Header().Set(headerContentType, contentTypeProtobuf)
@@ -342,3 +486,58 @@ func (s *server) handlePlainHTTPRequest(req *http.Request, w http.ResponseWriter
 		s.logger.Debugf("Cannot send HTTP response: %v", err)
 	}
 }
+
+// sanitizeResponse canonicalizes the headers of the connection settings offers in
+// the response and removes the offers with invalid headers, so that the Agent does
+// not receive headers that could break its HTTP stack.
+func (s *server) sanitizeResponse(response *protobufs.ServerToAgent) {
+	internal.SanitizeConnectionSettingsOffers(response.ConnectionSettings, func(offer string, err error) {
+		s.logger.Errorf("Removing %s connection settings offer from the response: %v", offer, err)
+	})
+}
+
+// checkAgentPolicy evaluates the AgentPolicy for the message. The Agents send the
+// AgentDescription only when it changes, so the policy is evaluated with the last
+// known agentDescription if the message has none. Returns the response to send to
+// the Agent if the Agent is rejected, nil if it is accepted.
+func (s *server) checkAgentPolicy(
+	request *protobufs.AgentToServer, agentDescription *protobufs.AgentDescription,
+) *protobufs.ServerToAgent {
+	if s.settings.AgentPolicy == nil {
+		return nil
+	}
+	if request.AgentDescription == nil && agentDescription != nil {
+		request.AgentDescription = agentDescription
+		defer func() { request.AgentDescription = nil }()
+	}
+	if err := s.settings.AgentPolicy(request); err != nil {
+		s.logger.Debugf("Rejecting agent %s: %v", request.InstanceUid, err)
+		return rejectedAgentResponse(request, err)
+	}
+	return nil
+}
+
+// requestUnknownDescription asks the Agent to report its full state if the Server
+// does not know its AgentDescription yet, e.g. because the Server was restarted,
+// so that AgentPolicy can evaluate the description on the next message.
+func (s *server) requestUnknownDescription(
+	response *protobufs.ServerToAgent, agentDescription *protobufs.AgentDescription,
+) {
+	if s.settings.AgentPolicy != nil && agentDescription == nil {
+		response.Flags |= uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState)
+	}
+}
+
+// rejectWSAgent sends the rejection response to the Agent and closes the WebSocket
+// connection with the specified close code and reason.
+func (s *server) rejectWSAgent(agentConn wsConnection, response *protobufs.ServerToAgent, closeCode int, reason string) {
+	if err := agentConn.Send(context.Background(), response); err != nil {
+		s.logger.Errorf("Cannot send message to WebSocket: %v", err)
+		return
+	}
+	closeMsg := websocket.FormatCloseMessage(closeCode, reason)
+	deadline := time.Now().Add(time.Second)
+	if err := agentConn.wsConn.WriteControl(websocket.CloseMessage, closeMsg, deadline); err != nil {
+		s.logger.Debugf("Cannot send close message to WebSocket: %v", err)
+	}
+}
@@ -3,11 +3,14 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -408,6 +411,712 @@ func TestServerReceiveSendMessagePlainHTTP(t *testing.T) {
 	eventually(t, func() bool { return atomic.LoadInt32(&onCloseCalled) == 1 })
 }
 
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestServerWireCapture(t *testing.T) {
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					return &protobufs.ServerToAgent{
+						ConnectionSettings: RedirectOffer(
+							"wss://opamp-2.example.com/v1/opamp", http.Header{"Authorization": {"Bearer s3cr3t"}},
+						),
+					}
+				},
+			}}
+		},
+	}
+
+	// Start a Server.
+	var capture lockedBuffer
+	settings := &StartSettings{Settings: Settings{Callbacks: callbacks, WireCapture: &capture}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	// Send a message without the header to the Server.
+	conn, _, _ := dialClient(settings)
+	require.NotNil(t, conn)
+	defer conn.Close()
+	sent, err := proto.Marshal(&protobufs.AgentToServer{InstanceUid: "12345678"})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, sent))
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	var records []sharedinternal.WireRecord
+	eventually(t, func() bool {
+		records = nil
+		r := bytes.NewReader(capture.Bytes())
+		for {
+			record, err := sharedinternal.ReadWireRecord(r)
+			if err != nil {
+				return len(records) == 2
+			}
+			records = append(records, record)
+		}
+	})
+
+	// The received frame is captured as is.
+	assert.EqualValues(t, sharedinternal.WireAgentToServer, records[0].Direction)
+	assert.EqualValues(t, sharedinternal.WireWebSocket, records[0].Transport)
+	assert.EqualValues(t, sent, records[0].Frame)
+
+	// The credentials of the response are redacted.
+	assert.EqualValues(t, sharedinternal.WireServerToAgent, records[1].Direction)
+	assert.EqualValues(t, sharedinternal.WireRedacted, records[1].Flags)
+	assert.NotContains(t, string(records[1].Frame), "s3cr3t")
+	var response protobufs.ServerToAgent
+	require.NoError(t, sharedinternal.DecodeWSMessage(records[1].Frame, &response))
+	assert.EqualValues(t, "12345678", response.InstanceUid)
+	assert.EqualValues(t, "wss://opamp-2.example.com/v1/opamp", response.ConnectionSettings.Opamp.DestinationEndpoint)
+}
+
+func TestServerSanitizesConnectionSettingsHeaders(t *testing.T) {
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					return &protobufs.ServerToAgent{
+						ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+							Opamp: &protobufs.OpAMPConnectionSettings{
+								Headers: &protobufs.Headers{
+									Headers: []*protobufs.Header{{Key: "authorization", Value: "secret"}},
+								},
+							},
+							OwnMetrics: &protobufs.TelemetryConnectionSettings{
+								Headers: &protobufs.Headers{
+									Headers: []*protobufs.Header{{Key: "Host", Value: "evil.example.com"}},
+								},
+							},
+						},
+					}
+				},
+			}}
+		},
+	}
+
+	// Start a Server.
+	settings := &StartSettings{Settings: Settings{Callbacks: callbacks}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	// Send a message to the Server.
+	b, err := proto.Marshal(&protobufs.AgentToServer{InstanceUid: "12345678"})
+	require.NoError(t, err)
+	resp, err := http.Post("http://"+settings.ListenEndpoint+settings.ListenPath, contentTypeProtobuf, bytes.NewReader(b))
+	require.NoError(t, err)
+
+	b, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var response protobufs.ServerToAgent
+	require.NoError(t, proto.Unmarshal(b, &response))
+
+	// The header name is canonicalized and the offer with forbidden header is removed.
+	require.NotNil(t, response.ConnectionSettings.Opamp)
+	assert.Equal(t, "Authorization", response.ConnectionSettings.Opamp.Headers.Headers[0].Key)
+	assert.Nil(t, response.ConnectionSettings.OwnMetrics)
+}
+
+func TestServerSendDoesNotModifyMessage(t *testing.T) {
+	message := &protobufs.ServerToAgent{
+		ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+			Opamp: &protobufs.OpAMPConnectionSettings{
+				Headers: &protobufs.Headers{
+					Headers: []*protobufs.Header{{Key: "authorization", Value: "secret"}},
+				},
+			},
+		},
+	}
+	original := proto.Clone(message)
+
+	// The same message is sent to every connecting Agent.
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnConnectedFunc: func(conn types.Connection) {
+					assert.NoError(t, conn.Send(context.Background(), message))
+				},
+			}}
+		},
+	}
+
+	// Start a Server.
+	settings := &StartSettings{Settings: Settings{Callbacks: callbacks}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	for i := 0; i < 2; i++ {
+		conn, _, err := dialClient(settings)
+		require.NoError(t, err)
+
+		_, bytes, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var response protobufs.ServerToAgent
+		require.NoError(t, sharedinternal.DecodeWSMessage(bytes, &response))
+		_ = conn.Close()
+
+		// The sent message has the canonical header name.
+		assert.Equal(t, "Authorization", response.ConnectionSettings.Opamp.Headers.Headers[0].Key)
+	}
+
+	// The caller's message is left intact.
+	assert.True(t, proto.Equal(original, message))
+}
+
+func TestServerSendPreparedMessage(t *testing.T) {
+	var mux sync.Mutex
+	conns := map[string]types.Connection{}
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					mux.Lock()
+					defer mux.Unlock()
+					conns[message.InstanceUid] = conn
+					return &protobufs.ServerToAgent{}
+				},
+			}}
+		},
+	}
+
+	// Start a Server.
+	settings := &StartSettings{Settings: Settings{Callbacks: callbacks}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	// Connect two Agents and wait for the responses to their first messages.
+	agents := map[string]*websocket.Conn{}
+	for _, instanceUid := range []string{"agent-1", "agent-2"} {
+		conn, _, err := dialClient(settings)
+		require.NoError(t, err)
+		defer conn.Close()
+		bytes, err := proto.Marshal(&protobufs.AgentToServer{InstanceUid: instanceUid})
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, bytes))
+		_, _, err = conn.ReadMessage()
+		require.NoError(t, err)
+		agents[instanceUid] = conn
+	}
+
+	message := &protobufs.ServerToAgent{
+		InstanceUid: "template",
+		RemoteConfig: &protobufs.AgentRemoteConfig{
+			Config: &protobufs.AgentConfigMap{ConfigMap: map[string]*protobufs.AgentConfigFile{
+				"": {Body: []byte("receivers: {}")},
+			}},
+			ConfigHash: []byte("hash"),
+		},
+	}
+	original := proto.Clone(message)
+	prepared, err := PrepareMessage(message)
+	require.NoError(t, err)
+
+	for instanceUid, conn := range agents {
+		mux.Lock()
+		srvConn := conns[instanceUid]
+		mux.Unlock()
+		require.NoError(t, prepared.SendTo(context.Background(), srvConn))
+
+		_, bytes, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var received protobufs.ServerToAgent
+		require.NoError(t, sharedinternal.DecodeWSMessage(bytes, &received))
+
+		// Every Agent receives the message with its own instance uid.
+		assert.Equal(t, instanceUid, received.InstanceUid)
+		assert.True(t, proto.Equal(message.RemoteConfig, received.RemoteConfig))
+	}
+
+	// The caller's message is left intact.
+	assert.True(t, proto.Equal(original, message))
+}
+
+func TestPrepareMessageInvalidOffer(t *testing.T) {
+	_, err := PrepareMessage(&protobufs.ServerToAgent{
+		ConnectionSettings: &protobufs.ConnectionSettingsOffers{
+			Opamp: &protobufs.OpAMPConnectionSettings{
+				Headers: &protobufs.Headers{
+					Headers: []*protobufs.Header{{Key: "invalid header", Value: "value"}},
+				},
+			},
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestServerBatchesEmptyAcks(t *testing.T) {
+	var received int64
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					atomic.AddInt64(&received, 1)
+					return &protobufs.ServerToAgent{}
+				},
+			}}
+		},
+	}
+
+	// Start a Server.
+	window := 200 * time.Millisecond
+	settings := &StartSettings{Settings: Settings{Callbacks: callbacks, AckBatchWindow: window}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	conn, _, err := dialClient(settings)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Send heartbeats.
+	for i := 1; i <= 3; i++ {
+		bytes, err := proto.Marshal(&protobufs.AgentToServer{InstanceUid: "agent", SequenceNum: uint64(i)})
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, bytes))
+	}
+	eventually(t, func() bool { return atomic.LoadInt64(&received) == 3 })
+
+	// The first heartbeat is acknowledged right away, the others by one ack at the
+	// end of the window.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*window)))
+		_, bytes, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var ack protobufs.ServerToAgent
+		require.NoError(t, sharedinternal.DecodeWSMessage(bytes, &ack))
+		assert.Equal(t, "agent", ack.InstanceUid)
+	}
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*window)))
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err, "no more acks expected")
+}
+
+func TestServerAttachNegativeAckBatchWindow(t *testing.T) {
+	srv := New(&sharedinternal.NopLogger{})
+	_, _, err := srv.Attach(Settings{AckBatchWindow: -time.Second})
+	assert.ErrorIs(t, err, errNegativeAckBatchWindow)
+}
+
+func TestServerBeforeSend(t *testing.T) {
+	descr := &protobufs.AgentDescription{
+		IdentifyingAttributes: []*protobufs.KeyValue{{
+			Key:   "service.name",
+			Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: "agent"}},
+		}},
+	}
+	var targets int32
+	settings := &StartSettings{Settings: Settings{
+		Callbacks: CallbacksStruct{
+			OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+				return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{}}
+			},
+		},
+		// Restart every Agent that reported its description.
+		BeforeSend: func(message *protobufs.ServerToAgent, target MessageTarget) {
+			assert.NotNil(t, target.Conn)
+			assert.EqualValues(t, "12345678", target.InstanceUid)
+			if proto.Equal(descr, target.AgentDescription) {
+				atomic.AddInt32(&targets, 1)
+				message.Command = &protobufs.ServerToAgentCommand{Type: protobufs.CommandType_CommandType_Restart}
+			}
+		},
+	}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	// The Agent reports its description only in the first message.
+	requests := []*protobufs.AgentToServer{
+		{InstanceUid: "12345678", AgentDescription: descr},
+		{InstanceUid: "12345678", SequenceNum: 1},
+	}
+
+	t.Run("ws", func(t *testing.T) {
+		conn, _, err := dialClient(settings)
+		require.NoError(t, err)
+		defer conn.Close()
+		for _, request := range requests {
+			require.NoError(t, sharedinternal.WriteWSMessage(conn, request))
+			_, bytes, err := conn.ReadMessage()
+			require.NoError(t, err)
+			var response protobufs.ServerToAgent
+			require.NoError(t, sharedinternal.DecodeWSMessage(bytes, &response))
+			assert.EqualValues(t, protobufs.CommandType_CommandType_Restart, response.Command.GetType())
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		for _, request := range requests {
+			b, err := proto.Marshal(request)
+			require.NoError(t, err)
+			resp, err := http.Post("http://"+settings.ListenEndpoint+settings.ListenPath, contentTypeProtobuf, bytes.NewReader(b))
+			require.NoError(t, err)
+			b, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			var response protobufs.ServerToAgent
+			require.NoError(t, proto.Unmarshal(b, &response))
+			assert.EqualValues(t, protobufs.CommandType_CommandType_Restart, response.Command.GetType())
+		}
+	})
+
+	assert.EqualValues(t, 4, atomic.LoadInt32(&targets))
+}
+
+func TestServerAttachInvalidSigningKey(t *testing.T) {
+	srv := New(&sharedinternal.NopLogger{})
+	_, _, err := srv.Attach(Settings{ResponseSigningKey: []byte("key")})
+	assert.ErrorIs(t, err, errInvalidSigningKey)
+}
+
+func TestServerResponseSigning(t *testing.T) {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var returned []*protobufs.ServerToAgent
+	var mux sync.Mutex
+	settings := &StartSettings{Settings: Settings{
+		Callbacks: CallbacksStruct{
+			OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+				return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+					OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+						response := &protobufs.ServerToAgent{
+							InstanceUid:  message.InstanceUid,
+							RemoteConfig: &protobufs.AgentRemoteConfig{Config: &protobufs.AgentConfigMap{}, ConfigHash: []byte{1}},
+						}
+						mux.Lock()
+						returned = append(returned, response)
+						mux.Unlock()
+						return response
+					},
+				}}
+			},
+		},
+		ResponseSigningKey: key,
+	}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	request := &protobufs.AgentToServer{InstanceUid: "12345678"}
+
+	t.Run("ws", func(t *testing.T) {
+		conn, _, err := dialClient(settings)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, sharedinternal.WriteWSMessage(conn, request))
+		_, bytes, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var response protobufs.ServerToAgent
+		require.NoError(t, sharedinternal.DecodeWSMessage(bytes, &response))
+		assert.NoError(t, sharedinternal.VerifyServerToAgent(&response, publicKey))
+	})
+
+	t.Run("http", func(t *testing.T) {
+		b, err := proto.Marshal(request)
+		require.NoError(t, err)
+		resp, err := http.Post("http://"+settings.ListenEndpoint+settings.ListenPath, contentTypeProtobuf, bytes.NewReader(b))
+		require.NoError(t, err)
+		b, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		var response protobufs.ServerToAgent
+		require.NoError(t, proto.Unmarshal(b, &response))
+		assert.NoError(t, sharedinternal.VerifyServerToAgent(&response, publicKey))
+	})
+
+	// The messages returned by OnMessage are not modified.
+	mux.Lock()
+	defer mux.Unlock()
+	require.Len(t, returned, 2)
+	for _, response := range returned {
+		assert.Empty(t, response.ProtoReflect().GetUnknown())
+	}
+}
+
+func TestServerRejectsAgentByPolicy(t *testing.T) {
+	var msgCount int32
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					atomic.AddInt32(&msgCount, 1)
+					return &protobufs.ServerToAgent{InstanceUid: message.InstanceUid}
+				},
+			}}
+		},
+	}
+
+	// Start a Server that requires AcceptsRemoteConfig capability.
+	settings := &StartSettings{Settings: Settings{
+		Callbacks:   callbacks,
+		AgentPolicy: RequireCapabilities(protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig),
+	}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	sendMsg := protobufs.AgentToServer{
+		InstanceUid:  "12345678",
+		Capabilities: uint64(protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus),
+	}
+	b, err := proto.Marshal(&sendMsg)
+	require.NoError(t, err)
+
+	t.Run("websocket", func(t *testing.T) {
+		conn, _, err := dialClient(settings)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, b))
+
+		// The Server must respond with a permanent error.
+		_, bytes, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var response protobufs.ServerToAgent
+		require.NoError(t, sharedinternal.DecodeWSMessage(bytes, &response))
+		assert.EqualValues(t, sendMsg.InstanceUid, response.InstanceUid)
+		require.NotNil(t, response.ErrorResponse)
+		assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest, response.ErrorResponse.Type)
+
+		// And close the connection.
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+	})
+
+	t.Run("plain http", func(t *testing.T) {
+		resp, err := http.Post("http://"+settings.ListenEndpoint+settings.ListenPath, contentTypeProtobuf, bytes.NewReader(b))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		var response protobufs.ServerToAgent
+		require.NoError(t, proto.Unmarshal(body, &response))
+		require.NotNil(t, response.ErrorResponse)
+		assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest, response.ErrorResponse.Type)
+	})
+
+	// OnMessage must never be called for the rejected Agent.
+	assert.EqualValues(t, 0, atomic.LoadInt32(&msgCount))
+}
+
+func TestServerStrictSpecCompliance(t *testing.T) {
+	var msgCount, violationCount int32
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					atomic.AddInt32(&msgCount, 1)
+					return &protobufs.ServerToAgent{InstanceUid: message.InstanceUid}
+				},
+			}}
+		},
+	}
+	var violations atomic.Value
+	settings := &StartSettings{Settings: Settings{
+		Callbacks:            callbacks,
+		StrictSpecCompliance: true,
+		OnSpecViolation: func(conn types.Connection, message *protobufs.AgentToServer, v []string) {
+			atomic.AddInt32(&violationCount, 1)
+			violations.Store(v)
+		},
+	}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	capabilities := uint64(protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus)
+
+	t.Run("websocket", func(t *testing.T) {
+		conn, _, err := dialClient(settings)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		exchange := func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+			require.NoError(t, sharedinternal.WriteWSMessage(conn, msg))
+			_, bytes, err := conn.ReadMessage()
+			require.NoError(t, err)
+			var response protobufs.ServerToAgent
+			require.NoError(t, sharedinternal.DecodeWSMessage(bytes, &response))
+			return &response
+		}
+
+		// A compliant message is passed to OnMessage.
+		response := exchange(&protobufs.AgentToServer{InstanceUid: "agent1", SequenceNum: 1, Capabilities: capabilities})
+		assert.Nil(t, response.ErrorResponse)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&msgCount))
+
+		// The sequence_num must be incremented by 1, the rejected message does not
+		// close the connection.
+		response = exchange(&protobufs.AgentToServer{InstanceUid: "agent1", SequenceNum: 3, Capabilities: capabilities})
+		require.NotNil(t, response.ErrorResponse)
+		assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest, response.ErrorResponse.Type)
+		assert.Contains(t, response.ErrorResponse.ErrorMessage, "sequence_num 3 does not follow")
+		assert.EqualValues(t, []string{"sequence_num 3 does not follow the previous sequence_num 1"}, violations.Load())
+
+		response = exchange(&protobufs.AgentToServer{InstanceUid: "agent1", SequenceNum: 4, Capabilities: capabilities})
+		assert.Nil(t, response.ErrorResponse)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&msgCount))
+		assert.EqualValues(t, 1, atomic.LoadInt32(&violationCount))
+	})
+
+	t.Run("plain http", func(t *testing.T) {
+		// The ReportsStatus capability is missing.
+		b, err := proto.Marshal(&protobufs.AgentToServer{InstanceUid: "agent2"})
+		require.NoError(t, err)
+		resp, err := http.Post("http://"+settings.ListenEndpoint+settings.ListenPath, contentTypeProtobuf, bytes.NewReader(b))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		var response protobufs.ServerToAgent
+		require.NoError(t, proto.Unmarshal(body, &response))
+		require.NotNil(t, response.ErrorResponse)
+		assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest, response.ErrorResponse.Type)
+		assert.EqualValues(t, []string{"the ReportsStatus bit of capabilities is not set"}, violations.Load())
+	})
+
+	assert.EqualValues(t, 2, atomic.LoadInt32(&violationCount))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&msgCount))
+}
+
+func TestServerRejectsBlockedHTTPAgentOnEveryRequest(t *testing.T) {
+	var msgCount int32
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					atomic.AddInt32(&msgCount, 1)
+					return &protobufs.ServerToAgent{InstanceUid: message.InstanceUid}
+				},
+			}}
+		},
+	}
+	settings := &StartSettings{Settings: Settings{
+		Callbacks:   callbacks,
+		AgentPolicy: BlockAgents(map[string][]string{"collector": {"0.1.0"}}),
+	}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	post := func(msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+		b, err := proto.Marshal(msg)
+		require.NoError(t, err)
+		resp, err := http.Post("http://"+settings.ListenEndpoint+settings.ListenPath, contentTypeProtobuf, bytes.NewReader(b))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		var response protobufs.ServerToAgent
+		require.NoError(t, proto.Unmarshal(body, &response))
+		return &response
+	}
+
+	// The first request carries the description and is rejected.
+	blocked := agentMessage(0, "collector", "0.1.0")
+	blocked.InstanceUid = "blocked"
+	require.NotNil(t, post(blocked).ErrorResponse)
+
+	// The next poll has no description but the Agent is still rejected.
+	require.NotNil(t, post(&protobufs.AgentToServer{InstanceUid: "blocked"}).ErrorResponse)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&msgCount))
+
+	// An Agent with unknown description is asked to report its full state.
+	response := post(&protobufs.AgentToServer{InstanceUid: "unknown"})
+	require.Nil(t, response.ErrorResponse)
+	assert.NotZero(t, response.Flags&uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState))
+}
+
+func TestServerEnforcesTenantQuotas(t *testing.T) {
+	var msgCount int32
+	callbacks := CallbacksStruct{
+		OnConnectingFunc: func(request *http.Request) types.ConnectionResponse {
+			return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ConnectionCallbacksStruct{
+				OnMessageFunc: func(conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+					atomic.AddInt32(&msgCount, 1)
+					return &protobufs.ServerToAgent{InstanceUid: message.InstanceUid}
+				},
+			}}
+		},
+	}
+	quotas := NewTenantQuotas(TenantQuotasSettings{
+		TenantOf:     func(req *http.Request) string { return req.URL.Query().Get("tenant") },
+		DefaultQuota: Quota{MaxAgents: 1, MaxMessagesPerSecond: 1},
+	})
+	settings := &StartSettings{Settings: Settings{Callbacks: callbacks, TenantQuotas: quotas}}
+	srv := startServer(t, settings)
+	defer srv.Stop(context.Background())
+
+	dial := func(tenant string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+settings.ListenEndpoint+settings.ListenPath+"?tenant="+tenant, nil)
+		require.NoError(t, err)
+		return conn
+	}
+	exchange := func(conn *websocket.Conn, instanceUid string) *protobufs.ServerToAgent {
+		b, err := proto.Marshal(&protobufs.AgentToServer{InstanceUid: instanceUid})
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, b))
+		_, bytes, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var response protobufs.ServerToAgent
+		require.NoError(t, sharedinternal.DecodeWSMessage(bytes, &response))
+		return &response
+	}
+
+	first := dial("a")
+	defer first.Close()
+	require.Nil(t, exchange(first, "1").ErrorResponse)
+
+	// The next message exceeds the rate and is throttled without closing the connection.
+	response := exchange(first, "1")
+	require.NotNil(t, response.ErrorResponse)
+	assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable, response.ErrorResponse.Type)
+	assert.NotZero(t, response.ErrorResponse.GetRetryInfo().RetryAfterNanoseconds)
+
+	// A second Agent of the tenant is rejected and disconnected.
+	second := dial("a")
+	defer second.Close()
+	response = exchange(second, "2")
+	require.NotNil(t, response.ErrorResponse)
+	assert.EqualValues(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest, response.ErrorResponse.Type)
+	_, _, err := second.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+
+	// The Agent of another tenant is accepted.
+	other := dial("b")
+	defer other.Close()
+	require.Nil(t, exchange(other, "3").ErrorResponse)
+
+	assert.EqualValues(t, 2, atomic.LoadInt32(&msgCount))
+	usage := quotas.Usage()
+	require.Len(t, usage, 2)
+	assert.EqualValues(t, 1, usage[0].ConnectedAgents)
+	assert.EqualValues(t, 3, usage[0].MessagesSent)
+	assert.EqualValues(t, 1, usage[0].RateLimitedMessages)
+	assert.EqualValues(t, 1, usage[0].RejectedAgents)
+	assert.NotZero(t, usage[0].BytesSent)
+	assert.EqualValues(t, 1, usage[1].MessagesReceived)
+}
+
+func TestServerAttachInvalidCompressionLevel(t *testing.T) {
+	srv := New(&sharedinternal.NopLogger{})
+	_, _, err := srv.Attach(Settings{EnableCompression: true, CompressionLevel: -3})
+	assert.Error(t, err)
+}
+
 func TestServerAttachAcceptConnection(t *testing.T) {
 	connectedCalled := int32(0)
 	connectionCloseCalled := int32(0)
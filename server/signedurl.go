@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query parameters added to the signed URLs.
+const (
+	signedURLAgentParam     = "agent"
+	signedURLExpiresParam   = "expires"
+	signedURLSignatureParam = "signature"
+)
+
+var (
+	errSignedURLMissingParams = errors.New("signed URL parameters are missing")
+	errSignedURLExpired       = errors.New("signed URL has expired")
+	errSignedURLInvalid       = errors.New("signed URL signature is invalid")
+)
+
+// URLSigner generates time-limited signed URLs for downloadable files hosted by the
+// Server, e.g. the package files offered to the Agents in PackagesAvailable messages,
+// and verifies the signature when the files are requested. This allows the Server to
+// hand out a download URL to a particular Agent without making the file publicly
+// fetchable.
+type URLSigner struct {
+	key []byte
+	now func() time.Time
+}
+
+// NewURLSigner creates a URLSigner that signs the URLs using HMAC-SHA256 with the
+// specified secret key. The key must be kept secret by the Server.
+func NewURLSigner(key []byte) *URLSigner {
+	return &URLSigner{key: key, now: time.Now}
+}
+
+// Sign returns a copy of rawURL that is valid for the duration of ttl and is bound
+// to the Agent with the specified instanceUid.
+func (s *URLSigner) Sign(rawURL string, instanceUid string, ttl time.Duration) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(s.now().Add(ttl).Unix(), 10)
+
+	query := u.Query()
+	query.Set(signedURLAgentParam, instanceUid)
+	query.Set(signedURLExpiresParam, expires)
+	query.Set(signedURLSignatureParam, s.signature(u.Path, instanceUid, expires))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Verify checks that the request URL was signed by this URLSigner and has not
+// expired. Returns the instanceUid of the Agent the URL was signed for.
+func (s *URLSigner) Verify(u *url.URL) (instanceUid string, err error) {
+	query := u.Query()
+	instanceUid = query.Get(signedURLAgentParam)
+	expires := query.Get(signedURLExpiresParam)
+	signature := query.Get(signedURLSignatureParam)
+	if instanceUid == "" || expires == "" || signature == "" {
+		return "", errSignedURLMissingParams
+	}
+
+	expected := s.signature(u.Path, instanceUid, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", errSignedURLInvalid
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", errSignedURLInvalid
+	}
+	if s.now().Unix() > expiresAt {
+		return "", errSignedURLExpired
+	}
+
+	return instanceUid, nil
+}
+
+// Handler returns an http.Handler that only passes the requests with valid signed
+// URLs to next. Other requests are rejected with 403 Forbidden status.
+func (s *URLSigner) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.Verify(r.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *URLSigner) signature(path string, instanceUid string, expires string) string {
+	mac := hmac.New(sha256.New, s.key)
+	// Use separators that cannot appear in the values to make the encoding unambiguous.
+	mac.Write([]byte(path))
+	mac.Write([]byte{0})
+	mac.Write([]byte(instanceUid))
+	mac.Write([]byte{0})
+	mac.Write([]byte(expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestURLSigner(t *testing.T) {
+	signer := NewURLSigner([]byte("secret"))
+
+	signed, err := signer.Sign("https://example.com/packages/agent.tar.gz", "agent1", time.Minute)
+	require.NoError(t, err)
+
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	instanceUid, err := signer.Verify(u)
+	require.NoError(t, err)
+	assert.EqualValues(t, "agent1", instanceUid)
+
+	// A different key must not accept the URL.
+	_, err = NewURLSigner([]byte("other")).Verify(u)
+	assert.ErrorIs(t, err, errSignedURLInvalid)
+
+	// The URL must not be usable for another Agent or another file.
+	tampered := *u
+	query := tampered.Query()
+	query.Set(signedURLAgentParam, "agent2")
+	tampered.RawQuery = query.Encode()
+	_, err = signer.Verify(&tampered)
+	assert.ErrorIs(t, err, errSignedURLInvalid)
+
+	tampered = *u
+	tampered.Path = "/packages/other.tar.gz"
+	_, err = signer.Verify(&tampered)
+	assert.ErrorIs(t, err, errSignedURLInvalid)
+
+	// Unsigned URL.
+	u, err = url.Parse("https://example.com/packages/agent.tar.gz")
+	require.NoError(t, err)
+	_, err = signer.Verify(u)
+	assert.ErrorIs(t, err, errSignedURLMissingParams)
+}
+
+func TestURLSignerExpired(t *testing.T) {
+	signer := NewURLSigner([]byte("secret"))
+
+	signed, err := signer.Sign("/file", "agent1", time.Minute)
+	require.NoError(t, err)
+
+	signer.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	_, err = signer.Verify(u)
+	assert.ErrorIs(t, err, errSignedURLExpired)
+}
+
+func TestURLSignerHandler(t *testing.T) {
+	signer := NewURLSigner([]byte("secret"))
+	handler := signer.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	signed, err := signer.Sign("/file", "agent1", time.Minute)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, signed, nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+	assert.EqualValues(t, http.StatusForbidden, w.Code)
+}
+
+func TestURLSignerFileServer(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "agent.tar.gz"), []byte("agent"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.tar.gz"), []byte("other"), 0600))
+
+	// Serve the files the same way as the example Server serves the package files.
+	signer := NewURLSigner([]byte("secret"))
+	srv := httptest.NewServer(signer.Handler(http.StripPrefix("/packages/", http.FileServer(http.Dir(dir)))))
+	defer srv.Close()
+
+	get := func(rawURL string) (int, string) {
+		resp, err := http.Get(rawURL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	signed, err := signer.Sign(srv.URL+"/packages/agent.tar.gz", "agent1", time.Minute)
+	require.NoError(t, err)
+	status, body := get(signed)
+	assert.EqualValues(t, http.StatusOK, status)
+	assert.EqualValues(t, "agent", body)
+
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	tamper := func(modify func(u *url.URL, query url.Values)) string {
+		tampered := *u
+		query := tampered.Query()
+		modify(&tampered, query)
+		tampered.RawQuery = query.Encode()
+		return tampered.String()
+	}
+
+	tamperedURLs := map[string]string{
+		"unsigned": srv.URL + "/packages/agent.tar.gz",
+		"other file": tamper(func(u *url.URL, _ url.Values) {
+			u.Path = "/packages/other.tar.gz"
+		}),
+		"other agent": tamper(func(_ *url.URL, query url.Values) {
+			query.Set(signedURLAgentParam, "agent2")
+		}),
+		"extended expiry": tamper(func(_ *url.URL, query url.Values) {
+			query.Set(signedURLExpiresParam, "99999999999")
+		}),
+	}
+	for name, tampered := range tamperedURLs {
+		status, body := get(tampered)
+		assert.EqualValues(t, http.StatusForbidden, status, name)
+		assert.NotContains(t, body, "agent", name)
+	}
+
+	signer.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	status, _ = get(signed)
+	assert.EqualValues(t, http.StatusForbidden, status, "expired")
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/open-telemetry/opamp-go/internal"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+)
+
+// checkSpecCompliance checks the message against the invariants of the OpAMP
+// specification if Settings.StrictSpecCompliance is set. previous is the message
+// received before on the same connection, nil if there is none. Returns the response
+// to send to the Agent if the message is rejected, nil if it is accepted.
+func (s *server) checkSpecCompliance(
+	conn types.Connection, request, previous *protobufs.AgentToServer,
+) *protobufs.ServerToAgent {
+	if !s.settings.StrictSpecCompliance {
+		return nil
+	}
+	violations := internal.AgentToServerViolations(request, previous)
+	if len(violations) == 0 {
+		return nil
+	}
+	description := strings.Join(violations, "; ")
+	s.logger.Debugf("Rejecting the message of agent %s, it violates the OpAMP specification: %s",
+		request.InstanceUid, description)
+	if s.settings.OnSpecViolation != nil {
+		s.settings.OnSpecViolation(conn, request, violations)
+	}
+	return &protobufs.ServerToAgent{
+		InstanceUid: request.InstanceUid,
+		ErrorResponse: &protobufs.ServerErrorResponse{
+			Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest,
+			ErrorMessage: "message violates the OpAMP specification: " + description,
+		},
+	}
+}
@@ -13,7 +13,8 @@ type Connection interface {
 	// RemoteAddr returns the remote network address of the connection.
 	RemoteAddr() net.Addr
 
-	// Send a message. Should not be called concurrently for the same Connection instance.
+	// Send a message. Safe to call concurrently with the responses the Server sends
+	// for the same Connection instance.
 	// Can be called only for WebSocket connections. Will return an error for plain HTTP
 	// connections.
 	// Blocks until the message is sent.
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CompareVersions compares the versions a and b in the form "v1.2.3-pre+build" and
+// returns -1, 0 or 1 if a is respectively lower than, equal to or greater than b.
+//
+// The precedence follows Semantic Versioning: the dot-separated release components
+// are compared numerically, missing components are treated as 0 (i.e. "1.2" equals
+// "1.2.0") and a pre-release is lower than the release. The dot-separated pre-release
+// identifiers are compared one by one, numerically if both are numeric, otherwise
+// lexically, and numeric identifiers are lower than non-numeric ones, e.g.
+// "1.0.0-rc.9" < "1.0.0-rc.10" < "1.0.0-rc.a". Build metadata is ignored.
+func CompareVersions(a, b string) int {
+	aRelease, aPre := splitVersion(a)
+	bRelease, bPre := splitVersion(b)
+
+	aParts := strings.Split(aRelease, ".")
+	bParts := strings.Split(bRelease, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		if c := compareVersionParts(versionPart(aParts, i), versionPart(bParts, i)); c != 0 {
+			return c
+		}
+	}
+
+	// A pre-release is lower than the release.
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return comparePreReleases(aPre, bPre)
+}
+
+func splitVersion(version string) (release string, preRelease string) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	// Build metadata does not affect the precedence.
+	if i := strings.IndexByte(version, '+'); i >= 0 {
+		version = version[:i]
+	}
+	if i := strings.IndexByte(version, '-'); i >= 0 {
+		return version[:i], version[i+1:]
+	}
+	return version, ""
+}
+
+func versionPart(parts []string, i int) string {
+	if i < len(parts) {
+		return parts[i]
+	}
+	return "0"
+}
+
+func compareVersionParts(a, b string) int {
+	aNum, aErr := strconv.ParseUint(a, 10, 64)
+	bNum, bErr := strconv.ParseUint(b, 10, 64)
+	if aErr == nil && bErr == nil {
+		return compareUints(aNum, bNum)
+	}
+	return strings.Compare(a, b)
+}
+
+// comparePreReleases compares the dot-separated pre-release identifiers. A larger set
+// of identifiers is greater if all the preceding identifiers are equal.
+func comparePreReleases(a, b string) int {
+	aIds := strings.Split(a, ".")
+	bIds := strings.Split(b, ".")
+	for i := 0; i < len(aIds) && i < len(bIds); i++ {
+		aNum, aErr := strconv.ParseUint(aIds[i], 10, 64)
+		bNum, bErr := strconv.ParseUint(bIds[i], 10, 64)
+		var c int
+		switch {
+		case aErr == nil && bErr == nil:
+			c = compareUints(aNum, bNum)
+		case aErr == nil:
+			// Numeric identifiers are lower than non-numeric ones.
+			c = -1
+		case bErr == nil:
+			c = 1
+		default:
+			c = strings.Compare(aIds[i], bIds[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareUints(uint64(len(aIds)), uint64(len(bIds)))
+}
+
+func compareUints(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, CompareVersions("1.0", "1.0.0"))
+	assert.Equal(t, 0, CompareVersions("v1.0.0+build1", "1.0.0+build2"))
+	assert.Equal(t, -1, CompareVersions("1.9", "1.10"))
+	assert.Equal(t, 1, CompareVersions("1.0.0", "1.0.0-rc1"))
+	assert.Equal(t, -1, CompareVersions("1.0.0-alpha", "1.0.0-beta"))
+
+	// Pre-release precedence example from the Semantic Versioning specification.
+	ordered := []string{
+		"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2",
+		"1.0.0-beta.11", "1.0.0-rc.1", "1.0.0",
+	}
+	for i := 1; i < len(ordered); i++ {
+		assert.Equal(t, -1, CompareVersions(ordered[i-1], ordered[i]), "%s < %s", ordered[i-1], ordered[i])
+		assert.Equal(t, 1, CompareVersions(ordered[i], ordered[i-1]), "%s > %s", ordered[i], ordered[i-1])
+	}
+	assert.Equal(t, -1, CompareVersions("1.0.0-rc.9", "1.0.0-rc.10"))
+}
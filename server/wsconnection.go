@@ -2,9 +2,12 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"sync"
 
 	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/open-telemetry/opamp-go/internal"
 	"github.com/open-telemetry/opamp-go/protobufs"
@@ -14,6 +17,17 @@ import (
 // wsConnection represents a persistent OpAMP connection over a WebSocket.
 type wsConnection struct {
 	wsConn *websocket.Conn
+	// Serializes the writes of the responses and of the messages sent by the user.
+	sendMux *sync.Mutex
+	// Accounts the sent messages to the tenant of the Agent, nil if the quotas are
+	// not enabled.
+	tenant *tenantConn
+	// The Agent the messages are sent to, for Settings.BeforeSend.
+	agent *agentInfo
+	// Records the sent messages. nil if the capture is not enabled.
+	wireCapture *internal.WireCapture
+	// Batches the empty acks, nil if the batching is not enabled.
+	acks *ackBatcher
 }
 
 var _ types.Connection = (*wsConnection)(nil)
@@ -25,8 +39,65 @@ func (c wsConnection) RemoteAddr() net.Addr {
 // Message header is currently uint64 zero value.
 const wsMsgHeader = uint64(0)
 
+// Send sends the message. The message is modified by Settings.BeforeSend, the
+// header names of the connection settings offers are canonicalized and the
+// message is signed with Settings.ResponseSigningKey in the sent message. The
+// message itself is not modified, so the same message can be sent to several
+// connections concurrently. Returns an error and does not send the message if any
+// of the offers has invalid headers.
 func (c wsConnection) Send(_ context.Context, message *protobufs.ServerToAgent) error {
-	return internal.WriteWSMessage(c.wsConn, message)
+	if prepared := c.agent.prepare(c, message); prepared != message {
+		message = prepared
+	} else if message.ConnectionSettings != nil {
+		message = proto.Clone(message).(*protobufs.ServerToAgent)
+	}
+
+	var invalidErr error
+	internal.SanitizeConnectionSettingsOffers(message.ConnectionSettings, func(offer string, err error) {
+		invalidErr = fmt.Errorf("invalid %s connection settings offer: %w", offer, err)
+	})
+	if invalidErr != nil {
+		return invalidErr
+	}
+	if err := c.agent.sign(message); err != nil {
+		return err
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	c.sendMux.Lock()
+	defer c.sendMux.Unlock()
+	if err := internal.WriteWSMessageBytes(c.wsConn, data); err != nil {
+		return err
+	}
+	c.wireCapture.CaptureWSData(internal.WireServerToAgent, data, message)
+	c.tenant.sent(message)
+	c.acks.sent()
+	return nil
+}
+
+// sendPrepared sends the marshaled message with the instance uid of the Agent
+// appended, see PreparedMessage.SendTo.
+func (c wsConnection) sendPrepared(ctx context.Context, message *PreparedMessage) error {
+	instanceUid := c.agent.currentInstanceUid()
+	if c.agent.modifiesMessages() {
+		return c.Send(ctx, message.forInstance(instanceUid))
+	}
+
+	patch := message.instanceUidPatch(instanceUid)
+	c.sendMux.Lock()
+	defer c.sendMux.Unlock()
+	if err := internal.WriteWSMessageBytes(c.wsConn, message.data, patch); err != nil {
+		return err
+	}
+	if c.wireCapture != nil {
+		data := append(append([]byte(nil), message.data...), patch...)
+		c.wireCapture.CaptureWSData(internal.WireServerToAgent, data, message.forInstance(instanceUid))
+	}
+	c.tenant.sentBytes(len(message.data) + len(patch))
+	c.acks.sent()
+	return nil
 }
 
 func (c wsConnection) Disconnect() error {